@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// adminJSON is a control API request to send an admin command to a
+// managed peer
+type adminJSON struct {
+	Peer    string          `json:"peer"`
+	Command string          `json:"command"`
+	Args    json.RawMessage `json:"args,omitempty"`
+}
+
+// runAdmin implements the "admin" subcommand
+// It has the running peer, which holds the operator's -admin-key, send an
+// admin command to a peer it manages: "status" reports the peer's state,
+// "limits" changes its bandwidth caps and "sync" has it sync a channel
+func runAdmin(args []string) {
+	usage := "usage: admin -peer ADDR status | limits [-max-upload R] [-max-download R] | sync -channel NAME -publisher KEY -from ADDRS"
+	fs := flag.NewFlagSet("admin", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	target := fs.String("peer", "", "Address of the managed peer")
+	fs.Parse(args)
+	if *target == "" || fs.NArg() == 0 {
+		log.Fatal(usage)
+	}
+
+	cmd := flag.NewFlagSet("admin "+fs.Arg(0), flag.ExitOnError)
+	req := adminJSON{Peer: *target, Command: fs.Arg(0)}
+	var body interface{}
+	switch fs.Arg(0) {
+	case peer.AdminStatus:
+		cmd.Parse(fs.Args()[1:])
+	case peer.AdminLimits:
+		maxUpload := cmd.String("max-upload", "", "Total upload rate per second, e.g. 10MB; 0 for unlimited")
+		maxDownload := cmd.String("max-download", "", "Total download rate per second; 0 for unlimited")
+		cmd.Parse(fs.Args()[1:])
+		var limits peer.AdminLimitsArgs
+		if *maxUpload != "" {
+			n, err := rateValue(*maxUpload)
+			if err != nil {
+				log.Fatalf("Invalid -max-upload: %v", err)
+			}
+			limits.Upload = &n
+		}
+		if *maxDownload != "" {
+			n, err := rateValue(*maxDownload)
+			if err != nil {
+				log.Fatalf("Invalid -max-download: %v", err)
+			}
+			limits.Download = &n
+		}
+		body = limits
+	case peer.AdminSync:
+		channel := cmd.String("channel", "", "Name of the channel to sync")
+		publisher := cmd.String("publisher", "", "Publisher key of the channel")
+		from := cmd.String("from", "", "Comma-separated addresses of the peers offering the channel, as the managed peer reaches them")
+		cmd.Parse(fs.Args()[1:])
+		if *channel == "" || *publisher == "" || *from == "" {
+			log.Fatal(usage)
+		}
+		body = peer.AdminSyncArgs{Channel: *channel, Publisher: *publisher, Peers: strings.Split(*from, ",")}
+	default:
+		log.Fatal(usage)
+	}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			log.Fatal(err)
+		}
+		req.Args = data
+	}
+
+	var status peer.AdminStatusResult
+	var out interface{} = &status
+	if req.Command == peer.AdminSync {
+		out = nil
+	}
+	if err := controlRequest(*addr, http.MethodPost, "/admin", req, out); err != nil {
+		log.Fatal(err)
+	}
+	if req.Command == peer.AdminSync {
+		fmt.Printf("Peer %s started syncing channel %s\n", *target, body.(peer.AdminSyncArgs).Channel)
+		return
+	}
+
+	rate := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return formatSize(n) + "/s"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Peer:\t%s at %s\n", status.ID, status.Addr)
+	fmt.Fprintf(w, "Features:\t%s\n", strings.Join(status.Features, ", "))
+	fmt.Fprintf(w, "Known peers:\t%d\n", status.Peers)
+	fmt.Fprintf(w, "Limits:\tupload %s, download %s\n", rate(status.Upload), rate(status.Download))
+	fmt.Fprintf(w, "Shared:\t%d files, %s\n", status.Disk.SharedFiles, formatSize(status.Disk.SharedBytes))
+	fmt.Fprintf(w, "Received:\t%d files, %s\n", status.Disk.ReceivedFiles, formatSize(status.Disk.ReceivedBytes))
+	fmt.Fprintf(w, "Transfers:\t%d active\n", len(status.Transfers))
+	for _, t := range status.Transfers {
+		fmt.Fprintf(w, "\t%s %s %s: %s of %s\n", t.Direction, t.FileName, t.Peer, formatSize(t.Done), formatSize(t.Size))
+	}
+	w.Flush()
+}
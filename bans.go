@@ -0,0 +1,45 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+// runBans implements the "bans" subcommand
+// It lists the hosts the running peer has banned for misbehaving, or lifts
+// the ban on one
+func runBans(args []string) {
+	fs := flag.NewFlagSet("bans", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	unban := fs.String("unban", "", "Host whose ban to lift, e.g. 10.0.0.7")
+	fs.Parse(args)
+
+	if *unban != "" {
+		if err := controlRequest(*addr, http.MethodDelete, "/bans?host="+url.QueryEscape(*unban), nil, nil); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Lifted the ban on %s\n", *unban)
+		return
+	}
+
+	var bans []banJSON
+	if err := controlRequest(*addr, http.MethodGet, "/bans", nil, &bans); err != nil {
+		log.Fatal(err)
+	}
+	if len(bans) == 0 {
+		fmt.Println("No hosts banned")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tOFFENSE\tBAN\tSINCE\tREMAINING")
+	for _, b := range bans {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", b.Host, b.Offense, b.Count, b.Since.Format("2006-01-02 15:04:05"), time.Until(b.Until).Round(time.Second))
+	}
+	w.Flush()
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// Exit codes of -batch runs; log.Fatal's 1 stays for usage and startup errors
+const (
+	exitAllOK   = 0 // Every file was received, or there were none
+	exitPartial = 2 // Some files were received and some weren't
+	exitFailed  = 3 // No file was received, or the batch couldn't start
+)
+
+// batchSummary is the JSON summary a -batch run prints on standard output
+type batchSummary struct {
+	Status string        `json:"status"` // "ok", "partial" or "failed"
+	Total  int           `json:"total"`
+	OK     int           `json:"ok"`
+	Failed int           `json:"failed"`
+	Error  string        `json:"error,omitempty"` // Why the batch stopped before trying every file
+	Files  []batchResult `json:"files"`
+}
+
+// batchResult is the outcome of one file in a batchSummary
+type batchResult struct {
+	Name  string `json:"name"`
+	Path  string `json:"path,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// summarize aggregates per-file results into a summary and its exit code
+// err: Why the batch stopped early, nil if every file was tried
+func summarize(results []peer.FileResult, err error) (batchSummary, int) {
+	s := batchSummary{Total: len(results), Files: []batchResult{}}
+	for _, r := range results {
+		res := batchResult{Name: r.Name, Path: r.Path}
+		if r.Err != nil {
+			res.Error = r.Err.Error()
+			s.Failed++
+		} else {
+			s.OK++
+		}
+		s.Files = append(s.Files, res)
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+
+	switch {
+	case s.Failed == 0 && err == nil:
+		s.Status = "ok"
+		return s, exitAllOK
+	case s.OK == 0:
+		s.Status = "failed"
+		return s, exitFailed
+	default:
+		s.Status = "partial"
+		return s, exitPartial
+	}
+}
+
+// printSummary writes a summary as JSON, and a line for people to stderr
+func printSummary(w io.Writer, s batchSummary) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(s)
+	fmt.Fprintf(os.Stderr, "%s: %d of %d files received\n", s.Status, s.OK, s.Total)
+}
+
+// readNameList reads the file names of -receive-list, one per line;
+// blank lines and lines starting with # are skipped
+// path: The list file, or "-" for standard input
+func readNameList(path string) ([]string, error) {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		in = f
+	}
+	var names []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || strings.HasPrefix(name, "#") {
+			continue
+		}
+		names = append(names, name)
+	}
+	return names, scanner.Err()
+}
+
+// receiveNames downloads each named file in turn; a failed file doesn't
+// stop the others
+// Returns: A result for each file tried, and an error if ctx ended first
+func receiveNames(ctx context.Context, p *peer.Peer, names []string, opts peer.DownloadOptions) ([]peer.FileResult, error) {
+	var results []peer.FileResult
+	for _, name := range names {
+		path, err := p.Download(ctx, name, opts)
+		if ctx.Err() != nil {
+			return results, ctx.Err()
+		}
+		results = append(results, peer.FileResult{Name: name, Path: path, Err: err})
+	}
+	return results, nil
+}
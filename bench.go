@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// benchPair is a sender peer plus the address of the peer it benchmarks against
+type benchPair struct {
+	sender  *peer.Peer
+	target  string
+	cleanup func()
+}
+
+// benchSetup describes one transport/codec combination to benchmark
+type benchSetup struct {
+	transport string
+	codec     string
+	newPair   func(dir string) (*benchPair, error)
+}
+
+// benchStats holds the measurements for one benchmark run
+type benchStats struct {
+	report    *peer.BenchReport
+	cpu       time.Duration
+	cpuOK     bool
+	mallocs   uint64
+	allocated uint64
+}
+
+// runBench implements the "bench" subcommand
+// It measures throughput against a running peer given by -peer, or runs
+// in-process loopback benchmarks for every transport/codec combination
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	target := fs.String("peer", "", "Address of a running peer to benchmark against (default: in-process loopback)")
+	sizeFlag := fs.String("size", "256MB", "Amount of synthetic data to send (e.g. 512MB, 1GB)")
+	chunkFlag := fs.String("chunk", "64KB", "Payload size of each message")
+	timeout := fs.Duration("timeout", 10*time.Minute, "Maximum duration of each run")
+	codecFlag := fs.String("codec", "", "Comma-separated message codecs to benchmark: "+strings.Join(protocol.Codecs(), ", ")+" (default: all)")
+	fs.Parse(args)
+
+	size, err := parseSize(*sizeFlag)
+	if err != nil {
+		log.Fatalf("Invalid -size: %v", err)
+	}
+	chunk, err := parseSize(*chunkFlag)
+	if err != nil {
+		log.Fatalf("Invalid -chunk: %v", err)
+	}
+
+	codecs := protocol.Codecs()
+	if *codecFlag != "" {
+		codecs = strings.Split(*codecFlag, ",")
+		for _, name := range codecs {
+			if err := transport.ValidCodec(name); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+
+	var setups []benchSetup
+	if *target != "" {
+		for _, codec := range codecs {
+			setups = append(setups, benchSetup{"tcp", codec, remotePair(*target, codec)})
+		}
+	} else {
+		for _, codec := range codecs {
+			setups = append(setups, benchSetup{"tcp", codec, tcpPair(codec)})
+		}
+		for _, codec := range codecs {
+			setups = append(setups, benchSetup{"memory", codec, memoryPair(codec)})
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TRANSPORT\tCODEC\tBYTES\tELAPSED\tTHROUGHPUT\tCPU\tALLOCS\tALLOCATED")
+	for _, setup := range setups {
+		stats, err := benchOnce(setup, size, int(chunk), *timeout)
+		if err != nil {
+			logging.Errorf(log.Default(), "Benchmark %s/%s failed: %v", setup.transport, setup.codec, err)
+			continue
+		}
+
+		cpu := "n/a"
+		if stats.cpuOK {
+			cpu = stats.cpu.Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%s/s\t%s\t%d\t%s\n",
+			setup.transport, setup.codec, formatSize(stats.report.Bytes),
+			stats.report.Elapsed.Round(time.Millisecond),
+			formatSize(int64(stats.report.Throughput())), cpu,
+			stats.mallocs, formatSize(int64(stats.allocated)))
+	}
+	w.Flush()
+}
+
+// benchOnce runs a single benchmark and collects CPU and allocation stats
+func benchOnce(setup benchSetup, size int64, chunk int, timeout time.Duration) (*benchStats, error) {
+	dir, err := os.MkdirTemp("", "p2p-bench-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	pair, err := setup.newPair(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer pair.cleanup()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	cpuBefore, cpuOK := cpuTime()
+
+	report, err := pair.sender.Bench(ctx, pair.target, size, chunk)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuAfter, _ := cpuTime()
+	runtime.ReadMemStats(&after)
+
+	return &benchStats{
+		report:    report,
+		cpu:       cpuAfter - cpuBefore,
+		cpuOK:     cpuOK,
+		mallocs:   after.Mallocs - before.Mallocs,
+		allocated: after.TotalAlloc - before.TotalAlloc,
+	}, nil
+}
+
+// benchPeer creates and starts a quiet peer for benchmarking
+func benchPeer(id, dir string, t peer.Transport, opts ...peer.Option) (*peer.Peer, error) {
+	logger := log.New(io.Discard, "", 0)
+	p, err := peer.New(id, t.GetListenAddress(),
+		filepath.Join(dir, id, "shared"), filepath.Join(dir, id, "received"),
+		t, append([]peer.Option{peer.WithLogger(logger)}, opts...)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// tcpPair starts two peers talking over loopback TCP, the sender offering
+// codec on the connection it dials
+func tcpPair(codec string) func(dir string) (*benchPair, error) {
+	return func(dir string) (*benchPair, error) {
+		logger := log.New(io.Discard, "", 0)
+		sender, err := benchPeer("bench-sender", dir,
+			transport.NewTCPTransport("127.0.0.1:0", transport.WithLogger(logger), transport.WithCodec(codec)))
+		if err != nil {
+			return nil, err
+		}
+		receiver, err := benchPeer("bench-receiver", dir, transport.NewTCPTransport("127.0.0.1:0", transport.WithLogger(logger)))
+		if err != nil {
+			sender.Shutdown()
+			return nil, err
+		}
+		return &benchPair{
+			sender:  sender,
+			target:  receiver.Addr(),
+			cleanup: func() { sender.Shutdown(); receiver.Shutdown() },
+		}, nil
+	}
+}
+
+// memoryPair starts two peers connected by an in-process memory network
+// passing messages through codec
+func memoryPair(codec string) func(dir string) (*benchPair, error) {
+	return func(dir string) (*benchPair, error) {
+		network := transport.NewMemoryNetwork()
+		var transports []*transport.MemoryTransport
+		for i := 0; i < 2; i++ {
+			t := network.NewTransport("")
+			if err := t.SetCodec(codec); err != nil {
+				return nil, err
+			}
+			transports = append(transports, t)
+		}
+		sender, err := benchPeer("bench-sender", dir, transports[0])
+		if err != nil {
+			return nil, err
+		}
+		receiver, err := benchPeer("bench-receiver", dir, transports[1])
+		if err != nil {
+			sender.Shutdown()
+			return nil, err
+		}
+		return &benchPair{
+			sender:  sender,
+			target:  receiver.Addr(),
+			cleanup: func() { sender.Shutdown(); receiver.Shutdown() },
+		}, nil
+	}
+}
+
+// remotePair starts a local TCP peer that benchmarks against a remote
+// peer, offering codec on the connection
+func remotePair(target, codec string) func(dir string) (*benchPair, error) {
+	return func(dir string) (*benchPair, error) {
+		// Peers prove an identity key on every connection, so the
+		// sender needs one too, as with ping
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		logger := log.New(io.Discard, "", 0)
+		sender, err := benchPeer(peer.KeyID(key.Public().(ed25519.PublicKey)), dir,
+			transport.NewTCPTransport("0.0.0.0:0", transport.WithLogger(logger), transport.WithCodec(codec)),
+			peer.WithIdentityKey(key))
+		if err != nil {
+			return nil, err
+		}
+		return &benchPair{
+			sender:  sender,
+			target:  target,
+			cleanup: func() { sender.Shutdown() },
+		}, nil
+	}
+}
+
+// sizeUnits are the suffixes accepted by parseSize, longest first
+var sizeUnits = []struct {
+	suffix string
+	factor int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1},
+}
+
+// parseSize parses a human-readable size such as "64KB" or "1GB"
+// Units are binary, so 1KB is 1024 bytes
+func parseSize(s string) (int64, error) {
+	upper := strings.ToUpper(strings.TrimSpace(s))
+	factor := int64(1)
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(upper, unit.suffix) {
+			upper = strings.TrimSpace(strings.TrimSuffix(upper, unit.suffix))
+			factor = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseFloat(upper, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(factor)), nil
+}
+
+// formatSize renders a byte count with a binary unit suffix
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", float64(n)/float64(div), "KMGT"[exp])
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// runChannel implements the "channel" subcommand
+// "channel publish -name NAME FILE..." signs a channel of shared files with
+// the running peer's key; "channel list" shows the channels it knows
+func runChannel(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: channel publish -name NAME FILE... | channel list")
+	}
+	fs := flag.NewFlagSet("channel "+args[0], flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+
+	switch args[0] {
+	case "publish":
+		name := fs.String("name", "", "Name of the channel")
+		fs.Parse(args[1:])
+		if *name == "" || fs.NArg() == 0 {
+			log.Fatal("usage: channel publish -name NAME FILE...")
+		}
+		var ch channelJSON
+		if err := controlRequest(*addr, http.MethodPost, "/channels", publishJSON{Name: *name, Files: fs.Args()}, &ch); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Published channel %s version %d with %d files\n", ch.Name, ch.Version, len(ch.Files))
+		fmt.Printf("Subscribers verify it with -channel %s -publisher %s\n", ch.Name, ch.Publisher)
+	case "list":
+		fs.Parse(args[1:])
+		var list []channelJSON
+		if err := controlRequest(*addr, http.MethodGet, "/channels", nil, &list); err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tVERSION\tPUBLISHED\tPUBLISHER\tFILES")
+		for _, ch := range list {
+			publisher := ch.Publisher
+			if ch.Own {
+				publisher += " (this peer)"
+			}
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", ch.Name, ch.Version, ch.Published.Format("2006-01-02 15:04"), publisher, strings.Join(ch.Files, ", "))
+		}
+		w.Flush()
+	default:
+		log.Fatalf("unknown channel command %q", args[0])
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/config"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// setFlags returns the names of the flags given explicitly on the command line
+// Explicit flags take precedence over config file values, including on reload
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
+
+// configValues maps flag names to the corresponding config file values
+func configValues(cfg *config.Config) map[string]string {
+	return map[string]string{
+		"id":           cfg.ID,
+		"port":         cfg.Port,
+		"host":         cfg.Host,
+		"shared":       cfg.SharedDir,
+		"received":     cfg.ReceivedDir,
+		"state":        cfg.StateFile,
+		"index":        cfg.IndexFile,
+		"cache-size":   cfg.CacheSize,
+		"max-received": cfg.MaxReceived,
+		"evict":        cfg.Evict,
+		"swarm":        cfg.Swarm,
+		"swarm-key":    cfg.SwarmKey,
+		"tls-cert":     cfg.TLSCert,
+		"tls-key":      cfg.TLSKey,
+		"tls-ca":       cfg.TLSCA,
+		"noise-key":    cfg.NoiseKey,
+		"perms":        cfg.Perms,
+		"file-mode":    cfg.FileMode,
+		"dir-mode":     cfg.DirMode,
+		"owner":        cfg.Owner,
+		"sync":         cfg.SyncPartner,
+		"piece-size":   cfg.PieceSize,
+		"codec":        cfg.Codec,
+		"max-message":  cfg.MaxMessage,
+		"max-upload":   cfg.MaxUpload,
+		"max-download": cfg.MaxDownload,
+		"log-level":    cfg.LogLevel,
+	}
+}
+
+// configSwitches maps boolean flag names to the corresponding config file
+// values, nil where the file leaves them out
+func configSwitches(cfg *config.Config) map[string]*bool {
+	return map[string]*bool{
+		"tls":             cfg.TLS,
+		"tls-client-auth": cfg.TLSClientAuth,
+	}
+}
+
+// applyConfigFile fills in flag values that were not given on the command line
+// from the config file
+// flags: Pointers to the flag values keyed by flag name
+// switches: Pointers to the boolean flag values keyed by flag name
+func applyConfigFile(cfg *config.Config, flags map[string]*string, switches map[string]*bool) {
+	set := setFlags()
+	for name, value := range configValues(cfg) {
+		if ptr, ok := flags[name]; ok && !set[name] && value != "" {
+			*ptr = value
+		}
+	}
+	for name, value := range configSwitches(cfg) {
+		if ptr, ok := switches[name]; ok && !set[name] && value != nil {
+			*ptr = *value
+		}
+	}
+}
+
+// contactPeers greets the known peers of the config file, so that they
+// are listed and searched like the peers that got in touch
+func contactPeers(p *peer.Peer, addrs []string) {
+	for _, addr := range addrs {
+		if _, err := p.PeerFeatures(context.Background(), addr); err != nil {
+			logging.Warnf(log.Default(), "Could not reach known peer %s: %v", addr, err)
+		}
+	}
+}
+
+// rateLimits converts the bandwidth flags and settings of cfg into transport
+// limits
+// upload, download: The -max-upload and -max-download rates in effect
+// flagged: The -peer-limit flags, which replace the file's caps for the same peer
+// cfg: The config file, nil if none was given
+// Returns: The global limits and the per-peer limits keyed by peer
+func rateLimits(upload, download string, flagged peerLimitFlags, cfg *config.Config) (transport.Limits, map[string]transport.Limits, error) {
+	var global transport.Limits
+	var err error
+	if global.Upload, err = rateValue(upload); err != nil {
+		return global, nil, fmt.Errorf("max upload rate: %v", err)
+	}
+	if global.Download, err = rateValue(download); err != nil {
+		return global, nil, fmt.Errorf("max download rate: %v", err)
+	}
+
+	peers := make(map[string]transport.Limits)
+	for key, l := range flagged {
+		peers[key] = transport.Limits{Upload: l.Upload, Download: l.Download}
+	}
+	if cfg == nil {
+		return global, peers, nil
+	}
+	for key, pl := range cfg.PeerLimits {
+		if _, ok := flagged[key]; ok {
+			continue
+		}
+		var l transport.Limits
+		if l.Upload, err = optionalSize(pl.Upload); err != nil {
+			return global, nil, fmt.Errorf("peer_limits.%s.upload: %v", key, err)
+		}
+		if l.Download, err = optionalSize(pl.Download); err != nil {
+			return global, nil, fmt.Errorf("peer_limits.%s.download: %v", key, err)
+		}
+		peers[key] = l
+	}
+	return global, peers, nil
+}
+
+// applyRateLimits replaces the transport's bandwidth caps with those of the
+// flags and cfg, explicit flags taking precedence
+// current: The string flag values in effect, see applyConfigFile
+// flagged: The -peer-limit flags
+func applyRateLimits(t *transport.TCPTransport, cfg *config.Config, current map[string]*string, flagged peerLimitFlags) error {
+	global, peers, err := configRateLimits(cfg, current, flagged)
+	if err != nil {
+		return err
+	}
+	setRateLimits(t, global, peers)
+	return nil
+}
+
+// configRateLimits returns the bandwidth caps of the flags and cfg,
+// explicit flags taking precedence, see rateLimits
+func configRateLimits(cfg *config.Config, current map[string]*string, flagged peerLimitFlags) (transport.Limits, map[string]transport.Limits, error) {
+	upload, download := *current["max-upload"], *current["max-download"]
+	if cfg != nil {
+		set, values := setFlags(), configValues(cfg)
+		if !set["max-upload"] {
+			upload = values["max-upload"]
+		}
+		if !set["max-download"] {
+			download = values["max-download"]
+		}
+	}
+	return rateLimits(upload, download, flagged, cfg)
+}
+
+// setRateLimits replaces the transport's bandwidth caps
+func setRateLimits(t *transport.TCPTransport, global transport.Limits, peers map[string]transport.Limits) {
+	t.SetRateLimits(global)
+	for key := range t.PeerRateLimits() {
+		if _, ok := peers[key]; !ok {
+			t.SetPeerRateLimits(key, transport.Limits{})
+		}
+	}
+	for key, l := range peers {
+		t.SetPeerRateLimits(key, l)
+	}
+}
+
+// applySocketOptions tunes the transport's new connections as configured
+func applySocketOptions(t *transport.TCPTransport, cfg *config.Config) error {
+	o, err := socketOptions(cfg)
+	if err != nil {
+		return err
+	}
+	t.SetSocketOptions(o)
+	return nil
+}
+
+// socketOptions returns the socket options of the config file
+func socketOptions(cfg *config.Config) (transport.SocketOptions, error) {
+	s := cfg.Socket
+	o := transport.SocketOptions{KeepAlive: s.KeepAlive, Nagle: s.NoDelay != nil && !*s.NoDelay}
+	read, err := optionalSize(s.ReadBuffer)
+	if err != nil {
+		return o, fmt.Errorf("socket.read_buffer: %v", err)
+	}
+	write, err := optionalSize(s.WriteBuffer)
+	if err != nil {
+		return o, fmt.Errorf("socket.write_buffer: %v", err)
+	}
+	o.ReadBuffer, o.WriteBuffer = int(read), int(write)
+	return o, nil
+}
+
+// accessControl builds the ACL from the config file's groups and rules
+// Returns: nil if the file defines no rules
+func accessControl(cfg *config.Config) (*peer.ACL, error) {
+	if len(cfg.ACL) == 0 {
+		return nil, nil
+	}
+	acl := &peer.ACL{Groups: cfg.Groups, Rules: make(map[string]peer.ACLRule)}
+	for group, rule := range cfg.ACL {
+		r := peer.ACLRule{Paths: rule.Paths}
+		for _, name := range rule.Access {
+			access, err := peer.ParseAccess(name)
+			if err != nil {
+				return nil, fmt.Errorf("acl.%s: %v", group, err)
+			}
+			r.Access = append(r.Access, access)
+		}
+		acl.Rules[group] = r
+	}
+	if err := acl.Validate(); err != nil {
+		return nil, fmt.Errorf("acl: %v", err)
+	}
+	return acl, nil
+}
+
+// syncRules builds the sync rules from the config file
+// Returns: nil if the file defines none
+func syncRules(cfg *config.Config) (map[string]peer.SyncRule, error) {
+	if len(cfg.Sync) == 0 {
+		return nil, nil
+	}
+	rules := make(map[string]peer.SyncRule, len(cfg.Sync))
+	for key, rule := range cfg.Sync {
+		r := peer.SyncRule{Include: rule.Include, Exclude: rule.Exclude, Dirs: rule.Dirs}
+		if err := r.Validate(); err != nil {
+			return nil, fmt.Errorf("sync.%s: %v", key, err)
+		}
+		rules[key] = r
+	}
+	return rules, nil
+}
+
+// permissions parses the -perms, -file-mode, -dir-mode and -owner settings
+func permissions(mode, fileMode, dirMode, owner string) (peer.Permissions, error) {
+	var perms peer.Permissions
+	var err error
+	if perms.Mode, err = peer.ParsePermissionMode(mode); err != nil {
+		return perms, err
+	}
+	file, err := strconv.ParseUint(fileMode, 8, 32)
+	if err != nil || file > 0777 {
+		return perms, fmt.Errorf("invalid file-mode %q, expected octal like 0644", fileMode)
+	}
+	dir, err := strconv.ParseUint(dirMode, 8, 32)
+	if err != nil || dir > 0777 {
+		return perms, fmt.Errorf("invalid dir-mode %q, expected octal like 0755", dirMode)
+	}
+	perms.FileMode, perms.DirMode = os.FileMode(file), os.FileMode(dir)
+
+	if owner != "" {
+		uid, gid, ok := strings.Cut(owner, ":")
+		if perms.UID, err = strconv.Atoi(uid); err == nil && ok {
+			perms.GID, err = strconv.Atoi(gid)
+		}
+		if err != nil || !ok {
+			return perms, fmt.Errorf("invalid owner %q, expected uid:gid", owner)
+		}
+		perms.SetOwner = true
+	}
+	return perms, nil
+}
+
+// receivedLimit parses the -max-received and -evict settings
+func receivedLimit(size, policy string) (int64, peer.EvictionPolicy, error) {
+	limit, err := optionalSize(size)
+	if err != nil {
+		return 0, 0, fmt.Errorf("max-received: %v", err)
+	}
+	eviction, err := peer.ParseEvictionPolicy(policy)
+	if err != nil {
+		return 0, 0, err
+	}
+	return limit, eviction, nil
+}
+
+// optionalSize parses a size like "10MB", treating an empty string as 0
+func optionalSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return parseSize(s)
+}
+
+// liveSettings are the settings of a config file that can change while
+// the peer runs, parsed and validated so that they're applied together or
+// not at all
+type liveSettings struct {
+	sharedDir     string // Empty to keep the current directory
+	receivedDir   string // Empty to keep the current directory
+	limits        transport.Limits
+	peerLimits    map[string]transport.Limits
+	socket        transport.SocketOptions
+	acl           *peer.ACL
+	syncRules     map[string]peer.SyncRule
+	logLevel      logging.Level
+	receivedLimit int64
+	eviction      peer.EvictionPolicy
+}
+
+// reloadConfig re-reads the config file and applies the settings that can
+// change while the peer is running, including bandwidth caps, socket
+// options, the ACL, sync rules and the received directory limit. Every
+// setting is checked before any is applied, so a file with a mistake
+// changes nothing. Existing connections are left untouched; settings that
+// need a restart are reported and otherwise ignored
+// switches: The boolean flag values in effect, see applyConfigFile
+// peerLimits: The -peer-limit flags, which keep precedence over the file
+func reloadConfig(p *peer.Peer, t *transport.TCPTransport, path string, current map[string]*string, switches map[string]*bool, peerLimits peerLimitFlags) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		return err
+	}
+	live, err := parseLiveSettings(cfg, current, peerLimits)
+	if err != nil {
+		return err
+	}
+
+	set := setFlags()
+	values := configValues(cfg)
+	for _, name := range []string{"id", "port", "host", "state", "index", "cache-size", "tls-cert", "tls-key", "tls-ca", "noise-key", "sync", "piece-size", "codec", "max-message"} {
+		if !set[name] && values[name] != "" && values[name] != *current[name] {
+			logging.Warnf(log.Default(), "Config change to %q requires a restart, ignoring", name)
+		}
+	}
+	for name, value := range configSwitches(cfg) {
+		if !set[name] && value != nil && *value != *switches[name] {
+			logging.Warnf(log.Default(), "Config change to %q requires a restart, ignoring", name)
+		}
+	}
+	if err := applyLiveSettings(p, t, live); err != nil {
+		return err
+	}
+	go contactPeers(p, cfg.Peers)
+	return nil
+}
+
+// parseLiveSettings reads the settings reloadConfig applies from cfg,
+// explicit flags taking precedence
+// New shared and received directories are created here, so that applying
+// them can't fail halfway through
+func parseLiveSettings(cfg *config.Config, current map[string]*string, peerLimits peerLimitFlags) (*liveSettings, error) {
+	set := setFlags()
+	values := configValues(cfg)
+	live := &liveSettings{}
+	var err error
+	if dir := values["shared"]; !set["shared"] && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create shared directory: %v", err)
+		}
+		live.sharedDir = dir
+	}
+	if dir := values["received"]; !set["received"] && dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create received directory: %v", err)
+		}
+		live.receivedDir = dir
+	}
+	if live.limits, live.peerLimits, err = configRateLimits(cfg, current, peerLimits); err != nil {
+		return nil, err
+	}
+	if live.socket, err = socketOptions(cfg); err != nil {
+		return nil, err
+	}
+	if live.acl, err = accessControl(cfg); err != nil {
+		return nil, err
+	}
+	if live.syncRules, err = syncRules(cfg); err != nil {
+		return nil, err
+	}
+
+	level := *current["log-level"]
+	if !set["log-level"] {
+		level = values["log-level"]
+	}
+	if live.logLevel, err = logging.ParseLevel(level); err != nil {
+		return nil, err
+	}
+
+	// The received directory limit follows the file unless set by a flag
+	size, policy := *current["max-received"], *current["evict"]
+	if !set["max-received"] {
+		size = values["max-received"]
+	}
+	if !set["evict"] && values["evict"] != "" {
+		policy = values["evict"]
+	}
+	if live.receivedLimit, live.eviction, err = receivedLimit(size, policy); err != nil {
+		return nil, err
+	}
+	return live, nil
+}
+
+// applyLiveSettings applies settings parsed by parseLiveSettings, logging
+// those that changed
+func applyLiveSettings(p *peer.Peer, t *transport.TCPTransport, live *liveSettings) error {
+	var changed []string
+	if live.sharedDir != "" && live.sharedDir != p.SharedDir() {
+		if err := p.SetSharedDir(live.sharedDir); err != nil {
+			return fmt.Errorf("failed to apply shared directory: %v", err)
+		}
+		changed = append(changed, "shared directory "+live.sharedDir)
+	}
+	if live.receivedDir != "" && live.receivedDir != p.ReceivedDir() {
+		if err := p.SetReceivedDir(live.receivedDir); err != nil {
+			return fmt.Errorf("failed to apply received directory: %v", err)
+		}
+		changed = append(changed, "received directory "+live.receivedDir)
+	}
+	if live.limits != t.RateLimits() || !reflect.DeepEqual(live.peerLimits, t.PeerRateLimits()) {
+		changed = append(changed, fmt.Sprintf("rate limits (upload %d B/s, download %d B/s, %d peer override(s))",
+			live.limits.Upload, live.limits.Download, len(live.peerLimits)))
+	}
+	setRateLimits(t, live.limits, live.peerLimits)
+	if live.socket != t.SocketOptions() {
+		changed = append(changed, "socket options")
+		t.SetSocketOptions(live.socket)
+	}
+	if !reflect.DeepEqual(live.acl, p.ACL()) {
+		changed = append(changed, fmt.Sprintf("ACL (%d rules)", len(aclRules(live.acl))))
+		p.SetACL(live.acl)
+	}
+	if !reflect.DeepEqual(live.syncRules, p.SyncRules()) {
+		changed = append(changed, fmt.Sprintf("sync rules (%d peers)", len(live.syncRules)))
+		p.SetSyncRules(live.syncRules)
+	}
+	if live.logLevel != logging.CurrentLevel() {
+		changed = append(changed, "log level "+live.logLevel.String())
+		logging.SetLevel(live.logLevel)
+	}
+	if limit, eviction := p.ReceivedLimit(); live.receivedLimit != limit || live.eviction != eviction {
+		changed = append(changed, fmt.Sprintf("received directory limit %d bytes, evicting %s", live.receivedLimit, live.eviction))
+		p.SetReceivedLimit(live.receivedLimit, live.eviction)
+	}
+
+	if len(changed) == 0 {
+		logging.Infof(log.Default(), "Config reloaded, no live setting changed")
+	} else {
+		logging.Infof(log.Default(), "Config reloaded, changed: %s", strings.Join(changed, "; "))
+	}
+	return nil
+}
+
+// aclRules returns the rules of acl, nil for no ACL
+func aclRules(acl *peer.ACL) map[string]peer.ACLRule {
+	if acl == nil {
+		return nil
+	}
+	return acl.Rules
+}
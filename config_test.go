@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// TestReloadConfigAtomic checks that a config file with one bad setting
+// changes none of the others, and that a good one applies them all
+func TestReloadConfigAtomic(t *testing.T) {
+	defer logging.SetLevel(logging.CurrentLevel())
+	dir := t.TempDir()
+	tr := transport.NewTCPTransport("127.0.0.1:0")
+	p, err := peer.New("peer1", "127.0.0.1:0", filepath.Join(dir, "shared"), filepath.Join(dir, "received"), tr,
+		peer.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := map[string]*string{}
+	for _, name := range []string{"max-upload", "max-download", "max-received", "evict", "log-level"} {
+		current[name] = new(string)
+	}
+	*current["log-level"], *current["evict"] = "info", "oldest"
+	logging.SetLevel(logging.Info)
+
+	path := filepath.Join(dir, "p2p.toml")
+	reload := func(contents string) error {
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return reloadConfig(p, tr, path, current, map[string]*bool{}, nil)
+	}
+
+	shared := filepath.Join(dir, "shared2")
+	if err := reload("shared_dir = \"" + shared + "\"\nmax_upload = \"1MB\"\nlog_level = \"warn\"\nmax_received = \"lots\"\n"); err == nil {
+		t.Fatal("reload with a bad max_received succeeded")
+	}
+	if p.SharedDir() == shared || tr.RateLimits().Upload != 0 || logging.CurrentLevel() != logging.Info {
+		t.Fatalf("failed reload applied settings: shared %s, upload %d, level %v", p.SharedDir(), tr.RateLimits().Upload, logging.CurrentLevel())
+	}
+
+	if err := reload("shared_dir = \"" + shared + "\"\nmax_upload = \"1MB\"\nlog_level = \"warn\"\nmax_received = \"1GB\"\n"); err != nil {
+		t.Fatal(err)
+	}
+	limit, _ := p.ReceivedLimit()
+	if p.SharedDir() != shared || tr.RateLimits().Upload != 1<<20 || logging.CurrentLevel() != logging.Warn || limit != 1<<30 {
+		t.Fatalf("reload not applied: shared %s, upload %d, level %v, limit %d", p.SharedDir(), tr.RateLimits().Upload, logging.CurrentLevel(), limit)
+	}
+}
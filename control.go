@@ -0,0 +1,703 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// controlTimeout bounds a single control API request made by the CLI
+const controlTimeout = 10 * time.Second
+
+// controlTokenEnv names the environment variable CLI subcommands take the
+// control API token from, see -control-token
+const controlTokenEnv = "P2P_CONTROL_TOKEN"
+
+// controlServer exposes a running peer's settings over a local HTTP/JSON API
+// used by the CLI subcommands
+type controlServer struct {
+	peer      *peer.Peer
+	transport *transport.TCPTransport
+	remote    string // Peer given with -peer, which readiness requires a connection to
+	server    *http.Server
+	jobs      jobs   // Transfers requested through the API
+	token     string // Bearer token requests must carry, empty for none
+	anyOutput bool   // Let transfers save files outside the received directory
+}
+
+// startControl starts the control API on addr
+// addr should be a loopback address; without a token the API is
+// unauthenticated, and only guarded against requests from web pages
+// remote: Peer the readiness check requires to be reachable, may be empty
+// token: Bearer token requests must carry, empty for none
+// anyOutput: Accept output paths outside the received directory
+func startControl(addr string, p *peer.Peer, t *transport.TCPTransport, remote, token string, anyOutput bool) (*controlServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start control API: %v", err)
+	}
+
+	c := &controlServer{peer: p, transport: t, remote: remote, jobs: jobs{byID: map[uint64]*job{}},
+		token: token, anyOutput: anyOutput}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/limits", c.handleLimits)
+	mux.HandleFunc("/transfers", c.handleTransfers)
+	mux.HandleFunc("/transfers/", c.handleTransfer)
+	mux.HandleFunc("/files", c.handleFiles)
+	mux.Handle("/metrics", p.Metrics().Handler())
+	mux.HandleFunc("/gc", c.handleGC)
+	mux.HandleFunc("/disk", c.handleDisk)
+	mux.HandleFunc("/index", c.handleIndex)
+	mux.HandleFunc("/peers", c.handlePeers)
+	mux.HandleFunc("/attempts", c.handleAttempts)
+	mux.HandleFunc("/dht", c.handleDHT)
+	mux.HandleFunc("/tracker", c.handleTracker)
+	mux.HandleFunc("/receipts", c.handleReceipts)
+	mux.HandleFunc("/stream/", c.handleStream)
+	mux.HandleFunc("/channels", c.handleChannels)
+	mux.HandleFunc("/keys", c.handleKeys)
+	mux.HandleFunc("/bans", c.handleBans)
+	mux.HandleFunc("/quarantine", c.handleQuarantine)
+	mux.HandleFunc("/pushes", c.handlePushes)
+	mux.HandleFunc("/admin", c.handleAdmin)
+	mux.HandleFunc("/healthz", c.handleHealthz)
+	mux.HandleFunc("/readyz", c.handleReadyz)
+	c.server = &http.Server{Handler: c.guard(mux), ReadHeaderTimeout: controlTimeout}
+
+	go func() {
+		if err := c.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Errorf(log.Default(), "Control API stopped: %v", err)
+		}
+	}()
+	logging.Infof(log.Default(), "Control API listening on %s", ln.Addr())
+	return c, nil
+}
+
+// Close stops the control API
+func (c *controlServer) Close() error {
+	return c.server.Close()
+}
+
+// guard refuses the requests a web page the operator visits could make:
+// those for a host name other than localhost, as after DNS rebinding, and
+// changes not sent as JSON, which browsers don't send to another origin
+// without asking first. With a token, every request but the health
+// checks must also carry it
+func (c *controlServer) guard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !controlHost(r.Host) {
+			http.Error(w, fmt.Sprintf("host %q not allowed, use localhost or an IP address", r.Host), http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead &&
+			!strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+			http.Error(w, "requests must be JSON", http.StatusUnsupportedMediaType)
+			return
+		}
+		if c.token != "" && r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			auth := r.Header.Get("Authorization")
+			if !strings.HasPrefix(auth, "Bearer ") ||
+				subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(c.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "missing or wrong control API token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// controlHost reports whether a request's Host names the control API
+// without a DNS name an attacker could point at it: localhost, or an IP
+// address such as the one health checks of orchestrators connect to
+func controlHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	return host == "localhost" || strings.HasSuffix(host, ".localhost") || net.ParseIP(host) != nil
+}
+
+// checkOutput refuses an output path outside the received directory
+// unless the API was started to accept any
+func (c *controlServer) checkOutput(output string) error {
+	if output == "" || c.anyOutput {
+		return nil
+	}
+	if err := c.peer.CheckReceivedPath(output); err != nil {
+		return fmt.Errorf("output must be inside the received directory (see -control-any-output): %v", err)
+	}
+	return nil
+}
+
+// loadControlToken reads the control API token from path, saving a new
+// random one readable only by the owner if the file doesn't exist
+func loadControlToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		buf := make([]byte, 32)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		token := hex.EncodeToString(buf)
+		if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+			return "", fmt.Errorf("failed to save control API token: %v", err)
+		}
+		return token, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read control API token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("control API token file %s is empty", path)
+	}
+	return token, nil
+}
+
+// limitsJSON is the control API representation of the bandwidth caps, in
+// bytes per second with 0 meaning unlimited. In updates, omitted fields are
+// left unchanged and a peer entry with both rates 0 is removed
+type limitsJSON struct {
+	MaxUpload   *int64                   `json:"max_upload,omitempty"`
+	MaxDownload *int64                   `json:"max_download,omitempty"`
+	Peers       map[string]transportRate `json:"peers,omitempty"`
+}
+
+// transportRate is the JSON form of transport.Limits
+type transportRate struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+// handleLimits reports the rate limits on GET and changes them on PUT
+func (c *controlServer) handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var update limitsJSON
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("invalid limits: %v", err), http.StatusBadRequest)
+			return
+		}
+		c.applyLimits(update)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.currentLimits())
+}
+
+// applyLimits changes the limits named in update
+func (c *controlServer) applyLimits(update limitsJSON) {
+	global := c.transport.RateLimits()
+	if update.MaxUpload != nil {
+		global.Upload = *update.MaxUpload
+	}
+	if update.MaxDownload != nil {
+		global.Download = *update.MaxDownload
+	}
+	c.transport.SetRateLimits(global)
+	for key, l := range update.Peers {
+		c.transport.SetPeerRateLimits(key, transport.Limits{Upload: l.Upload, Download: l.Download})
+	}
+	logging.Infof(log.Default(), "Rate limits changed through the control API: upload %d B/s, download %d B/s, %d peer override(s)",
+		global.Upload, global.Download, len(c.transport.PeerRateLimits()))
+}
+
+// currentLimits returns the limits in effect
+func (c *controlServer) currentLimits() limitsJSON {
+	global := c.transport.RateLimits()
+	out := limitsJSON{
+		MaxUpload:   &global.Upload,
+		MaxDownload: &global.Download,
+		Peers:       make(map[string]transportRate),
+	}
+	for key, l := range c.transport.PeerRateLimits() {
+		out.Peers[key] = transportRate{Upload: l.Upload, Download: l.Download}
+	}
+	return out
+}
+
+// transfersJSON is the control API view of active and recent transfers
+type transfersJSON struct {
+	Active  []peer.Transfer       `json:"active"`
+	History []peer.TransferRecord `json:"history"` // Most recent last
+}
+
+// handleTransfers reports active transfers and the most recent history
+// entries on GET; the "history" query parameter sets how many, default 20
+// POST starts a transfer, see handleTransferRequest
+func (c *controlServer) handleTransfers(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		c.handleTransferRequest(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	n := 20
+	if s := r.URL.Query().Get("history"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n < 0 {
+			http.Error(w, "invalid history count", http.StatusBadRequest)
+			return
+		}
+	}
+
+	history := c.peer.History()
+	if len(history) > n {
+		history = history[len(history)-n:]
+	}
+	writeJSON(w, transfersJSON{Active: c.peer.ActiveTransfers(), History: history})
+}
+
+// handleGC runs a garbage collection on POST; the "max_age" query
+// parameter sets the age of the files and records to remove, default 24h
+func (c *controlServer) handleGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	maxAge := 24 * time.Hour
+	if s := r.URL.Query().Get("max_age"); s != "" {
+		var err error
+		if maxAge, err = time.ParseDuration(s); err != nil || maxAge < 0 {
+			http.Error(w, "invalid max_age", http.StatusBadRequest)
+			return
+		}
+	}
+
+	res, err := c.peer.CollectGarbage(maxAge)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, res)
+}
+
+// handleDisk reports the disk usage of the shared and received directories
+func (c *controlServer) handleDisk(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	u, err := c.peer.DiskUsage()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, u)
+}
+
+// handleIndex reports the progress of hashing the shared directory in the
+// background
+func (c *controlServer) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.peer.HashProgress())
+}
+
+// handlePeers lists the remote peers seen or discovered on the local network
+func (c *controlServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.peer.Peers())
+}
+
+// handleAttempts reports the recent connection attempts by address, or
+// with ?addr= those to or from one address or host
+func (c *controlServer) handleAttempts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if addr := r.URL.Query().Get("addr"); addr != "" {
+		attempts := c.transport.AttemptsTo(addr)
+		if len(attempts) == 0 {
+			http.Error(w, fmt.Sprintf("no connection attempts to or from %s", addr), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string][]transport.ConnAttempt{addr: attempts})
+		return
+	}
+	writeJSON(w, c.transport.Attempts())
+}
+
+// handleDHT reports on the peer's DHT node, or with ?find=<hash> looks up
+// the providers of a content hash
+func (c *controlServer) handleDHT(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if find := r.URL.Query().Get("find"); find != "" {
+		hash, err := hex.DecodeString(find)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid hash: %v", err), http.StatusBadRequest)
+			return
+		}
+		providers, err := c.peer.FindProviders(r.Context(), hash)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, providers)
+		return
+	}
+	status, err := c.peer.DHTStatus()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// handleTracker lists the peers registered with the tracker
+func (c *controlServer) handleTracker(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.peer.TrackedPeers())
+}
+
+// handleReceipts lists the receipts signed for files the peer sent
+func (c *controlServer) handleReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.peer.Receipts())
+}
+
+// handleStream serves a file held by other peers with support for Range
+// requests, fetching the requested pieces on demand, e.g. for a video
+// player: GET /stream/<name>?peer=<addr>, with "peer" repeatable
+func (c *controlServer) handleStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/stream/")
+	peers := r.URL.Query()["peer"]
+	if name == "" || len(peers) == 0 {
+		http.Error(w, "usage: /stream/<name>?peer=<addr>", http.StatusBadRequest)
+		return
+	}
+
+	stream, err := c.peer.OpenStream(r.Context(), name, peers)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	http.ServeContent(w, r, path.Base(name), time.Time{}, stream)
+}
+
+// releaseJSON asks to release a quarantined file, and reports where it went
+type releaseJSON struct {
+	File string `json:"file"`
+	To   string `json:"to,omitempty"` // Defaults to where the file would have been saved
+}
+
+// handleQuarantine lists the quarantined files on GET, releases one on
+// POST and deletes the one named by the "file" query parameter on DELETE
+func (c *controlServer) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := c.peer.Quarantined()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		var req releaseJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := c.checkOutput(req.To); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		to, err := c.peer.ReleaseQuarantined(req.File, req.To)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, releaseJSON{File: req.File, To: to})
+	case http.MethodDelete:
+		if err := c.peer.DeleteQuarantined(r.URL.Query().Get("file")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, map[string]string{"deleted": r.URL.Query().Get("file")})
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// decisionJSON accepts or refuses a push offer
+type decisionJSON struct {
+	ID     uint64 `json:"id"`
+	Accept bool   `json:"accept"`
+}
+
+// handlePushes lists the push offers waiting for a decision on GET and
+// decides one on POST
+func (c *controlServer) handlePushes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, c.peer.PendingPushes())
+	case http.MethodPost:
+		var req decisionJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := c.peer.DecidePush(req.ID, req.Accept); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, req)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// keysJSON lists the pinned peer keys and the key changes detected
+type keysJSON struct {
+	Own    string          `json:"own"` // This peer's public key
+	Keys   []peer.KnownKey `json:"keys"`
+	Alerts []peer.KeyAlert `json:"alerts"`
+}
+
+// handleKeys lists the pinned keys on GET and forgets the key of the peer
+// named by the "id" query parameter on DELETE
+func (c *controlServer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, keysJSON{
+			Own:    peer.EncodePublicKey(c.peer.PublicKey()),
+			Keys:   c.peer.KnownKeys(),
+			Alerts: c.peer.KeyAlerts(),
+		})
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		found, err := c.peer.ForgetKey(id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("no key pinned for peer %q", id), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"forgotten": id})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// banJSON is the control API form of transport.Ban
+type banJSON struct {
+	Host    string    `json:"host"`
+	Offense string    `json:"offense"` // Offense that triggered the ban: auth, malformed or rate
+	Count   int       `json:"count"`   // Bans of the host so far, each doubling the last
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+}
+
+// handleBans lists the banned hosts on GET and lifts the ban on the host
+// given as ?host= on DELETE
+func (c *controlServer) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		bans := []banJSON{}
+		for _, b := range c.transport.Bans() {
+			bans = append(bans, banJSON{Host: b.Host, Offense: string(b.Offense), Count: b.Count, Since: b.Since, Until: b.Until})
+		}
+		writeJSON(w, bans)
+	case http.MethodDelete:
+		host := r.URL.Query().Get("host")
+		if !c.transport.Unban(host) {
+			http.Error(w, fmt.Sprintf("host %q is not banned", host), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, map[string]string{"unbanned": host})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// channelJSON is the control API summary of a channel
+type channelJSON struct {
+	Name      string    `json:"name"`
+	Version   int64     `json:"version"`
+	Publisher string    `json:"publisher"` // See peer.EncodePublicKey
+	Published time.Time `json:"published"`
+	Files     []string  `json:"files"`
+	Own       bool      `json:"own"` // Published by this peer
+}
+
+// publishJSON is the body of a channel publication
+type publishJSON struct {
+	Name  string   `json:"name"`
+	Files []string `json:"files"`
+}
+
+// handleChannels lists the known channels on GET and publishes one on POST
+func (c *controlServer) handleChannels(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		var list []channelJSON
+		for _, ch := range c.peer.Channels() {
+			list = append(list, c.channelSummary(ch))
+		}
+		writeJSON(w, list)
+	case http.MethodPost:
+		var req publishJSON
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		ch, err := c.peer.PublishChannel(req.Name, req.Files)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, c.channelSummary(ch))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// channelSummary converts a channel for the control API
+func (c *controlServer) channelSummary(ch *protocol.Channel) channelJSON {
+	out := channelJSON{
+		Name:      ch.Name,
+		Version:   ch.Version,
+		Publisher: peer.EncodePublicKey(ch.Publisher),
+		Published: ch.Published,
+		Own:       bytes.Equal(ch.Publisher, c.peer.PublicKey()),
+	}
+	for _, m := range ch.Files {
+		out.Files = append(out.Files, m.Name)
+	}
+	return out
+}
+
+// handleAdmin sends an admin command to a managed peer on POST and
+// returns its result
+func (c *controlServer) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req adminJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	var args interface{}
+	if len(req.Args) > 0 {
+		args = req.Args
+	}
+	var result json.RawMessage
+	if err := c.peer.Admin(r.Context(), req.Peer, req.Command, args, &result); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, result)
+}
+
+// writeJSON sends v as an indented JSON response
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logging.Errorf(log.Default(), "Control API response failed: %v", err)
+	}
+}
+
+// controlRequest calls the control API of the peer at addr
+// body is sent as JSON if non-nil; the JSON response is decoded into out
+func controlRequest(addr, method, path string, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://"+addr+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil || method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := os.Getenv(controlTokenEnv); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: controlTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("control API unreachable at %s: %v", addr, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("control API: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
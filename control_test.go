@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+func TestControlHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"localhost:9000", true},
+		{"LOCALHOST", true},
+		{"app.localhost:9000", true},
+		{"127.0.0.1:9000", true},
+		{"[::1]:9000", true},
+		{"10.0.0.7:9000", true},
+		{"attacker.example:9000", false},
+		{"localhost.attacker.example", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := controlHost(tt.host); got != tt.want {
+			t.Errorf("controlHost(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestControlGuard(t *testing.T) {
+	c := &controlServer{token: "secret"}
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name, method, path, host, contentType, auth string
+		want                                        int
+	}{
+		{"authorized", "POST", "/gc", "localhost:9000", "application/json", "Bearer secret", http.StatusOK},
+		{"get without body type", "GET", "/peers", "127.0.0.1:9000", "", "Bearer secret", http.StatusOK},
+		{"rebound host", "POST", "/gc", "attacker.example:9000", "application/json", "Bearer secret", http.StatusForbidden},
+		{"form post", "POST", "/gc", "localhost:9000", "text/plain", "Bearer secret", http.StatusUnsupportedMediaType},
+		{"delete without type", "DELETE", "/keys", "localhost:9000", "", "Bearer secret", http.StatusUnsupportedMediaType},
+		{"no token", "POST", "/gc", "localhost:9000", "application/json", "", http.StatusUnauthorized},
+		{"wrong token", "GET", "/peers", "localhost:9000", "", "Bearer secrex", http.StatusUnauthorized},
+		{"health check", "GET", "/healthz", "10.0.0.7:9000", "", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, strings.NewReader("{}"))
+		r.Host = tt.host
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		c.guard(ok).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+}
+
+func TestControlOutput(t *testing.T) {
+	dir := t.TempDir()
+	received := filepath.Join(dir, "received")
+	tr := transport.NewMemoryNetwork().NewTransport("mem:peer")
+	p, err := peer.New("peer1", tr.GetListenAddress(), filepath.Join(dir, "shared"), received, tr,
+		peer.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(received, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(received, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &controlServer{peer: p}
+	for _, output := range []string{"", filepath.Join(received, "a.txt"), filepath.Join(received, "new/dir/a.txt")} {
+		if err := c.checkOutput(output); err != nil {
+			t.Errorf("checkOutput(%q): %v", output, err)
+		}
+	}
+	for _, output := range []string{
+		filepath.Join(dir, "a.txt"), "/etc/cron.d/job", filepath.Join(received, "../a.txt"),
+		filepath.Join(received, "link/a.txt"), filepath.Join(received, "link/new/a.txt"),
+	} {
+		if err := c.checkOutput(output); err == nil {
+			t.Errorf("checkOutput(%q) accepted a path outside the received directory", output)
+		}
+	}
+	c.anyOutput = true
+	if err := c.checkOutput("/etc/cron.d/job"); err != nil {
+		t.Errorf("with anyOutput: %v", err)
+	}
+}
+
+func TestLoadControlToken(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.token")
+	token, err := loadControlToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(token) != 64 {
+		t.Fatalf("token %q: want 64 hex digits", token)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("token file: %v, %v", info, err)
+	}
+	again, err := loadControlToken(path)
+	if err != nil || again != token {
+		t.Fatalf("reloaded %q, %v, want %q", again, err, token)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "time"
+
+// cpuTime is not implemented on this platform
+func cpuTime() (time.Duration, bool) {
+	return 0, false
+}
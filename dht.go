@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/dht"
+)
+
+// runDHT implements the "dht" subcommand
+// It shows the running peer's DHT node and the content hashes of the files
+// it announced, or looks up the providers of a content hash
+func runDHT(args []string) {
+	fs := flag.NewFlagSet("dht", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	find := fs.String("find", "", "Content hash to look up the providers of")
+	fs.Parse(args)
+
+	if *find != "" {
+		var providers []dht.Provider
+		if err := controlRequest(*addr, http.MethodGet, "/dht?find="+url.QueryEscape(*find), nil, &providers); err != nil {
+			log.Fatal(err)
+		}
+		if len(providers) == 0 {
+			fmt.Println("No providers found")
+			return
+		}
+		for _, pr := range providers {
+			fmt.Printf("%-20s %-24s %s\n", pr.PeerID, pr.Addr, pr.Name)
+		}
+		return
+	}
+
+	var status peer.DHTStatus
+	if err := controlRequest(*addr, http.MethodGet, "/dht", nil, &status); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("%d contacts, %d provider records for %d hashes stored for other peers\n", status.Contacts, status.Providers, status.Keys)
+	for _, a := range status.Announced {
+		fmt.Printf("%s  %s (on %d nodes)\n", a.Hash, a.Name, a.Nodes)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// runDisk implements the "disk" subcommand
+// It prints how much space the running peer's directories take up
+func runDisk(args []string) {
+	fs := flag.NewFlagSet("disk", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	fs.Parse(args)
+
+	var u peer.DiskUsage
+	if err := controlRequest(*addr, http.MethodGet, "/disk", nil, &u); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Shared:   %s in %d files\n", formatSize(u.SharedBytes), u.SharedFiles)
+	fmt.Printf("Received: %s in %d files", formatSize(u.ReceivedBytes), u.ReceivedFiles)
+	if u.ReceivedLimit > 0 {
+		fmt.Printf(" (limit %s, evicting %s first)", formatSize(u.ReceivedLimit), u.Eviction)
+	}
+	fmt.Println()
+}
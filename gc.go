@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// runGC implements the "gc" subcommand
+// It makes the running peer remove stale partial downloads and records now
+// rather than waiting for the background collection
+func runGC(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	maxAge := fs.Duration("max-age", 24*time.Hour, "Remove files and records older than this, 0 for everything not in use")
+	fs.Parse(args)
+
+	var res peer.GCResult
+	path := "/gc?max_age=" + url.QueryEscape(maxAge.String())
+	if err := controlRequest(*addr, http.MethodPost, path, nil, &res); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Removed %d files (%s) and %d source records\n", res.Files, formatSize(res.Bytes), res.Sources)
+}
@@ -1,3 +1,5 @@
 module joeyyy09/P2P-FileTransfer-Go
 
-go 1.22.4
+go 1.24
+
+require golang.org/x/text v0.21.0
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/grpclite"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	grpcService          = "/p2p.control.v1.PeerControl/"
+	grpcProgressInterval = 500 * time.Millisecond // Least time between a transfer's events when nothing else sets it
+	grpcWatchBuffer      = 256                    // Events a slow watcher may fall behind by before some are dropped
+)
+
+// grpcServer serves the PeerControl gRPC service of proto/control.proto
+type grpcServer struct {
+	peer      *peer.Peer
+	progress  *progressHub
+	server    *grpclite.Server
+	anyOutput bool // Let transfers save files outside the received directory
+}
+
+// startGRPC starts the gRPC control service on addr
+// addr should be a loopback address; the service is unauthenticated
+// progress: Hub the peer publishes its transfers' progress on
+// anyOutput: Accept output paths outside the received directory
+func startGRPC(addr string, p *peer.Peer, progress *progressHub, anyOutput bool) (*grpcServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start gRPC service: %v", err)
+	}
+	g := &grpcServer{peer: p, progress: progress, server: grpclite.NewServer(), anyOutput: anyOutput}
+	g.server.Handle(grpcService+"RequestFile", g.requestFile)
+	g.server.Handle(grpcService+"ListPeers", g.listPeers)
+	g.server.Handle(grpcService+"ListSharedFiles", g.listSharedFiles)
+	g.server.HandleStream(grpcService+"WatchTransfers", g.watchTransfers)
+
+	go func() {
+		if err := g.server.Serve(ln); err != nil {
+			logging.Errorf(log.Default(), "gRPC service stopped: %v", err)
+		}
+	}()
+	logging.Infof(log.Default(), "gRPC service listening on %s", ln.Addr())
+	return g, nil
+}
+
+// Close stops the gRPC service
+func (g *grpcServer) Close() error {
+	return g.server.Close()
+}
+
+// requestFile receives a file, answering once it's saved
+func (g *grpcServer) requestFile(ctx context.Context, req []grpclite.Field) (grpclite.Message, error) {
+	var file, output, priority string
+	var peers []string
+	for _, f := range req {
+		switch f.Num {
+		case 1:
+			file = f.String()
+		case 2:
+			peers = append(peers, f.String())
+		case 3:
+			output = f.String()
+		case 4:
+			priority = f.String()
+		}
+	}
+	if file == "" || len(peers) == 0 {
+		return nil, grpclite.Errorf(grpclite.InvalidArgument, "a transfer needs a file and peers")
+	}
+	prio, err := protocol.ParsePriority(priority)
+	if err != nil {
+		return nil, grpclite.Errorf(grpclite.InvalidArgument, "%v", err)
+	}
+	if output != "" && !g.anyOutput {
+		if err := g.peer.CheckReceivedPath(output); err != nil {
+			return nil, grpclite.Errorf(grpclite.PermissionDenied, "output must be inside the received directory (see -control-any-output): %v", err)
+		}
+	}
+
+	logging.Infof(log.Default(), "Receiving %s through the gRPC service", file)
+	path, err := g.peer.Download(ctx, file, peer.DownloadOptions{Peers: peers, Priority: prio, Output: output})
+	if err != nil {
+		return nil, err
+	}
+	var resp grpclite.Message
+	resp.String(1, path)
+	return resp, nil
+}
+
+// listPeers lists the peers seen so far
+func (g *grpcServer) listPeers(ctx context.Context, req []grpclite.Field) (grpclite.Message, error) {
+	var resp grpclite.Message
+	for _, info := range g.peer.Peers() {
+		var m grpclite.Message
+		m.String(1, info.ID)
+		m.String(2, info.Addr)
+		m.String(3, info.ListenAddr)
+		m.Timestamp(4, info.LastSeen)
+		for _, feature := range info.Features {
+			m.String(5, feature)
+		}
+		m.Bool(6, info.Discovered)
+		resp.Embed(1, m)
+	}
+	return resp, nil
+}
+
+// listSharedFiles lists the shared files, or those a peer shares with
+// this one
+func (g *grpcServer) listSharedFiles(ctx context.Context, req []grpclite.Field) (grpclite.Message, error) {
+	var addr string
+	for _, f := range req {
+		if f.Num == 1 {
+			addr = f.String()
+		}
+	}
+	var files []protocol.ListEntry
+	var err error
+	if addr != "" {
+		if files, err = g.peer.ListFiles(ctx, addr); err != nil {
+			return nil, grpclite.Errorf(grpclite.Unavailable, "%v", err)
+		}
+	} else if files, err = g.peer.SharedFiles(); err != nil {
+		return nil, grpclite.Errorf(grpclite.Internal, "%v", err)
+	}
+
+	var resp grpclite.Message
+	for _, f := range files {
+		var m grpclite.Message
+		m.String(1, f.Name)
+		m.Int(2, f.Size)
+		m.Timestamp(3, f.ModTime)
+		m.Bytes(4, f.Hash)
+		resp.Embed(1, m)
+	}
+	return resp, nil
+}
+
+// watchTransfers streams the transfers in progress, then their progress
+// reports, until the call ends
+func (g *grpcServer) watchTransfers(ctx context.Context, req []grpclite.Field, send func(grpclite.Message) error) error {
+	// Subscribing first leaves no gap between the transfers in progress
+	// and the reports that follow; a report may repeat one of them
+	events := make(chan peer.Progress, grpcWatchBuffer)
+	unsubscribe := g.progress.subscribe(func(pr peer.Progress) {
+		if pr.Finished {
+			select {
+			case events <- pr:
+			case <-ctx.Done():
+			}
+			return
+		}
+		// A watcher falling behind misses reports, but never the last one
+		select {
+		case events <- pr:
+		default:
+		}
+	})
+	defer unsubscribe()
+
+	for _, t := range g.peer.ActiveTransfers() {
+		if err := send(transferEvent(peer.Progress{Transfer: t})); err != nil {
+			return err
+		}
+	}
+	for {
+		select {
+		case pr := <-events:
+			if err := send(transferEvent(pr)); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// transferEvent encodes a progress report as a TransferEvent
+func transferEvent(pr peer.Progress) grpclite.Message {
+	var m grpclite.Message
+	m.Uint(1, pr.ID)
+	m.String(2, pr.FileName)
+	m.String(3, pr.Peer)
+	m.String(4, pr.Direction)
+	m.Int(5, pr.Size)
+	m.Int(6, pr.Done)
+	m.Double(7, pr.Rate)
+	m.Duration(8, pr.ETA)
+	m.Timestamp(9, pr.Started)
+	m.Bool(10, pr.Finished)
+	if pr.Err != nil {
+		m.String(11, pr.Err.Error())
+	}
+	return m
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// healthDialTimeout bounds the reconnection attempt of a readiness check
+const healthDialTimeout = 3 * time.Second
+
+// healthCheck is the outcome of one check in a health report
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthJSON is the response of /healthz and /readyz
+type healthJSON struct {
+	Status string        `json:"status"` // "ok" or "fail"
+	Checks []healthCheck `json:"checks"`
+}
+
+// handleHealthz reports liveness: the peer is running and accepting
+// connections. Failing it means the process should be restarted
+func (c *controlServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, c.livenessChecks())
+}
+
+// handleReadyz reports readiness: in addition to liveness, the configured
+// peer is reachable and the directories are usable. Failing it means the
+// peer shouldn't be sent traffic until it recovers
+func (c *controlServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := c.livenessChecks()
+	checks = append(checks, c.connectivityCheck(), c.diskCheck())
+	writeHealth(w, checks)
+}
+
+func (c *controlServer) livenessChecks() []healthCheck {
+	running := healthCheck{Name: "peer", OK: c.peer.Running()}
+	if !running.OK {
+		running.Detail = "not running"
+	}
+	listener := healthCheck{Name: "listener", OK: c.transport.Listening(), Detail: c.transport.GetListenAddress()}
+	if !listener.OK {
+		listener.Detail = "not accepting connections on " + listener.Detail
+	}
+	return []healthCheck{running, listener}
+}
+
+// connectivityCheck passes if there is a connection to the peer given with
+// -peer, reconnecting if needed; without one, any number of connections will do
+func (c *controlServer) connectivityCheck() healthCheck {
+	check := healthCheck{Name: "connectivity", OK: true}
+	if c.remote == "" || c.transport.Connected(c.remote) {
+		check.Detail = fmt.Sprintf("%d connections", c.transport.ConnectionCount())
+		return check
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- c.transport.ConnectToPeer(c.remote) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			check.OK, check.Detail = false, fmt.Sprintf("%s unreachable: %v", c.remote, err)
+		} else {
+			check.Detail = "reconnected to " + c.remote
+		}
+	case <-time.After(healthDialTimeout):
+		check.OK, check.Detail = false, fmt.Sprintf("%s unreachable: timed out", c.remote)
+	}
+	return check
+}
+
+func (c *controlServer) diskCheck() healthCheck {
+	detail, err := c.peer.CheckDisk()
+	if err != nil {
+		return healthCheck{Name: "disk", Detail: err.Error()}
+	}
+	return healthCheck{Name: "disk", OK: true, Detail: detail}
+}
+
+// writeHealth sends a health report, with status 503 if any check failed
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	report := healthJSON{Status: "ok", Checks: checks}
+	code := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			report.Status = "fail"
+			code = http.StatusServiceUnavailable
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		logging.Errorf(log.Default(), "Health check response failed: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// runIndex implements the "index" subcommand
+// It prints the progress of hashing the running peer's shared directory
+func runIndex(args []string) {
+	fs := flag.NewFlagSet("index", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	fs.Parse(args)
+
+	var prog peer.HashProgress
+	if err := controlRequest(*addr, http.MethodGet, "/index", nil, &prog); err != nil {
+		log.Fatal(err)
+	}
+	switch {
+	case prog.Started.IsZero():
+		fmt.Println("The shared directory hasn't been scanned yet")
+		return
+	case !prog.Running:
+		fmt.Printf("Idle; the last scan hashed %d files (%s) in %v\n", prog.FilesDone, formatSize(prog.Bytes),
+			prog.Finished.Sub(prog.Started).Round(time.Second))
+		return
+	}
+	percent := 100.0
+	if prog.Bytes > 0 {
+		percent = 100 * float64(prog.BytesDone) / float64(prog.Bytes)
+	}
+	fmt.Printf("Hashing: %d of %d files, %s of %s (%.0f%%), running for %v\n", prog.FilesDone, prog.Files,
+		formatSize(prog.BytesDone), formatSize(prog.Bytes), percent, time.Since(prog.Started).Round(time.Second))
+	if len(prog.Current) > 0 {
+		fmt.Printf("Current: %s\n", strings.Join(prog.Current, ", "))
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// jobsKept is how many finished transfers requested through the control
+// API are remembered for GET /transfers/{id}
+const jobsKept = 100
+
+// Outcomes of a requested transfer
+const (
+	jobRunning  = "running"
+	jobDone     = "done"
+	jobFailed   = "failed"
+	jobCanceled = "canceled"
+)
+
+// transferRequestJSON is the body of POST /transfers
+type transferRequestJSON struct {
+	Direction string   `json:"direction"` // "receive" fetches File from Peers, "send" offers the shared File to the one peer in Peers
+	File      string   `json:"file"`
+	Peers     []string `json:"peers"`
+	Output    string   `json:"output,omitempty"`   // Where to save a received file instead of the received directory
+	Priority  string   `json:"priority,omitempty"` // high, normal or low, for receiving
+}
+
+// jobJSON is a transfer requested through the control API
+type jobJSON struct {
+	ID        uint64         `json:"id"`
+	Direction string         `json:"direction"`
+	File      string         `json:"file"`
+	Peers     []string       `json:"peers"`
+	State     string         `json:"state"`          // running, done, failed or canceled
+	Path      string         `json:"path,omitempty"` // Where a received file was saved
+	Error     string         `json:"error,omitempty"`
+	Started   time.Time      `json:"started"`
+	Finished  *time.Time     `json:"finished,omitempty"`
+	Progress  *peer.Transfer `json:"progress,omitempty"` // While running, once the peer has begun moving data
+}
+
+// fileJSON is the control API form of a shared file
+type fileJSON struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Hash     string    `json:"hash,omitempty"` // Content hash in hex, empty until the file is hashed
+}
+
+// job tracks a transfer requested through the control API
+type job struct {
+	info   jobJSON
+	cancel context.CancelFunc
+}
+
+// jobs are the transfers requested through the control API, by ID
+type jobs struct {
+	mu   sync.Mutex
+	seq  uint64
+	byID map[uint64]*job
+}
+
+// handleTransferRequest starts the transfer described by the body of
+// POST /transfers in the background and answers with its ID, to follow
+// it with GET /transfers/{id}
+func (c *controlServer) handleTransferRequest(w http.ResponseWriter, r *http.Request) {
+	var req transferRequestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	priority, err := protocol.ParsePriority(req.Priority)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.File == "" || len(req.Peers) == 0 {
+		http.Error(w, "a transfer needs a file and peers", http.StatusBadRequest)
+		return
+	}
+
+	var run func(ctx context.Context) (string, error)
+	switch req.Direction {
+	case "receive":
+		if err := c.checkOutput(req.Output); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		opts := peer.DownloadOptions{Peers: req.Peers, Priority: priority, Output: req.Output}
+		run = func(ctx context.Context) (string, error) {
+			return c.peer.Download(ctx, req.File, opts)
+		}
+	case "send":
+		if len(req.Peers) != 1 {
+			http.Error(w, "a file is sent to one peer at a time", http.StatusBadRequest)
+			return
+		}
+		run = func(ctx context.Context) (string, error) {
+			return "", c.peer.PushFile(ctx, req.Peers[0], req.File)
+		}
+	default:
+		http.Error(w, `direction must be "receive" or "send"`, http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	j := &job{
+		info:   jobJSON{Direction: req.Direction, File: req.File, Peers: req.Peers, State: jobRunning, Started: time.Now()},
+		cancel: cancel,
+	}
+	c.jobs.add(j)
+	logging.Infof(log.Default(), "Transfer %d requested through the control API: %s %s with %s", j.info.ID, req.Direction, req.File, strings.Join(req.Peers, ", "))
+
+	go func() {
+		defer cancel()
+		path, err := run(ctx)
+		c.jobs.finish(j, path, err, ctx.Err() != nil)
+		if err != nil {
+			logging.Errorf(log.Default(), "Transfer %d requested through the control API failed: %v", j.info.ID, err)
+		}
+	}()
+	writeJSON(w, c.jobs.status(j, nil))
+}
+
+// handleTransfer reports a transfer requested through the control API on
+// GET /transfers/{id} and cancels it on DELETE
+func (c *controlServer) handleTransfer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/transfers/"), 10, 64)
+	if err != nil {
+		http.Error(w, "usage: /transfers/<id>", http.StatusBadRequest)
+		return
+	}
+	c.jobs.mu.Lock()
+	j, ok := c.jobs.byID[id]
+	c.jobs.mu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no transfer %d", id), http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		j.cancel()
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, c.jobs.status(j, c.peer.ActiveTransfers()))
+}
+
+// handleFiles lists the files in the shared directory, or with ?peer=<addr>
+// those the peer at addr shares with this one
+func (c *controlServer) handleFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var files []protocol.ListEntry
+	var err error
+	status := http.StatusInternalServerError
+	if addr := r.URL.Query().Get("peer"); addr != "" {
+		files, err = c.peer.ListFiles(r.Context(), addr)
+		status = http.StatusBadGateway
+	} else {
+		files, err = c.peer.SharedFiles()
+	}
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	out := make([]fileJSON, len(files))
+	for i, f := range files {
+		out[i] = fileJSON{Name: f.Name, Size: f.Size, Modified: f.ModTime, Hash: hex.EncodeToString(f.Hash)}
+	}
+	writeJSON(w, out)
+}
+
+// add registers a requested transfer under a new ID, forgetting the
+// oldest finished ones beyond jobsKept
+func (js *jobs) add(j *job) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	js.seq++
+	j.info.ID = js.seq
+	js.byID[j.info.ID] = j
+
+	var finished []uint64
+	for id, other := range js.byID {
+		if other.info.State != jobRunning {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) > jobsKept {
+		slices.Sort(finished)
+		for _, id := range finished[:len(finished)-jobsKept] {
+			delete(js.byID, id)
+		}
+	}
+}
+
+// finish records the outcome of a requested transfer
+func (js *jobs) finish(j *job, path string, err error, canceled bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	now := time.Now()
+	j.info.Finished = &now
+	switch {
+	case err == nil:
+		j.info.State, j.info.Path = jobDone, path
+	case canceled && errors.Is(err, context.Canceled):
+		j.info.State, j.info.Error = jobCanceled, err.Error()
+	default:
+		j.info.State, j.info.Error = jobFailed, err.Error()
+	}
+}
+
+// status returns a snapshot of a requested transfer, with the progress of
+// the peer's transfer moving its data if it's among active
+func (js *jobs) status(j *job, active []peer.Transfer) jobJSON {
+	js.mu.Lock()
+	info := j.info
+	js.mu.Unlock()
+
+	if info.State != jobRunning {
+		return info
+	}
+	// The peer names a download's peers joined by commas, and a transfer
+	// it falls back to by the one peer it uses
+	joined := strings.Join(info.Peers, ",")
+	for i := len(active) - 1; i >= 0; i-- {
+		t := active[i]
+		if t.Direction == info.Direction && t.FileName == info.File && !t.Started.Before(info.Started) &&
+			(t.Peer == joined || slices.Contains(info.Peers, t.Peer)) {
+			info.Progress = &t
+			break
+		}
+	}
+	return info
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// runKeys implements the "keys" subcommand
+// It lists the peer keys the running peer has pinned, after any alerts
+// about changed keys, or forgets one so the peer's new key is trusted
+func runKeys(args []string) {
+	fs := flag.NewFlagSet("keys", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	forget := fs.String("forget", "", "Peer ID whose pinned key to remove, e.g. after it was replaced on purpose")
+	fs.Parse(args)
+
+	if *forget != "" {
+		if err := controlRequest(*addr, http.MethodDelete, "/keys?id="+url.QueryEscape(*forget), nil, nil); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Forgot the key of %s; the next key it presents will be pinned\n", *forget)
+		return
+	}
+
+	var keys keysJSON
+	if err := controlRequest(*addr, http.MethodGet, "/keys", nil, &keys); err != nil {
+		log.Fatal(err)
+	}
+	for _, a := range keys.Alerts {
+		fmt.Printf("!! %s: peer %s at %s presented a changed key\n", a.Time.Format("2006-01-02 15:04:05"), a.PeerID, a.Addr)
+		fmt.Printf("!!   pinned    %s\n!!   presented %s\n", a.Pinned, a.Presented)
+	}
+	if len(keys.Alerts) > 0 {
+		fmt.Println()
+	}
+
+	fmt.Printf("This peer: %s\n\n", keys.Own)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tKEY\tFIRST SEEN\tLAST SEEN\tADDRESSES")
+	for _, k := range keys.Keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Key, k.FirstSeen.Format("2006-01-02 15:04"), k.LastSeen.Format("2006-01-02 15:04"), strings.Join(k.Addrs, ", "))
+	}
+	w.Flush()
+}
+
+// promptKey asks on the terminal whether to trust the key of a peer seen
+// for the first time; prompts for concurrent connections are asked in turn
+func promptKey() func(transport.PeerIdentity) bool {
+	var mu sync.Mutex
+	stdin := bufio.NewReader(os.Stdin)
+	return func(remote transport.PeerIdentity) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		fmt.Printf("New peer %s at %s presents key %s\nTrust it? [y/N] ", remote.ID, remote.Addr, peer.EncodePublicKey(remote.Key))
+		answer, _ := stdin.ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		return answer == "y" || answer == "yes"
+	}
+}
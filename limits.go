@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// peerLimitFlags collects repeated -peer-limit flags
+type peerLimitFlags map[string]transportRate
+
+func (f peerLimitFlags) String() string {
+	return fmt.Sprint(map[string]transportRate(f))
+}
+
+// Set parses "key=upload/download", e.g. "10.0.0.7=512KB/1MB"; either rate
+// may be empty or 0 for unlimited, and "key=0" removes the override
+func (f peerLimitFlags) Set(s string) error {
+	key, rates, ok := strings.Cut(s, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected host[:port]=upload/download, got %q", s)
+	}
+	up, down, _ := strings.Cut(rates, "/")
+	var l transportRate
+	var err error
+	if l.Upload, err = rateValue(up); err != nil {
+		return err
+	}
+	if l.Download, err = rateValue(down); err != nil {
+		return err
+	}
+	f[key] = l
+	return nil
+}
+
+// rateValue parses a rate flag, where "" and "0" mean unlimited
+func rateValue(s string) (int64, error) {
+	if s == "" || s == "0" {
+		return 0, nil
+	}
+	return parseSize(s)
+}
+
+// runLimits implements the "limits" subcommand
+// Without limit flags it prints the running peer's limits; otherwise it
+// changes the given ones and leaves the rest as they are
+func runLimits(args []string) {
+	fs := flag.NewFlagSet("limits", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	maxUpload := fs.String("max-upload", "", "Total upload rate per second, e.g. 10MB; 0 for unlimited")
+	maxDownload := fs.String("max-download", "", "Total download rate per second; 0 for unlimited")
+	peerLimits := peerLimitFlags{}
+	fs.Var(peerLimits, "peer-limit", "Per-peer rates as host[:port]=upload/download, e.g. 10.0.0.7=512KB/1MB; repeatable, =0 removes")
+	fs.Parse(args)
+
+	var update limitsJSON
+	if *maxUpload != "" {
+		n, err := rateValue(*maxUpload)
+		if err != nil {
+			log.Fatalf("Invalid -max-upload: %v", err)
+		}
+		update.MaxUpload = &n
+	}
+	if *maxDownload != "" {
+		n, err := rateValue(*maxDownload)
+		if err != nil {
+			log.Fatalf("Invalid -max-download: %v", err)
+		}
+		update.MaxDownload = &n
+	}
+	if len(peerLimits) > 0 {
+		update.Peers = peerLimits
+	}
+
+	method, body := http.MethodGet, interface{}(nil)
+	if update.MaxUpload != nil || update.MaxDownload != nil || update.Peers != nil {
+		method, body = http.MethodPut, update
+	}
+	var current limitsJSON
+	if err := controlRequest(*addr, method, "/limits", body, &current); err != nil {
+		log.Fatal(err)
+	}
+	printLimits(current)
+}
+
+// printLimits renders the limits as a table
+func printLimits(l limitsJSON) {
+	rate := func(n int64) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return formatSize(n) + "/s"
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SCOPE\tUPLOAD\tDOWNLOAD")
+	fmt.Fprintf(w, "global\t%s\t%s\n", rate(*l.MaxUpload), rate(*l.MaxDownload))
+	keys := make([]string, 0, len(l.Peers))
+	for key := range l.Peers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", key, rate(l.Peers[key].Upload), rate(l.Peers[key].Download))
+	}
+	w.Flush()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// printListing renders a page of the shared files of a remote peer, as
+// passed on by Peer.ListPages, as a table; files not hashed yet show "-"
+// as their hash
+// header: Whether to print the column names, for the first page
+func printListing(files []protocol.ListEntry, header bool) {
+	if header && len(files) == 0 {
+		fmt.Println("No shared files")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	if header {
+		fmt.Fprintln(w, "NAME\tSIZE\tMODIFIED\tHASH")
+	}
+	for _, f := range files {
+		hash := "-"
+		if len(f.Hash) > 0 {
+			hash = fmt.Sprintf("%x", f.Hash)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Name, formatSize(f.Size), f.ModTime.Local().Format("2006-01-02 15:04:05"), hash)
+	}
+	w.Flush()
+}
+
+// printSearch renders the results of Peer.Search as a table
+func printSearch(results []peer.SearchResult) {
+	if len(results) == 0 {
+		fmt.Println("No matching files")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tPEER\tADDRESS\tHASH")
+	for _, r := range results {
+		hash := "-"
+		if len(r.Hash) > 0 {
+			hash = fmt.Sprintf("%x", r.Hash)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.Name, formatSize(r.Size), r.Peer, r.Addr, hash)
+	}
+	w.Flush()
+}
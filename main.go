@@ -1,47 +1,568 @@
 package main
 
 import (
+	"crypto/ed25519"
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"log"
+	"math"
+	"net"
+	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
 	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/compress"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/config"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/metrics"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
 	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/webui"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bench":
+			runBench(os.Args[2:])
+			return
+		case "limits":
+			runLimits(os.Args[2:])
+			return
+		case "transfers":
+			runTransfers(os.Args[2:])
+			return
+		case "gc":
+			runGC(os.Args[2:])
+			return
+		case "index":
+			runIndex(os.Args[2:])
+			return
+		case "peers":
+			runPeers(os.Args[2:])
+			return
+		case "dht":
+			runDHT(os.Args[2:])
+			return
+		case "tracker":
+			runTracker(os.Args[2:])
+			return
+		case "disk":
+			runDisk(os.Args[2:])
+			return
+		case "channel":
+			runChannel(os.Args[2:])
+			return
+		case "receipts":
+			runReceipts(os.Args[2:])
+			return
+		case "bans":
+			runBans(os.Args[2:])
+			return
+		case "keys":
+			runKeys(os.Args[2:])
+			return
+		case "quarantine":
+			runQuarantine(os.Args[2:])
+			return
+		case "pushes":
+			runPushes(os.Args[2:])
+			return
+		case "snapshot":
+			runSnapshot(os.Args[2:])
+			return
+		case "admin":
+			runAdmin(os.Args[2:])
+			return
+		case "ping":
+			runPing(os.Args[2:])
+			return
+		}
+	}
 	
 	// Basic peer setup flags
-	peerID := flag.String("id", "", "Peer ID (peer1 or peer2)")
+	peerID := flag.String("id", "", "Peer ID, e.g. peer1 (default: derived from the identity key, see -key)")
 	port := flag.String("port", "", "Port to listen on (3000 or 3001)")
+	host := flag.String("host", "localhost", "Host or IP to listen on; 0.0.0.0 lets peers on other hosts connect")
+	mdns := flag.Bool("mdns", false, "Advertise the peer on the local network over mDNS and discover others, so -peer can name them by ID")
+	addrWatch := flag.Duration("addr-watch", 10*time.Second, "How often to check the local addresses and, when they change, announce the new one to peers, trackers, the DHT and mDNS; 0 to not check")
+	useDHT := flag.Bool("dht", false, "Join the distributed hash table, announcing shared files by content hash so peers can find them without knowing an address")
+	bootstrap := flag.String("bootstrap", "", "Comma-separated addresses of peers to join the -dht through (default: none, for the first peer)")
+	tracker := flag.Bool("tracker", false, "Run as a tracker, keeping a registry of the peers that announce themselves and the files they share")
+	trackers := flag.String("trackers", "", "Comma-separated tracker addresses to announce the shared files to, and to ask for the peers holding a file to -receive without -peer")
 	
 	// File operation flags
 	sendFile := flag.String("send", "", "Path to file to send (relative to shared directory)")
+	pushFile := flag.String("push", "", "Shared file to offer to -peer, which saves it if its push policy allows")
+	pushFrom := flag.String("accept-pushes", "", "Comma-separated IDs of peers whose pushed files are accepted without asking")
+	promptPush := flag.Bool("prompt-pushes", false, "Hold files pushed by other peers for a decision with the pushes subcommand instead of refusing them")
+	maxPush := flag.String("max-push-size", "", "Largest file other peers may push, e.g. 1GB (default: unlimited)")
+	pushDirs := flag.Bool("push-dirs", false, "Save pushed files in a subdirectory of the received directory named after the sender")
+	syncPartner := flag.String("sync", "", "Address of a partner peer to push new and modified shared files to as they appear, which must accept pushes from this peer")
+	syncInterval := flag.Duration("sync-interval", 2*time.Second, "How often -sync scans the shared directory for changes")
+	syncDeletes := flag.Int("sync-deletes", 0, "Pass up to this many deletions per -sync scan on to the partner, which applies them with -accept-deletes (default: deletions are not passed on)")
+	acceptDeletes := flag.Bool("accept-deletes", false, "Delete copies of files that peers allowed to push here deleted on their side, as passed on by their -sync-deletes")
+	deleteArchive := flag.String("delete-archive", "", "Move files deleted by -accept-deletes to this directory instead of removing them")
+	pushExpiry := flag.Duration("push-expiry", 0, "How long a -push offer stays valid, including sending the file, e.g. 1h (default: no limit)")
 	receiveFile := flag.String("receive", "", "Name of file to receive")
-	targetPeer := flag.String("peer", "", "Address of peer to connect to (e.g., localhost:3000)")
+	receiveDir := flag.String("receive-dir", "", "Name of a directory on -peer to receive with every file under it, recreating the tree in the received directory")
+	receiveList := flag.String("receive-list", "", "File listing the names of files to receive from -peer, one per line, or - for standard input")
+	batch := flag.Bool("batch", false, "Exit once -receive-dir or -receive-list is done, printing a JSON summary of every file on standard output; the exit code is 0 if all files were received, 2 if some were, 3 if none were")
+	search := flag.String("search", "", "Search the shared files of every known peer and -peer by name: a glob such as '*.iso', or a part of the name")
+	list := flag.Bool("list", false, "List the files -peer shares with their sizes, modification times and content hashes")
+	shellMode := flag.Bool("shell", false, "Read commands such as ls, get and send from the terminal, see help in the shell")
+	listAfter := flag.String("list-after", "", "With -list, resume an interrupted listing from the token it logged")
+	receiveHash := flag.String("receive-hash", "", "Content hash of a file to find through the -dht and download from every peer holding it, as listed by the dht subcommand")
+	followFile := flag.String("follow", "", "Name of a file on -peer to print as it grows, like tail -f")
+	followFrom := flag.Int64("follow-from", -4096, "Byte offset to start -follow at; negative counts back from the end")
+	replicateFile := flag.String("replicate", "", "Name of an append-only file on -peer to keep a copy of, fetching only what was added")
+	replicateInterval := flag.Duration("replicate-interval", 2*time.Second, "How often -replicate checks for new data")
+	channel := flag.String("channel", "", "Name of a signed channel on -peer to verify and download all files of")
+	publisher := flag.String("publisher", "", "Public key the -channel must be signed with, as printed by the publisher")
+	output := flag.String("o", "", "Path to save the -receive or -replicate file to, or a directory to save it in; a named pipe, or - for standard output, gets the -receive file as it arrives without a copy on disk (default: the received directory)")
+	targetPeer := flag.String("peer", "", "Address of peer to connect to (e.g., localhost:3000), or its ID with -mdns; with -receive, a comma-separated list downloads from all of them at once")
+	priority := flag.String("priority", "normal", "Priority of the -receive transfer: high, normal or low")
+	interfaces := flag.String("interfaces", "", "Comma-separated network interfaces or local IPs to spread -receive over, e.g. eth0,wlan0")
+	maxDials := flag.Int("max-dials", 32, "Maximum outgoing connections to set up at once; further ones queue, 0 for no limit")
+	dialWait := flag.Duration("dial-wait", 30*time.Second, "How long an outgoing connection may queue behind -max-dials before failing, 0 to wait indefinitely")
+	connections := flag.Int("connections", 1, "Parallel connections to open to the -peer for -receive, to fill high-latency links")
+	dedup := flag.Bool("dedup", false, "With -receive, fetch only the content-defined chunks of the file that no local file already holds")
+	webSeeds := flag.String("webseed", "", "Comma-separated HTTP web seed URLs; announced when sharing, used as a fallback source with -receive")
 	
 	// Directory flags
 	sharedDir := flag.String("shared", "", "Directory for shared files (default: ./shared{id})")
 	receivedDir := flag.String("received", "", "Directory for received files (default: ./received{id})")
+	tempDir := flag.String("temp-dir", "", "Directory to keep downloads in progress in, e.g. on a fast local disk when -received is on network storage (default: next to each received file)")
+	stateFile := flag.String("state", "", "File to persist peer state to (default: ./state{id}.json)")
+	indexFile := flag.String("index", "", "File to persist the sizes and hashes of shared files to, so they aren't hashed again on start (default: ./index{id}.json)")
+	swarm := flag.String("swarm", "", "Name of a private swarm to join; only peers holding its -swarm-key can connect, and all traffic is encrypted")
+	swarmKeyFile := flag.String("swarm-key", "", "File holding the group secret of the -swarm (default: ./{swarm}.key)")
+	banAfter := flag.Int("ban-after", transport.DefaultBanPolicy.Threshold, "Ban a host after this many failed handshakes, malformed frames or rate violations within -ban-window, 0 to never ban")
+	banWindow := flag.Duration("ban-window", transport.DefaultBanPolicy.Window, "Period the offenses counting towards a ban are counted over")
+	banTime := flag.Duration("ban-time", transport.DefaultBanPolicy.Duration, "Length of a host's first ban; each further ban doubles it up to -max-ban-time")
+	maxBanTime := flag.Duration("max-ban-time", transport.DefaultBanPolicy.MaxDuration, "Longest a host is banned for")
+	maxMsgRate := flag.Int("max-msg-rate", 0, "Messages per second a host may send; every second over it counts towards a ban, 0 for no limit")
+	useTLS := flag.Bool("tls", false, "Encrypt connections with TLS; every peer must use it. Without -tls-cert a self-signed certificate is generated on first run")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate for -tls (default: ./tls{id}.crt)")
+	tlsKey := flag.String("tls-key", "", "PEM private key of the -tls-cert (default: ./tls{id}.key)")
+	tlsCA := flag.String("tls-ca", "", "PEM file of CA certificates that must sign the certificates of other peers (default: accept any)")
+	tlsClientAuth := flag.Bool("tls-client-auth", false, "Require peers that connect to present a certificate signed by -tls-ca")
+	useNoise := flag.Bool("noise", false, "Encrypt connections with a Noise_XX handshake, which needs no certificates; every peer must use it")
+	noiseKey := flag.String("noise-key", "", "PEM file holding the static X25519 key for -noise, created if missing (default: ./noise{id}.key)")
+	adminKey := flag.String("admin-key", "", "PEM file holding the operator's Ed25519 admin key, created if missing, for sending commands with the admin subcommand")
+	adminKeys := flag.String("admin-keys", "", "Comma-separated public admin keys of the operators that may manage this peer")
+	confirmKeys := flag.Bool("confirm-keys", false, "Ask on the terminal before trusting the key of a peer seen for the first time")
+	keyFile := flag.String("key", "", "PEM file holding the peer's Ed25519 identity key, created if missing (default: ./key{id}.pem)")
+	progressEvery := flag.Duration("progress", 0, "Log the progress of each transfer this often, e.g. 1s, instead of drawing progress bars (default: disabled)")
+	progressBars := flag.Bool("progress-bars", true, "Draw a live progress bar for each transfer when the log goes to a terminal")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for active transfers on shutdown")
+	onConflict := flag.String("on-conflict", "overwrite", "What to do when a received file already exists: overwrite, rename or skip")
+	preserveMeta := flag.Bool("preserve-meta", false, "Transfer permissions, ownership (as root) and extended attributes in the user.* namespace")
+	permMode := flag.String("perms", "fixed", "How received files get their mode: fixed (-file-mode and -dir-mode), umask (those minus the umask) or sender (the sender's mode)")
+	fileMode := flag.String("file-mode", "0644", "Mode of received files, in octal")
+	dirMode := flag.String("dir-mode", "0755", "Mode of directories created for received files, in octal")
+	owner := flag.String("owner", "", "Owner of received files as uid:gid, applied when running as root (default: the process's)")
+	maxReceived := flag.String("max-received", "", "Maximum total size of the received directory, e.g. 10GB; older files are evicted (default: unlimited)")
+	evict := flag.String("evict", "oldest", "Which received files -max-received evicts first: oldest or lru (least recently read)")
+	gcMaxAge := flag.Duration("gc-max-age", 0, "Remove partial downloads and source records older than this in the background, e.g. 24h (default: disabled)")
+	quarantineDir := flag.String("quarantine", "", "Directory to keep received files that fail a check in, for inspection (default: discard them)")
+	acceptTypes := flag.String("accept-types", "", "Comma-separated content type prefixes to accept in received files, e.g. image/,application/pdf (default: all)")
+	disableFeatures := flag.String("disable-features", "", "Comma-separated features not to offer other peers: "+strings.Join(protocol.Features(), ", "))
+	reshare := flag.Bool("reshare", false, "Serve received files to other peers by linking them into the shared directory")
+	cacheSize := flag.String("cache-size", "", "Memory for caching served files, e.g. 64MB (default: no cache)")
+	readAhead := flag.Int("read-ahead", 2, "Pieces to read from disk ahead of chunk requests being served, 0 to disable")
+	maxUpload := flag.String("max-upload", "", "Maximum total upload rate to all peers per second, e.g. 10MB; 0 for unlimited (default: unlimited)")
+	maxDownload := flag.String("max-download", "", "Maximum total download rate from all peers per second, e.g. 20MB; 0 for unlimited (default: unlimited)")
+	peerLimits := peerLimitFlags{}
+	flag.Var(peerLimits, "peer-limit", "Per-peer rates tightening -max-upload and -max-download, as host[:port]=upload/download, e.g. 10.0.0.7=512KB/1MB; repeatable, =0 lifts a cap from the config file")
+	diskRate := flag.String("disk-rate", "", "Maximum disk throughput for file reads and writes per second, e.g. 50MB (default: unlimited)")
+	diskIOPS := flag.Int("disk-iops", 0, "Maximum file read and write operations per second, 0 for unlimited")
+	hashWorkers := flag.Int("hash-workers", 1, "Shared files hashed at once in the background")
+	serveWorkers := flag.Int("serve-workers", 4, "File, piece and manifest requests from other peers served at once; further ones are queued")
+	hashRate := flag.String("hash-rate", "", "Maximum read throughput for hashing shared files in the background per second, e.g. 20MB (default: unlimited)")
+	hashAlgos := flag.String("hash", "", "Hash algorithms whole-file transfers are checked with, most preferred first, e.g. blake3,sha256; one of sha256, blake3, xxh64 (default: sha256, taking any)")
+	compression := flag.String("compress", "", "Compress file payloads on the wire, most preferred first, e.g. zstd,gzip; one of zstd, gzip (default: none asked for, taking any)")
+	controlAddr := flag.String("control", "", "Address for the local control API used by subcommands, e.g. localhost:9000 (default: disabled)")
+	controlToken := flag.String("control-token", "", "File holding a token the control API requires as a bearer token, created with a random one if missing; subcommands send it from $"+controlTokenEnv+" (default: none)")
+	controlAnyOutput := flag.Bool("control-any-output", false, "Let the control API and gRPC service save files outside the received directory")
+	grpcAddr := flag.String("grpc", "", "Address for the gRPC control service described in proto/control.proto, e.g. localhost:9090 (default: disabled)")
+	webUIAddr := flag.String("webui", "", "Address to serve a web dashboard of the peer on, e.g. localhost:8080 (default: disabled)")
+	pieceSize := flag.String("piece-size", "1MB", "Size of the pieces shared files are hashed and served in, from 16KB to 16MB; peers finding each other's files by hash must agree on it")
+	codec := flag.String("codec", protocol.CodecGob, "Comma-separated message codecs to offer the peers this one connects to, most preferred first: gob, json or proto; incoming connections take either")
+	maxMessage := flag.String("max-message", "256MB", "Longest message to accept from a peer; peers sending longer ones are disconnected, and peers that know the limit don't send them")
+	logLevel := flag.String("log-level", "info", "Lowest level of log lines to write: "+strings.Join(logging.Levels(), ", ")+"; warn leaves out routine progress, error everything but failures")
+	configFile := flag.String("config", "", "Config file; explicit flags override its values. Send SIGHUP to reload")
 	
 	flag.Parse()
 
-	if *peerID == "" || *port == "" {
-		log.Fatal("Please provide -id and -port flags")
+	stringFlags := map[string]*string{
+		"id":         peerID,
+		"port":       port,
+		"host":       host,
+		"shared":     sharedDir,
+		"received":   receivedDir,
+		"state":      stateFile,
+		"index":      indexFile,
+		"cache-size": cacheSize,
+		"max-received": maxReceived,
+		"evict":      evict,
+		"swarm":      swarm,
+		"swarm-key":  swarmKeyFile,
+		"tls-cert":   tlsCert,
+		"tls-key":    tlsKey,
+		"tls-ca":     tlsCA,
+		"noise-key":  noiseKey,
+		"perms":      permMode,
+		"file-mode":  fileMode,
+		"dir-mode":   dirMode,
+		"owner":      owner,
+		"sync":       syncPartner,
+		"piece-size": pieceSize,
+		"codec":      codec,
+		"max-message": maxMessage,
+		"max-upload": maxUpload,
+		"max-download": maxDownload,
+		"log-level": logLevel,
+	}
+	switches := map[string]*bool{
+		"tls":             useTLS,
+		"tls-client-auth": tlsClientAuth,
+	}
+	var cfg *config.Config
+	if *configFile != "" {
+		var err error
+		if cfg, err = config.Load(*configFile); err != nil {
+			log.Fatal(err)
+		}
+		applyConfigFile(cfg, stringFlags, switches)
+	}
+	level, err := logging.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.SetLevel(level)
+
+	if *port == "" {
+		log.Fatal("Please provide the -port flag")
 	}
 
-	// Set default directories if not specified
+	// Set default directories if not specified; without an -id they are
+	// ./shared, ./received and so on
+	suffix := ""
+	if *peerID != "" {
+		suffix = dirSuffix(*peerID)
+	}
 	if *sharedDir == "" {
-		*sharedDir = filepath.Join(".", "shared"+(*peerID)[4:])
+		*sharedDir = filepath.Join(".", "shared"+suffix)
 	}
 	if *receivedDir == "" {
-		*receivedDir = filepath.Join(".", "received"+(*peerID)[4:])
+		*receivedDir = filepath.Join(".", "received"+suffix)
+	}
+	if *stateFile == "" {
+		*stateFile = filepath.Join(".", "state"+suffix+".json")
+	}
+	if *indexFile == "" {
+		*indexFile = filepath.Join(".", "index"+suffix+".json")
+	}
+	if *keyFile == "" {
+		*keyFile = filepath.Join(".", "key"+suffix+".pem")
+	}
+	identity, err := peer.LoadOrCreateKey(*keyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	logging.Infof(log.Default(), "Identity key %s", peer.EncodePublicKey(identity.Public().(ed25519.PublicKey)))
+	if *peerID == "" {
+		*peerID = peer.KeyID(identity.Public().(ed25519.PublicKey))
+	}
+
+	var locals []string
+	if *interfaces != "" {
+		for _, name := range strings.Split(*interfaces, ",") {
+			local, err := transport.InterfaceAddr(strings.TrimSpace(name))
+			if err != nil {
+				log.Fatal(err)
+			}
+			locals = append(locals, local)
+		}
 	}
 
 	// Create and start peer
-	transport := transport.NewTCPTransport("localhost:" + *port)
-	p, err := peer.New(*peerID, "localhost:"+*port, *sharedDir, *receivedDir, transport)
+	transportOpts := []transport.TCPOption{
+		transport.WithDialLimit(*maxDials, *dialWait),
+		transport.WithBanPolicy(transport.BanPolicy{
+			Threshold:      *banAfter,
+			Window:         *banWindow,
+			Duration:       *banTime,
+			MaxDuration:    *maxBanTime,
+			MaxMessageRate: *maxMsgRate,
+		}),
+	}
+	if *useTLS {
+		if *tlsCert == "" {
+			*tlsCert = filepath.Join(".", "tls"+suffix+".crt")
+		}
+		if *tlsKey == "" {
+			*tlsKey = filepath.Join(".", "tls"+suffix+".key")
+		}
+		config, generated, err := transport.LoadTLS(transport.TLSOptions{
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			CAFile:     *tlsCA,
+			ClientAuth: *tlsClientAuth,
+			SelfSigned: *tlsCA == "",
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if generated {
+			logging.Infof(log.Default(), "Generated self-signed TLS certificate %s", *tlsCert)
+		}
+		transportOpts = append(transportOpts, transport.WithTLS(config))
+	} else if *tlsCA != "" || *tlsClientAuth {
+		log.Fatal("-tls-ca and -tls-client-auth need -tls")
+	}
+	if *useNoise {
+		if *noiseKey == "" {
+			*noiseKey = filepath.Join(".", "noise"+suffix+".key")
+		}
+		key, generated, err := transport.LoadOrCreateNoiseKey(*noiseKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if generated {
+			logging.Infof(log.Default(), "Generated Noise static key %s", *noiseKey)
+		}
+		transportOpts = append(transportOpts, transport.WithNoise(key))
+	}
+	if *swarm != "" {
+		if *swarmKeyFile == "" {
+			*swarmKeyFile = filepath.Join(".", *swarm+".key")
+		}
+		key, err := transport.LoadSwarmKey(*swarm, *swarmKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		transportOpts = append(transportOpts, transport.WithSwarm(key))
+		logging.Infof(log.Default(), "Joined private swarm %s", key.Name())
+	}
+	codecs := strings.Split(*codec, ",")
+	for i, name := range codecs {
+		codecs[i] = strings.TrimSpace(name)
+		if err := transport.ValidCodec(codecs[i]); err != nil {
+			log.Fatal(err)
+		}
+	}
+	transportOpts = append(transportOpts, transport.WithCodec(codecs...))
+	maxMessageSize, err := parseSize(*maxMessage)
+	if err != nil || maxMessageSize < 0 || maxMessageSize > math.MaxUint32 {
+		log.Fatalf("Invalid -max-message %q: want a size under 4GB, or 0 for no limit", *maxMessage)
+	}
+	transportOpts = append(transportOpts, transport.WithMaxMessageSize(uint32(maxMessageSize)))
+	if *batch && *receiveDir == "" && *receiveList == "" {
+		log.Fatal("-batch needs -receive-dir or -receive-list")
+	}
+	transport := transport.NewTCPTransport(net.JoinHostPort(*host, *port), transportOpts...)
+	if err := applyRateLimits(transport, cfg, stringFlags, peerLimits); err != nil {
+		log.Fatal(err)
+	}
+	if cfg != nil {
+		if err := applySocketOptions(transport, cfg); err != nil {
+			log.Fatal(err)
+		}
+	}
+	conflict, err := peer.ParseConflictPolicy(*onConflict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	perms, err := permissions(*permMode, *fileMode, *dirMode, *owner)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := []peer.Option{peer.WithStateFile(*stateFile), peer.WithIndexFile(*indexFile), peer.WithConflictPolicy(conflict), peer.WithIdentityKey(identity), peer.WithPermissions(perms)}
+	if *preserveMeta {
+		opts = append(opts, peer.WithPreserveMetadata())
+	}
+	// The gRPC service streams the same reports to its watchers
+	var progress *progressHub
+	if *grpcAddr != "" {
+		progress = newProgressHub()
+	}
+	if *progressEvery > 0 {
+		opts = append(opts, peer.WithProgress(progress.tee(logProgress), *progressEvery))
+	} else if *progressBars && isTerminal(os.Stderr) {
+		bars := newProgressBars(os.Stderr)
+		log.SetOutput(bars)
+		opts = append(opts, peer.WithProgress(progress.tee(bars.update), barInterval))
+	} else if progress != nil {
+		opts = append(opts, peer.WithProgress(progress.publish, grpcProgressInterval))
+	}
+	if *confirmKeys {
+		opts = append(opts, peer.WithKeyPrompt(promptKey()))
+	}
+	if *adminKey != "" {
+		key, err := peer.LoadOrCreateKey(*adminKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logging.Infof(log.Default(), "Admin key %s", peer.EncodePublicKey(key.Public().(ed25519.PublicKey)))
+		opts = append(opts, peer.WithAdminKey(key))
+	}
+	if *adminKeys != "" {
+		var keys []ed25519.PublicKey
+		for _, s := range strings.Split(*adminKeys, ",") {
+			key, err := peer.ParsePublicKey(strings.TrimSpace(s))
+			if err != nil {
+				log.Fatalf("Invalid -admin-keys: %v", err)
+			}
+			keys = append(keys, key)
+		}
+		opts = append(opts, peer.WithAdminKeys(keys...))
+	}
+	if *quarantineDir != "" {
+		opts = append(opts, peer.WithQuarantine(*quarantineDir))
+	}
+	if *tempDir != "" {
+		opts = append(opts, peer.WithTempDir(*tempDir))
+	}
+	if *acceptTypes != "" {
+		opts = append(opts, peer.WithReceiveFilter(typeFilter(strings.Split(*acceptTypes, ","))))
+	}
+	if *disableFeatures != "" {
+		names := strings.Split(*disableFeatures, ",")
+		for _, name := range names {
+			if !slices.Contains(protocol.Features(), name) {
+				log.Fatalf("Unknown feature %q, expected one of: %s", name, strings.Join(protocol.Features(), ", "))
+			}
+		}
+		opts = append(opts, peer.WithoutFeatures(names...))
+	}
+	if *pushFrom != "" || *promptPush || *acceptDeletes {
+		policy := peer.PushPolicy{Prompt: *promptPush, PeerDirs: *pushDirs, Deletes: *acceptDeletes, ArchiveDir: *deleteArchive}
+		if *pushFrom != "" {
+			policy.Allow = strings.Split(*pushFrom, ",")
+		}
+		if policy.MaxSize, err = optionalSize(*maxPush); err != nil {
+			log.Fatalf("max-push-size: %v", err)
+		}
+		opts = append(opts, peer.WithPushPolicy(policy))
+	}
+	if *pushExpiry > 0 {
+		opts = append(opts, peer.WithOfferExpiry(*pushExpiry))
+	}
+	if *syncPartner != "" {
+		if *syncInterval <= 0 {
+			log.Fatal("-sync-interval must be positive")
+		}
+		opts = append(opts, peer.WithSyncPartner(*syncPartner, *syncInterval), peer.WithSyncDeletes(*syncDeletes))
+	}
+	if cfg != nil {
+		acl, err := accessControl(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if acl != nil {
+			opts = append(opts, peer.WithACL(*acl))
+		}
+		rules, err := syncRules(cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, peer.WithSyncRules(rules))
+	}
+	if *reshare {
+		opts = append(opts, peer.WithReshare())
+	}
+	opts = append(opts, peer.WithGarbageCollection(*gcMaxAge))
+	receivedLimit, eviction, err := receivedLimit(*maxReceived, *evict)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts = append(opts, peer.WithReceivedLimit(receivedLimit, eviction))
+	if *cacheSize != "" {
+		size, err := parseSize(*cacheSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, peer.WithReadCache(size))
+	}
+	opts = append(opts, peer.WithReadAhead(*readAhead))
+	opts = append(opts, peer.WithServeWorkers(*serveWorkers))
+	pieceBytes, err := parseSize(*pieceSize)
+	if err != nil {
+		log.Fatalf("Invalid -piece-size: %v", err)
+	}
+	opts = append(opts, peer.WithPieceSize(pieceBytes))
+	var diskBytes int64
+	if *diskRate != "" {
+		if diskBytes, err = parseSize(*diskRate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts = append(opts, peer.WithDiskLimit(diskBytes, *diskIOPS))
+	var hashBytes int64
+	if *hashRate != "" {
+		if hashBytes, err = parseSize(*hashRate); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts = append(opts, peer.WithHashing(*hashWorkers, hashBytes))
+	if *hashAlgos != "" {
+		names, err := checksum.Parse(*hashAlgos)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, peer.WithHashAlgorithms(names...))
+	}
+	if *compression != "" {
+		names, err := compress.Parse(*compression)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, peer.WithCompression(names...))
+	}
+	var seeds []string
+	if *webSeeds != "" {
+		seeds = strings.Split(*webSeeds, ",")
+		opts = append(opts, peer.WithWebSeeds(seeds...))
+	}
+	if len(locals) > 0 {
+		opts = append(opts, peer.WithInterfaces(locals...))
+		logging.Infof(log.Default(), "Spreading downloads over paths from %s", strings.Join(locals, ", "))
+	}
+	if *connections > 1 {
+		opts = append(opts, peer.WithConnections(*connections))
+	}
+	if *mdns {
+		opts = append(opts, peer.WithDiscovery(discoveryInterval))
+	}
+	if *addrWatch > 0 {
+		opts = append(opts, peer.WithAddressWatch(*addrWatch))
+	}
+	if *tracker {
+		opts = append(opts, peer.WithTracker())
+	}
+	if *trackers != "" {
+		opts = append(opts, peer.WithTrackers(strings.Split(*trackers, ",")...))
+	}
+	if *useDHT {
+		var nodes []string
+		if *bootstrap != "" {
+			nodes = strings.Split(*bootstrap, ",")
+		}
+		opts = append(opts, peer.WithDHT(nodes...))
+	}
+	p, err := peer.New(*peerID, net.JoinHostPort(*host, *port), *sharedDir, *receivedDir, transport, opts...)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -49,27 +570,303 @@ func main() {
 	if err := p.Start(); err != nil {
 		log.Fatal(err)
 	}
+	if cfg != nil && len(cfg.Peers) > 0 {
+		go contactPeers(p, cfg.Peers)
+	}
+	if *mdns && *targetPeer != "" {
+		if *targetPeer, err = discoverPeers(p, *targetPeer); err != nil {
+			log.Fatal(err)
+		}
+	}
+	p.Metrics().GaugeFunc("p2p_dials_active", "Outgoing connections being set up", func() float64 {
+		active, _ := transport.DialStats()
+		return float64(active)
+	})
+	p.Metrics().GaugeFunc("p2p_dials_queued", "Outgoing connections waiting for -max-dials", func() float64 {
+		_, queued := transport.DialStats()
+		return float64(queued)
+	})
+	if cfg != nil && cfg.Metrics.Sink != "" {
+		m := cfg.Metrics
+		pusher, err := metrics.NewPusher(p.Metrics(), m.Sink, m.Address, m.Prefix, m.Interval, log.Default())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pusher.Close()
+		logging.Infof(log.Default(), "Pushing metrics to %s server %s", m.Sink, m.Address)
+	}
+	if *controlAddr != "" {
+		var token string
+		if *controlToken != "" {
+			if token, err = loadControlToken(*controlToken); err != nil {
+				log.Fatal(err)
+			}
+		}
+		control, err := startControl(*controlAddr, p, transport, *targetPeer, token, *controlAnyOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer control.Close()
+	}
+	if *grpcAddr != "" {
+		service, err := startGRPC(*grpcAddr, p, progress, *controlAnyOutput)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer service.Close()
+	}
+	if *webUIAddr != "" {
+		ln, err := net.Listen("tcp", *webUIAddr)
+		if err != nil {
+			log.Fatalf("Failed to start web UI: %v", err)
+		}
+		ui := webui.New(p, log.Default())
+		go func() {
+			if err := ui.Serve(ln); err != nil {
+				logging.Errorf(log.Default(), "Web UI stopped: %v", err)
+			}
+		}()
+		defer ui.Close()
+		logging.Infof(log.Default(), "Web UI at http://%s/", ln.Addr())
+	}
+
+	// Keep program running until interrupted, then shut down gracefully.
+	// SIGHUP reloads the config file without dropping connections
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	// Handle file operations
-	if *receiveFile != "" {
+	transferPriority, err := protocol.ParsePriority(*priority)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var batchExit *int // Exit code once a -batch run is done
+	if *receiveHash != "" {
+		if !*useDHT {
+			log.Fatal("Please join the DHT with -dht to look up -receive-hash")
+		}
+		hash, err := hex.DecodeString(*receiveHash)
+		if err != nil {
+			log.Fatalf("Invalid -receive-hash: %v", err)
+		}
+		go func() {
+			opts := peer.DownloadOptions{WebSeeds: seeds, Priority: transferPriority, Output: *output}
+			if _, err := p.DownloadContent(context.Background(), hash, opts); err != nil && !errors.Is(err, peer.ErrClosed) {
+				logging.Errorf(log.Default(), "File receive error: %v", err)
+			}
+		}()
+	} else if *receiveFile != "" && isStreamOutput(*output) {
 		if *targetPeer == "" {
 			log.Fatal("Please specify peer address with -peer flag")
 		}
-		if err := p.RequestFile(*targetPeer, *receiveFile); err != nil {
-			log.Printf("File receive error: %v", err)
+		// Opening a named pipe waits for a reader
+		go func() {
+			if err := receiveToPipe(p, *targetPeer, *receiveFile, *output); err != nil {
+				logging.Errorf(log.Default(), "File receive error: %v", err)
+			}
+		}()
+	} else if *receiveFile != "" && (*dedup || len(seeds) > 0 || len(locals) > 0 || *connections > 1 || strings.Contains(*targetPeer, ",") || (*targetPeer == "" && *trackers != "")) {
+		// Download piece by piece from every -peer at once, or those the
+		// -trackers list, falling back to the web seeds when the peers are
+		// unreachable or can't serve the file, and striping the pieces
+		// across the -interfaces and -connections; with -dedup, only the
+		// chunks not held locally are fetched
+		var peers []string
+		if *targetPeer != "" {
+			peers = strings.Split(*targetPeer, ",")
+		}
+		if _, err := p.Download(context.Background(), *receiveFile, peer.DownloadOptions{Peers: peers, WebSeeds: seeds, Priority: transferPriority, Output: *output, Dedup: *dedup}); err != nil {
+			logging.Errorf(log.Default(), "File receive error: %v", err)
+		}
+	} else if *receiveFile != "" {
+		if *targetPeer == "" {
+			log.Fatal("Please specify peer address with -peer flag")
+		}
+		if err := p.RequestFileTo(*targetPeer, *receiveFile, *output, transferPriority); err != nil {
+			logging.Errorf(log.Default(), "File receive error: %v", err)
+		}
+	} else if *receiveDir != "" || *receiveList != "" {
+		if *targetPeer == "" {
+			log.Fatal("Please specify peer address with -peer flag")
+		}
+		var results []peer.FileResult
+		var err error
+		if *receiveDir != "" {
+			results, err = p.RequestDirResults(context.Background(), *targetPeer, *receiveDir)
+		} else {
+			var names []string
+			if names, err = readNameList(*receiveList); err == nil {
+				opts := peer.DownloadOptions{Peers: strings.Split(*targetPeer, ","), WebSeeds: seeds, Priority: transferPriority}
+				results, err = receiveNames(context.Background(), p, names, opts)
+			}
+		}
+		summary, code := summarize(results, err)
+		if *batch {
+			printSummary(os.Stdout, summary)
+			batchExit = &code
+		} else if err != nil {
+			logging.Errorf(log.Default(), "Batch receive error: %v", err)
+		} else {
+			logging.Infof(log.Default(), "Received %d of %d files", summary.OK, summary.Total)
+		}
+	} else if *followFile != "" {
+		if *targetPeer == "" {
+			log.Fatal("Please specify peer address with -peer flag")
+		}
+		go func() {
+			if err := p.Follow(context.Background(), *targetPeer, *followFile, *followFrom, os.Stdout); err != nil && !errors.Is(err, peer.ErrClosed) {
+				logging.Errorf(log.Default(), "Follow error: %v", err)
+			}
+		}()
+	} else if *channel != "" {
+		if *targetPeer == "" || *publisher == "" {
+			log.Fatal("Please specify the -peer to fetch the channel from and its -publisher key")
+		}
+		key, err := peer.ParsePublicKey(*publisher)
+		if err != nil {
+			log.Fatal(err)
+		}
+		ch, paths, err := p.SyncChannel(context.Background(), *channel, key, []string{*targetPeer})
+		if err != nil {
+			logging.Errorf(log.Default(), "Channel sync error: %v", err)
+		} else {
+			logging.Infof(log.Default(), "Channel %s version %d: %d verified files received", ch.Name, ch.Version, len(paths))
+		}
+	} else if *replicateFile != "" {
+		if *targetPeer == "" {
+			log.Fatal("Please specify peer address with -peer flag")
+		}
+		go func() {
+			opts := peer.ReplicateOptions{Interval: *replicateInterval, Output: *output}
+			if err := p.Replicate(context.Background(), *targetPeer, *replicateFile, opts); err != nil && !errors.Is(err, peer.ErrClosed) {
+				logging.Errorf(log.Default(), "Replication error: %v", err)
+			}
+		}()
+	} else if *pushFile != "" {
+		if *targetPeer == "" {
+			log.Fatal("Please specify peer address with -peer flag")
+		}
+		if err := p.PushFile(context.Background(), *targetPeer, *pushFile); err != nil {
+			logging.Errorf(log.Default(), "Push error: %v", err)
+		} else {
+			logging.Infof(log.Default(), "Pushed %s to %s", *pushFile, *targetPeer)
+		}
+	} else if *list {
+		if *targetPeer == "" {
+			log.Fatal("Please specify peer address with -peer flag")
+		}
+		// Pages are printed as they arrive, so listing a huge share shows
+		// progress and can be resumed where it failed
+		listed, resume := 0, *listAfter
+		err := p.ListPages(context.Background(), *targetPeer, *listAfter, func(files []protocol.ListEntry, next string) error {
+			printListing(files, listed == 0)
+			listed += len(files)
+			resume = next
+			return nil
+		})
+		if err != nil {
+			logging.Errorf(log.Default(), "List error: %v", err)
+			if resume != "" {
+				logging.Infof(log.Default(), "Resume the listing with -list-after %q", resume)
+			}
+		}
+	} else if *search != "" {
+		// Peers given with -peer join those already known
+		if *targetPeer != "" {
+			for _, addr := range strings.Split(*targetPeer, ",") {
+				if _, err := p.PeerFeatures(context.Background(), addr); err != nil {
+					logging.Warnf(log.Default(), "Could not reach %s: %v", addr, err)
+				}
+			}
+		}
+		results, err := p.Search(context.Background(), *search)
+		if err != nil {
+			logging.Errorf(log.Default(), "Search error: %v", err)
+		} else {
+			printSearch(results)
 		}
 	} else if *sendFile != "" {
 		if err := p.SendFile(*sendFile); err != nil {
-			log.Printf("File send error: %v", err)
+			logging.Errorf(log.Default(), "File send error: %v", err)
 		} else {
-			log.Printf("Ready to send file: %s", *sendFile)
+			logging.Infof(log.Default(), "Ready to send file: %s", *sendFile)
 		}
 	} else {
-		log.Printf("Peer %s listening on %s", *peerID, *port)
-		log.Printf("Shared directory: %s", *sharedDir)
-		log.Printf("Received files directory: %s", *receivedDir)
+		logging.Infof(log.Default(), "Peer %s listening on %s", *peerID, *port)
+		logging.Infof(log.Default(), "Shared directory: %s", *sharedDir)
+		logging.Infof(log.Default(), "Received files directory: %s", *receivedDir)
+	}
+	if *shellMode {
+		go stdinShell(p, sigCh)
+	}
+
+	// A -batch run is done by now, so there's no signal to wait for
+	for batchExit == nil {
+		if sig := <-sigCh; sig != syscall.SIGHUP {
+			break
+		}
+		if *configFile == "" {
+			logging.Warnf(log.Default(), "Received SIGHUP but no -config file was given")
+			continue
+		}
+		logging.Infof(log.Default(), "Reloading config from %s", *configFile)
+		if err := reloadConfig(p, transport, *configFile, stringFlags, switches, peerLimits); err != nil {
+			logging.Errorf(log.Default(), "Config reload failed: %v", err)
+		}
+	}
+
+	logging.Infof(log.Default(), "Shutting down, waiting up to %v for active transfers", *shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if err := p.Close(ctx); err != nil {
+		logging.Errorf(log.Default(), "Shutdown error: %v", err)
+	}
+	if batchExit != nil {
+		os.Exit(*batchExit)
+	}
+}
+
+// isStreamOutput reports whether -o names a named pipe or standard output,
+// which receive the file as it arrives
+func isStreamOutput(path string) bool {
+	if path == "-" {
+		return true
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.Mode()&os.ModeNamedPipe != 0
+}
+
+// receiveToPipe writes a file to a named pipe, or standard output for "-",
+// as it arrives from addr, closing it at the end so the reader sees the
+// end of the data
+func receiveToPipe(p *peer.Peer, addr, name, path string) error {
+	out := os.Stdout
+	if path != "-" {
+		var err error
+		if out, err = os.OpenFile(path, os.O_WRONLY, 0); err != nil {
+			return err
+		}
+	}
+	_, err := p.ReceiveTo(context.Background(), addr, name, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
 	}
+	return err
+}
 
-	// Keep program running
-	select {}
-} 
\ No newline at end of file
+// dirSuffix derives the suffix of the default directory names from the
+// peer ID: "peer1" gives "1", any other ID is used whole. Characters that
+// aren't valid in Windows file names are replaced so the defaults work on
+// every platform
+func dirSuffix(id string) string {
+	suffix := strings.TrimPrefix(id, "peer")
+	if suffix == "" {
+		suffix = id
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, suffix)
+}
@@ -0,0 +1,187 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Access is an operation an ACL rule grants to a group of peers
+type Access string
+
+const (
+	AccessRead  Access = "read"  // Fetch shared files, their manifests and pieces, follow them and read channels
+	AccessWrite Access = "write" // Push files, which are then accepted without asking
+	AccessAdmin Access = "admin" // Everything
+)
+
+// EveryoneGroup names, in ACL rules, the group every peer belongs to
+const EveryoneGroup = "*"
+
+// ACL grants other peers access by the groups their IDs are assigned to,
+// e.g. admins, readers and writers, so that rules don't have to list every
+// peer. Peer IDs are those proven by the identity key on connection
+// A peer has an access if any rule of a group it belongs to grants it
+type ACL struct {
+	Groups map[string][]string // Peer IDs by group name
+	Rules  map[string]ACLRule  // What each group may do, by group name
+}
+
+// ACLRule grants a group access to all shared files or some of them
+type ACLRule struct {
+	Access []Access
+	Paths  []string // path.Match patterns of the file names covered, e.g. "releases/*"; empty for all
+}
+
+// ParseAccess validates an access name
+func ParseAccess(s string) (Access, error) {
+	switch a := Access(s); a {
+	case AccessRead, AccessWrite, AccessAdmin:
+		return a, nil
+	}
+	return "", fmt.Errorf("unknown access %q, expected read, write or admin", s)
+}
+
+// Validate checks that every rule names a defined group, known accesses
+// and well-formed patterns
+func (a *ACL) Validate() error {
+	for group, rule := range a.Rules {
+		if _, ok := a.Groups[group]; !ok && group != EveryoneGroup {
+			return fmt.Errorf("rule for undefined group %q", group)
+		}
+		for _, access := range rule.Access {
+			if _, err := ParseAccess(string(access)); err != nil {
+				return fmt.Errorf("rule for group %q: %v", group, err)
+			}
+		}
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule for group %q: invalid path %q: %v", group, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// GroupsOf returns the groups a peer is assigned to, not counting
+// EveryoneGroup
+func (a *ACL) GroupsOf(id string) []string {
+	var groups []string
+	for group, ids := range a.Groups {
+		if slices.Contains(ids, id) {
+			groups = append(groups, group)
+		}
+	}
+	slices.Sort(groups)
+	return groups
+}
+
+// Allows reports whether the peer id has access to the file name
+// name: Wire name of the file, or empty for requests not about a file;
+// names aclName refuses are never allowed
+func (a *ACL) Allows(id, name string, access Access) bool {
+	if name != "" {
+		var err error
+		if name, err = aclName(name); err != nil {
+			return false
+		}
+	}
+	for _, group := range append(a.GroupsOf(id), EveryoneGroup) {
+		rule, ok := a.Rules[group]
+		if ok && rule.grants(access) && rule.covers(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// aclName returns the form of a wire name that rules are matched against,
+// cleaned as localPath cleans it before the file is opened
+// Returns: An error for absolute names and names holding backslashes or
+// ".." segments, which could match a rule for one file and open another
+func aclName(name string) (string, error) {
+	if strings.Contains(name, `\`) {
+		return "", fmt.Errorf("invalid file name %q: contains a backslash", name)
+	}
+	if strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("invalid file name %q: must be relative", name)
+	}
+	if slices.Contains(strings.Split(name, "/"), "..") {
+		return "", fmt.Errorf("invalid file name %q: contains ..", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", errors.New("empty file name")
+	}
+	return clean, nil
+}
+
+// grants reports whether the rule grants access
+func (r ACLRule) grants(access Access) bool {
+	return slices.Contains(r.Access, access) || slices.Contains(r.Access, AccessAdmin)
+}
+
+// covers reports whether the rule applies to the file name
+func (r ACLRule) covers(name string) bool {
+	if len(r.Paths) == 0 || name == "" {
+		return true
+	}
+	for _, pattern := range r.Paths {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithACL restricts what other peers may do to what the ACL grants them
+// Without an ACL every peer may read shared files, and pushes are left to
+// the push policy
+func WithACL(acl ACL) Option {
+	return func(p *Peer) {
+		p.acl = &acl
+	}
+}
+
+// SetACL replaces the ACL while the peer runs; nil removes it
+// Requests already being served are not affected
+func (p *Peer) SetACL(acl *ACL) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.acl = acl
+}
+
+// ACL returns the ACL in effect, nil if there is none
+func (p *Peer) ACL() *ACL {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.acl
+}
+
+// checkAccess applies the ACL to a request from another peer
+func (p *Peer) checkAccess(from, name string, access Access) error {
+	p.mu.Lock()
+	acl := p.acl
+	p.mu.Unlock()
+	if acl == nil || acl.Allows(from, name, access) {
+		return nil
+	}
+	if _, err := aclName(name); name != "" && err != nil {
+		return err
+	}
+	if name == "" {
+		return fmt.Errorf("peer %s has no %s access", from, access)
+	}
+	return fmt.Errorf("peer %s has no %s access to %s", from, access, name)
+}
+
+// writeAllowed reports whether the ACL lets a peer push the file name
+// Without an ACL no peer is allowed, leaving pushes to the push policy
+func (p *Peer) writeAllowed(from, name string) bool {
+	p.mu.Lock()
+	acl := p.acl
+	p.mu.Unlock()
+	return acl != nil && acl.Allows(from, name, AccessWrite)
+}
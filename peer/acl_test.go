@@ -0,0 +1,99 @@
+package peer
+
+import "testing"
+
+func testACL() *ACL {
+	return &ACL{
+		Groups: map[string][]string{
+			"readers": {"reader"},
+			"writers": {"writer"},
+			"admins":  {"admin"},
+		},
+		Rules: map[string]ACLRule{
+			"readers": {Access: []Access{AccessRead}, Paths: []string{"releases/*"}},
+			"writers": {Access: []Access{AccessWrite}, Paths: []string{"incoming/*"}},
+			"admins":  {Access: []Access{AccessAdmin}},
+		},
+	}
+}
+
+func TestACLAllows(t *testing.T) {
+	acl := testACL()
+	tests := []struct {
+		id, name string
+		access   Access
+		want     bool
+	}{
+		{"reader", "releases/a.iso", AccessRead, true},
+		{"reader", "releases/./a.iso", AccessRead, true},
+		{"reader", "releases//a.iso", AccessRead, true},
+		{"reader", "releases/a.iso", AccessWrite, false},
+		{"reader", "private/keys.txt", AccessRead, false},
+		{"reader", "releases/sub/a.iso", AccessRead, false},
+		{"reader", "", AccessRead, true},
+		{"stranger", "releases/a.iso", AccessRead, false},
+		{"writer", "incoming/a.txt", AccessWrite, true},
+		{"writer", "incoming/a.txt", AccessRead, false},
+		{"admin", "anything/at/all", AccessWrite, true},
+
+		// Names that match a rule as written but open another file once
+		// localPath cleans them
+		{"reader", `releases/..\private\keys.txt`, AccessRead, false},
+		{"reader", "releases/../private/keys.txt", AccessRead, false},
+		{"reader", `releases\a.iso`, AccessRead, false},
+		{"reader", "releases/a/..", AccessRead, false},
+		{"reader", "/releases/a.iso", AccessRead, false},
+		{"writer", `incoming/..\.bashrc`, AccessWrite, false},
+		{"writer", "incoming/../.bashrc", AccessWrite, false},
+		{"admin", "../outside", AccessRead, false},
+		{"admin", ".", AccessRead, false},
+	}
+	for _, tt := range tests {
+		if got := acl.Allows(tt.id, tt.name, tt.access); got != tt.want {
+			t.Errorf("Allows(%q, %q, %s) = %v, want %v", tt.id, tt.name, tt.access, got, tt.want)
+		}
+	}
+}
+
+// TestACLMatchesOpenedFile checks that every name a rule allows opens a
+// file the rule covers
+func TestACLMatchesOpenedFile(t *testing.T) {
+	acl := testACL()
+	names := []string{
+		"releases/a.iso", "releases/./a.iso", `releases/..\private\keys.txt`,
+		"releases/../private/keys.txt", `releases\..\..\etc\passwd`, "releases/x/../../private/k",
+	}
+	for _, name := range names {
+		if !acl.Allows("reader", name, AccessRead) {
+			continue
+		}
+		local, err := localPath("/share", name)
+		if err != nil {
+			t.Errorf("%q allowed but not openable: %v", name, err)
+			continue
+		}
+		if local != "/share/releases/a.iso" {
+			t.Errorf("%q allowed but opens %s", name, local)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	p := &Peer{}
+	if err := p.checkAccess("reader", "private/keys.txt", AccessRead); err != nil {
+		t.Fatalf("without an ACL: %v", err)
+	}
+	p.SetACL(testACL())
+	if err := p.checkAccess("reader", "releases/a.iso", AccessRead); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkAccess("reader", `releases/..\private\keys.txt`, AccessRead); err == nil {
+		t.Fatal("traversal out of releases/ allowed")
+	}
+	if p.writeAllowed("writer", "incoming/../.bashrc") {
+		t.Fatal("push outside incoming/ allowed")
+	}
+	if !p.writeAllowed("writer", "incoming/a.txt") {
+		t.Fatal("push to incoming/ refused")
+	}
+}
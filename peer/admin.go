@@ -0,0 +1,267 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// Commands operators can send to the peers they manage, see Admin
+const (
+	AdminStatus = "status" // Reports AdminStatusResult
+	AdminLimits = "limits" // Changes the bandwidth caps, taking AdminLimitsArgs
+	AdminSync   = "sync"   // Starts syncing a channel, taking AdminSyncArgs
+)
+
+const (
+	adminTimeout = 5 * time.Second  // Time allowed for a managed peer to answer
+	adminMaxSkew = 5 * time.Minute  // How far a request's time may be from the clock
+	adminSync    = 30 * time.Minute // Time allowed for a sync started by an operator
+)
+
+// AdminStatusResult is a managed peer's answer to AdminStatus
+type AdminStatusResult struct {
+	ID        string     `json:"id"`
+	Addr      string     `json:"addr"`
+	Features  []string   `json:"features"`
+	Peers     int        `json:"peers"` // Remote peers seen so far
+	Transfers []Transfer `json:"transfers"`
+	Disk      DiskUsage  `json:"disk"`
+	Upload    int64      `json:"upload"`   // Upload cap in bytes per second, 0 if unlimited
+	Download  int64      `json:"download"` // Download cap in bytes per second, 0 if unlimited
+}
+
+// AdminLimitsArgs are the arguments of AdminLimits; nil fields are left
+// unchanged and 0 means unlimited
+type AdminLimitsArgs struct {
+	Upload   *int64 `json:"upload,omitempty"`
+	Download *int64 `json:"download,omitempty"`
+}
+
+// AdminSyncArgs are the arguments of AdminSync, see SyncChannel
+type AdminSyncArgs struct {
+	Channel   string   `json:"channel"`
+	Publisher string   `json:"publisher"` // Publisher key, as formatted by EncodePublicKey
+	Peers     []string `json:"peers"`     // Addresses of the peers offering the channel
+}
+
+// limitsTransport is implemented by transports with adjustable bandwidth
+// caps, such as transport.TCPTransport
+type limitsTransport interface {
+	RateLimits() transport.Limits
+	SetRateLimits(global transport.Limits)
+}
+
+// WithAdminKeys lets operators holding one of the given admin keys manage
+// the peer over the P2P protocol, see Admin; without any, admin commands
+// are refused
+func WithAdminKeys(keys ...ed25519.PublicKey) Option {
+	return func(p *Peer) {
+		p.adminKeys = keys
+	}
+}
+
+// WithAdminKey sets the key the peer signs admin commands to other peers
+// with; keep it apart from the identity key, see WithIdentityKey
+func WithAdminKey(key ed25519.PrivateKey) Option {
+	return func(p *Peer) {
+		p.adminKey = key
+	}
+}
+
+// Admin sends an admin command to the peer at addr, signed with the admin
+// key, and decodes its result into result
+// args: Arguments of the command, e.g. AdminLimitsArgs, or nil
+// result: Where to decode the result, e.g. *AdminStatusResult, or nil
+func (p *Peer) Admin(ctx context.Context, addr, command string, args, result interface{}) error {
+	if p.adminKey == nil {
+		return errors.New("no admin key, see WithAdminKey")
+	}
+	ctx, cancel := context.WithTimeout(ctx, adminTimeout)
+	defer cancel()
+
+	// The hello tells the managed peer's ID, which the request is bound to
+	id := p.nextCallID()
+	msg, err := p.call(ctx, addr, protocol.MessageTypeHello, id, &protocol.Hello{ID: id, Features: p.Features()})
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(msg.Payload.(*protocol.HelloResponse).Features, protocol.FeatureAdmin) {
+		return fmt.Errorf("peer %s does not take admin commands", addr)
+	}
+
+	req := &protocol.AdminRequest{ID: p.nextCallID(), Target: msg.From, Command: command, Time: time.Now().UTC(), Nonce: make([]byte, 16)}
+	if args != nil {
+		if req.Args, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+	if _, err := rand.Read(req.Nonce); err != nil {
+		return err
+	}
+	if err := req.Sign(p.adminKey); err != nil {
+		return err
+	}
+	msg, err = p.call(ctx, addr, protocol.MessageTypeAdminRequest, req.ID, req)
+	if err != nil {
+		return err
+	}
+	resp := msg.Payload.(*protocol.AdminResponse)
+	if resp.Error != "" {
+		return errors.New(resp.Error)
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(resp.Result, result)
+}
+
+// handleAdminRequest runs a command from an operator once its signature,
+// key, target and freshness check out
+func (p *Peer) handleAdminRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.AdminRequest)
+	resp := &protocol.AdminResponse{ID: req.ID}
+
+	result, err := p.runAdmin(msg.From, req)
+	if err != nil {
+		logging.Warnf(p.logger, "Refused admin command %q from %s: %v", req.Command, msg.From, err)
+		resp.Error = err.Error()
+	} else if resp.Result, err = json.Marshal(result); err != nil {
+		resp.Error = err.Error()
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeAdminResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending admin response: %v", err)
+	}
+}
+
+// handleAdminResponse delivers an admin result to the waiting call
+func (p *Peer) handleAdminResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.AdminResponse).ID, msg)
+}
+
+// runAdmin authorizes and runs an admin request
+func (p *Peer) runAdmin(from string, req *protocol.AdminRequest) (interface{}, error) {
+	if err := p.checkAdmin(req); err != nil {
+		return nil, err
+	}
+	logging.Infof(p.logger, "Admin command %q from %s with key %s", req.Command, from, EncodePublicKey(req.Key))
+
+	switch req.Command {
+	case AdminStatus:
+		return p.adminStatus()
+	case AdminLimits:
+		var args AdminLimitsArgs
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %v", err)
+		}
+		t, ok := p.transport.(limitsTransport)
+		if !ok {
+			return nil, errors.New("transport has no rate limits")
+		}
+		limits := t.RateLimits()
+		if args.Upload != nil {
+			limits.Upload = *args.Upload
+		}
+		if args.Download != nil {
+			limits.Download = *args.Download
+		}
+		if limits.Upload < 0 || limits.Download < 0 {
+			return nil, errors.New("rates must not be negative")
+		}
+		t.SetRateLimits(limits)
+		logging.Infof(p.logger, "Rate limits changed by an operator: upload %d B/s, download %d B/s", limits.Upload, limits.Download)
+		return p.adminStatus()
+	case AdminSync:
+		var args AdminSyncArgs
+		if err := json.Unmarshal(req.Args, &args); err != nil {
+			return nil, fmt.Errorf("invalid arguments: %v", err)
+		}
+		publisher, err := ParsePublicKey(args.Publisher)
+		if err != nil {
+			return nil, err
+		}
+		if args.Channel == "" || len(args.Peers) == 0 {
+			return nil, errors.New("sync needs a channel and the peers offering it")
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), adminSync)
+			defer cancel()
+			ch, paths, err := p.SyncChannel(ctx, args.Channel, publisher, args.Peers)
+			if err != nil {
+				logging.Errorf(p.logger, "Sync of channel %s started by an operator failed: %v", args.Channel, err)
+				return
+			}
+			logging.Infof(p.logger, "Synced channel %s version %d started by an operator: %d files", ch.Name, ch.Version, len(paths))
+		}()
+		return struct{}{}, nil
+	default:
+		return nil, fmt.Errorf("unknown admin command %q", req.Command)
+	}
+}
+
+// checkAdmin verifies that a request is signed by an admin key of this
+// peer, addressed to it, recent and not seen before
+func (p *Peer) checkAdmin(req *protocol.AdminRequest) error {
+	if err := p.checkFeature(protocol.FeatureAdmin); err != nil {
+		return err
+	}
+	if err := req.Verify(); err != nil {
+		return err
+	}
+	if !slices.ContainsFunc(p.adminKeys, func(k ed25519.PublicKey) bool { return bytes.Equal(k, req.Key) }) {
+		return fmt.Errorf("key %s may not administer this peer", EncodePublicKey(req.Key))
+	}
+	if req.Target != p.id {
+		return fmt.Errorf("request is addressed to peer %q", req.Target)
+	}
+	now := time.Now()
+	if d := now.Sub(req.Time); d > adminMaxSkew || d < -adminMaxSkew {
+		return fmt.Errorf("request time %s is too far from this peer's clock", req.Time.Format(time.RFC3339))
+	}
+
+	// Nonces are remembered for as long as their requests would be accepted
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for nonce, seen := range p.adminNonces {
+		if now.Sub(seen) > 2*adminMaxSkew {
+			delete(p.adminNonces, nonce)
+		}
+	}
+	if _, ok := p.adminNonces[string(req.Nonce)]; ok || len(req.Nonce) < 16 {
+		return errors.New("request was replayed")
+	}
+	p.adminNonces[string(req.Nonce)] = now
+	return nil
+}
+
+// adminStatus collects the answer to AdminStatus
+func (p *Peer) adminStatus() (*AdminStatusResult, error) {
+	disk, err := p.DiskUsage()
+	if err != nil {
+		return nil, err
+	}
+	s := &AdminStatusResult{
+		ID:        p.id,
+		Addr:      p.listenAddr,
+		Features:  p.Features(),
+		Peers:     len(p.Peers()),
+		Transfers: p.ActiveTransfers(),
+		Disk:      disk,
+	}
+	if t, ok := p.transport.(limitsTransport); ok {
+		limits := t.RateLimits()
+		s.Upload, s.Download = limits.Upload, limits.Download
+	}
+	return s, nil
+}
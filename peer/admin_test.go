@@ -0,0 +1,116 @@
+package peer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+func newAdminKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// adminRequest returns a request to peer1 signed with key after edit
+// changed it
+func adminRequest(t *testing.T, key ed25519.PrivateKey, edit func(*protocol.AdminRequest)) *protocol.AdminRequest {
+	t.Helper()
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	req := &protocol.AdminRequest{ID: 1, Target: "peer1", Command: AdminStatus, Time: time.Now().UTC(), Nonce: nonce}
+	if edit != nil {
+		edit(req)
+	}
+	if err := req.Sign(key); err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestCheckAdmin(t *testing.T) {
+	admin, stranger := newAdminKey(t), newAdminKey(t)
+	p := newTestPeer(t, WithAdminKeys(admin.Public().(ed25519.PublicKey)))
+
+	if err := p.checkAdmin(adminRequest(t, admin, nil)); err != nil {
+		t.Fatalf("valid request refused: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		req  *protocol.AdminRequest
+	}{
+		{"unknown key", adminRequest(t, stranger, nil)},
+		{"other target", adminRequest(t, admin, func(r *protocol.AdminRequest) { r.Target = "peer2" })},
+		{"old", adminRequest(t, admin, func(r *protocol.AdminRequest) { r.Time = r.Time.Add(-adminMaxSkew - time.Minute) })},
+		{"future", adminRequest(t, admin, func(r *protocol.AdminRequest) { r.Time = r.Time.Add(adminMaxSkew + time.Minute) })},
+		{"short nonce", adminRequest(t, admin, func(r *protocol.AdminRequest) { r.Nonce = r.Nonce[:8] })},
+		{"no nonce", adminRequest(t, admin, func(r *protocol.AdminRequest) { r.Nonce = nil })},
+	}
+	for _, tt := range tests {
+		if err := p.checkAdmin(tt.req); err == nil {
+			t.Errorf("%s: request accepted", tt.name)
+		}
+	}
+
+	// Changing a signed request invalidates it
+	tampered := adminRequest(t, admin, nil)
+	tampered.Command = AdminLimits
+	if err := p.checkAdmin(tampered); err == nil {
+		t.Error("request changed after signing accepted")
+	}
+	retargeted := adminRequest(t, admin, nil)
+	retargeted.Target = "peer2"
+	p2 := newTestPeer(t, WithAdminKeys(admin.Public().(ed25519.PublicKey)))
+	p2.id = "peer2"
+	if err := p2.checkAdmin(retargeted); err == nil {
+		t.Error("request readdressed after signing accepted")
+	}
+	unsigned := adminRequest(t, admin, nil)
+	unsigned.Signature = nil
+	if err := p.checkAdmin(unsigned); err == nil {
+		t.Error("unsigned request accepted")
+	}
+	forged := adminRequest(t, stranger, nil)
+	forged.Key = admin.Public().(ed25519.PublicKey)
+	if err := p.checkAdmin(forged); err == nil {
+		t.Error("request signed by another key accepted")
+	}
+}
+
+func TestCheckAdminReplay(t *testing.T) {
+	admin := newAdminKey(t)
+	p := newTestPeer(t, WithAdminKeys(admin.Public().(ed25519.PublicKey)))
+	req := adminRequest(t, admin, nil)
+	if err := p.checkAdmin(req); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.checkAdmin(req); err == nil {
+		t.Fatal("replayed request accepted")
+	}
+
+	// The ID isn't signed, so a replay can't get past by changing it
+	again := *req
+	again.ID++
+	if err := p.checkAdmin(&again); err == nil {
+		t.Fatal("replay with a new ID accepted")
+	}
+}
+
+func TestCheckAdminDisabled(t *testing.T) {
+	admin := newAdminKey(t)
+	p := newTestPeer(t, WithAdminKeys())
+	if err := p.checkAdmin(adminRequest(t, admin, nil)); err == nil {
+		t.Fatal("request accepted by a peer without admin keys")
+	}
+	p = newTestPeer(t, WithAdminKeys(admin.Public().(ed25519.PublicKey)), WithoutFeatures(protocol.FeatureAdmin))
+	if err := p.checkAdmin(adminRequest(t, admin, nil)); err == nil {
+		t.Fatal("request accepted with the admin feature disabled")
+	}
+}
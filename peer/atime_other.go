@@ -0,0 +1,13 @@
+//go:build !linux
+
+package peer
+
+import (
+	"os"
+	"time"
+)
+
+// accessTime is not supported on this platform
+func accessTime(info os.FileInfo) (time.Time, bool) {
+	return time.Time{}, false
+}
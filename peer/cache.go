@@ -0,0 +1,238 @@
+package peer
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxCacheEntryShare limits a single cached range to this fraction of the
+// cache, so one large file can't flush everything else
+const maxCacheEntryShare = 4
+
+// CacheStats reports how effective the read cache is and how much memory it uses
+type CacheStats struct {
+	Hits      uint64 // Reads served from memory
+	Misses    uint64 // Reads that went to disk
+	Evictions uint64 // Entries dropped to make room
+	Entries   int    // Ranges currently cached
+	Bytes     int64  // Memory held by cached data
+	MaxBytes  int64  // Configured cache size
+}
+
+// HitRatio returns the fraction of reads served from memory
+func (s CacheStats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// WithReadCache keeps up to maxBytes of recently served file data in memory,
+// so files and pieces requested by many peers aren't re-read from disk for
+// each of them. Files larger than a quarter of the cache are only cached
+// piece by piece
+func WithReadCache(maxBytes int64) Option {
+	return func(p *Peer) {
+		if maxBytes > 0 {
+			p.cache = newReadCache(maxBytes)
+		}
+	}
+}
+
+// CacheStats returns the read cache statistics; all zero if the cache is disabled
+func (p *Peer) CacheStats() CacheStats {
+	if p.cache == nil {
+		return CacheStats{}
+	}
+	return p.cache.stats()
+}
+
+// cacheKey identifies a byte range of a file
+type cacheKey struct {
+	path   string
+	offset int64
+	length int64
+}
+
+// cacheEntry is a cached byte range together with the file state it was
+// read from; a file whose size or modification time changed is re-read
+type cacheEntry struct {
+	key     cacheKey
+	size    int64
+	modTime time.Time
+	data    []byte
+}
+
+// readCache is an LRU cache of file ranges read from the shared directory
+// All methods are safe for concurrent use
+type readCache struct {
+	mu      sync.Mutex
+	lru     *list.List // Front is most recently used
+	entries map[cacheKey]*list.Element
+	s       CacheStats
+}
+
+// newReadCache creates a cache holding up to maxBytes of data
+func newReadCache(maxBytes int64) *readCache {
+	return &readCache{
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+		s:       CacheStats{MaxBytes: maxBytes},
+	}
+}
+
+// get returns the cached data for key if it is still current for info
+// The returned slice is shared and must not be modified
+func (c *readCache) get(key cacheKey, info os.FileInfo) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if ok {
+		e := el.Value.(*cacheEntry)
+		if e.size == info.Size() && e.modTime.Equal(info.ModTime()) {
+			c.lru.MoveToFront(el)
+			c.s.Hits++
+			return e.data, true
+		}
+		c.remove(el)
+	}
+	c.s.Misses++
+	return nil, false
+}
+
+// put stores data for key, evicting the least recently used entries to make room
+func (c *readCache) put(key cacheKey, info os.FileInfo, data []byte) {
+	if int64(len(data)) > c.s.MaxBytes/maxCacheEntryShare {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: info.Size(), modTime: info.ModTime(), data: data})
+	c.s.Entries++
+	c.s.Bytes += int64(len(data))
+
+	for c.s.Bytes > c.s.MaxBytes {
+		c.remove(c.lru.Back())
+		c.s.Evictions++
+	}
+}
+
+// remove drops an entry; caller must hold c.mu
+func (c *readCache) remove(el *list.Element) {
+	e := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.s.Entries--
+	c.s.Bytes -= int64(len(e.data))
+}
+
+// stats returns a snapshot of the cache statistics
+func (c *readCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.s
+}
+
+// contains reports whether key is cached and current, without counting
+// a hit or miss or affecting the eviction order
+func (c *readCache) contains(key cacheKey, info os.FileInfo) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return false
+	}
+	e := el.Value.(*cacheEntry)
+	return e.size == info.Size() && e.modTime.Equal(info.ModTime())
+}
+
+// take is like get but removes the entry, for data that is only read once
+func (c *readCache) take(key cacheKey, info os.FileInfo) ([]byte, bool) {
+	data, ok := c.get(key, info)
+	if ok {
+		c.mu.Lock()
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+		}
+		c.mu.Unlock()
+	}
+	return data, ok
+}
+
+// readShared reads a byte range of a shared file, going through the read
+// cache and read-ahead buffer when they are configured. A negative length
+// reads to the end of the file; ranges running past the end are cut short
+// Returns: The data, which must not be modified, and the file's info
+func (p *Peer) readShared(path string, offset, length int64) ([]byte, os.FileInfo, error) {
+	key := cacheKey{path: path, offset: offset, length: length}
+	if p.cache != nil || p.readAhead != nil {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if p.cache != nil {
+			if data, ok := p.cache.get(key, info); ok {
+				return data, info, nil
+			}
+		}
+		if p.readAhead != nil {
+			if data, ok := p.readAhead.buf.take(key, info); ok {
+				if p.cache != nil {
+					p.cache.put(key, info, data)
+				}
+				return data, info, nil
+			}
+		}
+	}
+
+	data, info, err := p.readRange(path, offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.cache != nil {
+		p.cache.put(key, info, data)
+	}
+	return data, info, nil
+}
+
+// readRange reads a byte range of a file from disk, subject to the disk
+// limit; see readShared
+func (p *Peer) readRange(path string, offset, length int64) ([]byte, os.FileInfo, error) {
+	file, err := openShared(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if length < 0 || offset+length > info.Size() {
+		length = info.Size() - offset
+	}
+	if length < 0 {
+		length = 0
+	}
+
+	if err := p.disk.wait(context.Background(), int(length)); err != nil {
+		return nil, nil, err
+	}
+	data := make([]byte, length)
+	n, err := file.ReadAt(data, offset)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
+	}
+	return data[:n], info, nil
+}
@@ -0,0 +1,185 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// PublishChannel signs a channel listing the given shared files with the
+// peer's identity key and serves it to subscribers. Publishing a channel
+// again replaces it with a new version
+// files: Names relative to the shared directory
+// Returns: The signed channel
+func (p *Peer) PublishChannel(name string, files []string) (*protocol.Channel, error) {
+	if p.key == nil {
+		return nil, errors.New("peer has no identity key to sign with")
+	}
+	if name == "" || len(files) == 0 {
+		return nil, errors.New("a channel needs a name and at least one file")
+	}
+
+	ch := &protocol.Channel{Name: name, Version: 1, Published: time.Now().UTC()}
+	for _, file := range files {
+		m, err := p.sharedManifest(wireName(file), protocol.NameEncodingUTF8NFC)
+		if err != nil {
+			return nil, fmt.Errorf("failed to add %s to channel: %v", file, err)
+		}
+		ch.Files = append(ch.Files, m)
+	}
+
+	p.mu.Lock()
+	if prev, ok := p.channels[name]; ok {
+		ch.Version = prev.Version + 1
+	}
+	p.mu.Unlock()
+	if err := ch.Sign(p.key); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.channels[name] = ch
+	p.mu.Unlock()
+	if err := p.saveState(); err != nil {
+		logging.Errorf(p.logger, "Error persisting peer state: %v", err)
+	}
+	logging.Infof(p.logger, "Published channel %s version %d with %d files", name, ch.Version, len(ch.Files))
+	return ch, nil
+}
+
+// FetchChannel asks the peer at addr for a channel and verifies that it
+// was signed by publisher. Verified channels are kept and served to other
+// peers; a version older than one already seen is rejected
+func (p *Peer) FetchChannel(ctx context.Context, addr, name string, publisher ed25519.PublicKey) (*protocol.Channel, error) {
+	id := p.nextCallID()
+	msg, err := p.call(ctx, addr, protocol.MessageTypeChannelRequest, id, &protocol.ChannelRequest{ID: id, Name: name})
+	if err != nil {
+		return nil, err
+	}
+	resp := msg.Payload.(*protocol.ChannelResponse)
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	ch := resp.Channel
+	if ch == nil || ch.Name != name {
+		return nil, fmt.Errorf("peer %s sent no channel %s", addr, name)
+	}
+	if err := ch.Verify(publisher); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if known, ok := p.channels[name]; ok && bytes.Equal(known.Publisher, publisher) {
+		if ch.Version < known.Version {
+			return nil, fmt.Errorf("peer %s sent version %d of channel %s, older than version %d", addr, ch.Version, name, known.Version)
+		}
+	}
+	p.channels[name] = ch
+	return ch, nil
+}
+
+// SyncChannel fetches the newest verified version of a channel offered by
+// the given peers and downloads every file it lists from them, each from
+// the peers whose sync rules select it; see WithSyncRules
+// Nothing is downloaded unless the channel's signature checks out, and
+// each piece is verified against the signed manifests
+// Files the publisher renamed or moved since the version synced before
+// are renamed locally rather than downloaded again
+// Returns: The channel and the paths the files were saved to
+func (p *Peer) SyncChannel(ctx context.Context, name string, publisher ed25519.PublicKey, peers []string) (*protocol.Channel, []string, error) {
+	p.mu.Lock()
+	prev := p.channels[name]
+	p.mu.Unlock()
+	if prev != nil && !bytes.Equal(prev.Publisher, publisher) {
+		prev = nil
+	}
+
+	var ch *protocol.Channel
+	for _, addr := range peers {
+		fetched, err := p.FetchChannel(ctx, addr, name, publisher)
+		if err != nil {
+			logging.Errorf(p.logger, "Could not get channel %s from %s: %v", name, addr, err)
+			continue
+		}
+		if ch == nil || fetched.Version > ch.Version {
+			ch = fetched
+		}
+	}
+	if ch == nil {
+		return nil, nil, fmt.Errorf("no peer provided a valid channel %s", name)
+	}
+
+	moves := channelMoves(prev, ch)
+	var paths []string
+	for _, m := range ch.Files {
+		sources := p.syncSources(m.Name, peers)
+		if len(sources) == 0 {
+			logging.Warnf(p.logger, "Skipping %s of channel %s: excluded by the sync rules", m.Name, name)
+			continue
+		}
+		if old, ok := moves[m.Name]; ok {
+			path, err := p.applyMove(old, m)
+			if err == nil {
+				logging.Infof(p.logger, "Moved %s to %s, renamed in channel %s", old.Name, m.Name, name)
+				p.reshareFile(m.Name, path)
+				paths = append(paths, path)
+				continue
+			}
+			logging.Infof(p.logger, "Downloading %s of channel %s instead of moving %s: %v", m.Name, name, old.Name, err)
+		}
+		path, err := p.Download(ctx, m.Name, DownloadOptions{Peers: sources, Manifest: m})
+		if err != nil {
+			return ch, paths, fmt.Errorf("failed to download %s from channel %s: %v", m.Name, name, err)
+		}
+		paths = append(paths, path)
+	}
+	return ch, paths, nil
+}
+
+// Channels returns the published and verified channels, sorted by name
+func (p *Peer) Channels() []*protocol.Channel {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := make([]*protocol.Channel, 0, len(p.channels))
+	for _, ch := range p.channels {
+		list = append(list, ch)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// handleChannelRequest serves a published or previously verified channel
+func (p *Peer) handleChannelRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.ChannelRequest)
+	resp := &protocol.ChannelResponse{ID: req.ID}
+
+	p.mu.Lock()
+	resp.Channel = p.channels[req.Name]
+	p.mu.Unlock()
+	if resp.Channel == nil {
+		resp.Error = fmt.Sprintf("unknown channel %s", req.Name)
+	}
+	if err := p.checkFeature(protocol.FeatureChannels); err != nil {
+		resp.Channel, resp.Error = nil, err.Error()
+	} else if err := p.checkAccess(msg.From, "", AccessRead); err != nil {
+		resp.Channel, resp.Error = nil, err.Error()
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeChannelResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending channel: %v", err)
+	}
+}
+
+// handleChannelResponse delivers a channel to the waiting FetchChannel call
+func (p *Peer) handleChannelResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.ChannelResponse).ID, msg)
+}
@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// maxChunkLength bounds the piece size a peer is willing to serve
+const maxChunkLength = 16 << 20
+
+// handleChunkRequest serves one piece of a shared file
+func (p *Peer) handleChunkRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.ChunkRequest)
+	resp := &protocol.ChunkData{ID: req.ID, Index: req.Index, Offset: req.Offset}
+
+	var data []byte
+	var size int64
+	err := p.checkAccess(msg.From, req.FileName, AccessRead)
+	if err == nil {
+		data, size, err = p.readChunk(req)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Chunk request for %s piece %d from %s failed: %v", req.FileName, req.Index, msg.From, err)
+		resp.Error = err.Error()
+	} else {
+		resp.Data, resp.Compression = p.compressData(req.Compression, data)
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeChunkData, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending chunk: %v", err)
+		return
+	}
+	if len(data) > 0 {
+		p.noteUpload(msg, req.FileName, size, int64(len(data)))
+		p.notePiece(msg.From, req.FileName, req.Index)
+	}
+}
+
+// readChunk reads the byte range named by a chunk request from the shared directory
+// Returns: The data and the size of the whole file
+func (p *Peer) readChunk(req *protocol.ChunkRequest) ([]byte, int64, error) {
+	p.mu.Lock()
+	closing := p.closing
+	p.mu.Unlock()
+	if closing {
+		return nil, 0, ErrClosed
+	}
+
+	if err := p.checkFeature(protocol.FeatureChunks); err != nil {
+		return nil, 0, err
+	}
+	if req.Offset < 0 || req.Length <= 0 || req.Length > maxChunkLength {
+		return nil, 0, fmt.Errorf("invalid chunk range %d+%d", req.Offset, req.Length)
+	}
+	if err := checkNameEncoding(req.FileName, req.NameEncoding); err != nil {
+		return nil, 0, err
+	}
+	path, err := resolveShared(p.SharedDir(), req.FileName)
+	if err != nil {
+		return nil, 0, err
+	}
+	data, info, err := p.readShared(path, req.Offset, req.Length)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) == 0 {
+		return nil, 0, io.EOF
+	}
+	p.prefetchAfter(path, info, req.Offset, req.Length)
+	return data, info.Size(), nil
+}
+
+// handleChunkData delivers a piece to the waiting fetch or push stream
+func (p *Peer) handleChunkData(msg protocol.Message) {
+	if p.deliverPush(msg) {
+		return
+	}
+	p.completeCall(msg.Payload.(*protocol.ChunkData).ID, msg)
+}
+
+// peerSource fetches pieces from another peer over the transport
+type peerSource struct {
+	p        *Peer
+	addr     string
+	peerID   string            // ID of the peer behind addr, empty if unknown
+	priority *transferPriority // Priority of the download the source serves
+}
+
+func (s *peerSource) String() string {
+	return "peer " + s.addr
+}
+
+func (s *peerSource) id() string {
+	return s.addr
+}
+
+func (s *peerSource) webSeed() bool {
+	return false
+}
+
+// fetch requests one piece and waits for it to arrive
+func (s *peerSource) fetch(ctx context.Context, m *protocol.Manifest, index int) ([]byte, error) {
+	offset, length := m.PieceRange(index)
+	id := s.p.nextCallID()
+	req := &protocol.ChunkRequest{
+		ID:           id,
+		FileName:     m.Name,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		Index:        index,
+		Offset:       offset,
+		Length:       length,
+		Priority:     s.priority.get(),
+		Compression:  s.p.compression,
+	}
+
+	msg, err := s.p.call(ctx, s.addr, protocol.MessageTypeChunkRequest, id, req)
+	if err != nil {
+		return nil, err
+	}
+	data := msg.Payload.(*protocol.ChunkData)
+	if data.Error != "" {
+		return nil, errors.New(data.Error)
+	}
+	return decompressData(data.Compression, data.Data, length)
+}
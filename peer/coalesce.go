@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// sharedDownload is a download that concurrent Download calls for the same
+// file and destination, e.g. one from the command line and one through the
+// control API, wait on together
+type sharedDownload struct {
+	output  string             // Destination all callers asked for
+	callers int                // Calls still waiting for the download, guarded by Peer.mu
+	cancel  context.CancelFunc // Stops the download once no caller waits for it
+	done    chan struct{}      // Closed once path and err are set
+	path    string
+	err     error
+}
+
+// coalesceDownload runs the work of Download once for all the calls made
+// for a file while it is being downloaded to the same destination
+// The download runs until it finishes or every caller's ctx is done; the
+// options of the first call apply, except that a later call can raise the
+// priority
+func (p *Peer) coalesceDownload(ctx context.Context, name string, opts DownloadOptions) (string, error) {
+	p.mu.Lock()
+	d, ok := p.coalesced[name]
+	switch {
+	case ok && d.output != opts.Output:
+		p.mu.Unlock()
+		return "", fmt.Errorf("download of %s to another destination already in progress", name)
+	case ok:
+		d.callers++
+		p.mu.Unlock()
+		logging.Infof(p.logger, "Joining the download of %s already in progress", name)
+		p.raiseDownloadPriority(name, opts.Priority)
+	default:
+		dctx, cancel := context.WithCancel(context.Background())
+		d = &sharedDownload{output: opts.Output, callers: 1, cancel: cancel, done: make(chan struct{})}
+		p.coalesced[name] = d
+		p.mu.Unlock()
+		go func() {
+			d.path, d.err = p.runDownload(dctx, name, opts)
+			p.mu.Lock()
+			delete(p.coalesced, name)
+			p.mu.Unlock()
+			cancel()
+			close(d.done)
+		}()
+	}
+
+	select {
+	case <-d.done:
+		return d.path, d.err
+	case <-ctx.Done():
+	}
+	p.mu.Lock()
+	d.callers--
+	last := d.callers == 0
+	p.mu.Unlock()
+	if last {
+		// Nobody is left to wait for the file, so stop fetching it and
+		// wait for the download to clean up as it would have alone
+		d.cancel()
+		<-d.done
+	}
+	return "", ctx.Err()
+}
+
+// joinsDownload reports whether a file is already being downloaded to
+// output, so that a request for it can rely on that download, raising its
+// priority if need be
+func (p *Peer) joinsDownload(name, output string, priority protocol.Priority) bool {
+	p.mu.Lock()
+	d, ok := p.coalesced[name]
+	p.mu.Unlock()
+	if !ok || d.output != output {
+		return false
+	}
+	logging.Infof(p.logger, "Joining the download of %s already in progress", name)
+	p.raiseDownloadPriority(name, priority)
+	return true
+}
+
+// raiseDownloadPriority raises the priority of a running download to pr
+// if it is lower
+func (p *Peer) raiseDownloadPriority(name string, pr protocol.Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tp, ok := p.downloads[name]; ok && tp.get() < pr {
+		tp.set(pr)
+		p.slots.wakeAll()
+	}
+}
@@ -0,0 +1,87 @@
+package peer
+
+import (
+	"fmt"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/compress"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// maxWholeFile caps a whole-file response once decompressed: sent as it
+// is, the file would have had to fit one message of the default size
+const maxWholeFile = transport.DefaultMaxMessageSize
+
+// WithCompression sets the algorithms file payloads are compressed with,
+// see package compress, most preferred first: requests offer them to the
+// sender, which compresses with the first it also takes, and a sender
+// takes only these. Without it requests ask for no compression and any
+// algorithm is taken
+// Compression pays off for compressible files over slow links; payloads
+// that don't shrink are sent as they are either way
+func WithCompression(names ...string) Option {
+	return func(p *Peer) {
+		p.compression = names
+	}
+}
+
+// compressData compresses a payload for a requester that offered the
+// given algorithms
+// Returns: The payload to send and the algorithm it's compressed with,
+// empty if it's sent as it is
+func (p *Peer) compressData(offered []string, data []byte) ([]byte, string) {
+	name := compress.Negotiate(offered, p.compression)
+	out, used, err := compress.Compress(name, data)
+	if err != nil {
+		logging.Warnf(p.logger, "Error compressing with %s, sending as it is: %v", name, err)
+		return data, ""
+	}
+	return out, used
+}
+
+// decompressData reverses compressData for a payload received
+// maxSize: Size the payload can't exceed once decompressed
+func decompressData(name string, data []byte, maxSize int64) ([]byte, error) {
+	out, err := compress.Decompress(name, data, maxSize)
+	if err != nil {
+		return nil, fmt.Errorf("%s payload: %v", name, err)
+	}
+	return out, nil
+}
+
+// decompressResponse decompresses the data of a whole-file response in
+// place, so that it's checked and saved as sent
+// maxSize: Size the data can't exceed once decompressed, see responseLimit;
+// never the size the sender announced
+func decompressResponse(resp *protocol.FileResponse, maxSize int64) error {
+	if resp.Compression == "" {
+		return nil
+	}
+	data, err := decompressData(resp.Compression, resp.Data, maxSize)
+	if err != nil {
+		return err
+	}
+	resp.Data, resp.Compression = data, ""
+	return nil
+}
+
+// responseLimit returns the most bytes a whole-file response may hold once
+// decompressed, from local limits alone: the size an accepted push
+// offered, the push size limit for unsolicited files, the received
+// directory's cap for files saved there, and maxWholeFile
+// t: The transfer the response belongs to, nil for an unsolicited one
+// output: Where the file is saved, empty for the received directory
+func (p *Peer) responseLimit(t *transfer, output string) int64 {
+	limit := int64(maxWholeFile)
+	if t != nil && t.pushed {
+		limit = min(limit, t.maxSize)
+	}
+	if t == nil && p.pushPolicy != nil && p.pushPolicy.MaxSize > 0 {
+		limit = min(limit, p.pushPolicy.MaxSize)
+	}
+	if received, _ := p.receivedLimitPolicy(); received > 0 && output == "" && (t == nil || t.sink == nil) {
+		limit = min(limit, received)
+	}
+	return limit
+}
@@ -0,0 +1,92 @@
+package peer
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/compress"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// newTestPeer returns a peer on a memory transport that isn't started
+func newTestPeer(t *testing.T, opts ...Option) *Peer {
+	t.Helper()
+	dir := t.TempDir()
+	tr := transport.NewMemoryNetwork().NewTransport("mem:peer")
+	opts = append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	p, err := New("peer1", tr.GetListenAddress(), filepath.Join(dir, "shared"), filepath.Join(dir, "received"), tr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// bomb returns a response whose few bytes of data expand to size bytes,
+// as it announces
+func bomb(t *testing.T, name string, size int) *protocol.FileResponse {
+	t.Helper()
+	data, used, err := compress.Compress(compress.Gzip, make([]byte, size))
+	if err != nil || used != compress.Gzip {
+		t.Fatalf("compressing: %v", err)
+	}
+	return &protocol.FileResponse{Name: name, NameEncoding: protocol.NameEncodingUTF8NFC, Size: int64(size), Data: data, Compression: compress.Gzip}
+}
+
+// TestUnsolicitedNotDecompressed checks that a file nobody asked for is
+// discarded before its data is decompressed
+func TestUnsolicitedNotDecompressed(t *testing.T) {
+	p := newTestPeer(t)
+	resp := bomb(t, "a.bin", 1<<20)
+	p.handleFileResponse(protocol.Message{Type: protocol.MessageTypeFileResponse, From: "stranger", Payload: resp})
+	if resp.Compression != compress.Gzip {
+		t.Fatal("unsolicited response decompressed before it was refused")
+	}
+	if _, err := os.Stat(filepath.Join(p.ReceivedDir(), "a.bin")); !os.IsNotExist(err) {
+		t.Fatalf("unsolicited file saved: %v", err)
+	}
+}
+
+// TestDecompressionCapped checks that an admitted file is decompressed up
+// to the local limit rather than the size the sender announced
+func TestDecompressionCapped(t *testing.T) {
+	p := newTestPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}, MaxSize: 1 << 10}))
+	resp := bomb(t, "a.bin", 1<<20)
+	p.handleFileResponse(protocol.Message{Type: protocol.MessageTypeFileResponse, From: "friend", Payload: resp})
+	if _, err := os.Stat(filepath.Join(p.ReceivedDir(), "a.bin")); !os.IsNotExist(err) {
+		t.Fatalf("file past the push size limit saved: %v", err)
+	}
+
+	if got := p.responseLimit(nil, ""); got != 1<<10 {
+		t.Errorf("responseLimit for an unsolicited file = %d, want %d", got, 1<<10)
+	}
+	if got := p.responseLimit(&transfer{pushed: true, maxSize: 100}, ""); got != 100 {
+		t.Errorf("responseLimit for a push of 100 bytes = %d, want 100", got)
+	}
+	if got := newTestPeer(t).responseLimit(&transfer{}, ""); got != maxWholeFile {
+		t.Errorf("responseLimit for a request = %d, want %d", got, maxWholeFile)
+	}
+}
+
+func TestDecompressResponse(t *testing.T) {
+	data := bytes.Repeat([]byte("hello "), 1000)
+	packed, _, err := compress.Compress(compress.Gzip, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := &protocol.FileResponse{Size: 1, Data: packed, Compression: compress.Gzip}
+	if err := decompressResponse(resp, int64(len(data))); err != nil {
+		t.Fatalf("decompressing within the limit: %v", err)
+	}
+	if !bytes.Equal(resp.Data, data) || resp.Compression != "" {
+		t.Fatal("data not decompressed in place")
+	}
+	resp = &protocol.FileResponse{Size: int64(len(data)), Data: packed, Compression: compress.Gzip}
+	if err := decompressResponse(resp, int64(len(data))-1); err == nil {
+		t.Fatal("decompressed past the limit")
+	}
+}
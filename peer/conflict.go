@@ -0,0 +1,160 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// ConflictPolicy decides what happens when a received file would replace
+// an existing one, including one whose name differs only in case on a
+// case-insensitive filesystem
+type ConflictPolicy int
+
+const (
+	// ConflictOverwrite replaces the existing file
+	ConflictOverwrite ConflictPolicy = iota
+	// ConflictRename saves the new file under a free name like "a (1).txt"
+	ConflictRename
+	// ConflictSkip keeps the existing file and discards the new one
+	ConflictSkip
+)
+
+// ErrConflict is returned when a received file is discarded by ConflictSkip
+var ErrConflict = errors.New("file already exists")
+
+// ParseConflictPolicy parses "overwrite", "rename" or "skip"
+func ParseConflictPolicy(s string) (ConflictPolicy, error) {
+	switch s {
+	case "overwrite":
+		return ConflictOverwrite, nil
+	case "rename":
+		return ConflictRename, nil
+	case "skip":
+		return ConflictSkip, nil
+	}
+	return 0, fmt.Errorf("unknown conflict policy %q", s)
+}
+
+// String returns the name accepted by ParseConflictPolicy
+func (c ConflictPolicy) String() string {
+	switch c {
+	case ConflictRename:
+		return "rename"
+	case ConflictSkip:
+		return "skip"
+	}
+	return "overwrite"
+}
+
+// WithConflictPolicy sets how name collisions in the received directory are handled
+// The default is ConflictOverwrite
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(p *Peer) {
+		p.conflict = policy
+	}
+}
+
+// resolveConflict applies the conflict policy to a destination path
+// Returns: The path to write to, or ErrConflict if the file must be skipped
+func (p *Peer) resolveConflict(path string) (string, error) {
+	existing, err := p.findCollision(path)
+	if err != nil || existing == "" {
+		return path, err
+	}
+
+	switch p.conflict {
+	case ConflictSkip:
+		return "", fmt.Errorf("%w: %s", ErrConflict, existing)
+
+	case ConflictRename:
+		for i := 1; ; i++ {
+			ext := filepath.Ext(path)
+			candidate := fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(path, ext), i, ext)
+			other, err := p.findCollision(candidate)
+			if err != nil {
+				return "", err
+			}
+			if other == "" {
+				logging.Infof(p.logger, "%s already exists, saving as %s", existing, candidate)
+				return candidate, nil
+			}
+		}
+
+	default:
+		// Remove a differently-cased file first; otherwise a
+		// case-insensitive filesystem would keep the old name
+		if existing != path {
+			logging.Infof(p.logger, "Replacing %s, which collides with %s on this filesystem", existing, filepath.Base(path))
+			if err := os.Remove(existing); err != nil {
+				return "", err
+			}
+		}
+		return path, nil
+	}
+}
+
+// findCollision returns the path of an existing entry that path would
+// replace: the path itself, or on a case-insensitive filesystem an entry
+// whose name matches case-insensitively. Returns "" if there is none
+func (p *Peer) findCollision(path string) (string, error) {
+	dir, base := filepath.Split(path)
+	insensitive, err := p.caseInsensitive(filepath.Clean(dir))
+	if err != nil {
+		return "", err
+	}
+
+	if !insensitive {
+		if _, err := os.Lstat(path); err == nil {
+			return path, nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		return "", nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	want := norm.NFC.String(base)
+	for _, e := range entries {
+		if strings.EqualFold(norm.NFC.String(e.Name()), want) {
+			return filepath.Join(dir, e.Name()), nil
+		}
+	}
+	return "", nil
+}
+
+// caseInsensitive reports whether the filesystem holding dir treats names
+// that differ only in case as the same file, probing once per directory
+func (p *Peer) caseInsensitive(dir string) (bool, error) {
+	p.mu.Lock()
+	result, ok := p.caseProbe[dir]
+	p.mu.Unlock()
+	if ok {
+		return result, nil
+	}
+
+	probe, err := os.CreateTemp(dir, ".p2p-case-probe-")
+	if err != nil {
+		return false, err
+	}
+	probe.Close()
+	defer os.Remove(probe.Name())
+
+	upper := filepath.Join(dir, strings.ToUpper(filepath.Base(probe.Name())))
+	_, err = os.Lstat(upper)
+	result = err == nil
+
+	p.mu.Lock()
+	p.caseProbe[dir] = result
+	p.mu.Unlock()
+	return result, nil
+}
@@ -0,0 +1,85 @@
+package peer
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	congestionTarget  = 100 * time.Millisecond // Queueing delay a source's requests may add before its window shrinks
+	congestionBackoff = 0.75                   // Window kept when the queueing delay exceeds the target
+	lossBackoff       = 0.5                    // Window kept when a piece is lost
+	baseDelayWindow   = time.Minute            // How long the lowest piece latency seen stays the baseline
+)
+
+// congestion sizes the request window of one source from the latency of
+// its pieces, in the manner of LEDBAT: the window grows by about one
+// request per window of pieces while latency stays within congestionTarget
+// of the lowest seen, and shrinks once a queue builds up on the path or a
+// piece is lost, leaving room for interactive traffic sharing the link
+// The zero value starts with workersPerSource requests
+type congestion struct {
+	window  float64       // Requests allowed in flight
+	base    time.Duration // Lowest piece latency seen since baseAt
+	baseAt  time.Time
+	latency float64   // Smoothed piece latency in nanoseconds
+	cut     time.Time // Last decrease; the window shrinks at most once per latency
+}
+
+// init gives a zero congestion its starting window
+func (c *congestion) init() {
+	if c.window == 0 {
+		c.window = workersPerSource
+	}
+}
+
+// sample records the latency of a delivered piece
+// Returns: true if the window was decreased because of queueing delay
+func (c *congestion) sample(elapsed time.Duration, now time.Time) bool {
+	c.init()
+	if c.base == 0 || elapsed < c.base || now.Sub(c.baseAt) > baseDelayWindow {
+		c.base, c.baseAt = elapsed, now
+	}
+	c.latency = smooth(c.latency, float64(elapsed))
+
+	if c.queueDelay() > congestionTarget {
+		return c.decrease(congestionBackoff, now)
+	}
+	c.window = math.Min(c.window+1/c.window, maxWorkersPerSource)
+	return false
+}
+
+// lost records a piece that timed out
+// Returns: true if the window was decreased
+func (c *congestion) lost(now time.Time) bool {
+	c.init()
+	return c.decrease(lossBackoff, now)
+}
+
+// decrease shrinks the window by factor unless it did so within the
+// current latency, since pieces already in flight still carry the old queue
+func (c *congestion) decrease(factor float64, now time.Time) bool {
+	if c.window <= 1 || now.Sub(c.cut) < time.Duration(c.latency) {
+		return false
+	}
+	c.cut = now
+	c.window = math.Max(c.window*factor, 1)
+	return true
+}
+
+// queueDelay estimates the delay added by queues on the path, from how far
+// piece latency has risen above its baseline
+func (c *congestion) queueDelay() time.Duration {
+	if d := time.Duration(c.latency) - c.base; d > 0 {
+		return d
+	}
+	return 0
+}
+
+// limit returns the number of requests the window allows in flight
+func (c *congestion) limit() int {
+	if c.window == 0 {
+		return workersPerSource
+	}
+	return int(c.window)
+}
@@ -0,0 +1,408 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	pushDecisionTimeout = 10 * time.Minute // How long an offer may wait to be accepted
+	pushDataTimeout     = 10 * time.Minute // How long an accepted file may take to arrive
+)
+
+// PushPolicy decides which files other peers may push to this one
+// Without a policy every push is refused, except from peers the ACL lets write
+type PushPolicy struct {
+	Allow    []string // IDs of peers whose pushes are accepted without asking
+	Prompt   bool     // Hold pushes from other peers for a decision, see DecidePush, instead of refusing them
+	MaxSize  int64    // Largest file accepted by push, 0 for no limit
+	PeerDirs bool     // Save pushed files under a subdirectory of the received directory named after the sender
+
+	// Deletes applies the deletions passed on by allowed peers that sync
+	// to this one, see WithSyncDeletes; copies changed since they were
+	// synced are kept
+	Deletes bool
+	// ArchiveDir is where deleted files are moved to instead of being
+	// removed, empty to remove them
+	ArchiveDir string
+}
+
+// PendingPush is a push offer waiting for a decision
+type PendingPush struct {
+	ID   uint64    `json:"id"`   // Identifies the offer in DecidePush
+	Peer string    `json:"peer"` // ID of the offering peer
+	Name string    `json:"name"` // Wire name of the offered file
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"` // When the offer arrived
+	// When the offer lapses, nil if the sender set no deadline
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// pendingOffer is a held push offer and the message to answer
+type pendingOffer struct {
+	info  PendingPush
+	msg   protocol.Message
+	req   *protocol.PushOffer
+	timer *time.Timer // Refuses the offer once it has waited too long
+}
+
+// WithPushPolicy lets other peers push files to this one as the policy allows
+func WithPushPolicy(policy PushPolicy) Option {
+	return func(p *Peer) {
+		p.pushPolicy = &policy
+	}
+}
+
+// WithOfferExpiry limits how long the files this peer pushes may take:
+// each offer tells the receiver its deadline, after which neither side
+// starts or continues the transfer, so an offer that went unanswered for
+// days is never honored
+// expiry: Time from the offer to the deadline, 0 for no limit
+func WithOfferExpiry(expiry time.Duration) Option {
+	return func(p *Peer) {
+		p.offerExpiry = expiry
+	}
+}
+
+// PushFile offers a shared file to the peer at addr and sends it once the
+// peer accepts, which may take until the peer's user decides
+// Peers that take files in pieces are sent only the pieces they don't
+// hold yet, so pushing a file again resumes an interrupted push
+// Returns: An error if the peer refuses the file or doesn't accept pushes
+func (p *Peer) PushFile(ctx context.Context, addr, name string) error {
+	name = wireName(name)
+	features, err := p.PeerFeatures(ctx, addr)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(features, protocol.FeatureOffers) {
+		return fmt.Errorf("peer %s does not accept pushed files", addr)
+	}
+	path, err := resolveShared(p.SharedDir(), name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	var m *protocol.Manifest
+	if slices.Contains(features, protocol.FeatureChunks) {
+		if m, err = p.sharedManifest(name, protocol.NameEncodingUTF8NFC); err != nil {
+			return err
+		}
+	}
+
+	id := p.nextCallID()
+	offer := &protocol.PushOffer{ID: id, FileName: name, NameEncoding: protocol.NameEncodingUTF8NFC, Size: info.Size(), Manifest: m}
+	if p.offerExpiry > 0 {
+		// The deadline covers sending the file too, not just the answer
+		deadline := time.Now().Add(p.offerExpiry)
+		offer.Expires = deadline.Unix()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	callCtx, cancel := context.WithTimeout(ctx, pushDecisionTimeout)
+	defer cancel()
+	logging.Infof(p.logger, "Offering %s (%d bytes) to %s", name, info.Size(), addr)
+	msg, err := p.call(callCtx, addr, protocol.MessageTypePushOffer, id, offer)
+	if err != nil {
+		return fmt.Errorf("no answer to the offer of %s: %v", name, err)
+	}
+	reply := msg.Payload.(*protocol.PushReply)
+	if !reply.Accepted {
+		return fmt.Errorf("peer %s refused %s: %s", addr, name, reply.Error)
+	}
+	if offerExpired(offer) {
+		return fmt.Errorf("offer of %s expired before the transfer started", name)
+	}
+
+	t, err := p.beginTransfer(name, addr, "send")
+	if err != nil {
+		return err
+	}
+	if m != nil && reply.StreamID != 0 {
+		t.setSize(m.Size)
+		size, err := p.sendPieces(ctx, protocol.Message{From: msg.From, FromAddr: addr}, reply, m, path, t)
+		p.endTransfer(t, size, err)
+		return err
+	}
+	req := &protocol.FileRequest{FileName: name, NameEncoding: protocol.NameEncodingUTF8NFC, WantMeta: reply.WantMeta, HashAlgorithms: reply.HashAlgorithms, Compression: reply.Compression}
+	size, err := p.serveFile(protocol.Message{From: msg.From, FromAddr: addr}, req, t)
+	p.endTransfer(t, size, err)
+	return err
+}
+
+// handlePushOffer applies the push policy to a file another peer offers
+func (p *Peer) handlePushOffer(msg protocol.Message) {
+	req := msg.Payload.(*protocol.PushOffer)
+	err := p.checkFeature(protocol.FeatureOffers)
+	if err == nil {
+		err = checkNameEncoding(req.FileName, req.NameEncoding)
+	}
+	if err == nil {
+		err = p.checkPushSize(req.Size)
+	}
+	if err == nil && offerExpired(req) {
+		err = errors.New("offer expired")
+	}
+	if err != nil {
+		p.refusePush(msg, req, err.Error())
+		return
+	}
+
+	policy := p.pushPolicy
+	switch {
+	case p.writeAllowed(msg.From, req.FileName):
+		p.acceptPush(msg, req)
+	case policy == nil:
+		p.refusePush(msg, req, "pushes are not accepted")
+	case slices.Contains(policy.Allow, msg.From):
+		p.acceptPush(msg, req)
+	case policy.Prompt:
+		p.holdPush(msg, req)
+	default:
+		p.refusePush(msg, req, fmt.Sprintf("pushes from %s are not accepted", msg.From))
+	}
+}
+
+// checkPushSize applies the push policy's size cap
+func (p *Peer) checkPushSize(size int64) error {
+	if p.pushPolicy != nil && p.pushPolicy.MaxSize > 0 && size > p.pushPolicy.MaxSize {
+		return fmt.Errorf("file of %d bytes exceeds the limit of %d", size, p.pushPolicy.MaxSize)
+	}
+	return nil
+}
+
+// checkPushedSize checks the size of a pushed file as received, rather
+// than as offered, against its offer and the push size limit; files that
+// were requested aren't limited
+// t: The transfer the file belongs to, nil for an unsolicited file
+func (p *Peer) checkPushedSize(t *transfer, size int64) error {
+	if t != nil && !t.pushed {
+		return nil
+	}
+	if t != nil && size > t.maxSize {
+		return fmt.Errorf("file of %d bytes exceeds the %d bytes offered", size, t.maxSize)
+	}
+	return p.checkPushSize(size)
+}
+
+// sentBy reports whether msg comes from the peer a transfer expects its
+// file from, as its history entry names it: the ID of a peer whose push
+// was accepted, or the address a request was sent to
+func (p *Peer) sentBy(t *transfer, msg protocol.Message) bool {
+	want := t.rec.Peer
+	return want == msg.From || want == msg.FromAddr || sameHostPort(want, msg.FromAddr)
+}
+
+// sameHostPort reports whether two host:port addresses name the same
+// endpoint, e.g. a requested "localhost:3000" and the connection's
+// "127.0.0.1:3000"
+func sameHostPort(a, b string) bool {
+	hostA, portA, err := net.SplitHostPort(a)
+	if err != nil {
+		return false
+	}
+	hostB, portB, err := net.SplitHostPort(b)
+	if err != nil || portA != portB {
+		return false
+	}
+	ipB := net.ParseIP(hostB)
+	if ipB == nil {
+		return false
+	}
+	ips, err := net.LookupIP(hostA)
+	if err != nil {
+		return false
+	}
+	return slices.ContainsFunc(ips, ipB.Equal)
+}
+
+// holdPush keeps an offer until DecidePush is called or it expires
+func (p *Peer) holdPush(msg protocol.Message, req *protocol.PushOffer) {
+	o := &pendingOffer{msg: msg, req: req}
+	o.info = PendingPush{ID: p.nextCallID(), Peer: msg.From, Name: req.FileName, Size: req.Size, Time: time.Now()}
+	wait := pushDecisionTimeout
+	if deadline, ok := offerDeadline(req); ok {
+		o.info.Expires = &deadline
+		wait = min(wait, time.Until(deadline))
+	}
+	o.timer = time.AfterFunc(wait, func() {
+		if p.takeOffer(o.info.ID) != nil {
+			p.refusePush(msg, req, "offer expired")
+		}
+	})
+	p.mu.Lock()
+	p.offers[o.info.ID] = o
+	p.mu.Unlock()
+
+	logging.Infof(p.logger, "Peer %s offers %s (%d bytes); accept with: pushes -accept %d", msg.From, req.FileName, req.Size, o.info.ID)
+}
+
+// takeOffer removes a held offer
+// Returns: The offer, nil if there is none with the ID
+func (p *Peer) takeOffer(id uint64) *pendingOffer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	o := p.offers[id]
+	delete(p.offers, id)
+	return o
+}
+
+// PendingPushes lists the push offers waiting for a decision, oldest first
+func (p *Peer) PendingPushes() []PendingPush {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := make([]PendingPush, 0, len(p.offers))
+	for _, o := range p.offers {
+		list = append(list, o.info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list
+}
+
+// DecidePush accepts or refuses a held push offer
+// id: See PendingPush.ID
+func (p *Peer) DecidePush(id uint64, accept bool) error {
+	o := p.takeOffer(id)
+	if o == nil {
+		return fmt.Errorf("no pending push %d", id)
+	}
+	o.timer.Stop()
+	if !accept {
+		p.refusePush(o.msg, o.req, "refused by the user")
+		return nil
+	}
+	if offerExpired(o.req) {
+		p.refusePush(o.msg, o.req, "offer expired")
+		return fmt.Errorf("push %d expired", id)
+	}
+	p.acceptPush(o.msg, o.req)
+	return nil
+}
+
+// acceptPush registers the offered file as expected and asks the sender
+// to send it, in pieces if it offered a manifest
+func (p *Peer) acceptPush(msg protocol.Message, req *protocol.PushOffer) {
+	output, err := p.pushTarget(msg.From, req.FileName)
+	if err == nil && req.Manifest != nil && p.checkFeature(protocol.FeatureChunks) == nil {
+		if err := p.acceptPieces(msg, req, output); err != nil {
+			p.refusePush(msg, req, err.Error())
+		}
+		return
+	}
+	var t *transfer
+	if err == nil {
+		t, err = p.beginTransfer(req.FileName, msg.From, "receive")
+	}
+	if err != nil {
+		p.refusePush(msg, req, err.Error())
+		return
+	}
+	t.output = output
+	t.pushed, t.maxSize = true, req.Size
+
+	p.mu.Lock()
+	_, exists := p.pending[req.FileName]
+	if !exists {
+		p.pending[req.FileName] = t
+	}
+	p.mu.Unlock()
+	if exists {
+		p.dropTransfer(t)
+		p.refusePush(msg, req, fmt.Sprintf("a transfer of %s is already in progress", req.FileName))
+		return
+	}
+
+	wait, reason := pushDataTimeout, "pushed file never arrived"
+	if deadline, ok := offerDeadline(req); ok && time.Until(deadline) < wait {
+		wait, reason = time.Until(deadline), "offer expired before the file arrived"
+	}
+	time.AfterFunc(wait, func() {
+		p.mu.Lock()
+		waiting := p.pending[req.FileName] == t
+		if waiting {
+			delete(p.pending, req.FileName)
+		}
+		p.mu.Unlock()
+		if waiting {
+			p.endTransfer(t, 0, errors.New(reason))
+		}
+	})
+	logging.Infof(p.logger, "Accepted %s (%d bytes) pushed by %s", req.FileName, req.Size, msg.From)
+	resp := &protocol.PushReply{ID: req.ID, Accepted: true, WantMeta: p.wantsMeta(), HashAlgorithms: p.hashAlgorithms, Compression: p.compression}
+	if err := p.reply(msg, protocol.MessageTypePushReply, resp); err != nil {
+		logging.Errorf(p.logger, "Error accepting push: %v", err)
+	}
+}
+
+// offerDeadline returns when an offer lapses
+// Returns: false if the sender set no deadline
+func offerDeadline(req *protocol.PushOffer) (time.Time, bool) {
+	if req.Expires == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(req.Expires, 0), true
+}
+
+// offerExpired reports whether an offer is past its deadline
+func offerExpired(req *protocol.PushOffer) bool {
+	deadline, ok := offerDeadline(req)
+	return ok && !time.Now().Before(deadline)
+}
+
+// refusePush tells the sender its offer was refused
+func (p *Peer) refusePush(msg protocol.Message, req *protocol.PushOffer, reason string) {
+	logging.Warnf(p.logger, "Refused %s pushed by %s: %s", req.FileName, msg.From, reason)
+	resp := &protocol.PushReply{ID: req.ID, Error: reason}
+	if err := p.reply(msg, protocol.MessageTypePushReply, resp); err != nil {
+		logging.Errorf(p.logger, "Error refusing push: %v", err)
+	}
+}
+
+// handlePushReply delivers the answer to an offer to the waiting PushFile call
+func (p *Peer) handlePushReply(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.PushReply).ID, msg)
+}
+
+// pushTarget returns where a file pushed by the peer from is saved
+// Returns: An empty path for the received directory's default
+func (p *Peer) pushTarget(from, name string) (string, error) {
+	if p.pushPolicy == nil || !p.pushPolicy.PeerDirs {
+		return "", nil
+	}
+	dir := path.Base(sanitizeName(from))
+	if dir == "" || dir == "." || dir == ".." || dir == "/" {
+		return "", fmt.Errorf("peer ID %q can't name a directory", from)
+	}
+	return localPath(filepath.Join(p.ReceivedDir(), dir), sanitizeName(name))
+}
+
+// admitUnsolicited applies the push policy to a file that arrived without
+// being requested or offered, as sent by peers that predate push offers
+// Such files are only accepted from allowed peers, or those the ACL lets write
+// Returns: Where to save the file, see pushTarget
+func (p *Peer) admitUnsolicited(from string, resp *protocol.FileResponse) (string, error) {
+	allowed := p.pushPolicy != nil && slices.Contains(p.pushPolicy.Allow, from)
+	if !allowed && !p.writeAllowed(from, resp.Name) {
+		return "", fmt.Errorf("files from %s are only accepted when requested", from)
+	}
+	if err := p.checkPushSize(resp.Size); err != nil {
+		return "", err
+	}
+	return p.pushTarget(from, resp.Name)
+}
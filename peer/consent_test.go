@@ -0,0 +1,307 @@
+package peer
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// expect registers a pending transfer of name from peer, as a request or
+// an accepted push of size bytes registers it
+func expect(t *testing.T, p *Peer, name, peer string, pushed bool, size int64) *transfer {
+	t.Helper()
+	tr, err := p.beginTransfer(name, peer, "receive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.pushed, tr.maxSize = pushed, size
+	p.mu.Lock()
+	p.pending[name] = tr
+	p.mu.Unlock()
+	return tr
+}
+
+func fileResponse(from, addr, name string, data []byte) protocol.Message {
+	return protocol.Message{Type: protocol.MessageTypeFileResponse, From: from, FromAddr: addr, Payload: &protocol.FileResponse{
+		Name: name, NameEncoding: protocol.NameEncodingUTF8NFC, Size: int64(len(data)), Data: data,
+	}}
+}
+
+// TestResponseFromOtherPeer checks that a response only completes a
+// pending transfer when it comes from the peer the file is expected from
+func TestResponseFromOtherPeer(t *testing.T) {
+	p := newTestPeer(t)
+	want := expect(t, p, "a.txt", "mem:peer2", false, 0)
+	saved := filepath.Join(p.ReceivedDir(), "a.txt")
+
+	p.handleFileResponse(fileResponse("peer3", "mem:peer3", "a.txt", []byte("forged")))
+	if _, err := os.Stat(saved); !os.IsNotExist(err) {
+		t.Fatalf("response from another peer saved: %v", err)
+	}
+	p.mu.Lock()
+	pending := p.pending["a.txt"]
+	p.mu.Unlock()
+	if pending != want {
+		t.Fatal("response from another peer took the pending transfer")
+	}
+
+	p.handleFileResponse(fileResponse("peer2", "mem:peer2", "a.txt", []byte("hello")))
+	if data, err := os.ReadFile(saved); err != nil || string(data) != "hello" {
+		t.Fatalf("response from the requested peer: %q, %v", data, err)
+	}
+}
+
+// TestPushedSizeEnforced checks the size of pushed data as received
+// against the size offered and the push size limit
+func TestPushedSizeEnforced(t *testing.T) {
+	p := newTestPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}, MaxSize: 8}))
+	expect(t, p, "a.txt", "friend", true, 4)
+	p.handleFileResponse(fileResponse("friend", "mem:friend", "a.txt", []byte("longer")))
+	if _, err := os.Stat(filepath.Join(p.ReceivedDir(), "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("push longer than its offer saved: %v", err)
+	}
+
+	p.handleFileResponse(fileResponse("friend", "mem:friend", "b.txt", []byte("past the limit")))
+	if _, err := os.Stat(filepath.Join(p.ReceivedDir(), "b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("unsolicited file past the push size limit saved: %v", err)
+	}
+
+	tests := []struct {
+		t    *transfer
+		size int64
+		ok   bool
+	}{
+		{nil, 8, true},
+		{nil, 9, false},
+		{&transfer{pushed: true, maxSize: 4}, 4, true},
+		{&transfer{pushed: true, maxSize: 4}, 5, false},
+		{&transfer{pushed: true, maxSize: 0}, 1, false},
+		{&transfer{}, 1 << 30, true},
+	}
+	for i, tt := range tests {
+		if err := p.checkPushedSize(tt.t, tt.size); (err == nil) != tt.ok {
+			t.Errorf("%d: checkPushedSize(%d) = %v, want ok %v", i, tt.size, err, tt.ok)
+		}
+	}
+}
+
+func TestSameHostPort(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"127.0.0.1:3000", "127.0.0.1:3000", true},
+		{"localhost:3000", "127.0.0.1:3000", true},
+		{"localhost:3000", "127.0.0.1:3001", false},
+		{"10.0.0.7:3000", "127.0.0.1:3000", false},
+		{"mem:peer", "mem:peer", false},
+	}
+	for _, tt := range tests {
+		if got := sameHostPort(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameHostPort(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// offerPeer returns a peer that isn't started and the transport of a
+// sender that receives its answers to push offers
+func offerPeer(t *testing.T, opts ...Option) (*Peer, *transport.MemoryTransport) {
+	t.Helper()
+	network := transport.NewMemoryNetwork()
+	sender := network.NewTransport("mem:sender")
+	if err := sender.StartListening(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sender.Shutdown() })
+	dir := t.TempDir()
+	tr := network.NewTransport("mem:peer")
+	opts = append([]Option{WithLogger(log.New(io.Discard, "", 0))}, opts...)
+	p, err := New("peer1", tr.GetListenAddress(), filepath.Join(dir, "shared"), filepath.Join(dir, "received"), tr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p, sender
+}
+
+// offer hands p a push offer from the peer called from
+// Returns: The answer to it, nil if there was none
+func offer(t *testing.T, p *Peer, sender *transport.MemoryTransport, from string, req *protocol.PushOffer) *protocol.PushReply {
+	t.Helper()
+	if req.NameEncoding == "" {
+		req.NameEncoding = protocol.NameEncodingUTF8NFC
+	}
+	p.handlePushOffer(protocol.Message{Type: protocol.MessageTypePushOffer, From: from, FromAddr: sender.GetListenAddress(), Payload: req})
+	return pushReply(t, sender)
+}
+
+// pushReply returns the next answer to a push offer, nil if there is none
+func pushReply(t *testing.T, sender *transport.MemoryTransport) *protocol.PushReply {
+	t.Helper()
+	select {
+	case msg := <-sender.GetMessageChannel():
+		reply, ok := msg.Payload.(*protocol.PushReply)
+		if !ok {
+			t.Fatalf("got %T, want a push reply", msg.Payload)
+		}
+		return reply
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+func TestPushOfferPolicy(t *testing.T) {
+	policy := PushPolicy{Allow: []string{"friend"}, MaxSize: 100}
+	tests := []struct {
+		name   string
+		policy *PushPolicy
+		acl    *ACL
+		from   string
+		req    protocol.PushOffer
+		accept bool
+	}{
+		{"no policy", nil, nil, "friend", protocol.PushOffer{FileName: "a.txt", Size: 10}, false},
+		{"allowed peer", &policy, nil, "friend", protocol.PushOffer{FileName: "a.txt", Size: 10}, true},
+		{"other peer", &policy, nil, "stranger", protocol.PushOffer{FileName: "a.txt", Size: 10}, false},
+		{"at the size limit", &policy, nil, "friend", protocol.PushOffer{FileName: "a.txt", Size: 100}, true},
+		{"past the size limit", &policy, nil, "friend", protocol.PushOffer{FileName: "a.txt", Size: 101}, false},
+		{"expired", &policy, nil, "friend", protocol.PushOffer{FileName: "a.txt", Size: 10, Expires: time.Now().Add(-time.Minute).Unix()}, false},
+		{"unexpired", &policy, nil, "friend", protocol.PushOffer{FileName: "a.txt", Size: 10, Expires: time.Now().Add(time.Hour).Unix()}, true},
+		{"other name encoding", &policy, nil, "friend", protocol.PushOffer{FileName: "a.txt", NameEncoding: "latin1", Size: 10}, false},
+		{"name not UTF-8", &policy, nil, "friend", protocol.PushOffer{FileName: "a\xff.txt", Size: 10}, false},
+		{"ACL writer", nil, testACL(), "writer", protocol.PushOffer{FileName: "incoming/a.txt", Size: 10}, true},
+		{"ACL writer elsewhere", nil, testACL(), "writer", protocol.PushOffer{FileName: "incoming/../a.txt", Size: 10}, false},
+		{"ACL reader", nil, testACL(), "reader", protocol.PushOffer{FileName: "releases/a.iso", Size: 10}, false},
+	}
+	for i, tt := range tests {
+		var opts []Option
+		if tt.policy != nil {
+			opts = append(opts, WithPushPolicy(*tt.policy))
+		}
+		p, sender := offerPeer(t, opts...)
+		if tt.acl != nil {
+			p.SetACL(tt.acl)
+		}
+		req := tt.req
+		req.ID = uint64(i + 1)
+		reply := offer(t, p, sender, tt.from, &req)
+		if reply == nil || reply.ID != req.ID {
+			t.Errorf("%s: offer not answered", tt.name)
+			continue
+		}
+		if reply.Accepted != tt.accept {
+			t.Errorf("%s: accepted %v, want %v (%s)", tt.name, reply.Accepted, tt.accept, reply.Error)
+		}
+		p.mu.Lock()
+		pending := p.pending[req.FileName]
+		p.mu.Unlock()
+		if !tt.accept {
+			if pending != nil {
+				t.Errorf("%s: refused file expected", tt.name)
+			}
+			continue
+		}
+		if pending == nil || !pending.pushed || pending.maxSize != req.Size || pending.rec.Peer != tt.from {
+			t.Errorf("%s: accepted file not expected from %s at %d bytes: %+v", tt.name, tt.from, req.Size, pending)
+		}
+	}
+}
+
+func TestPushOfferPrompt(t *testing.T) {
+	p, sender := offerPeer(t, WithPushPolicy(PushPolicy{Prompt: true}))
+	if reply := offer(t, p, sender, "stranger", &protocol.PushOffer{ID: 1, FileName: "a.txt", Size: 10}); reply != nil {
+		t.Fatalf("held offer answered: %+v", reply)
+	}
+	if reply := offer(t, p, sender, "stranger", &protocol.PushOffer{ID: 2, FileName: "b.txt", Size: 10}); reply != nil {
+		t.Fatalf("held offer answered: %+v", reply)
+	}
+	held := p.PendingPushes()
+	if len(held) != 2 || held[0].Peer != "stranger" || held[0].Name != "a.txt" {
+		t.Fatalf("held offers: %+v", held)
+	}
+
+	if err := p.DecidePush(held[0].ID, false); err != nil {
+		t.Fatal(err)
+	}
+	if reply := pushReply(t, sender); reply == nil || reply.ID != 1 || reply.Accepted {
+		t.Fatalf("refused offer answered with %+v", reply)
+	}
+	if err := p.DecidePush(held[1].ID, true); err != nil {
+		t.Fatal(err)
+	}
+	if reply := pushReply(t, sender); reply == nil || reply.ID != 2 || !reply.Accepted {
+		t.Fatalf("accepted offer answered with %+v", reply)
+	}
+	if err := p.DecidePush(held[1].ID, true); err == nil {
+		t.Fatal("offer decided twice")
+	}
+	if len(p.PendingPushes()) != 0 {
+		t.Fatal("decided offers still held")
+	}
+}
+
+func TestPushOfferInProgress(t *testing.T) {
+	p, sender := offerPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend", "other"}}))
+	if reply := offer(t, p, sender, "friend", &protocol.PushOffer{ID: 1, FileName: "a.txt", Size: 10}); reply == nil || !reply.Accepted {
+		t.Fatalf("first offer: %+v", reply)
+	}
+	if reply := offer(t, p, sender, "other", &protocol.PushOffer{ID: 2, FileName: "a.txt", Size: 1000}); reply == nil || reply.Accepted {
+		t.Fatalf("offer of a file already being pushed: %+v", reply)
+	}
+	p.mu.Lock()
+	pending := p.pending["a.txt"]
+	p.mu.Unlock()
+	if pending == nil || pending.rec.Peer != "friend" || pending.maxSize != 10 {
+		t.Fatalf("second offer replaced the first: %+v", pending)
+	}
+}
+
+// TestPushPeerDirs checks that sender IDs and names can't place pushed
+// files outside the sender's directory
+func TestPushPeerDirs(t *testing.T) {
+	p, _ := offerPeer(t, WithPushPolicy(PushPolicy{PeerDirs: true}))
+	received := p.ReceivedDir()
+	tests := []struct {
+		from, name string
+		want       string // "" if refused
+	}{
+		{"friend", "a.txt", filepath.Join(received, "friend", "a.txt")},
+		{"friend", "sub/a.txt", filepath.Join(received, "friend", "sub", "a.txt")},
+		{"a/../../x", "a.txt", filepath.Join(received, "x", "a.txt")},
+		{"..", "a.txt", ""},
+		{"", "a.txt", ""},
+		{"friend", "../other/a.txt", ""},
+		{"friend", `..\other\a.txt`, ""},
+	}
+	for _, tt := range tests {
+		got, err := p.pushTarget(tt.from, tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("pushTarget(%q, %q) = %q, want an error", tt.from, tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("pushTarget(%q, %q) = %q, %v, want %q", tt.from, tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// TestUnsolicitedFromStranger checks that a file sent without being
+// requested or offered is only saved from peers allowed to push
+func TestUnsolicitedFromStranger(t *testing.T) {
+	p := newTestPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}, Prompt: true}))
+	p.handleFileResponse(fileResponse("stranger", "mem:stranger", "a.txt", []byte("unasked")))
+	if _, err := os.Stat(filepath.Join(p.ReceivedDir(), "a.txt")); !os.IsNotExist(err) {
+		t.Fatalf("unsolicited file from a stranger saved: %v", err)
+	}
+	p.handleFileResponse(fileResponse("friend", "mem:friend", "b.txt", []byte("pushed")))
+	if data, err := os.ReadFile(filepath.Join(p.ReceivedDir(), "b.txt")); err != nil || string(data) != "pushed" {
+		t.Fatalf("unsolicited file from an allowed peer: %q, %v", data, err)
+	}
+}
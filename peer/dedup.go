@@ -0,0 +1,434 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/cdc"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	blockBatch    = 16 // Chunks asked for in one BlockRequest
+	blockInflight = 4  // BlockRequests outstanding at once
+)
+
+// recipe is the list of content-defined chunks of a local file, kept while
+// the file is unchanged
+type recipe struct {
+	size    int64
+	modTime time.Time
+	sum     []byte      // SHA-256 of the whole file
+	chunks  []cdc.Chunk // In file order
+}
+
+// chunkLocation is where a chunk is found in a local file
+type chunkLocation struct {
+	path   string
+	offset int64
+	length int
+}
+
+// recipeFor returns the chunks of the file at path, chunking it again only
+// if it changed since the last call
+func (p *Peer) recipeFor(path string) (*recipe, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	r, ok := p.recipes[path]
+	p.mu.Unlock()
+	if ok && r.size == info.Size() && r.modTime.Equal(info.ModTime()) {
+		return r, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	r = &recipe{size: info.Size(), modTime: info.ModTime()}
+	h := sha256.New()
+	err = cdc.Split(file, func(c cdc.Chunk, data []byte) error {
+		if err := p.disk.wait(context.Background(), len(data)); err != nil {
+			return err
+		}
+		h.Write(data)
+		r.chunks = append(r.chunks, c)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to chunk %s: %v", path, err)
+	}
+	r.sum = h.Sum(nil)
+	p.mu.Lock()
+	p.recipes[path] = r
+	p.mu.Unlock()
+	return r, nil
+}
+
+// sharedRecipe resolves a wire name in the shared directory and returns
+// its path and chunks
+func (p *Peer) sharedRecipe(name, encoding string) (string, *recipe, error) {
+	if err := p.checkFeature(protocol.FeatureDedup); err != nil {
+		return "", nil, err
+	}
+	if err := checkNameEncoding(name, encoding); err != nil {
+		return "", nil, err
+	}
+	path, err := resolveShared(p.SharedDir(), name)
+	if err != nil {
+		return "", nil, err
+	}
+	r, err := p.recipeFor(path)
+	return path, r, err
+}
+
+// handleRecipeRequest answers a request for the chunks of a shared file
+func (p *Peer) handleRecipeRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.RecipeRequest)
+	resp := &protocol.RecipeResponse{ID: req.ID}
+
+	err := p.checkAccess(msg.From, req.FileName, AccessRead)
+	var r *recipe
+	if err == nil {
+		_, r, err = p.sharedRecipe(req.FileName, req.NameEncoding)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Chunk list request for %s from %s failed: %v", req.FileName, msg.From, err)
+		resp.Error = err.Error()
+	} else {
+		resp.Size, resp.Hash = r.size, r.sum
+		resp.Chunks = make([]protocol.RecipeChunk, len(r.chunks))
+		for i, c := range r.chunks {
+			resp.Chunks[i] = protocol.RecipeChunk{Hash: c.Hash[:], Length: c.Length}
+		}
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeRecipeResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending chunk list: %v", err)
+	}
+}
+
+// handleBlockRequest serves chunks of a shared file by hash
+func (p *Peer) handleBlockRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.BlockRequest)
+	resp := &protocol.BlockResponse{ID: req.ID}
+
+	err := p.checkAccess(msg.From, req.FileName, AccessRead)
+	var path string
+	var r *recipe
+	if err == nil && len(req.Hashes) > blockBatch {
+		err = fmt.Errorf("too many chunks requested: %d", len(req.Hashes))
+	}
+	if err == nil {
+		path, r, err = p.sharedRecipe(req.FileName, req.NameEncoding)
+	}
+	if err == nil {
+		offsets := make(map[[sha256.Size]byte]cdc.Chunk, len(r.chunks))
+		for _, c := range r.chunks {
+			offsets[c.Hash] = c
+		}
+		var sent int64
+		for _, h := range req.Hashes {
+			c, ok := offsets[[sha256.Size]byte(padHash(h))]
+			if !ok {
+				err = fmt.Errorf("%s has no chunk %x", req.FileName, h)
+				break
+			}
+			var data []byte
+			if data, _, err = p.readShared(path, c.Offset, int64(c.Length)); err != nil {
+				break
+			}
+			resp.Blocks = append(resp.Blocks, data)
+			sent += int64(len(data))
+		}
+		if err == nil {
+			p.noteUpload(msg, req.FileName, r.size, sent)
+		}
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Chunk request for %s from %s failed: %v", req.FileName, msg.From, err)
+		resp.Blocks = nil
+		resp.Error = err.Error()
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeBlockResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending chunks: %v", err)
+	}
+}
+
+// padHash returns h as a SHA-256 sized slice, so that hashes of the wrong
+// length simply match no chunk
+func padHash(h []byte) []byte {
+	out := make([]byte, sha256.Size)
+	if len(h) == sha256.Size {
+		copy(out, h)
+	}
+	return out
+}
+
+// handleRecipeResponse delivers a chunk list to the waiting download
+func (p *Peer) handleRecipeResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.RecipeResponse).ID, msg)
+}
+
+// handleBlockResponse delivers chunks to the waiting download
+func (p *Peer) handleBlockResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.BlockResponse).ID, msg)
+}
+
+// fetchRecipe asks the peer at addr for the chunks of a shared file
+func (p *Peer) fetchRecipe(ctx context.Context, addr, name string) (*protocol.RecipeResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	id := p.nextCallID()
+	msg, err := p.call(ctx, addr, protocol.MessageTypeRecipeRequest, id, &protocol.RecipeRequest{ID: id, FileName: name, NameEncoding: protocol.NameEncodingUTF8NFC})
+	if err != nil {
+		return nil, err
+	}
+	resp := msg.Payload.(*protocol.RecipeResponse)
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	var total int64
+	for _, c := range resp.Chunks {
+		if len(c.Hash) != sha256.Size || c.Length <= 0 || c.Length > cdc.MaxSize {
+			return nil, fmt.Errorf("peer %s sent an invalid chunk list for %s", addr, name)
+		}
+		total += int64(c.Length)
+	}
+	if total != resp.Size || len(resp.Hash) != sha256.Size {
+		return nil, fmt.Errorf("peer %s sent an invalid chunk list for %s", addr, name)
+	}
+	return resp, nil
+}
+
+// localChunks indexes the chunks of the files in the shared and received
+// directories, where a download can take chunks from instead of fetching
+// them; files that fail to read are left out
+func (p *Peer) localChunks() map[[sha256.Size]byte]chunkLocation {
+	index := make(map[[sha256.Size]byte]chunkLocation)
+	seen := make(map[string]bool)
+	for _, dir := range []string{p.SharedDir(), p.ReceivedDir()} {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() || isPartial(d.Name()) || seen[path] {
+				return nil
+			}
+			seen[path] = true
+			if info, err := d.Info(); err != nil || info.Size() < cdc.MinSize {
+				return nil
+			}
+			r, err := p.recipeFor(path)
+			if err != nil {
+				return nil
+			}
+			for _, c := range r.chunks {
+				if _, ok := index[c.Hash]; !ok {
+					index[c.Hash] = chunkLocation{path: path, offset: c.Offset, length: c.Length}
+				}
+			}
+			return nil
+		})
+	}
+
+	// Forget the files that are gone
+	p.mu.Lock()
+	for path := range p.recipes {
+		if !seen[path] {
+			delete(p.recipes, path)
+		}
+	}
+	p.mu.Unlock()
+	return index
+}
+
+// readLocal reads a chunk from a local file, checking it still holds it
+func readLocal(loc chunkLocation, hash [sha256.Size]byte) ([]byte, bool) {
+	file, err := os.Open(loc.path)
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	data := make([]byte, loc.length)
+	if _, err := file.ReadAt(data, loc.offset); err != nil {
+		return nil, false
+	}
+	return data, sha256.Sum256(data) == hash
+}
+
+// downloadDedup downloads a file from the peer at addr by its
+// content-defined chunks, taking every chunk the local files already hold
+// from them and fetching each of the others once
+// Returns: The saved path and the number of bytes fetched from the peer
+func (p *Peer) downloadDedup(ctx context.Context, addr, name, output string, t *transfer) (string, int64, error) {
+	rec, err := p.fetchRecipe(ctx, addr, name)
+	if err != nil {
+		return "", 0, err
+	}
+	t.setSize(rec.Size)
+	if limit, _ := p.receivedLimitPolicy(); limit > 0 && rec.Size > limit && output == "" {
+		return "", 0, fmt.Errorf("%s is %d bytes, larger than the received directory limit of %d", name, rec.Size, limit)
+	}
+	target, err := p.saveTarget(name, protocol.NameEncodingUTF8NFC, output)
+	if err != nil {
+		return "", 0, err
+	}
+	local := p.localChunks()
+
+	part := p.partPath(target)
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR|os.O_TRUNC, p.fileMode(nil))
+	if err != nil {
+		return "", 0, err
+	}
+	fail := func(err error) (string, int64, error) {
+		file.Close()
+		os.Remove(part)
+		return "", 0, err
+	}
+	if err := file.Truncate(rec.Size); err != nil {
+		return fail(err)
+	}
+
+	// Copy the chunks held locally, and collect where the others go
+	missing := make(map[[sha256.Size]byte][]int64)
+	var order [][sha256.Size]byte
+	var reused, offset int64
+	reusedChunks := 0
+	for _, c := range rec.Chunks {
+		h := [sha256.Size]byte(c.Hash)
+		at := offset
+		offset += int64(c.Length)
+		if _, ok := missing[h]; !ok {
+			if loc, ok := local[h]; ok {
+				if data, ok := readLocal(loc, h); ok {
+					if err := p.disk.wait(ctx, len(data)); err != nil {
+						return fail(err)
+					}
+					if _, err := file.WriteAt(data, at); err != nil {
+						return fail(err)
+					}
+					reused += int64(len(data))
+					reusedChunks++
+					t.addProgress(int64(len(data)))
+					continue
+				}
+			}
+			order = append(order, h)
+		}
+		missing[h] = append(missing[h], at)
+	}
+
+	fetched, err := p.fetchBlocks(ctx, addr, name, file, order, missing, t)
+	if err != nil {
+		return fail(err)
+	}
+	h, err := p.hashPrefix(file, rec.Size, checksum.Default)
+	if err != nil {
+		return fail(err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, rec.Hash) {
+		return fail(fmt.Errorf("%s has SHA-256 %x after reassembly, peer announced %x", name, got, rec.Hash))
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(part)
+		return "", 0, err
+	}
+
+	final, err := p.finishPart(name, target, addr)
+	if err != nil {
+		return "", 0, err
+	}
+	logging.Infof(p.logger, "Fetched %d bytes of %s from %s; reused %d bytes in %d of %d chunks already held locally",
+		fetched, name, addr, reused, reusedChunks, len(rec.Chunks))
+	p.issueReceipts(name, final, rec.Hash, rec.Size, map[string]int64{addr: fetched})
+	return final, fetched, nil
+}
+
+// fetchBlocks fetches the chunks in order from the peer at addr, a batch
+// at a time with several batches in flight, and writes each at every
+// offset it occurs at
+// Returns: The number of bytes fetched
+func (p *Peer) fetchBlocks(ctx context.Context, addr, name string, file *os.File, order [][sha256.Size]byte, missing map[[sha256.Size]byte][]int64, t *transfer) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var fetched int64
+	var firstErr error
+	sem := make(chan struct{}, blockInflight)
+	var wg sync.WaitGroup
+	for start := 0; start < len(order) && ctx.Err() == nil; start += blockBatch {
+		batch := order[start:min(start+blockBatch, len(order))]
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			n, err := p.fetchBatch(ctx, addr, name, file, batch, missing, t)
+			mu.Lock()
+			defer mu.Unlock()
+			fetched += n
+			if err != nil && firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr = ctx.Err()
+	}
+	return fetched, firstErr
+}
+
+// fetchBatch fetches one batch of chunks and writes them into file
+func (p *Peer) fetchBatch(ctx context.Context, addr, name string, file *os.File, batch [][sha256.Size]byte, missing map[[sha256.Size]byte][]int64, t *transfer) (int64, error) {
+	hashes := make([][]byte, len(batch))
+	for i := range batch {
+		hashes[i] = batch[i][:]
+	}
+	callCtx, cancel := context.WithTimeout(ctx, pieceTimeout)
+	defer cancel()
+	id := p.nextCallID()
+	msg, err := p.call(callCtx, addr, protocol.MessageTypeBlockRequest, id, &protocol.BlockRequest{ID: id, FileName: name, NameEncoding: protocol.NameEncodingUTF8NFC, Hashes: hashes})
+	if err != nil {
+		return 0, err
+	}
+	resp := msg.Payload.(*protocol.BlockResponse)
+	if resp.Error != "" {
+		return 0, errors.New(resp.Error)
+	}
+	if len(resp.Blocks) != len(batch) {
+		return 0, fmt.Errorf("peer %s sent %d of %d chunks", addr, len(resp.Blocks), len(batch))
+	}
+
+	var n int64
+	for i, data := range resp.Blocks {
+		if sha256.Sum256(data) != batch[i] {
+			return n, fmt.Errorf("chunk %x from %s failed verification", batch[i], addr)
+		}
+		for _, at := range missing[batch[i]] {
+			if err := p.disk.wait(ctx, len(data)); err != nil {
+				return n, err
+			}
+			if _, err := file.WriteAt(data, at); err != nil {
+				return n, err
+			}
+			t.addProgress(int64(len(data)))
+		}
+		n += int64(len(data))
+	}
+	return n, nil
+}
@@ -0,0 +1,380 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/dht"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	dhtTimeout   = 10 * time.Second // Time allowed for a node to answer a DHT query
+	dhtRepublish = time.Hour        // How often shared files are announced again
+	dhtRetry     = time.Minute      // How often bootstrapping is retried while no node is known
+)
+
+// AnnouncedFile is a shared file the peer announced in the DHT
+type AnnouncedFile struct {
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash"`      // Content hash in hex, see protocol.Manifest.ContentHash
+	Nodes     int       `json:"nodes"`     // Nodes that stored the announcement
+	Announced time.Time `json:"announced"` // Time of the last announcement
+}
+
+// DHTStatus reports on the peer's node of the DHT
+type DHTStatus struct {
+	dht.Stats
+	Announced []AnnouncedFile `json:"announced"`
+}
+
+// WithDHT joins the distributed hash table once the peer starts, through
+// the nodes at the bootstrap addresses (none for the first node). The
+// content hashes of the files in the index, see WithIndexFile, are
+// announced there, and DownloadContent finds the providers of others
+func WithDHT(bootstrap ...string) Option {
+	return func(p *Peer) {
+		p.dhtEnabled = true
+		p.dhtBootstrap = bootstrap
+	}
+}
+
+// startDHT creates the peer's DHT node; the lookups run in dhtLoop, so
+// no I/O happens here
+// Caller must hold p.mu, with the transport listening
+func (p *Peer) startDHT() {
+	p.dht = dht.New(p.id, p.transport.GetListenAddress(), dhtNetwork{p}, p.logger)
+	go p.dhtLoop()
+}
+
+// dhtLoop bootstraps the DHT node, then announces the shared files
+// whenever the index changes and every dhtRepublish
+func (p *Peer) dhtLoop() {
+	// Cancelled when the peer closes, so that lookups stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	bootstrapped := len(p.dhtBootstrap) == 0
+	if bootstrapped {
+		close(p.dhtJoined)
+	}
+	for {
+		if !bootstrapped {
+			if err := p.dht.Bootstrap(ctx, p.dhtBootstrap); err != nil {
+				logging.Errorf(p.logger, "Error joining the DHT: %v", err)
+			} else {
+				bootstrapped = true
+				close(p.dhtJoined)
+				logging.Infof(p.logger, "Joined the DHT with %d contacts", p.dht.Stats().Contacts)
+			}
+		}
+		p.announceShared(ctx)
+
+		wait := dhtRepublish
+		if !bootstrapped {
+			wait = dhtRetry
+		}
+		select {
+		case <-time.After(wait):
+			p.dht.Expire()
+			if bootstrapped {
+				if err := p.dht.Refresh(ctx); err != nil && ctx.Err() == nil {
+					logging.Errorf(p.logger, "Error refreshing the DHT: %v", err)
+				}
+			}
+		case <-p.dhtAnnounce:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// announceShared announces the shared files in the index that weren't
+// announced in the last dhtRepublish
+func (p *Peer) announceShared(ctx context.Context) {
+	type content struct {
+		key  dht.Key
+		name string
+	}
+	var todo []content
+	for _, c := range p.sharedContent() {
+		key, err := dht.KeyFromBytes(c.hash)
+		if err != nil {
+			continue
+		}
+		p.mu.Lock()
+		a, ok := p.dhtAnnounced[key]
+		p.mu.Unlock()
+		if ok && time.Since(a.Announced) < dhtRepublish {
+			continue
+		}
+		todo = append(todo, content{key: key, name: c.name})
+	}
+
+	announced := 0
+	for _, c := range todo {
+		nodes, err := p.dht.Announce(ctx, c.key, c.name)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			logging.Errorf(p.logger, "Error announcing %s in the DHT: %v", c.name, err)
+			continue
+		}
+		p.mu.Lock()
+		p.dhtAnnounced[c.key] = AnnouncedFile{Name: c.name, Hash: c.key.String(), Nodes: nodes, Announced: time.Now()}
+		p.mu.Unlock()
+		announced++
+	}
+	if announced > 0 {
+		logging.Infof(p.logger, "Announced %d shared files in the DHT", announced)
+	}
+}
+
+// DHTStatus returns the state of the peer's DHT node
+// Returns: An error without WithDHT or before the peer starts
+func (p *Peer) DHTStatus() (DHTStatus, error) {
+	node, err := p.dhtNode()
+	if err != nil {
+		return DHTStatus{}, err
+	}
+	status := DHTStatus{Stats: node.Stats()}
+	p.mu.Lock()
+	for _, a := range p.dhtAnnounced {
+		status.Announced = append(status.Announced, a)
+	}
+	p.mu.Unlock()
+	slices.SortFunc(status.Announced, func(a, b AnnouncedFile) int { return strings.Compare(a.Name, b.Name) })
+	return status, nil
+}
+
+// FindProviders looks up the peers that announced the content with the
+// given hash in the DHT, see protocol.Manifest.ContentHash
+// While the peer is still joining the DHT, it waits until it has
+func (p *Peer) FindProviders(ctx context.Context, hash []byte) ([]dht.Provider, error) {
+	node, err := p.dhtNode()
+	if err != nil {
+		return nil, err
+	}
+	key, err := dht.KeyFromBytes(hash)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-p.dhtJoined:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("not joined the DHT yet: %v", ctx.Err())
+	case <-p.stop:
+		return nil, ErrClosed
+	}
+	return node.FindProviders(ctx, key)
+}
+
+// DownloadContent downloads the content with the given hash from the
+// peers that announced it in the DHT, see Download
+// The manifest is taken from the first provider whose manifest matches
+// the hash, so every piece is verified against the requested content;
+// providers that hold it under another name are left out
+// Returns: The path the file was saved to
+func (p *Peer) DownloadContent(ctx context.Context, hash []byte, opts DownloadOptions) (string, error) {
+	providers, err := p.FindProviders(ctx, hash)
+	if err != nil {
+		return "", err
+	}
+	providers = slices.DeleteFunc(providers, func(pr dht.Provider) bool { return pr.PeerID == p.id })
+	if len(providers) == 0 {
+		return "", fmt.Errorf("no provider of %x found in the DHT", hash)
+	}
+
+	var source dht.Provider
+	for _, pr := range providers {
+		m, err := p.FetchManifest(ctx, pr.Addr, pr.Name)
+		if err != nil {
+			logging.Warnf(p.logger, "Provider %s of %x: %v", pr.PeerID, hash, err)
+			continue
+		}
+		if !bytes.Equal(m.ContentHash(), hash) {
+			logging.Warnf(p.logger, "Provider %s no longer holds %x as %s", pr.PeerID, hash, pr.Name)
+			continue
+		}
+		opts.Manifest, source = m, pr
+		break
+	}
+	if opts.Manifest == nil {
+		return "", fmt.Errorf("none of the %d providers of %x serves it", len(providers), hash)
+	}
+	for _, pr := range providers {
+		if pr.Name == source.Name && !slices.Contains(opts.Peers, pr.Addr) {
+			opts.Peers = append(opts.Peers, pr.Addr)
+		}
+	}
+	logging.Infof(p.logger, "Downloading %x as %s from %d providers", hash, source.Name, len(opts.Peers))
+	return p.Download(ctx, source.Name, opts)
+}
+
+// dhtNode returns the peer's DHT node
+func (p *Peer) dhtNode() (*dht.Node, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.dht == nil {
+		return nil, errors.New("the DHT is not enabled")
+	}
+	return p.dht, nil
+}
+
+// handleDHTRequest answers a query of another DHT node
+func (p *Peer) handleDHTRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.DHTRequest)
+	resp := &protocol.DHTResponse{ID: req.ID}
+
+	err := p.checkFeature(protocol.FeatureDHT)
+	if err == nil {
+		err = p.checkAccess(msg.From, "", AccessRead)
+	}
+	var node *dht.Node
+	if err == nil {
+		node, err = p.dhtNode()
+	}
+	var key dht.Key
+	if err == nil {
+		key, err = dht.KeyFromBytes(req.Key)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		addr := advertisedAddr(req.Addr, msg.FromAddr)
+		node.Seen(msg.From, addr)
+		switch req.Op {
+		case protocol.DHTFindNode:
+			resp.Closer = wireContacts(node.Closest(key, msg.From))
+		case protocol.DHTFindProviders:
+			for _, pr := range node.Providers(key) {
+				resp.Providers = append(resp.Providers, protocol.DHTContact{PeerID: pr.PeerID, Addr: pr.Addr, Name: pr.Name})
+			}
+			resp.Closer = wireContacts(node.Closest(key, msg.From))
+		case protocol.DHTAddProvider:
+			if addr == "" {
+				resp.Error = "no address to reach the provider at"
+			} else {
+				node.StoreProvider(key, dht.Provider{PeerID: msg.From, Addr: addr, Name: req.Name})
+			}
+		default:
+			resp.Error = fmt.Sprintf("unknown DHT operation %q", req.Op)
+		}
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeDHTResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error answering DHT query: %v", err)
+	}
+}
+
+// handleDHTResponse delivers an answer to the waiting DHT query
+func (p *Peer) handleDHTResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.DHTResponse).ID, msg)
+}
+
+// advertisedAddr returns the address a node announced it listens on, with
+// an unspecified host such as 0.0.0.0 replaced by the one it connected from
+// Returns: "" if addr isn't a valid address
+func advertisedAddr(addr, from string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		fromHost, _, err := net.SplitHostPort(from)
+		if err != nil {
+			return ""
+		}
+		return net.JoinHostPort(fromHost, port)
+	}
+	return addr
+}
+
+// wireContacts converts contacts for a DHTResponse
+func wireContacts(contacts []dht.Contact) []protocol.DHTContact {
+	out := make([]protocol.DHTContact, 0, len(contacts))
+	for _, c := range contacts {
+		out = append(out, protocol.DHTContact{PeerID: c.PeerID, Addr: c.Addr})
+	}
+	return out
+}
+
+// dhtNetwork sends the queries of the peer's DHT node as DHTRequests
+type dhtNetwork struct {
+	p *Peer
+}
+
+// query sends req to the node and waits for its answer
+func (n dhtNetwork) query(ctx context.Context, to dht.Contact, req *protocol.DHTRequest) (*protocol.DHTResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, dhtTimeout)
+	defer cancel()
+
+	req.ID = n.p.nextCallID()
+	req.Addr = n.p.Addr()
+	msg, err := n.p.call(ctx, to.Addr, protocol.MessageTypeDHTRequest, req.ID, req)
+	if err != nil {
+		return nil, err
+	}
+	resp := msg.Payload.(*protocol.DHTResponse)
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	n.p.dht.Seen(msg.From, to.Addr)
+	return resp, nil
+}
+
+// FindNode implements dht.Network
+func (n dhtNetwork) FindNode(ctx context.Context, to dht.Contact, target dht.Key) ([]dht.Contact, error) {
+	resp, err := n.query(ctx, to, &protocol.DHTRequest{Op: protocol.DHTFindNode, Key: target[:]})
+	if err != nil {
+		return nil, err
+	}
+	return nodeContacts(resp.Closer), nil
+}
+
+// FindProviders implements dht.Network
+func (n dhtNetwork) FindProviders(ctx context.Context, to dht.Contact, key dht.Key) ([]dht.Provider, []dht.Contact, error) {
+	resp, err := n.query(ctx, to, &protocol.DHTRequest{Op: protocol.DHTFindProviders, Key: key[:]})
+	if err != nil {
+		return nil, nil, err
+	}
+	var providers []dht.Provider
+	for _, c := range resp.Providers {
+		if c.PeerID != "" && c.Addr != "" {
+			providers = append(providers, dht.Provider{PeerID: c.PeerID, Addr: c.Addr, Name: c.Name})
+		}
+	}
+	return providers, nodeContacts(resp.Closer), nil
+}
+
+// AddProvider implements dht.Network
+func (n dhtNetwork) AddProvider(ctx context.Context, to dht.Contact, key dht.Key, name string) error {
+	_, err := n.query(ctx, to, &protocol.DHTRequest{Op: protocol.DHTAddProvider, Key: key[:], Name: name})
+	return err
+}
+
+// nodeContacts converts the contacts of a DHTResponse
+func nodeContacts(list []protocol.DHTContact) []dht.Contact {
+	var out []dht.Contact
+	for _, c := range list {
+		if c.PeerID != "" && c.Addr != "" {
+			out = append(out, dht.Contact{ID: dht.NodeKey(c.PeerID), PeerID: c.PeerID, Addr: c.Addr})
+		}
+	}
+	return out
+}
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// FileResult is the outcome of one file of a batch, see RequestDirResults
+type FileResult struct {
+	Name string // Wire name of the file
+	Path string // Where the file was saved, empty if it couldn't be received
+	Err  error
+}
+
+// RequestDir fetches every file under a directory of the peer's shared
+// directory that this peer may read, recreating the tree under the
+// received directory; each file is downloaded as by Download, one at a
+// time, and a failed file doesn't stop the others
+// Files the peer has hard linked together are fetched once and linked
+// the same way here, where the file system allows
+// dir: Wire name of the directory, e.g. "photos/2024"
+// Returns: The paths the files were saved to, and an error if the listing
+// failed or any file couldn't be fetched
+func (p *Peer) RequestDir(ctx context.Context, peerAddr, dir string) ([]string, error) {
+	results, err := p.RequestDirResults(ctx, peerAddr, dir)
+	var paths []string
+	failed := 0
+	for _, r := range results {
+		if r.Err != nil {
+			failed++
+			continue
+		}
+		paths = append(paths, r.Path)
+	}
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d files of %s could not be received", failed, len(results), strings.Trim(wireName(dir), "/"))
+	}
+	return paths, err
+}
+
+// RequestDirResults is like RequestDir but reports the outcome of every
+// file, e.g. to summarise a mirror run
+// Returns: A result for each file tried, and an error only if the listing
+// failed or ctx ended, leaving the remaining files untried
+func (p *Peer) RequestDirResults(ctx context.Context, peerAddr, dir string) ([]FileResult, error) {
+	dir = strings.Trim(wireName(dir), "/")
+	files, err := p.listDir(ctx, peerAddr, dir)
+	if err != nil {
+		return nil, err
+	}
+	logging.Infof(p.logger, "Receiving %d files of %s from %s", len(files), dir, peerAddr)
+
+	var results []FileResult
+	savedAs := map[string]string{} // Where each file was saved, by name relative to dir
+	for _, f := range files {
+		name := path.Join(dir, f.Name)
+		if first, ok := savedAs[f.LinkOf]; ok && f.LinkOf != "" {
+			target, err := p.linkReceived(first, name)
+			if err == nil {
+				logging.Infof(p.logger, "Linked %s to %s as on %s", target, first, peerAddr)
+				savedAs[f.Name] = target
+				results = append(results, FileResult{Name: name, Path: target})
+				continue
+			}
+			logging.Warnf(p.logger, "Could not link %s to %s, receiving it again: %v", name, first, err)
+		}
+		saved, err := p.Download(ctx, name, DownloadOptions{Peers: []string{peerAddr}})
+		if err != nil {
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+			logging.Errorf(p.logger, "Failed to receive %s of %s: %v", name, dir, err)
+			results = append(results, FileResult{Name: name, Err: err})
+			continue
+		}
+		savedAs[f.Name] = saved
+		results = append(results, FileResult{Name: name, Path: saved})
+	}
+	return results, nil
+}
+
+// linkReceived saves a received file as a hard link to one saved before,
+// unless something already exists where it goes
+// Returns: The path of the link
+func (p *Peer) linkReceived(first, name string) (string, error) {
+	target, err := p.receivedTarget(name, protocol.NameEncodingUTF8NFC)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return "", fmt.Errorf("%s already exists", target)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := os.Link(first, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// listDir asks the peer at peerAddr for the files under a shared directory
+// and checks that their names stay inside it
+func (p *Peer) listDir(ctx context.Context, peerAddr, dir string) ([]protocol.ListEntry, error) {
+	features, err := p.PeerFeatures(ctx, peerAddr)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(features, protocol.FeatureDirs) {
+		return nil, fmt.Errorf("peer %s does not serve directories", peerAddr)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	id := p.nextCallID()
+	msg, err := p.call(ctx, peerAddr, protocol.MessageTypeDirRequest, id, &protocol.DirRequest{ID: id, Path: dir})
+	if err != nil {
+		return nil, err
+	}
+	resp := msg.Payload.(*protocol.DirResponse)
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	for _, f := range resp.Files {
+		if !cleanRelative(f.Name) {
+			return nil, fmt.Errorf("peer %s listed an invalid name %q in %s", peerAddr, f.Name, dir)
+		}
+	}
+	return resp.Files, nil
+}
+
+// cleanRelative reports whether name is a clean slash-separated path that
+// stays inside the directory it's relative to
+func cleanRelative(name string) bool {
+	if name == "" || strings.Contains(name, `\`) || path.IsAbs(name) || path.Clean(name) != name {
+		return false
+	}
+	return name != ".." && !strings.HasPrefix(name, "../")
+}
+
+// handleDirRequest answers a request for the files under a shared directory
+func (p *Peer) handleDirRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.DirRequest)
+	resp := &protocol.DirResponse{ID: req.ID}
+
+	files, err := p.listSharedDir(msg.From, req.Path)
+	if err != nil {
+		logging.Errorf(p.logger, "Listing %s for %s failed: %v", req.Path, msg.From, err)
+		resp.Error = err.Error()
+	}
+	resp.Files = files
+
+	if err := p.reply(msg, protocol.MessageTypeDirResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending directory listing: %v", err)
+	}
+}
+
+// handleDirResponse delivers a directory listing to the waiting call
+func (p *Peer) handleDirResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.DirResponse).ID, msg)
+}
+
+// listSharedDir lists the files under a shared directory the peer with the
+// given ID may read, named relative to that directory
+func (p *Peer) listSharedDir(from, dir string) ([]protocol.ListEntry, error) {
+	if err := p.checkFeature(protocol.FeatureDirs); err != nil {
+		return nil, err
+	}
+	if err := checkNameEncoding(dir, protocol.NameEncodingUTF8NFC); err != nil {
+		return nil, err
+	}
+	root, err := resolveShared(p.SharedDir(), dir)
+	if err != nil {
+		return nil, err
+	}
+	// Symlinked directories aren't followed, as when listing the whole
+	// shared directory
+	if info, err := os.Lstat(root); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("no shared directory %s", dir)
+	}
+
+	rel, err := filepath.Rel(p.SharedDir(), root)
+	if err != nil {
+		return nil, err
+	}
+	files, err := p.listShared(p.readableBy(from), root, "")
+	if err != nil {
+		return nil, err
+	}
+	prefix := wireName(rel) + "/"
+	links := map[[2]uint64]string{}
+	for i := range files {
+		files[i].Name = strings.TrimPrefix(files[i].Name, prefix)
+		// Names listed later that share an inode point to the first, so the
+		// content only needs fetching once
+		path, err := resolveShared(root, files[i].Name)
+		if err != nil {
+			continue
+		}
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		if key, ok := hardLinkKey(info); ok {
+			if first, ok := links[key]; ok {
+				files[i].LinkOf = first
+			} else {
+				links[key] = files[i].Name
+			}
+		}
+	}
+	return files, nil
+}
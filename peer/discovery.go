@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/discovery"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// WithDiscovery advertises the peer on the local network over mDNS once it
+// starts and keeps a live list of the other peers advertised there, which
+// Peers includes and DiscoverPeer looks up
+// interval: How often the peer is announced again; others drop it three
+// intervals after its last announcement
+func WithDiscovery(interval time.Duration) Option {
+	return func(p *Peer) {
+		p.discoverEvery = interval
+	}
+}
+
+// startDiscovery starts advertising the peer at its listen address, unless
+// the peer is closing
+// Caller must not hold p.mu, as it opens sockets
+func (p *Peer) startDiscovery() {
+	svc, err := discovery.Start(p.id, p.transport.GetListenAddress(), p.discoverEvery, p.logger)
+	if err != nil {
+		logging.Warnf(p.logger, "mDNS discovery disabled: %v", err)
+		return
+	}
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		svc.Close()
+		return
+	}
+	p.discovery = svc
+	p.mu.Unlock()
+	logging.Infof(p.logger, "Advertising %s on the local network as %s", p.id, discovery.ServiceName)
+}
+
+// discovered returns the peers currently advertised on the local network,
+// or nil without WithDiscovery
+func (p *Peer) discovered() []discovery.Entry {
+	p.mu.Lock()
+	svc := p.discovery
+	p.mu.Unlock()
+	if svc == nil {
+		return nil
+	}
+	return svc.Peers()
+}
+
+// DiscoverPeer waits for the peer with the given ID to be advertised on the
+// local network
+// Returns: The address it listens on, or an error if discovery is off or
+// ctx ends first
+func (p *Peer) DiscoverPeer(ctx context.Context, id string) (string, error) {
+	p.mu.Lock()
+	enabled := p.discoverEvery > 0
+	p.mu.Unlock()
+	if !enabled {
+		return "", fmt.Errorf("peer %s: discovery is not enabled", id)
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		for _, e := range p.discovered() {
+			if e.ID == id {
+				return e.Addr, nil
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return "", fmt.Errorf("peer %s not found on the local network: %v", id, ctx.Err())
+		case <-p.stop:
+			return "", ErrClosed
+		}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package peer
+
+// diskFree is not supported on this platform
+func diskFree(dir string) (int64, bool) {
+	return 0, false
+}
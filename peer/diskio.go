@@ -0,0 +1,46 @@
+package peer
+
+import (
+	"context"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/ratelimit"
+)
+
+// diskLimiter throttles file reads and writes, independently of any
+// network limits, so transfers don't starve other workloads of disk
+// A nil diskLimiter doesn't limit
+type diskLimiter struct {
+	bytes *ratelimit.Limiter // Bytes per second, nil if unlimited
+	ops   *ratelimit.Limiter // Read and write calls per second, nil if unlimited
+}
+
+// WithDiskLimit caps the disk throughput used for serving, hashing and
+// saving files, in bytes per second and read/write operations per second
+// Either limit may be 0 to leave it unrestricted
+func WithDiskLimit(bytesPerSec int64, opsPerSec int) Option {
+	return func(p *Peer) {
+		if bytesPerSec <= 0 && opsPerSec <= 0 {
+			p.disk = nil
+			return
+		}
+		d := &diskLimiter{}
+		if bytesPerSec > 0 {
+			d.bytes = ratelimit.New(float64(bytesPerSec), 0)
+		}
+		if opsPerSec > 0 {
+			d.ops = ratelimit.New(float64(opsPerSec), 0)
+		}
+		p.disk = d
+	}
+}
+
+// wait blocks until a read or write of n bytes is allowed
+func (d *diskLimiter) wait(ctx context.Context, n int) error {
+	if d == nil {
+		return nil
+	}
+	if err := d.ops.WaitN(ctx, 1); err != nil {
+		return err
+	}
+	return d.bytes.WaitN(ctx, n)
+}
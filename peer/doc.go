@@ -0,0 +1,25 @@
+// Package peer implements a node of the P2P file transfer network.
+//
+// A Peer shares files from its shared directory and stores files it
+// receives in its received directory. Network I/O is delegated to a
+// Transport implementation such as transport.TCPTransport.
+//
+// # Concurrency
+//
+// All exported methods of Peer may be called from any number of goroutines.
+// Incoming messages are processed sequentially by a single handler
+// goroutine started by Start, except requests that read files, which are
+// queued for a small pool of serve workers; the queue hands out higher
+// priorities first and shares bandwidth fairly between the transfers of
+// equal priority. State shared between that goroutine and API
+// callers (outstanding requests, known peers, transfer history, lifecycle
+// flags) is guarded by an internal mutex, and accessors such as Peers and
+// History return copies so callers never observe it changing underneath
+// them. The mutex is never held while performing network or disk I/O;
+// Start binds the transport's sockets under a separate lock that only
+// Close waits on.
+//
+// Transport implementations must likewise be safe for concurrent use:
+// Send may be called from the handler goroutine and from API callers at
+// the same time.
+package peer
@@ -0,0 +1,784 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	workersPerSource    = 4                // Average number of pieces requested concurrently from each source
+	maxWorkersPerSource = 16               // Upper bound on concurrent requests to a single source
+	pieceTimeout        = 30 * time.Second // Time allowed for a single piece to arrive
+	maxSourceFailures   = 5                // Consecutive failures after which a source is dropped
+	rateCheckInterval   = time.Second      // How often sources are rescored and requests rebalanced
+)
+
+// pieceSource is anywhere pieces of a file can be fetched from
+type pieceSource interface {
+	fetch(ctx context.Context, m *protocol.Manifest, index int) ([]byte, error)
+	webSeed() bool
+	id() string // Address or URL the source's statistics are recorded under
+	String() string
+}
+
+// DownloadOptions configures a chunked download
+type DownloadOptions struct {
+	Peers    []string           // Addresses of peers holding the file
+	WebSeeds []string           // Web seeds of the file, in addition to those in the manifest; see WithWebSeeds
+	Manifest *protocol.Manifest // Manifest to download; fetched from Peers when nil
+	Priority protocol.Priority  // Initial priority; see Peer.SetPriority
+	Output   string             // Where to save the file instead of the received directory; see Peer.RequestFileTo
+
+	// MinPeerRate is the peer throughput in bytes per second below which
+	// web seeds are used alongside peers. With 0, web seeds are only used
+	// once no peer is able to serve pieces
+	MinPeerRate int64
+
+	// Dedup fetches the file by its content-defined chunks from the first
+	// peer that serves them, taking the chunks local files already hold
+	// from those instead; without such a peer the file is downloaded as
+	// usual
+	Dedup bool
+}
+
+// Download fetches a file piece by piece from peers and HTTP web seeds,
+// verifying every piece against the manifest's hashes before writing it
+// Every source is scored by its measured throughput, round-trip time and
+// reputation, and requests are shifted toward the best sources as the
+// download progresses; see SourceStats
+// Pieces are written to a ".part" file that is moved into place once
+// the whole file has been verified
+// Peers that don't serve files in pieces are left out; if none of them does
+// and there are no web seeds, the file is requested whole from one instead
+// Without any peers, the trackers are asked for them, see WithTrackers
+// With Dedup set, only the chunks not found locally are fetched
+// Calls for a file that is already being downloaded to the same Output
+// wait for that download instead of fetching the file again; see
+// coalesceDownload
+// Returns: The path the file was saved to
+func (p *Peer) Download(ctx context.Context, name string, opts DownloadOptions) (string, error) {
+	return p.coalesceDownload(ctx, wireName(name), opts)
+}
+
+// runDownload performs the work of Download for the first of the calls
+// sharing it
+func (p *Peer) runDownload(ctx context.Context, name string, opts DownloadOptions) (string, error) {
+	if len(opts.Peers) == 0 && len(p.trackers) > 0 {
+		peers, err := p.LocateFile(ctx, name)
+		if err != nil {
+			logging.Errorf(p.logger, "Could not locate %s: %v", name, err)
+		} else {
+			logging.Infof(p.logger, "Trackers list %d peers sharing %s", len(peers), name)
+		}
+		opts.Peers = peers
+	}
+	var dedupFrom string
+	if opts.Dedup {
+		if deduped, _ := p.splitByFeature(ctx, opts.Peers, protocol.FeatureDedup); len(deduped) > 0 {
+			dedupFrom = deduped[0]
+		} else {
+			logging.Infof(p.logger, "No peer serves %s by chunk, downloading it as usual", name)
+		}
+	}
+	chunked, whole := p.splitByFeature(ctx, opts.Peers, protocol.FeatureChunks)
+	if dedupFrom == "" && len(chunked) == 0 && len(whole) > 0 && len(opts.WebSeeds) == 0 && (opts.Manifest == nil || len(opts.Manifest.WebSeeds) == 0) {
+		logging.Infof(p.logger, "No peer serves %s in pieces, requesting the whole file from %s", name, whole[0])
+		return p.receiveWhole(ctx, whole[0], name, opts.Output, opts.Priority)
+	}
+	if dedupFrom != "" {
+		opts.Peers = []string{dedupFrom}
+	} else {
+		opts.Peers = chunked
+	}
+
+	t, err := p.beginTransfer(name, strings.Join(opts.Peers, ","), "receive")
+	if err != nil {
+		return "", err
+	}
+
+	tp := newTransferPriority(opts.Priority)
+	p.mu.Lock()
+	_, exists := p.downloads[name]
+	exists = exists || p.pending[name] != nil
+	if !exists {
+		p.downloads[name] = tp
+	}
+	p.mu.Unlock()
+	if exists {
+		err := fmt.Errorf("download of %s already in progress", name)
+		p.endTransfer(t, 0, err)
+		return "", err
+	}
+
+	var path string
+	var size int64
+	if dedupFrom != "" {
+		path, size, err = p.downloadDedup(ctx, dedupFrom, name, opts.Output, t)
+	} else {
+		path, size, err = p.download(ctx, name, opts, tp, t)
+	}
+	p.mu.Lock()
+	delete(p.downloads, name)
+	p.mu.Unlock()
+	p.endTransfer(t, size, err)
+	if err != nil {
+		return "", err
+	}
+	logging.Infof(p.logger, "File received and saved: %s", path)
+	p.reshareFile(name, path)
+	p.enforceReceivedLimit(path)
+	return path, nil
+}
+
+// receiveWhole requests a file in a single response, for peers that can't
+// serve it in pieces, and waits for it to be saved
+func (p *Peer) receiveWhole(ctx context.Context, addr, name, output string, priority protocol.Priority) (string, error) {
+	t, err := p.requestFile(addr, name, output, nil, priority, true)
+	if err != nil {
+		return "", err
+	}
+	select {
+	case res := <-t.saved:
+		return res.path, res.err
+	case <-ctx.Done():
+		p.mu.Lock()
+		waiting := p.pending[name] == t
+		if waiting {
+			delete(p.pending, name)
+		}
+		p.mu.Unlock()
+		if waiting {
+			p.endTransfer(t, 0, ctx.Err())
+		}
+		return "", ctx.Err()
+	}
+}
+
+// download performs the work of Download
+// Returns: The saved path and the number of bytes downloaded
+func (p *Peer) download(ctx context.Context, name string, opts DownloadOptions, tp *transferPriority, t *transfer) (string, int64, error) {
+	m, peers := p.probePeers(ctx, name, opts.Peers, opts.Manifest, tp)
+	if m == nil {
+		return "", 0, fmt.Errorf("no peer could provide the manifest for %s", name)
+	}
+	if err := m.Validate(); err != nil {
+		return "", 0, err
+	}
+	t.setSize(m.Size)
+	if limit, _ := p.receivedLimitPolicy(); limit > 0 && m.Size > limit && opts.Output == "" {
+		return "", 0, fmt.Errorf("%s is %d bytes, larger than the received directory limit of %d", name, m.Size, limit)
+	}
+	seeds := p.probeWebSeeds(ctx, name, opts.WebSeeds, m.WebSeeds)
+	if len(peers) == 0 && len(seeds) == 0 {
+		return "", 0, fmt.Errorf("no reachable source for %s", name)
+	}
+
+	target, err := p.saveTarget(name, protocol.NameEncodingUTF8NFC, opts.Output)
+	if err != nil {
+		return "", 0, err
+	}
+	// Keep what an interrupted download left behind; pieces that don't
+	// match the manifest are fetched again
+	file, have, err := p.openPart(ctx, target, m)
+	if err != nil {
+		return "", 0, err
+	}
+	if n := have.Count(m.NumPieces()); n > 0 {
+		logging.Infof(p.logger, "Resuming download of %s with %d of %d pieces already present", name, n, m.NumPieces())
+	}
+
+	d := newDownloader(m, file, have, p.logger)
+	d.disk = p.disk
+	d.slots = p.slots
+	d.priority = tp
+	d.progress = t
+	d.metrics = p.metrics
+	d.migrate = func(ctx context.Context, s *activeSource) *activeSource {
+		return p.migrateSource(ctx, d, s)
+	}
+	if len(peers) == 1 && len(seeds) == 0 && p.knownFeature(peers[0].src.id(), protocol.FeaturePush) {
+		// A single peer can stream exactly the pieces still missing;
+		// whatever it doesn't deliver is requested piece by piece below
+		p.pushMissing(ctx, d, peers[0], tp)
+	} else {
+		p.announceHave(d, peers)
+	}
+	err = d.run(ctx, peers, seeds, opts.MinPeerRate)
+	sources := d.started() // Including those of peers that moved
+	for _, s := range sources {
+		p.updateSourceStats(s.stats)
+	}
+	if err != nil {
+		p.keepPart(target, file, m, d.written())
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// The verified pieces stay in the .part file, listed in its
+		// sidecar, for the next attempt to resume from; see
+		// WithGarbageCollection for removing them
+		return "", 0, err
+	}
+
+	final, err := p.finishPart(name, target, strings.Join(opts.Peers, ","))
+	if err != nil {
+		return "", 0, err
+	}
+	p.issueReceipts(name, final, nil, m.Size, sourceBytes(sources))
+	return final, m.Size, nil
+}
+
+// finishPart moves the completed ".part" file of target into place, unless
+// the receive filter rejects it
+// peer: The source recorded if the file is quarantined
+// Returns: The final path
+func (p *Peer) finishPart(name, target, peer string) (string, error) {
+	part := p.partPath(target)
+	if reject := p.filterReceived(name, part); reject != nil {
+		p.rejectFile(part, QuarantineEntry{Name: name, Target: target, Peer: peer, Reason: QuarantinePolicy, Detail: reject.Error()})
+		return "", fmt.Errorf("rejected by receive filter: %v", reject)
+	}
+
+	final, err := p.resolveConflict(target)
+	if err == nil {
+		err = moveFile(part, final)
+	}
+	if err != nil {
+		os.Remove(part)
+		return "", err
+	}
+	p.setReceivedPerms(final, nil)
+	return final, nil
+}
+
+// probePeers asks every peer for the file's manifest, which both checks
+// that the peer can serve it and measures the round-trip time
+// Peers whose manifest differs from the one downloaded are left out
+// Returns: The manifest to download and the usable peers with their stats
+func (p *Peer) probePeers(ctx context.Context, name string, addrs []string, m *protocol.Manifest, tp *transferPriority) (*protocol.Manifest, []*activeSource) {
+	type probe struct {
+		addr     string
+		peerID   string
+		manifest *protocol.Manifest
+		rtt      time.Duration
+		err      error
+	}
+	addrs = p.expandPaths(addrs)
+	probes := make([]probe, len(addrs))
+	var wg sync.WaitGroup
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+			defer cancel()
+			start := time.Now()
+			fetched, peerID, err := p.fetchManifest(probeCtx, addr, name)
+			probes[i] = probe{addr: addr, peerID: peerID, manifest: fetched, rtt: time.Since(start), err: err}
+		}(i, addr)
+	}
+	wg.Wait()
+
+	var peers []*activeSource
+	for _, pr := range probes {
+		if pr.err != nil {
+			logging.Warnf(p.logger, "Could not get manifest for %s from %s: %v", name, pr.addr, pr.err)
+			continue
+		}
+		if m == nil {
+			m = pr.manifest
+		} else if !m.SameContent(pr.manifest) {
+			logging.Warnf(p.logger, "Peer %s has different content for %s, not using it", pr.addr, name)
+			continue
+		}
+		src := &peerSource{p: p, addr: pr.addr, peerID: pr.peerID, priority: tp}
+		stats := p.sourceStats(src)
+		stats.RTT = time.Duration(smooth(float64(stats.RTT), float64(pr.rtt)))
+		peers = append(peers, &activeSource{src: src, stats: stats})
+	}
+	return m, peers
+}
+
+// probeWebSeeds checks which web seeds serve the file and measures their latency
+// Returns: The usable web seeds with their stats
+func (p *Peer) probeWebSeeds(ctx context.Context, name string, bases, urls []string) []*activeSource {
+	seen := make(map[string]bool)
+	var candidates []*httpSource
+	for _, base := range bases {
+		urls = append(urls, webSeedURL(base, name))
+	}
+	for _, u := range urls {
+		if !seen[u] {
+			seen[u] = true
+			candidates = append(candidates, newHTTPSource(u))
+		}
+	}
+
+	rtts := make([]time.Duration, len(candidates))
+	errs := make([]error, len(candidates))
+	var wg sync.WaitGroup
+	for i, src := range candidates {
+		wg.Add(1)
+		go func(i int, src *httpSource) {
+			defer wg.Done()
+			rtts[i], errs[i] = probeWebSeed(ctx, src)
+		}(i, src)
+	}
+	wg.Wait()
+
+	var seeds []*activeSource
+	for i, src := range candidates {
+		if errs[i] != nil {
+			logging.Warnf(p.logger, "Web seed %s is unavailable: %v", src.url, errs[i])
+			continue
+		}
+		stats := p.sourceStats(src)
+		stats.RTT = time.Duration(smooth(float64(stats.RTT), float64(rtts[i])))
+		seeds = append(seeds, &activeSource{src: src, stats: stats})
+	}
+	return seeds
+}
+
+// activeSource is a source taking part in a download
+// All fields other than src are guarded by the downloader's mutex
+type activeSource struct {
+	src       pieceSource
+	stats     SourceStats
+	started   bool  // Workers have been started
+	dropped   bool  // Failed too often and no longer used
+	moved     bool  // Dropped and looked for at another address, see downloader.migrate
+	share     int   // Workers the source's score entitles it to
+	limit     int   // Workers currently allowed to request pieces, the share cut to the congestion window
+	inflight  int   // Requests currently outstanding
+	failures  int   // Consecutive failed pieces
+	bytes     int64 // Bytes delivered since the last rebalance
+	delivered int64 // Bytes delivered over the whole download
+	cc        congestion
+}
+
+// downloader schedules the pieces of one file across its sources
+// Each source runs workers pulling piece indices from a shared queue, and
+// failed pieces go back on the queue for any source to retry. How many of
+// a source's workers may request pieces at once is recomputed from its
+// score every rateCheckInterval, so faster sources take more of the queue,
+// and is further held to the source's congestion window
+type downloader struct {
+	m      *protocol.Manifest
+	file   *os.File
+	disk   *diskLimiter // Throttle for piece writes, may be nil
+	logger *log.Logger
+
+	slots    *prioritySlots    // Shared with other downloads, nil for no limit
+	priority *transferPriority // Decides the download's turn for slots
+	progress *transfer         // Receives the bytes written, may be nil
+	metrics  *peerMetrics      // Records piece outcomes, may be nil
+
+	// migrate looks for the peer behind a dropped source at another
+	// address, returning a source there or nil; may be nil
+	migrate func(ctx context.Context, s *activeSource) *activeSource
+
+	pieces   chan int           // Pieces waiting to be fetched
+	done     chan struct{}      // Closed once every piece is written
+	dropped  chan struct{}      // Signalled whenever a source is dropped
+	migrated chan *activeSource // Results of migrate
+	fatal    chan error         // Errors that abort the download
+
+	mu        sync.Mutex
+	wake      *sync.Cond // Broadcast when worker limits change or the download ends
+	stopped   bool       // The download is over; idle workers should exit
+	sources   []*activeSource
+	have      protocol.Bitmap // Pieces written to the file
+	remaining int             // Pieces not yet written
+}
+
+// newDownloader prepares a download of m into file
+// have: Pieces the file already holds, e.g. from an interrupted download; may be nil
+func newDownloader(m *protocol.Manifest, file *os.File, have protocol.Bitmap, logger *log.Logger) *downloader {
+	if have == nil {
+		have = protocol.NewBitmap(m.NumPieces())
+	}
+	d := &downloader{
+		m:         m,
+		file:      file,
+		logger:    logger,
+		pieces:    make(chan int, m.NumPieces()),
+		done:      make(chan struct{}),
+		dropped:   make(chan struct{}, 1),
+		migrated:  make(chan *activeSource),
+		fatal:     make(chan error, 1),
+		have:      have,
+		remaining: m.NumPieces() - have.Count(m.NumPieces()),
+	}
+	d.wake = sync.NewCond(&d.mu)
+	return d
+}
+
+// run fetches every missing piece and returns once the file is complete
+func (d *downloader) run(ctx context.Context, peers, seeds []*activeSource, minPeerRate int64) error {
+	d.mu.Lock()
+	missing := d.have.Missing(d.m.NumPieces())
+	d.mu.Unlock()
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, i := range missing {
+		d.pieces <- i
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		d.mu.Lock()
+		d.stopped = true
+		d.wake.Broadcast()
+		d.mu.Unlock()
+		wg.Wait()
+	}()
+
+	start := func(sources []*activeSource) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for _, s := range sources {
+			s.started = true
+			d.sources = append(d.sources, s)
+			for slot := 0; slot < maxWorkersPerSource; slot++ {
+				wg.Add(1)
+				go func(s *activeSource, slot int) {
+					defer wg.Done()
+					d.worker(ctx, s, slot)
+				}(s, slot)
+			}
+		}
+		d.rebalance()
+	}
+
+	seedsStarted := false
+	startSeeds := func(reason string) {
+		if seedsStarted || len(seeds) == 0 {
+			return
+		}
+		seedsStarted = true
+		logging.Infof(d.logger, "Using %d web seed(s) for %s: %s", len(seeds), d.m.Name, reason)
+		start(seeds)
+	}
+
+	// Dropped peers are looked for at other addresses, and the download
+	// only fails once every search came to nothing
+	migrating := 0
+	migrateDropped := func() {
+		d.mu.Lock()
+		var dropped []*activeSource
+		for _, s := range d.sources {
+			if s.dropped && !s.moved && !s.src.webSeed() {
+				s.moved = true
+				dropped = append(dropped, s)
+			}
+		}
+		d.mu.Unlock()
+		for _, s := range dropped {
+			migrating++
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				moved := d.migrate(ctx, s)
+				select {
+				case d.migrated <- moved:
+				case <-ctx.Done():
+				}
+			}()
+		}
+	}
+
+	start(peers)
+	if len(peers) == 0 {
+		startSeeds("no peer is reachable")
+	}
+
+	ticker := time.NewTicker(rateCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return nil
+		case err := <-d.fatal:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-d.dropped:
+			if d.migrate != nil {
+				migrateDropped()
+			}
+		case moved := <-d.migrated:
+			migrating--
+			if moved != nil {
+				start([]*activeSource{moved})
+				continue
+			}
+		case <-ticker.C:
+			d.mu.Lock()
+			var peerBytes int64
+			for _, s := range d.sources {
+				if !s.src.webSeed() {
+					peerBytes += s.bytes
+				}
+			}
+			d.rebalance()
+			d.mu.Unlock()
+
+			rate := int64(float64(peerBytes) / rateCheckInterval.Seconds())
+			if minPeerRate > 0 && rate < minPeerRate {
+				startSeeds(fmt.Sprintf("peer throughput %d B/s below %d B/s", rate, minPeerRate))
+			}
+			continue
+		}
+
+		// A source was dropped, or a dropped one couldn't be found again
+		if d.liveSources() > 0 || migrating > 0 {
+			continue
+		}
+		if !seedsStarted && len(seeds) > 0 {
+			startSeeds("all peers failed")
+			continue
+		}
+		return fmt.Errorf("all sources for %s failed", d.m.Name)
+	}
+}
+
+// liveSources returns the number of started sources that haven't been dropped
+func (d *downloader) liveSources() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := 0
+	for _, s := range d.sources {
+		if !s.dropped {
+			n++
+		}
+	}
+	return n
+}
+
+// started returns the sources the download has used
+func (d *downloader) started() []*activeSource {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*activeSource(nil), d.sources...)
+}
+
+// written returns a copy of the pieces written to the file so far
+func (d *downloader) written() protocol.Bitmap {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(protocol.Bitmap(nil), d.have...)
+}
+
+// rebalance shares the request budget among the live sources in proportion
+// to their scores, keeping at least one request open to each so that
+// every source keeps being measured
+// Caller must hold d.mu
+func (d *downloader) rebalance() {
+	var live []*activeSource
+	var total float64
+	for _, s := range d.sources {
+		s.bytes = 0
+		if !s.dropped {
+			live = append(live, s)
+			total += s.stats.Score()
+		}
+	}
+
+	budget := float64(workersPerSource * len(live))
+	for _, s := range live {
+		limit := workersPerSource
+		if total > 0 {
+			limit = int(math.Round(budget * s.stats.Score() / total))
+		}
+		if limit < 1 {
+			limit = 1
+		}
+		if limit > maxWorkersPerSource {
+			limit = maxWorkersPerSource
+		}
+		s.share = limit
+		s.limit = min(limit, s.cc.limit())
+	}
+	d.wake.Broadcast()
+}
+
+// applyWindow cuts the source's worker limit to its congestion window
+// after the window changed, waking workers if it grew
+// Caller must hold d.mu
+func (d *downloader) applyWindow(s *activeSource) {
+	limit := min(s.share, s.cc.limit())
+	if limit > s.limit {
+		d.wake.Broadcast()
+	}
+	s.limit = limit
+}
+
+// congested records a piece latency or loss in the source's congestion
+// window; timedOut marks a lost piece
+// Caller must hold d.mu
+func (d *downloader) congested(s *activeSource, elapsed time.Duration, timedOut bool) {
+	now, before := time.Now(), s.cc.limit()
+	var backoff bool
+	if timedOut {
+		backoff = s.cc.lost(now)
+	} else {
+		backoff = s.cc.sample(elapsed, now)
+	}
+	if backoff && d.metrics != nil {
+		d.metrics.congestion.Inc()
+	}
+	if s.cc.limit() < before {
+		logging.Warnf(d.logger, "Congestion toward %s (queueing delay %v), down to %d requests at a time", s.src, s.cc.queueDelay().Round(time.Millisecond), s.cc.limit())
+	}
+	d.applyWindow(s)
+}
+
+// worker fetches pieces from a single source while its slot is within the
+// source's current limit, until the download finishes or the source is dropped
+func (d *downloader) worker(ctx context.Context, s *activeSource, slot int) {
+	for {
+		d.mu.Lock()
+		for slot >= s.limit && !s.dropped && !d.stopped {
+			d.wake.Wait()
+		}
+		if s.dropped || d.stopped {
+			d.mu.Unlock()
+			return
+		}
+		d.mu.Unlock()
+
+		var index int
+		select {
+		case index = <-d.pieces:
+		case <-d.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+
+		d.mu.Lock()
+		if s.dropped {
+			d.mu.Unlock()
+			d.pieces <- index
+			return
+		}
+		s.inflight++
+		d.mu.Unlock()
+
+		if d.slots != nil {
+			if err := d.slots.acquire(ctx, d.priority); err != nil {
+				d.pieces <- index
+				return
+			}
+		}
+		start := time.Now()
+		pieceCtx, cancel := context.WithTimeout(ctx, pieceTimeout)
+		data, err := s.src.fetch(pieceCtx, d.m, index)
+		timedOut := pieceCtx.Err() == context.DeadlineExceeded
+		cancel()
+		if d.slots != nil {
+			d.slots.release()
+		}
+		elapsed := time.Since(start)
+		if err == nil {
+			err = d.m.VerifyPiece(index, data)
+		}
+		if err == nil || timedOut {
+			d.mu.Lock()
+			d.congested(s, elapsed, timedOut)
+			d.mu.Unlock()
+		}
+		if err != nil {
+			d.pieces <- index
+			if ctx.Err() != nil {
+				return
+			}
+			logging.Warnf(d.logger, "Piece %d of %s from %s failed: %v", index, d.m.Name, s.src, err)
+			if d.metrics != nil {
+				d.metrics.piecesFail.Inc()
+			}
+			d.fail(s)
+			continue
+		}
+
+		offset, _ := d.m.PieceRange(index)
+		if err := d.disk.wait(ctx, len(data)); err != nil {
+			d.pieces <- index
+			return
+		}
+		if _, err := d.file.WriteAt(data, offset); err != nil {
+			select {
+			case d.fatal <- fmt.Errorf("writing piece %d: %v", index, err):
+			default:
+			}
+			return
+		}
+		d.complete(s, index, len(data), time.Since(start))
+		if d.metrics != nil {
+			d.metrics.piecesOK.Inc()
+			d.metrics.pieceTime.Since(start)
+		}
+		if d.progress != nil {
+			d.progress.addProgress(int64(len(data)))
+		}
+	}
+}
+
+// fail records a failed piece and drops the source after too many in a row
+func (d *downloader) fail(s *activeSource) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s.inflight--
+	s.failures++
+	s.stats.Bad++
+	if s.failures >= maxSourceFailures && !s.dropped {
+		logging.Warnf(d.logger, "Giving up on %s after %d failures", s.src, s.failures)
+		s.dropped = true
+		d.wake.Broadcast()
+		select {
+		case d.dropped <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// complete records a written piece and signals completion after the last one
+// The source's throughput is estimated from the piece's own transfer rate
+// times the number of requests it was sharing the source with
+func (d *downloader) complete(s *activeSource, index, n int, elapsed time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.have.Set(index)
+	if elapsed > 0 {
+		rate := float64(n) / elapsed.Seconds() * float64(s.inflight)
+		s.stats.Throughput = smooth(s.stats.Throughput, rate)
+	}
+	s.inflight--
+	s.failures = 0
+	s.stats.Good++
+	s.bytes += int64(n)
+	s.delivered += int64(n)
+
+	d.remaining--
+	if d.remaining == 0 {
+		d.stopped = true
+		close(d.done)
+		d.wake.Broadcast()
+	}
+}
@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+const (
+	helloTimeout = 5 * time.Second  // Time allowed for a peer to answer a Hello
+	featureTTL   = 10 * time.Minute // How long a peer's advertised features are trusted
+)
+
+// featureEntry caches the features a remote peer advertised
+type featureEntry struct {
+	features []string
+	checked  time.Time
+}
+
+// WithoutFeatures stops the peer from advertising and serving the named
+// features, see protocol.Features; other peers fall back to the rest, e.g.
+// to whole-file requests without protocol.FeatureChunks
+func WithoutFeatures(names ...string) Option {
+	return func(p *Peer) {
+		for _, name := range names {
+			p.disabled[name] = true
+		}
+	}
+}
+
+// Features returns the features the peer advertises to others
+func (p *Peer) Features() []string {
+	var list []string
+	for _, f := range protocol.Features() {
+		if !p.disabled[f] {
+			list = append(list, f)
+		}
+	}
+	return list
+}
+
+// checkFeature refuses requests for a feature the peer doesn't serve
+func (p *Peer) checkFeature(name string) error {
+	if p.disabled[name] {
+		return fmt.Errorf("feature %s is disabled on this peer", name)
+	}
+	return nil
+}
+
+// PeerFeatures returns the features the peer at addr advertises, asking
+// it unless they were learned recently
+// A peer that doesn't answer in time is taken to predate feature
+// advertisement and to support only whole-file requests
+// Returns: An error only if the peer can't be reached
+func (p *Peer) PeerFeatures(ctx context.Context, addr string) ([]string, error) {
+	remote, _ := transport.SplitPathAddr(addr)
+	p.mu.Lock()
+	e, ok := p.features[remote]
+	p.mu.Unlock()
+	if ok && time.Since(e.checked) < featureTTL {
+		return e.features, nil
+	}
+
+	helloCtx, cancel := context.WithTimeout(ctx, helloTimeout)
+	defer cancel()
+	id := p.nextCallID()
+	msg, err := p.call(helloCtx, remote, protocol.MessageTypeHello, id, &protocol.Hello{ID: id, Features: p.Features(), Addr: p.Addr()})
+	var features []string
+	switch {
+	case err == nil:
+		features = msg.Payload.(*protocol.HelloResponse).Features
+		p.notePeerFeatures(msg.From, features)
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		logging.Infof(p.logger, "Peer %s did not answer a hello, assuming it only supports whole-file transfers", remote)
+	default:
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.features[remote] = featureEntry{features: features, checked: time.Now()}
+	p.mu.Unlock()
+	return features, nil
+}
+
+// knownFeature reports whether the peer at addr advertised a feature, as
+// far as PeerFeatures has learned
+func (p *Peer) knownFeature(addr, name string) bool {
+	remote, _ := transport.SplitPathAddr(addr)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Contains(p.features[remote].features, name)
+}
+
+// splitByFeature separates the peers known to lack a feature from the rest
+// Peers that can't be reached stay with the rest, to fail where they are used
+func (p *Peer) splitByFeature(ctx context.Context, addrs []string, name string) (with, without []string) {
+	for _, addr := range addrs {
+		features, err := p.PeerFeatures(ctx, addr)
+		if err == nil && !slices.Contains(features, name) {
+			without = append(without, addr)
+			continue
+		}
+		with = append(with, addr)
+	}
+	return with, without
+}
+
+// notePeerFeatures records the features a peer advertised
+func (p *Peer) notePeerFeatures(id string, features []string) {
+	if id == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, ok := p.peers[id]
+	if !ok {
+		info = &PeerInfo{ID: id}
+		p.peers[id] = info
+	}
+	info.Features = append([]string(nil), features...)
+}
+
+// handleHello answers another peer's Hello with the features this peer serves
+func (p *Peer) handleHello(msg protocol.Message) {
+	req := msg.Payload.(*protocol.Hello)
+	p.notePeerFeatures(msg.From, req.Features)
+	if req.Addr != "" {
+		p.noteListenAddr(msg.From, advertisedAddr(req.Addr, msg.FromAddr))
+	}
+
+	resp := &protocol.HelloResponse{ID: req.ID, Features: p.Features(), Version: Version()}
+	if err := p.reply(msg, protocol.MessageTypeHelloResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error answering hello: %v", err)
+	}
+}
+
+// helloTransport is implemented by transports that send a handshake with
+// the peer's ID and features when a connection opens, such as
+// transport.TCPTransport
+type helloTransport interface {
+	SetHello(id string, features []string)
+}
+
+// setupHello gives the transport the ID and features to send in the
+// handshake of new connections
+func (p *Peer) setupHello() {
+	if t, ok := p.transport.(helloTransport); ok {
+		t.SetHello(p.id, p.Features())
+	}
+}
+
+// handleHandshake records the features a peer sent when its connection
+// opened
+func (p *Peer) handleHandshake(msg protocol.Message) {
+	p.notePeerFeatures(msg.From, msg.Payload.(*protocol.Handshake).Features)
+}
+
+// handleHelloResponse delivers a peer's features to the waiting PeerFeatures call
+func (p *Peer) handleHelloResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.HelloResponse).ID, msg)
+}
@@ -0,0 +1,97 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// defaultFetchLimit is the largest file Fetch returns unless WithFetchLimit
+// says otherwise
+const defaultFetchLimit = 16 << 20
+
+// ErrTooLarge is returned by Fetch for files over the fetch limit, which
+// are better saved with Download
+var ErrTooLarge = errors.New("file is too large to fetch into memory")
+
+// WithFetchLimit sets the largest file Fetch returns, 16 MiB by default
+func WithFetchLimit(maxBytes int64) Option {
+	return func(p *Peer) {
+		p.fetchLimit = maxBytes
+	}
+}
+
+// Fetch receives a small file from a peer into memory instead of saving
+// it, e.g. to use the network for configuration or build artifacts
+// Pieces are fetched one after another and verified against the file's
+// manifest; the peer must serve files in pieces
+// peerID: ID of a peer seen so far, or its address
+// Returns: The file's contents, or ErrTooLarge if the file is larger than
+// the fetch limit, see WithFetchLimit
+func (p *Peer) Fetch(ctx context.Context, peerID, name string) ([]byte, error) {
+	name = wireName(name)
+	addr, err := p.peerAddr(peerID)
+	if err != nil {
+		return nil, err
+	}
+	if chunked, _ := p.splitByFeature(ctx, []string{addr}, protocol.FeatureChunks); len(chunked) == 0 {
+		return nil, fmt.Errorf("peer %s doesn't serve files in pieces", peerID)
+	}
+	m, err := p.FetchManifest(ctx, addr, name)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	if m.Size > p.fetchLimit {
+		return nil, fmt.Errorf("%w: %s is %d bytes, over the limit of %d", ErrTooLarge, name, m.Size, p.fetchLimit)
+	}
+
+	t, err := p.beginTransfer(name, addr, "receive")
+	if err != nil {
+		return nil, err
+	}
+	t.setSize(m.Size)
+	data, err := p.fetchPieces(ctx, addr, m, t)
+	p.endTransfer(t, int64(len(data)), err)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// fetchPieces receives every piece of a file from one peer
+func (p *Peer) fetchPieces(ctx context.Context, addr string, m *protocol.Manifest, t *transfer) ([]byte, error) {
+	src := &peerSource{p: p, addr: addr, priority: newTransferPriority(protocol.PriorityHigh)}
+	data := make([]byte, 0, m.Size)
+	for i := 0; i < m.NumPieces(); i++ {
+		piece, err := src.fetch(ctx, m, i)
+		if err != nil {
+			return nil, fmt.Errorf("piece %d of %s: %v", i, m.Name, err)
+		}
+		if err := m.VerifyPiece(i, piece); err != nil {
+			return nil, err
+		}
+		data = append(data, piece...)
+		t.addProgress(int64(len(piece)))
+	}
+	return data, nil
+}
+
+// peerAddr returns the address of a peer given by ID; anything holding a
+// ":" is taken to be an address already
+func (p *Peer) peerAddr(peerID string) (string, error) {
+	if strings.Contains(peerID, ":") {
+		return peerID, nil
+	}
+	for _, info := range p.Peers() {
+		if info.ID == peerID && info.DialAddr() != "" {
+			return info.DialAddr(), nil
+		}
+	}
+	return "", fmt.Errorf("unknown peer %s", peerID)
+}
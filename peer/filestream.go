@@ -0,0 +1,477 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	fileDataSize      = 1 << 20          // Bytes per FileData message of a streamed file
+	fileStreamTimeout = 30 * time.Second // Silence after which a streamed file is given up
+)
+
+// WithHashAlgorithms sets the algorithms whole files are checked with, see
+// package checksum, most preferred first: a request offers them to the
+// sender, which uses the first it also takes, and a sender takes only
+// these. Without it requests offer SHA-256 alone and any algorithm is
+// taken; SHA-256 is the fallback either way, as every peer supports it
+// BLAKE3 is a faster cryptographic hash on machines with several cores;
+// xxHash64 is faster still but only catches damage, not forged content
+func WithHashAlgorithms(names ...string) Option {
+	return func(p *Peer) {
+		p.hashAlgorithms = names
+	}
+}
+
+// fileStream is a streamed file being received into a temporary file
+type fileStream struct {
+	key    string // Entry in p.fileStreams
+	from   string
+	addr   string // Address the stream arrives from
+	resp   *protocol.FileResponse
+	target string    // Where the file is saved, before the conflict policy
+	t      *transfer // Transfer of the request, nil for an unsolicited file
+
+	mu      sync.Mutex
+	file    *os.File
+	sink    io.Writer       // Receives the content instead of file, see Peer.ReceiveTo
+	hasher  checksum.Hasher // Algorithm the sender hashes the file with
+	hash    hash.Hash
+	written int64
+	timer   *time.Timer // Gives up on the stream when it stalls
+	done    bool
+}
+
+// sendStreamed sends a shared file as a FileResponse header followed by
+// FileData messages, reading it a part at a time so that memory use
+// doesn't grow with the size of the file
+// Returns: Number of bytes sent and any error encountered
+func (p *Peer) sendStreamed(msg protocol.Message, req *protocol.FileRequest, filePath string, t *transfer) (int64, error) {
+	file, err := openShared(filePath)
+	if err != nil {
+		logging.Errorf(p.logger, "Error opening file: %v", err)
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	resp := &protocol.FileResponse{
+		Name:         req.FileName,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		Size:         info.Size(),
+		Streamed:     true,
+	}
+	if req.WantMeta {
+		resp.Meta = readMeta(filePath, info)
+	}
+
+	hasher := checksum.Negotiate(req.HashAlgorithms, p.hashAlgorithms)
+	resp.HashAlgorithm = hasher.Name()
+
+	// Resume after the requester's bytes if they are still the start of
+	// the file; they are hashed with the algorithm it prefers, so resuming
+	// needs the sender to use that one too
+	h := hasher.New()
+	if req.Offset > 0 && req.Offset <= info.Size() && hasher.Name() == checksum.Preferred(req.HashAlgorithms) {
+		prefix, err := p.hashPrefix(file, req.Offset, hasher)
+		if err == nil && bytes.Equal(prefix.Sum(nil), req.PrefixHash) {
+			h, resp.Offset = prefix, req.Offset
+		} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+	}
+	if resp.Offset > 0 {
+		logging.Infof(p.logger, "Resuming file %s for peer %s at byte %d of %d", req.FileName, msg.From, resp.Offset, info.Size())
+	} else {
+		logging.Infof(p.logger, "Streaming file %s (%d bytes, %s) to peer %s", req.FileName, info.Size(), hasher.Name(), msg.From)
+	}
+	t.setSize(info.Size() - resp.Offset)
+	if err := p.reply(msg, protocol.MessageTypeFileResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending file response: %v", err)
+		return 0, err
+	}
+
+	// Bytes appended while sending are left out, so the size stays as
+	// announced. Requesters that accept holes are sent the holes of a
+	// sparse file, and parts that read as zeros, as lengths alone
+	size := info.Size()
+	buf := make([]byte, fileDataSize)
+	sent := resp.Offset
+	for sent < size {
+		want := min(int64(len(buf)), size-sent)
+		if req.Sparse {
+			hole, data := dataExtent(file, sent, size)
+			if hole > 0 {
+				if err := p.sendHole(msg, req.FileName, sent, hole, h); err != nil {
+					return sent - resp.Offset, err
+				}
+				sent += hole
+				t.addProgress(hole)
+				continue
+			}
+			if data > 0 {
+				want = min(want, data)
+			}
+		}
+		if err := p.disk.wait(context.Background(), int(want)); err != nil {
+			return sent - resp.Offset, err
+		}
+		n, err := file.ReadAt(buf[:want], sent)
+		if n > 0 && req.Sparse && allZero(buf[:n]) {
+			if err := p.sendHole(msg, req.FileName, sent, int64(n), h); err != nil {
+				return sent - resp.Offset, err
+			}
+			sent += int64(n)
+			t.addProgress(int64(n))
+		} else if n > 0 {
+			h.Write(buf[:n])
+			data := &protocol.FileData{Name: req.FileName, Offset: sent}
+			data.Data, data.Compression = p.compressData(req.Compression, buf[:n])
+			if err := p.reply(msg, protocol.MessageTypeFileData, data); err != nil {
+				logging.Errorf(p.logger, "Error streaming file %s: %v", req.FileName, err)
+				return sent - resp.Offset, err
+			}
+			sent += int64(n)
+			t.addProgress(int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			p.reply(msg, protocol.MessageTypeFileData, &protocol.FileData{Name: req.FileName, Offset: sent, Last: true, Error: err.Error()})
+			return sent - resp.Offset, err
+		}
+	}
+
+	last := &protocol.FileData{Name: req.FileName, Offset: sent, Last: true, Hash: h.Sum(nil)}
+	if err := p.reply(msg, protocol.MessageTypeFileData, last); err != nil {
+		return sent - resp.Offset, err
+	}
+	logging.Infof(p.logger, "Successfully sent file %s to peer %s", req.FileName, msg.From)
+	return sent - resp.Offset, nil
+}
+
+// sendHole sends a run of zeros of a streamed file as a hole, adding the
+// zeros to the file's hash h
+func (p *Peer) sendHole(msg protocol.Message, name string, offset, length int64, h hash.Hash) error {
+	hashZeros(h, length)
+	if err := p.reply(msg, protocol.MessageTypeFileData, &protocol.FileData{Name: name, Offset: offset, Hole: length}); err != nil {
+		logging.Errorf(p.logger, "Error streaming file %s: %v", name, err)
+		return err
+	}
+	return nil
+}
+
+// zeros is a block of zeros for hashing holes
+var zeros = make([]byte, 64<<10)
+
+// hashZeros adds n zero bytes to h
+func hashZeros(h hash.Hash, n int64) {
+	for n > 0 {
+		k := min(n, int64(len(zeros)))
+		h.Write(zeros[:k])
+		n -= k
+	}
+}
+
+// allZero reports whether b holds only zeros
+func allZero(b []byte) bool {
+	for len(b) > 0 {
+		k := min(len(b), len(zeros))
+		if !bytes.Equal(b[:k], zeros[:k]) {
+			return false
+		}
+		b = b[k:]
+	}
+	return true
+}
+
+// receiveStreamed prepares to receive the content of a streamed
+// FileResponse for target: into the ".part" file of a request, kept
+// when the stream breaks off so that the request can resume from it, or
+// into a temporary file for an unsolicited file. A request with a sink
+// has the content written to it instead, and no target
+// t: Transfer of the request, nil for an unsolicited file
+func (p *Peer) receiveStreamed(msg protocol.Message, resp *protocol.FileResponse, target string, t *transfer) error {
+	hasher, err := checksum.Lookup(resp.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+	var file *os.File
+	var h hash.Hash
+	switch {
+	case t != nil && t.sink != nil:
+		if resp.Offset != 0 {
+			return fmt.Errorf("stream starts at byte %d, requested 0", resp.Offset)
+		}
+		h = hasher.New()
+	case t == nil:
+		if resp.Offset != 0 {
+			return fmt.Errorf("unrequested stream starts at byte %d", resp.Offset)
+		}
+		h = hasher.New()
+		file, err = p.createTemp(target)
+	default:
+		// The .part file may hold pieces of an earlier download, whose
+		// list no longer applies once the stream writes to it
+		part := p.partPath(target)
+		os.Remove(part + haveSuffix)
+		file, err = os.OpenFile(part, os.O_CREATE|os.O_RDWR, p.fileMode(resp.Meta))
+		if err == nil {
+			if h, err = resumePart(file, resp, hasher, t); err != nil {
+				file.Close()
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if resp.Offset > 0 {
+		logging.Infof(p.logger, "Resuming %s from %s at byte %d of %d", resp.Name, msg.From, resp.Offset, resp.Size)
+		t.setSize(resp.Size - resp.Offset)
+	}
+	s := &fileStream{
+		key:     msg.From + "\x00" + resp.Name,
+		from:    msg.From,
+		addr:    msg.FromAddr,
+		resp:    resp,
+		target:  target,
+		t:       t,
+		file:    file,
+		hasher:  hasher,
+		hash:    h,
+		written: resp.Offset,
+	}
+	if t != nil {
+		s.sink = t.sink
+	}
+	s.timer = time.AfterFunc(fileStreamTimeout, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		p.finishStreamed(s, errors.New("stream stalled"))
+	})
+
+	p.mu.Lock()
+	old := p.fileStreams[s.key]
+	p.fileStreams[s.key] = s
+	p.mu.Unlock()
+	if old != nil {
+		old.mu.Lock()
+		p.finishStreamed(old, errors.New("replaced by a new response"))
+		old.mu.Unlock()
+	}
+	return nil
+}
+
+// resumePart prepares the ".part" file of a request for a stream starting
+// at resp.Offset, which is either 0 or where the request asked to resume
+// hasher: The algorithm the sender hashes the file with
+// Returns: The hash of the bytes before resp.Offset
+func resumePart(file *os.File, resp *protocol.FileResponse, hasher checksum.Hasher, t *transfer) (hash.Hash, error) {
+	if resp.Offset == 0 {
+		return hasher.New(), file.Truncate(0)
+	}
+	if resp.Offset != t.resumeAt || t.resumeHash == nil {
+		return nil, fmt.Errorf("stream resumes at byte %d, requested %d", resp.Offset, t.resumeAt)
+	}
+	if hasher.Name() != t.resumeAlgorithm {
+		return nil, fmt.Errorf("stream resumes hashed with %s, requested %s", hasher.Name(), t.resumeAlgorithm)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() < resp.Offset {
+		return nil, fmt.Errorf("partial file shrank to %d bytes while resuming at byte %d", info.Size(), resp.Offset)
+	}
+	if err := file.Truncate(resp.Offset); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(resp.Offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return t.resumeHash, nil
+}
+
+// streaming reports whether a requested file is being streamed in
+// Caller must hold p.mu
+func (p *Peer) streaming(name string) bool {
+	for _, s := range p.fileStreams {
+		if s.resp.Name == name && s.t != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// handleFileData writes the next part of a streamed file, and saves the
+// file after the last one
+func (p *Peer) handleFileData(msg protocol.Message) {
+	data := msg.Payload.(*protocol.FileData)
+	p.mu.Lock()
+	s := p.fileStreams[msg.From+"\x00"+data.Name]
+	p.mu.Unlock()
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.timer.Reset(fileStreamTimeout)
+
+	var err error
+	if data.Compression != "" {
+		data.Data, err = decompressData(data.Compression, data.Data, min(s.resp.Size-s.written, fileDataSize))
+	}
+	switch {
+	case err != nil:
+	case data.Offset != s.written:
+		err = fmt.Errorf("data at offset %d, expected %d", data.Offset, s.written)
+	case data.Error != "":
+		err = fmt.Errorf("sender stopped: %s", data.Error)
+	case data.Hole < 0 || (data.Hole > 0 && s.written+data.Hole > s.resp.Size):
+		err = fmt.Errorf("hole of %d bytes at offset %d, past the end of the file", data.Hole, data.Offset)
+	case data.Hole > 0:
+		// Extending the file leaves a hole where the filesystem supports them
+		end := s.written + data.Hole
+		if s.sink != nil {
+			err = writeZeros(s.sink, data.Hole)
+		} else {
+			err = s.file.Truncate(end)
+			if err == nil {
+				_, err = s.file.Seek(end, io.SeekStart)
+			}
+		}
+		if err == nil {
+			hashZeros(s.hash, data.Hole)
+			s.written = end
+			if s.t != nil {
+				s.t.addProgress(data.Hole)
+			}
+		}
+	case s.written+int64(len(data.Data)) > s.resp.Size:
+		err = fmt.Errorf("%d bytes at offset %d, past the end of the file", len(data.Data), data.Offset)
+	case len(data.Data) > 0:
+		if s.sink != nil {
+			_, err = s.sink.Write(data.Data)
+		} else if err = p.disk.wait(context.Background(), len(data.Data)); err == nil {
+			_, err = s.file.Write(data.Data)
+		}
+		if err == nil {
+			s.hash.Write(data.Data)
+			s.written += int64(len(data.Data))
+			if s.t != nil {
+				s.t.addProgress(int64(len(data.Data)))
+			}
+		}
+	}
+	if err != nil {
+		p.finishStreamed(s, err)
+		return
+	}
+	if data.Last && s.sink != nil {
+		p.finishDelivered(s, data.Hash)
+	} else if data.Last {
+		p.saveStreamed(s, data.Hash)
+	}
+}
+
+// saveStreamed checks a completely received stream against the size and
+// hash the sender announced, both as received and as read back from disk,
+// and moves it into place
+// Caller must hold s.mu
+func (p *Peer) saveStreamed(s *fileStream, sum []byte) {
+	name, tmp := s.resp.Name, s.file.Name()
+	var reason, detail string
+	if got := s.hash.Sum(nil); sum == nil {
+		reason, detail = QuarantineChecksum, "sender announced no "+s.hasher.Name()
+	} else if !bytes.Equal(got, sum) {
+		reason, detail = QuarantineChecksum, fmt.Sprintf("%s %x, sender announced %x", s.hasher.Name(), got, sum)
+	} else if s.written != s.resp.Size {
+		reason, detail = QuarantineIncomplete, fmt.Sprintf("received %d of %d bytes", s.written, s.resp.Size)
+	}
+	err := s.file.Close()
+	if err == nil && reason == "" {
+		reason, detail = p.verifyWritten(tmp, s.hasher.Name(), sum)
+	}
+	if err == nil && reason != "" {
+		p.rejectFile(tmp, QuarantineEntry{Name: name, Target: s.target, Peer: s.from, Reason: reason, Detail: detail})
+		err = fmt.Errorf("%s check failed: %s", reason, detail)
+	} else if err == nil {
+		if reject := p.filterReceived(name, tmp); reject != nil {
+			p.rejectFile(tmp, QuarantineEntry{Name: name, Target: s.target, Peer: s.from, Reason: QuarantinePolicy, Detail: reject.Error()})
+			err = fmt.Errorf("rejected by receive filter: %v", reject)
+		}
+	}
+	var final string
+	if err == nil {
+		final, err = p.resolveConflict(s.target)
+	}
+	if err == nil {
+		err = moveFile(tmp, final)
+	}
+	p.finishStreamed(s, err)
+	if err != nil {
+		return
+	}
+
+	p.setReceivedPerms(final, s.resp.Meta)
+	if p.preserveMeta && s.resp.Meta != nil {
+		p.applyMeta(final, s.resp.Meta)
+	}
+	logging.Infof(p.logger, "File received and saved: %s", final)
+	p.issueReceipts(name, final, receiptSum(s.hasher.Name(), sum), s.resp.Size, map[string]int64{s.addr: s.written - s.resp.Offset})
+	p.reshareFile(name, final)
+	p.enforceReceivedLimit(final)
+	s.t.reportSaved(final, nil)
+}
+
+// finishStreamed ends a stream. If it failed, what a request received is
+// kept in its ".part" file to resume from, and an unsolicited file removed
+// Caller must hold s.mu
+func (p *Peer) finishStreamed(s *fileStream, err error) {
+	if s.done {
+		return
+	}
+	s.done = true
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	p.mu.Lock()
+	if p.fileStreams[s.key] == s {
+		delete(p.fileStreams, s.key)
+	}
+	p.mu.Unlock()
+
+	if s.t != nil {
+		p.endTransfer(s.t, s.written-s.resp.Offset, err)
+	}
+	if err == nil {
+		return
+	}
+	if s.file != nil {
+		s.file.Close()
+		if s.t == nil || s.written == 0 {
+			os.Remove(s.file.Name())
+		}
+	}
+	logging.Errorf(p.logger, "Error saving file: %v", err)
+	s.t.reportSaved("", err)
+}
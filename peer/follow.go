@@ -0,0 +1,250 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	followPollInterval = 250 * time.Millisecond // How often a followed file is checked for new data
+	maxStreamChunk     = 64 << 10               // Largest StreamData payload
+	followBuffer       = 256                    // StreamData frames a follower may fall behind by
+)
+
+// errFollowTooSlow ends a Follow whose writer can't keep up with the stream
+var errFollowTooSlow = errors.New("follow fell too far behind the stream")
+
+// follower is a subscription of another peer to one of the shared files
+type follower struct {
+	cancel context.CancelFunc
+}
+
+// Follow streams the bytes appended to a file shared by the peer at addr
+// into w, like "tail -f", until ctx is done or the sender stops
+// The sender keeps following the file by name when it is truncated or
+// replaced, e.g. by log rotation, and streams the new file from its start
+// offset: Where to start; negative counts back from the end, e.g. -4096
+// for the last 4 KiB
+// Returns: ctx.Err() once ctx is done, otherwise the reason the stream ended
+func (p *Peer) Follow(ctx context.Context, addr, name string, offset int64, w io.Writer) error {
+	name = wireName(name)
+	id := p.nextCallID()
+	ch := make(chan *protocol.StreamData, followBuffer)
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.streams[id] = ch
+	p.mu.Unlock()
+
+	req := &protocol.FollowRequest{ID: id, FileName: name, NameEncoding: protocol.NameEncodingUTF8NFC, Offset: offset}
+	msg := protocol.Message{Type: protocol.MessageTypeFollowRequest, From: p.id, Payload: req}
+	cancel := func() {
+		p.mu.Lock()
+		delete(p.streams, id)
+		p.mu.Unlock()
+		msg.Payload = &protocol.FollowRequest{ID: id, Cancel: true}
+		p.transport.Send(addr, msg)
+	}
+	if err := p.transport.Send(addr, msg); err != nil {
+		p.mu.Lock()
+		delete(p.streams, id)
+		p.mu.Unlock()
+		return err
+	}
+
+	for {
+		select {
+		case d, ok := <-ch:
+			if !ok {
+				cancel()
+				return errFollowTooSlow
+			}
+			if d.Error != "" {
+				p.mu.Lock()
+				delete(p.streams, id)
+				p.mu.Unlock()
+				return fmt.Errorf("peer %s stopped streaming %s: %s", addr, name, d.Error)
+			}
+			if d.Truncated {
+				logging.Infof(p.logger, "%s was truncated or replaced on %s, following from its start", name, addr)
+			}
+			p.metrics.bytesReceived.Add(uint64(len(d.Data)))
+			if _, err := w.Write(d.Data); err != nil {
+				cancel()
+				return err
+			}
+		case <-ctx.Done():
+			cancel()
+			return ctx.Err()
+		case <-p.stop:
+			cancel()
+			return ErrClosed
+		}
+	}
+}
+
+// handleStream hands streamed bytes to the Follow waiting for them
+// A follower that falls followBuffer frames behind is dropped; streams
+// nobody follows any more are cancelled at the sender
+func (p *Peer) handleStream(msg protocol.Message) {
+	d := msg.Payload.(*protocol.StreamData)
+
+	p.mu.Lock()
+	ch, ok := p.streams[d.ID]
+	if ok {
+		select {
+		case ch <- d:
+		default:
+			delete(p.streams, d.ID)
+			close(ch)
+		}
+	}
+	p.mu.Unlock()
+
+	if !ok && d.Error == "" {
+		p.reply(msg, protocol.MessageTypeFollowRequest, &protocol.FollowRequest{ID: d.ID, Cancel: true})
+	}
+}
+
+// handleFollowRequest starts or cancels a subscription to a shared file
+func (p *Peer) handleFollowRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.FollowRequest)
+	key := fmt.Sprintf("%s\x00%d", msg.From, req.ID)
+
+	p.mu.Lock()
+	if f, ok := p.follows[key]; ok {
+		f.cancel()
+		delete(p.follows, key)
+	}
+	if req.Cancel || p.closing {
+		p.mu.Unlock()
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &follower{cancel: cancel}
+	p.follows[key] = f
+	p.mu.Unlock()
+
+	go func() {
+		defer p.recoverHandler(msg)
+		defer func() {
+			cancel()
+			p.mu.Lock()
+			if p.follows[key] == f {
+				delete(p.follows, key)
+			}
+			p.mu.Unlock()
+		}()
+
+		logging.Infof(p.logger, "Peer %s is following %s", msg.From, req.FileName)
+		err := p.streamFile(ctx, msg, req)
+		if err != nil && ctx.Err() == nil {
+			logging.Infof(p.logger, "Stopped streaming %s to %s: %v", req.FileName, msg.From, err)
+			p.reply(msg, protocol.MessageTypeStream, &protocol.StreamData{ID: req.ID, Error: err.Error()})
+		}
+	}()
+}
+
+// streamFile sends the data appended to a shared file until ctx is done or
+// the peer closes
+func (p *Peer) streamFile(ctx context.Context, msg protocol.Message, req *protocol.FollowRequest) error {
+	if err := p.checkFeature(protocol.FeatureFollow); err != nil {
+		return err
+	}
+	if err := p.checkAccess(msg.From, req.FileName, AccessRead); err != nil {
+		return err
+	}
+	if err := checkNameEncoding(req.FileName, req.NameEncoding); err != nil {
+		return err
+	}
+	path, err := resolveShared(p.SharedDir(), req.FileName)
+	if err != nil {
+		return err
+	}
+	file, err := openShared(path)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := req.Offset
+	if offset < 0 {
+		offset = max(info.Size()+offset, 0)
+	} else if offset > info.Size() {
+		offset = info.Size()
+	}
+
+	buf := make([]byte, maxStreamChunk)
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	truncated := false
+	for {
+		// Send everything written since the last round
+		for {
+			n, err := file.ReadAt(buf, offset)
+			if n > 0 {
+				if err := p.disk.wait(ctx, n); err != nil {
+					return nil
+				}
+				d := &protocol.StreamData{ID: req.ID, Offset: offset, Data: buf[:n], Truncated: truncated}
+				if err := p.reply(msg, protocol.MessageTypeStream, d); err != nil {
+					return err
+				}
+				p.metrics.bytesSent.Add(uint64(n))
+				offset += int64(n)
+				truncated = false
+			}
+			if err == io.EOF || n == 0 {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		case <-p.stop:
+			return nil
+		}
+
+		// Follow the name rather than the open file, like "tail -F"
+		cur, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue // Mid-rotation; the new file will show up
+		}
+		if err != nil {
+			return err
+		}
+		if info, err = file.Stat(); err != nil {
+			return err
+		}
+		if !os.SameFile(cur, info) {
+			next, err := openShared(path)
+			if err != nil {
+				continue
+			}
+			file.Close()
+			file = next
+			offset, truncated = 0, true
+		} else if info.Size() < offset {
+			offset, truncated = 0, true
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// isWindows is checked at runtime rather than through build tags so the
+// same code paths are compiled, vetted and reviewed on every platform
+var isWindows = runtime.GOOS == "windows"
+
+// Windows error codes returned when another process holds a file open
+// without sharing, or holds a byte-range lock on it
+const (
+	errSharingViolation syscall.Errno = 32
+	errLockViolation    syscall.Errno = 33
+	errNotSameDevice    syscall.Errno = 17
+)
+
+// lockRetries and lockRetryDelay bound how long we wait for a file that
+// is locked by another process before giving up
+const (
+	lockRetries    = 5
+	lockRetryDelay = 200 * time.Millisecond
+)
+
+// ErrFileLocked is returned when a file stays locked by another process
+var ErrFileLocked = errors.New("file is locked by another process")
+
+// isLocked reports whether err means the file is in use by another process
+func isLocked(err error) bool {
+	if !isWindows {
+		return false
+	}
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == errSharingViolation || errno == errLockViolation)
+}
+
+// retryLocked runs op, retrying while it fails because the file is locked
+func retryLocked(op func() error) error {
+	var err error
+	for i := 0; i < lockRetries; i++ {
+		if err = op(); err == nil || !isLocked(err) {
+			return err
+		}
+		time.Sleep(lockRetryDelay)
+	}
+	return fmt.Errorf("%w: %v", ErrFileLocked, err)
+}
+
+// isCrossDevice reports whether err means a rename failed because source and
+// destination are on different filesystems
+func isCrossDevice(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EXDEV || isWindows && errno == errNotSameDevice
+}
+
+// moveFile renames src to dst, or copies it there and removes it when they
+// are on different filesystems. The rename is retried if another process
+// has the destination open
+func moveFile(src, dst string) error {
+	err := retryLocked(func() error { return os.Rename(src, dst) })
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	if err := copyFileAtomic(src, dst); err != nil {
+		return err
+	}
+	os.Remove(src)
+	return nil
+}
+
+// wireName converts a local relative path into the form used in protocol
+// messages: slash separated and NFC normalized
+func wireName(rel string) string {
+	return norm.NFC.String(filepath.ToSlash(rel))
+}
+
+// localPath resolves a slash-separated name from a protocol message to a
+// path inside dir, using the platform's separator
+// Returns: An error if the name is absolute, names a drive or escapes dir
+func localPath(dir, name string) (string, error) {
+	if name == "" {
+		return "", errors.New("empty file name")
+	}
+
+	// Backslashes are separators on Windows; treat them the same way on
+	// every platform so a name means the same thing wherever it's resolved
+	rel := filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	if filepath.IsAbs(rel) || filepath.VolumeName(rel) != "" || strings.HasPrefix(rel, string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file name %q: must be relative", name)
+	}
+
+	clean := filepath.Clean(rel)
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("invalid file name %q: escapes directory", name)
+	}
+	return filepath.Join(dir, clean), nil
+}
+
+// openShared opens a file for serving, waiting briefly if another process
+// has it locked
+func openShared(path string) (*os.File, error) {
+	var file *os.File
+	err := retryLocked(func() error {
+		var err error
+		file, err = os.Open(path)
+		return err
+	})
+	return file, err
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so readers never see a partially written file. The rename
+// is retried if another process has the destination open
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, perm)
+	}
+	if err == nil {
+		err = retryLocked(func() error { return os.Rename(tmpName, path) })
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
+
+// resolvesInside checks that path, which need not exist yet, lies inside
+// root once symlinks are followed, see resolvePath
+func resolvesInside(root, path string) error {
+	realRoot, err := resolvePath(root)
+	if err != nil {
+		return err
+	}
+	real, err := resolvePath(path)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves outside %s", path, root)
+	}
+	return nil
+}
+
+// resolvePath returns the absolute path that path, which need not exist
+// yet, names once symlinks are followed: its deepest existing ancestor is
+// resolved, and the components below it don't exist, so can't be links
+func resolvePath(path string) (string, error) {
+	existing, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	var missing []string
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		missing = append(missing, filepath.Base(existing))
+		existing = parent
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		real = filepath.Join(real, missing[i])
+	}
+	return real, nil
+}
+
+// prepareDir creates the parent directories of path, which must lie inside
+// root, and verifies that symlinks along the way don't lead outside root
+// The check is made before anything is created, so that a link to a
+// directory elsewhere can't have directories made through it, and again
+// after, in case the tree changed meanwhile
+func prepareDir(root, path string) error {
+	parent := filepath.Dir(path)
+	if err := resolvesInside(root, parent); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	realParent, err := filepath.EvalSymlinks(parent)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(realRoot, realParent)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves outside %s", parent, root)
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// TestReceivedTargetSymlink checks that a symlink in the received
+// directory can't have directories created outside it
+func TestReceivedTargetSymlink(t *testing.T) {
+	p := newTestPeer(t)
+	outside := t.TempDir()
+	if err := os.MkdirAll(p.ReceivedDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(p.ReceivedDir(), "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.receivedTarget("link/sub/deeper/a.txt", protocol.NameEncodingUTF8NFC); err == nil {
+		t.Fatal("file saved through a symlink out of the received directory")
+	}
+	if _, err := os.Stat(filepath.Join(outside, "sub")); !os.IsNotExist(err) {
+		t.Fatalf("directory created outside the received directory: %v", err)
+	}
+
+	path, err := p.receivedTarget("sub/deeper/a.txt", protocol.NameEncodingUTF8NFC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(p.ReceivedDir(), "sub", "deeper", "a.txt"); path != want {
+		t.Fatalf("receivedTarget = %s, want %s", path, want)
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		t.Fatalf("parent not created: %v", err)
+	}
+}
+
+func TestResolvesInside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "missing"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"new/dir/a.txt", true},
+		{"out", false},
+		{"out/a.txt", false},
+		{"out/new/a.txt", false},
+		{"dangling/a.txt", false},
+		{"../a.txt", false},
+	}
+	for _, tt := range tests {
+		err := resolvesInside(root, filepath.Join(root, tt.path))
+		if (err == nil) != tt.ok {
+			t.Errorf("resolvesInside(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+	if err := resolvesInside(filepath.Join(root, "not/yet"), filepath.Join(root, "not/yet/a.txt")); err != nil {
+		t.Errorf("root that doesn't exist yet: %v", err)
+	}
+}
+
+func TestLocalPath(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // "" if the name must be refused
+	}{
+		{"a.txt", "/share/a.txt"},
+		{"dir/a.txt", "/share/dir/a.txt"},
+		{"dir/./a.txt", "/share/dir/a.txt"},
+		{"dir//a.txt", "/share/dir/a.txt"},
+		{`dir\a.txt`, "/share/dir/a.txt"},
+		{"dir/../a.txt", "/share/a.txt"},
+		{"..a.txt", "/share/..a.txt"},
+
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"../a.txt", ""},
+		{`..\a.txt`, ""},
+		{"dir/../../a.txt", ""},
+		{`dir\..\..\etc\passwd`, ""},
+		{"/etc/passwd", ""},
+		{`\etc\passwd`, ""},
+		{"dir/..", ""},
+	}
+	for _, tt := range tests {
+		got, err := localPath("/share", tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("localPath(%q) = %q, want an error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil || got != filepath.FromSlash(tt.want) {
+			t.Errorf("localPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	defer func(w bool) { isWindows = w }(isWindows)
+	tests := []struct {
+		name           string
+		posix, windows string
+	}{
+		{"a.txt", "a.txt", "a.txt"},
+		{"dir/a.txt", "dir/a.txt", "dir/a.txt"},
+		{"e\u0301te\u0301.txt", "\u00e9t\u00e9.txt", "\u00e9t\u00e9.txt"},
+		{"a\x00b\x1f\x7f.txt", "a_b__.txt", "a_b__.txt"},
+		{"new\nline/a.txt", "new_line/a.txt", "new_line/a.txt"},
+		{`a<b>:"|?*.txt`, `a<b>:"|?*.txt`, "a_b______.txt"},
+		{"CON", "CON", "_CON"},
+		{"dir/nul.txt", "dir/nul.txt", "dir/_nul.txt"},
+		{"console.txt", "console.txt", "console.txt"},
+		{"trailing. ", "trailing. ", "trailing__"},
+		{"../a.txt", "../a.txt", "../a.txt"},
+	}
+	for _, tt := range tests {
+		isWindows = false
+		if got := sanitizeName(tt.name); got != tt.posix {
+			t.Errorf("sanitizeName(%q) = %q, want %q", tt.name, got, tt.posix)
+		}
+		isWindows = true
+		if got := sanitizeName(tt.name); got != tt.windows {
+			t.Errorf("on Windows sanitizeName(%q) = %q, want %q", tt.name, got, tt.windows)
+		}
+	}
+}
+
+// TestReceivedTargetTraversal checks that names sanitizing leaves alone
+// can't reach outside the received directory
+func TestReceivedTargetTraversal(t *testing.T) {
+	p := newTestPeer(t)
+	for _, name := range []string{"../a.txt", `..\a.txt`, "sub/../../a.txt", "/etc/passwd", "..", ""} {
+		if path, err := p.receivedTarget(name, protocol.NameEncodingUTF8NFC); err == nil {
+			t.Errorf("receivedTarget(%q) = %q, want an error", name, path)
+		}
+	}
+	if _, err := p.receivedTarget("a\xff.txt", protocol.NameEncodingUTF8NFC); err == nil {
+		t.Error("name that isn't UTF-8 accepted")
+	}
+	if _, err := p.receivedTarget("a.txt", "latin1"); err == nil {
+		t.Error("unknown name encoding accepted")
+	}
+}
@@ -0,0 +1,138 @@
+package peer
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// maxGCInterval caps the time between background garbage collections
+const maxGCInterval = time.Hour
+
+// GCResult summarizes one garbage collection run
+type GCResult struct {
+	Files   int   `json:"files"`   // Partial and temporary files removed
+	Bytes   int64 `json:"bytes"`   // Disk space they took up
+	Sources int   `json:"sources"` // Source statistics dropped from the state
+}
+
+// WithGarbageCollection removes partial downloads, temporary files and
+// source statistics older than maxAge in the background while the peer
+// runs, so failed transfers don't slowly eat disk; 0 disables it
+func WithGarbageCollection(maxAge time.Duration) Option {
+	return func(p *Peer) {
+		p.gcMaxAge = maxAge
+	}
+}
+
+// CollectGarbage removes ".part" files of downloads that are no longer
+// running, leftover temporary files in the received and temp directories, and
+// statistics of download sources not used within maxAge
+func (p *Peer) CollectGarbage(maxAge time.Duration) (GCResult, error) {
+	var res GCResult
+	cutoff := time.Now().Add(-maxAge)
+	receivedDir := p.ReceivedDir()
+
+	// Parts of running downloads and requests are kept however old they are
+	p.mu.Lock()
+	active := make(map[string]bool, len(p.downloads)+len(p.pending)+len(p.fileStreams))
+	for name := range p.downloads {
+		if target, err := localPath(receivedDir, sanitizeName(name)); err == nil {
+			active[p.partPath(target)] = true
+		}
+	}
+	for _, t := range p.pending {
+		active[t.part] = true
+	}
+	for _, s := range p.fileStreams {
+		active[s.file.Name()] = true
+	}
+	p.mu.Unlock()
+
+	dirs := []string{receivedDir}
+	if p.tempDir != "" {
+		dirs = append(dirs, p.tempDir)
+	}
+	var err error
+	for _, dir := range dirs {
+		if walkErr := p.collectDir(dir, cutoff, active, &res); walkErr != nil && err == nil {
+			err = walkErr
+		}
+	}
+
+	p.mu.Lock()
+	for key, s := range p.sources {
+		if s.LastUsed.Before(cutoff) {
+			delete(p.sources, key)
+			res.Sources++
+		}
+	}
+	p.mu.Unlock()
+
+	if res.Files > 0 || res.Sources > 0 {
+		logging.Infof(p.logger, "Garbage collection removed %d files (%d bytes) and %d source records", res.Files, res.Bytes, res.Sources)
+	}
+	return res, err
+}
+
+// collectDir removes the partial and temporary files under dir last
+// modified before cutoff, except those of active transfers
+func (p *Peer) collectDir(dir string, cutoff time.Time, active map[string]bool, res *GCResult) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if d.IsDir() || !isPartial(d.Name()) || active[strings.TrimSuffix(path, haveSuffix)] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logging.Errorf(p.logger, "Error removing stale file %s: %v", path, err)
+			return nil
+		}
+		res.Files++
+		res.Bytes += info.Size()
+		return nil
+	})
+}
+
+// isPartial reports whether a file name is a partial download, the list of
+// pieces it holds, or a temporary file written on the way to an atomic rename
+func isPartial(name string) bool {
+	if strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".part"+haveSuffix) {
+		return true
+	}
+	return strings.HasPrefix(name, ".") && strings.HasSuffix(name, ".tmp") ||
+		strings.HasPrefix(name, ".healthcheck-")
+}
+
+// gcLoop runs CollectGarbage periodically until the peer closes
+func (p *Peer) gcLoop() {
+	interval := p.gcMaxAge / 2
+	if interval > maxGCInterval {
+		interval = maxGCInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.CollectGarbage(p.gcMaxAge); err != nil {
+			logging.Errorf(p.logger, "Garbage collection failed: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package peer
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/ratelimit"
+)
+
+// indexSaveInterval is how often the index file is saved while the
+// background hasher runs, so an interrupted scan doesn't start over
+const indexSaveInterval = time.Minute
+
+// HashProgress reports on the background hashing of the shared directory
+// Files are servable as soon as their own hashes complete
+type HashProgress struct {
+	Running   bool      `json:"running"`
+	Files     int       `json:"files"`             // New or changed files found by the last scan
+	FilesDone int       `json:"files_done"`        // Of those, files hashed or given up on
+	Bytes     int64     `json:"bytes"`             // Total size of the files to hash
+	BytesDone int64     `json:"bytes_done"`        // Bytes hashed so far
+	Current   []string  `json:"current,omitempty"` // Files being hashed
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished,omitempty"`
+}
+
+// hashTask is a shared file the background hasher has to hash
+type hashTask struct {
+	name, path string
+	size       int64
+}
+
+// WithHashing sets how the shared directory is hashed in the background:
+// the number of files hashed at once, default 1, and a cap on the bytes
+// read per second for it, 0 for none. Files requested by other peers are
+// hashed right away, outside these limits
+func WithHashing(workers int, bytesPerSec int64) Option {
+	return func(p *Peer) {
+		p.hashWorkers = workers
+		if bytesPerSec > 0 {
+			p.hashRate = ratelimit.New(float64(bytesPerSec), 0)
+		} else {
+			p.hashRate = nil
+		}
+	}
+}
+
+// HashProgress returns the progress of the background hasher
+func (p *Peer) HashProgress() HashProgress {
+	p.hashMu.Lock()
+	defer p.hashMu.Unlock()
+	prog := p.hashProgress
+	prog.Current = slices.Clone(prog.Current)
+	return prog
+}
+
+// hashAll hashes the given shared files with the configured number of
+// workers, saving the index file from time to time
+// Returns: The number of files hashed, and whether the peer closed before
+// all of them were
+func (p *Peer) hashAll(tasks []hashTask) (int, bool) {
+	var total int64
+	for _, t := range tasks {
+		total += t.size
+	}
+	p.hashMu.Lock()
+	p.hashProgress = HashProgress{Running: true, Files: len(tasks), Bytes: total, Started: time.Now()}
+	p.hashMu.Unlock()
+	defer func() {
+		p.hashMu.Lock()
+		p.hashProgress.Running = false
+		p.hashProgress.Current = nil
+		p.hashProgress.Finished = time.Now()
+		p.hashMu.Unlock()
+	}()
+
+	// Cancelled when the peer closes, so that hashing stops mid-file
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	queue := make(chan hashTask)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	hashed := 0
+	lastSave := time.Now()
+	for i := 0; i < max(p.hashWorkers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range queue {
+				if p.hashTask(ctx, t) {
+					mu.Lock()
+					hashed++
+					save := time.Since(lastSave) >= indexSaveInterval
+					if save {
+						lastSave = time.Now()
+					}
+					mu.Unlock()
+					if save {
+						if err := p.saveIndex(); err != nil {
+							logging.Errorf(p.logger, "Error saving index: %v", err)
+						}
+					}
+				}
+			}
+		}()
+	}
+feed:
+	for _, t := range tasks {
+		select {
+		case queue <- t:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return hashed, ctx.Err() != nil
+}
+
+// hashTask hashes one file for hashAll and records the progress
+// Returns: Whether the file was hashed
+func (p *Peer) hashTask(ctx context.Context, t hashTask) bool {
+	p.hashMu.Lock()
+	p.hashProgress.Current = append(p.hashProgress.Current, t.name)
+	p.hashMu.Unlock()
+
+	var done int64
+	_, err := p.hashShared(t.name, t.path, func(n int) error {
+		if err := p.hashRate.WaitN(ctx, n); err != nil {
+			return err
+		}
+		p.hashMu.Lock()
+		p.hashProgress.BytesDone += int64(n)
+		p.hashMu.Unlock()
+		done += int64(n)
+		return nil
+	})
+
+	p.hashMu.Lock()
+	defer p.hashMu.Unlock()
+	if i := slices.Index(p.hashProgress.Current, t.name); i >= 0 {
+		p.hashProgress.Current = slices.Delete(p.hashProgress.Current, i, i+1)
+	}
+	p.hashProgress.FilesDone++
+	// Count a file given up on, or hashed by a request, as fully done
+	p.hashProgress.BytesDone += max(t.size-done, 0)
+	if err != nil && ctx.Err() == nil {
+		logging.Warnf(p.logger, "Not indexing %s: %v", t.name, err)
+	}
+	return err == nil
+}
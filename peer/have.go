@@ -0,0 +1,332 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// pushBuffer is the number of pushed pieces a download may fall behind by
+// before further ones are dropped and left to be requested again
+const pushBuffer = 64
+
+// pushStream receives the pieces a peer pushes in answer to a HaveBitmap
+type pushStream struct {
+	from   string // ID of the peer pushing the pieces, empty to take them from any as the manifest checks them
+	pieces chan *protocol.ChunkData
+	end    chan string // Receives the error of the end marker, empty when complete
+}
+
+// scanPart checks which pieces of m an existing partial file already holds
+// A file longer than m is cut to size
+func (p *Peer) scanPart(ctx context.Context, file *os.File, m *protocol.Manifest) (protocol.Bitmap, error) {
+	have := protocol.NewBitmap(m.NumPieces())
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > m.Size {
+		if err := file.Truncate(m.Size); err != nil {
+			return nil, err
+		}
+	}
+
+	buf := make([]byte, m.PieceSize)
+	for i := 0; i < m.NumPieces(); i++ {
+		offset, length := m.PieceRange(i)
+		if offset+length > info.Size() {
+			break
+		}
+		if err := p.disk.wait(ctx, int(length)); err != nil {
+			return nil, err
+		}
+		if _, err := file.ReadAt(buf[:length], offset); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if m.VerifyPiece(i, buf[:length]) == nil {
+			have.Set(i)
+		}
+	}
+	return have, nil
+}
+
+// announceHave tells the peers of a download which pieces it already holds
+func (p *Peer) announceHave(d *downloader, peers []*activeSource) {
+	d.mu.Lock()
+	have := append(protocol.Bitmap(nil), d.have...)
+	d.mu.Unlock()
+	if have.Count(d.m.NumPieces()) == 0 {
+		return
+	}
+
+	for _, s := range peers {
+		if !p.knownFeature(s.src.id(), protocol.FeaturePush) {
+			continue
+		}
+		req := &protocol.HaveBitmap{FileName: d.m.Name, NameEncoding: protocol.NameEncodingUTF8NFC, Size: d.m.Size, PieceSize: d.m.PieceSize, Have: have}
+		msg := protocol.Message{Type: protocol.MessageTypeHaveBitmap, From: p.id, Payload: req}
+		if err := p.transport.Send(s.src.id(), msg); err != nil {
+			logging.Warnf(p.logger, "Could not announce pieces of %s to %s: %v", d.m.Name, s.src, err)
+		}
+	}
+}
+
+// pushMissing asks the peer behind s to stream every piece the download is
+// missing and writes them as they arrive, until the peer is done, fails or
+// stalls; pieces that don't arrive are left for piece requests
+func (p *Peer) pushMissing(ctx context.Context, d *downloader, s *activeSource, tp *transferPriority) {
+	d.mu.Lock()
+	have := append(protocol.Bitmap(nil), d.have...)
+	remaining := d.remaining
+	s.started = true
+	d.mu.Unlock()
+	if remaining == 0 {
+		return
+	}
+
+	id := p.nextCallID()
+	stream := &pushStream{pieces: make(chan *protocol.ChunkData, pushBuffer), end: make(chan string, 1)}
+	p.mu.Lock()
+	p.pushes[id] = stream
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.pushes, id)
+		p.mu.Unlock()
+	}()
+
+	req := &protocol.HaveBitmap{
+		ID:           id,
+		FileName:     d.m.Name,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		Size:         d.m.Size,
+		PieceSize:    d.m.PieceSize,
+		Have:         have,
+		Stream:       true,
+		Priority:     tp.get(),
+		Compression:  p.compression,
+	}
+	msg := protocol.Message{Type: protocol.MessageTypeHaveBitmap, From: p.id, Payload: req}
+	if err := p.transport.Send(s.src.id(), msg); err != nil {
+		logging.Warnf(p.logger, "Could not ask %s to stream %s: %v", s.src, d.m.Name, err)
+		return
+	}
+
+	timer := time.NewTimer(pieceTimeout)
+	defer timer.Stop()
+	start := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			logging.Warnf(p.logger, "Stream of %s from %s stalled, requesting the remaining pieces", d.m.Name, s.src)
+			return
+		case reason := <-stream.end:
+			if reason != "" {
+				logging.Warnf(p.logger, "Stream of %s from %s ended early: %s", d.m.Name, s.src, reason)
+			}
+			return
+		case data := <-stream.pieces:
+			if err := d.writePushed(ctx, s, data, time.Since(start)); err != nil {
+				logging.Warnf(p.logger, "Piece %d of %s from %s failed: %v", data.Index, d.m.Name, s.src, err)
+			}
+			d.mu.Lock()
+			remaining = d.remaining
+			d.mu.Unlock()
+			if remaining == 0 {
+				return
+			}
+			start = time.Now()
+			timer.Reset(pieceTimeout)
+		}
+	}
+}
+
+// writePushed verifies and writes a piece pushed by the source s
+func (d *downloader) writePushed(ctx context.Context, s *activeSource, piece *protocol.ChunkData, elapsed time.Duration) error {
+	index := piece.Index
+	data, err := decompressData(piece.Compression, piece.Data, d.m.PieceSize)
+	if err == nil {
+		err = d.m.VerifyPiece(index, data)
+	}
+	if err != nil {
+		d.mu.Lock()
+		s.stats.Bad++
+		d.mu.Unlock()
+		if d.metrics != nil {
+			d.metrics.piecesFail.Inc()
+		}
+		return err
+	}
+	d.mu.Lock()
+	if d.have.Has(index) {
+		d.mu.Unlock()
+		return nil
+	}
+	s.inflight++
+	d.mu.Unlock()
+
+	offset, _ := d.m.PieceRange(index)
+	err = d.disk.wait(ctx, len(data))
+	if err == nil {
+		_, err = d.file.WriteAt(data, offset)
+	}
+	if err != nil {
+		d.mu.Lock()
+		s.inflight--
+		d.mu.Unlock()
+		return err
+	}
+	d.complete(s, index, len(data), elapsed)
+	if d.metrics != nil {
+		d.metrics.piecesOK.Inc()
+		d.metrics.pieceTime.Observe(elapsed)
+	}
+	if d.progress != nil {
+		d.progress.addProgress(int64(len(data)))
+	}
+	return nil
+}
+
+// deliverPush hands a pushed piece to the download waiting for it
+// Pieces from a peer other than the stream's are dropped
+// Returns: false if the ID doesn't belong to a push stream
+func (p *Peer) deliverPush(msg protocol.Message) bool {
+	data := msg.Payload.(*protocol.ChunkData)
+	p.mu.Lock()
+	stream, ok := p.pushes[data.ID]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if stream.from != "" && msg.From != stream.from {
+		logging.Warnf(p.logger, "Dropping piece %d of push stream %d from %s, expected from %s", data.Index, data.ID, msg.From, stream.from)
+		return true
+	}
+
+	if data.Index < 0 {
+		stream.end <- data.Error
+		return true
+	}
+	select {
+	case stream.pieces <- data:
+	default:
+		// The download is behind; the piece is requested again later
+	}
+	return true
+}
+
+// handleHaveBitmap records which pieces of a shared file another peer
+// holds, and streams the missing ones if asked to
+func (p *Peer) handleHaveBitmap(msg protocol.Message) {
+	req := msg.Payload.(*protocol.HaveBitmap)
+	p.mu.Lock()
+	p.remotePieces[req.FileName+"\x00"+msg.From] = append(protocol.Bitmap(nil), req.Have...)
+	p.mu.Unlock()
+	if !req.Stream {
+		return
+	}
+
+	err := p.checkFeature(protocol.FeaturePush)
+	if err == nil {
+		err = p.checkAccess(msg.From, req.FileName, AccessRead)
+	}
+	var m *protocol.Manifest
+	if err == nil {
+		m, err = p.sharedManifest(req.FileName, req.NameEncoding)
+	}
+	if err == nil && (m.Size != req.Size || m.PieceSize != req.PieceSize) {
+		err = errors.New("file has changed since the bitmap's manifest")
+	}
+	var path string
+	if err == nil {
+		path, err = resolveShared(p.SharedDir(), req.FileName)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Cannot stream %s to %s: %v", req.FileName, msg.From, err)
+		p.reply(msg, protocol.MessageTypeChunkData, &protocol.ChunkData{ID: req.ID, Index: -1, Error: err.Error()})
+		return
+	}
+	p.pushPiece(msg, req, m, path, req.Have.Missing(m.NumPieces()))
+}
+
+// pushPiece queues the first of the missing pieces for sending and, once
+// it is sent, the rest; queueing them one at a time lets other requests
+// take turns with the stream, which ends with an error if the queue is full
+func (p *Peer) pushPiece(msg protocol.Message, req *protocol.HaveBitmap, m *protocol.Manifest, path string, missing []int) {
+	if len(missing) == 0 {
+		p.reply(msg, protocol.MessageTypeChunkData, &protocol.ChunkData{ID: req.ID, Index: -1})
+		return
+	}
+
+	index := missing[0]
+	offset, length := m.PieceRange(index)
+	p.enqueueRequest(msg, req.Priority, req.FileName, length, func() {
+		resp := &protocol.ChunkData{ID: req.ID, Index: index, Offset: offset}
+		p.mu.Lock()
+		closing := p.closing
+		p.mu.Unlock()
+		if closing {
+			resp.Index, resp.Error = -1, ErrClosed.Error()
+			p.reply(msg, protocol.MessageTypeChunkData, resp)
+			return
+		}
+
+		data, info, err := p.readShared(path, offset, length)
+		if err == nil && int64(len(data)) != length {
+			err = fmt.Errorf("file shrank while reading piece %d", index)
+		}
+		if err != nil {
+			resp.Index, resp.Error = -1, err.Error()
+			p.reply(msg, protocol.MessageTypeChunkData, resp)
+			return
+		}
+		resp.Data, resp.Compression = p.compressData(req.Compression, data)
+		if err := p.reply(msg, protocol.MessageTypeChunkData, resp); err != nil {
+			logging.Errorf(p.logger, "Stream of %s to %s failed: %v", req.FileName, msg.From, err)
+			return
+		}
+		p.noteUpload(msg, req.FileName, info.Size(), length)
+		p.notePiece(msg.From, req.FileName, index)
+		p.pushPiece(msg, req, m, path, missing[1:])
+	})
+}
+
+// notePiece records that another peer now holds a piece of a shared file
+func (p *Peer) notePiece(from, name string, index int) {
+	key := name + "\x00" + from
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	have := p.remotePieces[key]
+	if need := index/8 + 1; len(have) < need {
+		have = append(have, make(protocol.Bitmap, need-len(have))...)
+	}
+	have.Set(index)
+	p.remotePieces[key] = have
+}
+
+// PieceHolders returns how many pieces of a shared file each remote peer
+// is known to hold, by peer ID, from the bitmaps they announced and the
+// pieces served to them
+func (p *Peer) PieceHolders(name string) map[string]int {
+	name = wireName(name)
+	prefix := name + "\x00"
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	holders := make(map[string]int)
+	for key, have := range p.remotePieces {
+		if len(key) > len(prefix) && key[:len(prefix)] == prefix {
+			holders[key[len(prefix):]] = have.Count(len(have) * 8)
+		}
+	}
+	return holders
+}
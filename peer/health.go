@@ -0,0 +1,43 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+)
+
+// minFreeSpace is the free space below which the received directory is
+// considered unable to take new files
+const minFreeSpace = 64 << 20
+
+// Running reports whether the peer has been started and is not closing
+func (p *Peer) Running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.started && !p.closing
+}
+
+// CheckDisk verifies that the shared directory can be read and the received
+// directory written to, with at least minFreeSpace left where supported
+// Returns: A description of the free space, or an error naming the problem
+func (p *Peer) CheckDisk() (string, error) {
+	if _, err := os.ReadDir(p.SharedDir()); err != nil {
+		return "", fmt.Errorf("shared directory unreadable: %v", err)
+	}
+
+	dir := p.ReceivedDir()
+	f, err := os.CreateTemp(dir, ".healthcheck-*")
+	if err != nil {
+		return "", fmt.Errorf("received directory not writable: %v", err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	free, ok := diskFree(dir)
+	if !ok {
+		return "free space unknown", nil
+	}
+	if free < minFreeSpace {
+		return "", fmt.Errorf("only %d bytes free in received directory", free)
+	}
+	return fmt.Sprintf("%d bytes free", free), nil
+}
@@ -0,0 +1,236 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// indexVersion is the format of the index file; an index of another
+// version is ignored and rebuilt
+const indexVersion = 1
+
+// sharedIndex is the on-disk representation of the shared-file index
+type sharedIndex struct {
+	Version int          `json:"version"`
+	Dir     string       `json:"dir"` // Shared directory the paths are relative to
+	Files   []indexEntry `json:"files"`
+}
+
+// indexEntry records a shared file together with the state it was hashed in
+type indexEntry struct {
+	Path        string    `json:"path"` // Relative to the shared directory, slash-separated, as named on disk
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	PieceSize   int64     `json:"piece_size"`
+	PieceHashes [][]byte  `json:"piece_hashes"`
+}
+
+// IndexStats summarizes a scan of the shared directory
+type IndexStats struct {
+	Files    int           `json:"files"`    // Shared files in the index
+	Hashed   int           `json:"hashed"`   // Files hashed because they were new or had changed
+	Removed  int           `json:"removed"`  // Entries dropped for files that are gone
+	Duration time.Duration `json:"duration"` // Time the scan took
+}
+
+// WithIndexFile persists the names, sizes and piece hashes of shared files
+// to path. On start the peer serves them from the index right away and
+// checks the shared directory in the background, hashing only files whose
+// size or modification time changed, so large shares come online without
+// being hashed again
+func WithIndexFile(path string) Option {
+	return func(p *Peer) {
+		p.indexFile = path
+	}
+}
+
+// loadIndex fills the manifest cache from the index file
+// A missing index is not an error; the files are hashed as they are found
+func (p *Peer) loadIndex() error {
+	data, err := os.ReadFile(p.indexFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read index file: %v", err)
+	}
+	var idx sharedIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return fmt.Errorf("failed to parse index file: %v", err)
+	}
+	sharedDir := p.SharedDir()
+	if idx.Version != indexVersion || filepath.Clean(idx.Dir) != filepath.Clean(sharedDir) {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, e := range idx.Files {
+		path, err := localPath(sharedDir, e.Path)
+		if err != nil {
+			continue
+		}
+		// Manifests built since the peer started are newer, and files
+		// hashed with another piece size are hashed again
+		if _, ok := p.manifests[path]; ok || e.PieceSize != p.pieceSize {
+			continue
+		}
+		name := wireName(e.Path)
+		m := &protocol.Manifest{
+			Name:         name,
+			NameEncoding: protocol.NameEncodingUTF8NFC,
+			Size:         e.Size,
+			PieceSize:    e.PieceSize,
+			PieceHashes:  e.PieceHashes,
+		}
+		for _, seed := range p.webSeeds {
+			m.WebSeeds = append(m.WebSeeds, webSeedURL(seed, name))
+		}
+		if m.Validate() != nil {
+			continue
+		}
+		p.manifests[path] = manifestEntry{size: e.Size, modTime: e.ModTime, manifest: m}
+	}
+	return nil
+}
+
+// saveIndex writes the manifests of files in the shared directory to the
+// index file, through a temporary file renamed into place
+func (p *Peer) saveIndex() error {
+	if p.indexFile == "" {
+		return nil
+	}
+	sharedDir := p.SharedDir()
+	idx := sharedIndex{Version: indexVersion, Dir: sharedDir}
+	p.mu.Lock()
+	for path, entry := range p.manifests {
+		rel, err := filepath.Rel(sharedDir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		idx.Files = append(idx.Files, indexEntry{
+			Path:        filepath.ToSlash(rel),
+			Size:        entry.size,
+			ModTime:     entry.modTime,
+			PieceSize:   entry.manifest.PieceSize,
+			PieceHashes: entry.manifest.PieceHashes,
+		})
+	}
+	p.mu.Unlock()
+
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p.indexFile), 0755); err != nil {
+		return fmt.Errorf("failed to create index directory: %v", err)
+	}
+	if err := writeFileAtomic(p.indexFile, data, 0644); err != nil {
+		return fmt.Errorf("failed to write index file: %v", err)
+	}
+	return nil
+}
+
+// IndexShared brings the index up to date with the shared directory: files
+// whose size and modification time still match are kept as they are, new
+// and changed ones are hashed in the background as set by WithHashing, and
+// those that are gone are dropped. Each file is servable as soon as its own
+// hash completes; see HashProgress
+// The index file, if any, is saved afterwards
+func (p *Peer) IndexShared() (IndexStats, error) {
+	start := time.Now()
+	var stats IndexStats
+	sharedDir := p.SharedDir()
+
+	seen := make(map[string]bool)
+	var tasks []hashTask
+	err := filepath.WalkDir(sharedDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == sharedDir {
+				return err
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || isPartial(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(sharedDir, path)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		seen[path] = true
+		p.mu.Lock()
+		entry, ok := p.manifests[path]
+		p.mu.Unlock()
+		if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+			stats.Files++
+		} else {
+			tasks = append(tasks, hashTask{name: wireName(rel), path: path, size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	hashed, stopped := p.hashAll(tasks)
+	stats.Files += hashed
+	stats.Hashed = hashed
+	if stopped {
+		stats.Duration = time.Since(start)
+		return stats, p.saveIndex()
+	}
+
+	p.mu.Lock()
+	for path := range p.manifests {
+		if !seen[path] {
+			delete(p.manifests, path)
+			stats.Removed++
+		}
+	}
+	p.mu.Unlock()
+
+	stats.Duration = time.Since(start)
+	return stats, p.saveIndex()
+}
+
+// indexLoop loads the index file and then checks it against the shared
+// directory, on start and whenever the shared directory changes
+func (p *Peer) indexLoop() {
+	if err := p.loadIndex(); err != nil {
+		logging.Errorf(p.logger, "Error loading index: %v", err)
+	}
+	for {
+		stats, err := p.IndexShared()
+		if err != nil {
+			logging.Errorf(p.logger, "Error indexing shared files: %v", err)
+		} else {
+			logging.Infof(p.logger, "Indexed %d shared files in %v (%d hashed, %d removed)",
+				stats.Files, stats.Duration.Round(time.Millisecond), stats.Hashed, stats.Removed)
+		}
+		// The DHT and the trackers hear of the files hashed
+		for _, ch := range []chan struct{}{p.dhtAnnounce, p.trackerAnnounce} {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+		select {
+		case <-p.reindex:
+		case <-p.stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package peer
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// keyIDPrefix starts the peer IDs derived from identity keys, see KeyID
+const keyIDPrefix = "key-"
+
+// keyIDEncoding spells key-derived peer IDs in lowercase letters and digits
+var keyIDEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// WithIdentityKey sets the Ed25519 key the peer signs with, e.g. one
+// loaded by LoadOrCreateKey
+func WithIdentityKey(key ed25519.PrivateKey) Option {
+	return func(p *Peer) {
+		p.key = key
+	}
+}
+
+// PublicKey returns the public half of the peer's identity key, nil if it has none
+func (p *Peer) PublicKey() ed25519.PublicKey {
+	if p.key == nil {
+		return nil
+	}
+	return p.key.Public().(ed25519.PublicKey)
+}
+
+// LoadOrCreateKey reads an Ed25519 private key from a PEM file, generating
+// and saving a new one readable only by the owner if the file doesn't exist
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, out, 0600); err != nil {
+			return nil, fmt.Errorf("failed to save key: %v", err)
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, fmt.Errorf("%s does not contain a PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %s: %v", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 key", path)
+	}
+	return key, nil
+}
+
+// KeyID derives a peer ID from an identity key: "key-" and the first 160
+// bits of the key's SHA-256 in base32, e.g. "key-5gq3...". Other peers
+// check that a peer announcing such an ID holds the key it came from, so
+// the ID can't be taken over even by a peer seen first
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return keyIDPrefix + keyIDEncoding.EncodeToString(sum[:20])
+}
+
+// IsKeyID reports whether id has the form of a key-derived peer ID
+func IsKeyID(id string) bool {
+	return strings.HasPrefix(id, keyIDPrefix) && len(id) == len(keyIDPrefix)+32
+}
+
+// EncodePublicKey formats a public key for display and configuration
+func EncodePublicKey(key ed25519.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// ParsePublicKey parses a key formatted by EncodePublicKey
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %v", err)
+	}
+	if len(data) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key: wrong length")
+	}
+	return ed25519.PublicKey(data), nil
+}
@@ -0,0 +1,189 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	listPageSize   = 1000            // Entries asked for per page of a listing
+	listPageMax    = 10000           // Most entries served per page to a peer asking for pages
+	listRetries    = 3               // Attempts at fetching a page of a listing
+	listRetryDelay = 2 * time.Second // Pause before asking for a failed page again
+)
+
+// ListFiles asks the peer at peerAddr for the files in its shared
+// directory that this peer may read, sorted by name
+// Files the remote peer hasn't hashed yet are listed without a hash
+func (p *Peer) ListFiles(ctx context.Context, peerAddr string) ([]protocol.ListEntry, error) {
+	var files []protocol.ListEntry
+	err := p.ListPages(ctx, peerAddr, "", func(page []protocol.ListEntry, next string) error {
+		files = append(files, page...)
+		return nil
+	})
+	return files, err
+}
+
+// ListPages is like ListFiles but hands the listing to fn a page at a
+// time, with the continuation token that resumes it after that page, so
+// enormous shares can be listed incrementally; a page that fails, e.g. as
+// the connection drops, is asked for again from the last token
+// after: Token to resume an earlier listing from, as passed to its fn, or
+// "" to start at the beginning
+// Returns: The error fn returned, if any, or why a page couldn't be had
+func (p *Peer) ListPages(ctx context.Context, peerAddr, after string, fn func(page []protocol.ListEntry, next string) error) error {
+	for {
+		var resp *protocol.ListResponse
+		var err error
+		for attempt := 1; ; attempt++ {
+			if resp, err = p.listPage(ctx, peerAddr, after); err == nil || attempt == listRetries || ctx.Err() != nil {
+				break
+			}
+			logging.Warnf(p.logger, "Listing %s failed, resuming in %v: %v", peerAddr, listRetryDelay, err)
+			select {
+			case <-time.After(listRetryDelay):
+			case <-ctx.Done():
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		// Tokens only move forward, or a faulty peer could keep the
+		// listing going forever
+		if resp.Next != "" && resp.Next <= after {
+			return fmt.Errorf("peer %s repeated a page of its listing", peerAddr)
+		}
+		if err := fn(resp.Files, resp.Next); err != nil {
+			return err
+		}
+		if resp.Next == "" {
+			return nil
+		}
+		after = resp.Next
+	}
+}
+
+// listPage asks the peer at peerAddr for the page of its listing after a
+// continuation token
+func (p *Peer) listPage(ctx context.Context, peerAddr, after string) (*protocol.ListResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	id := p.nextCallID()
+	msg, err := p.call(ctx, peerAddr, protocol.MessageTypeListRequest, id, &protocol.ListRequest{ID: id, After: after, Limit: listPageSize})
+	if err != nil {
+		return nil, err
+	}
+	return msg.Payload.(*protocol.ListResponse), nil
+}
+
+// handleListRequest answers a request for the shared directory's contents
+func (p *Peer) handleListRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.ListRequest)
+	resp := &protocol.ListResponse{ID: req.ID}
+
+	err := p.checkFeature(protocol.FeatureList)
+	var files []protocol.ListEntry
+	if err == nil {
+		files, err = p.listShared(p.readableBy(msg.From), p.SharedDir(), req.After)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Listing for %s failed: %v", msg.From, err)
+		resp.Error = err.Error()
+	}
+	// Peers that don't ask for pages get everything, as they can't ask
+	// for the rest
+	if limit := min(req.Limit, listPageMax); limit > 0 && len(files) > limit {
+		files = files[:limit]
+		resp.Next = files[limit-1].Name
+	}
+	resp.Files = files
+
+	if err := p.reply(msg, protocol.MessageTypeListResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending file list: %v", err)
+	}
+}
+
+// handleListResponse delivers a file list to the waiting call
+func (p *Peer) handleListResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.ListResponse).ID, msg)
+}
+
+// SharedFiles lists the files in the shared directory, sorted by name,
+// with the content hashes known so far; unlike the listings served to
+// other peers it isn't narrowed by the ACL
+func (p *Peer) SharedFiles() ([]protocol.ListEntry, error) {
+	return p.listShared(nil, p.SharedDir(), "")
+}
+
+// readableBy returns whether the ACL lets the peer with the given ID read
+// a shared file, for listShared
+func (p *Peer) readableBy(from string) func(name string) bool {
+	return func(name string) bool {
+		return p.checkAccess(from, name, AccessRead) == nil
+	}
+}
+
+// listShared lists the files under root, the shared directory or one of
+// its subdirectories, with the content hashes known from the index
+// readable: Whether a file may be listed, see readableBy; nil lists all
+// after: Only files named after this are listed, and directories holding
+// none are skipped; "" lists them all
+// Returns: Entries named relative to the shared directory
+func (p *Peer) listShared(readable func(name string) bool, root, after string) ([]protocol.ListEntry, error) {
+	sharedDir := p.SharedDir()
+	var files []protocol.ListEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(sharedDir, path)
+		if err != nil {
+			return nil
+		}
+		name := wireName(rel)
+		// Every name under a directory sorts before after when its prefix
+		// does without after being under it, so resuming a listing doesn't
+		// walk what was listed before again
+		if d.IsDir() && path != root && after != "" && name+"/" < after && !strings.HasPrefix(after, name+"/") {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || isPartial(d.Name()) || name <= after {
+			return nil
+		}
+		if readable != nil && !readable(name) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		entry := protocol.ListEntry{Name: name, Size: info.Size(), ModTime: info.ModTime().UTC()}
+		p.mu.Lock()
+		if m, ok := p.manifests[path]; ok && m.size == info.Size() && m.modTime.Equal(info.ModTime()) {
+			entry.Hash = m.manifest.ContentHash()
+		}
+		p.mu.Unlock()
+		files = append(files, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(files, func(a, b protocol.ListEntry) int { return strings.Compare(a.Name, b.Name) })
+	return files, nil
+}
@@ -0,0 +1,230 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	defaultPieceSize = 1 << 20  // Piece size of shared files' manifests unless WithPieceSize says otherwise
+	minPieceSize     = 16 << 10 // Smallest piece size WithPieceSize takes
+)
+
+// manifestEntry caches a manifest together with the file state it describes
+type manifestEntry struct {
+	size     int64
+	modTime  time.Time
+	manifest *protocol.Manifest
+}
+
+// hashJob is a shared file being hashed; callers needing the same manifest
+// wait for done instead of hashing the file again
+type hashJob struct {
+	size     int64
+	modTime  time.Time
+	done     chan struct{} // Closed once manifest and err are set
+	manifest *protocol.Manifest
+	err      error
+}
+
+// WithWebSeeds sets HTTP(S) base URLs that serve a mirror of the shared
+// directory. They are announced in every manifest so downloaders can fall
+// back to them; a file "a/b.txt" is expected at "<url>/a/b.txt"
+func WithWebSeeds(urls ...string) Option {
+	return func(p *Peer) {
+		p.webSeeds = append(p.webSeeds, urls...)
+	}
+}
+
+// WithPieceSize sets the size of the pieces shared files are hashed and
+// served in, 1 MiB by default; it must be between 16 KiB and 16 MiB
+// Content hashes depend on it, so peers that should find each other's
+// copies of a file by hash must use the same piece size
+func WithPieceSize(n int64) Option {
+	return func(p *Peer) {
+		p.pieceSize = n
+	}
+}
+
+// manifestFor returns the manifest of a shared file, hashing it only if it
+// changed since the manifest was last built
+func (p *Peer) manifestFor(name, path string) (*protocol.Manifest, error) {
+	return p.hashShared(name, path, nil)
+}
+
+// hashShared performs the work of manifestFor. A file that is already being
+// hashed, e.g. by the background hasher, is waited for rather than hashed twice
+// throttle: Called before each piece is read, e.g. to limit and count the
+// reads of the background hasher; nil for none
+func (p *Peer) hashShared(name, path string, throttle func(n int) error) (*protocol.Manifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+
+	p.mu.Lock()
+	entry, ok := p.manifests[path]
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) {
+		p.mu.Unlock()
+		return entry.manifest, nil
+	}
+	job := p.hashing[path]
+	if job != nil && job.size == info.Size() && job.modTime.Equal(info.ModTime()) {
+		p.mu.Unlock()
+		<-job.done
+		return job.manifest, job.err
+	}
+	job = &hashJob{size: info.Size(), modTime: info.ModTime(), done: make(chan struct{})}
+	p.hashing[path] = job
+	p.mu.Unlock()
+
+	m, err := buildManifest(path, name, p.pieceSize, p.disk, throttle)
+	if err == nil {
+		for _, seed := range p.webSeeds {
+			m.WebSeeds = append(m.WebSeeds, webSeedURL(seed, name))
+		}
+	}
+
+	p.mu.Lock()
+	if err == nil {
+		p.manifests[path] = manifestEntry{size: info.Size(), modTime: info.ModTime(), manifest: m}
+	}
+	if p.hashing[path] == job {
+		delete(p.hashing, path)
+	}
+	p.mu.Unlock()
+	job.manifest, job.err = m, err
+	close(job.done)
+	return m, err
+}
+
+// buildManifest hashes the file at path piece by piece
+// disk: Limiter the reads are subject to, may be nil
+// throttle: Called before each piece is read, may be nil
+func buildManifest(path, name string, pieceSize int64, disk *diskLimiter, throttle func(n int) error) (*protocol.Manifest, error) {
+	file, err := openShared(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &protocol.Manifest{
+		Name:         name,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		Size:         info.Size(),
+		PieceSize:    pieceSize,
+	}
+	buf := make([]byte, pieceSize)
+	for read := int64(0); ; {
+		if err := disk.wait(context.Background(), len(buf)); err != nil {
+			return nil, err
+		}
+		if throttle != nil {
+			if err := throttle(int(max(min(pieceSize, info.Size()-read), 0))); err != nil {
+				return nil, err
+			}
+		}
+		n, err := io.ReadFull(file, buf)
+		read += int64(n)
+		if n > 0 {
+			sum := sha256.Sum256(buf[:n])
+			m.PieceHashes = append(m.PieceHashes, sum[:])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// FetchManifest asks the peer at addr for the manifest of a shared file
+// Returns: The validated manifest, or an error if the peer can't provide it
+func (p *Peer) FetchManifest(ctx context.Context, addr, name string) (*protocol.Manifest, error) {
+	m, _, err := p.fetchManifest(ctx, addr, name)
+	return m, err
+}
+
+// fetchManifest performs the work of FetchManifest
+// Returns: The manifest and the ID of the peer that sent it
+func (p *Peer) fetchManifest(ctx context.Context, addr, name string) (*protocol.Manifest, string, error) {
+	name = wireName(name)
+	id := p.nextCallID()
+	req := &protocol.ManifestRequest{ID: id, FileName: name, NameEncoding: protocol.NameEncodingUTF8NFC}
+
+	msg, err := p.call(ctx, addr, protocol.MessageTypeManifestRequest, id, req)
+	if err != nil {
+		return nil, "", err
+	}
+	resp := msg.Payload.(*protocol.ManifestResponse)
+	if resp.Error != "" {
+		return nil, "", errors.New(resp.Error)
+	}
+	if resp.Manifest == nil {
+		return nil, "", fmt.Errorf("peer %s sent no manifest for %s", addr, name)
+	}
+	if err := resp.Manifest.Validate(); err != nil {
+		return nil, "", err
+	}
+	return resp.Manifest, msg.From, nil
+}
+
+// handleManifestRequest answers a request for a shared file's manifest
+func (p *Peer) handleManifestRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.ManifestRequest)
+	resp := &protocol.ManifestResponse{ID: req.ID}
+
+	err := p.checkFeature(protocol.FeatureChunks)
+	if err == nil {
+		err = p.checkAccess(msg.From, req.FileName, AccessRead)
+	}
+	var m *protocol.Manifest
+	if err == nil {
+		m, err = p.sharedManifest(req.FileName, req.NameEncoding)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Manifest request for %s from %s failed: %v", req.FileName, msg.From, err)
+		resp.Error = err.Error()
+	} else {
+		resp.Manifest = m
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeManifestResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending manifest: %v", err)
+	}
+}
+
+// sharedManifest resolves a wire name in the shared directory and returns its manifest
+func (p *Peer) sharedManifest(name, encoding string) (*protocol.Manifest, error) {
+	if err := checkNameEncoding(name, encoding); err != nil {
+		return nil, err
+	}
+	path, err := resolveShared(p.SharedDir(), name)
+	if err != nil {
+		return nil, err
+	}
+	return p.manifestFor(name, path)
+}
+
+// handleManifestResponse delivers a manifest to the waiting FetchManifest call
+func (p *Peer) handleManifestResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.ManifestResponse).ID, msg)
+}
@@ -0,0 +1,83 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// Limits on the extended attributes applied to received files, those of
+// Linux
+const (
+	maxXattrName  = 255
+	maxXattrValue = 64 << 10
+)
+
+// WithPreserveMetadata asks senders to include permission bits, ownership
+// and extended attributes with every file, and applies them to received
+// files where the OS and filesystem allow it. Ownership is only applied
+// when the receiving process runs as root, and extended attributes only in
+// the user namespace, see checkXattr
+func WithPreserveMetadata() Option {
+	return func(p *Peer) {
+		p.preserveMeta = true
+	}
+}
+
+// readMeta collects the metadata of an open file
+// Attributes the platform doesn't support are skipped
+func readMeta(path string, info os.FileInfo) *protocol.FileMeta {
+	meta := &protocol.FileMeta{
+		Mode: uint32(info.Mode().Perm()),
+	}
+	meta.UID, meta.GID, meta.HasOwner = fileOwner(info)
+	meta.Xattrs = readXattrs(path)
+	return meta
+}
+
+// applyMeta applies metadata received from the sender to a saved file
+// Each attribute is applied independently and failures are logged rather
+// than failing the transfer, since the file content itself is intact
+func (p *Peer) applyMeta(path string, meta *protocol.FileMeta) {
+	if meta.Mode != 0 {
+		if err := os.Chmod(path, os.FileMode(meta.Mode).Perm()); err != nil {
+			logging.Warnf(p.logger, "Could not apply mode to %s: %v", path, err)
+		}
+	}
+
+	if meta.HasOwner && isPrivileged() {
+		if err := os.Lchown(path, meta.UID, meta.GID); err != nil {
+			logging.Warnf(p.logger, "Could not apply ownership to %s: %v", path, err)
+		}
+	}
+
+	for name, value := range meta.Xattrs {
+		if err := checkXattr(name, value); err != nil {
+			logging.Warnf(p.logger, "Skipping extended attribute %q of %s: %v", name, path, err)
+			continue
+		}
+		if err := setXattr(path, name, value); err != nil {
+			logging.Warnf(p.logger, "Could not apply extended attribute %s to %s: %v", name, path, err)
+		}
+	}
+}
+
+// checkXattr vets an extended attribute sent by another peer. Only the
+// user namespace is applied: security.capability, trusted.* or ACLs in
+// system.* chosen by a remote peer would grant received files privileges
+func checkXattr(name string, value []byte) error {
+	if !strings.HasPrefix(name, "user.") || len(name) == len("user.") {
+		return errors.New("only user.* attributes are applied")
+	}
+	if len(name) > maxXattrName {
+		return fmt.Errorf("name longer than %d bytes", maxXattrName)
+	}
+	if len(value) > maxXattrValue {
+		return fmt.Errorf("value of %d bytes, over the limit of %d", len(value), maxXattrValue)
+	}
+	return nil
+}
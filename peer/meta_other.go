@@ -0,0 +1,26 @@
+//go:build !unix
+
+package peer
+
+import "os"
+
+// fileOwner is not supported on this platform
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
+
+// hardLinkKey is not supported on this platform, so no file counts as
+// hard linked
+func hardLinkKey(info os.FileInfo) (key [2]uint64, ok bool) {
+	return key, false
+}
+
+// processUmask returns 0 since this platform has no umask
+func processUmask() os.FileMode {
+	return 0
+}
+
+// isPrivileged reports false since ownership can't be applied on this platform
+func isPrivileged() bool {
+	return false
+}
@@ -0,0 +1,29 @@
+package peer
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckXattr(t *testing.T) {
+	tests := []struct {
+		name  string
+		value []byte
+		ok    bool
+	}{
+		{"user.comment", []byte("hello"), true},
+		{"user.big", make([]byte, maxXattrValue), true},
+		{"user.", nil, false},
+		{"security.capability", []byte{1, 0, 0, 2}, false},
+		{"trusted.overlay.opaque", []byte("y"), false},
+		{"system.posix_acl_access", []byte{2}, false},
+		{"User.comment", nil, false},
+		{"user." + string(bytes.Repeat([]byte("a"), maxXattrName)), nil, false},
+		{"user.huge", make([]byte, maxXattrValue+1), false},
+	}
+	for _, tt := range tests {
+		if err := checkXattr(tt.name, tt.value); (err == nil) != tt.ok {
+			t.Errorf("checkXattr(%.30q, %d bytes) = %v, want ok %v", tt.name, len(tt.value), err, tt.ok)
+		}
+	}
+}
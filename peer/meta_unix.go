@@ -0,0 +1,40 @@
+//go:build unix
+
+package peer
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileOwner returns the numeric owner and group of a file
+func fileOwner(info os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, 0, false
+	}
+	return int(st.Uid), int(st.Gid), true
+}
+
+// hardLinkKey identifies the inode of a file with more than one hard link
+// Returns: false if the file has a single link
+func hardLinkKey(info os.FileInfo) (key [2]uint64, ok bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Nlink < 2 {
+		return key, false
+	}
+	return [2]uint64{uint64(st.Dev), uint64(st.Ino)}, true
+}
+
+// processUmask returns the file mode creation mask of the process
+// The mask can only be read by setting it, so this briefly clears it
+func processUmask() os.FileMode {
+	mask := syscall.Umask(0)
+	syscall.Umask(mask)
+	return os.FileMode(mask)
+}
+
+// isPrivileged reports whether the process may change file ownership
+func isPrivileged() bool {
+	return os.Geteuid() == 0
+}
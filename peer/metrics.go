@@ -0,0 +1,106 @@
+package peer
+
+import (
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/metrics"
+)
+
+// peerMetrics holds the peer's entries in its metrics registry
+type peerMetrics struct {
+	bytesSent      *metrics.Counter
+	bytesReceived  *metrics.Counter
+	transfersOK    *metrics.Counter
+	transfersFail  *metrics.Counter
+	transferTime   *metrics.Timing
+	piecesOK       *metrics.Counter
+	piecesFail     *metrics.Counter
+	pieceTime      *metrics.Timing
+	requestsServed *metrics.Counter
+	queueWait      *metrics.Timing
+	serveTime      *metrics.Timing
+	panics         *metrics.Counter
+	congestion     *metrics.Counter
+}
+
+// WithMetrics sets the registry the peer records its metrics in, e.g. to
+// share it with other components; by default the peer creates its own
+func WithMetrics(reg *metrics.Registry) Option {
+	return func(p *Peer) {
+		p.registry = reg
+	}
+}
+
+// Metrics returns the registry the peer records its metrics in
+func (p *Peer) Metrics() *metrics.Registry {
+	return p.registry
+}
+
+// registerMetrics creates the peer's metrics in p.registry
+func (p *Peer) registerMetrics() {
+	reg := p.registry
+	p.metrics = &peerMetrics{
+		bytesSent:      reg.Counter("p2p_bytes_sent_total", "File bytes sent to other peers"),
+		bytesReceived:  reg.Counter("p2p_bytes_received_total", "File bytes received from peers and web seeds"),
+		transfersOK:    reg.Counter("p2p_transfers_completed_total", "Transfers that finished successfully"),
+		transfersFail:  reg.Counter("p2p_transfers_failed_total", "Transfers that failed"),
+		transferTime:   reg.Timing("p2p_transfer_duration", "Duration of finished transfers"),
+		piecesOK:       reg.Counter("p2p_pieces_completed_total", "Downloaded pieces that passed verification"),
+		piecesFail:     reg.Counter("p2p_pieces_failed_total", "Piece fetches that failed or did not verify"),
+		pieceTime:      reg.Timing("p2p_piece_fetch_duration", "Time to fetch one piece from a source"),
+		requestsServed: reg.Counter("p2p_requests_served_total", "File, manifest and chunk requests served"),
+		queueWait:      reg.Timing("p2p_request_queue_wait", "Time requests waited for a serve worker"),
+		serveTime:      reg.Timing("p2p_request_serve_duration", "Time spent serving one request"),
+		panics:         reg.Counter("p2p_handler_panics_total", "Panics recovered in message handlers"),
+		congestion:     reg.Counter("p2p_congestion_backoffs_total", "Times a source's request window shrank because of queueing delay or lost pieces"),
+	}
+
+	reg.GaugeFunc("p2p_transfers_active", "Transfers in progress", func() float64 {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return float64(len(p.transfers))
+	})
+	reg.GaugeFunc("p2p_requests_queued", "Requests waiting for a serve worker", func() float64 {
+		return float64(p.queue.len())
+	})
+	reg.GaugeFunc("p2p_peers_known", "Remote peers seen", func() float64 {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return float64(len(p.peers))
+	})
+	reg.GaugeFunc("p2p_shared_bytes", "Size of the files in the shared directory", func() float64 {
+		return float64(p.cachedDiskUsage().SharedBytes)
+	})
+	reg.GaugeFunc("p2p_received_bytes", "Size of the files in the received directory", func() float64 {
+		return float64(p.cachedDiskUsage().ReceivedBytes)
+	})
+	if p.cache != nil {
+		reg.GaugeFunc("p2p_cache_hits", "Read cache hits", func() float64 {
+			return float64(p.cache.stats().Hits)
+		})
+		reg.GaugeFunc("p2p_cache_misses", "Read cache misses", func() float64 {
+			return float64(p.cache.stats().Misses)
+		})
+		reg.GaugeFunc("p2p_cache_bytes", "Bytes held in the read cache", func() float64 {
+			return float64(p.cache.stats().Bytes)
+		})
+	}
+}
+
+// byteCounter returns the counter for bytes moving in direction
+func (m *peerMetrics) byteCounter(direction string) *metrics.Counter {
+	if direction == "send" {
+		return m.bytesSent
+	}
+	return m.bytesReceived
+}
+
+// finished records the outcome of a transfer started at start
+func (m *peerMetrics) finished(start time.Time, err error) {
+	if err != nil {
+		m.transfersFail.Inc()
+		return
+	}
+	m.transfersOK.Inc()
+	m.transferTime.Since(start)
+}
@@ -0,0 +1,94 @@
+package peer
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	migrateWait     = 30 * time.Second // How long a download looks for a dropped peer at other addresses
+	migrateInterval = time.Second      // How often it looks again meanwhile
+)
+
+// migrateSource looks for the peer behind a source a download dropped at
+// another address: the one it announced after its network changed, the
+// one it was last seen at, or the one it advertises on the local network
+// The download carries on there from the pieces it already holds, which
+// are announced to the peer so it can push the rest
+// Returns: A source at the new address, or nil if the peer wasn't found
+// serving the same content within migrateWait
+func (p *Peer) migrateSource(ctx context.Context, d *downloader, s *activeSource) *activeSource {
+	src, ok := s.src.(*peerSource)
+	if !ok {
+		return nil
+	}
+	id := src.peerID
+	if id == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, migrateWait)
+	defer cancel()
+	ticker := time.NewTicker(migrateInterval)
+	defer ticker.Stop()
+	tried := map[string]bool{src.addr: true}
+	for {
+		for _, addr := range p.otherAddrs(id) {
+			if tried[addr] {
+				continue
+			}
+			tried[addr] = true
+			if !p.servesManifest(ctx, addr, d.m) {
+				continue
+			}
+			logging.Infof(p.logger, "Peer %s moved from %s to %s, continuing %s there", id, src.addr, addr, d.m.Name)
+			moved := &peerSource{p: p, addr: addr, peerID: id, priority: src.priority}
+			ms := &activeSource{src: moved, stats: p.sourceStats(moved)}
+			p.announceHave(d, []*activeSource{ms})
+			return ms
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			logging.Warnf(p.logger, "Peer %s did not turn up at another address within %v", id, migrateWait)
+			return nil
+		}
+	}
+}
+
+// otherAddrs returns the addresses the peer with the given ID may be
+// reached at, as far as this peer knows
+func (p *Peer) otherAddrs(id string) []string {
+	var addrs []string
+	p.mu.Lock()
+	if info, ok := p.peers[id]; ok {
+		if info.ListenAddr != "" {
+			addrs = append(addrs, info.ListenAddr)
+		}
+		addrs = append(addrs, info.Addr)
+	}
+	p.mu.Unlock()
+	for _, e := range p.discovered() {
+		if e.ID == id {
+			addrs = append(addrs, e.Addr)
+		}
+	}
+	return addrs
+}
+
+// servesManifest reports whether the peer at addr serves pieces of the
+// file m describes
+func (p *Peer) servesManifest(ctx context.Context, addr string, m *protocol.Manifest) bool {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	features, err := p.PeerFeatures(ctx, addr)
+	if err != nil || !slices.Contains(features, protocol.FeatureChunks) {
+		return false
+	}
+	fetched, err := p.FetchManifest(ctx, addr, m.Name)
+	return err == nil && m.SameContent(fetched)
+}
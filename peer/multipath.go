@@ -0,0 +1,59 @@
+package peer
+
+import "joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+
+// WithInterfaces spreads chunked downloads over several network paths to
+// each peer, one leaving from each of the given local IP addresses (see
+// transport.InterfaceAddr), e.g. Ethernet and Wi-Fi or two uplinks
+// Every path becomes a download source of its own with a connection of its
+// own, so faster paths take a larger share of the pieces and a path that
+// fails is dropped while the others finish the transfer
+// Requires a transport that understands path addresses, such as TCPTransport
+func WithInterfaces(locals ...string) Option {
+	return func(p *Peer) {
+		// Interface names and IPs may resolve to the same address; one
+		// connection per path is enough
+		seen := make(map[string]bool)
+		for _, local := range locals {
+			if !seen[local] {
+				seen[local] = true
+				p.paths = append(p.paths, local)
+			}
+		}
+	}
+}
+
+// WithConnections opens n parallel connections to each peer a chunked
+// download uses, on every path, and spreads piece requests over them
+// A single TCP stream can't fill a long fat link, e.g. across continents,
+// while several streams together can
+// Requires a transport that understands stripe addresses, such as TCPTransport
+func WithConnections(n int) Option {
+	return func(p *Peer) {
+		p.stripes = n
+	}
+}
+
+// expandPaths replaces every peer address with its paths when the peer is
+// multi-homed, and those with their parallel connections
+func (p *Peer) expandPaths(addrs []string) []string {
+	if len(p.paths) > 0 {
+		var out []string
+		for _, addr := range addrs {
+			for _, local := range p.paths {
+				out = append(out, transport.PathAddr(addr, local))
+			}
+		}
+		addrs = out
+	}
+	if p.stripes > 1 {
+		var out []string
+		for _, addr := range addrs {
+			for n := 0; n < p.stripes; n++ {
+				out = append(out, transport.StripeAddr(addr, n))
+			}
+		}
+		addrs = out
+	}
+	return addrs
+}
@@ -0,0 +1,110 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// windowsReserved are device names Windows refuses as file names, with or
+// without an extension
+var windowsReserved = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkNameEncoding validates a name received in a protocol message
+// Returns: An error if the encoding is unknown or the name isn't valid UTF-8
+func checkNameEncoding(name, encoding string) error {
+	if encoding != "" && encoding != protocol.NameEncodingUTF8NFC {
+		return fmt.Errorf("unsupported name encoding %q", encoding)
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("file name %q is not valid UTF-8", name)
+	}
+	return nil
+}
+
+// sanitizeName makes a wire name safe to create on the local filesystem
+// Control characters are replaced in every component; on Windows the
+// characters and device names it reserves, and trailing dots and spaces
+// it silently strips, are replaced as well
+func sanitizeName(name string) string {
+	parts := strings.Split(norm.NFC.String(name), "/")
+	for i, part := range parts {
+		parts[i] = sanitizeComponent(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// sanitizeComponent sanitizes a single path component
+func sanitizeComponent(c string) string {
+	c = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return '_'
+		}
+		if isWindows && strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, c)
+
+	if !isWindows || c == "." || c == ".." {
+		return c
+	}
+
+	if trimmed := strings.TrimRight(c, ". "); trimmed != c {
+		c = trimmed + strings.Repeat("_", len(c)-len(trimmed))
+	}
+	base := strings.ToUpper(strings.SplitN(c, ".", 2)[0])
+	if windowsReserved[base] {
+		c = "_" + c
+	}
+	return c
+}
+
+// resolveShared maps a wire name to a file in the shared directory
+// Names on the wire are NFC, but files may be stored decomposed (e.g. on
+// HFS+), so when there is no exact match each component is looked up by
+// comparing normalized directory entries
+func resolveShared(dir, name string) (string, error) {
+	path, err := localPath(dir, name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(path); err == nil || !os.IsNotExist(err) {
+		return path, nil
+	}
+
+	current := dir
+	for _, part := range strings.Split(norm.NFC.String(name), "/") {
+		if part == "" || part == "." {
+			continue
+		}
+		entries, err := os.ReadDir(current)
+		if err != nil {
+			return path, nil
+		}
+		found := false
+		for _, e := range entries {
+			if norm.NFC.String(e.Name()) == part {
+				current = filepath.Join(current, e.Name())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return path, nil
+		}
+	}
+	return current, nil
+}
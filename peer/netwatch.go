@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// WithAddressWatch checks the addresses of the local network interfaces
+// every interval and, when they change, e.g. as a laptop moves between
+// networks, announces the peer again at once instead of at the next
+// scheduled announcement: to the peers seen recently, which learn the
+// address it listens on, to the trackers, in the DHT and over mDNS
+// Only a peer listening on all interfaces, such as 0.0.0.0, stays
+// reachable after its address changes
+func WithAddressWatch(interval time.Duration) Option {
+	return func(p *Peer) {
+		p.addrWatch = interval
+	}
+}
+
+// watchAddresses announces the peer again whenever the local addresses
+// change, until the peer stops
+func (p *Peer) watchAddresses() {
+	prev, err := localAddrs()
+	if err != nil {
+		logging.Errorf(p.logger, "Error reading the local addresses: %v", err)
+	}
+	ticker := time.NewTicker(p.addrWatch)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+		current, err := localAddrs()
+		if err != nil {
+			logging.Errorf(p.logger, "Error reading the local addresses: %v", err)
+			continue
+		}
+		if strings.Join(current, ",") == strings.Join(prev, ",") {
+			continue
+		}
+		logging.Infof(p.logger, "Local addresses changed from [%s] to [%s], announcing the peer again", strings.Join(prev, " "), strings.Join(current, " "))
+		prev = current
+		p.reannounce()
+	}
+}
+
+// localAddrs returns the IP addresses of the interfaces that are up,
+// leaving out loopback and link-local ones, sorted
+func localAddrs() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		list, err := ifi.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range list {
+			if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLinkLocalUnicast() {
+				addrs = append(addrs, ipnet.IP.String())
+			}
+		}
+	}
+	sort.Strings(addrs)
+	return addrs, nil
+}
+
+// reannounce tells everyone who may hold the peer's address about it again
+func (p *Peer) reannounce() {
+	// mDNS is restarted, as the multicast group is joined on whichever
+	// interface is the default one at the time
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return
+	}
+	svc := p.discovery
+	p.discovery = nil
+	p.mu.Unlock()
+	if svc != nil {
+		svc.Close()
+		p.startDiscovery()
+	}
+
+	if p.dht != nil {
+		p.mu.Lock()
+		for key, a := range p.dhtAnnounced {
+			a.Announced = time.Time{}
+			p.dhtAnnounced[key] = a
+		}
+		p.mu.Unlock()
+		signal(p.dhtAnnounce)
+	}
+	if len(p.trackers) > 0 {
+		signal(p.trackerAnnounce)
+	}
+
+	told := p.helloPeers()
+	logging.Infof(p.logger, "Told %d peers the address %s", told, p.Addr())
+}
+
+// helloPeers sends a hello giving the peer's address to every peer seen
+// within featureTTL
+// Returns: How many answered
+func (p *Peer) helloPeers() int {
+	ctx, cancel := context.WithTimeout(context.Background(), helloTimeout)
+	defer cancel()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	told := 0
+	for _, info := range p.Peers() {
+		addr := info.DialAddr()
+		if addr == "" || time.Since(info.LastSeen) > featureTTL {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := p.nextCallID()
+			msg, err := p.call(ctx, addr, protocol.MessageTypeHello, id, &protocol.Hello{ID: id, Features: p.Features(), Addr: p.Addr()})
+			if err != nil {
+				return
+			}
+			p.notePeerFeatures(msg.From, msg.Payload.(*protocol.HelloResponse).Features)
+			mu.Lock()
+			told++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return told
+}
+
+// noteListenAddr records the address a peer announced it listens on
+func (p *Peer) noteListenAddr(id, addr string) {
+	if id == "" || addr == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, ok := p.peers[id]
+	if !ok {
+		return
+	}
+	if info.ListenAddr != "" && info.ListenAddr != addr {
+		logging.Infof(p.logger, "Peer %s moved from %s to %s", id, info.ListenAddr, addr)
+	}
+	info.ListenAddr = addr
+}
+
+// signal wakes up a loop waiting on ch without blocking
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -1,22 +1,166 @@
 package peer
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
+	"joeyyy09/P2P-FileTransfer-Go/pkg/cdc"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/dht"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/discovery"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/metrics"
 	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/ratelimit"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
 )
 
 // Peer represents a node in the P2P network that can share and receive files
+// All exported methods are safe for concurrent use; see the package
+// documentation for details
 type Peer struct {
 	id          string            // Unique identifier for the peer
 	listenAddr  string            // Network address the peer listens on
 	transport   Transport         // Transport layer for network communication
-	sharedDir   string           // Directory for shared files
-	receivedDir string           // Directory for received files
+	stateFile   string           // Path of the persisted state file, empty to disable
+	indexFile   string           // Path of the persisted shared-file index, empty to disable
+	logger      *log.Logger      // Destination for the peer's log output
+	preserveMeta bool            // Request and apply file metadata on transfers
+	perms       Permissions      // Mode and owner of received files, see WithPermissions
+	reshare     bool             // Publish received files in the shared directory
+	paths       []string         // Local addresses to reach peers from; see WithInterfaces
+	stripes     int              // Parallel connections per path; see WithConnections
+	gcMaxAge    time.Duration    // Age of stale partial files to collect, 0 to disable
+	stop        chan struct{}    // Closed by Close to stop background goroutines
+	reindex     chan struct{}    // Signals the index loop that the shared directory changed
+	hashWorkers int              // Files the background hasher hashes at once
+	serveWorkers int             // Requests from other peers served at once
+	hashRate    *ratelimit.Limiter // Read rate of the background hasher, nil if unlimited
+	hashMu      sync.Mutex       // Guards hashProgress
+	hashProgress HashProgress    // Progress of the background hasher
+	usage       usageCache       // Last disk usage scan
+	evictMu     sync.Mutex       // Serializes evictions from the received directory
+	conflict    ConflictPolicy   // What to do when a received file already exists
+	webSeeds    []string         // Web seed base URLs announced in manifests
+	cache       *readCache       // Cache of served file data, nil if disabled
+	readAhead   *readAhead       // Pieces prefetched for chunk requests, nil if disabled
+	disk        *diskLimiter     // Disk I/O throttle, nil if unlimited
+	queue       *serveQueue      // Requests from other peers waiting to be served
+	uploadWeights map[string]float64 // Upload shares of remote peers by peer ID, default 1
+	slots       *prioritySlots   // Piece requests outstanding across downloads
+	registry    *metrics.Registry // Registry the peer's metrics are recorded in
+	key         ed25519.PrivateKey // Identity key for signing, nil if none
+	adminKey    ed25519.PrivateKey // Key signing admin commands to other peers, nil if none
+	adminKeys   []ed25519.PublicKey // Keys of the operators that may manage this peer
+	metrics     *peerMetrics     // The peer's entries in registry
+
+	startMu     sync.Mutex                 // Held by Start throughout, so that Close waits for a start in progress
+	mu          sync.Mutex                 // Guards the fields below
+	sharedDir   string                     // Directory for shared files
+	receivedDir string                     // Directory for received files
+	started     bool                       // Set once Start has been called
+	closing     bool                       // Set once Close has been called
+	active      sync.WaitGroup             // Counts in-flight transfers
+	pending     map[string]*transfer       // Outstanding file requests keyed by file name
+	transfers   map[uint64]*transfer       // Transfers in progress keyed by ID
+	transferSeq uint64                     // Last transfer ID handed out
+	uploads     map[string]*uploadSession  // Chunked uploads keyed by peer ID and file name
+	peers       map[string]*PeerInfo       // Known remote peers keyed by peer ID
+	history     []TransferRecord           // Finished transfers, oldest first
+	benchRecv   map[string]int64           // Bytes received per incoming benchmark run
+	benchWait   map[string]chan int64      // Outgoing benchmark runs awaiting a result
+	caseProbe   map[string]bool            // Case-insensitivity of directories, by path
+	manifests   map[string]manifestEntry   // Manifests of shared files, by path
+	hashing     map[string]*hashJob        // Shared files being hashed, by path
+	receivedLimit int64                    // Cap on the received directory's size, 0 if unlimited
+	eviction    EvictionPolicy             // Order in which received files are evicted
+	sources     map[string]*SourceStats    // Download source statistics, by address or URL
+	downloads   map[string]*transferPriority // Priorities of running downloads, by file name
+	coalesced   map[string]*sharedDownload // Downloads concurrent Download calls wait on together, by file name
+	calls       map[uint64]chan protocol.Message // Requests awaiting a response, by call ID
+	streams     map[uint64]chan *protocol.StreamData // Files being followed, by call ID
+	pushes      map[uint64]*pushStream     // Downloads receiving pushed pieces, by call ID
+	remotePieces map[string]protocol.Bitmap // Pieces other peers hold, by file name and peer ID
+	follows     map[string]*follower       // Other peers following shared files, by peer ID and call ID
+	prefixes    map[string]*prefixState    // Hash state of append-only shared files, by path
+	channels    map[string]*protocol.Channel // Published and verified channels, by name
+	keys        map[string]*KnownKey         // Identity keys pinned for remote peers, by peer ID
+	receipts    []*protocol.Receipt          // Receipts for files this peer sent, oldest first
+	keyAlerts   []KeyAlert                   // Connections refused for a changed key
+	keyPrompt   func(transport.PeerIdentity) bool // Confirms first-seen keys, nil to trust them
+	quarantineDir string                      // Where received files failing a check are kept, empty to discard them
+	tempDir       string                      // Where downloads in progress are kept, empty for next to their targets
+	receiveFilter func(name, path string) error // Policy check on received files, nil to accept all
+	disabled    map[string]bool              // Features not offered to other peers, see WithoutFeatures
+	features    map[string]featureEntry      // Features other peers advertised, by address
+	pushPolicy  *PushPolicy                  // Which pushed files are accepted, nil to refuse all
+	offerExpiry time.Duration                // How long offers of pushed files stay valid, 0 for no limit
+	acl         *ACL                         // What other peers may do, nil to let them read everything
+	discoverEvery time.Duration              // mDNS announce interval, 0 to not advertise; see WithDiscovery
+	discovery   *discovery.Service           // Advertises the peer once started with WithDiscovery
+	addrWatch   time.Duration                // How often the local addresses are checked for changes, 0 to not; see WithAddressWatch
+	dhtEnabled  bool                         // Join the DHT on start, see WithDHT
+	dhtBootstrap []string                    // Addresses of the nodes to join the DHT through
+	dht         *dht.Node                    // The peer's DHT node once started with WithDHT
+	dhtJoined   chan struct{}                // Closed once the DHT node has bootstrapped
+	dhtAnnounce chan struct{}                // Signals that the index changed and may hold files to announce
+	dhtAnnounced map[dht.Key]AnnouncedFile   // Shared files announced in the DHT, by content hash
+	trackerMode bool                         // Keep a registry of peers and their files, see WithTracker
+	tracked     map[string]*TrackedPeer      // Peers registered with the tracker, by peer ID
+	trackers    []string                     // Addresses of the trackers to announce to, see WithTrackers
+	trackerAnnounce chan struct{}            // Signals that the index changed and the trackers should hear of it
+	syncRules   map[string]SyncRule          // What SyncChannel pulls from each peer, see WithSyncRules
+	syncPartner string                       // Address shared files are pushed to as they change, see WithSyncPartner
+	syncEvery   time.Duration                // How often the shared directory is scanned for the sync partner
+	syncDeletes int                          // Deletions passed on to the sync partner per scan, 0 for none
+	synced      map[string]map[string]syncedFile // Shared files as they last reached each sync partner, by address and name
+	recipes     map[string]*recipe           // Content-defined chunks of local files, by path
+	adminNonces map[string]time.Time         // Nonces of recent admin requests, against replays
+	panicHook   func(HandlerPanic)           // Called after a handler panic is recovered, may be nil
+	progress    ProgressFunc                 // Receives transfer progress reports, may be nil
+	progressEvery time.Duration              // Least time between progress reports of a transfer
+	fileStreams map[string]*fileStream       // Streamed files being received, by sender ID and name
+	hashAlgorithms []string                  // Algorithms whole-file transfers are checked with, most preferred first; see WithHashAlgorithms
+	compression    []string                  // Algorithms file payloads are compressed with, most preferred first; see WithCompression
+	offers      map[uint64]*pendingOffer     // Push offers waiting for a decision, by local ID
+	fetchLimit  int64                        // Largest file Fetch returns, see WithFetchLimit
+	pieceSize   int64                        // Piece size of shared files' manifests, see WithPieceSize
+	callSeq     uint64                     // Last call ID handed out, accessed atomically
+}
+
+// ErrClosed is returned when new work is submitted to a peer that is closing
+var ErrClosed = errors.New("peer is closed")
+
+// Option configures optional Peer behaviour
+type Option func(*Peer)
+
+// WithLogger sets the logger the peer writes to instead of the standard
+// logger, e.g. to tell several peers in one process apart by prefix
+func WithLogger(logger *log.Logger) Option {
+	return func(p *Peer) {
+		p.logger = logger
+	}
+}
+
+// WithStateFile sets the file the peer persists its state to on Close
+// and restores it from on startup
+func WithStateFile(path string) Option {
+	return func(p *Peer) {
+		p.stateFile = path
+	}
 }
 
 // Transport defines the interface for network communication
@@ -31,13 +175,15 @@ type Transport interface {
 }
 
 // New creates and initializes a new Peer instance
-// id: Unique identifier for the peer
+// id: Unique identifier for the peer; empty to derive it from the identity
+// key, see KeyID
 // listenAddr: Network address to listen on
 // sharedDir: Directory path for shared files
 // receivedDir: Directory path for received files
 // transport: Implementation of the Transport interface
+// opts: Optional settings such as WithStateFile
 // Returns: Initialized peer and any error encountered
-func New(id, listenAddr, sharedDir, receivedDir string, transport Transport) (*Peer, error) {
+func New(id, listenAddr, sharedDir, receivedDir string, transport Transport, opts ...Option) (*Peer, error) {
 	// Create both directories
 	if err := os.MkdirAll(sharedDir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create shared directory: %v", err)
@@ -46,51 +192,523 @@ func New(id, listenAddr, sharedDir, receivedDir string, transport Transport) (*P
 		return nil, fmt.Errorf("failed to create received directory: %v", err)
 	}
 
-	return &Peer{
+	p := &Peer{
 		id:          id,
 		listenAddr:  listenAddr,
 		transport:   transport,
 		sharedDir:   sharedDir,
 		receivedDir: receivedDir,
-	}, nil
+		logger:      log.Default(),
+		pending:     make(map[string]*transfer),
+		transfers:   make(map[uint64]*transfer),
+		uploads:     make(map[string]*uploadSession),
+		peers:       make(map[string]*PeerInfo),
+		benchRecv:   make(map[string]int64),
+		benchWait:   make(map[string]chan int64),
+		caseProbe:   make(map[string]bool),
+		manifests:   make(map[string]manifestEntry),
+		hashing:     make(map[string]*hashJob),
+		sources:     make(map[string]*SourceStats),
+		calls:       make(map[uint64]chan protocol.Message),
+		streams:     make(map[uint64]chan *protocol.StreamData),
+		pushes:      make(map[uint64]*pushStream),
+		remotePieces: make(map[string]protocol.Bitmap),
+		follows:     make(map[string]*follower),
+		prefixes:    make(map[string]*prefixState),
+		channels:    make(map[string]*protocol.Channel),
+		keys:        make(map[string]*KnownKey),
+		perms:       Permissions{FileMode: 0644, DirMode: 0755},
+		disabled:    make(map[string]bool),
+		features:    make(map[string]featureEntry),
+		offers:      make(map[uint64]*pendingOffer),
+		synced:      make(map[string]map[string]syncedFile),
+		fileStreams: make(map[string]*fileStream),
+		downloads:   make(map[string]*transferPriority),
+		coalesced:   make(map[string]*sharedDownload),
+		fetchLimit:  defaultFetchLimit,
+		pieceSize:   defaultPieceSize,
+		queue:       newServeQueue(),
+		serveWorkers: defaultServeWorkers,
+		uploadWeights: make(map[string]float64),
+		slots:       newPrioritySlots(maxActivePieces),
+		stop:        make(chan struct{}),
+		reindex:     make(chan struct{}, 1),
+		dhtJoined:   make(chan struct{}),
+		dhtAnnounce: make(chan struct{}, 1),
+		dhtAnnounced: make(map[dht.Key]AnnouncedFile),
+		tracked:     make(map[string]*TrackedPeer),
+		recipes:     make(map[string]*recipe),
+		adminNonces: make(map[string]time.Time),
+		trackerAnnounce: make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	if p.key != nil && p.id == "" {
+		p.id = KeyID(p.PublicKey())
+	}
+	if p.id == "" {
+		return nil, errors.New("peer ID is empty and there is no identity key to derive it from")
+	}
+	if p.tempDir != "" {
+		if err := os.MkdirAll(p.tempDir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %v", err)
+		}
+	}
+	if p.serveWorkers < 1 {
+		return nil, fmt.Errorf("need at least 1 serve worker, got %d", p.serveWorkers)
+	}
+	if p.pieceSize < minPieceSize || p.pieceSize > maxChunkLength {
+		return nil, fmt.Errorf("piece size %d is not between %d and %d bytes", p.pieceSize, minPieceSize, maxChunkLength)
+	}
+	if IsKeyID(p.id) && (p.key == nil || p.id != KeyID(p.PublicKey())) {
+		return nil, fmt.Errorf("peer ID %s is derived from a key other than the identity key", p.id)
+	}
+	if !p.dhtEnabled {
+		p.disabled[protocol.FeatureDHT] = true
+	}
+	if !p.trackerMode {
+		p.disabled[protocol.FeatureTracker] = true
+	}
+	if len(p.adminKeys) == 0 {
+		p.disabled[protocol.FeatureAdmin] = true
+	}
+	if p.pushPolicy == nil || !p.pushPolicy.Deletes {
+		p.disabled[protocol.FeatureDeletes] = true
+	}
+	if p.registry == nil {
+		p.registry = metrics.NewRegistry()
+	}
+	p.registerMetrics()
+
+	if err := p.loadState(); err != nil {
+		return nil, err
+	}
+	return p, nil
 }
 
 // Start begins peer operation by starting the transport layer and message handler
-// Returns: Error if the transport fails to start
+// Returns: Error if the peer was already started or the transport fails to start
 func (p *Peer) Start() error {
+	p.startMu.Lock()
+	defer p.startMu.Unlock()
+
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	if p.started {
+		p.mu.Unlock()
+		return errors.New("peer already started")
+	}
+	p.setupIdentity()
+	p.setupHello()
+	p.mu.Unlock()
+
 	if err := p.transport.StartListening(); err != nil {
 		return err
 	}
 
+	p.mu.Lock()
+	p.started = true
+	if p.dhtEnabled {
+		p.startDHT()
+	}
+	p.mu.Unlock()
+
 	go p.handleMessages()
+	for i := 0; i < p.serveWorkers; i++ {
+		go p.serveLoop()
+	}
+	if p.gcMaxAge > 0 {
+		go p.gcLoop()
+	}
+	if p.indexFile != "" {
+		go p.indexLoop()
+	}
+	if p.discoverEvery > 0 {
+		p.startDiscovery()
+	}
+	if len(p.trackers) > 0 {
+		go p.trackerLoop()
+	}
+	if p.syncPartner != "" {
+		go p.syncLoop()
+	}
+	if p.addrWatch > 0 {
+		go p.watchAddresses()
+	}
 	return nil
 }
 
 // handleMessages processes incoming messages from the transport layer
 // Continuously reads from message channel and routes to appropriate handlers
+// Requests that read files are queued by priority for the serve workers
 func (p *Peer) handleMessages() {
 	for msg := range p.transport.GetMessageChannel() {
-		switch msg.Type {
-		case protocol.MessageTypeFileRequest:
-			p.handleFileRequest(msg)
-		case protocol.MessageTypeFileResponse:
-			p.handleFileResponse(msg)
+		p.dispatch(msg)
+	}
+	p.queue.close()
+}
+
+// dispatch routes a message to its handler
+// A panic in the handler is recovered, see recoverHandler
+func (p *Peer) dispatch(msg protocol.Message) {
+	defer p.recoverHandler(msg)
+	p.notePeer(msg.From, msg.FromAddr)
+
+	switch msg.Type {
+	case protocol.MessageTypeFileRequest:
+		req := msg.Payload.(*protocol.FileRequest)
+		p.enqueueRequest(msg, req.Priority, req.FileName, defaultPieceSize, func() { p.handleFileRequest(msg) })
+	case protocol.MessageTypeFileResponse:
+		p.handleFileResponse(msg)
+	case protocol.MessageTypeFileData:
+		p.handleFileData(msg)
+	case protocol.MessageTypeBenchData:
+		p.handleBenchData(msg)
+	case protocol.MessageTypeBenchResult:
+		p.handleBenchResult(msg)
+	case protocol.MessageTypeManifestRequest:
+		req := msg.Payload.(*protocol.ManifestRequest)
+		p.enqueueRequest(msg, protocol.PriorityNormal, req.FileName, 0, func() { p.handleManifestRequest(msg) })
+	case protocol.MessageTypeManifestResponse:
+		p.handleManifestResponse(msg)
+	case protocol.MessageTypeChunkRequest:
+		req := msg.Payload.(*protocol.ChunkRequest)
+		p.enqueueRequest(msg, req.Priority, req.FileName, req.Length, func() { p.handleChunkRequest(msg) })
+	case protocol.MessageTypeChunkData:
+		p.handleChunkData(msg)
+	case protocol.MessageTypeFollowRequest:
+		p.handleFollowRequest(msg)
+	case protocol.MessageTypeStream:
+		p.handleStream(msg)
+	case protocol.MessageTypeAppendRequest:
+		req := msg.Payload.(*protocol.AppendRequest)
+		p.enqueueRequest(msg, protocol.PriorityNormal, req.FileName, maxAppendChunk, func() { p.handleAppendRequest(msg) })
+	case protocol.MessageTypeAppendData:
+		p.handleAppendData(msg)
+	case protocol.MessageTypeChannelRequest:
+		p.handleChannelRequest(msg)
+	case protocol.MessageTypeChannelResponse:
+		p.handleChannelResponse(msg)
+	case protocol.MessageTypeHaveBitmap:
+		p.handleHaveBitmap(msg)
+	case protocol.MessageTypeHello:
+		p.handleHello(msg)
+	case protocol.MessageTypeHelloResponse:
+		p.handleHelloResponse(msg)
+	case protocol.MessageTypeHandshake:
+		p.handleHandshake(msg)
+	case protocol.MessageTypePushOffer:
+		p.handlePushOffer(msg)
+	case protocol.MessageTypePushReply:
+		p.handlePushReply(msg)
+	case protocol.MessageTypeDHTRequest:
+		p.handleDHTRequest(msg)
+	case protocol.MessageTypeDHTResponse:
+		p.handleDHTResponse(msg)
+	case protocol.MessageTypeTrackerAnnounce:
+		p.handleTrackerAnnounce(msg)
+	case protocol.MessageTypeTrackerQuery:
+		p.handleTrackerQuery(msg)
+	case protocol.MessageTypeTrackerResponse:
+		p.handleTrackerResponse(msg)
+	case protocol.MessageTypeReceipt:
+		p.handleReceipt(msg)
+	case protocol.MessageTypeRecipeRequest:
+		req := msg.Payload.(*protocol.RecipeRequest)
+		p.enqueueRequest(msg, protocol.PriorityNormal, req.FileName, 0, func() { p.handleRecipeRequest(msg) })
+	case protocol.MessageTypeRecipeResponse:
+		p.handleRecipeResponse(msg)
+	case protocol.MessageTypeBlockRequest:
+		req := msg.Payload.(*protocol.BlockRequest)
+		p.enqueueRequest(msg, protocol.PriorityNormal, req.FileName, int64(len(req.Hashes))*cdc.MaxSize, func() { p.handleBlockRequest(msg) })
+	case protocol.MessageTypeBlockResponse:
+		p.handleBlockResponse(msg)
+	case protocol.MessageTypeAdminRequest:
+		// Operators go ahead of file requests; the status scans the disk
+		p.enqueueRequest(msg, protocol.PriorityHigh, "", 0, func() { p.handleAdminRequest(msg) })
+	case protocol.MessageTypeAdminResponse:
+		p.handleAdminResponse(msg)
+	case protocol.MessageTypeListRequest:
+		p.enqueueRequest(msg, protocol.PriorityNormal, "", 0, func() { p.handleListRequest(msg) })
+	case protocol.MessageTypeListResponse:
+		p.handleListResponse(msg)
+	case protocol.MessageTypeSearchRequest:
+		p.enqueueRequest(msg, protocol.PriorityNormal, "", 0, func() { p.handleSearchRequest(msg) })
+	case protocol.MessageTypeSearchResponse:
+		p.handleSearchResponse(msg)
+	case protocol.MessageTypeDirRequest:
+		p.enqueueRequest(msg, protocol.PriorityNormal, "", 0, func() { p.handleDirRequest(msg) })
+	case protocol.MessageTypeDirResponse:
+		p.handleDirResponse(msg)
+	case protocol.MessageTypeDeleteRequest:
+		p.enqueueRequest(msg, protocol.PriorityNormal, "", 0, func() { p.handleDeleteRequest(msg) })
+	case protocol.MessageTypeDeleteResponse:
+		p.handleDeleteResponse(msg)
+	}
+}
+
+// notePeer records that a message was received from the given peer
+func (p *Peer) notePeer(id, addr string) {
+	if id == "" {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	info, ok := p.peers[id]
+	if !ok {
+		info = &PeerInfo{ID: id}
+		p.peers[id] = info
+	}
+	info.Addr = addr
+	info.LastSeen = time.Now()
+}
+
+// ID returns the peer's identifier
+func (p *Peer) ID() string {
+	return p.id
+}
+
+// Addr returns the address the peer's transport is listening on
+func (p *Peer) Addr() string {
+	return p.transport.GetListenAddress()
+}
+
+// SharedDir returns the directory files are served from
+func (p *Peer) SharedDir() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.sharedDir
+}
+
+// ReceivedDir returns the directory received files are saved to
+func (p *Peer) ReceivedDir() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.receivedDir
+}
+
+// SetSharedDir switches the directory files are served from, creating it
+// if needed. Requests already being served keep reading from the old directory
+func (p *Peer) SetSharedDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create shared directory: %v", err)
+	}
+
+	p.mu.Lock()
+	p.sharedDir = dir
+	p.mu.Unlock()
+	select {
+	case p.reindex <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetReceivedDir switches the directory received files are saved to,
+// creating it if needed
+func (p *Peer) SetReceivedDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create received directory: %v", err)
+	}
+
+	p.mu.Lock()
+	p.receivedDir = dir
+	p.mu.Unlock()
+	return nil
+}
+
+// Peers returns a snapshot of the remote peers this node has seen, and
+// those currently advertised on the local network with WithDiscovery,
+// sorted by peer ID
+func (p *Peer) Peers() []PeerInfo {
+	discovered := p.discovered()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	peers := make([]PeerInfo, 0, len(p.peers)+len(discovered))
+	for _, info := range p.peers {
+		peers = append(peers, *info)
+	}
+	for _, e := range discovered {
+		i := slices.IndexFunc(peers, func(info PeerInfo) bool { return info.ID == e.ID })
+		if i < 0 {
+			peers = append(peers, PeerInfo{ID: e.ID})
+			i = len(peers) - 1
+		}
+		// The advertised address is the one to connect to
+		peers[i].Addr = e.Addr
+		peers[i].Discovered = true
+		if e.Seen.After(peers[i].LastSeen) {
+			peers[i].LastSeen = e.Seen
 		}
 	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// History returns a copy of the finished transfer records, oldest first
+func (p *Peer) History() []TransferRecord {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]TransferRecord(nil), p.history...)
+}
+
+// beginTransfer registers a new in-flight transfer
+// Returns ErrClosed if the peer is shutting down and no longer accepts work
+func (p *Peer) beginTransfer(fileName, peer, direction string) (*transfer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closing {
+		return nil, ErrClosed
+	}
+	p.active.Add(1)
+	return p.newTransfer(fileName, peer, direction), nil
+}
+
+// endTransfer marks a transfer started by beginTransfer as finished
+// and appends it to the transfer history
+func (p *Peer) endTransfer(t *transfer, size int64, err error) {
+	p.mu.Lock()
+	p.finishTransfer(t, size, err)
+	p.mu.Unlock()
+
+	t.reportFinished(err)
+	p.active.Done()
+}
+
+// dropTransfer forgets a transfer started by beginTransfer that never got
+// going, without recording it in the history
+func (p *Peer) dropTransfer(t *transfer) {
+	p.mu.Lock()
+	delete(p.transfers, t.id)
+	p.mu.Unlock()
+
+	p.active.Done()
 }
 
 // RequestFile initiates a file transfer request to a peer
+// The transfer stays active until the matching response has been saved
 // peerAddr: Address of the peer to request the file from
 // fileName: Name of the file to request
 // Returns: Error if the request fails to send
 func (p *Peer) RequestFile(peerAddr, fileName string) error {
-	maxRetries := 5
-	retryInterval := time.Second * 2
+	return p.RequestFilePriority(peerAddr, fileName, protocol.PriorityNormal)
+}
+
+// RequestFilePriority is like RequestFile but asks the peer to serve the
+// request ahead of or behind its other requests according to priority
+func (p *Peer) RequestFilePriority(peerAddr, fileName string, priority protocol.Priority) error {
+	return p.RequestFileTo(peerAddr, fileName, "", priority)
+}
+
+// RequestFileTo is like RequestFilePriority but saves the file to output
+// instead of the received directory
+// output: Destination path; an existing directory, or a path ending in a
+// separator, receives the file under its base name. Empty for the default
+func (p *Peer) RequestFileTo(peerAddr, fileName, output string, priority protocol.Priority) error {
+	if p.joinsDownload(wireName(fileName), output, priority) {
+		return nil
+	}
+	_, err := p.requestFile(peerAddr, wireName(fileName), output, nil, priority, false)
+	return err
+}
+
+// RequestFileFrom is like RequestFileTo but fetches the file from several
+// peers at once, each serving different pieces that are verified and
+// written into place as they arrive; see Download. Peers that can only
+// serve whole files are left out unless none can serve pieces
+// The download runs in the background and shows up among the transfers;
+// its outcome is logged
+func (p *Peer) RequestFileFrom(peerAddrs []string, fileName, output string, priority protocol.Priority) error {
+	if len(peerAddrs) == 0 {
+		return errors.New("no peer to request the file from")
+	}
+	if len(peerAddrs) == 1 {
+		return p.RequestFileTo(peerAddrs[0], fileName, output, priority)
+	}
+	go func() {
+		opts := DownloadOptions{Peers: peerAddrs, Priority: priority, Output: output}
+		if _, err := p.Download(context.Background(), fileName, opts); err != nil {
+			logging.Errorf(p.logger, "Download of %s from %s failed: %v", fileName, strings.Join(peerAddrs, ", "), err)
+		}
+	}()
+	return nil
+}
+
+// requestFile performs the work of RequestFileTo
+// sink: Receives the file instead of output, nil to save it; see ReceiveTo
+// wait: Whether the caller waits for the file on the transfer's saved channel
+// Returns: The pending transfer
+func (p *Peer) requestFile(peerAddr, fileName, output string, sink io.Writer, priority protocol.Priority, wait bool) (*transfer, error) {
+	t, err := p.beginTransfer(fileName, peerAddr, "receive")
+	if err != nil {
+		return nil, err
+	}
+	t.output = output
+	t.sink = sink
+	if wait {
+		t.saved = make(chan savedFile, 1)
+	}
+
+	p.mu.Lock()
+	if _, exists := p.pending[fileName]; exists {
+		p.mu.Unlock()
+		p.dropTransfer(t)
+		return nil, fmt.Errorf("request for %s already in progress", fileName)
+	}
+	// Downloads in pieces and streamed requests share the .part file
+	if _, exists := p.downloads[fileName]; exists || p.streaming(fileName) {
+		p.mu.Unlock()
+		p.dropTransfer(t)
+		return nil, fmt.Errorf("a transfer of %s is already in progress", fileName)
+	}
+	p.pending[fileName] = t
+	p.mu.Unlock()
 
 	req := &protocol.FileRequest{
-		FileName: fileName,
+		FileName:     fileName,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		WantMeta:     p.wantsMeta(),
+		Priority:     priority,
+		Stream:       true,
+		Sparse:       sink == nil,
+		HashAlgorithms: p.hashAlgorithms,
+		Compression:    p.compression,
 	}
-	
+	// Resume after what an interrupted stream of the file left behind,
+	// hashed with the algorithm the sender is asked for first
+	if target, err := p.saveTarget(fileName, protocol.NameEncodingUTF8NFC, output); err == nil && sink == nil {
+		t.part = p.partPath(target)
+		t.resumeAlgorithm = checksum.Preferred(req.HashAlgorithms)
+		if t.resumeAt, t.resumeHash = p.partPrefix(t.part, t.resumeAlgorithm); t.resumeHash != nil {
+			req.Offset, req.PrefixHash = t.resumeAt, t.resumeHash.Sum(nil)
+			logging.Infof(p.logger, "Asking %s to resume %s after %d bytes", peerAddr, fileName, t.resumeAt)
+		}
+	}
+
+	if err := p.sendRequest(peerAddr, req); err != nil {
+		p.mu.Lock()
+		delete(p.pending, fileName)
+		p.mu.Unlock()
+		p.endTransfer(t, 0, err)
+		return nil, err
+	}
+	return t, nil
+}
+
+// sendRequest sends a file request message, retrying on connection failures
+func (p *Peer) sendRequest(peerAddr string, req *protocol.FileRequest) error {
+	maxRetries := 5
+	retryInterval := time.Second * 2
+
 	msg := protocol.Message{
 		Type:    protocol.MessageTypeFileRequest,
 		From:    p.id,
@@ -104,7 +722,7 @@ func (p *Peer) RequestFile(peerAddr, fileName string) error {
 			return nil
 		}
 		
-		log.Printf("Connection attempt %d failed: %v. Retrying in %v...", 
+		logging.Warnf(p.logger, "Connection attempt %d failed: %v. Retrying in %v...", 
 			i+1, err, retryInterval)
 		
 		// Wait before retrying
@@ -119,48 +737,86 @@ func (p *Peer) RequestFile(peerAddr, fileName string) error {
 // msg: The file request message containing the file name
 func (p *Peer) handleFileRequest(msg protocol.Message) {
 	req := msg.Payload.(*protocol.FileRequest)
-	log.Printf("Received file request from %s for file: %s", msg.From, req.FileName)
-	
-	filePath := filepath.Join(p.sharedDir, req.FileName)
-	file, err := os.Open(filePath)
-	if err != nil {
-		log.Printf("File not found: %s", req.FileName)
+	logging.Infof(p.logger, "Received file request from %s for file: %s", msg.From, req.FileName)
+
+	if err := p.checkAccess(msg.From, req.FileName, AccessRead); err != nil {
+		logging.Warnf(p.logger, "Rejecting file request for %s: %v", req.FileName, err)
 		return
 	}
-	defer file.Close()
-
-	fileInfo, err := file.Stat()
+	t, err := p.beginTransfer(req.FileName, msg.From, "send")
 	if err != nil {
-		log.Printf("Error reading file stats: %v", err)
+		logging.Warnf(p.logger, "Rejecting file request for %s: %v", req.FileName, err)
 		return
 	}
+	size, err := p.serveFile(msg, req, t)
+	p.endTransfer(t, size, err)
+}
 
-	content := make([]byte, fileInfo.Size())
-	if _, err := file.Read(content); err != nil {
-		log.Printf("Error reading file: %v", err)
-		return
+// serveFile reads the requested file and sends it to the requesting peer
+// Returns: Number of bytes sent and any error encountered
+func (p *Peer) serveFile(msg protocol.Message, req *protocol.FileRequest, t *transfer) (int64, error) {
+	if err := checkNameEncoding(req.FileName, req.NameEncoding); err != nil {
+		logging.Warnf(p.logger, "Rejecting request: %v", err)
+		return 0, err
+	}
+	filePath, err := resolveShared(p.SharedDir(), req.FileName)
+	if err != nil {
+		logging.Warnf(p.logger, "Rejecting request: %v", err)
+		return 0, err
+	}
+	if req.Stream {
+		return p.sendStreamed(msg, req, filePath, t)
+	}
+	content, fileInfo, err := p.readShared(filePath, 0, -1)
+	if errors.Is(err, ErrFileLocked) {
+		logging.Warnf(p.logger, "File %s is in use by another process", req.FileName)
+		return 0, err
+	}
+	if os.IsNotExist(err) {
+		logging.Warnf(p.logger, "File not found: %s", req.FileName)
+		return 0, err
 	}
-	log.Printf("Reading file: %s (size: %d bytes)", req.FileName, fileInfo.Size())
+	if err != nil {
+		logging.Errorf(p.logger, "Error reading file: %v", err)
+		return 0, err
+	}
+	logging.Infof(p.logger, "Reading file: %s (size: %d bytes)", req.FileName, fileInfo.Size())
 
 	resp := &protocol.FileResponse{
-		Name: req.FileName,
-		Size: fileInfo.Size(),
-		Data: content,
+		Name:         req.FileName,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		Size:         fileInfo.Size(),
+		Data:         content,
+	}
+	hasher := checksum.Negotiate(req.HashAlgorithms, p.hashAlgorithms)
+	h := hasher.New()
+	h.Write(content)
+	resp.Hash, resp.HashAlgorithm = h.Sum(nil), hasher.Name()
+	resp.Data, resp.Compression = p.compressData(req.Compression, content)
+	if req.WantMeta {
+		resp.Meta = readMeta(filePath, fileInfo)
 	}
 
 	responseMsg := protocol.Message{
 		Type:     protocol.MessageTypeFileResponse,
 		From:     p.id,
-		FromAddr: p.listenAddr,
+		FromAddr: p.transport.GetListenAddress(),
 		Payload:  resp,
 	}
 	
-	log.Printf("Sending file %s to peer %s", req.FileName, msg.From)
+	if resp.Compression != "" {
+		logging.Infof(p.logger, "Sending file %s to peer %s (%s, %d bytes on the wire)", req.FileName, msg.From, resp.Compression, len(resp.Data))
+	} else {
+		logging.Infof(p.logger, "Sending file %s to peer %s", req.FileName, msg.From)
+	}
+	t.setSize(fileInfo.Size())
 	if err := p.transport.Send(msg.FromAddr, responseMsg); err != nil {
-		log.Printf("Error sending file response: %v", err)
-		return
+		logging.Errorf(p.logger, "Error sending file response: %v", err)
+		return 0, err
 	}
-	log.Printf("Successfully sent file %s to peer %s", req.FileName, msg.From)
+	t.addProgress(fileInfo.Size())
+	logging.Infof(p.logger, "Successfully sent file %s to peer %s", req.FileName, msg.From)
+	return fileInfo.Size(), nil
 }
 
 // handleFileResponse processes incoming file responses
@@ -168,31 +824,315 @@ func (p *Peer) handleFileRequest(msg protocol.Message) {
 // msg: The file response message containing the file data
 func (p *Peer) handleFileResponse(msg protocol.Message) {
 	resp := msg.Payload.(*protocol.FileResponse)
-	filePath := filepath.Join(p.receivedDir, resp.Name)
+	p.mu.Lock()
+	t := p.pending[resp.Name]
+	p.mu.Unlock()
+	// Pending transfers are keyed by name, so a response only completes
+	// one if it comes from the peer the file was requested from or
+	// offered by
+	if t != nil && !p.sentBy(t, msg) {
+		logging.Warnf(p.logger, "Discarding %s sent by %s: expected from %s", resp.Name, msg.From, t.rec.Peer)
+		return
+	}
+	if t != nil {
+		p.mu.Lock()
+		if p.pending[resp.Name] == t {
+			delete(p.pending, resp.Name)
+		} else {
+			t = nil
+		}
+		p.mu.Unlock()
+	}
+	if t != nil {
+		t.setSize(resp.Size)
+	}
 
-	if err := os.WriteFile(filePath, resp.Data, 0644); err != nil {
-		log.Printf("Error saving file: %v", err)
+	// Nothing is decompressed before the file is known to be wanted, and
+	// then only up to what local limits allow
+	var output string
+	if t != nil {
+		output = t.output
+	} else {
+		var err error
+		if output, err = p.admitUnsolicited(msg.From, resp); err != nil {
+			logging.Warnf(p.logger, "Discarding %s sent by %s: %v", resp.Name, msg.From, err)
+			return
+		}
+	}
+	err := decompressResponse(resp, p.responseLimit(t, output))
+	if err == nil {
+		err = p.checkPushedSize(t, max(resp.Size, int64(len(resp.Data))))
+	}
+	if err != nil {
+		logging.Warnf(p.logger, "Discarding %s sent by %s: %v", resp.Name, msg.From, err)
+		if t != nil {
+			p.endTransfer(t, 0, err)
+			t.reportSaved("", err)
+		}
+		return
+	}
+	if t != nil && t.sink != nil {
+		p.deliverResponse(msg, resp, t)
 		return
 	}
+	filePath, err := p.saveTarget(resp.Name, resp.NameEncoding, output)
+	if err == nil && resp.Streamed {
+		if err = p.receiveStreamed(msg, resp, filePath, t); err == nil {
+			return
+		}
+	}
+	if err == nil {
+		if reason, detail := checkResponse(resp); reason != "" {
+			p.quarantineData(resp.Data, QuarantineEntry{Name: resp.Name, Target: filePath, Peer: msg.From, Reason: reason, Detail: detail})
+			if t != nil {
+				err := fmt.Errorf("%s check failed: %s", reason, detail)
+				p.endTransfer(t, int64(len(resp.Data)), err)
+				t.reportSaved("", err)
+			}
+			return
+		}
+	}
+	target := filePath
+	if err == nil {
+		filePath, err = p.resolveConflict(filePath)
+	}
+	if err == nil {
+		err = p.disk.wait(context.Background(), len(resp.Data))
+	}
+	// The file is written to its .part file and checked there, so that
+	// nothing is replaced by a file that doesn't read back as it was sent
+	// or that the filter rejects
+	part := p.partPath(filePath)
+	if err == nil {
+		err = writeFileAtomic(part, resp.Data, p.fileMode(resp.Meta))
+	}
+	if err == nil {
+		if reason, detail := p.verifyWritten(part, resp.HashAlgorithm, resp.Hash); reason != "" {
+			p.rejectFile(part, QuarantineEntry{Name: resp.Name, Target: target, Peer: msg.From, Reason: reason, Detail: detail})
+			err = fmt.Errorf("%s check failed: %s", reason, detail)
+		} else if reject := p.filterReceived(resp.Name, part); reject != nil {
+			p.rejectFile(part, QuarantineEntry{Name: resp.Name, Target: target, Peer: msg.From, Reason: QuarantinePolicy, Detail: reject.Error()})
+			err = fmt.Errorf("rejected by receive filter: %v", reject)
+		} else if err = moveFile(part, filePath); err != nil {
+			os.Remove(part)
+		}
+	}
+	if t != nil {
+		t.addProgress(int64(len(resp.Data)))
+		p.endTransfer(t, int64(len(resp.Data)), err)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Error saving file: %v", err)
+		t.reportSaved("", err)
+		return
+	}
+	p.setReceivedOwner(filePath)
+	if p.preserveMeta && resp.Meta != nil {
+		p.applyMeta(filePath, resp.Meta)
+	}
+
+	logging.Infof(p.logger, "File received and saved: %s", filePath)
+	p.issueReceipts(resp.Name, filePath, receiptSum(resp.HashAlgorithm, resp.Hash), int64(len(resp.Data)), map[string]int64{msg.FromAddr: int64(len(resp.Data))})
+	p.reshareFile(resp.Name, filePath)
+	p.enforceReceivedLimit(filePath)
+	t.reportSaved(filePath, nil)
+}
+
+// checkResponse verifies a whole-file response against the size and hash
+// the sender announced
+// Returns: The quarantine reason and a description, or "" if it passes
+func checkResponse(resp *protocol.FileResponse) (reason, detail string) {
+	if resp.Hash != nil {
+		hasher, err := checksum.Lookup(resp.HashAlgorithm)
+		if err != nil {
+			return QuarantineChecksum, err.Error()
+		}
+		h := hasher.New()
+		h.Write(resp.Data)
+		if sum := h.Sum(nil); !bytes.Equal(sum, resp.Hash) {
+			return QuarantineChecksum, fmt.Sprintf("%s %x, sender announced %x", hasher.Name(), sum, resp.Hash)
+		}
+	}
+	if int64(len(resp.Data)) != resp.Size {
+		return QuarantineIncomplete, fmt.Sprintf("received %d of %d bytes", len(resp.Data), resp.Size)
+	}
+	return "", ""
+}
+
+// verifyWritten reads a received file back from disk and checks it against
+// the hash the sender announced, catching data damaged on its way to disk
+// algorithm: The hash algorithm the sender used, see package checksum
+// sum: The announced hash; nil skips the check, for senders that don't
+// announce one
+// Returns: The quarantine reason and a description, or "" if it passes
+func (p *Peer) verifyWritten(path, algorithm string, sum []byte) (reason, detail string) {
+	if sum == nil {
+		return "", ""
+	}
+	hasher, err := checksum.Lookup(algorithm)
+	if err != nil {
+		return QuarantineChecksum, err.Error()
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return QuarantineChecksum, fmt.Sprintf("reading back: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return QuarantineChecksum, fmt.Sprintf("reading back: %v", err)
+	}
+	h, err := p.hashPrefix(file, info.Size(), hasher)
+	if err != nil {
+		return QuarantineChecksum, fmt.Sprintf("reading back: %v", err)
+	}
+	if got := h.Sum(nil); !bytes.Equal(got, sum) {
+		return QuarantineChecksum, fmt.Sprintf("%s %x on disk, sender announced %x", hasher.Name(), got, sum)
+	}
+	return "", ""
+}
+
+// receivedTarget validates a wire name and returns the path it is saved
+// to in the received directory, before any conflict policy is applied
+// Nested names like "reports/2024/q3.pdf" recreate their directories
+// under the received directory
+func (p *Peer) receivedTarget(name, encoding string) (string, error) {
+	if err := checkNameEncoding(name, encoding); err != nil {
+		return "", err
+	}
+	receivedDir := p.ReceivedDir()
+	path, err := localPath(receivedDir, sanitizeName(name))
+	if err != nil {
+		return "", err
+	}
+	// Directories are only created once a symlink in the received
+	// directory can't have them made elsewhere
+	if err := resolvesInside(receivedDir, filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	if err := p.mkdirReceived(filepath.Dir(path)); err != nil {
+		return "", err
+	}
+	if err := prepareDir(receivedDir, path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
 
-	log.Printf("File received and saved: %s", filePath)
+// CheckReceivedPath reports an error unless path, which need not exist,
+// lies inside the received directory once symlinks are followed; for
+// output paths taken from less trusted callers such as the control API
+func (p *Peer) CheckReceivedPath(path string) error {
+	return resolvesInside(p.ReceivedDir(), path)
 }
 
-// Shutdown gracefully stops the peer and its transport layer
+// saveTarget returns the path a received file is saved to, before any
+// conflict policy is applied: output if set, otherwise its place in the
+// received directory
+func (p *Peer) saveTarget(name, encoding, output string) (string, error) {
+	if output == "" {
+		return p.receivedTarget(name, encoding)
+	}
+	if err := checkNameEncoding(name, encoding); err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(output); (err == nil && info.IsDir()) || os.IsPathSeparator(output[len(output)-1]) {
+		output = filepath.Join(output, path.Base(sanitizeName(name)))
+	}
+	if err := p.mkdirReceived(filepath.Dir(output)); err != nil {
+		return "", err
+	}
+	return output, nil
+}
+
+// Shutdown immediately stops the peer and its transport layer,
+// abandoning any in-flight transfers. Use Close for a graceful stop
 // Returns: Error if shutdown fails
 func (p *Peer) Shutdown() error {
 	return p.transport.Shutdown()
 }
 
+// Close gracefully stops the peer
+// New requests are rejected with ErrClosed, active transfers are given
+// until the context is done to complete, the peer state is persisted and
+// finally the transport is shut down
+// ctx: Bounds how long to wait for in-flight transfers
+// Returns: The context error if transfers were still active at the deadline,
+// or any error from persisting state or shutting down the transport
+func (p *Peer) Close(ctx context.Context) error {
+	p.startMu.Lock()
+	p.mu.Lock()
+	if p.closing {
+		p.mu.Unlock()
+		p.startMu.Unlock()
+		return ErrClosed
+	}
+	p.closing = true
+	started := p.started
+	p.mu.Unlock()
+	p.startMu.Unlock()
+	close(p.stop)
+
+	done := make(chan struct{})
+	go func() {
+		p.active.Wait()
+		close(done)
+	}()
+
+	var waitErr error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		waitErr = fmt.Errorf("transfers still active at shutdown: %v", ctx.Err())
+	}
+
+	p.endUploads()
+	if p.cache != nil {
+		s := p.cache.stats()
+		logging.Infof(p.logger, "Read cache: %d hits, %d misses (%.0f%% hit ratio), %d bytes in %d entries",
+			s.Hits, s.Misses, 100*s.HitRatio(), s.Bytes, s.Entries)
+	}
+
+	if err := p.saveState(); err != nil {
+		logging.Errorf(p.logger, "Error persisting peer state: %v", err)
+		if waitErr == nil {
+			waitErr = err
+		}
+	}
+	p.mu.Lock()
+	svc := p.discovery
+	p.mu.Unlock()
+	if svc != nil {
+		svc.Close()
+	}
+	if started && len(p.trackers) > 0 {
+		p.leaveTrackers()
+	}
+	// The index is only loaded once the peer starts
+	if started {
+		if err := p.saveIndex(); err != nil {
+			logging.Errorf(p.logger, "Error persisting index: %v", err)
+		}
+	}
+
+	if err := p.transport.Shutdown(); err != nil {
+		return err
+	}
+	return waitErr
+}
+
 // SendFile initiates sending a file to a requesting peer
 func (p *Peer) SendFile(fileName string) error {
-	filePath := filepath.Join(p.sharedDir, fileName)
+	filePath, err := localPath(p.SharedDir(), fileName)
+	if err != nil {
+		return err
+	}
 	
 	// Verify file exists
 	if _, err := os.Stat(filePath); err != nil {
 		return fmt.Errorf("file %s not found: %v", fileName, err)
 	}
 	
-	log.Printf("Ready to send file %s to any requesting peer", fileName)
+	logging.Infof(p.logger, "Ready to send file %s to any requesting peer", fileName)
 	return nil
 }
\ No newline at end of file
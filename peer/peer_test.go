@@ -0,0 +1,43 @@
+package peer
+
+import (
+	"context"
+	"io"
+	"log"
+	"path/filepath"
+	"testing"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// TestStartClose races Start against Close: whichever wins, the address
+// must be free again once both return
+func TestStartClose(t *testing.T) {
+	network := transport.NewMemoryNetwork()
+	dir := t.TempDir()
+	for i := 0; i < 50; i++ {
+		tr := network.NewTransport("mem:peer")
+		p, err := New("peer1", tr.GetListenAddress(), filepath.Join(dir, "shared"), filepath.Join(dir, "received"),
+			tr, WithLogger(log.New(io.Discard, "", 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		started := make(chan error, 1)
+		go func() { started <- p.Start() }()
+		if err := p.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-started; err != nil && err != ErrClosed {
+			t.Fatal(err)
+		}
+		if err := p.Start(); err != ErrClosed {
+			t.Fatalf("Start after Close: got %v, want ErrClosed", err)
+		}
+
+		probe := network.NewTransport("mem:peer")
+		if err := probe.StartListening(); err != nil {
+			t.Fatalf("round %d: address still taken after Close: %v", i, err)
+		}
+		probe.Shutdown()
+	}
+}
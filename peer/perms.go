@@ -0,0 +1,135 @@
+package peer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// PermissionMode decides the mode bits of received files and of the
+// directories created for them
+type PermissionMode int
+
+const (
+	// PermFixed applies the configured file and directory modes as they are
+	PermFixed PermissionMode = iota
+	// PermUmask applies the configured modes minus the process umask, like
+	// files created by other programs
+	PermUmask
+	// PermSender applies the mode the sender's file has, when it is sent
+	// along with the file; otherwise the configured mode as with PermFixed
+	PermSender
+)
+
+// ParsePermissionMode parses "fixed", "umask" or "sender"
+func ParsePermissionMode(s string) (PermissionMode, error) {
+	switch s {
+	case "fixed":
+		return PermFixed, nil
+	case "umask":
+		return PermUmask, nil
+	case "sender":
+		return PermSender, nil
+	}
+	return 0, fmt.Errorf("unknown permission mode %q", s)
+}
+
+// String returns the name accepted by ParsePermissionMode
+func (m PermissionMode) String() string {
+	switch m {
+	case PermUmask:
+		return "umask"
+	case PermSender:
+		return "sender"
+	}
+	return "fixed"
+}
+
+// Permissions holds the rules for the mode and owner of received files
+type Permissions struct {
+	Mode     PermissionMode
+	FileMode os.FileMode // Mode of received files, 0644 if zero
+	DirMode  os.FileMode // Mode of directories created for them, 0755 if zero
+	SetOwner bool        // Give received files and directories to UID and GID; only applied when running as root
+	UID, GID int
+}
+
+// WithPermissions sets the mode and owner of received files and of the
+// directories created for them; by default files get 0644 and
+// directories 0755
+func WithPermissions(rules Permissions) Option {
+	return func(p *Peer) {
+		if rules.FileMode == 0 {
+			rules.FileMode = 0644
+		}
+		if rules.DirMode == 0 {
+			rules.DirMode = 0755
+		}
+		if rules.Mode == PermUmask {
+			umask := processUmask()
+			rules.FileMode &^= umask
+			rules.DirMode &^= umask
+		}
+		p.perms = rules
+	}
+}
+
+// fileMode returns the mode for a received file
+// meta: Metadata the sender sent along with the file, may be nil
+func (p *Peer) fileMode(meta *protocol.FileMeta) os.FileMode {
+	if (p.perms.Mode == PermSender || p.preserveMeta) && meta != nil && meta.Mode != 0 {
+		return os.FileMode(meta.Mode).Perm()
+	}
+	return p.perms.FileMode
+}
+
+// wantsMeta reports whether file requests should ask for the sender's metadata
+func (p *Peer) wantsMeta() bool {
+	return p.preserveMeta || p.perms.Mode == PermSender
+}
+
+// setReceivedPerms applies the permission rules to a saved file
+func (p *Peer) setReceivedPerms(path string, meta *protocol.FileMeta) {
+	if err := os.Chmod(path, p.fileMode(meta)); err != nil {
+		logging.Warnf(p.logger, "Could not set the mode of %s: %v", path, err)
+	}
+	p.setReceivedOwner(path)
+}
+
+// setReceivedOwner gives a received file or directory to the configured owner
+func (p *Peer) setReceivedOwner(path string) {
+	if !p.perms.SetOwner || !isPrivileged() {
+		return
+	}
+	if err := os.Lchown(path, p.perms.UID, p.perms.GID); err != nil {
+		logging.Warnf(p.logger, "Could not set the owner of %s: %v", path, err)
+	}
+}
+
+// mkdirReceived creates dir and any missing parents for received files,
+// applying the directory mode and owner to the ones it creates
+func (p *Peer) mkdirReceived(dir string) error {
+	var created []string
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil {
+			break
+		}
+		created = append(created, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	if err := os.MkdirAll(dir, p.perms.DirMode); err != nil {
+		return err
+	}
+	for _, d := range created {
+		if err := os.Chmod(d, p.perms.DirMode); err != nil {
+			logging.Warnf(p.logger, "Could not set the mode of %s: %v", d, err)
+		}
+		p.setReceivedOwner(d)
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package peer
+
+import (
+	"context"
+	"runtime/debug"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// modulePath is the path of the module the peer package belongs to
+const modulePath = "joeyyy09/P2P-FileTransfer-Go"
+
+// PingResult is what a peer answered a Ping with
+type PingResult struct {
+	ID       string        // ID of the peer that answered
+	Version  string        // Software version it reported, empty if it predates reporting one
+	Features []string      // Features it serves, see protocol.Features
+	RTT      time.Duration // Time from sending the ping to receiving the answer
+}
+
+// Ping sends a hello to the peer at addr and times its answer, connecting
+// first if there is no connection yet, e.g. to check that the peer is
+// reachable before transferring files
+// Unlike the hellos sent to learn a peer's features, a ping doesn't tell
+// the peer where to reach this one, so it doesn't take a pinging tool for
+// a peer to contact later
+func (p *Peer) Ping(ctx context.Context, addr string) (PingResult, error) {
+	id := p.nextCallID()
+	start := time.Now()
+	msg, err := p.call(ctx, addr, protocol.MessageTypeHello, id, &protocol.Hello{ID: id, Features: p.Features()})
+	if err != nil {
+		return PingResult{}, err
+	}
+	resp := msg.Payload.(*protocol.HelloResponse)
+	return PingResult{ID: msg.From, Version: resp.Version, Features: resp.Features, RTT: time.Since(start)}, nil
+}
+
+// Version returns the software version the peer reports to others: the
+// version of this module the program was built with and the Go release
+func Version() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	version := ""
+	if info.Main.Path == modulePath {
+		version = info.Main.Version
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == modulePath {
+			version = dep.Version
+		}
+	}
+	if version == "" {
+		version = "(devel)"
+	}
+	return version + " " + info.GoVersion
+}
@@ -0,0 +1,191 @@
+package peer
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// maxKeyAlerts caps the number of key change alerts kept
+const maxKeyAlerts = 100
+
+// KnownKey is the identity key pinned for a remote peer the first time it
+// connected
+type KnownKey struct {
+	ID        string    `json:"id"`              // Peer ID the key was announced with
+	Key       string    `json:"key"`             // See EncodePublicKey
+	Addrs     []string  `json:"addrs,omitempty"` // Addresses the peer was dialed at with this key
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// KeyAlert records a connection refused because a peer presented a key
+// other than the one pinned for it
+type KeyAlert struct {
+	Time      time.Time `json:"time"`
+	PeerID    string    `json:"peer_id"`   // ID of the peer the key is pinned for
+	Addr      string    `json:"addr"`      // Where the connection came from or went to
+	Pinned    string    `json:"pinned"`    // Key on record
+	Presented string    `json:"presented"` // Key the connection proved
+}
+
+// identityTransport is implemented by transports that can prove the peer's
+// identity key on their connections, such as transport.TCPTransport
+type identityTransport interface {
+	SetIdentity(id string, key ed25519.PrivateKey, verify transport.KeyVerifier)
+}
+
+// WithKeyPrompt asks confirm before trusting the key of a peer seen for the
+// first time; a false answer refuses the connection
+// Without a prompt, first keys are trusted and pinned silently
+func WithKeyPrompt(confirm func(transport.PeerIdentity) bool) Option {
+	return func(p *Peer) {
+		p.keyPrompt = confirm
+	}
+}
+
+// setupIdentity has the transport prove the peer's identity key on every
+// connection and check remote keys against the pinned ones
+// Peers without an identity key, or on transports that can't prove one,
+// skip the check
+func (p *Peer) setupIdentity() {
+	t, ok := p.transport.(identityTransport)
+	if !ok || p.key == nil {
+		return
+	}
+	t.SetIdentity(p.id, p.key, p.verifyPeerKey)
+}
+
+// verifyPeerKey pins the key of a peer seen for the first time (trust on
+// first use) and refuses connections from peers whose key has changed
+// Peers with a key-derived ID must hold the key the ID came from, see KeyID
+func (p *Peer) verifyPeerKey(remote transport.PeerIdentity) error {
+	if IsKeyID(remote.ID) && remote.ID != KeyID(remote.Key) {
+		logging.Warnf(p.logger, "Peer at %s announced ID %s, which doesn't belong to its key", remote.Addr, remote.ID)
+		return fmt.Errorf("peer ID %s does not match the key presented", remote.ID)
+	}
+	key := EncodePublicKey(remote.Key)
+	addr, _ := transport.SplitPathAddr(remote.Addr)
+
+	p.mu.Lock()
+	rec, known := p.keys[remote.ID]
+	if known && rec.Key != key {
+		p.mu.Unlock()
+		return p.keyChanged(remote.ID, remote.Addr, rec.Key, key)
+	}
+	if remote.Dialed {
+		for _, other := range p.keys {
+			if other.Key != key && slices.Contains(other.Addrs, addr) {
+				p.mu.Unlock()
+				return p.keyChanged(other.ID, remote.Addr, other.Key, key)
+			}
+		}
+	}
+	if known {
+		rec.LastSeen = time.Now()
+		if remote.Dialed && !slices.Contains(rec.Addrs, addr) {
+			rec.Addrs = append(rec.Addrs, addr)
+		}
+		p.mu.Unlock()
+		return nil
+	}
+	p.mu.Unlock()
+
+	if p.keyPrompt != nil && !p.keyPrompt(remote) {
+		return fmt.Errorf("key of peer %s at %s was not trusted", remote.ID, remote.Addr)
+	}
+
+	now := time.Now()
+	rec = &KnownKey{ID: remote.ID, Key: key, FirstSeen: now, LastSeen: now}
+	if remote.Dialed {
+		rec.Addrs = []string{addr}
+	}
+	p.mu.Lock()
+	if other, ok := p.keys[remote.ID]; ok && other.Key != key {
+		// Another connection pinned a different key while we asked
+		p.mu.Unlock()
+		return p.keyChanged(remote.ID, remote.Addr, other.Key, key)
+	}
+	p.keys[remote.ID] = rec
+	p.mu.Unlock()
+
+	logging.Infof(p.logger, "Pinned key %s for new peer %s at %s", key, remote.ID, remote.Addr)
+	if err := p.saveState(); err != nil {
+		logging.Errorf(p.logger, "Failed to save pinned key: %v", err)
+	}
+	return nil
+}
+
+// keyChanged raises an alert for a peer presenting a key other than the
+// pinned one
+// Returns: The error refusing the connection
+func (p *Peer) keyChanged(id, addr, pinned, presented string) error {
+	alert := KeyAlert{Time: time.Now(), PeerID: id, Addr: addr, Pinned: pinned, Presented: presented}
+	p.mu.Lock()
+	p.keyAlerts = append(p.keyAlerts, alert)
+	if len(p.keyAlerts) > maxKeyAlerts {
+		p.keyAlerts = p.keyAlerts[len(p.keyAlerts)-maxKeyAlerts:]
+	}
+	p.mu.Unlock()
+
+	banner := strings.Repeat("@", 60)
+	logging.Warnf(p.logger, "%s", banner)
+	logging.Warnf(p.logger, "WARNING: KEY OF PEER %s HAS CHANGED, CONNECTION REFUSED", id)
+	logging.Warnf(p.logger, "Connection: %s", addr)
+	logging.Warnf(p.logger, "Pinned key:    %s", pinned)
+	logging.Warnf(p.logger, "Presented key: %s", presented)
+	logging.Warnf(p.logger, "Someone may be impersonating the peer. If the peer's key was")
+	logging.Warnf(p.logger, "replaced on purpose, forget the old one with: keys -forget %s", id)
+	logging.Warnf(p.logger, "%s", banner)
+	return fmt.Errorf("key of peer %s has changed", id)
+}
+
+// KnownKeys returns the pinned peer keys, sorted by peer ID
+func (p *Peer) KnownKeys() []KnownKey {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	list := make([]KnownKey, 0, len(p.keys))
+	for _, rec := range p.keys {
+		k := *rec
+		k.Addrs = append([]string(nil), rec.Addrs...)
+		list = append(list, k)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// KeyAlerts returns the key changes detected, oldest first
+func (p *Peer) KeyAlerts() []KeyAlert {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]KeyAlert(nil), p.keyAlerts...)
+}
+
+// ForgetKey removes the pinned key of a peer, and the alerts about it, so
+// the next key it presents is trusted on first use again
+// Returns: Whether a key was pinned for the peer
+func (p *Peer) ForgetKey(id string) (bool, error) {
+	p.mu.Lock()
+	_, ok := p.keys[id]
+	delete(p.keys, id)
+	alerts := p.keyAlerts[:0]
+	for _, a := range p.keyAlerts {
+		if a.PeerID != id {
+			alerts = append(alerts, a)
+		}
+	}
+	p.keyAlerts = alerts
+	p.mu.Unlock()
+
+	if !ok {
+		return false, nil
+	}
+	return true, p.saveState()
+}
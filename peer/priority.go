@@ -0,0 +1,352 @@
+package peer
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	defaultServeWorkers = 4    // Requests from other peers served concurrently
+	maxActivePieces     = 32   // Piece requests outstanding across all downloads
+	maxQueuedPerPeer    = 256  // Requests from one peer the serve queue holds
+	maxQueued           = 4096 // Requests from all peers the serve queue holds
+)
+
+// ErrBusy refuses a request from another peer while the serve queue holds
+// as many as it takes from that peer, or from all of them
+var ErrBusy = errors.New("peer busy, try again later")
+
+// transferPriority is the priority of a download, changeable while it runs
+type transferPriority struct {
+	v int32
+}
+
+func newTransferPriority(pr protocol.Priority) *transferPriority {
+	return &transferPriority{v: int32(pr)}
+}
+
+func (t *transferPriority) get() protocol.Priority {
+	return protocol.Priority(atomic.LoadInt32(&t.v))
+}
+
+func (t *transferPriority) set(pr protocol.Priority) {
+	atomic.StoreInt32(&t.v, int32(pr))
+}
+
+// WithUploadWeight gives the transfers of a remote peer, by peer ID, a
+// larger or smaller share of upload bandwidth than the default weight of 1
+// when several recipients compete at the same priority
+func WithUploadWeight(peerID string, weight float64) Option {
+	return func(p *Peer) {
+		p.uploadWeights[peerID] = weight
+	}
+}
+
+// WithServeWorkers sets how many requests from other peers are served at
+// once, default 4; further requests wait in the serve queue, so the
+// message loop keeps reading while every worker is busy, until the queue
+// is full and refuses them with ErrBusy
+func WithServeWorkers(n int) Option {
+	return func(p *Peer) {
+		p.serveWorkers = n
+	}
+}
+
+// enqueueRequest queues a request from another peer for the serve workers
+// A request the queue has no room for is refused, see refuseRequest
+// name: File the request is for; cost: bytes it is expected to send
+// Returns: ErrBusy if the request was refused
+func (p *Peer) enqueueRequest(msg protocol.Message, pr protocol.Priority, name string, cost int64, handle func()) error {
+	weight, ok := p.uploadWeights[msg.From]
+	if !ok {
+		weight = 1
+	}
+	queued := time.Now()
+	err := p.queue.push(pr, msg.From, msg.From+"\x00"+name, weight, cost, func() {
+		defer p.recoverHandler(msg)
+		start := time.Now()
+		p.metrics.queueWait.Observe(start.Sub(queued))
+		handle()
+		p.metrics.serveTime.Since(start)
+		p.metrics.requestsServed.Inc()
+	})
+	if err != nil {
+		p.refuseRequest(msg, err)
+	}
+	return err
+}
+
+// refuseRequest answers a request from another peer that won't be served
+// with err, for the requests whose responses can carry an error; other
+// requests are dropped, and time out at the requester
+func (p *Peer) refuseRequest(msg protocol.Message, err error) {
+	var msgType uint8
+	var resp interface{}
+	switch req := msg.Payload.(type) {
+	case *protocol.ChunkRequest:
+		msgType, resp = protocol.MessageTypeChunkData, &protocol.ChunkData{ID: req.ID, Index: req.Index, Offset: req.Offset, Error: err.Error()}
+	case *protocol.HaveBitmap:
+		msgType, resp = protocol.MessageTypeChunkData, &protocol.ChunkData{ID: req.ID, Index: -1, Error: err.Error()}
+	case *protocol.ManifestRequest:
+		msgType, resp = protocol.MessageTypeManifestResponse, &protocol.ManifestResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.AppendRequest:
+		msgType, resp = protocol.MessageTypeAppendData, &protocol.AppendData{ID: req.ID, Error: err.Error()}
+	case *protocol.RecipeRequest:
+		msgType, resp = protocol.MessageTypeRecipeResponse, &protocol.RecipeResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.BlockRequest:
+		msgType, resp = protocol.MessageTypeBlockResponse, &protocol.BlockResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.AdminRequest:
+		msgType, resp = protocol.MessageTypeAdminResponse, &protocol.AdminResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.ListRequest:
+		msgType, resp = protocol.MessageTypeListResponse, &protocol.ListResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.SearchRequest:
+		msgType, resp = protocol.MessageTypeSearchResponse, &protocol.SearchResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.DirRequest:
+		msgType, resp = protocol.MessageTypeDirResponse, &protocol.DirResponse{ID: req.ID, Error: err.Error()}
+	case *protocol.DeleteRequest:
+		msgType, resp = protocol.MessageTypeDeleteResponse, &protocol.DeleteResponse{ID: req.ID, Error: err.Error()}
+	default:
+		logging.Warnf(p.logger, "Dropping request from %s: %v", msg.From, err)
+		return
+	}
+	logging.Warnf(p.logger, "Refusing request from %s: %v", msg.From, err)
+	if err := p.reply(msg, msgType, resp); err != nil {
+		logging.Errorf(p.logger, "Error refusing request: %v", err)
+	}
+}
+
+// SetPriority changes the priority of a running download; the remaining
+// pieces are requested, and served by the remote peers, at the new priority
+// Returns: An error if no download of the named file is in progress
+func (p *Peer) SetPriority(name string, pr protocol.Priority) error {
+	name = wireName(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tp, ok := p.downloads[name]
+	if !ok {
+		return fmt.Errorf("no download of %s in progress", name)
+	}
+	tp.set(pr)
+	p.slots.wakeAll()
+	return nil
+}
+
+// serveItem is a queued request from another peer
+type serveItem struct {
+	peer     string // Peer the request came from
+	priority protocol.Priority
+	tag      float64 // Virtual start time within the request's priority level
+	seq      uint64  // Arrival order, to break ties
+	handle   func()
+}
+
+// serveHeap orders queued requests by priority, then virtual start time
+type serveHeap []serveItem
+
+func (h serveHeap) Len() int { return len(h) }
+func (h serveHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	if h[i].tag != h[j].tag {
+		return h[i].tag < h[j].tag
+	}
+	return h[i].seq < h[j].seq
+}
+func (h serveHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *serveHeap) Push(x interface{}) { *h = append(*h, x.(serveItem)) }
+func (h *serveHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// maxIdleFlows bounds how many finished flows the serve queue remembers
+const maxIdleFlows = 1024
+
+// serveQueue holds file and chunk requests from other peers until a serve
+// worker is free. Higher priorities always go first; within a priority,
+// upload bandwidth is shared between transfers by start-time fair queueing,
+// a weighted round-robin over bytes: each request is tagged with the point
+// in virtual time its transfer has earned service, advancing by the
+// request's size divided by the transfer's weight, so a recipient asking
+// for many pieces at once can't starve one asking for a few
+type serveQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  serveHeap
+	seq    uint64
+	vtime  float64            // Tag of the request served last
+	flows  map[string]float64 // Virtual finish time of each transfer's last queued request
+	peers  map[string]int     // Requests queued from each peer
+	closed bool
+}
+
+func newServeQueue() *serveQueue {
+	q := &serveQueue{flows: make(map[string]float64), peers: make(map[string]int)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push queues a request handler
+// peer: Peer the request came from; flow: transfer the request belongs to;
+// weight: its share relative to other transfers; cost: bytes the request is
+// expected to send
+// Returns: ErrBusy if the queue holds maxQueuedPerPeer requests from peer
+// or maxQueued in all, ErrClosed once closed
+func (q *serveQueue) push(pr protocol.Priority, peer, flow string, weight float64, cost int64, handle func()) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+	if q.peers[peer] >= maxQueuedPerPeer || len(q.items) >= maxQueued {
+		return ErrBusy
+	}
+	if weight <= 0 {
+		weight = 1
+	}
+	tag := q.vtime
+	if finish, ok := q.flows[flow]; ok && finish > tag {
+		tag = finish
+	}
+	q.flows[flow] = tag + float64(cost)/weight
+
+	q.seq++
+	heap.Push(&q.items, serveItem{peer: peer, priority: pr, tag: tag, seq: q.seq, handle: handle})
+	q.peers[peer]++
+	q.cond.Signal()
+	return nil
+}
+
+// pop waits for the next request to serve
+// Returns: false once the queue is closed and drained
+func (q *serveQueue) pop() (func(), bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	item := heap.Pop(&q.items).(serveItem)
+	if q.peers[item.peer]--; q.peers[item.peer] == 0 {
+		delete(q.peers, item.peer)
+	}
+	if item.tag > q.vtime {
+		q.vtime = item.tag
+	}
+	if len(q.flows) > maxIdleFlows {
+		for flow, finish := range q.flows {
+			if finish <= q.vtime {
+				delete(q.flows, flow)
+			}
+		}
+	}
+	return item.handle, true
+}
+
+// len returns the number of requests waiting for a serve worker
+func (q *serveQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// close stops accepting requests; queued ones are still handed out
+func (q *serveQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// serveLoop runs queued requests until the queue is closed
+func (p *Peer) serveLoop() {
+	for {
+		handle, ok := p.queue.pop()
+		if !ok {
+			return
+		}
+		handle()
+	}
+}
+
+// prioritySlots limits the piece requests outstanding across all downloads
+// A free slot goes to the highest-priority waiter, so low-priority downloads
+// only proceed while nothing more important is waiting
+type prioritySlots struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	inUse   int
+	waiting map[protocol.Priority]int
+}
+
+func newPrioritySlots(limit int) *prioritySlots {
+	s := &prioritySlots{limit: limit, waiting: make(map[protocol.Priority]int)}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// acquire waits for a slot; the priority is re-read on every wake-up so a
+// changed priority takes effect for waiters too
+func (s *prioritySlots) acquire(ctx context.Context, tp *transferPriority) error {
+	stop := context.AfterFunc(ctx, s.wakeAll)
+	defer stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		pr := tp.get()
+		if s.inUse < s.limit && !s.higherWaiting(pr) {
+			s.inUse++
+			return nil
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		s.waiting[pr]++
+		s.cond.Wait()
+		s.waiting[pr]--
+	}
+}
+
+// release frees a slot taken by acquire
+func (s *prioritySlots) release() {
+	s.mu.Lock()
+	s.inUse--
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// wakeAll makes waiters re-check their priority and the context
+func (s *prioritySlots) wakeAll() {
+	s.mu.Lock()
+	s.mu.Unlock()
+	s.cond.Broadcast()
+}
+
+// higherWaiting reports whether anyone above pr is waiting; caller must hold s.mu
+func (s *prioritySlots) higherWaiting(pr protocol.Priority) bool {
+	for other, n := range s.waiting {
+		if other > pr && n > 0 {
+			return true
+		}
+	}
+	return false
+}
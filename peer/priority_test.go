@@ -0,0 +1,64 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+func TestServeQueueBounded(t *testing.T) {
+	q := newServeQueue()
+	push := func(peer string) error {
+		return q.push(protocol.PriorityNormal, peer, peer+"\x00a.bin", 1, 1, func() {})
+	}
+
+	for i := 0; i < maxQueuedPerPeer; i++ {
+		if err := push("flooder"); err != nil {
+			t.Fatalf("request %d refused: %v", i, err)
+		}
+	}
+	if err := push("flooder"); !errors.Is(err, ErrBusy) {
+		t.Fatalf("request past the per-peer cap: %v, want ErrBusy", err)
+	}
+	if _, ok := q.pop(); !ok {
+		t.Fatal("pop failed")
+	}
+	if err := push("flooder"); err != nil {
+		t.Fatalf("refused after a request was served: %v", err)
+	}
+	if err := push("other"); err != nil {
+		t.Fatalf("another peer refused while one is at its cap: %v", err)
+	}
+
+	for i := 0; q.len() < maxQueued; i++ {
+		if err := push(fmt.Sprintf("peer%d", i)); err != nil {
+			t.Fatalf("refused at %d of %d queued: %v", q.len(), maxQueued, err)
+		}
+	}
+	if err := push("latecomer"); !errors.Is(err, ErrBusy) {
+		t.Fatalf("request past the total cap: %v, want ErrBusy", err)
+	}
+
+	q.close()
+	if err := push("latecomer"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("request after close: %v, want ErrClosed", err)
+	}
+}
+
+func TestEnqueueRequestRefused(t *testing.T) {
+	p := newTestPeer(t)
+	msg := protocol.Message{Type: protocol.MessageTypeChunkRequest, From: "flooder", Payload: &protocol.ChunkRequest{FileName: "a.bin"}}
+	for i := 0; i < maxQueuedPerPeer; i++ {
+		if err := p.enqueueRequest(msg, protocol.PriorityNormal, "a.bin", 1, func() {}); err != nil {
+			t.Fatalf("request %d refused: %v", i, err)
+		}
+	}
+	if err := p.enqueueRequest(msg, protocol.PriorityNormal, "a.bin", 1, func() {}); !errors.Is(err, ErrBusy) {
+		t.Fatalf("request past the cap: %v, want ErrBusy", err)
+	}
+	if got := p.queue.len(); got != maxQueuedPerPeer {
+		t.Fatalf("%d requests queued, want %d", got, maxQueuedPerPeer)
+	}
+}
@@ -0,0 +1,212 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// sendPieces sends the pieces of an accepted push that the receiver
+// doesn't hold, one at a time through the request queue, followed by the
+// end marker
+// Returns: The number of bytes sent
+func (p *Peer) sendPieces(ctx context.Context, msg protocol.Message, reply *protocol.PushReply, m *protocol.Manifest, path string, t *transfer) (int64, error) {
+	missing := reply.Have.Missing(m.NumPieces())
+	if held := m.NumPieces() - len(missing); held > 0 {
+		logging.Infof(p.logger, "Resuming push of %s: %s already holds %d of %d pieces", m.Name, msg.From, held, m.NumPieces())
+	}
+
+	var sent int64
+	for _, index := range missing {
+		offset, length := m.PieceRange(index)
+		done := make(chan error, 1)
+		err := p.enqueueRequest(msg, protocol.PriorityNormal, m.Name, length, func() {
+			data, _, err := p.readShared(path, offset, length)
+			if err == nil && int64(len(data)) != length {
+				err = fmt.Errorf("file shrank while reading piece %d", index)
+			}
+			if err == nil {
+				piece := &protocol.ChunkData{ID: reply.StreamID, Index: index, Offset: offset}
+				piece.Data, piece.Compression = p.compressData(reply.Compression, data)
+				err = p.reply(msg, protocol.MessageTypeChunkData, piece)
+			}
+			done <- err
+		})
+
+		if err == nil {
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+		if err != nil {
+			p.reply(msg, protocol.MessageTypeChunkData, &protocol.ChunkData{ID: reply.StreamID, Index: -1, Error: err.Error()})
+			return sent, err
+		}
+		sent += length
+		t.addProgress(length)
+	}
+	return sent, p.reply(msg, protocol.MessageTypeChunkData, &protocol.ChunkData{ID: reply.StreamID, Index: -1})
+}
+
+// acceptPieces accepts an offer to be sent in pieces, resuming from the
+// ".part" file an interrupted push of the same file left behind
+func (p *Peer) acceptPieces(msg protocol.Message, req *protocol.PushOffer, output string) error {
+	m := req.Manifest
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	if m.Name != req.FileName || m.Size != req.Size {
+		return errors.New("manifest doesn't match the offer")
+	}
+	target, err := p.saveTarget(req.FileName, req.NameEncoding, output)
+	if err != nil {
+		return err
+	}
+	t, err := p.beginTransfer(req.FileName, msg.From, "receive")
+	if err != nil {
+		return err
+	}
+
+	// Pushes and downloads of a file share its .part file
+	p.mu.Lock()
+	_, exists := p.downloads[m.Name]
+	exists = exists || p.pending[m.Name] != nil
+	if !exists {
+		p.downloads[m.Name] = newTransferPriority(protocol.PriorityNormal)
+	}
+	p.mu.Unlock()
+	if exists {
+		p.dropTransfer(t)
+		return fmt.Errorf("a transfer of %s is already in progress", m.Name)
+	}
+	file, have, err := p.openPart(context.Background(), target, m)
+	if err != nil {
+		p.mu.Lock()
+		delete(p.downloads, m.Name)
+		p.mu.Unlock()
+		p.dropTransfer(t)
+		return err
+	}
+	if n := have.Count(m.NumPieces()); n > 0 {
+		logging.Infof(p.logger, "Resuming push of %s from %s with %d of %d pieces already present", m.Name, msg.From, n, m.NumPieces())
+	}
+	pushed := m.Size
+	for i := 0; i < m.NumPieces(); i++ {
+		if have.Has(i) {
+			_, length := m.PieceRange(i)
+			pushed -= length
+		}
+	}
+
+	t.setSize(m.Size)
+	d := newDownloader(m, file, have, p.logger)
+	d.disk = p.disk
+	d.progress = t
+	d.metrics = p.metrics
+	id := p.nextCallID()
+	stream := &pushStream{from: msg.From, pieces: make(chan *protocol.ChunkData, pushBuffer), end: make(chan string, 1)}
+	p.mu.Lock()
+	p.pushes[id] = stream
+	p.mu.Unlock()
+
+	logging.Infof(p.logger, "Accepted %s (%d bytes) pushed by %s", req.FileName, req.Size, msg.From)
+	go func() {
+		defer p.recoverHandler(msg)
+		resp := &protocol.PushReply{ID: req.ID, Accepted: true, StreamID: id, Have: have, Compression: p.compression}
+		err := p.reply(msg, protocol.MessageTypePushReply, resp)
+		if err == nil {
+			err = p.receivePieces(msg, d, stream, req)
+		}
+		p.mu.Lock()
+		delete(p.pushes, id)
+		delete(p.downloads, m.Name)
+		p.mu.Unlock()
+		if err != nil {
+			p.keepPart(target, file, m, d.written())
+		}
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+
+		var final string
+		if err == nil {
+			final, err = p.finishPart(m.Name, target, msg.From)
+		}
+		p.endTransfer(t, m.Size, err)
+		if err != nil {
+			// As with downloads, the verified pieces stay for the sender
+			// to resume from by pushing the file again
+			logging.Errorf(p.logger, "Push of %s from %s failed: %v", m.Name, msg.From, err)
+			return
+		}
+		logging.Infof(p.logger, "File received and saved: %s", final)
+		p.issueReceipts(m.Name, final, nil, m.Size, map[string]int64{msg.FromAddr: pushed})
+		p.reshareFile(m.Name, final)
+		p.enforceReceivedLimit(final)
+	}()
+	return nil
+}
+
+// receivePieces writes the pieces of a push as they arrive, until the
+// offer's deadline if it has one
+// Returns: nil once every piece is written, or why the push stopped short
+func (p *Peer) receivePieces(msg protocol.Message, d *downloader, stream *pushStream, req *protocol.PushOffer) error {
+	s := &activeSource{src: &peerSource{p: p, addr: msg.FromAddr}}
+	write := func(data *protocol.ChunkData, elapsed time.Duration) {
+		if err := d.writePushed(context.Background(), s, data, elapsed); err != nil {
+			logging.Warnf(p.logger, "Piece %d of %s from %s failed: %v", data.Index, d.m.Name, msg.From, err)
+		}
+	}
+
+	timer := time.NewTimer(pieceTimeout)
+	defer timer.Stop()
+	var expired <-chan time.Time
+	if deadline, ok := offerDeadline(req); ok {
+		expiry := time.NewTimer(time.Until(deadline))
+		defer expiry.Stop()
+		expired = expiry.C
+	}
+	start := time.Now()
+	for {
+		d.mu.Lock()
+		remaining := d.remaining
+		d.mu.Unlock()
+		if remaining == 0 {
+			return nil
+		}
+
+		select {
+		case <-p.stop:
+			return ErrClosed
+		case <-timer.C:
+			return fmt.Errorf("stalled with %d pieces missing", remaining)
+		case <-expired:
+			return fmt.Errorf("offer expired with %d pieces missing", remaining)
+		case reason := <-stream.end:
+			// Pieces sent before the end marker may still be buffered
+			for len(stream.pieces) > 0 {
+				write(<-stream.pieces, time.Since(start))
+			}
+			d.mu.Lock()
+			remaining = d.remaining
+			d.mu.Unlock()
+			if reason != "" {
+				return errors.New(reason)
+			}
+			if remaining > 0 {
+				return fmt.Errorf("sender finished with %d pieces missing", remaining)
+			}
+			return nil
+		case data := <-stream.pieces:
+			write(data, time.Since(start))
+			start = time.Now()
+			timer.Reset(pieceTimeout)
+		}
+	}
+}
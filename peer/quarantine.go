@@ -0,0 +1,254 @@
+package peer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// quarantineSuffix names the metadata sidecar written next to every
+// quarantined file
+const quarantineSuffix = ".quarantine.json"
+
+// Reasons a received file is quarantined
+const (
+	QuarantineChecksum   = "checksum"   // Content doesn't match the hash the sender announced
+	QuarantineIncomplete = "incomplete" // Fewer bytes arrived than the sender announced
+	QuarantinePolicy     = "policy"     // Rejected by the receive filter; see WithReceiveFilter
+)
+
+// QuarantineEntry describes a quarantined file; it is stored as JSON in a
+// sidecar next to the file
+type QuarantineEntry struct {
+	File   string    `json:"file"`   // Name of the file in the quarantine directory
+	Name   string    `json:"name"`   // Wire name the file was received as
+	Target string    `json:"target"` // Where it would have been saved
+	Peer   string    `json:"peer"`   // ID or address of the sender
+	Size   int64     `json:"size"`
+	Reason string    `json:"reason"` // One of the Quarantine* reasons
+	Detail string    `json:"detail"` // Description of the failed check
+	Time   time.Time `json:"time"`
+}
+
+// WithQuarantine keeps received files that fail a check in dir instead of
+// discarding them, each with a sidecar describing the failure, so they can
+// be inspected and released by hand; see Quarantined and ReleaseQuarantined
+func WithQuarantine(dir string) Option {
+	return func(p *Peer) {
+		p.quarantineDir = dir
+	}
+}
+
+// WithReceiveFilter checks every completely received file before it is
+// saved, e.g. against allowed file types
+// accept: Called with the wire name and the path of the received data;
+// an error rejects the file, which is quarantined or discarded
+func WithReceiveFilter(accept func(name, path string) error) Option {
+	return func(p *Peer) {
+		p.receiveFilter = accept
+	}
+}
+
+// filterReceived applies the receive filter to a file received as name
+// Returns: Why the file is rejected, nil if it is accepted
+func (p *Peer) filterReceived(name, path string) error {
+	if p.receiveFilter == nil {
+		return nil
+	}
+	return p.receiveFilter(name, path)
+}
+
+// rejectFile moves a received file that failed a check into quarantine,
+// or removes it when there is no quarantine directory
+func (p *Peer) rejectFile(path string, e QuarantineEntry) {
+	logging.Errorf(p.logger, "Received file %s from %s failed the %s check: %s", e.Name, e.Peer, e.Reason, e.Detail)
+	if p.quarantineDir == "" {
+		os.Remove(path)
+		return
+	}
+
+	dst, err := p.quarantinePath(e.Name)
+	if err == nil {
+		if err = retryLocked(func() error { return os.Rename(path, dst) }); err != nil {
+			// The quarantine directory may be on another filesystem
+			if err = copyFileAtomic(path, dst); err == nil {
+				os.Remove(path)
+			}
+		}
+	}
+	if err == nil {
+		os.Chmod(dst, 0600)
+		err = p.writeQuarantineEntry(dst, e)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Failed to quarantine %s, discarding it: %v", e.Name, err)
+		os.Remove(path)
+		return
+	}
+	logging.Warnf(p.logger, "Quarantined %s as %s", e.Name, dst)
+}
+
+// quarantineData stores received data that failed a check in quarantine;
+// without a quarantine directory the data is dropped
+func (p *Peer) quarantineData(data []byte, e QuarantineEntry) {
+	logging.Errorf(p.logger, "Received file %s from %s failed the %s check: %s", e.Name, e.Peer, e.Reason, e.Detail)
+	if p.quarantineDir == "" {
+		return
+	}
+
+	dst, err := p.quarantinePath(e.Name)
+	if err == nil {
+		err = writeFileAtomic(dst, data, 0600)
+	}
+	if err == nil {
+		err = p.writeQuarantineEntry(dst, e)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Failed to quarantine %s, discarding it: %v", e.Name, err)
+		return
+	}
+	logging.Warnf(p.logger, "Quarantined %s as %s", e.Name, dst)
+}
+
+// quarantinePath picks an unused path in the quarantine directory for a
+// file received as name; quarantined files are never executable or nested
+func (p *Peer) quarantinePath(name string) (string, error) {
+	if err := os.MkdirAll(p.quarantineDir, 0700); err != nil {
+		return "", err
+	}
+	base := time.Now().Format("20060102-150405") + "-" + path.Base(sanitizeName(name))
+	for i := 0; ; i++ {
+		candidate := filepath.Join(p.quarantineDir, base)
+		if i > 0 {
+			candidate = filepath.Join(p.quarantineDir, fmt.Sprintf("%s.%d", base, i))
+		}
+		if _, err := os.Lstat(candidate); os.IsNotExist(err) {
+			return candidate, nil
+		}
+	}
+}
+
+// writeQuarantineEntry writes the sidecar of the quarantined file at path
+func (p *Peer) writeQuarantineEntry(path string, e QuarantineEntry) error {
+	e.File = filepath.Base(path)
+	e.Time = time.Now()
+	if info, err := os.Stat(path); err == nil {
+		e.Size = info.Size()
+	}
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path+quarantineSuffix, data, 0600)
+}
+
+// Quarantined lists the files in the quarantine directory, oldest first
+func (p *Peer) Quarantined() ([]QuarantineEntry, error) {
+	if p.quarantineDir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(p.quarantineDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var list []QuarantineEntry
+	for _, de := range entries {
+		if !strings.HasSuffix(de.Name(), quarantineSuffix) {
+			continue
+		}
+		e, err := p.quarantineEntry(strings.TrimSuffix(de.Name(), quarantineSuffix))
+		if err != nil {
+			logging.Warnf(p.logger, "Skipping quarantine entry %s: %v", de.Name(), err)
+			continue
+		}
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.Before(list[j].Time) })
+	return list, nil
+}
+
+// quarantineEntry reads the sidecar of a quarantined file
+func (p *Peer) quarantineEntry(file string) (QuarantineEntry, error) {
+	var e QuarantineEntry
+	if p.quarantineDir == "" {
+		return e, errors.New("no quarantine directory configured")
+	}
+	if file == "" || file != filepath.Base(file) {
+		return e, fmt.Errorf("invalid quarantined file name %q", file)
+	}
+	data, err := os.ReadFile(filepath.Join(p.quarantineDir, file+quarantineSuffix))
+	if os.IsNotExist(err) {
+		return e, fmt.Errorf("%s is not in quarantine", file)
+	}
+	if err != nil {
+		return e, err
+	}
+	if err := json.Unmarshal(data, &e); err != nil {
+		return e, fmt.Errorf("invalid sidecar: %v", err)
+	}
+	e.File = file
+	return e, nil
+}
+
+// ReleaseQuarantined moves a quarantined file to where it would have been
+// saved, or to dst if set, applying the conflict policy
+// file: Name of the file in the quarantine directory, see QuarantineEntry.File
+// Returns: The path the file was released to
+func (p *Peer) ReleaseQuarantined(file, dst string) (string, error) {
+	e, err := p.quarantineEntry(file)
+	if err != nil {
+		return "", err
+	}
+	if dst == "" {
+		dst = e.Target
+	}
+	if dst == "" {
+		if dst, err = p.receivedTarget(e.Name, protocol.NameEncodingUTF8NFC); err != nil {
+			return "", err
+		}
+	}
+	if err := p.mkdirReceived(filepath.Dir(dst)); err != nil {
+		return "", err
+	}
+	final, err := p.resolveConflict(dst)
+	if err != nil {
+		return "", err
+	}
+
+	src := filepath.Join(p.quarantineDir, file)
+	if err := retryLocked(func() error { return os.Rename(src, final) }); err != nil {
+		if err := copyFileAtomic(src, final); err != nil {
+			return "", err
+		}
+		os.Remove(src)
+	}
+	p.setReceivedPerms(final, nil)
+	os.Remove(src + quarantineSuffix)
+	logging.Infof(p.logger, "Released %s from quarantine to %s", file, final)
+	return final, nil
+}
+
+// DeleteQuarantined removes a quarantined file and its sidecar
+func (p *Peer) DeleteQuarantined(file string) error {
+	if _, err := p.quarantineEntry(file); err != nil {
+		return err
+	}
+	src := filepath.Join(p.quarantineDir, file)
+	if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(src + quarantineSuffix)
+}
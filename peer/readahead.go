@@ -0,0 +1,81 @@
+package peer
+
+import (
+	"os"
+	"sync"
+)
+
+// readAheadStreams is the number of concurrent sequential readers the
+// read-ahead buffer is sized for
+const readAheadStreams = 8
+
+// WithReadAhead makes the peer read the next depth pieces of a file from
+// disk while the current piece is on the wire, so a downloader requesting
+// pieces in order doesn't wait for the disk on each of them
+func WithReadAhead(depth int) Option {
+	return func(p *Peer) {
+		if depth > 0 {
+			p.readAhead = &readAhead{
+				depth:   depth,
+				buf:     newReadCache(int64(depth) * defaultPieceSize * readAheadStreams),
+				loading: make(map[cacheKey]bool),
+			}
+		}
+	}
+}
+
+// readAhead holds pieces read from disk before they were requested
+// Prefetched pieces are handed out once and then forgotten; keeping hot
+// data around is the job of the read cache
+type readAhead struct {
+	depth int
+	buf   *readCache
+
+	mu      sync.Mutex
+	loading map[cacheKey]bool // Ranges being read in the background
+}
+
+// prefetchAfter starts reading the pieces following the given range of a
+// shared file in the background, skipping those already buffered or cached
+// info: The file's current info, used to stop at the end of the file
+func (p *Peer) prefetchAfter(path string, info os.FileInfo, offset, length int64) {
+	ra := p.readAhead
+	if ra == nil || length <= 0 {
+		return
+	}
+
+	var keys []cacheKey
+	ra.mu.Lock()
+	for i := 1; i <= ra.depth; i++ {
+		off := offset + int64(i)*length
+		if off >= info.Size() {
+			break
+		}
+		n := length
+		if off+n > info.Size() {
+			n = info.Size() - off
+		}
+		key := cacheKey{path: path, offset: off, length: n}
+		if ra.loading[key] || ra.buf.contains(key, info) || (p.cache != nil && p.cache.contains(key, info)) {
+			continue
+		}
+		ra.loading[key] = true
+		keys = append(keys, key)
+	}
+	ra.mu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	go func() {
+		for _, key := range keys {
+			data, info, err := p.readRange(key.path, key.offset, key.length)
+			if err == nil {
+				ra.buf.put(key, info, data)
+			}
+			ra.mu.Lock()
+			delete(ra.loading, key)
+			ra.mu.Unlock()
+		}
+	}()
+}
@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+const (
+	maxReceipts    = 1000             // Receipts kept in the persisted state; the oldest are dropped
+	receiptTimeout = 10 * time.Second // Time allowed for delivering the receipts of one file
+)
+
+// Receipts returns the receipts receivers signed for files this peer sent,
+// oldest first
+func (p *Peer) Receipts() []protocol.Receipt {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	out := make([]protocol.Receipt, len(p.receipts))
+	for i, r := range p.receipts {
+		out[i] = *r
+	}
+	return out
+}
+
+// issueReceipts signs a receipt for a verified file and sends it to each
+// peer it came from, in the background
+// Receipts need an identity key, see WithIdentityKey, and are only sent to
+// peers that take them
+// sum: SHA-256 of the file, or nil to compute it from path
+// delivered: Bytes of the file each peer delivered, by address
+func (p *Peer) issueReceipts(name, path string, sum []byte, size int64, delivered map[string]int64) {
+	if p.key == nil || p.disabled[protocol.FeatureReceipts] || len(delivered) == 0 {
+		return
+	}
+	go func() {
+		if sum == nil {
+			var err error
+			if sum, err = p.fileSum(path); err != nil {
+				logging.Warnf(p.logger, "Not sending receipts for %s: %v", name, err)
+				return
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), receiptTimeout)
+		defer cancel()
+		for addr, n := range delivered {
+			if err := p.sendReceipt(ctx, addr, name, sum, size, n); err != nil {
+				logging.Errorf(p.logger, "Could not send receipt for %s to %s: %v", name, addr, err)
+			}
+		}
+	}()
+}
+
+// receiptSum returns the hash a transfer was checked with for its
+// receipts, which name files by SHA-256, or nil to have it computed if the
+// transfer was checked with another algorithm
+func receiptSum(algorithm string, sum []byte) []byte {
+	if algorithm != "" && algorithm != checksum.SHA256 {
+		return nil
+	}
+	return sum
+}
+
+// sendReceipt signs and sends the receipt for a file to the peer at addr
+// Peers that don't take receipts are skipped
+func (p *Peer) sendReceipt(ctx context.Context, addr, name string, sum []byte, size, n int64) error {
+	// The hello tells the sender's ID for the receipt along with its features
+	id := p.nextCallID()
+	msg, err := p.call(ctx, addr, protocol.MessageTypeHello, id, &protocol.Hello{ID: id, Features: p.Features()})
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(msg.Payload.(*protocol.HelloResponse).Features, protocol.FeatureReceipts) {
+		return nil
+	}
+
+	r := &protocol.Receipt{
+		File:     name,
+		Hash:     sum,
+		Size:     size,
+		Bytes:    n,
+		Sender:   msg.From,
+		Receiver: p.id,
+		Time:     time.Now().UTC(),
+	}
+	if err := r.Sign(p.key); err != nil {
+		return err
+	}
+	return p.transport.Send(addr, protocol.Message{Type: protocol.MessageTypeReceipt, From: p.id, Payload: r})
+}
+
+// handleReceipt keeps a receipt for a file this peer sent, once its
+// signature checks out against the key pinned for the receiver
+func (p *Peer) handleReceipt(msg protocol.Message) {
+	r := msg.Payload.(*protocol.Receipt)
+	if err := p.checkReceipt(msg.From, r); err != nil {
+		logging.Warnf(p.logger, "Discarding receipt for %s from %s: %v", r.File, msg.From, err)
+		return
+	}
+
+	p.mu.Lock()
+	p.receipts = append(p.receipts, r)
+	if len(p.receipts) > maxReceipts {
+		p.receipts = p.receipts[len(p.receipts)-maxReceipts:]
+	}
+	p.mu.Unlock()
+	logging.Infof(p.logger, "Peer %s signed a receipt for %s (%d of %d bytes)", r.Receiver, r.File, r.Bytes, r.Size)
+	if err := p.saveState(); err != nil {
+		logging.Errorf(p.logger, "Failed to save receipt: %v", err)
+	}
+}
+
+// checkReceipt verifies that a receipt names this peer as the sender and
+// is signed by the peer that sent it
+func (p *Peer) checkReceipt(from string, r *protocol.Receipt) error {
+	if err := p.checkFeature(protocol.FeatureReceipts); err != nil {
+		return err
+	}
+	if r.Sender != p.id {
+		return fmt.Errorf("receipt names sender %q", r.Sender)
+	}
+	if r.Receiver != from {
+		return fmt.Errorf("receipt names receiver %q", r.Receiver)
+	}
+	p.mu.Lock()
+	rec, ok := p.keys[from]
+	p.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no key pinned for peer %s", from)
+	}
+	key, err := ParsePublicKey(rec.Key)
+	if err != nil {
+		return err
+	}
+	return r.Verify(key)
+}
+
+// fileSum returns the SHA-256 of the file at path
+func (p *Peer) fileSum(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	h, err := p.hashPrefix(file, info.Size(), checksum.Default)
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// sourceBytes totals the bytes each peer source delivered, by the
+// peer's address; paths and stripes to the same peer are added up
+func sourceBytes(sources []*activeSource) map[string]int64 {
+	delivered := make(map[string]int64)
+	for _, s := range sources {
+		if s.delivered > 0 && !s.src.webSeed() {
+			remote, _ := transport.SplitPathAddr(s.src.id())
+			delivered[remote] += s.delivered
+		}
+	}
+	return delivered
+}
@@ -0,0 +1,61 @@
+package peer
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// HandlerPanic describes a panic recovered while handling a message
+type HandlerPanic struct {
+	Peer  string // ID of the peer that sent the message
+	Addr  string // Address of the connection it arrived on, which is closed
+	Type  uint8  // Message type
+	Value string // Value passed to panic
+	Stack string
+	Time  time.Time
+}
+
+// connCloser is implemented by transports that can close a single
+// connection, such as the TCP transport
+type connCloser interface {
+	CloseConn(addr string) bool
+}
+
+// WithPanicHook calls hook after a panic in a message handler has been
+// recovered, e.g. to report it; the peer keeps running either way
+func WithPanicHook(hook func(HandlerPanic)) Option {
+	return func(p *Peer) {
+		p.panicHook = hook
+	}
+}
+
+// recoverHandler contains a panic in the handling of msg: it is logged and
+// counted, and only the connection the message arrived on is closed
+// Must be deferred directly by the goroutine running the handler
+func (p *Peer) recoverHandler(msg protocol.Message) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	event := HandlerPanic{
+		Peer:  msg.From,
+		Addr:  msg.FromAddr,
+		Type:  msg.Type,
+		Value: fmt.Sprint(r),
+		Stack: string(debug.Stack()),
+		Time:  time.Now(),
+	}
+	logging.Errorf(p.logger, "Panic handling message type %#x from %s at %s, closing the connection: %s\n%s", event.Type, event.Peer, event.Addr, event.Value, event.Stack)
+	p.metrics.panics.Inc()
+	if c, ok := p.transport.(connCloser); ok && msg.FromAddr != "" {
+		c.CloseConn(msg.FromAddr)
+	}
+	if p.panicHook != nil {
+		p.panicHook(event)
+	}
+}
@@ -0,0 +1,261 @@
+package peer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	maxAppendChunk           = 4 << 20         // Largest AppendData payload
+	defaultReplicateInterval = 2 * time.Second // Default time between polls once caught up
+)
+
+// ReplicateOptions configures the replication of an append-only file
+type ReplicateOptions struct {
+	Interval time.Duration // Time between polls once caught up, default 2s
+	Output   string        // Where to keep the copy instead of the received directory; see Peer.RequestFileTo
+}
+
+// prefixState caches how far a shared file has been hashed, so answering
+// append requests only hashes the bytes added since the last one
+type prefixState struct {
+	info   os.FileInfo // Identifies the file the state belongs to
+	offset int64
+	state  []byte // Marshaled SHA-256 state after offset bytes
+}
+
+// Replicate keeps a local copy of an append-only file shared by the peer
+// at addr, such as a log, until ctx is done. Each poll fetches only the
+// bytes past the end of the copy, after the sender has confirmed by hash
+// that the copy is still a prefix of its file; if the file was truncated
+// or rewritten the copy is started over
+// Returns: ctx.Err() once ctx is done, or the error that stopped replication
+func (p *Peer) Replicate(ctx context.Context, addr, name string, opts ReplicateOptions) error {
+	name = wireName(name)
+	if opts.Interval <= 0 {
+		opts.Interval = defaultReplicateInterval
+	}
+	path, err := p.saveTarget(name, protocol.NameEncodingUTF8NFC, opts.Output)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, p.fileMode(nil))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	p.setReceivedPerms(path, nil)
+
+	// Resume from an existing copy
+	h := sha256.New()
+	offset, err := io.Copy(h, file)
+	if err != nil {
+		return err
+	}
+	logging.Infof(p.logger, "Replicating %s from %s into %s, starting at byte %d", name, addr, path, offset)
+
+	for {
+		behind, err := p.pullAppend(ctx, addr, name, file, h, &offset)
+		if err != nil && ctx.Err() == nil {
+			logging.Warnf(p.logger, "Replicating %s from %s: %v", name, addr, err)
+		}
+		if behind && err == nil {
+			continue
+		}
+
+		select {
+		case <-time.After(opts.Interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-p.stop:
+			return ErrClosed
+		}
+	}
+}
+
+// pullAppend makes one append request and applies the response to file
+// Returns: Whether the sender has more data beyond what was received
+func (p *Peer) pullAppend(ctx context.Context, addr, name string, file *os.File, h hash.Hash, offset *int64) (bool, error) {
+	tail, err := tailHash(file, *offset)
+	if err != nil {
+		return false, err
+	}
+	id := p.nextCallID()
+	req := &protocol.AppendRequest{
+		ID:           id,
+		FileName:     name,
+		NameEncoding: protocol.NameEncodingUTF8NFC,
+		Offset:       *offset,
+		PrefixHash:   h.Sum(nil),
+		TailHash:     tail,
+	}
+
+	callCtx, cancel := context.WithTimeout(ctx, pieceTimeout)
+	msg, err := p.call(callCtx, addr, protocol.MessageTypeAppendRequest, id, req)
+	cancel()
+	if err != nil {
+		return false, err
+	}
+	resp := msg.Payload.(*protocol.AppendData)
+	if resp.Error != "" {
+		return false, errors.New(resp.Error)
+	}
+
+	if resp.Mismatch {
+		logging.Infof(p.logger, "%s on %s was truncated or rewritten, replicating it again from the start", name, addr)
+		if err := file.Truncate(0); err != nil {
+			return false, err
+		}
+		h.Reset()
+		*offset = 0
+		return true, nil
+	}
+
+	if len(resp.Data) > 0 {
+		if err := p.disk.wait(ctx, len(resp.Data)); err != nil {
+			return false, err
+		}
+		if _, err := file.WriteAt(resp.Data, *offset); err != nil {
+			return false, err
+		}
+		h.Write(resp.Data)
+		*offset += int64(len(resp.Data))
+		p.metrics.bytesReceived.Add(uint64(len(resp.Data)))
+	}
+	return *offset < resp.Size, nil
+}
+
+// tailHash hashes the last protocol.AppendTailWindow bytes before end
+func tailHash(file io.ReaderAt, end int64) ([]byte, error) {
+	start := max(end-protocol.AppendTailWindow, 0)
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, start, end-start)); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// handleAppendRequest serves the new suffix of an append-only shared file
+func (p *Peer) handleAppendRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.AppendRequest)
+	resp := &protocol.AppendData{ID: req.ID}
+
+	err := p.checkAccess(msg.From, req.FileName, AccessRead)
+	if err == nil {
+		err = p.readAppend(req, resp)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Append request for %s from %s failed: %v", req.FileName, msg.From, err)
+		resp.Error = err.Error()
+	}
+	if err := p.reply(msg, protocol.MessageTypeAppendData, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending appended data: %v", err)
+		return
+	}
+	p.metrics.bytesSent.Add(uint64(len(resp.Data)))
+}
+
+// handleAppendData delivers appended data to the waiting Replicate
+func (p *Peer) handleAppendData(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.AppendData).ID, msg)
+}
+
+// readAppend checks that the requester's copy is a prefix of the shared
+// file and fills resp with the bytes that follow it
+func (p *Peer) readAppend(req *protocol.AppendRequest, resp *protocol.AppendData) error {
+	if err := p.checkFeature(protocol.FeatureAppend); err != nil {
+		return err
+	}
+	if req.Offset < 0 {
+		return fmt.Errorf("invalid offset %d", req.Offset)
+	}
+	if err := checkNameEncoding(req.FileName, req.NameEncoding); err != nil {
+		return err
+	}
+	path, err := resolveShared(p.SharedDir(), req.FileName)
+	if err != nil {
+		return err
+	}
+	file, err := openShared(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	resp.Size = info.Size()
+
+	if req.Offset > info.Size() {
+		resp.Mismatch = true
+		return nil
+	}
+	tail, err := tailHash(file, req.Offset)
+	if err != nil {
+		return err
+	}
+	prefix, err := p.prefixHash(path, file, info, req.Offset)
+	if err != nil {
+		return err
+	}
+	if string(tail) != string(req.TailHash) || string(prefix) != string(req.PrefixHash) {
+		resp.Mismatch = true
+		return nil
+	}
+
+	n := min(info.Size()-req.Offset, maxAppendChunk)
+	if n == 0 {
+		return nil
+	}
+	if err := p.disk.wait(context.Background(), int(n)); err != nil {
+		return err
+	}
+	resp.Data = make([]byte, n)
+	read, err := file.ReadAt(resp.Data, req.Offset)
+	resp.Data = resp.Data[:read]
+	if err == io.EOF {
+		err = nil
+	}
+	return err
+}
+
+// prefixHash returns the SHA-256 of the first n bytes of a shared file
+// Hashing resumes from the state cached for the file, which is kept as
+// long as the file isn't replaced and hasn't shrunk below it; rewrites
+// behind the cached state are caught by the tail hash instead
+func (p *Peer) prefixHash(path string, file *os.File, info os.FileInfo, n int64) ([]byte, error) {
+	h := sha256.New()
+	var from int64
+
+	p.mu.Lock()
+	c := p.prefixes[path]
+	p.mu.Unlock()
+	if c != nil && os.SameFile(c.info, info) && c.offset <= n {
+		if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(c.state); err == nil {
+			from = c.offset
+		} else {
+			h.Reset()
+		}
+	}
+
+	if _, err := io.Copy(h, io.NewSectionReader(file, from, n-from)); err != nil {
+		return nil, err
+	}
+	if state, err := h.(encoding.BinaryMarshaler).MarshalBinary(); err == nil {
+		p.mu.Lock()
+		p.prefixes[path] = &prefixState{info: info, offset: n, state: state}
+		p.mu.Unlock()
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,90 @@
+package peer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// WithReshare makes the peer serve the files it receives: each one is
+// hard-linked into the shared directory under the name it was requested by,
+// or copied where a link isn't possible, so content spreads through
+// intermediate peers. Existing files in the shared directory are never
+// replaced
+func WithReshare() Option {
+	return func(p *Peer) {
+		p.reshare = true
+	}
+}
+
+// reshareFile publishes a verified received file in the shared directory
+// name: Wire name the file was received as; path: Where it was saved
+func (p *Peer) reshareFile(name, path string) {
+	if !p.reshare {
+		return
+	}
+
+	sharedDir := p.SharedDir()
+	target, err := localPath(sharedDir, sanitizeName(name))
+	if err == nil {
+		err = prepareDir(sharedDir, target)
+	}
+	if err != nil {
+		logging.Warnf(p.logger, "Not re-sharing %s: %v", name, err)
+		return
+	}
+
+	if existing, err := os.Stat(target); err == nil {
+		if saved, err := os.Stat(path); err == nil && os.SameFile(existing, saved) {
+			return
+		}
+		logging.Infof(p.logger, "Not re-sharing %s: the shared directory already has a file by that name", name)
+		return
+	}
+
+	if err := os.Link(path, target); err != nil {
+		if err := copyFileAtomic(path, target); err != nil {
+			logging.Errorf(p.logger, "Error re-sharing %s: %v", name, err)
+			return
+		}
+	}
+	logging.Infof(p.logger, "Re-sharing %s", name)
+}
+
+// copyFileAtomic copies src to dst through a temporary file, so dst never
+// appears partially written
+func copyFileAtomic(src, dst string) error {
+	in, err := openShared(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	_, err = io.Copy(tmp, in)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, info.Mode().Perm())
+	}
+	if err == nil {
+		err = retryLocked(func() error { return os.Rename(tmpName, dst) })
+	}
+	if err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	return nil
+}
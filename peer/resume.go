@@ -0,0 +1,153 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// haveSuffix is appended to a ".part" file's name for the sidecar listing
+// the pieces it holds
+const haveSuffix = ".have"
+
+// partHave is the sidecar an interrupted download leaves next to its
+// ".part" file, so the next attempt knows which pieces it holds without
+// verifying every one of them again
+type partHave struct {
+	Manifest []byte          `json:"manifest"` // Digest of the manifest the pieces belong to, see protocol.Manifest.ContentHash
+	Have     protocol.Bitmap `json:"have"`
+}
+
+// openPart opens the ".part" file of target for receiving m in pieces
+// Pieces an interrupted transfer left behind are kept; they are taken from
+// its sidecar when it matches m, and verified against m otherwise
+// Returns: The file and the pieces it already holds
+func (p *Peer) openPart(ctx context.Context, target string, m *protocol.Manifest) (*os.File, protocol.Bitmap, error) {
+	part := p.partPath(target)
+	file, err := os.OpenFile(part, os.O_CREATE|os.O_RDWR, p.fileMode(nil))
+	if err != nil {
+		return nil, nil, err
+	}
+	// The sidecar only describes the file as it was left; it is written
+	// again if this attempt stops short too
+	have := loadHave(part, file, m)
+	os.Remove(part + haveSuffix)
+	if have == nil {
+		if have, err = p.scanPart(ctx, file, m); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+	}
+	return file, have, nil
+}
+
+// loadHave reads the sidecar of part
+// Returns: The pieces it lists, or nil if there is none or it is for
+// another manifest
+func loadHave(part string, file *os.File, m *protocol.Manifest) protocol.Bitmap {
+	data, err := os.ReadFile(part + haveSuffix)
+	if err != nil {
+		return nil
+	}
+	var saved partHave
+	if json.Unmarshal(data, &saved) != nil || !bytes.Equal(saved.Manifest, m.ContentHash()) {
+		return nil
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	if info.Size() > m.Size {
+		if err := file.Truncate(m.Size); err != nil {
+			return nil
+		}
+	}
+
+	// Pieces past the end of the file can't be there, whatever it says
+	have := protocol.NewBitmap(m.NumPieces())
+	for i := 0; i < m.NumPieces(); i++ {
+		offset, length := m.PieceRange(i)
+		if saved.Have.Has(i) && offset+length <= info.Size() {
+			have.Set(i)
+		}
+	}
+	return have
+}
+
+// keepPart records the pieces an interrupted transfer of m wrote to file,
+// the ".part" file of target, for the next attempt to resume from
+// Caller closes file afterwards
+func (p *Peer) keepPart(target string, file *os.File, m *protocol.Manifest, have protocol.Bitmap) {
+	if have.Count(m.NumPieces()) == 0 {
+		return
+	}
+	// The pieces must be on disk before the sidecar vouches for them
+	err := file.Sync()
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(partHave{Manifest: m.ContentHash(), Have: have})
+	}
+	if err == nil {
+		err = writeFileAtomic(p.partPath(target)+haveSuffix, data, 0644)
+	}
+	if err != nil {
+		logging.Warnf(p.logger, "Could not record the pieces of %s: %v", p.partPath(target), err)
+	}
+}
+
+// partPrefix hashes the ".part" file an interrupted stream left behind, for
+// the sender to resume after it
+// algorithm: The hash algorithm to use, see package checksum
+// Returns: Its size and the hash of its content, or 0 and nil if there is
+// nothing to resume
+func (p *Peer) partPrefix(part, algorithm string) (int64, hash.Hash) {
+	hasher, err := checksum.Lookup(algorithm)
+	if err != nil {
+		return 0, nil
+	}
+	file, err := os.Open(part)
+	if err != nil {
+		return 0, nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return 0, nil
+	}
+	h, err := p.hashPrefix(file, info.Size(), hasher)
+	if err != nil {
+		logging.Warnf(p.logger, "Could not resume from %s: %v", part, err)
+		return 0, nil
+	}
+	return info.Size(), h
+}
+
+// hashPrefix hashes the first n bytes of file with hasher, leaving the
+// file positioned after them
+func (p *Peer) hashPrefix(file *os.File, n int64, hasher checksum.Hasher) (hash.Hash, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	h := hasher.New()
+	buf := make([]byte, fileDataSize)
+	for done := int64(0); done < n; {
+		chunk := buf[:min(int64(len(buf)), n-done)]
+		if err := p.disk.wait(context.Background(), len(chunk)); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(file, chunk); err != nil {
+			return nil, fmt.Errorf("reading the first %d bytes: %v", n, err)
+		}
+		h.Write(chunk)
+		done += int64(len(chunk))
+	}
+	return h, nil
+}
@@ -0,0 +1,69 @@
+package peer
+
+import (
+	"context"
+	"sync/atomic"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// nextCallID returns a fresh ID for correlating a request with its response
+func (p *Peer) nextCallID() uint64 {
+	return atomic.AddUint64(&p.callSeq, 1)
+}
+
+// call sends a request to addr and waits for the response carrying the same ID
+// The request payload must embed id so the remote can echo it back
+// Returns: The response message, or an error if sending fails or ctx expires
+func (p *Peer) call(ctx context.Context, addr string, msgType uint8, id uint64, payload interface{}) (protocol.Message, error) {
+	ch := make(chan protocol.Message, 1)
+	p.mu.Lock()
+	p.calls[id] = ch
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		delete(p.calls, id)
+		p.mu.Unlock()
+	}()
+
+	msg := protocol.Message{
+		Type:    msgType,
+		From:    p.id,
+		Payload: payload,
+	}
+	if err := p.transport.Send(addr, msg); err != nil {
+		return protocol.Message{}, err
+	}
+
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-ctx.Done():
+		return protocol.Message{}, ctx.Err()
+	}
+}
+
+// completeCall hands a response to the call waiting for it
+// Responses nobody is waiting for any more (e.g. after a timeout) are dropped
+func (p *Peer) completeCall(id uint64, msg protocol.Message) {
+	p.mu.Lock()
+	ch, ok := p.calls[id]
+	p.mu.Unlock()
+
+	if ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// reply sends a response payload back to the sender of msg
+func (p *Peer) reply(msg protocol.Message, msgType uint8, payload interface{}) error {
+	resp := protocol.Message{
+		Type:    msgType,
+		From:    p.id,
+		Payload: payload,
+	}
+	return p.transport.Send(msg.FromAddr, resp)
+}
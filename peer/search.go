@@ -0,0 +1,127 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// maxSearchResults caps the files a peer returns for one search
+const maxSearchResults = 1000
+
+// SearchResult is a file found by Search on another peer
+type SearchResult struct {
+	protocol.ListEntry
+	Peer string // ID of the peer holding the file
+	Addr string // Address the peer was reached at
+}
+
+// Search asks every known peer for the shared files matching pattern and
+// collects the matches, sorted by name and then peer
+// pattern: A path.Match glob if it contains any of "*?[", matched against
+// the base name unless it contains a "/"; otherwise a case-insensitive
+// substring of the name
+// Peers that can't be reached or don't search are left out
+// Returns: An error if the pattern is invalid or there is no peer to ask
+func (p *Peer) Search(ctx context.Context, pattern string) ([]SearchResult, error) {
+	if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+		return nil, fmt.Errorf("invalid search pattern %q", pattern)
+	}
+	var addrs []string
+	for _, info := range p.Peers() {
+		if addr := info.DialAddr(); addr != "" && !slices.Contains(addrs, addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New("no known peers to search")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	addrs, _ = p.splitByFeature(ctx, addrs, protocol.FeatureSearch)
+
+	var mu sync.Mutex
+	var results []SearchResult
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := p.nextCallID()
+			msg, err := p.call(ctx, addr, protocol.MessageTypeSearchRequest, id, &protocol.SearchRequest{ID: id, Pattern: pattern})
+			if err != nil {
+				logging.Errorf(p.logger, "Could not search %s: %v", addr, err)
+				return
+			}
+			resp := msg.Payload.(*protocol.SearchResponse)
+			if resp.Error != "" {
+				logging.Errorf(p.logger, "Search of %s failed: %s", addr, resp.Error)
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, f := range resp.Files {
+				results = append(results, SearchResult{ListEntry: f, Peer: msg.From, Addr: addr})
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(results, func(a, b SearchResult) int {
+		if c := strings.Compare(a.Name, b.Name); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Peer, b.Peer)
+	})
+	return results, nil
+}
+
+// handleSearchRequest answers a search of the shared directory
+func (p *Peer) handleSearchRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.SearchRequest)
+	resp := &protocol.SearchResponse{ID: req.ID}
+
+	err := p.checkFeature(protocol.FeatureSearch)
+	if err == nil {
+		_, err = path.Match(req.Pattern, "")
+	}
+	var files []protocol.ListEntry
+	if err == nil {
+		files, err = p.listShared(p.readableBy(msg.From), p.SharedDir(), "")
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Search for %s failed: %v", msg.From, err)
+		resp.Error = err.Error()
+	}
+	for _, f := range files {
+		if err == nil && searchMatches(f.Name, req.Pattern) && len(resp.Files) < maxSearchResults {
+			resp.Files = append(resp.Files, f)
+		}
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeSearchResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error sending search results: %v", err)
+	}
+}
+
+// handleSearchResponse delivers search results to the waiting call
+func (p *Peer) handleSearchResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.SearchResponse).ID, msg)
+}
+
+// searchMatches reports whether a file name matches a search pattern, see
+// Search
+func searchMatches(name, pattern string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		return matchesAny(name, []string{pattern})
+	}
+	return strings.Contains(strings.ToLower(name), strings.ToLower(pattern))
+}
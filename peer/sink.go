@@ -0,0 +1,120 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// ReceiveTo requests a file from a peer and writes it to w as it arrives
+// instead of saving it, e.g. to a named pipe a downstream process reads,
+// so that no copy is kept on disk
+// The size and hash the sender announced can only be checked once all of
+// the file has been written, so a consumer should only trust what it read
+// once ReceiveTo returns nil
+// w is written from the goroutine handling incoming messages, so a writer
+// that blocks holds up the peer's other incoming transfers too
+// Returns: The number of bytes written to w
+func (p *Peer) ReceiveTo(ctx context.Context, peerAddr, name string, w io.Writer) (int64, error) {
+	t, err := p.requestFile(peerAddr, wireName(name), "", w, protocol.PriorityNormal, true)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case res := <-t.saved:
+		return t.status().Done, res.err
+	case <-ctx.Done():
+		p.abandonRequest(t, ctx.Err())
+		return t.status().Done, ctx.Err()
+	}
+}
+
+// abandonRequest ends a request whose caller stopped waiting, whether its
+// response is still to come or being streamed in, so that nothing more
+// is written for it
+func (p *Peer) abandonRequest(t *transfer, err error) {
+	name := t.rec.FileName
+	p.mu.Lock()
+	waiting := p.pending[name] == t
+	if waiting {
+		delete(p.pending, name)
+	}
+	var stream *fileStream
+	for _, s := range p.fileStreams {
+		if s.t == t {
+			stream = s
+		}
+	}
+	p.mu.Unlock()
+
+	if waiting {
+		p.endTransfer(t, 0, err)
+	} else if stream != nil {
+		stream.mu.Lock()
+		p.finishStreamed(stream, err)
+		stream.mu.Unlock()
+	}
+}
+
+// deliverResponse passes the response to a request made with ReceiveTo on
+// to its writer: a streamed file as it arrives, see receiveStreamed, and a
+// whole one once it passed the checks
+func (p *Peer) deliverResponse(msg protocol.Message, resp *protocol.FileResponse, t *transfer) {
+	var err error
+	switch {
+	case resp.Streamed:
+		if err = p.receiveStreamed(msg, resp, "", t); err == nil {
+			return
+		}
+	default:
+		if reason, detail := checkResponse(resp); reason != "" {
+			err = fmt.Errorf("%s check failed: %s", reason, detail)
+		} else if _, err = t.sink.Write(resp.Data); err == nil {
+			t.addProgress(int64(len(resp.Data)))
+		}
+	}
+	p.endTransfer(t, t.status().Done, err)
+	if err != nil {
+		logging.Errorf(p.logger, "Error delivering %s: %v", resp.Name, err)
+	} else {
+		logging.Infof(p.logger, "File %s delivered (%d bytes)", resp.Name, len(resp.Data))
+	}
+	t.reportSaved("", err)
+}
+
+// finishDelivered checks a stream written to a ReceiveTo writer against
+// the size and hash the sender announced
+// Caller must hold s.mu
+func (p *Peer) finishDelivered(s *fileStream, sum []byte) {
+	var err error
+	if got := s.hash.Sum(nil); sum == nil {
+		err = fmt.Errorf("%s check failed: sender announced no %s", QuarantineChecksum, s.hasher.Name())
+	} else if !bytes.Equal(got, sum) {
+		err = fmt.Errorf("%s check failed: %s %x, sender announced %x", QuarantineChecksum, s.hasher.Name(), got, sum)
+	} else if s.written != s.resp.Size {
+		err = fmt.Errorf("%s check failed: received %d of %d bytes", QuarantineIncomplete, s.written, s.resp.Size)
+	}
+	p.finishStreamed(s, err)
+	if err != nil {
+		return
+	}
+	logging.Infof(p.logger, "File %s delivered (%d bytes)", s.resp.Name, s.written)
+	s.t.reportSaved("", nil)
+}
+
+// writeZeros writes n zero bytes to w
+func writeZeros(w io.Writer, n int64) error {
+	zeros := make([]byte, min(n, fileDataSize))
+	for n > 0 {
+		k, err := w.Write(zeros[:min(n, int64(len(zeros)))])
+		if err != nil {
+			return err
+		}
+		n -= int64(k)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	statsSmoothing = 0.3       // Weight of a new sample in smoothed source statistics
+	assumedRate    = 256 << 10 // Throughput assumed for sources that haven't delivered anything yet
+	probeTimeout   = 10 * time.Second
+)
+
+// SourceStats records how a download source has performed, across downloads
+// Peers are keyed by address and web seeds by URL
+type SourceStats struct {
+	Source     string        `json:"source"`             // Peer address or web seed URL
+	WebSeed    bool          `json:"web_seed,omitempty"` // Set for HTTP web seeds
+	RTT        time.Duration `json:"rtt"`                // Smoothed round-trip time of a probe request
+	Throughput float64       `json:"throughput"`         // Smoothed bytes per second delivered
+	Good       int64         `json:"good"`               // Pieces that passed verification
+	Bad        int64         `json:"bad"`                // Pieces that failed to arrive or to verify
+	LastUsed   time.Time     `json:"last_used"`
+}
+
+// Reputation returns the share of pieces expected to arrive intact, in (0, 1)
+// Sources without a history start at 0.5
+func (s SourceStats) Reputation() float64 {
+	return float64(s.Good+1) / float64(s.Good+s.Bad+2)
+}
+
+// Score estimates the rate in bytes per second at which the source delivers
+// verified data; higher is better. Sources that haven't been measured yet
+// are scored from their RTT as if a piece took one round trip plus the
+// transfer at a modest assumed rate
+func (s SourceStats) Score() float64 {
+	rate := s.Throughput
+	if rate <= 0 {
+		rate = float64(defaultPieceSize) / (s.RTT.Seconds() + float64(defaultPieceSize)/assumedRate)
+	}
+	return rate * s.Reputation()
+}
+
+// Sources returns the statistics of every source used for downloads so far,
+// best scoring first
+func (p *Peer) Sources() []SourceStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sources := make([]SourceStats, 0, len(p.sources))
+	for _, s := range p.sources {
+		sources = append(sources, *s)
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].Score() > sources[j].Score() })
+	return sources
+}
+
+// sourceStats returns the recorded statistics of a source, or fresh ones
+func (p *Peer) sourceStats(src pieceSource) SourceStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if s, ok := p.sources[src.id()]; ok {
+		return *s
+	}
+	return SourceStats{Source: src.id(), WebSeed: src.webSeed()}
+}
+
+// updateSourceStats stores the statistics gathered during a download
+func (p *Peer) updateSourceStats(s SourceStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s.LastUsed = time.Now()
+	p.sources[s.Source] = &s
+}
+
+// smooth folds a new sample into an exponentially weighted average
+func smooth(avg, sample float64) float64 {
+	if avg == 0 {
+		return sample
+	}
+	return avg + statsSmoothing*(sample-avg)
+}
+
+// probeWebSeed checks that a web seed serves the file and measures its latency
+// Returns: The time taken by a HEAD request for the file
+func probeWebSeed(ctx context.Context, s *httpSource) (time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return time.Since(start), nil
+}
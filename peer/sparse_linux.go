@@ -0,0 +1,36 @@
+package peer
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lseek whence values for finding data and holes, from Linux's unistd.h
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// dataExtent finds where data and holes lie in a file at offset, as
+// recorded by the filesystem; it moves the file's read offset
+// Returns: The length of the hole at offset, or if offset is in data the
+// length of the data before the next hole; both capped at size
+func dataExtent(file *os.File, offset, size int64) (hole, data int64) {
+	next, err := file.Seek(offset, seekData)
+	if errors.Is(err, syscall.ENXIO) {
+		// No data past offset
+		return size - offset, 0
+	}
+	if err != nil {
+		return 0, size - offset
+	}
+	if next > offset {
+		return min(next, size) - offset, 0
+	}
+	end, err := file.Seek(offset, seekHole)
+	if err != nil {
+		return 0, size - offset
+	}
+	return 0, min(end, size) - offset
+}
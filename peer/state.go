@@ -0,0 +1,132 @@
+package peer
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// maxHistory caps the number of transfer records kept in the persisted state
+const maxHistory = 1000
+
+// PeerInfo describes a remote peer this node has exchanged messages with
+type PeerInfo struct {
+	ID         string    `json:"id"`                    // Peer ID announced by the remote peer
+	Addr       string    `json:"addr"`                  // Last address the peer was seen at
+	ListenAddr string    `json:"listen_addr,omitempty"` // Address the peer announced it listens on, see WithAddressWatch
+	LastSeen   time.Time `json:"last_seen"`             // Time of the last message from the peer
+	Features   []string  `json:"features,omitempty"`    // Features the peer advertised, see protocol.Features
+	Discovered bool      `json:"discovered,omitempty"`  // Currently advertised on the local network, see WithDiscovery
+}
+
+// DialAddr returns the address to reach the peer at: the one it announced
+// it listens on if known, otherwise the one it was last seen at
+func (info PeerInfo) DialAddr() string {
+	if info.ListenAddr != "" {
+		return info.ListenAddr
+	}
+	return info.Addr
+}
+
+// TransferRecord describes a finished (or abandoned) file transfer
+type TransferRecord struct {
+	FileName  string    `json:"file_name"`       // Name of the transferred file
+	Peer      string    `json:"peer"`            // ID or address of the remote peer
+	Direction string    `json:"direction"`       // "send" or "receive"
+	Size      int64     `json:"size"`            // Number of bytes transferred
+	Started   time.Time `json:"started"`         // Time the transfer began
+	Finished  time.Time `json:"finished"`        // Time the transfer ended
+	Error     string    `json:"error,omitempty"` // Failure reason, empty on success
+}
+
+// state is the on-disk representation of the peer's persistent state
+type state struct {
+	Peers    map[string]*PeerInfo             `json:"peers"`
+	History  []TransferRecord                 `json:"history"`
+	Sources  map[string]*SourceStats          `json:"sources,omitempty"`
+	Channels map[string]*protocol.Channel     `json:"channels,omitempty"`
+	Keys     map[string]*KnownKey             `json:"keys,omitempty"`
+	Receipts []*protocol.Receipt              `json:"receipts,omitempty"`
+	Synced   map[string]map[string]syncedFile `json:"synced,omitempty"`
+}
+
+// loadState reads the persisted state from the configured state file
+// A missing state file is not an error; the peer simply starts fresh
+func (p *Peer) loadState() error {
+	if p.stateFile == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(p.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read state file: %v", err)
+	}
+
+	var s state
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("failed to parse state file: %v", err)
+	}
+
+	if s.Peers != nil {
+		p.peers = s.Peers
+	}
+	p.history = s.History
+	if s.Sources != nil {
+		p.sources = s.Sources
+	}
+	if s.Channels != nil {
+		p.channels = s.Channels
+	}
+	if s.Keys != nil {
+		p.keys = s.Keys
+	}
+	p.receipts = s.Receipts
+	if s.Synced != nil {
+		p.synced = s.Synced
+	}
+	return nil
+}
+
+// saveState writes the peer's state to the configured state file
+// The file is written to a temporary path first and renamed into place
+// so a crash mid-write never leaves a truncated state file behind
+func (p *Peer) saveState() error {
+	if p.stateFile == "" {
+		return nil
+	}
+
+	p.mu.Lock()
+	data, err := json.MarshalIndent(state{Peers: p.peers, History: p.history, Sources: p.sources, Channels: p.channels, Keys: p.keys, Receipts: p.receipts, Synced: p.synced}, "", "  ")
+	p.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(p.stateFile), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+	tmp := p.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	if err := os.Rename(tmp, p.stateFile); err != nil {
+		return fmt.Errorf("failed to replace state file: %v", err)
+	}
+	return nil
+}
+
+// recordTransfer appends a finished transfer to the history
+// Caller must hold p.mu
+func (p *Peer) recordTransfer(rec TransferRecord) {
+	p.history = append(p.history, rec)
+	if len(p.history) > maxHistory {
+		p.history = p.history[len(p.history)-maxHistory:]
+	}
+}
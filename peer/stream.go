@@ -0,0 +1,223 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	streamCachePieces = 8 // Pieces a Stream keeps in memory
+	streamReadAhead   = 2 // Pieces a Stream fetches ahead of the read position
+)
+
+// Stream reads a file shared by other peers at any position without
+// downloading it first, e.g. to play and seek in a video while it is
+// still being downloaded. Each read fetches the piece under the read
+// position at high priority and the next few in the background; pieces a
+// running Download has already written are read from its ".part" file
+// Every piece is verified against the manifest
+// A Stream is not safe for concurrent use, but several may read one file
+type Stream struct {
+	p      *Peer
+	ctx    context.Context
+	m      *protocol.Manifest
+	urgent []pieceSource // Sources for the piece being read, best first
+	ahead  []pieceSource // Sources for read-ahead, at normal priority
+	local  []string      // Local files that may hold verified pieces
+	pos    int64
+	last   int // Piece the previous Read started read-ahead from
+
+	mu      sync.Mutex
+	cache   map[int][]byte
+	order   []int                 // Cached pieces, least recently used first
+	loading map[int]chan struct{} // Pieces being fetched, closed when done
+}
+
+// OpenStream prepares a Stream of a file held by the given peers
+// ctx: Bounds every fetch made through the stream, e.g. an HTTP request's context
+// Returns: An error if no peer can provide the file's manifest
+func (p *Peer) OpenStream(ctx context.Context, name string, peers []string) (*Stream, error) {
+	name = wireName(name)
+	m, sources := p.probePeers(ctx, name, peers, nil, newTransferPriority(protocol.PriorityHigh))
+	if m == nil {
+		return nil, fmt.Errorf("no peer could provide the manifest for %s", name)
+	}
+	if err := m.Validate(); err != nil {
+		return nil, err
+	}
+	sort.Slice(sources, func(i, j int) bool { return sources[i].stats.Score() > sources[j].stats.Score() })
+
+	s := &Stream{
+		p:       p,
+		ctx:     ctx,
+		m:       m,
+		cache:   make(map[int][]byte),
+		loading: make(map[int]chan struct{}),
+		last:    -1,
+	}
+	normal := newTransferPriority(protocol.PriorityNormal)
+	for _, src := range sources {
+		s.urgent = append(s.urgent, src.src)
+		s.ahead = append(s.ahead, &peerSource{p: p, addr: src.src.id(), priority: normal})
+	}
+	if target, err := localPath(p.ReceivedDir(), sanitizeName(name)); err == nil {
+		s.local = []string{p.partPath(target), target}
+	}
+	return s, nil
+}
+
+// Name returns the name of the streamed file
+func (s *Stream) Name() string {
+	return s.m.Name
+}
+
+// Size returns the size of the streamed file
+func (s *Stream) Size() int64 {
+	return s.m.Size
+}
+
+// Read reads from the current position, fetching pieces as needed
+func (s *Stream) Read(b []byte) (int, error) {
+	if s.pos >= s.m.Size {
+		return 0, io.EOF
+	}
+	index := int(s.pos / s.m.PieceSize)
+	data, err := s.piece(index, s.urgent)
+	if err != nil {
+		return 0, err
+	}
+	if index != s.last {
+		s.last = index
+		for i := 1; i <= streamReadAhead && index+i < s.m.NumPieces(); i++ {
+			go s.piece(index+i, s.ahead)
+		}
+	}
+
+	start, _ := s.m.PieceRange(index)
+	n := copy(b, data[s.pos-start:])
+	s.pos += int64(n)
+	return n, nil
+}
+
+// Seek sets the position of the next Read
+func (s *Stream) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.m.Size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of stream")
+	}
+	s.pos = offset
+	return offset, nil
+}
+
+// piece returns a verified piece from the cache, a local file or a source
+func (s *Stream) piece(index int, sources []pieceSource) ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if data, ok := s.cache[index]; ok {
+			s.touch(index)
+			s.mu.Unlock()
+			return data, nil
+		}
+		ch, busy := s.loading[index]
+		if !busy {
+			ch = make(chan struct{})
+			s.loading[index] = ch
+		}
+		s.mu.Unlock()
+
+		if busy {
+			// Another read is fetching it; use its result or retry if it failed
+			select {
+			case <-ch:
+				continue
+			case <-s.ctx.Done():
+				return nil, s.ctx.Err()
+			}
+		}
+
+		data, err := s.load(index, sources)
+		s.mu.Lock()
+		delete(s.loading, index)
+		close(ch)
+		if err == nil {
+			s.cache[index] = data
+			s.touch(index)
+			if len(s.order) > streamCachePieces {
+				delete(s.cache, s.order[0])
+				s.order = s.order[1:]
+			}
+		}
+		s.mu.Unlock()
+		return data, err
+	}
+}
+
+// touch marks a cached piece as most recently used; caller must hold s.mu
+func (s *Stream) touch(index int) {
+	for i, v := range s.order {
+		if v == index {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	s.order = append(s.order, index)
+}
+
+// load reads a piece from a local file if one holds it, otherwise fetches
+// it from the first source that delivers it intact
+func (s *Stream) load(index int, sources []pieceSource) ([]byte, error) {
+	offset, length := s.m.PieceRange(index)
+	for _, path := range s.local {
+		if data, err := readLocalPiece(path, offset, length); err == nil && s.m.VerifyPiece(index, data) == nil {
+			return data, nil
+		}
+	}
+
+	err := errors.New("no source available")
+	for _, src := range sources {
+		ctx, cancel := context.WithTimeout(s.ctx, pieceTimeout)
+		var data []byte
+		data, err = src.fetch(ctx, s.m, index)
+		cancel()
+		if err == nil {
+			err = s.m.VerifyPiece(index, data)
+		}
+		if err == nil {
+			s.p.metrics.bytesReceived.Add(uint64(len(data)))
+			return data, nil
+		}
+		if s.ctx.Err() != nil {
+			return nil, s.ctx.Err()
+		}
+		logging.Warnf(s.p.logger, "Streaming piece %d of %s from %s failed: %v", index, s.m.Name, src, err)
+	}
+	return nil, fmt.Errorf("piece %d of %s: %v", index, s.m.Name, err)
+}
+
+// readLocalPiece reads a byte range of a local file, if it has one
+func readLocalPiece(path string, offset, length int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data := make([]byte, length)
+	if _, err := f.ReadAt(data, offset); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,345 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// syncedFile is the state a shared file was last seen in, or last reached
+// the sync partner in
+type syncedFile struct {
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	PieceSize int64     `json:"piece_size,omitempty"` // Piece size Hash was computed with
+	Hash      []byte    `json:"hash,omitempty"`       // Content hash as synced, for the tombstone if it's deleted
+}
+
+// WithSyncPartner keeps the peer at addr up to date with the shared
+// directory: it's scanned every interval, and files that are new or have
+// changed since they last reached the partner are pushed to it once they
+// stop changing. Files the partner's listing shows it already holds with
+// the same content aren't sent again; deletions are only passed on with
+// WithSyncDeletes
+// The partner must accept the pushes, see WithPushPolicy; a partner that
+// saves them into its own shared directory and syncs back to this peer
+// makes the sync two-way
+func WithSyncPartner(addr string, interval time.Duration) Option {
+	return func(p *Peer) {
+		p.syncPartner = addr
+		p.syncEvery = interval
+	}
+}
+
+// WithSyncDeletes passes deletions from the shared directory on to the
+// sync partner, see WithSyncPartner, as tombstones the partner applies if
+// its push policy allows, see PushPolicy.Deletes
+// maxPerScan: Most deletions passed on per scan of the shared directory,
+// so that a mistaken mass deletion spreads slowly enough to be stopped;
+// the others wait for later scans
+func WithSyncDeletes(maxPerScan int) Option {
+	return func(p *Peer) {
+		p.syncDeletes = maxPerScan
+	}
+}
+
+// syncLoop pushes changes of the shared directory to the sync partner
+// until the peer stops
+func (p *Peer) syncLoop() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-p.stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(p.syncEvery)
+	defer ticker.Stop()
+	var prev map[string]syncedFile
+	for {
+		prev = p.syncShared(ctx, prev)
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// syncShared scans the shared directory once and pushes the files that
+// changed since they last reached the sync partner and are as the
+// previous scan found them, so files still being written wait
+// prev: The files the previous scan found, by wire name
+// Returns: The files this scan found
+func (p *Peer) syncShared(ctx context.Context, prev map[string]syncedFile) map[string]syncedFile {
+	current, err := p.scanShared()
+	if err != nil {
+		logging.Errorf(p.logger, "Error scanning shared files to sync: %v", err)
+		return prev
+	}
+
+	var changed []string
+	p.mu.Lock()
+	synced := p.synced[p.syncPartner]
+	for name, f := range current {
+		if s, ok := synced[name]; ok && s.Size == f.Size && s.ModTime.Equal(f.ModTime) {
+			continue
+		}
+		if s, ok := prev[name]; ok && s.Size == f.Size && s.ModTime.Equal(f.ModTime) {
+			changed = append(changed, name)
+		}
+	}
+	p.mu.Unlock()
+	sort.Strings(changed)
+
+	remote := map[string][]byte{}
+	if len(changed) > 0 {
+		if files, err := p.ListFiles(ctx, p.syncPartner); err != nil {
+			logging.Errorf(p.logger, "Could not list the files of sync partner %s: %v", p.syncPartner, err)
+		} else {
+			for _, f := range files {
+				remote[f.Name] = f.Hash
+			}
+		}
+	}
+	for _, name := range changed {
+		if hash := remote[name]; hash != nil {
+			if m, err := p.sharedManifest(name, protocol.NameEncodingUTF8NFC); err == nil && bytes.Equal(m.ContentHash(), hash) {
+				p.markSynced(name, current[name])
+				continue
+			}
+		}
+		if err := p.PushFile(ctx, p.syncPartner, name); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			logging.Errorf(p.logger, "Sync of %s to %s failed: %v", name, p.syncPartner, err)
+			continue
+		}
+		logging.Infof(p.logger, "Synced %s to %s", name, p.syncPartner)
+		p.markSynced(name, current[name])
+	}
+
+	if p.syncDeletions(ctx, current) || len(changed) > 0 {
+		if err := p.saveState(); err != nil {
+			logging.Errorf(p.logger, "Error persisting peer state: %v", err)
+		}
+	}
+	return current
+}
+
+// syncDeletions deals with the files that reached the sync partner and
+// are gone from the shared directory: without WithSyncDeletes they're
+// forgotten, so they're sent again if they return; with it, they're
+// passed on to the partner as tombstones, up to the set number per scan,
+// and forgotten once the partner has them
+// Returns: Whether any file was forgotten
+func (p *Peer) syncDeletions(ctx context.Context, current map[string]syncedFile) bool {
+	forgot := false
+	var gone []protocol.Tombstone
+	p.mu.Lock()
+	for name, s := range p.synced[p.syncPartner] {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		if p.syncDeletes <= 0 || s.Hash == nil {
+			delete(p.synced[p.syncPartner], name)
+			forgot = true
+			continue
+		}
+		gone = append(gone, protocol.Tombstone{Name: name, Size: s.Size, PieceSize: s.PieceSize, Hash: s.Hash, Deleted: time.Now().UTC()})
+	}
+	p.mu.Unlock()
+	if len(gone) == 0 {
+		return forgot
+	}
+	sort.Slice(gone, func(i, j int) bool { return gone[i].Name < gone[j].Name })
+	if len(gone) > p.syncDeletes {
+		logging.Infof(p.logger, "%d synced files were deleted; passing %d on to %s now and the rest in later scans", len(gone), p.syncDeletes, p.syncPartner)
+		gone = gone[:p.syncDeletes]
+	}
+
+	deleted, err := p.sendTombstones(ctx, gone)
+	if err != nil {
+		logging.Errorf(p.logger, "Could not pass deletions on to %s: %v", p.syncPartner, err)
+		return forgot
+	}
+	p.mu.Lock()
+	for _, ts := range gone {
+		delete(p.synced[p.syncPartner], ts.Name)
+	}
+	p.mu.Unlock()
+	for _, name := range deleted {
+		logging.Infof(p.logger, "Deleted %s on %s", name, p.syncPartner)
+	}
+	return true
+}
+
+// sendTombstones passes tombstones on to the sync partner
+// Returns: The names of the files the partner deleted
+func (p *Peer) sendTombstones(ctx context.Context, tombstones []protocol.Tombstone) ([]string, error) {
+	features, err := p.PeerFeatures(ctx, p.syncPartner)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(features, protocol.FeatureDeletes) {
+		return nil, errors.New("partner does not take deletions")
+	}
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	id := p.nextCallID()
+	msg, err := p.call(ctx, p.syncPartner, protocol.MessageTypeDeleteRequest, id, &protocol.DeleteRequest{ID: id, Tombstones: tombstones})
+	if err != nil {
+		return nil, err
+	}
+	resp := msg.Payload.(*protocol.DeleteResponse)
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Deleted, nil
+}
+
+// handleDeleteRequest applies the tombstones a sync partner passed on,
+// as far as the push policy lets it delete files here
+func (p *Peer) handleDeleteRequest(msg protocol.Message) {
+	req := msg.Payload.(*protocol.DeleteRequest)
+	resp := &protocol.DeleteResponse{ID: req.ID}
+
+	if err := p.checkFeature(protocol.FeatureDeletes); err != nil {
+		resp.Error = err.Error()
+	} else {
+		for _, ts := range req.Tombstones {
+			deleted, err := p.applyTombstone(msg.From, ts)
+			if err != nil {
+				logging.Infof(p.logger, "Keeping %s deleted by %s: %v", ts.Name, msg.From, err)
+			} else if deleted {
+				logging.Infof(p.logger, "Deleted %s as %s did", ts.Name, msg.From)
+				resp.Deleted = append(resp.Deleted, ts.Name)
+			}
+		}
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeDeleteResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error answering deletions: %v", err)
+	}
+}
+
+// handleDeleteResponse delivers the answer to tombstones to the waiting call
+func (p *Peer) handleDeleteResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.DeleteResponse).ID, msg)
+}
+
+// applyTombstone removes, or moves to the archive directory, the copy of
+// a file the peer with ID from pushed here and has since deleted, unless
+// the copy no longer holds the content the tombstone names
+// Returns: false if there was no copy
+func (p *Peer) applyTombstone(from string, ts protocol.Tombstone) (bool, error) {
+	policy := p.pushPolicy
+	if !slices.Contains(policy.Allow, from) && !p.writeAllowed(from, ts.Name) {
+		return false, fmt.Errorf("%s may not delete files here", from)
+	}
+	if err := checkNameEncoding(ts.Name, protocol.NameEncodingUTF8NFC); err != nil {
+		return false, err
+	}
+	path, err := p.pushTarget(from, ts.Name)
+	if err == nil && path == "" {
+		path, err = localPath(p.ReceivedDir(), sanitizeName(ts.Name))
+	}
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() || info.Size() != ts.Size {
+		return false, errors.New("it changed since it was synced")
+	}
+	// Shared files are hashed with the configured piece size, which also
+	// keeps a tombstone from choosing how much is read at once
+	if ts.PieceSize != p.pieceSize {
+		return false, fmt.Errorf("unsupported piece size %d", ts.PieceSize)
+	}
+	m, err := p.manifestFor(ts.Name, path)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(m.ContentHash(), ts.Hash) {
+		return false, errors.New("it changed since it was synced")
+	}
+
+	if policy.ArchiveDir == "" {
+		return true, os.Remove(path)
+	}
+	target, err := localPath(policy.ArchiveDir, sanitizeName(ts.Name))
+	if err == nil {
+		err = os.MkdirAll(policy.ArchiveDir, 0755)
+	}
+	if err == nil {
+		err = prepareDir(policy.ArchiveDir, target)
+	}
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Lstat(target); err == nil {
+		target += "." + time.Now().Format("20060102-150405")
+	}
+	return true, retryLocked(func() error { return os.Rename(path, target) })
+}
+
+// markSynced records that a shared file reached the sync partner, with
+// its content hash if it's known
+func (p *Peer) markSynced(name string, f syncedFile) {
+	if m, err := p.sharedManifest(name, protocol.NameEncodingUTF8NFC); err == nil && m.Size == f.Size {
+		f.PieceSize, f.Hash = m.PieceSize, m.ContentHash()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.synced[p.syncPartner] == nil {
+		p.synced[p.syncPartner] = map[string]syncedFile{}
+	}
+	p.synced[p.syncPartner][name] = f
+}
+
+// scanShared finds the files in the shared directory
+// Returns: Their sizes and modification times, by wire name
+func (p *Peer) scanShared() (map[string]syncedFile, error) {
+	sharedDir := p.SharedDir()
+	files := map[string]syncedFile{}
+	err := filepath.WalkDir(sharedDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == sharedDir {
+				return err
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || isPartial(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(sharedDir, path)
+		if err != nil {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files[wireName(rel)] = syncedFile{Size: info.Size(), ModTime: info.ModTime()}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,155 @@
+package peer
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// tombstone returns the tombstone of a file called name that held data
+// when it was synced
+func tombstone(t *testing.T, p *Peer, name string, data []byte) protocol.Tombstone {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "synced")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	m, err := buildManifest(path, name, p.pieceSize, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.Tombstone{Name: name, Size: m.Size, PieceSize: m.PieceSize, Hash: m.ContentHash(), Deleted: time.Now().UTC()}
+}
+
+// writeFile writes data to path, creating its directory
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deleteFiles hands p tombstones from the peer called from
+// Returns: The answer to them
+func deleteFiles(t *testing.T, p *Peer, sender *transport.MemoryTransport, from string, tombstones ...protocol.Tombstone) *protocol.DeleteResponse {
+	t.Helper()
+	p.handleDeleteRequest(protocol.Message{Type: protocol.MessageTypeDeleteRequest, From: from, FromAddr: sender.GetListenAddress(), Payload: &protocol.DeleteRequest{ID: 1, Tombstones: tombstones}})
+	select {
+	case msg := <-sender.GetMessageChannel():
+		return msg.Payload.(*protocol.DeleteResponse)
+	case <-time.After(time.Second):
+		t.Fatal("deletions not answered")
+		return nil
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestTombstoneDeletes(t *testing.T) {
+	p, sender := offerPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}, Deletes: true}))
+	data := []byte("synced content")
+	path := filepath.Join(p.ReceivedDir(), "dir", "a.txt")
+	writeFile(t, path, data)
+
+	resp := deleteFiles(t, p, sender, "friend", tombstone(t, p, "dir/a.txt", data), tombstone(t, p, "missing.txt", data))
+	if resp.Error != "" || !slices.Equal(resp.Deleted, []string{"dir/a.txt"}) {
+		t.Fatalf("got %+v, want dir/a.txt deleted", resp)
+	}
+	if exists(path) {
+		t.Fatal("synced copy not deleted")
+	}
+}
+
+func TestTombstoneKeeps(t *testing.T) {
+	p, sender := offerPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}, Deletes: true}))
+	data := []byte("synced content")
+	outside := filepath.Join(filepath.Dir(p.ReceivedDir()), "outside.txt")
+	writeFile(t, outside, data)
+	shared := filepath.Join(p.SharedDir(), "a.txt")
+	writeFile(t, shared, data)
+
+	otherPiece := tombstone(t, p, "piece.txt", data)
+	otherPiece.PieceSize *= 2
+	tests := []struct {
+		name string
+		from string
+		ts   protocol.Tombstone
+		path string // The file that must be kept
+		data []byte // Its content, as written before the tombstone
+	}{
+		{"stranger", "stranger", tombstone(t, p, "a.txt", data), "a.txt", data},
+		{"changed", "friend", tombstone(t, p, "changed.txt", data), "changed.txt", []byte("edited content")},
+		{"grown", "friend", tombstone(t, p, "grown.txt", data), "grown.txt", append(data, '!')},
+		{"other piece size", "friend", otherPiece, "piece.txt", data},
+		{"traversal", "friend", tombstone(t, p, "../outside.txt", data), "", nil},
+		{"backslash traversal", "friend", tombstone(t, p, `..\shared\a.txt`, data), "", nil},
+		{"absolute", "friend", tombstone(t, p, outside, data), "", nil},
+		{"name not UTF-8", "friend", tombstone(t, p, "a\xff.txt", data), "", nil},
+	}
+	for _, tt := range tests {
+		if tt.path != "" {
+			writeFile(t, filepath.Join(p.ReceivedDir(), tt.path), tt.data)
+		}
+		resp := deleteFiles(t, p, sender, tt.from, tt.ts)
+		if len(resp.Deleted) != 0 {
+			t.Errorf("%s: deleted %v", tt.name, resp.Deleted)
+		}
+		if tt.path != "" && !exists(filepath.Join(p.ReceivedDir(), tt.path)) {
+			t.Errorf("%s: copy deleted", tt.name)
+		}
+	}
+	if !exists(outside) || !exists(shared) {
+		t.Fatal("file outside the received directory deleted")
+	}
+
+	// A symlink to a file with the synced content isn't the synced copy
+	if err := os.Symlink(outside, filepath.Join(p.ReceivedDir(), "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if resp := deleteFiles(t, p, sender, "friend", tombstone(t, p, "link.txt", data)); len(resp.Deleted) != 0 {
+		t.Fatalf("symlink deleted: %v", resp.Deleted)
+	}
+	if !exists(outside) || !exists(filepath.Join(p.ReceivedDir(), "link.txt")) {
+		t.Fatal("symlink or its target deleted")
+	}
+}
+
+func TestTombstoneArchives(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "archive")
+	p, sender := offerPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}, Deletes: true, ArchiveDir: archive}))
+	data := []byte("synced content")
+	writeFile(t, filepath.Join(p.ReceivedDir(), "dir", "a.txt"), data)
+
+	if resp := deleteFiles(t, p, sender, "friend", tombstone(t, p, "dir/a.txt", data)); len(resp.Deleted) != 1 {
+		t.Fatalf("got %+v, want dir/a.txt archived", resp)
+	}
+	if got, err := os.ReadFile(filepath.Join(archive, "dir", "a.txt")); err != nil || string(got) != string(data) {
+		t.Fatalf("archived copy: %q, %v", got, err)
+	}
+}
+
+func TestTombstonesDisabled(t *testing.T) {
+	p, sender := offerPeer(t, WithPushPolicy(PushPolicy{Allow: []string{"friend"}}))
+	data := []byte("synced content")
+	path := filepath.Join(p.ReceivedDir(), "a.txt")
+	writeFile(t, path, data)
+
+	resp := deleteFiles(t, p, sender, "friend", tombstone(t, p, "a.txt", data))
+	if resp.Error == "" || len(resp.Deleted) != 0 {
+		t.Fatalf("got %+v, want deletions refused", resp)
+	}
+	if !exists(path) {
+		t.Fatal("copy deleted without Deletes in the push policy")
+	}
+}
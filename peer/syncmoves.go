@@ -0,0 +1,88 @@
+package peer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// channelMoves finds the files a new version of a channel lists under a
+// new name that the previous version listed under another one, dropped
+// from the new version: files the publisher renamed or moved
+// Each old file is matched with at most one new name
+// Returns: The previous manifest of each moved file, by its new name
+func channelMoves(prev, ch *protocol.Channel) map[string]*protocol.Manifest {
+	if prev == nil {
+		return nil
+	}
+	current := map[string]bool{}
+	for _, m := range ch.Files {
+		current[m.Name] = true
+	}
+	previous := map[string]bool{}
+	var gone []*protocol.Manifest
+	for _, m := range prev.Files {
+		previous[m.Name] = true
+		if !current[m.Name] {
+			gone = append(gone, m)
+		}
+	}
+
+	moves := map[string]*protocol.Manifest{}
+	for _, m := range ch.Files {
+		if previous[m.Name] {
+			continue
+		}
+		for i, old := range gone {
+			if old != nil && old.SameContent(m) {
+				moves[m.Name] = old
+				gone[i] = nil
+				break
+			}
+		}
+	}
+	return moves
+}
+
+// applyMove renames the received copy of a file saved under its old name
+// to the name m gives it, once it checks out against m, instead of
+// downloading the same content again
+// Returns: The new path
+func (p *Peer) applyMove(old, m *protocol.Manifest) (string, error) {
+	from, err := p.receivedTarget(old.Name, protocol.NameEncodingUTF8NFC)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(from)
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != m.Size {
+		return "", fmt.Errorf("%s has changed since it was received", from)
+	}
+	// Reading the local copy is far cheaper than fetching it again, and
+	// catches one that was edited without changing its size
+	local, err := buildManifest(from, m.Name, m.PieceSize, p.disk, nil)
+	if err != nil {
+		return "", err
+	}
+	if !local.SameContent(m) {
+		return "", fmt.Errorf("%s has changed since it was received", from)
+	}
+
+	to, err := p.receivedTarget(m.Name, protocol.NameEncodingUTF8NFC)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return "", fmt.Errorf("%s already exists", to)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	if err := retryLocked(func() error { return os.Rename(from, to) }); err != nil {
+		return "", err
+	}
+	return to, nil
+}
@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// AnyPeer keys, in sync rules, the rule for peers without one of their own
+const AnyPeer = "*"
+
+// SyncRule selects the files of a channel that are pulled from a peer
+// A file is pulled if it lies in one of Dirs, matches one of Include and
+// matches none of Exclude; empty Dirs or Include allow every file
+// Patterns are path.Match patterns; one without a "/" is matched against
+// the base name, so "*.parquet" matches "data/2024/q3.parquet"
+type SyncRule struct {
+	Include []string
+	Exclude []string
+	Dirs    []string // Subdirectories of the channel, e.g. "data/2024"
+}
+
+// Validate checks that every pattern is well-formed
+func (r SyncRule) Validate() error {
+	for _, pattern := range append(append([]string(nil), r.Include...), r.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether the rule selects the file name
+// name: Wire name of the file as listed in the channel
+func (r SyncRule) Matches(name string) bool {
+	if len(r.Dirs) > 0 && !inAnyDir(name, r.Dirs) {
+		return false
+	}
+	if len(r.Include) > 0 && !matchesAny(name, r.Include) {
+		return false
+	}
+	return !matchesAny(name, r.Exclude)
+}
+
+// inAnyDir reports whether name lies in one of dirs or below it
+func inAnyDir(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		dir = strings.Trim(dir, "/")
+		if dir == "" || dir == "." || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny reports whether name matches one of the patterns
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// WithSyncRules limits what SyncChannel pulls from each peer
+// rules: Keyed by peer ID or address, with AnyPeer for the others; peers
+// without a rule supply every file
+func WithSyncRules(rules map[string]SyncRule) Option {
+	return func(p *Peer) {
+		p.syncRules = rules
+	}
+}
+
+// SetSyncRules replaces the sync rules while the peer runs; nil removes them
+// Syncs already running are not affected
+func (p *Peer) SetSyncRules(rules map[string]SyncRule) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.syncRules = rules
+}
+
+// SyncRules returns the sync rules in effect, nil if there are none
+func (p *Peer) SyncRules() map[string]SyncRule {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.syncRules
+}
+
+// syncSources returns the peers whose sync rules select the file name
+func (p *Peer) syncSources(name string, addrs []string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.syncRules) == 0 {
+		return addrs
+	}
+
+	var sources []string
+	for _, addr := range addrs {
+		rule, ok := p.syncRules[addr]
+		if !ok {
+			rule, ok = p.syncRules[p.peerIDAt(addr)]
+		}
+		if !ok {
+			rule, ok = p.syncRules[AnyPeer]
+		}
+		if !ok || rule.Matches(name) {
+			sources = append(sources, addr)
+		}
+	}
+	return sources
+}
+
+// peerIDAt returns the ID of the known peer last seen at addr, or "" if none
+// Caller must hold p.mu
+func (p *Peer) peerIDAt(addr string) string {
+	remote, _ := transport.SplitPathAddr(addr)
+	for id, info := range p.peers {
+		if info.Addr == remote {
+			return id
+		}
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package peer
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// WithTempDir keeps the ".part" files of downloads in progress in dir rather
+// than next to their targets, e.g. on a fast local disk when the received
+// directory is on network storage. Completed files are moved into place,
+// and copied there when dir is on another filesystem
+func WithTempDir(dir string) Option {
+	return func(p *Peer) {
+		p.tempDir = dir
+	}
+}
+
+// partPath returns the ".part" file target is received into: next to it,
+// or in the temp directory under a name unique to target, so that the
+// same target resumes from the same file
+func (p *Peer) partPath(target string) string {
+	if p.tempDir == "" {
+		return target + ".part"
+	}
+	abs, err := filepath.Abs(target)
+	if err != nil {
+		abs = target
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(p.tempDir, fmt.Sprintf("%s.%x.part", filepath.Base(target), sum[:6]))
+}
+
+// createTemp creates a temporary file to receive target into, in the temp
+// directory if there is one
+func (p *Peer) createTemp(target string) (*os.File, error) {
+	dir := p.tempDir
+	if dir == "" {
+		dir = filepath.Dir(target)
+	}
+	return os.CreateTemp(dir, "."+filepath.Base(target)+".*.tmp")
+}
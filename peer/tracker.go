@@ -0,0 +1,294 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	trackerInterval = 10 * time.Minute    // How often a tracker asks peers to announce themselves again
+	trackerTTL      = 3 * trackerInterval // How long a tracker keeps a peer that stopped announcing itself
+	trackerTimeout  = 10 * time.Second    // Time allowed for a tracker to answer
+	trackerLeave    = 2 * time.Second     // Time allowed for telling trackers the peer leaves, on Close
+)
+
+// TrackedPeer is a peer registered with a tracker, see WithTracker
+type TrackedPeer struct {
+	ID        string                 `json:"id"`
+	Addr      string                 `json:"addr"`  // Address the peer listens on
+	Files     []protocol.TrackerFile `json:"files"` // Files the peer shares
+	Announced time.Time              `json:"announced"`
+}
+
+// sharedContent is a shared file with its content hash
+type sharedContent struct {
+	name string
+	size int64
+	hash []byte
+}
+
+// WithTracker runs the peer as a tracker: it keeps a registry of the peers
+// that announce themselves to it and the files they share, and tells
+// other peers where to find a file
+func WithTracker() Option {
+	return func(p *Peer) {
+		p.trackerMode = true
+	}
+}
+
+// WithTrackers announces the peer and its shared files to the trackers at
+// the given addresses once it starts, and asks them for the peers holding
+// a file that is downloaded without any, see Download
+// Only the files in the index are announced, see WithIndexFile
+func WithTrackers(addrs ...string) Option {
+	return func(p *Peer) {
+		p.trackers = addrs
+	}
+}
+
+// TrackedPeers returns the peers registered with the tracker, sorted by ID
+func (p *Peer) TrackedPeers() []TrackedPeer {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expireTracked()
+	peers := make([]TrackedPeer, 0, len(p.tracked))
+	for _, tp := range p.tracked {
+		peers = append(peers, *tp)
+	}
+	slices.SortFunc(peers, func(a, b TrackedPeer) int { return strings.Compare(a.ID, b.ID) })
+	return peers
+}
+
+// expireTracked drops the peers that stopped announcing themselves
+// Caller must hold p.mu
+func (p *Peer) expireTracked() {
+	for id, tp := range p.tracked {
+		if time.Since(tp.Announced) > trackerTTL {
+			delete(p.tracked, id)
+			logging.Infof(p.logger, "Peer %s stopped announcing itself, no longer tracking it", id)
+		}
+	}
+}
+
+// handleTrackerAnnounce registers the sender and its files with the tracker
+func (p *Peer) handleTrackerAnnounce(msg protocol.Message) {
+	req := msg.Payload.(*protocol.TrackerAnnounce)
+	resp := &protocol.TrackerResponse{ID: req.ID, Interval: int64(trackerInterval / time.Second)}
+
+	err := p.checkFeature(protocol.FeatureTracker)
+	if err == nil {
+		err = p.checkAccess(msg.From, "", AccessRead)
+	}
+	addr := advertisedAddr(req.Addr, msg.FromAddr)
+	if err == nil && addr == "" && !req.Leaving {
+		err = fmt.Errorf("invalid listen address %q", req.Addr)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		p.mu.Lock()
+		_, known := p.tracked[msg.From]
+		if req.Leaving {
+			delete(p.tracked, msg.From)
+		} else {
+			p.tracked[msg.From] = &TrackedPeer{ID: msg.From, Addr: addr, Files: req.Files, Announced: time.Now()}
+		}
+		p.mu.Unlock()
+		switch {
+		case req.Leaving && known:
+			logging.Infof(p.logger, "Peer %s left the tracker", msg.From)
+		case !req.Leaving && !known:
+			logging.Infof(p.logger, "Tracking peer %s at %s with %d files", msg.From, addr, len(req.Files))
+		}
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeTrackerResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error answering tracker announce: %v", err)
+	}
+}
+
+// handleTrackerQuery tells the sender which registered peers share a file
+func (p *Peer) handleTrackerQuery(msg protocol.Message) {
+	req := msg.Payload.(*protocol.TrackerQuery)
+	resp := &protocol.TrackerResponse{ID: req.ID}
+
+	err := p.checkFeature(protocol.FeatureTracker)
+	if err == nil {
+		err = p.checkAccess(msg.From, "", AccessRead)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	} else {
+		name := wireName(req.Name)
+		p.mu.Lock()
+		p.expireTracked()
+		for _, tp := range p.tracked {
+			if tp.ID == msg.From {
+				continue
+			}
+			for _, f := range tp.Files {
+				if (len(req.Hash) > 0 && bytes.Equal(f.Hash, req.Hash)) || (len(req.Hash) == 0 && f.Name == name) {
+					resp.Peers = append(resp.Peers, protocol.TrackerPeer{PeerID: tp.ID, Addr: tp.Addr, Name: f.Name})
+					break
+				}
+			}
+		}
+		p.mu.Unlock()
+	}
+
+	if err := p.reply(msg, protocol.MessageTypeTrackerResponse, resp); err != nil {
+		logging.Errorf(p.logger, "Error answering tracker query: %v", err)
+	}
+}
+
+// handleTrackerResponse delivers a tracker's answer to the waiting call
+func (p *Peer) handleTrackerResponse(msg protocol.Message) {
+	p.completeCall(msg.Payload.(*protocol.TrackerResponse).ID, msg)
+}
+
+// callTracker sends a request to the tracker at addr and waits for its answer
+func (p *Peer) callTracker(ctx context.Context, addr string, msgType uint8, id uint64, payload interface{}) (*protocol.TrackerResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, trackerTimeout)
+	defer cancel()
+	msg, err := p.call(ctx, addr, msgType, id, payload)
+	if err != nil {
+		return nil, err
+	}
+	resp := msg.Payload.(*protocol.TrackerResponse)
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp, nil
+}
+
+// trackerLoop announces the peer to every tracker on start, whenever the
+// index changes, and as often as the trackers ask
+func (p *Peer) trackerLoop() {
+	// Cancelled when the peer closes, so that announcements stop
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	announced := make(map[string]bool)
+	for {
+		wait := trackerInterval
+		files := p.trackerFiles()
+		for _, addr := range p.trackers {
+			id := p.nextCallID()
+			req := &protocol.TrackerAnnounce{ID: id, Addr: p.Addr(), Files: files}
+			resp, err := p.callTracker(ctx, addr, protocol.MessageTypeTrackerAnnounce, id, req)
+			if ctx.Err() != nil {
+				return
+			}
+			if err != nil {
+				logging.Errorf(p.logger, "Error announcing to tracker %s: %v", addr, err)
+				// Try again soon rather than after a full interval
+				wait = min(wait, time.Minute)
+				continue
+			}
+			if !announced[addr] {
+				announced[addr] = true
+				logging.Infof(p.logger, "Announced %d shared files to tracker %s", len(files), addr)
+			}
+			if resp.Interval > 0 {
+				wait = min(wait, time.Duration(resp.Interval)*time.Second)
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-p.trackerAnnounce:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// leaveTrackers tells the trackers the peer is leaving, on Close
+func (p *Peer) leaveTrackers() {
+	ctx, cancel := context.WithTimeout(context.Background(), trackerLeave)
+	defer cancel()
+	for _, addr := range p.trackers {
+		id := p.nextCallID()
+		req := &protocol.TrackerAnnounce{ID: id, Leaving: true}
+		if _, err := p.callTracker(ctx, addr, protocol.MessageTypeTrackerAnnounce, id, req); err != nil {
+			logging.Warnf(p.logger, "Could not tell tracker %s the peer is leaving: %v", addr, err)
+		}
+	}
+}
+
+// trackerFiles lists the shared files in the index for a TrackerAnnounce
+func (p *Peer) trackerFiles() []protocol.TrackerFile {
+	var files []protocol.TrackerFile
+	for _, c := range p.sharedContent() {
+		files = append(files, protocol.TrackerFile{Name: c.name, Size: c.size, Hash: c.hash})
+	}
+	return files
+}
+
+// sharedContent returns the files in the index that lie in the shared
+// directory, sorted by name
+func (p *Peer) sharedContent() []sharedContent {
+	sharedDir := p.SharedDir()
+	var files []sharedContent
+	p.mu.Lock()
+	for path, entry := range p.manifests {
+		rel, err := filepath.Rel(sharedDir, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		files = append(files, sharedContent{
+			name: wireName(filepath.ToSlash(rel)),
+			size: entry.size,
+			hash: entry.manifest.ContentHash(),
+		})
+	}
+	p.mu.Unlock()
+	slices.SortFunc(files, func(a, b sharedContent) int { return strings.Compare(a.name, b.name) })
+	return files
+}
+
+// LocateFile asks the trackers for the peers sharing the named file
+// Returns: Their addresses, or an error if no tracker could be asked
+func (p *Peer) LocateFile(ctx context.Context, name string) ([]string, error) {
+	if len(p.trackers) == 0 {
+		return nil, errors.New("no tracker to ask")
+	}
+	var addrs []string
+	var lastErr error
+	asked := 0
+	for _, tracker := range p.trackers {
+		id := p.nextCallID()
+		resp, err := p.callTracker(ctx, tracker, protocol.MessageTypeTrackerQuery, id, &protocol.TrackerQuery{ID: id, Name: wireName(name)})
+		if err != nil {
+			lastErr = fmt.Errorf("tracker %s: %v", tracker, err)
+			continue
+		}
+		asked++
+		for _, tp := range resp.Peers {
+			if tp.PeerID != p.id && !slices.Contains(addrs, tp.Addr) {
+				addrs = append(addrs, tp.Addr)
+			}
+		}
+	}
+	if asked == 0 {
+		return nil, lastErr
+	}
+	return addrs, nil
+}
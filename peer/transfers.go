@@ -0,0 +1,284 @@
+package peer
+
+import (
+	"hash"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/metrics"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	rateInterval      = time.Second      // Minimum time between transfer speed samples
+	uploadIdleTimeout = 10 * time.Second // Silence after which a chunked upload counts as finished
+)
+
+// Transfer describes a transfer in progress
+type Transfer struct {
+	ID        uint64    `json:"id"`
+	FileName  string    `json:"file_name"`
+	Peer      string    `json:"peer"`      // ID or address of the remote peer
+	Direction string    `json:"direction"` // "send" or "receive"
+	Size      int64     `json:"size"`      // Total bytes, 0 while unknown
+	Done      int64     `json:"done"`      // Bytes transferred so far
+	Rate      float64   `json:"rate"`      // Recent speed in bytes per second
+	Started   time.Time `json:"started"`
+}
+
+// eta estimates the time left at the current speed
+// Returns: 0 while the size or the speed is unknown
+func (t Transfer) eta() time.Duration {
+	if t.Size <= 0 || t.Rate <= 0 || t.Done >= t.Size {
+		return 0
+	}
+	return time.Duration(float64(t.Size-t.Done) / t.Rate * float64(time.Second))
+}
+
+// Progress is a report of how far a transfer has gotten, see WithProgress
+type Progress struct {
+	Transfer
+	ETA      time.Duration // Estimated time left, 0 while unknown
+	Finished bool          // The transfer is over; this is its last report
+	Err      error         // Why the finished transfer failed, nil if it didn't
+}
+
+// ProgressFunc receives progress reports of transfers
+type ProgressFunc func(Progress)
+
+// WithProgress reports the progress of every transfer, sending or
+// receiving, to fn: as bytes move, at most once per interval for each
+// transfer, and once more when it finishes
+// fn is called on the goroutines moving the data, possibly several at
+// once, so it should return quickly
+func WithProgress(fn ProgressFunc, interval time.Duration) Option {
+	return func(p *Peer) {
+		p.progress = fn
+		p.progressEvery = interval
+	}
+}
+
+// transfer tracks a transfer registered by beginTransfer
+type transfer struct {
+	id     uint64
+	rec    TransferRecord
+	output string         // Destination chosen by the requester, empty for the received directory
+	saved  chan savedFile // Receives the outcome of a whole-file request someone waits for, nil otherwise
+	sink   io.Writer      // Receives the requested file instead of a saved copy, see Peer.ReceiveTo
+	// Whether the file is an accepted push, and the size its offer
+	// announced, which the data received may not exceed
+	pushed  bool
+	maxSize int64
+
+	// The .part file a streamed request is received into, the bytes of an
+	// interrupted stream it asked to resume after, and their hash, which
+	// the rest of the stream continues
+	part            string
+	resumeAt        int64
+	resumeHash      hash.Hash
+	resumeAlgorithm string // Algorithm of resumeHash, see package checksum
+
+	mu       sync.Mutex
+	size     int64
+	done     int64
+	rate     float64   // Smoothed bytes per second
+	markTime time.Time // Start of the current speed sample
+	markDone int64     // Bytes done at markTime
+
+	progress      ProgressFunc // Receives progress reports, may be nil
+	progressEvery time.Duration
+	reported      time.Time // Time of the last progress report
+
+	bytes *metrics.Counter // Totals the bytes moved in the transfer's direction
+}
+
+// savedFile is the outcome of a whole-file request
+type savedFile struct {
+	path string
+	err  error
+}
+
+// reportSaved tells the caller waiting for a whole-file request, if any,
+// where the file was saved or why it wasn't
+func (t *transfer) reportSaved(path string, err error) {
+	if t != nil && t.saved != nil {
+		t.saved <- savedFile{path: path, err: err}
+	}
+}
+
+// setSize records the total size once it is known
+func (t *transfer) setSize(n int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.size = n
+}
+
+// addProgress records n more bytes transferred and reports the progress
+// if it's time to
+func (t *transfer) addProgress(n int64) {
+	t.mu.Lock()
+	t.done += n
+	t.bytes.Add(uint64(n))
+	now := time.Now()
+	if elapsed := now.Sub(t.markTime); elapsed >= rateInterval {
+		t.rate = smooth(t.rate, float64(t.done-t.markDone)/elapsed.Seconds())
+		t.markTime, t.markDone = now, t.done
+	}
+	report := t.progress != nil && now.Sub(t.reported) >= t.progressEvery
+	var s Transfer
+	if report {
+		t.reported = now
+		s = t.snapshot()
+	}
+	t.mu.Unlock()
+
+	if report {
+		t.progress(Progress{Transfer: s, ETA: s.eta()})
+	}
+}
+
+// reportFinished makes the last progress report of a finished transfer
+func (t *transfer) reportFinished(err error) {
+	if t.progress == nil {
+		return
+	}
+	s := t.status()
+	t.progress(Progress{Transfer: s, Finished: true, Err: err})
+}
+
+// status returns a snapshot of the transfer
+func (t *transfer) status() Transfer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.snapshot()
+}
+
+// snapshot is status for a caller holding t.mu
+func (t *transfer) snapshot() Transfer {
+	rate := t.rate
+	// A stalled transfer stops calling addProgress; let its speed decay
+	if elapsed := time.Since(t.markTime); elapsed > 2*rateInterval {
+		rate = float64(t.done-t.markDone) / elapsed.Seconds()
+	}
+	return Transfer{
+		ID:        t.id,
+		FileName:  t.rec.FileName,
+		Peer:      t.rec.Peer,
+		Direction: t.rec.Direction,
+		Size:      t.size,
+		Done:      t.done,
+		Rate:      rate,
+		Started:   t.rec.Started,
+	}
+}
+
+// ActiveTransfers returns the transfers in progress, oldest first
+func (p *Peer) ActiveTransfers() []Transfer {
+	p.mu.Lock()
+	list := make([]*transfer, 0, len(p.transfers))
+	for _, t := range p.transfers {
+		list = append(list, t)
+	}
+	p.mu.Unlock()
+
+	out := make([]Transfer, len(list))
+	for i, t := range list {
+		out[i] = t.status()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+// newTransfer registers a transfer in the active set; caller must hold p.mu
+func (p *Peer) newTransfer(fileName, peer, direction string) *transfer {
+	p.transferSeq++
+	now := time.Now()
+	t := &transfer{
+		id: p.transferSeq,
+		rec: TransferRecord{
+			FileName:  fileName,
+			Peer:      peer,
+			Direction: direction,
+			Started:   now,
+		},
+		markTime:      now,
+		bytes:         p.metrics.byteCounter(direction),
+		progress:      p.progress,
+		progressEvery: p.progressEvery,
+	}
+	p.transfers[t.id] = t
+	return t
+}
+
+// finishTransfer removes a transfer from the active set and appends it to
+// the history; caller must hold p.mu
+func (p *Peer) finishTransfer(t *transfer, size int64, err error) {
+	delete(p.transfers, t.id)
+	rec := t.rec
+	rec.Size = size
+	rec.Finished = time.Now()
+	if err != nil {
+		rec.Error = err.Error()
+	}
+	p.metrics.finished(rec.Started, err)
+	p.recordTransfer(rec)
+}
+
+// uploadSession is a chunked upload of one file to one peer; it spans many
+// chunk requests, so it ends after a period without any
+type uploadSession struct {
+	t     *transfer
+	timer *time.Timer
+}
+
+// noteUpload accounts a served chunk to the upload session of the requester
+func (p *Peer) noteUpload(msg protocol.Message, name string, size, n int64) {
+	key := msg.From + "\x00" + name
+
+	p.mu.Lock()
+	s, ok := p.uploads[key]
+	if !ok {
+		s = &uploadSession{t: p.newTransfer(name, msg.From, "send")}
+		s.timer = time.AfterFunc(uploadIdleTimeout, func() { p.endUpload(key, s) })
+		p.uploads[key] = s
+	} else {
+		s.timer.Reset(uploadIdleTimeout)
+	}
+	p.mu.Unlock()
+
+	s.t.setSize(size)
+	s.t.addProgress(n)
+}
+
+// endUpload finishes an idle upload session
+func (p *Peer) endUpload(key string, s *uploadSession) {
+	p.mu.Lock()
+	if p.uploads[key] != s {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.uploads, key)
+	p.finishTransfer(s.t, s.t.status().Done, nil)
+	p.mu.Unlock()
+
+	s.t.reportFinished(nil)
+}
+
+// endUploads finishes every upload session, e.g. on shutdown
+func (p *Peer) endUploads() {
+	p.mu.Lock()
+	var ended []*transfer
+	for key, s := range p.uploads {
+		s.timer.Stop()
+		delete(p.uploads, key)
+		p.finishTransfer(s.t, s.t.status().Done, nil)
+		ended = append(ended, s.t)
+	}
+	p.mu.Unlock()
+
+	for _, t := range ended {
+		t.reportFinished(nil)
+	}
+}
@@ -0,0 +1,221 @@
+package peer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// usageCacheTTL is how long a disk usage scan is reused for metrics
+const usageCacheTTL = 10 * time.Second
+
+// EvictionPolicy decides which received files are removed first when the
+// received directory grows beyond its limit
+type EvictionPolicy int
+
+const (
+	// EvictOldest removes the files received longest ago
+	EvictOldest EvictionPolicy = iota
+	// EvictLRU removes the files least recently read, as far as the
+	// filesystem records access times; otherwise it behaves like EvictOldest
+	// Mounts with relatime only record the first read after a change, and
+	// then at most once a day
+	EvictLRU
+)
+
+// ParseEvictionPolicy parses "oldest" or "lru"
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch s {
+	case "oldest":
+		return EvictOldest, nil
+	case "lru":
+		return EvictLRU, nil
+	}
+	return 0, fmt.Errorf("unknown eviction policy %q", s)
+}
+
+// String returns the name accepted by ParseEvictionPolicy
+func (e EvictionPolicy) String() string {
+	if e == EvictLRU {
+		return "lru"
+	}
+	return "oldest"
+}
+
+// DiskUsage reports the space taken up by the peer's directories
+type DiskUsage struct {
+	SharedBytes   int64  `json:"shared_bytes"`
+	SharedFiles   int    `json:"shared_files"`
+	ReceivedBytes int64  `json:"received_bytes"` // Including partial downloads
+	ReceivedFiles int    `json:"received_files"`
+	ReceivedLimit int64  `json:"received_limit"` // 0 if unlimited
+	Eviction      string `json:"eviction"`       // Policy applied when over the limit
+}
+
+// usageCache keeps the last disk usage scan for metrics
+type usageCache struct {
+	mu    sync.Mutex
+	at    time.Time
+	usage DiskUsage
+}
+
+// WithReceivedLimit caps the total size of the received directory; once a
+// received file takes it over maxBytes, older files are removed according
+// to policy until it fits again. 0 means unlimited
+func WithReceivedLimit(maxBytes int64, policy EvictionPolicy) Option {
+	return func(p *Peer) {
+		p.receivedLimit = maxBytes
+		p.eviction = policy
+	}
+}
+
+// SetReceivedLimit changes the received directory cap while the peer runs
+// The new limit is enforced when the next file arrives
+func (p *Peer) SetReceivedLimit(maxBytes int64, policy EvictionPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.receivedLimit = maxBytes
+	p.eviction = policy
+}
+
+// ReceivedLimit returns the received directory cap, 0 if unlimited, and
+// the eviction policy
+func (p *Peer) ReceivedLimit() (int64, EvictionPolicy) {
+	return p.receivedLimitPolicy()
+}
+
+// receivedLimitPolicy returns the received directory cap and eviction policy
+func (p *Peer) receivedLimitPolicy() (int64, EvictionPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.receivedLimit, p.eviction
+}
+
+// DiskUsage scans the shared and received directories
+func (p *Peer) DiskUsage() (DiskUsage, error) {
+	var u DiskUsage
+	limit, policy := p.receivedLimitPolicy()
+	u.ReceivedLimit, u.Eviction = limit, policy.String()
+
+	var err error
+	if u.SharedBytes, u.SharedFiles, err = dirSize(p.SharedDir()); err != nil {
+		return u, err
+	}
+	if u.ReceivedBytes, u.ReceivedFiles, err = dirSize(p.ReceivedDir()); err != nil {
+		return u, err
+	}
+
+	p.usage.mu.Lock()
+	p.usage.at, p.usage.usage = time.Now(), u
+	p.usage.mu.Unlock()
+	return u, nil
+}
+
+// cachedDiskUsage returns a recent disk usage scan, rescanning if the last
+// one is older than usageCacheTTL
+func (p *Peer) cachedDiskUsage() DiskUsage {
+	p.usage.mu.Lock()
+	if time.Since(p.usage.at) < usageCacheTTL {
+		defer p.usage.mu.Unlock()
+		return p.usage.usage
+	}
+	p.usage.mu.Unlock()
+
+	u, err := p.DiskUsage()
+	if err != nil {
+		logging.Errorf(p.logger, "Error scanning disk usage: %v", err)
+	}
+	return u
+}
+
+// dirSize returns the total size and number of the regular files under dir
+func dirSize(dir string) (int64, int, error) {
+	var size int64
+	var files int
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+			files++
+		}
+		return nil
+	})
+	return size, files, err
+}
+
+// evictionCandidate is a received file that may be removed to free space
+type evictionCandidate struct {
+	path string
+	size int64
+	used time.Time // Time the policy orders by
+}
+
+// enforceReceivedLimit removes received files until the received directory
+// fits its limit again
+// keep: File just received, which is never removed
+func (p *Peer) enforceReceivedLimit(keep string) {
+	limit, policy := p.receivedLimitPolicy()
+	if limit <= 0 {
+		return
+	}
+	p.evictMu.Lock()
+	defer p.evictMu.Unlock()
+
+	receivedDir := p.ReceivedDir()
+	var total int64
+	var candidates []evictionCandidate
+	filepath.WalkDir(receivedDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		total += info.Size()
+		if path == keep || isPartial(d.Name()) {
+			return nil
+		}
+		used := info.ModTime()
+		if policy == EvictLRU {
+			if at, ok := accessTime(info); ok && at.After(used) {
+				used = at
+			}
+		}
+		candidates = append(candidates, evictionCandidate{path: path, size: info.Size(), used: used})
+		return nil
+	})
+	if total <= limit {
+		return
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].used.Before(candidates[j].used) })
+	for _, c := range candidates {
+		if total <= limit {
+			break
+		}
+		if err := os.Remove(c.path); err != nil {
+			logging.Errorf(p.logger, "Error evicting %s: %v", c.path, err)
+			continue
+		}
+		total -= c.size
+		logging.Infof(p.logger, "Evicted %s (%d bytes) to keep the received directory under %d bytes", c.path, c.size, limit)
+	}
+	if total > limit {
+		logging.Warnf(p.logger, "Received directory holds %d bytes, over its %d byte limit, with nothing left to evict", total, limit)
+	}
+}
@@ -0,0 +1,91 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// webSeedTimeout bounds a single HTTP range request
+const webSeedTimeout = 60 * time.Second
+
+// webSeedURL returns the URL of a file on a web seed
+// As with BitTorrent web seeds, a base URL ending in "/" names a directory
+// and the file's path is appended; any other URL names the file itself
+func webSeedURL(base, name string) string {
+	if !strings.HasSuffix(base, "/") {
+		return base
+	}
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return base + strings.Join(parts, "/")
+}
+
+// httpSource fetches pieces from an HTTP(S) web seed using range requests
+type httpSource struct {
+	url    string
+	client *http.Client
+}
+
+// newHTTPSource creates a web seed source for the given file URL
+func newHTTPSource(fileURL string) *httpSource {
+	return &httpSource{
+		url:    fileURL,
+		client: &http.Client{Timeout: webSeedTimeout},
+	}
+}
+
+func (s *httpSource) String() string {
+	return "web seed " + s.url
+}
+
+func (s *httpSource) id() string {
+	return s.url
+}
+
+func (s *httpSource) webSeed() bool {
+	return true
+}
+
+// fetch downloads the byte range of one piece
+// Servers that ignore the Range header are tolerated by skipping to the
+// piece offset in the full response
+func (s *httpSource) fetch(ctx context.Context, m *protocol.Manifest, index int) ([]byte, error) {
+	offset, length := m.PieceRange(index)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			return nil, fmt.Errorf("skipping to piece %d: %v", index, err)
+		}
+	default:
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, fmt.Errorf("reading piece %d: %v", index, err)
+	}
+	return data, nil
+}
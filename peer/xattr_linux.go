@@ -0,0 +1,41 @@
+package peer
+
+import (
+	"bytes"
+	"syscall"
+)
+
+// readXattrs returns the extended attributes of a file, or nil if the
+// filesystem doesn't support them
+func readXattrs(path string) map[string][]byte {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(path, buf); err != nil {
+		return nil
+	}
+
+	attrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(path, string(name), value); err != nil {
+			continue
+		}
+		attrs[string(name)] = value[:vsize]
+	}
+	return attrs
+}
+
+// setXattr sets a single extended attribute on a file
+func setXattr(path, name string, value []byte) error {
+	return syscall.Setxattr(path, name, value, 0)
+}
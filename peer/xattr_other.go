@@ -0,0 +1,15 @@
+//go:build !linux
+
+package peer
+
+import "errors"
+
+// readXattrs is not supported on this platform
+func readXattrs(path string) map[string][]byte {
+	return nil
+}
+
+// setXattr is not supported on this platform
+func setXattr(path, name string, value []byte) error {
+	return errors.New("extended attributes not supported on this platform")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// discoveryInterval is how often a peer started with -mdns announces itself
+const discoveryInterval = 20 * time.Second
+
+// discoverWait is how long -peer waits for a peer named by ID to show up
+const discoverWait = 5 * time.Second
+
+// runPeers implements the "peers" subcommand
+// It lists the remote peers the running peer has seen or discovered on the
+// local network
+func runPeers(args []string) {
+	fs := flag.NewFlagSet("peers", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	verbose := fs.Bool("v", false, "Also list the recent connection attempts to and from each address, with why they failed")
+	fs.Parse(args)
+
+	var peers []peer.PeerInfo
+	if err := controlRequest(*addr, http.MethodGet, "/peers", nil, &peers); err != nil {
+		log.Fatal(err)
+	}
+	if !*verbose {
+		printPeers(peers)
+		return
+	}
+	var attempts map[string][]transport.ConnAttempt
+	if err := controlRequest(*addr, http.MethodGet, "/attempts", nil, &attempts); err != nil {
+		log.Fatal(err)
+	}
+	printPeerAttempts(peers, attempts)
+}
+
+// attemptsShown is how many connection attempts peers -v lists per address
+const attemptsShown = 5
+
+// printPeerAttempts renders the peers with the recent connection attempts
+// to their address and from their host under each, followed by the
+// addresses tried that belong to no peer seen, e.g. ones never reached
+func printPeerAttempts(peers []peer.PeerInfo, attempts map[string][]transport.ConnAttempt) {
+	printPeers(peers)
+	for _, info := range peers {
+		var list []transport.ConnAttempt
+		for key := range attempts {
+			if key == hostOf(info.Addr) || sameAddr(key, info.DialAddr()) {
+				list = append(list, attempts[key]...)
+				delete(attempts, key)
+			}
+		}
+		if len(list) > 0 {
+			fmt.Printf("\n%s (%s):\n", info.ID, info.DialAddr())
+			printAttempts(list)
+		}
+	}
+
+	addrs := make([]string, 0, len(attempts))
+	for addr := range attempts {
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		return attempts[addrs[i]][0].Time.After(attempts[addrs[j]][0].Time)
+	})
+	for _, addr := range addrs {
+		fmt.Printf("\n%s:\n", addr)
+		printAttempts(attempts[addr])
+	}
+}
+
+// printAttempts renders connection attempts, most recent first
+func printAttempts(list []transport.ConnAttempt) {
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	for _, a := range list[:min(len(list), attemptsShown)] {
+		dir := "out"
+		if a.Inbound {
+			dir = "in"
+		}
+		line := fmt.Sprintf("  %s %-3s %-9s %8s", a.Time.Format(time.RFC3339), dir, a.Stage, a.Duration.Round(time.Millisecond))
+		if a.Failed() {
+			if a.Cause != "" {
+				line += " " + a.Cause + ":"
+			}
+			line += " " + a.Error
+		}
+		fmt.Println(line)
+	}
+	if len(list) > attemptsShown {
+		fmt.Printf("  ... %d earlier\n", len(list)-attemptsShown)
+	}
+}
+
+// sameAddr reports whether the address dialed reaches addr, e.g.
+// localhost:3001 and 127.0.0.1:3001
+func sameAddr(dialed, addr string) bool {
+	if dialed == addr {
+		return true
+	}
+	host, port, err := net.SplitHostPort(dialed)
+	if err != nil {
+		return false
+	}
+	wantHost, wantPort, err := net.SplitHostPort(addr)
+	if err != nil || port != wantPort {
+		return false
+	}
+	ips, _ := net.LookupHost(host)
+	return slices.Contains(ips, wantHost)
+}
+
+// hostOf returns the host of a "host:port" address, or addr if it has none
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// printPeers renders the remote peers a peer has seen, one per line
+func printPeers(peers []peer.PeerInfo) {
+	if len(peers) == 0 {
+		fmt.Println("No peers seen yet")
+		return
+	}
+	for _, info := range peers {
+		how := "seen"
+		if info.Discovered {
+			how = "on the local network"
+		}
+		fmt.Printf("%-20s %-24s %s, last %s\n", info.ID, info.DialAddr(), how, info.LastSeen.Format(time.RFC3339))
+	}
+}
+
+// discoverPeers replaces the peer IDs in a comma-separated -peer list with
+// the addresses the peers advertise on the local network
+// Entries holding a ":" are taken as addresses and kept
+func discoverPeers(p *peer.Peer, list string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), discoverWait)
+	defer cancel()
+
+	entries := strings.Split(list, ",")
+	for i, entry := range entries {
+		if strings.Contains(entry, ":") {
+			continue
+		}
+		addr, err := p.DiscoverPeer(ctx, entry)
+		if err != nil {
+			return "", err
+		}
+		logging.Infof(log.Default(), "Using %s at %s", entry, addr)
+		entries[i] = addr
+	}
+	return strings.Join(entries, ","), nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// runPing implements the "ping" subcommand
+// It connects to a peer from a short-lived peer of its own, reports how
+// long the connection and its handshakes took and what the peer answered
+// about itself, then times protocol-level pings like ping(8)
+func runPing(args []string) {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	target := fs.String("peer", "", "Address of the peer to ping, e.g. localhost:3000")
+	count := fs.Int("count", 5, "Number of pings to send, 0 to ping until interrupted")
+	interval := fs.Duration("interval", time.Second, "Time between pings")
+	timeout := fs.Duration("timeout", 5*time.Second, "Time to wait for the connection and for each answer")
+	codec := fs.String("codec", protocol.CodecGob, "Message codecs to offer the peer, most preferred first: gob, json or proto")
+	fs.Parse(args)
+	if *target == "" {
+		log.Fatal("usage: ping -peer ADDR [-count N] [-interval D] [-timeout D] [-codec NAME]")
+	}
+	codecs := strings.Split(*codec, ",")
+	for _, name := range codecs {
+		if err := transport.ValidCodec(name); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "p2p-ping-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Peers prove an identity key on every connection, so the pinging
+	// peer needs one too; a fresh one keeps it from being recognised
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	id := peer.KeyID(key.Public().(ed25519.PublicKey))
+	logger := log.New(io.Discard, "", 0)
+	t := transport.NewTCPTransport("0.0.0.0:0", transport.WithLogger(logger), transport.WithCodec(codecs...))
+	p, err := peer.New(id, t.GetListenAddress(), filepath.Join(dir, "shared"), filepath.Join(dir, "received"), t,
+		peer.WithLogger(logger), peer.WithIdentityKey(key))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := p.Start(); err != nil {
+		log.Fatal(err)
+	}
+	defer p.Shutdown()
+
+	fmt.Printf("PING %s\n", *target)
+	start := time.Now()
+	if err := connectWithin(t, *target, *timeout); err != nil {
+		log.Fatalf("Could not connect to %s: %v", *target, err)
+	}
+	fmt.Printf("Connected in %v (TCP and handshakes, codec %s)\n", time.Since(start).Round(time.Microsecond), codecs[0])
+
+	var rtts []time.Duration
+	sent := 0
+	for seq := 1; *count == 0 || seq <= *count; seq++ {
+		if seq > 1 {
+			time.Sleep(*interval)
+		}
+		sent++
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		res, err := p.Ping(ctx, *target)
+		cancel()
+		if err != nil {
+			fmt.Printf("seq=%d error: %v\n", seq, err)
+			continue
+		}
+		if len(rtts) == 0 {
+			version := res.Version
+			if version == "" {
+				version = "unknown (predates version reporting)"
+			}
+			fmt.Printf("Peer:     %s\n", res.ID)
+			fmt.Printf("Version:  %s\n", version)
+			fmt.Printf("Features: %s\n", strings.Join(res.Features, ", "))
+		}
+		rtts = append(rtts, res.RTT)
+		fmt.Printf("seq=%d time=%v\n", seq, res.RTT.Round(time.Microsecond))
+	}
+
+	fmt.Printf("--- %s ping statistics ---\n", *target)
+	fmt.Printf("%d sent, %d received, %.0f%% loss\n", sent, len(rtts), 100*float64(sent-len(rtts))/float64(sent))
+	if len(rtts) == 0 {
+		os.Exit(1)
+	}
+	minRTT, avg, maxRTT, mdev := rttStats(rtts)
+	fmt.Printf("rtt min/avg/max/mdev = %v/%v/%v/%v\n", minRTT.Round(time.Microsecond), avg.Round(time.Microsecond),
+		maxRTT.Round(time.Microsecond), mdev.Round(time.Microsecond))
+}
+
+// connectWithin connects the transport to addr, giving up after timeout
+func connectWithin(t *transport.TCPTransport, addr string, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- t.ConnectToPeer(addr) }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
+
+// rttStats returns the minimum, mean, maximum and mean deviation of rtts
+func rttStats(rtts []time.Duration) (minRTT, avg, maxRTT, mdev time.Duration) {
+	minRTT, maxRTT = rtts[0], rtts[0]
+	var sum time.Duration
+	for _, d := range rtts {
+		minRTT, maxRTT = min(minRTT, d), max(maxRTT, d)
+		sum += d
+	}
+	avg = sum / time.Duration(len(rtts))
+	var dev float64
+	for _, d := range rtts {
+		dev += math.Abs(float64(d - avg))
+	}
+	return minRTT, avg, maxRTT, time.Duration(dev / float64(len(rtts)))
+}
@@ -0,0 +1,145 @@
+// Package cdc splits data into content-defined chunks with FastCDC
+// Chunk boundaries are placed where a rolling hash of the last bytes meets
+// a condition, rather than at fixed offsets, so an insertion or deletion
+// only changes the chunks around it and identical runs of data in
+// different files, or in versions of one file, produce identical chunks
+package cdc
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// Chunk sizes in bytes; chunks are at least MinSize long, except the last
+// one of a stream, at most MaxSize long, and AvgSize long on average
+const (
+	MinSize = 16 << 10
+	AvgSize = 64 << 10
+	MaxSize = 256 << 10
+)
+
+// Normalized chunking: before AvgSize a boundary needs more hash bits to be
+// zero than after it, which narrows the spread of chunk sizes around AvgSize
+const (
+	maskSmall uint64 = (1<<18 - 1) << (64 - 18)
+	maskLarge uint64 = (1<<14 - 1) << (64 - 14)
+)
+
+// gear maps every byte to a random value mixed into the rolling hash
+// It is derived from SHA-256, so every peer cuts data at the same places
+var gear [256]uint64
+
+func init() {
+	for i := range gear {
+		sum := sha256.Sum256([]byte{'c', 'd', 'c', byte(i)})
+		gear[i] = binary.BigEndian.Uint64(sum[:8])
+	}
+}
+
+// Chunk is one content-defined chunk of a stream
+type Chunk struct {
+	Offset int64
+	Length int
+	Hash   [sha256.Size]byte // SHA-256 of the chunk's data
+}
+
+// Chunker reads a stream one chunk at a time
+type Chunker struct {
+	r      io.Reader
+	buf    []byte
+	start  int   // Start of the unread data in buf
+	end    int   // End of the data read into buf
+	offset int64 // Offset in the stream of buf[start]
+	eof    bool
+}
+
+// NewChunker returns a chunker reading from r
+func NewChunker(r io.Reader) *Chunker {
+	return &Chunker{r: r, buf: make([]byte, 2*MaxSize)}
+}
+
+// Next returns the next chunk and its data, which is only valid until the
+// following call
+// Returns: io.EOF once the stream is exhausted
+func (c *Chunker) Next() (Chunk, []byte, error) {
+	if err := c.fill(); err != nil {
+		return Chunk{}, nil, err
+	}
+	if c.start == c.end {
+		return Chunk{}, nil, io.EOF
+	}
+	n := cut(c.buf[c.start:c.end])
+	data := c.buf[c.start : c.start+n]
+	chunk := Chunk{Offset: c.offset, Length: n, Hash: sha256.Sum256(data)}
+	c.start += n
+	c.offset += int64(n)
+	return chunk, data, nil
+}
+
+// fill reads until a whole MaxSize chunk is buffered or the stream ends
+func (c *Chunker) fill() error {
+	if c.eof || c.end-c.start >= MaxSize {
+		return nil
+	}
+	copy(c.buf, c.buf[c.start:c.end])
+	c.end -= c.start
+	c.start = 0
+	for c.end < len(c.buf) {
+		n, err := c.r.Read(c.buf[c.end:])
+		c.end += n
+		if errors.Is(err, io.EOF) {
+			c.eof = true
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut returns the length of the chunk at the start of data
+func cut(data []byte) int {
+	n := len(data)
+	if n <= MinSize {
+		return n
+	}
+	n = min(n, MaxSize)
+	normal := min(n, AvgSize)
+
+	var fp uint64
+	i := MinSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskSmall == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&maskLarge == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// Split chunks the whole of r, calling fn with every chunk and its data,
+// which is only valid during the call
+func Split(r io.Reader, fn func(Chunk, []byte) error) error {
+	c := NewChunker(r)
+	for {
+		chunk, data, err := c.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(chunk, data); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+	"runtime"
+	"sync"
+)
+
+// BLAKE3 parameters, see https://github.com/BLAKE3-team/BLAKE3-specs
+const (
+	blake3Size     = 32
+	blake3BlockLen = 64
+	blake3ChunkLen = 1024
+	blake3MaxDepth = 54 // Enough levels of subtrees for 2^64 bytes
+
+	// blake3ParallelChunks is the fewest chunks a goroutine is given when
+	// the chunks of a large write are hashed in parallel
+	blake3ParallelChunks = 64
+	flagChunkStart       = 1 << 0
+	flagChunkEnd         = 1 << 1
+	flagParent           = 1 << 2
+	flagRoot             = 1 << 3
+)
+
+var blake3IV = [8]uint32{
+	0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A,
+	0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19,
+}
+
+// blake3Schedule is the order message words are mixed in by each round:
+// the permutation applied once per round
+var blake3Schedule = func() (schedule [7][16]uint8) {
+	permutation := [16]uint8{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+	for i := range schedule[0] {
+		schedule[0][i] = uint8(i)
+	}
+	for r := 1; r < len(schedule); r++ {
+		for i, j := range permutation {
+			schedule[r][i] = schedule[r-1][j]
+		}
+	}
+	return schedule
+}()
+
+// blake3G mixes message words x and y into four words of the state
+func blake3G(a, b, c, d, x, y uint32) (uint32, uint32, uint32, uint32) {
+	a += b + x
+	d = bits.RotateLeft32(d^a, -16)
+	c += d
+	b = bits.RotateLeft32(b^c, -12)
+	a += b + y
+	d = bits.RotateLeft32(d^a, -8)
+	c += d
+	b = bits.RotateLeft32(b^c, -7)
+	return a, b, c, d
+}
+
+// blake3Compress runs the compression function on one block
+// Returns: The full 16-word output; its first 8 words are the new
+// chaining value
+func blake3Compress(cv *[8]uint32, m *[16]uint32, counter uint64, blockLen, flags uint32) [16]uint32 {
+	s0, s1, s2, s3, s4, s5, s6, s7 := cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7]
+	s8, s9, s10, s11 := blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3]
+	s12, s13, s14, s15 := uint32(counter), uint32(counter>>32), blockLen, flags
+	for r := range blake3Schedule {
+		w := &blake3Schedule[r]
+		s0, s4, s8, s12 = blake3G(s0, s4, s8, s12, m[w[0]], m[w[1]])
+		s1, s5, s9, s13 = blake3G(s1, s5, s9, s13, m[w[2]], m[w[3]])
+		s2, s6, s10, s14 = blake3G(s2, s6, s10, s14, m[w[4]], m[w[5]])
+		s3, s7, s11, s15 = blake3G(s3, s7, s11, s15, m[w[6]], m[w[7]])
+		s0, s5, s10, s15 = blake3G(s0, s5, s10, s15, m[w[8]], m[w[9]])
+		s1, s6, s11, s12 = blake3G(s1, s6, s11, s12, m[w[10]], m[w[11]])
+		s2, s7, s8, s13 = blake3G(s2, s7, s8, s13, m[w[12]], m[w[13]])
+		s3, s4, s9, s14 = blake3G(s3, s4, s9, s14, m[w[14]], m[w[15]])
+	}
+	return [16]uint32{
+		s0 ^ s8, s1 ^ s9, s2 ^ s10, s3 ^ s11, s4 ^ s12, s5 ^ s13, s6 ^ s14, s7 ^ s15,
+		s8 ^ cv[0], s9 ^ cv[1], s10 ^ cv[2], s11 ^ cv[3], s12 ^ cv[4], s13 ^ cv[5], s14 ^ cv[6], s15 ^ cv[7],
+	}
+}
+
+// blake3Words reads a block of up to 64 bytes as little-endian words,
+// padded with zeros
+func blake3Words(b []byte) [16]uint32 {
+	var buf [blake3BlockLen]byte
+	copy(buf[:], b)
+	var m [16]uint32
+	for i := range m {
+		m[i] = binary.LittleEndian.Uint32(buf[4*i:])
+	}
+	return m
+}
+
+// blake3Output is a compression not yet run, which becomes a chaining
+// value, or with the root flag, the hash
+type blake3Output struct {
+	cv       [8]uint32
+	block    [16]uint32
+	counter  uint64
+	blockLen uint32
+	flags    uint32
+}
+
+func (o *blake3Output) chainingValue() [8]uint32 {
+	out := blake3Compress(&o.cv, &o.block, o.counter, o.blockLen, o.flags)
+	return [8]uint32(out[:8])
+}
+
+func (o *blake3Output) root() [blake3Size]byte {
+	out := blake3Compress(&o.cv, &o.block, 0, o.blockLen, o.flags|flagRoot)
+	var sum [blake3Size]byte
+	for i := 0; i < 8; i++ {
+		binary.LittleEndian.PutUint32(sum[4*i:], out[i])
+	}
+	return sum
+}
+
+// blake3Parent is the output joining the chaining values of two subtrees
+func blake3Parent(left, right [8]uint32) blake3Output {
+	o := blake3Output{cv: blake3IV, blockLen: blake3BlockLen, flags: flagParent}
+	copy(o.block[:8], left[:])
+	copy(o.block[8:], right[:])
+	return o
+}
+
+// blake3Digest hashes data with BLAKE3, one 1 KiB chunk at a time, keeping
+// the chaining values of complete subtrees on a stack
+type blake3Digest struct {
+	stack    [blake3MaxDepth][8]uint32
+	depth    int
+	chunks   uint64 // Chunks completed
+	cv       [8]uint32
+	block    [blake3BlockLen]byte
+	blockLen int
+	blocks   int // Blocks of the current chunk compressed
+}
+
+// NewBLAKE3 returns a hash.Hash computing the 32-byte BLAKE3 hash
+func NewBLAKE3() hash.Hash {
+	d := &blake3Digest{}
+	d.Reset()
+	return d
+}
+
+func (d *blake3Digest) Size() int      { return blake3Size }
+func (d *blake3Digest) BlockSize() int { return blake3BlockLen }
+
+func (d *blake3Digest) Reset() {
+	*d = blake3Digest{cv: blake3IV}
+}
+
+// chunkFlags returns the flags of the current chunk's next block
+func (d *blake3Digest) chunkFlags() uint32 {
+	if d.blocks == 0 {
+		return flagChunkStart
+	}
+	return 0
+}
+
+func (d *blake3Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// A full block is only compressed once more input follows, as
+		// the last block of a chunk is compressed differently
+		if d.blockLen == blake3BlockLen {
+			if d.blocks == blake3ChunkLen/blake3BlockLen-1 {
+				d.endChunk()
+			} else {
+				m := blake3Words(d.block[:])
+				out := blake3Compress(&d.cv, &m, d.chunks, blake3BlockLen, d.chunkFlags())
+				d.cv = [8]uint32(out[:8])
+				d.blocks++
+				d.blockLen = 0
+			}
+		}
+		// Whole chunks with more input after them are hashed straight
+		// from p, in parallel when there are many
+		if d.blockLen == 0 && d.blocks == 0 && len(p) > blake3ChunkLen {
+			whole := (len(p) - 1) / blake3ChunkLen * blake3ChunkLen
+			for _, cv := range blake3Chunks(p[:whole], d.chunks) {
+				d.addChunk(cv)
+			}
+			p = p[whole:]
+		}
+		k := copy(d.block[d.blockLen:], p)
+		d.blockLen += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// blake3Chunks hashes whole chunks that are not the last of the input,
+// spreading them over the available CPUs
+// counter: Index of the first chunk in the input
+// Returns: The chaining value of each chunk
+func blake3Chunks(data []byte, counter uint64) [][8]uint32 {
+	cvs := make([][8]uint32, len(data)/blake3ChunkLen)
+	hash := func(from, to int) {
+		for i := from; i < to; i++ {
+			cvs[i] = blake3ChunkCV(data[i*blake3ChunkLen:(i+1)*blake3ChunkLen], counter+uint64(i))
+		}
+	}
+	workers := min(runtime.GOMAXPROCS(0), len(cvs)/blake3ParallelChunks)
+	if workers <= 1 {
+		hash(0, len(cvs))
+		return cvs
+	}
+	var wg sync.WaitGroup
+	per := (len(cvs) + workers - 1) / workers
+	for from := 0; from < len(cvs); from += per {
+		wg.Add(1)
+		go func(from, to int) {
+			defer wg.Done()
+			hash(from, to)
+		}(from, min(from+per, len(cvs)))
+	}
+	wg.Wait()
+	return cvs
+}
+
+// blake3ChunkCV hashes a whole chunk that is not the root of the tree
+func blake3ChunkCV(chunk []byte, counter uint64) [8]uint32 {
+	cv := blake3IV
+	last := blake3ChunkLen/blake3BlockLen - 1
+	for b := 0; b <= last; b++ {
+		var flags uint32
+		if b == 0 {
+			flags = flagChunkStart
+		}
+		if b == last {
+			flags |= flagChunkEnd
+		}
+		m := blake3Words(chunk[b*blake3BlockLen : (b+1)*blake3BlockLen])
+		out := blake3Compress(&cv, &m, counter, blake3BlockLen, flags)
+		cv = [8]uint32(out[:8])
+	}
+	return cv
+}
+
+// chunkOutput returns the output of the current chunk's last block
+func (d *blake3Digest) chunkOutput() blake3Output {
+	return blake3Output{
+		cv:       d.cv,
+		block:    blake3Words(d.block[:d.blockLen]),
+		counter:  d.chunks,
+		blockLen: uint32(d.blockLen),
+		flags:    d.chunkFlags() | flagChunkEnd,
+	}
+}
+
+// endChunk finishes the buffered chunk, once it's complete and more
+// input follows, and starts the next one
+func (d *blake3Digest) endChunk() {
+	out := d.chunkOutput()
+	d.addChunk(out.chainingValue())
+	d.cv, d.blockLen, d.blocks = blake3IV, 0, 0
+}
+
+// addChunk adds the chaining value of the next chunk to the stack,
+// merging the subtrees it completes
+func (d *blake3Digest) addChunk(cv [8]uint32) {
+	d.chunks++
+	for total := d.chunks; total&1 == 0; total >>= 1 {
+		d.depth--
+		parent := blake3Parent(d.stack[d.depth], cv)
+		cv = parent.chainingValue()
+	}
+	d.stack[d.depth] = cv
+	d.depth++
+}
+
+func (d *blake3Digest) Sum(b []byte) []byte {
+	out := d.chunkOutput()
+	for i := d.depth - 1; i >= 0; i-- {
+		out = blake3Parent(d.stack[i], out.chainingValue())
+	}
+	sum := out.root()
+	return append(b, sum[:]...)
+}
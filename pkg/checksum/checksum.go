@@ -0,0 +1,119 @@
+// Package checksum provides the hash algorithms transfers are checked
+// with behind one interface, and picks the one two peers agree on
+// SHA-256 is the default and what peers that don't negotiate use; BLAKE3
+// is also cryptographic and much faster in software; xxHash64 is faster
+// still but only catches corruption, not content forged to match
+package checksum
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+)
+
+// Names of the algorithms on the wire
+const (
+	SHA256 = "sha256"
+	BLAKE3 = "blake3"
+	XXH64  = "xxh64"
+)
+
+// Hasher is a hash algorithm a transfer can be checked with
+type Hasher interface {
+	// Name identifies the algorithm on the wire, e.g. "sha256"
+	Name() string
+	// New starts a new checksum
+	New() hash.Hash
+	// Cryptographic reports whether the algorithm resists content made to
+	// match a checksum, rather than only catching accidental damage
+	Cryptographic() bool
+}
+
+type hasher struct {
+	name   string
+	newFn  func() hash.Hash
+	crypto bool
+}
+
+func (h hasher) Name() string        { return h.name }
+func (h hasher) New() hash.Hash      { return h.newFn() }
+func (h hasher) Cryptographic() bool { return h.crypto }
+func (h hasher) String() string      { return h.name }
+
+// hashers are the supported algorithms, by name
+var hashers = map[string]Hasher{
+	SHA256: hasher{SHA256, sha256.New, true},
+	BLAKE3: hasher{BLAKE3, NewBLAKE3, true},
+	XXH64:  hasher{XXH64, NewXXH64, false},
+}
+
+// Default is the algorithm used when none is negotiated
+var Default = hashers[SHA256]
+
+// Lookup returns the algorithm with a wire name; the empty name, sent by
+// peers that don't negotiate, stands for SHA-256
+func Lookup(name string) (Hasher, error) {
+	if name == "" {
+		return Default, nil
+	}
+	h, ok := hashers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown hash algorithm %q, want one of %s", name, strings.Join(Names(), ", "))
+	}
+	return h, nil
+}
+
+// Names returns the wire names of the supported algorithms, sorted
+func Names() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// Parse reads a comma-separated list of algorithm names, most preferred
+// first, as given on the command line
+func Parse(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, err := Lookup(name); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Negotiate picks the algorithm for a transfer: the first one the
+// requester offers that the sender accepts, or SHA-256, which every peer
+// supports, if there is none
+// offered: The requester's algorithms, most preferred first
+// accepted: The sender's algorithms; empty accepts every supported one
+func Negotiate(offered, accepted []string) Hasher {
+	for _, name := range offered {
+		h, ok := hashers[name]
+		if ok && (len(accepted) == 0 || slices.Contains(accepted, name)) {
+			return h
+		}
+	}
+	return Default
+}
+
+// Preferred returns the algorithm a requester offering these algorithms
+// likes best, the one it hashes what it already holds with to resume
+func Preferred(offered []string) string {
+	if len(offered) == 0 {
+		return SHA256
+	}
+	return offered[0]
+}
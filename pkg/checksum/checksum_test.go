@@ -0,0 +1,107 @@
+package checksum
+
+import (
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+// vectorInput is the input of the BLAKE3 reference test vectors: n bytes
+// counting up modulo 251
+func vectorInput(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251)
+	}
+	return b
+}
+
+// vectors are the digests of vectorInput by the reference BLAKE3 and
+// xxHash64 implementations, at lengths around block, chunk and tree edges
+var vectors = []struct {
+	n      int
+	blake3 string
+	xxh64  string
+}{
+	{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262", "ef46db3751d8e999"},
+	{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213", "e934a84adb052768"},
+	{63, "e9bc37a594daad83be9470df7f7b3798297c3d834ce80ba85d6e207627b7db7b", "e26aa9e2a95f8e4f"},
+	{64, "4eed7141ea4a5cd4b788606bd23f46e212af9cacebacdc7d1f4c6dc7f2511b98", "f7c67301db6713f0"},
+	{65, "de1e5fa0be70df6d2be8fffd0e99ceaa8eb6e8c93a63f2d8d1c30ecb6b263dee", "c31eb63b2ae4465b"},
+	{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11", "d66738f081c25cf4"},
+	{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7", "138e26c65048ce29"},
+	{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444", "cfd73aedd2d6a39d"},
+	{2048, "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a", "a69e05a7eff57800"},
+	{2049, "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030", "27858160679416ba"},
+	{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3", "9805379a726bf789"},
+	{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b", "755e4befd10cccf4"},
+	{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47", "5fd04299cacedf8a"},
+	{102400, "bc3e3d41a1146b069abffad3c0d44860cf664390afce4d9661f7902e7943e085", "eb1adcdd9e1369a6"},
+}
+
+// sum hashes data with h, written in pieces of step bytes
+func sum(h hash.Hash, data []byte, step int) string {
+	for len(data) > 0 {
+		n := min(step, len(data))
+		h.Write(data[:n])
+		data = data[n:]
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func TestVectors(t *testing.T) {
+	for _, v := range vectors {
+		data := vectorInput(v.n)
+		// Whole, and split unevenly across blocks and chunks
+		for _, step := range []int{len(data) + 1, 1, 7, 100, 1500} {
+			if got := sum(NewBLAKE3(), data, step); got != v.blake3 {
+				t.Errorf("BLAKE3 of %d bytes in writes of %d = %s, want %s", v.n, step, got, v.blake3)
+			}
+			if got := sum(NewXXH64(), data, step); got != v.xxh64 {
+				t.Errorf("xxh64 of %d bytes in writes of %d = %s, want %s", v.n, step, got, v.xxh64)
+			}
+		}
+	}
+}
+
+func TestSumKeepsState(t *testing.T) {
+	data := vectorInput(3073)
+	for _, name := range []string{BLAKE3, XXH64} {
+		h, _ := Lookup(name)
+		d := h.New()
+		d.Write(data[:2000])
+		d.Sum(nil)
+		d.Write(data[2000:])
+		if got, want := hex.EncodeToString(d.Sum(nil)), sum(h.New(), data, len(data)); got != want {
+			t.Errorf("%s: Sum changed the state", name)
+		}
+		d.Reset()
+		if got, want := hex.EncodeToString(d.Sum(nil)), sum(h.New(), nil, 1); got != want {
+			t.Errorf("%s: Reset left state behind", name)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	names, err := Parse("XXH64, blake3, xxh64")
+	if err != nil || len(names) != 2 || names[0] != XXH64 || names[1] != BLAKE3 {
+		t.Fatalf("Parse = %q, %v", names, err)
+	}
+	if _, err := Parse("md5"); err == nil {
+		t.Fatal("Parse accepted md5")
+	}
+	tests := []struct {
+		offered, accepted []string
+		want              string
+	}{
+		{nil, nil, SHA256},
+		{[]string{XXH64, BLAKE3}, nil, XXH64},
+		{[]string{XXH64, BLAKE3}, []string{BLAKE3, SHA256}, BLAKE3},
+		{[]string{"md5", XXH64}, []string{SHA256}, SHA256},
+	}
+	for _, tt := range tests {
+		if got := Negotiate(tt.offered, tt.accepted).Name(); got != tt.want {
+			t.Errorf("Negotiate(%q, %q) = %s, want %s", tt.offered, tt.accepted, got, tt.want)
+		}
+	}
+}
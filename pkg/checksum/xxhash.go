@@ -0,0 +1,112 @@
+package checksum
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// xxHash64 primes, see https://github.com/Cyan4973/xxHash
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64Digest computes xxHash64 with seed 0, 32 bytes at a time
+type xxh64Digest struct {
+	v     [4]uint64
+	total uint64
+	buf   [32]byte
+	n     int // Bytes in buf
+}
+
+// NewXXH64 returns a hash.Hash computing the 8-byte xxHash64, big-endian
+// like the reference tool prints it
+func NewXXH64() hash.Hash {
+	d := &xxh64Digest{}
+	d.Reset()
+	return d
+}
+
+func (d *xxh64Digest) Size() int      { return 8 }
+func (d *xxh64Digest) BlockSize() int { return 32 }
+
+func (d *xxh64Digest) Reset() {
+	p1, p2 := xxPrime1, xxPrime2 // Variables, as the sums wrap around
+	*d = xxh64Digest{v: [4]uint64{p1 + p2, p2, 0, -p1}}
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	return bits.RotateLeft64(acc, 31) * xxPrime1
+}
+
+func xxMerge(acc, v uint64) uint64 {
+	acc ^= xxRound(0, v)
+	return acc*xxPrime1 + xxPrime4
+}
+
+// stripe mixes 32 bytes into the accumulators
+func (d *xxh64Digest) stripe(b []byte) {
+	for i := range d.v {
+		d.v[i] = xxRound(d.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (d *xxh64Digest) Write(p []byte) (int, error) {
+	n := len(p)
+	d.total += uint64(n)
+	if d.n > 0 {
+		k := copy(d.buf[d.n:], p)
+		d.n += k
+		p = p[k:]
+		if d.n < len(d.buf) {
+			return n, nil
+		}
+		d.stripe(d.buf[:])
+		d.n = 0
+	}
+	for ; len(p) >= 32; p = p[32:] {
+		d.stripe(p)
+	}
+	d.n = copy(d.buf[:], p)
+	return n, nil
+}
+
+func (d *xxh64Digest) Sum(b []byte) []byte {
+	var h uint64
+	if d.total >= 32 {
+		h = bits.RotateLeft64(d.v[0], 1) + bits.RotateLeft64(d.v[1], 7) +
+			bits.RotateLeft64(d.v[2], 12) + bits.RotateLeft64(d.v[3], 18)
+		for _, v := range d.v {
+			h = xxMerge(h, v)
+		}
+	} else {
+		h = xxPrime5
+	}
+	h += d.total
+
+	p := d.buf[:d.n]
+	for ; len(p) >= 8; p = p[8:] {
+		h ^= xxRound(0, binary.LittleEndian.Uint64(p))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(p) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(p)) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		p = p[4:]
+	}
+	for _, c := range p {
+		h ^= uint64(c) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return binary.BigEndian.AppendUint64(b, h)
+}
@@ -0,0 +1,121 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+var errCorrupt = errors.New("zstd: corrupt input")
+
+// forwardReader reads a bit stream least significant bit first, as FSE
+// table descriptions are written
+type forwardReader struct {
+	data []byte
+	pos  int // Bits read
+}
+
+func (r *forwardReader) read(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		byteIdx := (r.pos + int(i)) >> 3
+		if byteIdx < len(r.data) && r.data[byteIdx]>>(uint(r.pos+int(i))&7)&1 != 0 {
+			v |= 1 << i
+		}
+	}
+	r.pos += int(n)
+	return v
+}
+
+// bytesRead returns the number of bytes the bits read so far span
+func (r *forwardReader) bytesRead() int {
+	return (r.pos + 7) >> 3
+}
+
+// backwardReader reads a bit stream from its end, most significant bit
+// first, as FSE and Huffman coded streams are read. The stream ends in a
+// byte whose highest set bit marks where the first bit read follows
+type backwardReader struct {
+	data []byte
+	pos  int // Bits left to read; negative once reads ran past the start
+}
+
+func newBackwardReader(data []byte) (*backwardReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errCorrupt
+	}
+	last := data[len(data)-1]
+	return &backwardReader{data: data, pos: (len(data)-1)*8 + bits.Len8(last) - 1}, nil
+}
+
+// read reads n bits, which are zero once past the start of the stream
+func (r *backwardReader) read(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	r.pos -= int(n)
+	return r.bitsAt(r.pos, n)
+}
+
+// peek returns the next n bits without reading them
+func (r *backwardReader) peek(n uint) uint64 {
+	return r.bitsAt(r.pos-int(n), n)
+}
+
+// bitsAt returns n (at most 56) bits from bit position start up
+func (r *backwardReader) bitsAt(start int, n uint) uint64 {
+	if start < 0 {
+		if start+int(n) <= 0 {
+			return 0
+		}
+		return r.bitsAt(0, uint(start+int(n))) << uint(-start)
+	}
+	i := start >> 3
+	var v uint64
+	if i+8 <= len(r.data) {
+		v = binary.LittleEndian.Uint64(r.data[i:])
+	} else {
+		for j := len(r.data) - 1; j >= i; j-- {
+			v = v<<8 | uint64(r.data[j])
+		}
+	}
+	return v >> uint(start&7) & (1<<n - 1)
+}
+
+// overflowed reports whether reads ran past the start of the stream
+func (r *backwardReader) overflowed() bool {
+	return r.pos < 0
+}
+
+// finished reports whether the stream was read exactly to its start
+func (r *backwardReader) finished() bool {
+	return r.pos == 0
+}
+
+// bitWriter writes a bit stream least significant bit first, closed with
+// the marker backwardReader looks for
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// add writes the low n (at most 32) bits of v
+func (w *bitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close writes the end marker and returns the stream
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
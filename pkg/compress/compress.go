@@ -0,0 +1,128 @@
+// Package compress compresses file payloads on the wire: gzip, and
+// Zstandard (RFC 8878) implemented here so the module needs no outside
+// dependency. Peers offer the algorithms they can decompress in their
+// requests, and the sender picks one, see Negotiate
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// Algorithms, named as they are offered on the wire
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// minSize is the smallest payload worth compressing
+const minSize = 512
+
+// ErrTooLarge is returned by Decompress for payloads that would grow past
+// the size allowed
+var ErrTooLarge = errors.New("decompressed payload is larger than allowed")
+
+// Names returns every algorithm this package implements, most preferred first
+func Names() []string {
+	return []string{Zstd, Gzip}
+}
+
+// Valid checks that an algorithm is implemented
+func Valid(name string) error {
+	if !slices.Contains(Names(), name) {
+		return fmt.Errorf("unknown compression %q, want one of %s", name, strings.Join(Names(), ", "))
+	}
+	return nil
+}
+
+// Parse reads a comma-separated list of algorithm names, most preferred
+// first, as given on the command line
+func Parse(list string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if err := Valid(name); err != nil {
+			return nil, err
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Negotiate picks the algorithm a sender compresses a payload with: the
+// first one the requester offers that the sender accepts
+// offered: The requester's algorithms, most preferred first
+// accepted: The sender's algorithms; empty accepts every implemented one
+// Returns: The algorithm, empty if there is none
+func Negotiate(offered, accepted []string) string {
+	for _, name := range offered {
+		if Valid(name) == nil && (len(accepted) == 0 || slices.Contains(accepted, name)) {
+			return name
+		}
+	}
+	return ""
+}
+
+// Compress compresses data with an algorithm
+// Returns: The compressed data, or data itself with an empty name when it
+// is too small or doesn't shrink, so that it's better sent as it is
+func Compress(name string, data []byte) ([]byte, string, error) {
+	if name == "" || len(data) < minSize {
+		return data, "", nil
+	}
+	var out []byte
+	switch name {
+	case Gzip:
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		zw.Write(data)
+		if err := zw.Close(); err != nil {
+			return nil, "", err
+		}
+		out = buf.Bytes()
+	case Zstd:
+		out = zstdCompress(data)
+	default:
+		return nil, "", Valid(name)
+	}
+	if len(out) >= len(data) {
+		return data, "", nil
+	}
+	return out, name, nil
+}
+
+// Decompress reverses Compress
+// name: The algorithm data was compressed with, empty if it wasn't
+// maxSize: Size the decompressed data may not exceed
+func Decompress(name string, data []byte, maxSize int64) ([]byte, error) {
+	switch name {
+	case "":
+		return data, nil
+	case Gzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %v", err)
+		}
+		out, err := io.ReadAll(io.LimitReader(zr, maxSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %v", err)
+		}
+		if int64(len(out)) > maxSize {
+			return nil, ErrTooLarge
+		}
+		return out, nil
+	case Zstd:
+		return zstdDecompress(data, maxSize)
+	}
+	return nil, Valid(name)
+}
@@ -0,0 +1,164 @@
+package compress
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// samples returns payloads exercising runs, repeats, skewed literals and
+// incompressible data
+func samples() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 200<<10)
+	rnd.Read(random)
+	skewed := make([]byte, 300<<10)
+	for i := range skewed {
+		skewed[i] = "aaaabbc d\n"[rnd.Intn(10)]
+	}
+	var text bytes.Buffer
+	for i := 0; text.Len() < 1<<20; i++ {
+		text.WriteString("line ")
+		text.WriteString(string(rune('a' + i%26)))
+		text.WriteString(" of a log file that repeats itself\n")
+	}
+	return map[string][]byte{
+		"run":    bytes.Repeat([]byte{'x'}, 256<<10),
+		"text":   text.Bytes(),
+		"skewed": skewed,
+		"random": random,
+		"small":  bytes.Repeat([]byte("ab"), minSize),
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, algo := range Names() {
+		for name, data := range samples() {
+			out, used, err := Compress(algo, data)
+			if err != nil {
+				t.Fatalf("%s %s: %v", algo, name, err)
+			}
+			if used == "" {
+				if name != "random" {
+					t.Errorf("%s %s: sent uncompressed", algo, name)
+				}
+				continue
+			}
+			got, err := Decompress(used, out, int64(len(data)))
+			if err != nil {
+				t.Fatalf("%s %s: %v", algo, name, err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatalf("%s %s: round trip differs", algo, name)
+			}
+		}
+	}
+}
+
+// zstdVectors were compressed by the reference zstd from zstdVectorText,
+// at level 19 without a checksum and at level 1 with one
+var zstdVectors = []string{
+	"28b52ffd6026085d070062cd2017804d3a000020882f388619d091bd654a29a9" +
+		"f01840a503ca7b4ef3d5e92fffbdf9eea44f311d97f1cbbe6bb31e4d7391afd4" +
+		"a73565752fb9d59ef55a2a15ee900cabf8d3664b921b8958ca7e66b3d6f8cdd4" +
+		"22bfcd5b1585e7cc18aaaaffb6db92dc06602408021a2c8bc42170680428a060" +
+		"4c10858061914496c963810408b22c8e8083a811a0fafe9f01d01bd506112004" +
+		"b38c3022b0cd3ecb8202b44570865608a2565040b50812744150a22a406a0905" +
+		"680b820a3103f80420df7f52fc0bed3fc19fd07e32fa0be53b397e1238b1fa6b" +
+		"291e28396035e247d00fa12fa8363126ba4e00a902",
+	"28b52ffd642608cd0700624d21199029e908e45b2bd2e7ddaf67a63b7b6f9952" +
+		"4ab268ffa2c005e62d27f9eaf497ffde7c77d2674cc545fcb2efdaac47d35ce4" +
+		"9bbab4a4acee25b7dab35e4ba5e10a89b08a3f6db6244762d5fed96b476e1bd1" +
+		"6abbb71ac352460855d57fdb6d496e3bce5118120801000a38078883714030c8" +
+		"30482c0a060c82b3a0701609e730e8384711808ca831b8beff6fb0334a1e112c" +
+		"9388a0086cd2071a063a09814622d40da9893e23a049087412025927447db201" +
+		"4d46409310e84439a0e59701c28af00780f4227cfc6f2f1947efa29d8aa127d1" +
+		"4ec4d07368a76166e18ef0910ff20582312bb002dc9ebebc7e79ddfaba753858" +
+		"926d159110005e",
+}
+
+func zstdVectorText() []byte {
+	var b bytes.Buffer
+	for i := 0; i < 60; i++ {
+		fmt.Fprintf(&b, "peer%d requested chunk %d of file_%d.bin\n", i%7, i, i%13)
+	}
+	return b.Bytes()
+}
+
+func TestZstdReferenceFrames(t *testing.T) {
+	want := zstdVectorText()
+	for i, v := range zstdVectors {
+		frame, err := hex.DecodeString(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decompress(Zstd, frame, int64(len(want)))
+		if err != nil {
+			t.Fatalf("vector %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("vector %d: got %q", i, got)
+		}
+	}
+}
+
+func TestDecompressTooLarge(t *testing.T) {
+	data := bytes.Repeat([]byte{'x'}, 64<<10)
+	for _, algo := range Names() {
+		out, used, err := Compress(algo, data)
+		if err != nil || used != algo {
+			t.Fatalf("%s: %q, %v", algo, used, err)
+		}
+		if _, err := Decompress(used, out, int64(len(data)-1)); !errors.Is(err, ErrTooLarge) {
+			t.Errorf("%s: got %v, want ErrTooLarge", algo, err)
+		}
+	}
+}
+
+func TestZstdCorrupt(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	for name, data := range samples() {
+		out, used, _ := Compress(Zstd, data)
+		if used != Zstd {
+			continue
+		}
+		for i := 0; i < 200; i++ {
+			bad := bytes.Clone(out)
+			switch i % 3 {
+			case 0:
+				bad[rnd.Intn(len(bad))] ^= byte(1 + rnd.Intn(255))
+			case 1:
+				bad = bad[:rnd.Intn(len(bad))]
+			case 2:
+				for j := 0; j < 8; j++ {
+					bad[rnd.Intn(len(bad))] = byte(rnd.Intn(256))
+				}
+			}
+			// Damage needn't be detected, as the file checksum catches it,
+			// but must neither panic nor exceed the size allowed
+			got, err := Decompress(Zstd, bad, int64(len(data)))
+			if err == nil && len(got) > len(data) {
+				t.Fatalf("%s: %d bytes decompressed, more than the %d allowed", name, len(got), len(data))
+			}
+		}
+	}
+}
+
+func TestParseNegotiate(t *testing.T) {
+	names, err := Parse(" ZSTD, gzip,zstd,")
+	if err != nil || len(names) != 2 || names[0] != Zstd || names[1] != Gzip {
+		t.Fatalf("Parse = %q, %v", names, err)
+	}
+	if _, err := Parse("zstd,lz4"); err == nil {
+		t.Fatal("Parse accepted lz4")
+	}
+	if got := Negotiate([]string{"lz4", Gzip, Zstd}, []string{Zstd}); got != Zstd {
+		t.Fatalf("Negotiate = %q, want zstd", got)
+	}
+	if got := Negotiate([]string{Gzip}, []string{Zstd}); got != "" {
+		t.Fatalf("Negotiate = %q, want none", got)
+	}
+}
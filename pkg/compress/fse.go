@@ -0,0 +1,323 @@
+package compress
+
+import (
+	"math"
+	"math/bits"
+)
+
+// fseEntry is one state of an FSE decoding table
+type fseEntry struct {
+	symbol   uint8
+	nbBits   uint8  // Bits read to move to the next state
+	baseline uint16 // Added to them
+}
+
+// fseTable is an FSE decoding table
+type fseTable struct {
+	log     uint
+	entries []fseEntry
+}
+
+// fseSpread returns the symbol of each state of a table with the given
+// normalized counts, where -1 stands for a probability below 1
+func fseSpread(norm []int16, log uint) []uint8 {
+	size := 1 << log
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, n := range norm {
+		if n == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	step := size>>1 + size>>3 + 3
+	mask := size - 1
+	pos := 0
+	for s, n := range norm {
+		for i := 0; i < int(n); i++ {
+			symbols[pos] = uint8(s)
+			pos = (pos + step) & mask
+			for pos > high {
+				pos = (pos + step) & mask
+			}
+		}
+	}
+	return symbols
+}
+
+// newFSETable builds the decoding table for normalized counts
+func newFSETable(norm []int16, log uint) *fseTable {
+	size := 1 << log
+	symbols := fseSpread(norm, log)
+	next := make([]int, len(norm))
+	for s, n := range norm {
+		if n == -1 {
+			next[s] = 1
+		} else {
+			next[s] = int(n)
+		}
+	}
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+	for u, s := range symbols {
+		state := next[s]
+		next[s]++
+		nb := log - uint(bits.Len(uint(state))-1)
+		t.entries[u] = fseEntry{symbol: s, nbBits: uint8(nb), baseline: uint16(state<<nb - size)}
+	}
+	return t
+}
+
+// rleFSETable is the table of a stream that repeats one symbol
+func rleFSETable(symbol uint8) *fseTable {
+	return &fseTable{entries: []fseEntry{{symbol: symbol}}}
+}
+
+// readFSETable reads an FSE table description
+// maxSymbol: Largest symbol the table may code
+// maxLog: Largest accuracy log it may have
+// Returns: The table and the bytes the description took
+func readFSETable(data []byte, maxSymbol int, maxLog uint) (*fseTable, int, error) {
+	r := &forwardReader{data: data}
+	log := uint(r.read(4)) + 5
+	if log > maxLog {
+		return nil, 0, errCorrupt
+	}
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	var norm []int16
+	for remaining > 1 {
+		if len(norm) > maxSymbol || r.bytesRead() > len(data) {
+			return nil, 0, errCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		var count int
+		low := int(r.read(nbBits - 1))
+		if low < max {
+			count = low
+		} else {
+			count = low | int(r.read(1))<<(nbBits-1)
+			if count >= threshold {
+				count -= max
+			}
+		}
+		count--
+		if count < 0 {
+			remaining--
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		for remaining < threshold && threshold > 1 {
+			nbBits--
+			threshold >>= 1
+		}
+		if count == 0 {
+			// Runs of further zeros follow in 2 bit fields, 3 meaning more
+			for {
+				repeat := int(r.read(2))
+				for i := 0; i < repeat; i++ {
+					norm = append(norm, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+		}
+	}
+	if remaining != 1 || len(norm) > maxSymbol+1 || r.bytesRead() > len(data) {
+		return nil, 0, errCorrupt
+	}
+	return newFSETable(norm, log), r.bytesRead(), nil
+}
+
+// fseEncTable is an FSE encoding table
+type fseEncTable struct {
+	log        uint
+	states     []uint16
+	deltaBits  []int32 // Per symbol, from which the bits to write follow
+	deltaState []int32 // Per symbol, where its next states start in states
+}
+
+// newFSEEncTable builds the encoding table for normalized counts, the
+// counterpart of newFSETable
+func newFSEEncTable(norm []int16, log uint) *fseEncTable {
+	size := 1 << log
+	t := &fseEncTable{log: log, states: make([]uint16, size), deltaBits: make([]int32, len(norm)), deltaState: make([]int32, len(norm))}
+	cumul := make([]int, len(norm)+1)
+	for s, n := range norm {
+		cumul[s+1] = cumul[s] + max(int(n), 0)
+		if n == -1 {
+			cumul[s+1]++
+		}
+	}
+	for u, s := range fseSpread(norm, log) {
+		t.states[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := int32(0)
+	for s, n := range norm {
+		switch n {
+		case 0:
+			t.deltaBits[s] = int32(log+1)<<16 - int32(size)
+		case -1, 1:
+			t.deltaBits[s] = int32(log)<<16 - int32(size)
+			t.deltaState[s] = total - 1
+			total++
+		default:
+			maxBitsOut := int32(log) - int32(highBit(uint32(n-1)))
+			t.deltaBits[s] = maxBitsOut<<16 - int32(n)<<maxBitsOut
+			t.deltaState[s] = total - int32(n)
+			total += int32(n)
+		}
+	}
+	return t
+}
+
+// fseState is the state of an FSE encoder, which writes nothing without
+// a table: the stream then repeats a single symbol
+type fseState struct {
+	t     *fseEncTable
+	value int32
+}
+
+// init starts encoding with the last symbol of a stream
+func (st *fseState) init(t *fseEncTable, symbol uint8) {
+	st.t = t
+	if t == nil {
+		return
+	}
+	nb := (t.deltaBits[symbol] + 1<<15) >> 16
+	v := nb<<16 - t.deltaBits[symbol]
+	st.value = int32(t.states[v>>nb+t.deltaState[symbol]])
+}
+
+// encode writes the bits that lead from symbol to the one encoded before it
+func (st *fseState) encode(w *bitWriter, symbol uint8) {
+	if st.t == nil {
+		return
+	}
+	nb := (st.value + st.t.deltaBits[symbol]) >> 16
+	w.add(uint64(st.value), uint(nb))
+	st.value = int32(st.t.states[st.value>>nb+st.t.deltaState[symbol]])
+}
+
+// flush writes the state the decoder starts from
+func (st *fseState) flush(w *bitWriter) {
+	if st.t == nil {
+		return
+	}
+	w.add(uint64(st.value), st.t.log)
+}
+
+// fseTableLog picks the accuracy log of a table for n symbols no larger
+// than maxSymbol
+func fseTableLog(maxLog uint, n int, maxSymbol int) uint {
+	log := int(maxLog)
+	if b := bits.Len32(uint32(max(n-1, 1))) - 3; b < log {
+		log = b
+	}
+	if b := min(bits.Len32(uint32(n)), bits.Len32(uint32(max(maxSymbol, 1)))+1); b > log {
+		log = b
+	}
+	return uint(min(max(log, 5), int(maxLog)))
+}
+
+// fseNormalize scales symbol counts to a total of 1<<log, keeping every
+// symbol that occurs
+func fseNormalize(counts []int, log uint) []int16 {
+	total := 0
+	for _, c := range counts {
+		total += c
+	}
+	size := 1 << log
+	norm := make([]int16, len(counts))
+	sum := 0
+	for s, c := range counts {
+		if c > 0 {
+			norm[s] = int16(max(1, (c*size+total/2)/total))
+			sum += int(norm[s])
+		}
+	}
+	// Settle rounding on the most frequent symbols
+	for sum != size {
+		big := 0
+		for s, n := range norm {
+			if n > norm[big] {
+				big = s
+			}
+		}
+		if sum > size {
+			norm[big]--
+			sum--
+		} else {
+			norm[big]++
+			sum++
+		}
+	}
+	return norm
+}
+
+// fseCost estimates the bits coding symbol counts with a table takes
+func fseCost(counts []int, norm []int16, log uint) float64 {
+	bits := 0.0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		if s >= len(norm) || norm[s] == 0 {
+			return math.Inf(1)
+		}
+		bits += float64(c) * (float64(log) - math.Log2(math.Abs(float64(norm[s]))))
+	}
+	return bits
+}
+
+// appendFSETable appends the description of a table, which readFSETable
+// reads back
+func appendFSETable(out []byte, norm []int16, log uint) []byte {
+	w := &bitWriter{out: out}
+	w.add(uint64(log-5), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := log + 1
+	previous0 := false
+	for s := 0; s < len(norm) && remaining > 1; {
+		if previous0 {
+			start := s
+			for s < len(norm) && norm[s] == 0 {
+				s++
+			}
+			for ; s >= start+3; start += 3 {
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+		count := int(norm[s])
+		s++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			w.add(uint64(count), nbBits-1)
+		} else {
+			w.add(uint64(count), nbBits)
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
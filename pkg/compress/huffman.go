@@ -0,0 +1,318 @@
+package compress
+
+import (
+	"math/bits"
+	"sort"
+)
+
+const huffMaxBits = 11 // Longest Huffman code Zstandard allows
+
+// huffEntry is one entry of a Huffman decoding table, indexed by the next
+// maxBits bits of a stream
+type huffEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+type huffTable struct {
+	maxBits uint
+	entries []huffEntry
+}
+
+// readHuffTable reads a Huffman tree description
+// Returns: The table and the bytes the description took
+func readHuffTable(data []byte) (*huffTable, int, error) {
+	if len(data) == 0 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	header := int(data[0])
+	size := 1
+	if header >= 128 {
+		// Weights stored directly, 4 bits each
+		n := header - 127
+		size += (n + 1) / 2
+		if size > len(data) {
+			return nil, 0, errCorrupt
+		}
+		for i := 0; i < n; i++ {
+			b := data[1+i/2]
+			if i%2 == 0 {
+				weights = append(weights, b>>4)
+			} else {
+				weights = append(weights, b&15)
+			}
+		}
+	} else {
+		// Weights compressed with FSE, decoded by two interleaved states
+		size += header
+		if size > len(data) {
+			return nil, 0, errCorrupt
+		}
+		src := data[1:size]
+		t, n, err := readFSETable(src, 255, 6)
+		if err != nil {
+			return nil, 0, err
+		}
+		r, err := newBackwardReader(src[n:])
+		if err != nil {
+			return nil, 0, err
+		}
+		s1 := uint(r.read(t.log))
+		s2 := uint(r.read(t.log))
+		states := [2]*uint{&s1, &s2}
+		for i := 0; ; i++ {
+			if len(weights) > 255 {
+				return nil, 0, errCorrupt
+			}
+			s := states[i%2]
+			e := t.entries[*s]
+			weights = append(weights, e.symbol)
+			*s = uint(e.baseline) + uint(r.read(uint(e.nbBits)))
+			if r.overflowed() {
+				weights = append(weights, t.entries[*states[(i+1)%2]].symbol)
+				break
+			}
+		}
+	}
+
+	// The weight of the last symbol is implied by the others
+	var total uint32
+	for _, w := range weights {
+		if w > huffMaxBits {
+			return nil, 0, errCorrupt
+		}
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 || len(weights) > 255 {
+		return nil, 0, errCorrupt
+	}
+	maxBits := uint(bits.Len32(total))
+	rest := uint32(1)<<maxBits - total
+	if maxBits > huffMaxBits || rest&(rest-1) != 0 {
+		return nil, 0, errCorrupt
+	}
+	weights = append(weights, uint8(bits.Len32(rest)))
+
+	return newHuffTable(weights, maxBits), size, nil
+}
+
+// newHuffTable builds the decoding table for symbol weights, whose codes
+// are assigned in order of weight, then of symbol
+func newHuffTable(weights []uint8, maxBits uint) *huffTable {
+	t := &huffTable{maxBits: maxBits, entries: make([]huffEntry, 1<<maxBits)}
+	var start [huffMaxBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 1; w <= huffMaxBits+1; w++ {
+		start[w] += start[w-1]
+	}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{symbol: uint8(s), nbBits: uint8(maxBits + 1 - uint(w))}
+		n := 1 << (w - 1)
+		for i := start[w]; i < start[w]+n; i++ {
+			t.entries[i] = e
+		}
+		start[w] += n
+	}
+	return t
+}
+
+// decode decodes n symbols from one Huffman coded stream
+func (t *huffTable) decode(dst []byte, src []byte, n int) ([]byte, error) {
+	r, err := newBackwardReader(src)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < n; i++ {
+		e := t.entries[r.peek(t.maxBits)]
+		dst = append(dst, e.symbol)
+		r.pos -= int(e.nbBits)
+	}
+	if !r.finished() {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
+
+// huffCode is the code of one symbol
+type huffCode struct {
+	code   uint16
+	nbBits uint8
+}
+
+// huffEncoder holds the codes to compress literals with
+type huffEncoder struct {
+	codes   [256]huffCode
+	weights []uint8 // Of every symbol but the last
+	maxBits uint
+}
+
+// newHuffEncoder builds codes for the literals, which must use at least two
+// symbols
+// Returns: nil if the codes can't be described with weights stored
+// directly, which only fit symbols below 129
+func newHuffEncoder(literals []byte) *huffEncoder {
+	var counts [256]int
+	for _, b := range literals {
+		counts[b]++
+	}
+	last := 255
+	for last >= 0 && counts[last] == 0 {
+		last--
+	}
+	if last > 128 {
+		return nil
+	}
+	lengths := huffLengths(counts[:last+1], huffMaxBits)
+	if lengths == nil {
+		return nil
+	}
+
+	e := &huffEncoder{}
+	weights := make([]uint8, last+1)
+	for _, l := range lengths {
+		if l > 0 {
+			e.maxBits = max(e.maxBits, uint(l))
+		}
+	}
+	for s, l := range lengths {
+		if l > 0 {
+			weights[s] = uint8(e.maxBits + 1 - uint(l))
+		}
+	}
+	e.weights = weights[:last]
+
+	// Codes in the order newHuffTable lays out the table
+	var start [huffMaxBits + 2]int
+	for _, w := range weights {
+		if w > 0 {
+			start[w+1] += 1 << (w - 1)
+		}
+	}
+	for w := 1; w <= huffMaxBits+1; w++ {
+		start[w] += start[w-1]
+	}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e.codes[s] = huffCode{code: uint16(start[w] >> (w - 1)), nbBits: uint8(e.maxBits + 1 - uint(w))}
+		start[w] += 1 << (w - 1)
+	}
+	return e
+}
+
+// description returns the tree description, weights stored directly
+func (e *huffEncoder) description() []byte {
+	out := []byte{byte(127 + len(e.weights))}
+	for i := 0; i < len(e.weights); i += 2 {
+		b := e.weights[i] << 4
+		if i+1 < len(e.weights) {
+			b |= e.weights[i+1]
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// encode writes one Huffman coded stream, symbols in reverse so that
+// they're read back in order
+func (e *huffEncoder) encode(src []byte) []byte {
+	w := &bitWriter{out: make([]byte, 0, len(src)/2)}
+	for i := len(src) - 1; i >= 0; i-- {
+		c := e.codes[src[i]]
+		w.add(uint64(c.code), uint(c.nbBits))
+	}
+	return w.close()
+}
+
+// huffLengths returns Huffman code lengths of at most limit bits for the
+// symbol counts, making up a complete code
+// Returns: nil if no such code was found
+func huffLengths(counts []int, limit int) []int {
+	type node struct {
+		count       int
+		symbol      int // -1 for inner nodes
+		left, right int
+	}
+	var nodes []node
+	for s, c := range counts {
+		if c > 0 {
+			nodes = append(nodes, node{count: c, symbol: s})
+		}
+	}
+	if len(nodes) < 2 {
+		return nil
+	}
+	sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].count < nodes[j].count })
+
+	// Two queue construction: leaves in order of count, then inner nodes in
+	// the order they're made, which is also by count
+	leaves := len(nodes)
+	li, ii := 0, leaves
+	pick := func() int {
+		if li < leaves && (ii >= len(nodes) || nodes[li].count <= nodes[ii].count) {
+			li++
+			return li - 1
+		}
+		ii++
+		return ii - 1
+	}
+	for len(nodes) < 2*leaves-1 {
+		a, b := pick(), pick()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, symbol: -1, left: a, right: b})
+	}
+
+	lengths := make([]int, len(counts))
+	depth := make([]int, len(nodes))
+	for i := len(nodes) - 1; i >= leaves; i-- {
+		depth[nodes[i].left] = depth[i] + 1
+		depth[nodes[i].right] = depth[i] + 1
+	}
+	for i := 0; i < leaves; i++ {
+		lengths[nodes[i].symbol] = depth[i]
+	}
+
+	// Cap the lengths, then lengthen the rarest codes below the cap until
+	// the code fits again, and shorten codes while it has room to spare
+	kraft := 0
+	for i := 0; i < leaves; i++ {
+		s := nodes[i].symbol
+		lengths[s] = min(lengths[s], limit)
+		kraft += 1 << (limit - lengths[s])
+	}
+	full := 1 << limit
+	for kraft > full {
+		for i := 0; i < leaves && kraft > full; i++ {
+			s := nodes[i].symbol
+			if lengths[s] < limit {
+				kraft -= 1 << (limit - lengths[s] - 1)
+				lengths[s]++
+			}
+		}
+	}
+	for kraft < full {
+		changed := false
+		for i := leaves - 1; i >= 0 && kraft < full; i-- {
+			s := nodes[i].symbol
+			if gain := 1 << (limit - lengths[s]); lengths[s] > 1 && kraft+gain <= full {
+				kraft += gain
+				lengths[s]--
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+	}
+	return lengths
+}
@@ -0,0 +1,519 @@
+package compress
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/checksum"
+)
+
+const (
+	zstdMagic     = 0xFD2FB528
+	zstdBlockMax  = 128 << 10 // Largest block content
+	zstdWindowMax = 1 << 31   // Largest window this decoder accepts
+)
+
+// Sequence codes: the baseline and extra bits of each literals length and
+// match length code, and the predefined distributions of all three
+var (
+	llBase = [36]uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536}
+	llBits = [36]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16}
+	mlBase = [53]uint32{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539}
+	mlBits = [53]uint8{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16}
+
+	llDefault = []int16{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+		-1, -1, -1, -1}
+	mlDefault = []int16{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+		-1, -1, -1, -1, -1}
+	ofDefault = []int16{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1}
+
+	llDefaultTable = newFSETable(llDefault, 6)
+	mlDefaultTable = newFSETable(mlDefault, 6)
+	ofDefaultTable = newFSETable(ofDefault, 5)
+)
+
+// zstdDecoder holds what carries over between the blocks of a frame
+type zstdDecoder struct {
+	out      []byte
+	max      int64
+	huff     *huffTable
+	ll       *fseTable
+	of       *fseTable
+	ml       *fseTable
+	reps     [3]int
+	literals []byte
+}
+
+// zstdDecompress decompresses Zstandard frames, skipping skippable ones
+func zstdDecompress(src []byte, maxSize int64) ([]byte, error) {
+	d := &zstdDecoder{max: maxSize}
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, errCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			if len(src) < 8 {
+				return nil, errCorrupt
+			}
+			n := int64(binary.LittleEndian.Uint32(src[4:]))
+			if n > int64(len(src)-8) {
+				return nil, errCorrupt
+			}
+			src = src[8+n:]
+			continue
+		}
+		if magic != zstdMagic {
+			return nil, errors.New("zstd: not a Zstandard frame")
+		}
+		n, err := d.frame(src[4:])
+		if err != nil {
+			return nil, err
+		}
+		src = src[4+n:]
+	}
+	return d.out, nil
+}
+
+// frame decodes one frame after its magic number
+// Returns: The bytes it took
+func (d *zstdDecoder) frame(src []byte) (int, error) {
+	if len(src) < 1 {
+		return 0, errCorrupt
+	}
+	fhd := src[0]
+	pos := 1
+	fcsFlag := fhd >> 6
+	single := fhd&0x20 != 0
+	hasChecksum := fhd&0x04 != 0
+	dictFlag := fhd & 3
+	if fhd&0x08 != 0 {
+		return 0, errCorrupt
+	}
+
+	var window uint64
+	if !single {
+		if pos >= len(src) {
+			return 0, errCorrupt
+		}
+		wd := src[pos]
+		pos++
+		log := 10 + uint(wd>>3)
+		base := uint64(1) << log
+		window = base + base/8*uint64(wd&7)
+	}
+	dictSize := [4]int{0, 1, 2, 4}[dictFlag]
+	if pos+dictSize > len(src) {
+		return 0, errCorrupt
+	}
+	var dictID uint32
+	for i := dictSize - 1; i >= 0; i-- {
+		dictID = dictID<<8 | uint32(src[pos+i])
+	}
+	pos += dictSize
+	if dictID != 0 {
+		return 0, errors.New("zstd: frames using a dictionary are not supported")
+	}
+
+	fcsSize := [4]int{0, 2, 4, 8}[fcsFlag]
+	if fcsFlag == 0 && single {
+		fcsSize = 1
+	}
+	if pos+fcsSize > len(src) {
+		return 0, errCorrupt
+	}
+	var contentSize uint64
+	hasSize := fcsSize > 0
+	for i := fcsSize - 1; i >= 0; i-- {
+		contentSize = contentSize<<8 | uint64(src[pos+i])
+	}
+	if fcsSize == 2 {
+		contentSize += 256
+	}
+	pos += fcsSize
+	if single {
+		window = contentSize
+	}
+	if window > zstdWindowMax {
+		return 0, fmt.Errorf("zstd: window of %d bytes is too large", window)
+	}
+	if hasSize && contentSize > uint64(d.max-int64(len(d.out))) {
+		return 0, ErrTooLarge
+	}
+	if hasSize {
+		d.out = slices.Grow(d.out, int(contentSize))
+	}
+
+	// Each frame starts afresh; back references don't reach earlier ones
+	start := len(d.out)
+	d.huff, d.ll, d.of, d.ml = nil, nil, nil, nil
+	d.reps = [3]int{1, 4, 8}
+	blockMax := int(min(window, zstdBlockMax))
+	for {
+		if pos+3 > len(src) {
+			return 0, errCorrupt
+		}
+		h := uint32(src[pos]) | uint32(src[pos+1])<<8 | uint32(src[pos+2])<<16
+		pos += 3
+		last := h&1 != 0
+		size := int(h >> 3)
+		switch h >> 1 & 3 {
+		case 0:
+			if pos+size > len(src) {
+				return 0, errCorrupt
+			}
+			if err := d.grow(size); err != nil {
+				return 0, err
+			}
+			d.out = append(d.out, src[pos:pos+size]...)
+			pos += size
+		case 1:
+			if pos >= len(src) {
+				return 0, errCorrupt
+			}
+			if err := d.grow(size); err != nil {
+				return 0, err
+			}
+			for i := 0; i < size; i++ {
+				d.out = append(d.out, src[pos])
+			}
+			pos++
+		case 2:
+			if size > blockMax || pos+size > len(src) {
+				return 0, errCorrupt
+			}
+			if err := d.block(src[pos:pos+size], start); err != nil {
+				return 0, err
+			}
+			pos += size
+		default:
+			return 0, errCorrupt
+		}
+		if last {
+			break
+		}
+	}
+	if hasSize && uint64(len(d.out)-start) != contentSize {
+		return 0, errCorrupt
+	}
+
+	if hasChecksum {
+		if pos+4 > len(src) {
+			return 0, errCorrupt
+		}
+		h := checksum.NewXXH64()
+		h.Write(d.out[start:])
+		sum := h.Sum(nil)
+		if binary.LittleEndian.Uint32(src[pos:]) != binary.BigEndian.Uint32(sum[4:]) {
+			return 0, errors.New("zstd: checksum mismatch")
+		}
+		pos += 4
+	}
+	return pos, nil
+}
+
+// grow checks that n more bytes of output stay within the limit
+func (d *zstdDecoder) grow(n int) error {
+	if int64(len(d.out))+int64(n) > d.max {
+		return ErrTooLarge
+	}
+	return nil
+}
+
+// block decodes a compressed block
+// start: Where the frame's output starts
+func (d *zstdDecoder) block(src []byte, start int) error {
+	n, err := d.readLiterals(src)
+	if err != nil {
+		return err
+	}
+	src = src[n:]
+	if len(src) == 0 {
+		return errCorrupt
+	}
+
+	// Sequences section header
+	nbSeq := int(src[0])
+	pos := 1
+	switch {
+	case nbSeq == 0:
+		if len(src) != 1 {
+			return errCorrupt
+		}
+		if err := d.grow(len(d.literals)); err != nil {
+			return err
+		}
+		d.out = append(d.out, d.literals...)
+		return nil
+	case nbSeq == 255:
+		if len(src) < 3 {
+			return errCorrupt
+		}
+		nbSeq = int(src[1]) + int(src[2])<<8 + 0x7F00
+		pos = 3
+	case nbSeq >= 128:
+		if len(src) < 2 {
+			return errCorrupt
+		}
+		nbSeq = (nbSeq-128)<<8 + int(src[1])
+		pos = 2
+	}
+	if pos >= len(src) {
+		return errCorrupt
+	}
+	modes := src[pos]
+	pos++
+	if modes&3 != 0 {
+		return errCorrupt
+	}
+	tables := []struct {
+		t         **fseTable
+		mode      byte
+		def       *fseTable
+		maxSymbol int
+		maxLog    uint
+	}{
+		{&d.ll, modes >> 6, llDefaultTable, 35, 9},
+		{&d.of, modes >> 4 & 3, ofDefaultTable, 31, 8},
+		{&d.ml, modes >> 2 & 3, mlDefaultTable, 52, 9},
+	}
+	for _, tb := range tables {
+		switch tb.mode {
+		case 0:
+			*tb.t = tb.def
+		case 1:
+			if pos >= len(src) || int(src[pos]) > tb.maxSymbol {
+				return errCorrupt
+			}
+			*tb.t = rleFSETable(src[pos])
+			pos++
+		case 2:
+			t, n, err := readFSETable(src[pos:], tb.maxSymbol, tb.maxLog)
+			if err != nil {
+				return err
+			}
+			*tb.t = t
+			pos += n
+		case 3:
+			if *tb.t == nil {
+				return errCorrupt
+			}
+		}
+	}
+
+	r, err := newBackwardReader(src[pos:])
+	if err != nil {
+		return err
+	}
+	llState := uint(r.read(d.ll.log))
+	ofState := uint(r.read(d.of.log))
+	mlState := uint(r.read(d.ml.log))
+	lits := d.literals
+	for i := 0; i < nbSeq; i++ {
+		ll, of, ml := d.ll.entries[llState], d.of.entries[ofState], d.ml.entries[mlState]
+		if ll.symbol > 35 || ml.symbol > 52 || of.symbol > 31 {
+			return errCorrupt
+		}
+		offset := int(1)<<of.symbol + int(r.read(uint(of.symbol)))
+		matchLen := int(mlBase[ml.symbol]) + int(r.read(uint(mlBits[ml.symbol])))
+		litLen := int(llBase[ll.symbol]) + int(r.read(uint(llBits[ll.symbol])))
+
+		// Offset values up to 3 pick one of the repeat offsets
+		if offset > 3 {
+			offset -= 3
+			d.reps = [3]int{offset, d.reps[0], d.reps[1]}
+		} else {
+			if litLen == 0 {
+				offset++
+			}
+			switch offset {
+			case 1:
+				offset = d.reps[0]
+			case 2:
+				offset = d.reps[1]
+				d.reps = [3]int{offset, d.reps[0], d.reps[2]}
+			case 3:
+				offset = d.reps[2]
+				d.reps = [3]int{offset, d.reps[0], d.reps[1]}
+			case 4:
+				offset = d.reps[0] - 1
+				d.reps = [3]int{offset, d.reps[0], d.reps[1]}
+			}
+		}
+
+		if litLen > len(lits) {
+			return errCorrupt
+		}
+		if err := d.grow(litLen + matchLen); err != nil {
+			return err
+		}
+		d.out = append(d.out, lits[:litLen]...)
+		lits = lits[litLen:]
+		from := len(d.out) - offset
+		if offset <= 0 || from < start {
+			return errCorrupt
+		}
+		if offset >= matchLen {
+			d.out = append(d.out, d.out[from:from+matchLen]...)
+		} else {
+			for j := 0; j < matchLen; j++ {
+				d.out = append(d.out, d.out[from+j])
+			}
+		}
+
+		if i < nbSeq-1 {
+			llState = uint(ll.baseline) + uint(r.read(uint(ll.nbBits)))
+			mlState = uint(ml.baseline) + uint(r.read(uint(ml.nbBits)))
+			ofState = uint(of.baseline) + uint(r.read(uint(of.nbBits)))
+		}
+	}
+	if !r.finished() {
+		return errCorrupt
+	}
+	if err := d.grow(len(lits)); err != nil {
+		return err
+	}
+	d.out = append(d.out, lits...)
+	return nil
+}
+
+// readLiterals reads a block's literals section into d.literals
+// Returns: The bytes it took
+func (d *zstdDecoder) readLiterals(src []byte) (int, error) {
+	if len(src) == 0 {
+		return 0, errCorrupt
+	}
+	kind := src[0] & 3
+	format := src[0] >> 2 & 3
+	if kind < 2 {
+		// Raw or RLE: only a regenerated size
+		var size, n int
+		switch format {
+		case 0, 2:
+			size, n = int(src[0]>>3), 1
+		case 1:
+			if len(src) < 2 {
+				return 0, errCorrupt
+			}
+			size, n = int(src[0]>>4)+int(src[1])<<4, 2
+		case 3:
+			if len(src) < 3 {
+				return 0, errCorrupt
+			}
+			size, n = int(src[0]>>4)+int(src[1])<<4+int(src[2])<<12, 3
+		}
+		if size > zstdBlockMax {
+			return 0, errCorrupt
+		}
+		if kind == 0 {
+			if n+size > len(src) {
+				return 0, errCorrupt
+			}
+			d.literals = append(d.literals[:0], src[n:n+size]...)
+			return n + size, nil
+		}
+		if n >= len(src) {
+			return 0, errCorrupt
+		}
+		d.literals = d.literals[:0]
+		for i := 0; i < size; i++ {
+			d.literals = append(d.literals, src[n])
+		}
+		return n + 1, nil
+	}
+
+	// Huffman coded, in one stream or four
+	var headerSize, sizeBits int
+	streams := 4
+	switch format {
+	case 0:
+		headerSize, sizeBits, streams = 3, 10, 1
+	case 1:
+		headerSize, sizeBits = 3, 10
+	case 2:
+		headerSize, sizeBits = 4, 14
+	case 3:
+		headerSize, sizeBits = 5, 18
+	}
+	if len(src) < headerSize {
+		return 0, errCorrupt
+	}
+	var h uint64
+	for i := headerSize - 1; i >= 0; i-- {
+		h = h<<8 | uint64(src[i])
+	}
+	mask := uint64(1)<<sizeBits - 1
+	regenerated := int(h >> 4 & mask)
+	compressed := int(h >> (4 + sizeBits) & mask)
+	if regenerated > zstdBlockMax || headerSize+compressed > len(src) {
+		return 0, errCorrupt
+	}
+	body := src[headerSize : headerSize+compressed]
+	if kind == 2 {
+		t, n, err := readHuffTable(body)
+		if err != nil {
+			return 0, err
+		}
+		d.huff = t
+		body = body[n:]
+	} else if d.huff == nil {
+		return 0, errCorrupt
+	}
+
+	lits := d.literals[:0]
+	var err error
+	if streams == 1 {
+		lits, err = d.huff.decode(lits, body, regenerated)
+	} else {
+		if len(body) < 6 {
+			return 0, errCorrupt
+		}
+		sizes := [4]int{int(binary.LittleEndian.Uint16(body)), int(binary.LittleEndian.Uint16(body[2:])), int(binary.LittleEndian.Uint16(body[4:]))}
+		sizes[3] = len(body) - 6 - sizes[0] - sizes[1] - sizes[2]
+		if sizes[3] < 0 {
+			return 0, errCorrupt
+		}
+		body = body[6:]
+		segment := (regenerated + 3) / 4
+		for i, size := range sizes {
+			n := segment
+			if i == 3 {
+				n = regenerated - 3*segment
+			}
+			if n < 0 {
+				return 0, errCorrupt
+			}
+			if lits, err = d.huff.decode(lits, body[:size], n); err != nil {
+				break
+			}
+			body = body[size:]
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	d.literals = lits
+	return headerSize + compressed, nil
+}
+
+// highBit returns the position of the highest set bit of v > 0
+func highBit(v uint32) uint {
+	return uint(bits.Len32(v)) - 1
+}
@@ -0,0 +1,407 @@
+package compress
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+const (
+	zstdHashLog   = 17
+	zstdChainLog  = 17 // Positions whose earlier candidates are remembered
+	zstdChainMax  = 4  // Candidates tried per position
+	zstdMinMatch  = 4
+	zstdMaxOffset = 1<<28 - 1 // Keeps offset codes within the predefined table
+)
+
+var (
+	llEncTable = newFSEEncTable(llDefault, 6)
+	mlEncTable = newFSEEncTable(mlDefault, 6)
+	ofEncTable = newFSEEncTable(ofDefault, 5)
+
+	llCodeTable = codeTable(llBase[:], 64)
+	mlCodeTable = codeTable(mlBase[:], 131)
+)
+
+// sequence is a run of literals followed by a match
+type sequence struct {
+	litLen   uint32
+	matchLen uint32
+	offset   uint32 // Offset value: the distance back plus 3
+}
+
+// zstdCompress compresses src into a single Zstandard frame. Matches are
+// found greedily, literals are Huffman coded where that pays and sequences
+// use the predefined FSE tables, trading ratio for speed and simplicity
+func zstdCompress(src []byte) []byte {
+	out := make([]byte, 0, len(src)/2+16)
+	out = binary.LittleEndian.AppendUint32(out, zstdMagic)
+	size := uint64(len(src))
+	switch {
+	case size < 256:
+		out = append(out, 0x20, byte(size))
+	case size < 65536+256:
+		out = append(out, 0x60)
+		out = binary.LittleEndian.AppendUint16(out, uint16(size-256))
+	case size < 1<<32:
+		out = append(out, 0xA0)
+		out = binary.LittleEndian.AppendUint32(out, uint32(size))
+	default:
+		out = append(out, 0xE0)
+		out = binary.LittleEndian.AppendUint64(out, size)
+	}
+
+	m := newMatcher(src)
+	for start := 0; ; start += zstdBlockMax {
+		end := min(start+zstdBlockMax, len(src))
+		last := uint32(0)
+		if end == len(src) {
+			last = 1
+		}
+		block := src[start:end]
+		if body := m.block(start, end); body != nil && len(body) < len(block) {
+			out = appendBlockHeader(out, last|2<<1|uint32(len(body))<<3)
+			out = append(out, body...)
+		} else if isRun(block) {
+			out = appendBlockHeader(out, last|1<<1|uint32(len(block))<<3)
+			out = append(out, block[0])
+		} else {
+			out = appendBlockHeader(out, last|uint32(len(block))<<3)
+			out = append(out, block...)
+		}
+		if last == 1 {
+			return out
+		}
+	}
+}
+
+func appendBlockHeader(out []byte, h uint32) []byte {
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// isRun reports whether b is one byte repeated
+func isRun(b []byte) bool {
+	if len(b) < 2 {
+		return false
+	}
+	for _, c := range b[1:] {
+		if c != b[0] {
+			return false
+		}
+	}
+	return true
+}
+
+func hash4(b []byte) uint32 {
+	return binary.LittleEndian.Uint32(b) * 2654435761 >> (32 - zstdHashLog)
+}
+
+// matcher finds matches for the blocks of a frame, which may reach back
+// into earlier blocks
+type matcher struct {
+	src   []byte
+	table []int32 // Most recent position of each hash, -1 for none
+	chain []int32 // Previous position with the same hash, by position
+	rep   int     // Distance of the last match, the decoder's first repeat offset
+}
+
+func newMatcher(src []byte) *matcher {
+	m := &matcher{src: src, table: make([]int32, 1<<zstdHashLog), chain: make([]int32, 1<<zstdChainLog), rep: 1}
+	for i := range m.table {
+		m.table[i] = -1
+	}
+	return m
+}
+
+// insert adds position i to the hash chains
+func (m *matcher) insert(i int) {
+	h := hash4(m.src[i:])
+	m.chain[i&(1<<zstdChainLog-1)] = m.table[h]
+	m.table[h] = int32(i)
+}
+
+// find returns the longest match for position i among the last
+// zstdChainMax candidates with its hash, ending at end at the latest
+// Returns: The position matched and the match length, 0 if none was found
+func (m *matcher) find(i, end int) (int, int) {
+	src := m.src
+	head := binary.LittleEndian.Uint32(src[i:])
+	best, bestLen := 0, 0
+	cand := int(m.table[hash4(src[i:])])
+	for k := 0; k < zstdChainMax && cand >= 0 && i-cand < 1<<zstdChainLog && i-cand <= zstdMaxOffset; k++ {
+		if binary.LittleEndian.Uint32(src[cand:]) == head {
+			n := matchLen(src[cand:end], src[i:end])
+			if n > bestLen {
+				best, bestLen = cand, n
+			}
+		}
+		next := int(m.chain[cand&(1<<zstdChainLog-1)])
+		if next >= cand {
+			break
+		}
+		cand = next
+	}
+	return best, bestLen
+}
+
+// block compresses src[start:end]
+// Returns: The block body, or nil if no matches were found
+func (m *matcher) block(start, end int) []byte {
+	src := m.src
+	var seqs []sequence
+	var literals []byte
+	anchor := start
+	misses := 0
+	for i := start; i+zstdMinMatch <= end; {
+		// A match at the last distance is cheapest to encode: offset
+		// value 1 repeats it, as long as literals precede it
+		if i > anchor && i >= m.rep && binary.LittleEndian.Uint32(src[i-m.rep:]) == binary.LittleEndian.Uint32(src[i:]) {
+			n := matchLen(src[i-m.rep:end], src[i:end])
+			literals = append(literals, src[anchor:i]...)
+			seqs = append(seqs, sequence{litLen: uint32(i - anchor), matchLen: uint32(n), offset: 1})
+			m.skip(i, n, end)
+			i += n
+			anchor = i
+			continue
+		}
+
+		cand, n := m.find(i, end)
+		m.insert(i)
+		if n == 0 {
+			misses++
+			i += 1 + misses>>6
+			continue
+		}
+		misses = 0
+		// Extend backwards over literals that match too
+		for i > anchor && cand > 0 && src[i-1] == src[cand-1] {
+			i--
+			cand--
+			n++
+		}
+		literals = append(literals, src[anchor:i]...)
+		seqs = append(seqs, sequence{litLen: uint32(i - anchor), matchLen: uint32(n), offset: uint32(i-cand) + 3})
+		m.rep = i - cand
+		m.skip(i, n, end)
+		i += n
+		anchor = i
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	literals = append(literals, src[anchor:end]...)
+
+	body := appendLiterals(nil, literals)
+	n := len(seqs)
+	switch {
+	case n < 128:
+		body = append(body, byte(n))
+	case n < 0x7F00:
+		body = append(body, byte(n>>8+128), byte(n))
+	default:
+		body = append(body, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	return append(body, encodeSequences(seqs)...)
+}
+
+// matchLen returns the length of the common prefix of a and b, where a
+// starts earlier in the same buffer
+func matchLen(a, b []byte) int {
+	n := 0
+	for len(b)-n >= 8 {
+		if x := binary.LittleEndian.Uint64(a[n:]) ^ binary.LittleEndian.Uint64(b[n:]); x != 0 {
+			return n + bits.TrailingZeros64(x)>>3
+		}
+		n += 8
+	}
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// skip adds every other position of a match of n bytes at i to the hash
+// chains
+func (m *matcher) skip(i, n, end int) {
+	for j := i + 1; j < i+n && j+zstdMinMatch <= end; j += 2 {
+		m.insert(j)
+	}
+}
+
+// appendLiterals appends a literals section, Huffman coded if that's
+// smaller
+func appendLiterals(out []byte, lits []byte) []byte {
+	if len(lits) >= 32 {
+		if coded := huffLiterals(lits); coded != nil {
+			return append(out, coded...)
+		}
+	}
+	n := len(lits)
+	switch {
+	case n < 32:
+		return append(append(out, byte(n<<3)), lits...)
+	case n < 4096:
+		return append(append(out, byte(1<<2|n<<4), byte(n>>4)), lits...)
+	}
+	return append(append(out, byte(3<<2|n<<4), byte(n>>4), byte(n>>12)), lits...)
+}
+
+// huffLiterals Huffman codes literals
+// Returns: The literals section, or nil if it isn't smaller than the
+// literals stored as they are
+func huffLiterals(lits []byte) []byte {
+	e := newHuffEncoder(lits)
+	if e == nil {
+		return nil
+	}
+	body := e.description()
+	single := len(lits) < 256
+	if single {
+		body = append(body, e.encode(lits)...)
+	} else {
+		segment := (len(lits) + 3) / 4
+		var streams [4][]byte
+		for i := range streams {
+			streams[i] = e.encode(lits[min(i*segment, len(lits)):min((i+1)*segment, len(lits))])
+		}
+		for _, s := range streams[:3] {
+			if len(s) > 0xFFFF {
+				return nil
+			}
+			body = binary.LittleEndian.AppendUint16(body, uint16(len(s)))
+		}
+		for _, s := range streams {
+			body = append(body, s...)
+		}
+	}
+
+	regen, comp := uint64(len(lits)), uint64(len(body))
+	var header []byte
+	switch {
+	case single && comp < 1024:
+		h := 2 | regen<<4 | comp<<14
+		header = []byte{byte(h), byte(h >> 8), byte(h >> 16)}
+	case single:
+		return nil
+	case regen < 1024 && comp < 1024:
+		h := 2 | 1<<2 | regen<<4 | comp<<14
+		header = []byte{byte(h), byte(h >> 8), byte(h >> 16)}
+	case regen < 16384 && comp < 16384:
+		h := 2 | 2<<2 | regen<<4 | comp<<18
+		header = binary.LittleEndian.AppendUint32(nil, uint32(h))
+	case regen < 262144 && comp < 262144:
+		h := 2 | 3<<2 | regen<<4 | comp<<22
+		header = binary.LittleEndian.AppendUint64(nil, h)[:5]
+	default:
+		return nil
+	}
+	if len(header)+len(body) >= len(lits)+3 {
+		return nil
+	}
+	return append(header, body...)
+}
+
+// codeTable returns the code of each value below n: the one whose
+// baseline is the largest not above it
+func codeTable(base []uint32, n int) []uint8 {
+	codes := make([]uint8, n)
+	c := 0
+	for v := range codes {
+		for c+1 < len(base) && base[c+1] <= uint32(v) {
+			c++
+		}
+		codes[v] = uint8(c)
+	}
+	return codes
+}
+
+// llCode returns the code of a literals length
+func llCode(v uint32) uint8 {
+	if v < 64 {
+		return llCodeTable[v]
+	}
+	return uint8(highBit(v) + 19)
+}
+
+// mlCode returns the code of a match length
+func mlCode(v uint32) uint8 {
+	if v < 131 {
+		return mlCodeTable[v]
+	}
+	return uint8(highBit(v-3) + 36)
+}
+
+// encodeSequences writes the table modes and descriptions of the
+// sequences, then their bitstream: last sequence first so that the decoder
+// reads them in order
+func encodeSequences(seqs []sequence) []byte {
+	n := len(seqs)
+	llCodes := make([]uint8, n)
+	mlCodes := make([]uint8, n)
+	ofCodes := make([]uint8, n)
+	for i, s := range seqs {
+		llCodes[i] = llCode(s.litLen)
+		mlCodes[i] = mlCode(s.matchLen)
+		ofCodes[i] = uint8(bits.Len32(s.offset) - 1)
+	}
+
+	out := []byte{0}
+	llMode, llTable := seqTable(&out, llCodes, 35, 9, llDefault, llEncTable)
+	ofMode, ofTable := seqTable(&out, ofCodes, 31, 8, ofDefault, ofEncTable)
+	mlMode, mlTable := seqTable(&out, mlCodes, 52, 9, mlDefault, mlEncTable)
+	out[0] = llMode<<6 | ofMode<<4 | mlMode<<2
+
+	w := &bitWriter{out: out}
+	extras := func(i int) {
+		s := seqs[i]
+		w.add(uint64(s.litLen-llBase[llCodes[i]]), uint(llBits[llCodes[i]]))
+		w.add(uint64(s.matchLen-mlBase[mlCodes[i]]), uint(mlBits[mlCodes[i]]))
+		w.add(uint64(s.offset), uint(ofCodes[i]))
+	}
+	var ll, ml, of fseState
+	ml.init(mlTable, mlCodes[n-1])
+	of.init(ofTable, ofCodes[n-1])
+	ll.init(llTable, llCodes[n-1])
+	extras(n - 1)
+	for i := n - 2; i >= 0; i-- {
+		of.encode(w, ofCodes[i])
+		ml.encode(w, mlCodes[i])
+		ll.encode(w, llCodes[i])
+		extras(i)
+	}
+	ml.flush(w)
+	of.flush(w)
+	ll.flush(w)
+	return w.close()
+}
+
+// seqTable picks how one kind of sequence code is coded: as a single
+// repeated symbol, with its predefined table, or with a table made for
+// the block where that's estimated to be smaller, whose description is
+// appended to out
+// Returns: The mode and the table, nil for a repeated symbol
+func seqTable(out *[]byte, codes []uint8, maxSymbol int, maxLog uint, def []int16, defTable *fseEncTable) (byte, *fseEncTable) {
+	counts := make([]int, maxSymbol+1)
+	last, distinct := 0, 0
+	for _, c := range codes {
+		if counts[c] == 0 {
+			distinct++
+		}
+		counts[c]++
+		last = max(last, int(c))
+	}
+	if distinct == 1 && len(codes) > 1 {
+		*out = append(*out, codes[0])
+		return 1, nil
+	}
+	if len(codes) < 64 {
+		return 0, defTable
+	}
+	log := fseTableLog(maxLog, len(codes), last)
+	norm := fseNormalize(counts[:last+1], log)
+	desc := appendFSETable(nil, norm, log)
+	if fseCost(counts, norm, log)+float64(8*len(desc)) >= fseCost(counts, def, defTable.log) {
+		return 0, defTable
+	}
+	*out = append(*out, desc...)
+	return 2, newFSEEncTable(norm, log)
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Config holds the settings that can be supplied through a config file,
+// written in TOML or, with a .yaml or .yml extension, YAML
+// Keys use the `toml` tag names in either, e.g.
+//
+//	id = "peer1"
+//	port = "3000"
+//	shared_dir = "./shared1"
+//
+// or
+//
+//	id: peer1
+//	port: 3000
+//	shared_dir: ./shared1
+type Config struct {
+	ID            string `toml:"id"`              // Peer ID
+	Port          string `toml:"port"`            // Port to listen on
+	Host          string `toml:"host"`            // Host or IP to listen on, e.g. "0.0.0.0"
+	SharedDir     string `toml:"shared_dir"`      // Directory for shared files
+	ReceivedDir   string `toml:"received_dir"`    // Directory for received files
+	StateFile     string `toml:"state_file"`      // File to persist peer state to
+	IndexFile     string `toml:"index_file"`      // File to persist the sizes and hashes of shared files to
+	CacheSize     string `toml:"cache_size"`      // Memory for caching served files, e.g. "64MB"
+	MaxUpload     string `toml:"max_upload"`      // Total upload rate per second, e.g. "10MB"
+	MaxDownload   string `toml:"max_download"`    // Total download rate per second
+	MaxReceived   string `toml:"max_received"`    // Maximum size of the received directory, e.g. "10GB"
+	Evict         string `toml:"evict"`           // Eviction policy for max_received: "oldest" or "lru"
+	Swarm         string `toml:"swarm"`           // Name of the private swarm to join
+	SwarmKey      string `toml:"swarm_key"`       // File holding the swarm's group secret
+	TLS           *bool  `toml:"tls"`             // Encrypt connections with TLS
+	TLSClientAuth *bool  `toml:"tls_client_auth"` // Require peers that connect to present a certificate signed by tls_ca
+	TLSCert       string `toml:"tls_cert"`        // PEM certificate for TLS, used with -tls
+	TLSKey        string `toml:"tls_key"`         // PEM private key of tls_cert
+	TLSCA         string `toml:"tls_ca"`          // PEM CA certificates that must sign other peers' certificates
+	NoiseKey      string `toml:"noise_key"`       // PEM X25519 static key for Noise, used with -noise
+	Perms         string `toml:"perms"`           // How received files get their mode: "fixed", "umask" or "sender"
+	FileMode      string `toml:"file_mode"`       // Mode of received files in octal, e.g. "0640"
+	DirMode       string `toml:"dir_mode"`        // Mode of directories created for received files
+	Owner         string `toml:"owner"`           // Owner of received files as "uid:gid", applied when running as root
+	SyncPartner   string `toml:"sync_partner"`    // Address of a partner peer to push changed shared files to
+	PieceSize     string `toml:"piece_size"`      // Size of the pieces shared files are served in, e.g. "4MB"
+	Codec         string `toml:"codec"`           // Message codecs offered to the peers dialed, e.g. "json"
+	MaxMessage    string `toml:"max_message"`     // Longest message accepted from a peer, e.g. "64MB"
+	LogLevel      string `toml:"log_level"`       // Lowest level of log lines written: "info", "warn" or "error"
+
+	// Peers lists the addresses of known peers, which are contacted on
+	// start so that they are listed and searched like peers seen since
+	Peers []string `toml:"peers"`
+
+	// PeerLimits caps individual peers beyond the global rates, keyed by
+	// "host:port" or a bare host, e.g.
+	//
+	//	[peer_limits."10.0.0.7"]
+	//	upload = "512KB"
+	PeerLimits map[string]PeerLimit `toml:"peer_limits"`
+
+	// Groups assigns peer IDs to named groups, which ACL rules refer to, e.g.
+	//
+	//	[groups]
+	//	admins = ["ops1"]
+	//	readers = ["peer2", "peer3"]
+	Groups map[string][]string `toml:"groups"`
+
+	// ACL grants groups access to the peer, keyed by group name or "*" for
+	// every peer; without it every peer may read shared files, e.g.
+	//
+	//	[acl.readers]
+	//	access = ["read"]
+	//	paths = ["releases/*"]
+	ACL map[string]ACLRule `toml:"acl"`
+
+	// Sync selects the files of a channel pulled from each peer, keyed by
+	// peer ID or address, or "*" for the others; peers without a rule
+	// supply every file, e.g.
+	//
+	//	[sync.peerA]
+	//	include = ["*.parquet"]
+	//	dirs = ["data"]
+	Sync map[string]SyncRule `toml:"sync"`
+
+	// Socket tunes the TCP connections to other peers, e.g. for bulk
+	// transfers over a long, fast link:
+	//
+	//	[socket]
+	//	keepalive = "30s"
+	//	nodelay = false
+	//	read_buffer = "8MB"
+	//	write_buffer = "8MB"
+	Socket Socket `toml:"socket"`
+
+	// Metrics selects a sink the peer pushes its metrics to, e.g.
+	//
+	//	[metrics]
+	//	sink = "statsd"
+	//	address = "localhost:8125"
+	Metrics Metrics `toml:"metrics"`
+}
+
+// Metrics configures pushing metrics to a StatsD or Graphite server
+type Metrics struct {
+	Sink     string        `toml:"sink"`     // "statsd", "graphite" or empty to disable
+	Address  string        `toml:"address"`  // host:port of the server
+	Prefix   string        `toml:"prefix"`   // Prepended to every metric name, e.g. "peer1."
+	Interval time.Duration `toml:"interval"` // Time between pushes, default 10s
+}
+
+// Socket holds TCP socket options; empty values keep the system defaults
+type Socket struct {
+	KeepAlive   time.Duration `toml:"keepalive"`    // Interval between keepalive probes, negative to disable them
+	NoDelay     *bool         `toml:"nodelay"`      // Send small messages immediately; false lets the kernel coalesce them
+	ReadBuffer  string        `toml:"read_buffer"`  // Kernel receive buffer size, e.g. "8MB"
+	WriteBuffer string        `toml:"write_buffer"` // Kernel send buffer size
+}
+
+// ACLRule lists what a group may do: "read", "write" or "admin"
+type ACLRule struct {
+	Access []string `toml:"access"`
+	Paths  []string `toml:"paths"` // Patterns of the shared file names covered, empty for all
+}
+
+// SyncRule lists patterns of the file names pulled from a peer
+type SyncRule struct {
+	Include []string `toml:"include"` // Patterns of the names to pull, empty for all
+	Exclude []string `toml:"exclude"` // Patterns of the names not to pull
+	Dirs    []string `toml:"dirs"`    // Subdirectories to pull from, empty for all
+}
+
+// PeerLimit holds the rate caps for one peer; empty values are unlimited
+type PeerLimit struct {
+	Upload   string `toml:"upload"`   // Upload rate per second to the peer
+	Download string `toml:"download"` // Download rate per second from the peer
+}
+
+// Load reads and parses the config file at path
+// Returns: The parsed config or an error describing the offending line or key
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open config file: %v", err)
+	}
+	defer f.Close()
+
+	parse := parseTOML
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".yaml" || ext == ".yml" {
+		parse = parseYAML
+	}
+	t, err := parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	cfg := &Config{}
+	if err := decode(t, cfg); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+	return cfg, nil
+}
@@ -0,0 +1,147 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const tomlConfig = `
+# A peer
+id = "peer1"
+port = "3000"
+shared_dir = "./shared # not a comment"
+tls = true
+log_level = "warn"
+peers = ["localhost:3001", "10.0.0.2:3000"]
+
+[peer_limits."10.0.0.7"]
+upload = "512KB"
+download = "1MB"
+
+[groups]
+readers = ["peer2", "peer3"]
+
+[acl.readers]
+access = ["read"]
+paths = ["releases/*"]
+
+[sync."*"]
+exclude = ["*.tmp"]
+
+[socket]
+keepalive = "30s"
+nodelay = false
+read_buffer = "8MB"
+
+[metrics]
+sink = "statsd"
+interval = "5s"
+`
+
+const yamlConfig = `
+# A peer
+id: peer1
+port: 3000
+shared_dir: "./shared # not a comment"
+tls: true
+log_level: warn
+peers:
+  - localhost:3001
+  - 10.0.0.2:3000
+peer_limits:
+  "10.0.0.7":
+    upload: 512KB
+    download: 1MB
+groups:
+  readers: [peer2, peer3]
+acl:
+  readers:
+    access: [read]
+    paths: ["releases/*"]
+sync:
+  "*":
+    exclude: ["*.tmp"]
+socket:
+  keepalive: 30s
+  nodelay: false
+  read_buffer: 8MB
+metrics:
+  sink: statsd
+  interval: 5s
+`
+
+// load writes data to a file named name and loads it
+func load(t *testing.T, name, data string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad(t *testing.T) {
+	yes, no := true, false
+	want := &Config{
+		ID:        "peer1",
+		Port:      "3000",
+		SharedDir: "./shared # not a comment",
+		TLS:       &yes,
+		LogLevel:  "warn",
+		Peers:     []string{"localhost:3001", "10.0.0.2:3000"},
+		PeerLimits: map[string]PeerLimit{
+			"10.0.0.7": {Upload: "512KB", Download: "1MB"},
+		},
+		Groups: map[string][]string{"readers": {"peer2", "peer3"}},
+		ACL: map[string]ACLRule{
+			"readers": {Access: []string{"read"}, Paths: []string{"releases/*"}},
+		},
+		Sync: map[string]SyncRule{
+			"*": {Exclude: []string{"*.tmp"}},
+		},
+		Socket:  Socket{KeepAlive: 30 * time.Second, NoDelay: &no, ReadBuffer: "8MB"},
+		Metrics: Metrics{Sink: "statsd", Interval: 5 * time.Second},
+	}
+	for _, tt := range []struct{ name, data string }{
+		{"peer.toml", tomlConfig},
+		{"peer.yaml", yamlConfig},
+		{"peer.yml", yamlConfig},
+	} {
+		got, err := load(t, tt.name, tt.data)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s:\ngot  %+v\nwant %+v", tt.name, got, want)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name, data, want string
+	}{
+		{"bad.toml", "id = \"peer1", "line 1"},
+		{"bad.toml", "[socket]\nkeepalive = \"soon\"", "socket.keepalive"},
+		{"bad.toml", "tls = \"yes\"", "tls"},
+		{"bad.toml", "peers = \"localhost:3001\"", "peers"},
+		{"bad.yaml", "socket:\n  nodelay: maybe", "socket.nodelay"},
+		{"bad.yaml", "id: peer1\n  port: 3000", "line 2"},
+	}
+	for _, tt := range tests {
+		_, err := load(t, tt.name, tt.data)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want an error about %s", tt.data, err, tt.want)
+		}
+	}
+}
+
+func TestLoadMissing(t *testing.T) {
+	if _, err := Load(filepath.Join(t.TempDir(), "none.toml")); err == nil {
+		t.Fatal("loading a missing file succeeded")
+	}
+}
@@ -0,0 +1,314 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// table is a parsed TOML table: keys map to values or nested tables
+type table map[string]interface{}
+
+// parseTOML parses the subset of TOML used by peer config files:
+// comments, [table] and [dotted.table] headers, and key = value pairs
+// whose values are strings, integers, floats, booleans or single-line
+// arrays of those
+func parseTOML(r io.Reader) (table, error) {
+	root := table{}
+	current := root
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated table header", lineNo)
+			}
+			name := strings.TrimSpace(line[1 : len(line)-1])
+			t, err := root.subtable(splitKey(name))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineNo, err)
+			}
+			current = t
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		key := splitKey(strings.TrimSpace(line[:eq]))
+		val, err := parseValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+
+		parent, err := current.subtable(key[:len(key)-1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		parent[key[len(key)-1]] = val
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return root, nil
+}
+
+// subtable returns the nested table at path, creating it if needed
+func (t table) subtable(path []string) (table, error) {
+	for _, name := range path {
+		next, ok := t[name]
+		if !ok {
+			nt := table{}
+			t[name] = nt
+			t = nt
+			continue
+		}
+		nt, ok := next.(table)
+		if !ok {
+			return nil, fmt.Errorf("key %q is not a table", name)
+		}
+		t = nt
+	}
+	return t, nil
+}
+
+// splitKey splits a dotted key, honouring double-quoted segments
+func splitKey(key string) []string {
+	var parts []string
+	var cur strings.Builder
+	quoted := false
+	for _, r := range key {
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == '.' && !quoted:
+			parts = append(parts, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteRune(r)
+		}
+	}
+	return append(parts, strings.TrimSpace(cur.String()))
+}
+
+// stripComment removes a trailing # comment that is not inside a string
+func stripComment(line string) string {
+	quoted := false
+	for i, r := range line {
+		switch r {
+		case '"':
+			quoted = !quoted
+		case '#':
+			if !quoted {
+				return line[:i]
+			}
+		}
+	}
+	return line
+}
+
+// parseValue parses a single TOML value
+func parseValue(s string) (interface{}, error) {
+	switch {
+	case s == "":
+		return nil, fmt.Errorf("missing value")
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	case strings.HasPrefix(s, "["):
+		return parseArray(s)
+	case s == "true":
+		return true, nil
+	case s == "false":
+		return false, nil
+	}
+
+	clean := strings.ReplaceAll(s, "_", "")
+	if i, err := strconv.ParseInt(clean, 0, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(clean, 64); err == nil {
+		return f, nil
+	}
+	return nil, fmt.Errorf("invalid value %s", s)
+}
+
+// parseArray parses a single-line array of scalar values
+func parseArray(s string) ([]interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated array %s", s)
+	}
+	body := strings.TrimSpace(s[1 : len(s)-1])
+
+	var items []interface{}
+	var cur strings.Builder
+	quoted := false
+	flush := func() error {
+		item := strings.TrimSpace(cur.String())
+		cur.Reset()
+		if item == "" {
+			return nil
+		}
+		v, err := parseValue(item)
+		if err != nil {
+			return err
+		}
+		items = append(items, v)
+		return nil
+	}
+	for _, r := range body {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if r == ',' && !quoted {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		cur.WriteRune(r)
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// decode copies the values of t into the struct pointed to by out,
+// matching keys against `toml` struct tags
+func decode(t table, out interface{}) error {
+	return decodeStruct("", t, reflect.ValueOf(out).Elem())
+}
+
+func decodeStruct(prefix string, t table, v reflect.Value) error {
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		if tag := v.Type().Field(i).Tag.Get("toml"); tag != "" {
+			fields[tag] = v.Field(i)
+		}
+	}
+
+	for key, raw := range t {
+		field, ok := fields[key]
+		if !ok {
+			return fmt.Errorf("unknown key %q", prefix+key)
+		}
+		if err := decodeValue(prefix+key, raw, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func decodeValue(name string, raw interface{}, v reflect.Value) error {
+	if s, ok := raw.(scalar); ok && v.Kind() != reflect.Ptr {
+		raw = s.resolve(v)
+	}
+	mismatch := func() error {
+		return fmt.Errorf("key %q: cannot use %v as %s", name, raw, v.Type())
+	}
+
+	if v.Type() == durationType {
+		s, ok := raw.(string)
+		if !ok {
+			return mismatch()
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", name, err)
+		}
+		v.SetInt(int64(d))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		s, ok := raw.(string)
+		if !ok {
+			return mismatch()
+		}
+		v.SetString(s)
+	case reflect.Bool:
+		b, ok := raw.(bool)
+		if !ok {
+			return mismatch()
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		i, ok := raw.(int64)
+		if !ok {
+			return mismatch()
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		switch n := raw.(type) {
+		case float64:
+			v.SetFloat(n)
+		case int64:
+			v.SetFloat(float64(n))
+		default:
+			return mismatch()
+		}
+	case reflect.Slice:
+		items, ok := raw.([]interface{})
+		if !ok {
+			return mismatch()
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := decodeValue(fmt.Sprintf("%s[%d]", name, i), item, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Ptr:
+		// Pointers tell a value set to its zero value from one not set
+		elem := reflect.New(v.Type().Elem())
+		if err := decodeValue(name, raw, elem.Elem()); err != nil {
+			return err
+		}
+		v.Set(elem)
+	case reflect.Struct:
+		sub, ok := raw.(table)
+		if !ok {
+			return mismatch()
+		}
+		return decodeStruct(name+".", sub, v)
+	case reflect.Map:
+		sub, ok := raw.(table)
+		if !ok {
+			return mismatch()
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for key, item := range sub {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeValue(name+"."+key, item, elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+	default:
+		return mismatch()
+	}
+	return nil
+}
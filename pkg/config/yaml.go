@@ -0,0 +1,286 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// scalar is a plain (unquoted) YAML scalar, typed only once the field it
+// is decoded into is known, so that `port: 3000` fills a string field and
+// `nodelay: false` a bool
+type scalar string
+
+// resolve returns s as the type of v, or as a string if it isn't one
+func (s scalar) resolve(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Bool:
+		switch s {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+	case reflect.Int, reflect.Int64, reflect.Int32:
+		if v.Type() == durationType {
+			break
+		}
+		if i, err := strconv.ParseInt(strings.ReplaceAll(string(s), "_", ""), 0, 64); err == nil {
+			return i
+		}
+	case reflect.Float64:
+		if f, err := strconv.ParseFloat(strings.ReplaceAll(string(s), "_", ""), 64); err == nil {
+			return f
+		}
+	}
+	return string(s)
+}
+
+// yamlLine is a line of a YAML file that holds more than a comment
+type yamlLine struct {
+	no     int
+	indent int
+	text   string
+}
+
+// parseYAML parses the subset of YAML used by peer config files: block
+// mappings nested by indentation, "- item" and [flow] lists of scalars,
+// quoted and plain scalars, and comments; it produces the same tables as
+// parseTOML
+func parseYAML(r io.Reader) (table, error) {
+	var lines []yamlLine
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		raw := scanner.Text()
+		text := strings.TrimSpace(stripYAMLComment(raw))
+		if text == "" || text == "---" {
+			continue
+		}
+		indent := len(raw) - len(strings.TrimLeft(raw, " \t"))
+		if strings.Contains(raw[:indent], "\t") {
+			return nil, fmt.Errorf("line %d: tabs can't indent YAML", lineNo)
+		}
+		lines = append(lines, yamlLine{no: lineNo, indent: indent, text: text})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	root := table{}
+	if len(lines) == 0 {
+		return root, nil
+	}
+	if lines[0].indent != 0 {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[0].no)
+	}
+	n, err := parseYAMLMapping(lines, lines[0].indent, root)
+	if err != nil {
+		return nil, err
+	}
+	if n < len(lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", lines[n].no)
+	}
+	return root, nil
+}
+
+// parseYAMLMapping parses the "key: value" lines at indent into t
+// Returns: The number of lines consumed
+func parseYAMLMapping(lines []yamlLine, indent int, t table) (int, error) {
+	i := 0
+	for i < len(lines) && lines[i].indent == indent {
+		l := lines[i]
+		if isYAMLItem(l.text) {
+			return 0, fmt.Errorf("line %d: expected key: value", l.no)
+		}
+		key, value, ok := splitYAMLKey(l.text)
+		if !ok {
+			return 0, fmt.Errorf("line %d: expected key: value", l.no)
+		}
+		if _, dup := t[key]; dup {
+			return 0, fmt.Errorf("line %d: duplicate key %q", l.no, key)
+		}
+		i++
+
+		if value != "" {
+			v, err := parseYAMLValue(value)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: %v", l.no, err)
+			}
+			if v != nil {
+				t[key] = v
+			}
+			continue
+		}
+
+		// A key without a value opens a nested mapping, or a list that
+		// may start at the key's own indentation
+		switch {
+		case i < len(lines) && isYAMLItem(lines[i].text) && lines[i].indent >= indent:
+			items, n, err := parseYAMLList(lines[i:], lines[i].indent)
+			if err != nil {
+				return 0, err
+			}
+			t[key] = items
+			i += n
+		case i < len(lines) && lines[i].indent > indent:
+			sub := table{}
+			n, err := parseYAMLMapping(lines[i:], lines[i].indent, sub)
+			if err != nil {
+				return 0, err
+			}
+			t[key] = sub
+			i += n
+		}
+	}
+	if i < len(lines) && lines[i].indent > indent {
+		return 0, fmt.Errorf("line %d: unexpected indentation", lines[i].no)
+	}
+	return i, nil
+}
+
+// parseYAMLList parses the "- item" lines at indent
+// Returns: The items and the number of lines consumed
+func parseYAMLList(lines []yamlLine, indent int) ([]interface{}, int, error) {
+	var items []interface{}
+	i := 0
+	for i < len(lines) && lines[i].indent == indent && isYAMLItem(lines[i].text) {
+		l := lines[i]
+		item := strings.TrimSpace(strings.TrimPrefix(l.text, "-"))
+		if item == "" || strings.HasPrefix(item, "[") {
+			return nil, 0, fmt.Errorf("line %d: list items must be scalars", l.no)
+		}
+		if _, _, ok := splitYAMLKey(item); ok {
+			return nil, 0, fmt.Errorf("line %d: list items must be scalars", l.no)
+		}
+		v, err := parseYAMLValue(item)
+		if err != nil {
+			return nil, 0, fmt.Errorf("line %d: %v", l.no, err)
+		}
+		items = append(items, v)
+		i++
+	}
+	return items, i, nil
+}
+
+// isYAMLItem reports whether a line is an item of a block list
+func isYAMLItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitYAMLKey splits "key: value" at the first colon outside quotes
+// that ends the line or is followed by a space
+func splitYAMLKey(text string) (key, value string, ok bool) {
+	var quote rune
+	for i, r := range text {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ':' && (i == len(text)-1 || text[i+1] == ' '):
+			key = strings.TrimSpace(text[:i])
+			if k, err := parseYAMLValue(key); err == nil && k != nil {
+				if s, quoted := k.(string); quoted {
+					key = s
+				}
+			}
+			return key, strings.TrimSpace(text[i+1:]), key != ""
+		}
+	}
+	return "", "", false
+}
+
+// stripYAMLComment removes a # comment that starts the line or follows a
+// space, outside quotes
+func stripYAMLComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// parseYAMLValue parses a scalar or a flow list of scalars; null values
+// are returned as nil
+func parseYAMLValue(s string) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return strconv.Unquote(s)
+	case strings.HasPrefix(s, "'"):
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return strings.ReplaceAll(s[1:len(s)-1], "''", "'"), nil
+	case strings.HasPrefix(s, "["):
+		return parseYAMLFlow(s)
+	case strings.HasPrefix(s, "{"):
+		return nil, fmt.Errorf("flow mappings are not supported, nest the keys on their own lines")
+	case strings.HasPrefix(s, "|") || strings.HasPrefix(s, ">"):
+		return nil, fmt.Errorf("block scalars are not supported")
+	case s == "~" || s == "null":
+		return nil, nil
+	}
+	return scalar(s), nil
+}
+
+// parseYAMLFlow parses a single-line [a, b] list of scalars
+func parseYAMLFlow(s string) ([]interface{}, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+	body := s[1 : len(s)-1]
+
+	items := []interface{}{}
+	var quote rune
+	start := 0
+	flush := func(end int) error {
+		item := strings.TrimSpace(body[start:end])
+		if item == "" {
+			return nil
+		}
+		if strings.HasPrefix(item, "[") {
+			return fmt.Errorf("nested lists are not supported")
+		}
+		v, err := parseYAMLValue(item)
+		if err != nil {
+			return err
+		}
+		items = append(items, v)
+		return nil
+	}
+	for i, r := range body {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			if err := flush(i); err != nil {
+				return nil, err
+			}
+			start = i + 1
+		}
+	}
+	if err := flush(len(body)); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
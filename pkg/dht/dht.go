@@ -0,0 +1,346 @@
+// Package dht implements a Kademlia-style distributed hash table, so peers
+// can announce the content they hold and find the providers of a content
+// hash without a central server
+// Nodes keep contacts in a routing table ordered by XOR distance and find
+// the nodes closest to a key through iterative lookups; providers are
+// stored on the K nodes closest to the content's key. The package doesn't
+// do any networking itself: it sends its queries through a Network, and
+// the answers to queries from other nodes come from Node's methods
+package dht
+
+import (
+	"context"
+	"errors"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// K is the size of the buckets, and the number of nodes a provider is
+// stored on
+const K = 20
+
+// Alpha is the number of queries a lookup has in flight at once
+const Alpha = 3
+
+// ProviderTTL is how long a provider record is kept unless announced again
+const ProviderTTL = 24 * time.Hour
+
+// maxProviders bounds the providers a lookup collects before stopping
+const maxProviders = 50
+
+// Provider is a peer that announced it holds content
+type Provider struct {
+	PeerID string `json:"peer_id"`
+	Addr   string `json:"addr"` // Address its transport listens on
+	Name   string `json:"name"` // Name of the file at the provider
+}
+
+// Network sends queries to other nodes. Implementations pass the peer ID
+// and address of every node that answers, or sends a query, to Node.Seen;
+// nodes that fail to answer are dropped from the routing table
+type Network interface {
+	// FindNode asks to for the contacts it knows closest to target
+	FindNode(ctx context.Context, to Contact, target Key) ([]Contact, error)
+	// FindProviders asks to for the providers of key it stores, and the
+	// contacts it knows closest to key
+	FindProviders(ctx context.Context, to Contact, key Key) ([]Provider, []Contact, error)
+	// AddProvider asks to to store the local node as a provider of key,
+	// holding it under name
+	AddProvider(ctx context.Context, to Contact, key Key, name string) error
+}
+
+// Stats summarizes the state of a node
+type Stats struct {
+	Contacts  int `json:"contacts"`  // Contacts in the routing table
+	Keys      int `json:"keys"`      // Keys with provider records stored for other nodes
+	Providers int `json:"providers"` // Provider records stored for other nodes
+}
+
+// Node is the local node of the DHT
+type Node struct {
+	self   Contact
+	net    Network
+	table  *table
+	logger *log.Logger
+
+	mu        sync.Mutex
+	providers map[Key]map[string]providerRecord // Stored providers by key and peer ID
+}
+
+// providerRecord is a stored provider with its expiry
+type providerRecord struct {
+	Provider
+	expires time.Time
+}
+
+// New creates the local node for the peer with the given ID
+// addr: Address the peer listens on, announced to other nodes
+func New(peerID, addr string, net Network, logger *log.Logger) *Node {
+	self := Contact{ID: NodeKey(peerID), PeerID: peerID, Addr: addr}
+	return &Node{
+		self:      self,
+		net:       net,
+		table:     &table{self: self.ID},
+		logger:    logger,
+		providers: make(map[Key]map[string]providerRecord),
+	}
+}
+
+// Self returns the local node's contact
+func (n *Node) Self() Contact {
+	return n.self
+}
+
+// Seen records a message from the node run by peerID at addr
+func (n *Node) Seen(peerID, addr string) {
+	if peerID == "" || addr == "" {
+		return
+	}
+	n.table.seen(Contact{ID: NodeKey(peerID), PeerID: peerID, Addr: addr})
+}
+
+// Closest returns up to K contacts closest to target, for answering a
+// query; the asking node is left out
+func (n *Node) Closest(target Key, asker string) []Contact {
+	contacts := n.table.closest(target, K+1)
+	var out []Contact
+	for _, c := range contacts {
+		if c.PeerID != asker && len(out) < K {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Providers returns the unexpired providers stored for key
+func (n *Node) Providers(key Key) []Provider {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	var out []Provider
+	for id, rec := range n.providers[key] {
+		if now.After(rec.expires) {
+			delete(n.providers[key], id)
+			continue
+		}
+		out = append(out, rec.Provider)
+	}
+	if len(n.providers[key]) == 0 {
+		delete(n.providers, key)
+	}
+	return out
+}
+
+// StoreProvider stores p as a provider of key for ProviderTTL, on another
+// node's request
+func (n *Node) StoreProvider(key Key, p Provider) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.providers[key] == nil {
+		n.providers[key] = make(map[string]providerRecord)
+	}
+	n.providers[key][p.PeerID] = providerRecord{Provider: p, expires: time.Now().Add(ProviderTTL)}
+}
+
+// Expire drops the provider records that ran out
+func (n *Node) Expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for key, recs := range n.providers {
+		for id, rec := range recs {
+			if now.After(rec.expires) {
+				delete(recs, id)
+			}
+		}
+		if len(recs) == 0 {
+			delete(n.providers, key)
+		}
+	}
+}
+
+// Stats returns the size of the routing table and the provider store
+func (n *Node) Stats() Stats {
+	s := Stats{Contacts: n.table.size()}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	s.Keys = len(n.providers)
+	for _, recs := range n.providers {
+		s.Providers += len(recs)
+	}
+	return s
+}
+
+// Bootstrap joins the DHT through nodes at the given addresses, whose peer
+// IDs need not be known, by looking up the local node's own ID
+// Returns: An error if none of them answered
+func (n *Node) Bootstrap(ctx context.Context, addrs []string) error {
+	answered := 0
+	for _, addr := range addrs {
+		// The answer adds the node to the routing table, see Network
+		if _, err := n.net.FindNode(ctx, Contact{Addr: addr}, n.self.ID); err != nil {
+			logging.Warnf(n.logger, "DHT bootstrap node %s: %v", addr, err)
+			continue
+		}
+		answered++
+	}
+	if answered == 0 && len(addrs) > 0 {
+		return errors.New("no DHT bootstrap node answered")
+	}
+	_, _, err := n.lookup(ctx, n.self.ID, false)
+	return err
+}
+
+// Refresh looks up the local node's own ID, keeping the contacts closest
+// to it fresh and letting new nodes nearby learn about it
+func (n *Node) Refresh(ctx context.Context) error {
+	_, _, err := n.lookup(ctx, n.self.ID, false)
+	return err
+}
+
+// Announce stores the local node as a provider of key on the K nodes
+// closest to it
+// name: Name of the file holding the content at the local node
+// Returns: The number of nodes that stored it
+func (n *Node) Announce(ctx context.Context, key Key, name string) (int, error) {
+	contacts, _, err := n.lookup(ctx, key, false)
+	if err != nil {
+		return 0, err
+	}
+	stored := 0
+	for _, c := range contacts {
+		if err := n.net.AddProvider(ctx, c, key, name); err != nil {
+			if ctx.Err() == nil {
+				n.table.remove(c.ID)
+			}
+			continue
+		}
+		stored++
+	}
+	return stored, nil
+}
+
+// FindProviders looks up the providers of key, starting with those the
+// local node stores
+func (n *Node) FindProviders(ctx context.Context, key Key) ([]Provider, error) {
+	local := n.Providers(key)
+	if len(local) >= maxProviders {
+		return local, nil
+	}
+	_, found, err := n.lookup(ctx, key, true)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var out []Provider
+	for _, p := range append(local, found...) {
+		if !seen[p.PeerID] {
+			seen[p.PeerID] = true
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// lookup runs an iterative lookup for target: it repeatedly queries the
+// Alpha closest contacts not yet asked, until the K closest it knows of
+// have all answered
+// withProviders asks for providers of target on the way, stopping once
+// maxProviders are found
+// Returns: The K closest contacts that answered, and the providers found
+func (n *Node) lookup(ctx context.Context, target Key, withProviders bool) ([]Contact, []Provider, error) {
+	type answer struct {
+		from      Contact
+		contacts  []Contact
+		providers []Provider
+		err       error
+	}
+
+	candidates := n.table.closest(target, K)
+	known := make(map[Key]bool)
+	for _, c := range candidates {
+		known[c.ID] = true
+	}
+	asked := make(map[Key]bool)
+	var answered []Contact
+	var providers []Provider
+	seenProvider := make(map[string]bool)
+
+	answers := make(chan answer)
+	inFlight := 0
+	for {
+		// Query the closest candidates not yet asked, keeping Alpha in flight
+		sortByDistance(target, candidates)
+		for _, c := range candidates[:min(K, len(candidates))] {
+			if inFlight >= Alpha {
+				break
+			}
+			if asked[c.ID] {
+				continue
+			}
+			asked[c.ID] = true
+			inFlight++
+			go func(c Contact) {
+				a := answer{from: c}
+				if withProviders {
+					a.providers, a.contacts, a.err = n.net.FindProviders(ctx, c, target)
+				} else {
+					a.contacts, a.err = n.net.FindNode(ctx, c, target)
+				}
+				answers <- a
+			}(c)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		a := <-answers
+		inFlight--
+		if a.err != nil {
+			if ctx.Err() == nil {
+				n.table.remove(a.from.ID)
+			}
+			candidates = slices.DeleteFunc(candidates, func(c Contact) bool { return c.ID == a.from.ID })
+			continue
+		}
+		answered = append(answered, a.from)
+		for _, c := range a.contacts {
+			if c.PeerID == "" || c.ID == n.self.ID || known[c.ID] {
+				continue
+			}
+			known[c.ID] = true
+			candidates = append(candidates, c)
+		}
+		for _, p := range a.providers {
+			if !seenProvider[p.PeerID] {
+				seenProvider[p.PeerID] = true
+				providers = append(providers, p)
+			}
+		}
+		if withProviders && len(providers) >= maxProviders {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	// Let the queries still running finish in the background
+	go func(pending int) {
+		for ; pending > 0; pending-- {
+			<-answers
+		}
+	}(inFlight)
+
+	if len(answered) == 0 && ctx.Err() != nil {
+		return nil, providers, ctx.Err()
+	}
+	sortByDistance(target, answered)
+	return answered[:min(K, len(answered))], providers, nil
+}
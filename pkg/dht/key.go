@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+)
+
+// KeySize is the length of keys in bytes
+const KeySize = sha256.Size
+
+// Key places nodes and content in the DHT's keyspace: node IDs are the
+// SHA-256 of peer IDs, and content is keyed by its content hash, see
+// protocol.Manifest.ContentHash
+type Key [KeySize]byte
+
+// NodeKey returns the ID of the node run by the peer with the given ID
+func NodeKey(peerID string) Key {
+	return sha256.Sum256([]byte(peerID))
+}
+
+// KeyFromBytes converts a hash of KeySize bytes into a key
+func KeyFromBytes(b []byte) (Key, error) {
+	var k Key
+	if len(b) != KeySize {
+		return k, fmt.Errorf("key has %d bytes, want %d", len(b), KeySize)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+// ParseKey parses a key written in hex, as String prints it
+func ParseKey(s string) (Key, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid key %q: %v", s, err)
+	}
+	return KeyFromBytes(b)
+}
+
+// String returns the key in hex
+func (k Key) String() string {
+	return hex.EncodeToString(k[:])
+}
+
+// xor returns the Kademlia distance between a and b
+func xor(a, b Key) Key {
+	var d Key
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b
+func closer(target, a, b Key) bool {
+	da, db := xor(target, a), xor(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefix returns the number of leading bits a and b share, which
+// picks the bucket of the routing table b belongs in when a is the local
+// node; KeySize*8 if they are equal
+func commonPrefix(a, b Key) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return KeySize * 8
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Contact is a node of the DHT
+type Contact struct {
+	ID       Key       `json:"id"`
+	PeerID   string    `json:"peer_id"`
+	Addr     string    `json:"addr"`      // Address its transport listens on
+	LastSeen time.Time `json:"last_seen"` // Time of the last message from it
+}
+
+// table is the routing table of a node: one bucket of at most K contacts
+// for every length of the prefix they share with the local ID
+// Like in Kademlia, contacts that keep answering are preferred over new
+// ones, so a full bucket ignores new contacts until one of its own fails
+type table struct {
+	self Key
+
+	mu      sync.Mutex
+	buckets [KeySize * 8][]Contact // Least recently seen first
+}
+
+// seen records a message from c, moving it to the back of its bucket
+func (t *table) seen(c Contact) {
+	if c.ID == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c.LastSeen = time.Now()
+	b := &t.buckets[commonPrefix(t.self, c.ID)]
+	if i := slices.IndexFunc(*b, func(o Contact) bool { return o.ID == c.ID }); i >= 0 {
+		*b = slices.Delete(*b, i, i+1)
+	} else if len(*b) >= K {
+		return
+	}
+	*b = append(*b, c)
+}
+
+// remove drops the contact with the given ID, e.g. after it failed to answer
+func (t *table) remove(id Key) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[commonPrefix(t.self, id)]
+	*b = slices.DeleteFunc(*b, func(o Contact) bool { return o.ID == id })
+}
+
+// closest returns up to n contacts closest to target, closest first
+func (t *table) closest(target Key, n int) []Contact {
+	t.mu.Lock()
+	var all []Contact
+	for _, b := range t.buckets {
+		all = append(all, b...)
+	}
+	t.mu.Unlock()
+
+	sortByDistance(target, all)
+	return all[:min(n, len(all))]
+}
+
+// size returns the number of contacts in the table
+func (t *table) size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+// sortByDistance sorts contacts by their distance to target, closest first
+func sortByDistance(target Key, contacts []Contact) {
+	slices.SortFunc(contacts, func(a, b Contact) int {
+		switch {
+		case closer(target, a.ID, b.ID):
+			return -1
+		case closer(target, b.ID, a.ID):
+			return 1
+		}
+		return 0
+	})
+}
@@ -0,0 +1,302 @@
+// Package discovery finds peers on the local network over multicast DNS
+// (RFC 6762). Each peer advertises a "_p2pft._tcp.local." service instance
+// named after its peer ID, with a TXT record holding the ID and the address
+// its transport listens on, and keeps a live list of the instances other
+// peers advertise
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// ServiceName is the DNS-SD service type peers advertise themselves under
+const ServiceName = "_p2pft._tcp.local."
+
+// mdnsAddr is the IPv4 multicast group and port of mDNS
+var mdnsAddr = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// maxPacket is the largest mDNS packet read; RFC 6762 allows up to 9000 bytes
+const maxPacket = 9000
+
+// minAnswerGap rate-limits the answers to queries, as RFC 6762 asks
+const minAnswerGap = time.Second
+
+// Entry is a peer discovered on the local network
+type Entry struct {
+	ID      string    `json:"id"`      // Peer ID the peer advertised
+	Addr    string    `json:"addr"`    // Address its transport listens on
+	Seen    time.Time `json:"seen"`    // Time of its last announcement
+	Expires time.Time `json:"expires"` // When it is dropped unless announced again
+}
+
+// Service advertises a peer over mDNS and tracks the other peers doing so
+type Service struct {
+	id       string
+	instance string // DNS name of the service instance, e.g. "peer1._p2pft._tcp.local."
+	addr     string
+	port     uint16
+	interval time.Duration
+	logger   *log.Logger
+	conn     *net.UDPConn
+
+	mu         sync.Mutex
+	peers      map[string]*Entry // Discovered peers by peer ID
+	lastAnswer time.Time         // When a query was last answered
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Start joins the mDNS group on the default multicast interface, announces
+// the peer and asks the others on the network to announce themselves
+// id: Peer ID to advertise, at most 63 bytes without dots
+// addr: Address the peer listens on; an unspecified host such as 0.0.0.0
+// is replaced by the source address of the announcements on the receiving
+// side
+// interval: How often the announcement is repeated; other peers drop this
+// one three intervals after the last
+func Start(id, addr string, interval time.Duration, logger *log.Logger) (*Service, error) {
+	if err := checkLabel(id); err != nil {
+		return nil, fmt.Errorf("invalid peer ID for discovery: %v", err)
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address %q: %v", addr, err)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid announce interval %v", interval)
+	}
+
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to join the mDNS group: %v", err)
+	}
+	// Peers on the same host must hear each other too
+	if err := setMulticastLoop(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable multicast loopback: %v", err)
+	}
+
+	s := &Service{
+		id:       id,
+		instance: id + "." + ServiceName,
+		addr:     addr,
+		port:     uint16(port),
+		interval: interval,
+		logger:   logger,
+		conn:     conn,
+		peers:    make(map[string]*Entry),
+		done:     make(chan struct{}),
+	}
+	s.wg.Add(2)
+	go s.readLoop()
+	go s.announceLoop()
+	return s, nil
+}
+
+// Peers returns the peers currently advertised on the network, sorted by
+// peer ID
+func (s *Service) Peers() []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	peers := make([]Entry, 0, len(s.peers))
+	for _, e := range s.peers {
+		if now.Before(e.Expires) {
+			peers = append(peers, *e)
+		}
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers
+}
+
+// Close announces that the peer is leaving and stops the service
+func (s *Service) Close() error {
+	close(s.done)
+	s.send(s.announcement(0))
+	err := s.conn.Close()
+	s.wg.Wait()
+	return err
+}
+
+// announceLoop queries for other peers once, then announces this one
+// every interval and drops peers that stopped announcing themselves
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+
+	var b builder
+	b.header(0, 1, 0)
+	b.question(ServiceName, typePTR)
+	s.send(b.buf)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		s.send(s.announcement(s.ttl()))
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		s.expire()
+	}
+}
+
+// readLoop handles the mDNS packets received until the service closes
+func (s *Service) readLoop() {
+	defer s.wg.Done()
+
+	buf := make([]byte, maxPacket)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+			logging.Errorf(s.logger, "mDNS read error: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		msg, err := parseMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		if msg.response {
+			s.handleResponse(msg, src)
+		} else {
+			s.handleQuery(msg)
+		}
+	}
+}
+
+// handleQuery answers a query for the service with the announcement
+func (s *Service) handleQuery(msg *message) {
+	asked := false
+	for _, q := range msg.questions {
+		if (q.name == ServiceName || q.name == strings.ToLower(s.instance)) && (q.qtype == typePTR || q.qtype == typeTXT || q.qtype == typeANY) {
+			asked = true
+		}
+	}
+	if !asked {
+		return
+	}
+	s.mu.Lock()
+	if time.Since(s.lastAnswer) < minAnswerGap {
+		s.mu.Unlock()
+		return
+	}
+	s.lastAnswer = time.Now()
+	s.mu.Unlock()
+	s.send(s.announcement(s.ttl()))
+}
+
+// handleResponse records the peers announced in a response
+// A TTL of 0 announces that a peer left
+func (s *Service) handleResponse(msg *message, src *net.UDPAddr) {
+	for _, r := range msg.records {
+		if r.rtype != typeTXT || !strings.HasSuffix(r.name, "."+ServiceName) {
+			continue
+		}
+		var id, addr string
+		for _, kv := range readTXT(r.data) {
+			if v, ok := strings.CutPrefix(kv, "id="); ok {
+				id = v
+			} else if v, ok := strings.CutPrefix(kv, "addr="); ok {
+				addr = v
+			}
+		}
+		if id == "" || id == s.id || addr == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			addr = net.JoinHostPort(src.IP.String(), port)
+		}
+		s.update(id, addr, r.ttl)
+	}
+}
+
+// update records an announcement of the peer id at addr
+func (s *Service) update(id, addr string, ttl uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, known := s.peers[id]
+	if ttl == 0 {
+		if known {
+			delete(s.peers, id)
+			logging.Infof(s.logger, "Peer %s left the local network", id)
+		}
+		return
+	}
+	now := time.Now()
+	if !known {
+		e = &Entry{ID: id}
+		s.peers[id] = e
+	}
+	if !known || e.Addr != addr {
+		logging.Infof(s.logger, "Discovered peer %s at %s", id, addr)
+	}
+	e.Addr = addr
+	e.Seen = now
+	e.Expires = now.Add(time.Duration(ttl) * time.Second)
+}
+
+// expire drops the peers whose announcements ran out
+func (s *Service) expire() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for id, e := range s.peers {
+		if !now.Before(e.Expires) {
+			delete(s.peers, id)
+			logging.Infof(s.logger, "Peer %s is no longer announced on the local network", id)
+		}
+	}
+}
+
+// ttl returns the TTL of the announcement records in seconds
+func (s *Service) ttl() uint32 {
+	return uint32(max(3*s.interval/time.Second, 1))
+}
+
+// announcement builds the response advertising this peer
+func (s *Service) announcement(ttl uint32) []byte {
+	var b builder
+	b.header(flagResponse, 0, 3)
+	b.record(ServiceName, typePTR, classIN, ttl, func() { b.name(s.instance) })
+	b.record(s.instance, typeSRV, classIN|cacheFlush, ttl, func() { b.srv(s.port, s.id+".local.") })
+	b.record(s.instance, typeTXT, classIN|cacheFlush, ttl, func() { b.txt("id="+s.id, "addr="+s.addr) })
+	return b.buf
+}
+
+// send multicasts a packet to the mDNS group
+func (s *Service) send(packet []byte) {
+	if _, err := s.conn.WriteToUDP(packet, mdnsAddr); err != nil {
+		select {
+		case <-s.done:
+		default:
+			logging.Errorf(s.logger, "mDNS send error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package discovery
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// DNS record types and classes used by the service
+const (
+	typePTR = 12
+	typeTXT = 16
+	typeSRV = 33
+	typeANY = 255
+
+	classIN    = 1
+	cacheFlush = 0x8000 // Set on records only their owner announces
+)
+
+// flagResponse marks a message as an authoritative answer
+const flagResponse = 0x8400
+
+// errMalformed is returned for packets that aren't valid DNS messages
+var errMalformed = errors.New("malformed DNS message")
+
+// question is a question of a DNS message
+type question struct {
+	name  string
+	qtype uint16
+}
+
+// record is a resource record of a DNS message
+type record struct {
+	name  string
+	rtype uint16
+	class uint16
+	ttl   uint32
+	data  []byte // Raw record data
+}
+
+// message is a parsed DNS message
+type message struct {
+	response  bool
+	questions []question
+	records   []record // Answers and additional records alike
+}
+
+// builder appends DNS messages without name compression
+type builder struct {
+	buf []byte
+}
+
+// header starts a message with the given counts of questions and records
+func (b *builder) header(flags uint16, questions, answers int) {
+	b.buf = binary.BigEndian.AppendUint16(b.buf, 0) // mDNS messages have ID 0
+	b.buf = binary.BigEndian.AppendUint16(b.buf, flags)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, uint16(questions))
+	b.buf = binary.BigEndian.AppendUint16(b.buf, uint16(answers))
+	b.buf = binary.BigEndian.AppendUint16(b.buf, 0)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, 0)
+}
+
+// name appends a domain name such as "peer1._p2pft._tcp.local."
+// Labels must be at most 63 bytes, see checkLabel
+func (b *builder) name(name string) {
+	for _, label := range splitName(name) {
+		b.buf = append(b.buf, byte(len(label)))
+		b.buf = append(b.buf, label...)
+	}
+	b.buf = append(b.buf, 0)
+}
+
+// question appends a question for records of qtype
+func (b *builder) question(name string, qtype uint16) {
+	b.name(name)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, qtype)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, classIN)
+}
+
+// record appends a record, with data written by the data function
+func (b *builder) record(name string, rtype, class uint16, ttl uint32, data func()) {
+	b.name(name)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, rtype)
+	b.buf = binary.BigEndian.AppendUint16(b.buf, class)
+	b.buf = binary.BigEndian.AppendUint32(b.buf, ttl)
+	lenAt := len(b.buf)
+	b.buf = append(b.buf, 0, 0)
+	data()
+	binary.BigEndian.PutUint16(b.buf[lenAt:], uint16(len(b.buf)-lenAt-2))
+}
+
+// txt appends TXT record data holding the given strings
+func (b *builder) txt(strs ...string) {
+	for _, s := range strs {
+		b.buf = append(b.buf, byte(len(s)))
+		b.buf = append(b.buf, s...)
+	}
+}
+
+// srv appends SRV record data pointing at port on target
+func (b *builder) srv(port uint16, target string) {
+	b.buf = binary.BigEndian.AppendUint16(b.buf, 0) // Priority
+	b.buf = binary.BigEndian.AppendUint16(b.buf, 0) // Weight
+	b.buf = binary.BigEndian.AppendUint16(b.buf, port)
+	b.name(target)
+}
+
+// splitName splits a domain name into its labels
+func splitName(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, ".")
+}
+
+// checkLabel checks that s fits in a single DNS label
+func checkLabel(s string) error {
+	if s == "" || len(s) > 63 || strings.Contains(s, ".") {
+		return fmt.Errorf("%q can't be a DNS label: it must be 1 to 63 bytes without dots", s)
+	}
+	return nil
+}
+
+// parseMessage parses a DNS message
+func parseMessage(msg []byte) (*message, error) {
+	if len(msg) < 12 {
+		return nil, errMalformed
+	}
+	m := &message{response: msg[2]&0x80 != 0}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:])) + int(binary.BigEndian.Uint16(msg[10:]))
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+4 > len(msg) {
+			return nil, errMalformed
+		}
+		// The top bit of the class asks for a unicast reply; it is ignored
+		m.questions = append(m.questions, question{name: name, qtype: binary.BigEndian.Uint16(msg[next:])})
+		off = next + 4
+	}
+	for i := 0; i < rrcount; i++ {
+		name, next, err := readName(msg, off)
+		if err != nil || next+10 > len(msg) {
+			return nil, errMalformed
+		}
+		r := record{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[next:]),
+			class: binary.BigEndian.Uint16(msg[next+2:]),
+			ttl:   binary.BigEndian.Uint32(msg[next+4:]),
+		}
+		end := next + 10 + int(binary.BigEndian.Uint16(msg[next+8:]))
+		if end > len(msg) {
+			return nil, errMalformed
+		}
+		r.data = msg[next+10 : end]
+		m.records = append(m.records, r)
+		off = end
+	}
+	return m, nil
+}
+
+// readName reads the possibly compressed domain name at off
+// Returns: The name, lower-cased and ending in a dot, and the offset after it
+func readName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errMalformed
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if sb.Len() == 0 {
+				sb.WriteByte('.')
+			}
+			return strings.ToLower(sb.String()), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errMalformed
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			return "", 0, errMalformed
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errMalformed
+			}
+			sb.Write(msg[off+1 : off+1+n])
+			sb.WriteByte('.')
+			off += 1 + n
+		}
+	}
+}
+
+// readTXT returns the strings of TXT record data
+func readTXT(data []byte) []string {
+	var strs []string
+	for len(data) > 0 {
+		n := int(data[0])
+		if 1+n > len(data) {
+			break
+		}
+		strs = append(strs, string(data[1:1+n]))
+		data = data[1+n:]
+	}
+	return strs
+}
@@ -0,0 +1,11 @@
+//go:build !unix
+
+package discovery
+
+import "net"
+
+// setMulticastLoop is not supported on this platform; peers on the same
+// host may not discover each other
+func setMulticastLoop(conn *net.UDPConn) error {
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build unix
+
+package discovery
+
+import (
+	"net"
+	"syscall"
+)
+
+// setMulticastLoop delivers the packets sent on conn to other sockets of
+// the host that joined the group, which ListenMulticastUDP turns off
+func setMulticastLoop(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
@@ -0,0 +1,243 @@
+package grpclite
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxMessageSize caps a request message, as gRPC servers do by default
+const maxMessageSize = 4 << 20
+
+// Code is a gRPC status code
+type Code int
+
+// Status codes used by the handlers, see the gRPC documentation for all
+const (
+	OK               Code = 0
+	Canceled         Code = 1
+	Unknown          Code = 2
+	InvalidArgument  Code = 3
+	DeadlineExceeded Code = 4
+	NotFound         Code = 5
+	PermissionDenied Code = 7
+	Unimplemented    Code = 12
+	Internal         Code = 13
+	Unavailable      Code = 14
+)
+
+// Status is an error carrying the gRPC status a call fails with
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("rpc error: code = %d desc = %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status error with a formatted message
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// UnaryHandler serves a call taking one message and answering with one
+// req: The fields of the request
+type UnaryHandler func(ctx context.Context, req []Field) (Message, error)
+
+// StreamHandler serves a call taking one message and answering with a
+// stream of them, which ends when it returns
+// send: Sends the next message of the stream
+type StreamHandler func(ctx context.Context, req []Field, send func(Message) error) error
+
+// Server dispatches gRPC calls to the handlers registered for their
+// methods; register them all before serving
+type Server struct {
+	unary   map[string]UnaryHandler
+	streams map[string]StreamHandler
+	http    *http.Server
+}
+
+// NewServer creates a server without any methods
+func NewServer() *Server {
+	return &Server{unary: map[string]UnaryHandler{}, streams: map[string]StreamHandler{}}
+}
+
+// Handle registers a unary method
+// method: Its full name, e.g. "/package.Service/Method"
+func (s *Server) Handle(method string, h UnaryHandler) {
+	s.unary[method] = h
+}
+
+// HandleStream registers a server-streaming method
+func (s *Server) HandleStream(method string, h StreamHandler) {
+	s.streams[method] = h
+}
+
+// Serve accepts calls on ln until Close is called
+func (s *Server) Serve(ln net.Listener) error {
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	s.http = &http.Server{Handler: s, Protocols: &protocols, ReadHeaderTimeout: 10 * time.Second}
+	err := s.http.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server, ending the calls in progress
+func (s *Server) Close() error {
+	if s.http == nil {
+		return nil
+	}
+	return s.http.Close()
+}
+
+// ServeHTTP serves one call
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	// The status always goes in the trailers, after any messages
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+
+	ctx := r.Context()
+	if timeout, ok := parseTimeout(r.Header.Get("Grpc-Timeout")); ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := s.serve(ctx, w, r)
+	if err != nil && ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			err = Errorf(DeadlineExceeded, "%v", err)
+		} else {
+			err = Errorf(Canceled, "%v", err)
+		}
+	}
+	var st *Status
+	switch {
+	case err == nil:
+		st = &Status{Code: OK}
+	case !errors.As(err, &st):
+		st = &Status{Code: Unknown, Message: err.Error()}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(int(st.Code)))
+	if st.Message != "" {
+		w.Header().Set("Grpc-Message", percentEncode(st.Message))
+	}
+}
+
+// serve reads the request message and runs the method's handler
+func (s *Server) serve(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
+	unary, isUnary := s.unary[r.URL.Path]
+	stream, isStream := s.streams[r.URL.Path]
+	if !isUnary && !isStream {
+		return Errorf(Unimplemented, "unknown method %s", r.URL.Path)
+	}
+	if enc := r.Header.Get("Grpc-Encoding"); enc != "" && enc != "identity" {
+		return Errorf(Unimplemented, "compression %s is not supported", enc)
+	}
+	body, err := readMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	req, err := Parse(body)
+	if err != nil {
+		return Errorf(InvalidArgument, "malformed request: %v", err)
+	}
+
+	w.WriteHeader(http.StatusOK)
+	send := func(m Message) error {
+		if err := writeMessage(w, m); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		return nil
+	}
+	if isStream {
+		return stream(ctx, req, send)
+	}
+	resp, err := unary(ctx, req)
+	if err != nil {
+		return err
+	}
+	return send(resp)
+}
+
+// readMessage reads the one length-prefixed message of a request
+func readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, Errorf(InvalidArgument, "reading the request: %v", err)
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, Errorf(InvalidArgument, "request of %d bytes is too large", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, Errorf(InvalidArgument, "reading the request: %v", err)
+	}
+	return body, nil
+}
+
+// writeMessage writes one length-prefixed, uncompressed message
+func writeMessage(w io.Writer, m Message) error {
+	var prefix [5]byte
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(m)))
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(m)
+	return err
+}
+
+// parseTimeout reads a grpc-timeout header such as "500m" or "10S"
+func parseTimeout(s string) (time.Duration, bool) {
+	if len(s) < 2 {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	units := map[byte]time.Duration{
+		'H': time.Hour, 'M': time.Minute, 'S': time.Second,
+		'm': time.Millisecond, 'u': time.Microsecond, 'n': time.Nanosecond,
+	}
+	unit, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+// percentEncode escapes a grpc-message the way gRPC requires: bytes
+// outside printable ASCII, and "%", as %XX
+func percentEncode(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		} else {
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,168 @@
+// Package grpclite serves gRPC services without generated code: messages
+// are encoded and decoded field by field in the protocol buffers wire
+// format, and calls are served over HTTP/2 without TLS, as clients
+// connecting with plaintext credentials expect
+package grpclite
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Wire types of protocol buffers fields
+const (
+	WireVarint  = 0
+	WireFixed64 = 1
+	WireBytes   = 2
+	WireFixed32 = 5
+)
+
+// Message is an encoded protocol buffers message, built by appending its
+// fields; fields holding their zero value are left out, as in proto3
+type Message []byte
+
+func (m *Message) tag(num, wire int) {
+	*m = binary.AppendUvarint(*m, uint64(num)<<3|uint64(wire))
+}
+
+// Uint appends a uint64, uint32 or enum field
+func (m *Message) Uint(num int, v uint64) {
+	if v != 0 {
+		m.tag(num, WireVarint)
+		*m = binary.AppendUvarint(*m, v)
+	}
+}
+
+// Int appends an int64 or int32 field
+func (m *Message) Int(num int, v int64) {
+	m.Uint(num, uint64(v))
+}
+
+// Bool appends a bool field
+func (m *Message) Bool(num int, v bool) {
+	if v {
+		m.Uint(num, 1)
+	}
+}
+
+// Double appends a double field
+func (m *Message) Double(num int, v float64) {
+	if v != 0 {
+		m.tag(num, WireFixed64)
+		*m = binary.LittleEndian.AppendUint64(*m, math.Float64bits(v))
+	}
+}
+
+// Bytes appends a bytes field
+func (m *Message) Bytes(num int, v []byte) {
+	if len(v) > 0 {
+		m.tag(num, WireBytes)
+		*m = binary.AppendUvarint(*m, uint64(len(v)))
+		*m = append(*m, v...)
+	}
+}
+
+// String appends a string field, or one element of a repeated one
+func (m *Message) String(num int, v string) {
+	if v != "" {
+		m.tag(num, WireBytes)
+		*m = binary.AppendUvarint(*m, uint64(len(v)))
+		*m = append(*m, v...)
+	}
+}
+
+// Embed appends a message field, or one element of a repeated one; unlike
+// the other fields it's kept when empty, so repeated messages keep their
+// count
+func (m *Message) Embed(num int, v Message) {
+	m.tag(num, WireBytes)
+	*m = binary.AppendUvarint(*m, uint64(len(v)))
+	*m = append(*m, v...)
+}
+
+// Timestamp appends a google.protobuf.Timestamp field; the zero time is
+// left out
+func (m *Message) Timestamp(num int, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+	var ts Message
+	ts.Int(1, t.Unix())
+	ts.Int(2, int64(t.Nanosecond()))
+	m.Embed(num, ts)
+}
+
+// Duration appends a google.protobuf.Duration field; zero is left out
+func (m *Message) Duration(num int, d time.Duration) {
+	if d == 0 {
+		return
+	}
+	var dm Message
+	dm.Int(1, int64(d/time.Second))
+	dm.Int(2, int64(d%time.Second))
+	m.Embed(num, dm)
+}
+
+// Field is one field of a decoded message
+type Field struct {
+	Num   int
+	Wire  int
+	Value uint64 // Of varint and fixed fields
+	Data  []byte // Of length-delimited fields
+}
+
+// Int returns the field as an int64 or int32
+func (f Field) Int() int64 { return int64(f.Value) }
+
+// Bool returns the field as a bool
+func (f Field) Bool() bool { return f.Value != 0 }
+
+// String returns the field as a string
+func (f Field) String() string { return string(f.Data) }
+
+// Parse splits an encoded message into its fields, in the order they
+// were sent; a repeated field appears once per element
+func Parse(b []byte) ([]Field, error) {
+	var fields []Field
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("malformed field key")
+		}
+		b = b[n:]
+		f := Field{Num: int(key >> 3), Wire: int(key & 7)}
+		if f.Num <= 0 {
+			return nil, fmt.Errorf("invalid field number %d", f.Num)
+		}
+		switch f.Wire {
+		case WireVarint:
+			if f.Value, n = binary.Uvarint(b); n <= 0 {
+				return nil, fmt.Errorf("malformed varint in field %d", f.Num)
+			}
+			b = b[n:]
+		case WireFixed64:
+			if len(b) < 8 {
+				return nil, fmt.Errorf("truncated field %d", f.Num)
+			}
+			f.Value, b = binary.LittleEndian.Uint64(b), b[8:]
+		case WireFixed32:
+			if len(b) < 4 {
+				return nil, fmt.Errorf("truncated field %d", f.Num)
+			}
+			f.Value, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		case WireBytes:
+			size, n := binary.Uvarint(b)
+			if n <= 0 || size > uint64(len(b)-n) {
+				return nil, fmt.Errorf("truncated field %d", f.Num)
+			}
+			f.Data, b = b[n:n+int(size)], b[n+int(size):]
+		default:
+			return nil, fmt.Errorf("unsupported wire type %d in field %d", f.Wire, f.Num)
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
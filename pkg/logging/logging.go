@@ -0,0 +1,91 @@
+// Package logging writes log lines at a level through standard library
+// loggers, leaving out those below the level set for the process
+// Infof, Warnf and Errorf each state the level of their line; lines
+// written with the logger's own methods, such as log.Fatal, are always
+// written
+package logging
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Level is the severity of a log line
+type Level int32
+
+const (
+	Info  Level = iota // Routine progress, the default
+	Warn               // Skipped, refused or retried work
+	Error              // Failures
+)
+
+var levelNames = []string{"info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// Levels returns the names of the levels, lowest first
+func Levels() []string {
+	return append([]string(nil), levelNames...)
+}
+
+// ParseLevel parses a level name, "" meaning Info
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return Info, nil
+	}
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return Info, fmt.Errorf("unknown log level %q: want one of %s", s, strings.Join(levelNames, ", "))
+}
+
+// level is the lowest level written, shared by every logger so that it
+// can change while the process runs
+var level atomic.Int32
+
+// SetLevel changes the lowest level written
+func SetLevel(l Level) {
+	level.Store(int32(l))
+}
+
+// CurrentLevel returns the lowest level written
+func CurrentLevel() Level {
+	return Level(level.Load())
+}
+
+// Enabled reports whether lines at l are written
+func Enabled(l Level) bool {
+	return l >= CurrentLevel()
+}
+
+// Infof logs routine progress through logger, formatted as log.Printf
+func Infof(logger *log.Logger, format string, v ...interface{}) {
+	output(logger, Info, format, v)
+}
+
+// Warnf logs work that was skipped, refused or retried through logger
+func Warnf(logger *log.Logger, format string, v ...interface{}) {
+	output(logger, Warn, format, v)
+}
+
+// Errorf logs a failure through logger
+func Errorf(logger *log.Logger, format string, v ...interface{}) {
+	output(logger, Error, format, v)
+}
+
+// output writes the line if its level is enabled, crediting the caller of
+// Infof, Warnf or Errorf with it for log.Lshortfile
+func output(logger *log.Logger, l Level, format string, v []interface{}) {
+	if Enabled(l) {
+		logger.Output(3, fmt.Sprintf(format, v...))
+	}
+}
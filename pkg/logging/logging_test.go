@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	for _, name := range Levels() {
+		l, err := ParseLevel(name)
+		if err != nil || l.String() != name {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, l, err)
+		}
+	}
+	if l, err := ParseLevel(""); err != nil || l != Info {
+		t.Errorf("ParseLevel(\"\") = %v, %v, want info", l, err)
+	}
+	if l, err := ParseLevel("WARN"); err != nil || l != Warn {
+		t.Errorf("ParseLevel(\"WARN\") = %v, %v, want warn", l, err)
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Error("ParseLevel(\"verbose\") succeeded")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	defer SetLevel(CurrentLevel())
+	var buf bytes.Buffer
+	logger := log.New(&buf, "", log.Lshortfile)
+	logAll := func() {
+		Infof(logger, "Connected to peer %s", "a")
+		// Only the level counts, not the wording
+		Infof(logger, "Error correction enabled")
+		Warnf(logger, "Skipping %s", "a.txt")
+		Errorf(logger, "Send failed: %v", "broken pipe")
+		logger.Printf("Always written")
+	}
+
+	tests := []struct {
+		level Level
+		want  int
+	}{
+		{Info, 5},
+		{Warn, 3},
+		{Error, 2},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		SetLevel(tt.level)
+		logAll()
+		if got := strings.Count(buf.String(), "\n"); got != tt.want {
+			t.Errorf("level %v wrote %d lines, want %d:\n%s", tt.level, got, tt.want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	SetLevel(Info)
+	Warnf(logger, "Skipping")
+	if !strings.HasPrefix(buf.String(), "logging_test.go:") {
+		t.Errorf("line credited to the wrong caller: %q", buf.String())
+	}
+}
@@ -0,0 +1,200 @@
+// Package metrics provides a small registry of counters, gauges and timings
+// that can be scraped in Prometheus text format or pushed to StatsD or
+// Graphite, so every sink reports the same measurements
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxPendingSamples bounds the timing samples buffered for push sinks
+const maxPendingSamples = 1000
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	v uint64
+}
+
+// Add increases the counter by n
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Inc increases the counter by one
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+// Value returns the current count
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	bits uint64
+}
+
+// Set replaces the gauge's value
+func (g *Gauge) Set(v float64) {
+	atomic.StoreUint64(&g.bits, math.Float64bits(v))
+}
+
+// Add changes the gauge's value by delta
+func (g *Gauge) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&g.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&g.bits, old, next) {
+			return
+		}
+	}
+}
+
+// Value returns the gauge's value
+func (g *Gauge) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&g.bits))
+}
+
+// Timing records the durations of repeated operations
+type Timing struct {
+	mu      sync.Mutex
+	count   uint64
+	sum     time.Duration
+	pending []time.Duration // Samples not yet taken by a push sink
+}
+
+// Observe records one duration
+func (t *Timing) Observe(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.count++
+	t.sum += d
+	if len(t.pending) < maxPendingSamples {
+		t.pending = append(t.pending, d)
+	}
+}
+
+// Since records the time elapsed since start
+func (t *Timing) Since(start time.Time) {
+	t.Observe(time.Since(start))
+}
+
+// stats returns the number and total duration of observations
+func (t *Timing) stats() (uint64, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.count, t.sum
+}
+
+// drain returns and clears the samples recorded since the last drain
+func (t *Timing) drain() []time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	samples := t.pending
+	t.pending = nil
+	return samples
+}
+
+// kind distinguishes the metric types in a registry
+type kind int
+
+const (
+	kindCounter kind = iota
+	kindGauge
+	kindTiming
+)
+
+// metric is a named entry in a registry
+type metric struct {
+	name    string
+	help    string
+	kind    kind
+	counter *Counter
+	gauge   *Gauge
+	fn      func() float64 // Computes a gauge's value on demand, if set
+	timing  *Timing
+}
+
+// Registry holds named metrics; all methods are safe for concurrent use
+// Getting a metric that already exists returns the existing one, so
+// independent components can share a name
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]*metric
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*metric)}
+}
+
+// get returns the metric with name, creating it with create if needed
+func (r *Registry) get(name string, k kind, create func() *metric) *metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok && m.kind == k {
+		return m
+	}
+	m := create()
+	m.name, m.kind = name, k
+	r.metrics[name] = m
+	return m
+}
+
+// Counter returns the counter with the given name
+func (r *Registry) Counter(name, help string) *Counter {
+	return r.get(name, kindCounter, func() *metric {
+		return &metric{help: help, counter: &Counter{}}
+	}).counter
+}
+
+// Gauge returns the gauge with the given name
+func (r *Registry) Gauge(name, help string) *Gauge {
+	return r.get(name, kindGauge, func() *metric {
+		return &metric{help: help, gauge: &Gauge{}}
+	}).gauge
+}
+
+// GaugeFunc registers a gauge whose value is computed by fn when read
+// Registering the same name again replaces fn
+func (r *Registry) GaugeFunc(name, help string, fn func() float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics[name] = &metric{name: name, help: help, kind: kindGauge, fn: fn}
+}
+
+// Timing returns the timing with the given name
+func (r *Registry) Timing(name, help string) *Timing {
+	return r.get(name, kindTiming, func() *metric {
+		return &metric{help: help, timing: &Timing{}}
+	}).timing
+}
+
+// sorted returns the registered metrics ordered by name
+func (r *Registry) sorted() []*metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]*metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	return list
+}
+
+// gaugeValue reads a gauge metric
+func (m *metric) gaugeValue() float64 {
+	if m.fn != nil {
+		return m.fn()
+	}
+	return m.gauge.Value()
+}
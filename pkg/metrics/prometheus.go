@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// WritePrometheus writes every metric in the Prometheus text exposition
+// format; timings become summaries in seconds without quantiles
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.sorted() {
+		if m.help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", m.name, m.help)
+		}
+		switch m.kind {
+		case kindCounter:
+			fmt.Fprintf(bw, "# TYPE %s counter\n%s %d\n", m.name, m.name, m.counter.Value())
+		case kindGauge:
+			fmt.Fprintf(bw, "# TYPE %s gauge\n%s %g\n", m.name, m.name, m.gaugeValue())
+		case kindTiming:
+			count, sum := m.timing.stats()
+			fmt.Fprintf(bw, "# TYPE %s summary\n%s_sum %g\n%s_count %d\n", m.name, m.name, sum.Seconds(), m.name, count)
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registry in Prometheus text format
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+}
@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// maxDatagram keeps StatsD packets below common MTU sizes
+const maxDatagram = 1400
+
+// Pusher periodically sends the metrics of a registry to a StatsD or
+// Graphite server
+// StatsD receives counter increments, gauge values and individual timing
+// samples in milliseconds over UDP. Graphite receives absolute values over
+// TCP in the plaintext protocol, with timings as count, total and mean
+type Pusher struct {
+	reg      *Registry
+	protocol string
+	addr     string
+	prefix   string
+	interval time.Duration
+	logger   *log.Logger
+
+	last map[string]uint64 // Counter values at the last StatsD flush
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPusher starts pushing reg to addr every interval
+// protocol: "statsd" or "graphite"; prefix: Prepended to every metric name,
+// e.g. "peer1."
+func NewPusher(reg *Registry, protocol, addr, prefix string, interval time.Duration, logger *log.Logger) (*Pusher, error) {
+	if protocol != "statsd" && protocol != "graphite" {
+		return nil, fmt.Errorf("unknown metrics sink %q, want statsd or graphite", protocol)
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	if logger == nil {
+		logger = log.Default()
+	}
+
+	p := &Pusher{
+		reg:      reg,
+		protocol: protocol,
+		addr:     addr,
+		prefix:   prefix,
+		interval: interval,
+		logger:   logger,
+		last:     make(map[string]uint64),
+		done:     make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.run()
+	return p, nil
+}
+
+// Close stops pushing after a final flush
+func (p *Pusher) Close() error {
+	close(p.done)
+	p.wg.Wait()
+	return nil
+}
+
+func (p *Pusher) run() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-p.done:
+			p.flush()
+			return
+		}
+		p.flush()
+	}
+}
+
+// flush sends one round of metrics
+func (p *Pusher) flush() {
+	var lines []string
+	if p.protocol == "statsd" {
+		lines = p.statsdLines()
+	} else {
+		lines = p.graphiteLines(time.Now())
+	}
+	if len(lines) == 0 {
+		return
+	}
+
+	var err error
+	if p.protocol == "statsd" {
+		err = p.sendStatsD(lines)
+	} else {
+		err = p.sendGraphite(lines)
+	}
+	if err != nil {
+		logging.Errorf(p.logger, "Pushing metrics to %s failed: %v", p.addr, err)
+	}
+}
+
+// name converts a metric name to the dotted form both protocols use
+func (p *Pusher) name(m *metric) string {
+	return p.prefix + strings.ReplaceAll(m.name, "_", ".")
+}
+
+// statsdLines renders counters as increments since the last flush
+func (p *Pusher) statsdLines() []string {
+	var lines []string
+	for _, m := range p.reg.sorted() {
+		name := p.name(m)
+		switch m.kind {
+		case kindCounter:
+			v := m.counter.Value()
+			if delta := v - p.last[m.name]; delta > 0 {
+				lines = append(lines, fmt.Sprintf("%s:%d|c", name, delta))
+			}
+			p.last[m.name] = v
+		case kindGauge:
+			lines = append(lines, fmt.Sprintf("%s:%g|g", name, m.gaugeValue()))
+		case kindTiming:
+			for _, d := range m.timing.drain() {
+				lines = append(lines, fmt.Sprintf("%s:%g|ms", name, float64(d)/float64(time.Millisecond)))
+			}
+		}
+	}
+	return lines
+}
+
+// graphiteLines renders absolute values stamped with now
+func (p *Pusher) graphiteLines(now time.Time) []string {
+	ts := now.Unix()
+	var lines []string
+	for _, m := range p.reg.sorted() {
+		name := p.name(m)
+		switch m.kind {
+		case kindCounter:
+			lines = append(lines, fmt.Sprintf("%s %d %d", name, m.counter.Value(), ts))
+		case kindGauge:
+			lines = append(lines, fmt.Sprintf("%s %g %d", name, m.gaugeValue(), ts))
+		case kindTiming:
+			count, sum := m.timing.stats()
+			m.timing.drain()
+			mean := 0.0
+			if count > 0 {
+				mean = sum.Seconds() * 1000 / float64(count)
+			}
+			lines = append(lines,
+				fmt.Sprintf("%s.count %d %d", name, count, ts),
+				fmt.Sprintf("%s.total_ms %g %d", name, sum.Seconds()*1000, ts),
+				fmt.Sprintf("%s.mean_ms %g %d", name, mean, ts))
+		}
+	}
+	return lines
+}
+
+// sendStatsD sends lines over UDP, packing as many per datagram as fit
+func (p *Pusher) sendStatsD(lines []string) error {
+	conn, err := net.Dial("udp", p.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if buf.Len() > 0 && buf.Len()+1+len(line) > maxDatagram {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		if buf.Len() > 0 {
+			buf.WriteByte('\n')
+		}
+		buf.WriteString(line)
+	}
+	_, err = conn.Write(buf.Bytes())
+	return err
+}
+
+// sendGraphite sends lines over a fresh TCP connection
+func (p *Pusher) sendGraphite(lines []string) error {
+	conn, err := net.DialTimeout("tcp", p.addr, p.interval)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(p.interval))
+	_, err = conn.Write([]byte(strings.Join(lines, "\n") + "\n"))
+	return err
+}
@@ -0,0 +1,118 @@
+// Package p2ptest provides helpers for integration tests that need several
+// peers talking to each other.
+//
+// A Cluster runs N peers in the current process, wired together through a
+// transport.MemoryNetwork, each with its own temporary shared and received
+// directories:
+//
+//	c := p2ptest.NewCluster(t, 2)
+//	c.SeedFile(c.Peer(0), "a.txt", []byte("hello"))
+//	c.Peer(1).RequestFile(c.Peer(0).Addr(), "a.txt")
+//	data, err := p2ptest.WaitForFile(c.Peer(1), "a.txt", time.Second)
+package p2ptest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/transport"
+)
+
+// pollInterval is how often WaitForFile checks for the file
+const pollInterval = 10 * time.Millisecond
+
+// Cluster is a set of started in-process peers sharing a memory network
+type Cluster struct {
+	Network *transport.MemoryNetwork
+	Peers   []*peer.Peer
+}
+
+// NewCluster starts n peers named peer1..peerN on a fresh memory network
+// Directories live under t.TempDir and the peers are closed on test cleanup.
+// Peer logs are only shown when tests run with -v
+// opts: Extra options applied to every peer
+func NewCluster(t testing.TB, n int, opts ...peer.Option) *Cluster {
+	t.Helper()
+
+	c := &Cluster{Network: transport.NewMemoryNetwork()}
+	root := t.TempDir()
+
+	for i := 1; i <= n; i++ {
+		id := fmt.Sprintf("peer%d", i)
+		out := io.Discard
+		if testing.Verbose() {
+			out = os.Stderr
+		}
+		logger := log.New(out, "["+id+"] ", log.Lmicroseconds)
+
+		tr := c.Network.NewTransport("")
+		peerOpts := append([]peer.Option{peer.WithLogger(logger)}, opts...)
+		p, err := peer.New(id, tr.GetListenAddress(),
+			filepath.Join(root, id, "shared"), filepath.Join(root, id, "received"),
+			tr, peerOpts...)
+		if err != nil {
+			t.Fatalf("creating %s: %v", id, err)
+		}
+		if err := p.Start(); err != nil {
+			t.Fatalf("starting %s: %v", id, err)
+		}
+		c.Peers = append(c.Peers, p)
+	}
+
+	t.Cleanup(c.Close)
+	return c
+}
+
+// Peer returns the i-th peer, counting from zero
+func (c *Cluster) Peer(i int) *peer.Peer {
+	return c.Peers[i]
+}
+
+// SeedFile writes data to name inside p's shared directory, creating
+// intermediate directories as needed
+func (c *Cluster) SeedFile(p *peer.Peer, name string, data []byte) error {
+	path := filepath.Join(p.SharedDir(), filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+// Close shuts down every peer in the cluster, giving in-flight transfers
+// a short grace period
+func (c *Cluster) Close() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for _, p := range c.Peers {
+		p.Close(ctx)
+	}
+}
+
+// WaitForFile waits until name, a slash-separated relative path, appears
+// in p's received directory
+// Returns: The file contents, or an error if it doesn't appear within timeout
+func WaitForFile(p *peer.Peer, name string, timeout time.Duration) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	path := filepath.Join(p.ReceivedDir(), filepath.FromSlash(name))
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return data, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%s did not arrive at %s within %v", name, p.ID(), timeout)
+		}
+		time.Sleep(pollInterval)
+	}
+}
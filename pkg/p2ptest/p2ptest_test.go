@@ -0,0 +1,50 @@
+package p2ptest
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestTransfer(t *testing.T) {
+	large := make([]byte, 3<<20+123)
+	rand.New(rand.NewSource(1)).Read(large)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"small.txt", []byte("hello")},
+		{"empty.txt", nil},
+		{"docs/nested.txt", bytes.Repeat([]byte("compressible "), 1000)},
+		{"large.bin", large},
+	}
+
+	c := NewCluster(t, 2)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := c.SeedFile(c.Peer(0), tt.name, tt.data); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.Peer(1).RequestFile(c.Peer(0).Addr(), tt.name); err != nil {
+				t.Fatal(err)
+			}
+			got, err := WaitForFile(c.Peer(1), tt.name, 10*time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.data) {
+				t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(tt.data))
+			}
+		})
+	}
+}
+
+func TestTransferMissingFile(t *testing.T) {
+	c := NewCluster(t, 2)
+	c.Peer(1).RequestFile(c.Peer(0).Addr(), "missing.txt")
+	if _, err := WaitForFile(c.Peer(1), "missing.txt", 200*time.Millisecond); err == nil {
+		t.Fatal("a file that isn't shared arrived")
+	}
+}
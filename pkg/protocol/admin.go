@@ -0,0 +1,67 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// AdminRequest is a command from an operator to a peer it manages, such
+// as querying its status or changing its limits. It is signed with the
+// operator's admin key, which is separate from any peer's identity key;
+// Target, Time and Nonce keep it from being replayed to another peer or
+// later on
+type AdminRequest struct {
+	ID        uint64
+	Target    string            // Peer ID of the managed peer
+	Command   string            // e.g. "status"
+	Args      []byte            // JSON arguments of the command, if any
+	Time      time.Time         // When the request was signed
+	Nonce     []byte            // Random, unique to the request
+	Key       ed25519.PublicKey // Admin key that signs the request
+	Signature []byte            // Ed25519 signature over everything above
+}
+
+// AdminResponse answers an AdminRequest with the command's JSON result;
+// Error is set on failure
+type AdminResponse struct {
+	ID     uint64
+	Result []byte
+	Error  string
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (r *AdminRequest) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.ID = 0
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign sets the admin key and signs the request with it
+func (r *AdminRequest) Sign(key ed25519.PrivateKey) error {
+	r.Key = key.Public().(ed25519.PublicKey)
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	r.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+// Verify checks that the request is signed by the key it names; whether
+// that key may administer the peer is up to the caller
+func (r *AdminRequest) Verify() error {
+	if len(r.Key) != ed25519.PublicKeySize {
+		return errors.New("invalid admin key")
+	}
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(r.Key, data, r.Signature) {
+		return errors.New("admin request has an invalid signature")
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package protocol
+
+// Bitmap records which pieces of a file a peer holds, one bit per piece
+// with piece 0 in the most significant bit of the first byte
+type Bitmap []byte
+
+// NewBitmap creates an empty bitmap for n pieces
+func NewBitmap(n int) Bitmap {
+	return make(Bitmap, (n+7)/8)
+}
+
+// Has reports whether piece i is set; pieces beyond the bitmap are not
+func (b Bitmap) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+// Set marks piece i as held; pieces beyond the bitmap are ignored
+func (b Bitmap) Set(i int) {
+	if i >= 0 && i/8 < len(b) {
+		b[i/8] |= 0x80 >> (i % 8)
+	}
+}
+
+// Count returns the number of pieces set among the first n
+func (b Bitmap) Count(n int) int {
+	count := 0
+	for i := 0; i < n; i++ {
+		if b.Has(i) {
+			count++
+		}
+	}
+	return count
+}
+
+// Missing returns the indices of the first n pieces that are not set
+func (b Bitmap) Missing(n int) []int {
+	var missing []int
+	for i := 0; i < n; i++ {
+		if !b.Has(i) {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,65 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Channel is a signed list of files published by one peer, e.g. the
+// artifacts of a software release. Subscribers that trust the publisher's
+// key can verify the list, and through the piece hashes of its manifests
+// every byte they download, no matter which peer serves it
+type Channel struct {
+	Name      string
+	Version   int64             // Increases with every publication of the channel
+	Publisher ed25519.PublicKey // Key the channel is signed with
+	Published time.Time
+	Files     []*Manifest
+	Signature []byte // Ed25519 signature over everything above
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (c *Channel) signedBytes() ([]byte, error) {
+	unsigned := *c
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign sets the publisher and signs the channel with key
+func (c *Channel) Sign(key ed25519.PrivateKey) error {
+	c.Publisher = key.Public().(ed25519.PublicKey)
+	data, err := c.signedBytes()
+	if err != nil {
+		return err
+	}
+	c.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+// Verify checks that the channel was signed by publisher and that its
+// manifests are well formed
+func (c *Channel) Verify(publisher ed25519.PublicKey) error {
+	if len(publisher) != ed25519.PublicKeySize {
+		return errors.New("invalid publisher key")
+	}
+	if !bytes.Equal(c.Publisher, publisher) {
+		return fmt.Errorf("channel %s is published by a different key", c.Name)
+	}
+	data, err := c.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publisher, data, c.Signature) {
+		return fmt.Errorf("channel %s has an invalid signature", c.Name)
+	}
+	for _, m := range c.Files {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("channel %s: %v", c.Name, err)
+		}
+	}
+	return nil
+}
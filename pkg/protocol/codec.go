@@ -1,11 +1,105 @@
 package protocol
 
 import (
-	"encoding/gob"
+	"errors"
+	"fmt"
+	"sync"
 )
 
-func init() {
-	gob.Register(&FileRequest{})
-	gob.Register(&FileResponse{})
-	gob.Register([]byte{})
-} 
\ No newline at end of file
+// ErrUnknownType is returned when decoding a message of a type the registry
+// doesn't know, e.g. one sent by a newer peer
+var ErrUnknownType = errors.New("unknown message type")
+
+// Registry maps message types to the concrete payload types carried by them
+// Each codec owns its own registry, so several peers in one process can use
+// different message sets without touching package-level state
+type Registry struct {
+	mu        sync.RWMutex
+	factories map[uint8]func() interface{}
+}
+
+// NewRegistry creates an empty payload registry
+func NewRegistry() *Registry {
+	return &Registry{
+		factories: make(map[uint8]func() interface{}),
+	}
+}
+
+// DefaultRegistry creates a registry populated with the payload types of
+// all built-in message types
+// Returns: A new registry instance on every call
+func DefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.Register(MessageTypeFileRequest, func() interface{} { return &FileRequest{} })
+	r.Register(MessageTypeFileResponse, func() interface{} { return &FileResponse{} })
+	r.Register(MessageTypeBenchData, func() interface{} { return &BenchData{} })
+	r.Register(MessageTypeBenchResult, func() interface{} { return &BenchResult{} })
+	r.Register(MessageTypeManifestRequest, func() interface{} { return &ManifestRequest{} })
+	r.Register(MessageTypeManifestResponse, func() interface{} { return &ManifestResponse{} })
+	r.Register(MessageTypeChunkRequest, func() interface{} { return &ChunkRequest{} })
+	r.Register(MessageTypeChunkData, func() interface{} { return &ChunkData{} })
+	r.Register(MessageTypeFollowRequest, func() interface{} { return &FollowRequest{} })
+	r.Register(MessageTypeStream, func() interface{} { return &StreamData{} })
+	r.Register(MessageTypeAppendRequest, func() interface{} { return &AppendRequest{} })
+	r.Register(MessageTypeAppendData, func() interface{} { return &AppendData{} })
+	r.Register(MessageTypeChannelRequest, func() interface{} { return &ChannelRequest{} })
+	r.Register(MessageTypeChannelResponse, func() interface{} { return &ChannelResponse{} })
+	r.Register(MessageTypeHaveBitmap, func() interface{} { return &HaveBitmap{} })
+	r.Register(MessageTypeHello, func() interface{} { return &Hello{} })
+	r.Register(MessageTypeHelloResponse, func() interface{} { return &HelloResponse{} })
+	r.Register(MessageTypePushOffer, func() interface{} { return &PushOffer{} })
+	r.Register(MessageTypePushReply, func() interface{} { return &PushReply{} })
+	r.Register(MessageTypeFileData, func() interface{} { return &FileData{} })
+	r.Register(MessageTypeDHTRequest, func() interface{} { return &DHTRequest{} })
+	r.Register(MessageTypeDHTResponse, func() interface{} { return &DHTResponse{} })
+	r.Register(MessageTypeTrackerAnnounce, func() interface{} { return &TrackerAnnounce{} })
+	r.Register(MessageTypeTrackerQuery, func() interface{} { return &TrackerQuery{} })
+	r.Register(MessageTypeTrackerResponse, func() interface{} { return &TrackerResponse{} })
+	r.Register(MessageTypeReceipt, func() interface{} { return &Receipt{} })
+	r.Register(MessageTypeRecipeRequest, func() interface{} { return &RecipeRequest{} })
+	r.Register(MessageTypeRecipeResponse, func() interface{} { return &RecipeResponse{} })
+	r.Register(MessageTypeBlockRequest, func() interface{} { return &BlockRequest{} })
+	r.Register(MessageTypeBlockResponse, func() interface{} { return &BlockResponse{} })
+	r.Register(MessageTypeAdminRequest, func() interface{} { return &AdminRequest{} })
+	r.Register(MessageTypeAdminResponse, func() interface{} { return &AdminResponse{} })
+	r.Register(MessageTypeListRequest, func() interface{} { return &ListRequest{} })
+	r.Register(MessageTypeListResponse, func() interface{} { return &ListResponse{} })
+	r.Register(MessageTypeSearchRequest, func() interface{} { return &SearchRequest{} })
+	r.Register(MessageTypeSearchResponse, func() interface{} { return &SearchResponse{} })
+	r.Register(MessageTypeDirRequest, func() interface{} { return &DirRequest{} })
+	r.Register(MessageTypeDirResponse, func() interface{} { return &DirResponse{} })
+	r.Register(MessageTypeDeleteRequest, func() interface{} { return &DeleteRequest{} })
+	r.Register(MessageTypeDeleteResponse, func() interface{} { return &DeleteResponse{} })
+	r.Register(MessageTypeFraming, func() interface{} { return &Framing{} })
+	r.Register(MessageTypeHandshake, func() interface{} { return &Handshake{} })
+	return r
+}
+
+// Register associates a message type with a factory for its payload
+// The factory must return a pointer to a fresh payload value
+func (r *Registry) Register(msgType uint8, factory func() interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.factories[msgType] = factory
+}
+
+// Known reports whether a message type is registered
+func (r *Registry) Known(msgType uint8) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.factories[msgType]
+	return ok
+}
+
+// New returns a fresh payload value for the given message type
+// Returns: An error if the message type is not registered
+func (r *Registry) New(msgType uint8) (interface{}, error) {
+	r.mu.RLock()
+	factory, ok := r.factories[msgType]
+	r.mu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w 0x%x", ErrUnknownType, msgType)
+	}
+	return factory(), nil
+}
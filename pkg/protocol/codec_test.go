@@ -0,0 +1,83 @@
+package protocol
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// messages covers the payloads the proto codec encodes field by field,
+// one it carries as JSON, and none; every field is set so that each codec
+// has to carry it
+var messages = []*Message{
+	{Type: MessageTypeFileRequest, From: "peer1", FromAddr: "10.0.0.1:3000", Payload: &FileRequest{
+		FileName: "docs/a.txt", NameEncoding: NameEncodingUTF8NFC, WantMeta: true, Priority: PriorityHigh,
+		Stream: true, Offset: 1 << 40, PrefixHash: []byte{1, 2, 3}, Sparse: true,
+		HashAlgorithms: []string{"blake3", "sha256"}, Compression: []string{"zstd", "gzip"},
+	}},
+	{Type: MessageTypeFileResponse, From: "peer2", FromAddr: "10.0.0.2:3000", Payload: &FileResponse{
+		Name: "docs/a.txt", NameEncoding: NameEncodingUTF8NFC, Size: 5, Data: []byte("hello"), Hash: []byte{9, 8},
+		Meta: &FileMeta{
+			Mode: 0640, HasOwner: true, UID: 1000, GID: 100,
+			Xattrs: map[string][]byte{"user.origin": []byte("x"), "user.empty": {0}},
+		},
+		Streamed: true, Offset: 7, HashAlgorithm: "blake3", Compression: "zstd",
+	}},
+	{Type: MessageTypeChunkRequest, From: "peer1", FromAddr: "[::1]:3000", Payload: &ChunkRequest{
+		ID: 1<<64 - 1, FileName: "b.iso", NameEncoding: NameEncodingUTF8NFC, Index: 3, Offset: 12 << 20,
+		Length: 4 << 20, Priority: PriorityLow, Compression: []string{"gzip"},
+	}},
+	{Type: MessageTypeChunkData, From: "peer2", FromAddr: "10.0.0.2:3000", Payload: &ChunkData{
+		ID: 42, Index: 3, Offset: 12 << 20, Data: bytes.Repeat([]byte{0xAB}, 1000), Error: "short read",
+		Compression: "gzip",
+	}},
+	{Type: MessageTypeHello, From: "peer3", FromAddr: "10.0.0.3:3000", Payload: &Hello{
+		ID: 5, Features: []string{"stream", "pieces"}, Addr: "10.0.0.3:3001",
+	}},
+	{Type: MessageTypeHello, From: "peer3", FromAddr: "10.0.0.3:3000"},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range Codecs() {
+		enc, dec, err := NewCodec(name, DefaultRegistry())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range messages {
+			var buf bytes.Buffer
+			if err := enc.Encode(&buf, want); err != nil {
+				t.Fatalf("%s: encoding %T: %v", name, want.Payload, err)
+			}
+			var got Message
+			if err := dec.Decode(&buf, &got); err != nil {
+				t.Fatalf("%s: decoding %T: %v", name, want.Payload, err)
+			}
+			if !reflect.DeepEqual(&got, want) {
+				t.Errorf("%s: round trip of %T\ngot  %+v\nwant %+v", name, want.Payload, got.Payload, want.Payload)
+			}
+		}
+	}
+}
+
+func TestProtoDecodeTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := NewProtoEncoder().Encode(&buf, messages[1]); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for n := 1; n < len(data); n++ {
+		var msg Message
+		// A cut may fall between fields and still decode; it must not panic
+		NewProtoDecoder().Decode(bytes.NewReader(data[:n]), &msg)
+	}
+	var msg Message
+	if err := NewProtoDecoder().Decode(bytes.NewReader(data[:len(data)-1]), &msg); err == nil {
+		t.Fatal("decoding a message cut short succeeded")
+	}
+}
+
+func TestNewCodecUnknown(t *testing.T) {
+	if _, _, err := NewCodec("xml", DefaultRegistry()); err == nil {
+		t.Fatal("NewCodec accepted xml")
+	}
+}
@@ -1,25 +1,54 @@
- package protocol
+package protocol
 
 import (
-    "encoding/gob"
-    "io"
+	"bytes"
+	"encoding/gob"
+	"io"
 )
 
 // Decoder interface for decoding messages from network streams
 type Decoder interface {
-    Decode(io.Reader, *Message) error
+	Decode(io.Reader, *Message) error
 }
 
 // GobDecoder implements Decoder using Go's Gob encoding
-type GobDecoder struct{}
+type GobDecoder struct {
+	registry *Registry // Payload types keyed by message type
+}
 
+// NewGobDecoder creates a decoder that understands the built-in message types
 func NewGobDecoder() *GobDecoder {
-    // Register Message type with gob
-    gob.Register(&Message{})
-    return &GobDecoder{}
+	return NewGobDecoderWithRegistry(DefaultRegistry())
+}
+
+// NewGobDecoderWithRegistry creates a decoder that resolves payload types
+// through the given registry
+func NewGobDecoderWithRegistry(r *Registry) *GobDecoder {
+	return &GobDecoder{registry: r}
 }
 
 func (dec *GobDecoder) Decode(r io.Reader, msg *Message) error {
-    decoder := gob.NewDecoder(r)
-    return decoder.Decode(msg)
-}
\ No newline at end of file
+	var wire wireMessage
+	decoder := gob.NewDecoder(r)
+	if err := decoder.Decode(&wire); err != nil {
+		return err
+	}
+
+	msg.Type = wire.Type
+	msg.From = wire.From
+	msg.FromAddr = wire.FromAddr
+	msg.Payload = nil
+	if wire.Payload == nil {
+		return nil
+	}
+
+	payload, err := dec.registry.New(wire.Type)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(wire.Payload)).Decode(payload); err != nil {
+		return err
+	}
+	msg.Payload = payload
+	return nil
+}
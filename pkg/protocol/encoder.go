@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/gob"
 	"io"
 )
@@ -10,16 +11,37 @@ type Encoder interface {
 	Encode(io.Writer, *Message) error
 }
 
+// wireMessage is the on-the-wire form of a Message. The payload is encoded
+// separately so that gob never has to see an interface value, which would
+// require registering every payload type in gob's process-wide registry
+type wireMessage struct {
+	Type     uint8
+	From     string
+	FromAddr string
+	Payload  []byte
+}
+
 // GobEncoder implements Encoder using Go's Gob encoding
 type GobEncoder struct{}
 
 func NewGobEncoder() *GobEncoder {
-    // Register Message type with gob
-    gob.Register(&Message{})
-    return &GobEncoder{}
+	return &GobEncoder{}
 }
 
 func (enc *GobEncoder) Encode(w io.Writer, msg *Message) error {
-    encoder := gob.NewEncoder(w)
-    return encoder.Encode(msg)
-}
\ No newline at end of file
+	wire := wireMessage{
+		Type:     msg.Type,
+		From:     msg.From,
+		FromAddr: msg.FromAddr,
+	}
+	if msg.Payload != nil {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(msg.Payload); err != nil {
+			return err
+		}
+		wire.Payload = buf.Bytes()
+	}
+
+	encoder := gob.NewEncoder(w)
+	return encoder.Encode(&wire)
+}
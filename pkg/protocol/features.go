@@ -0,0 +1,28 @@
+package protocol
+
+// Features peers advertise in Hello, naming the optional parts of the
+// protocol they serve; whole-file requests are always supported
+// Peers ignore names they don't know, so features added later, such as
+// compression algorithms, need no new message types to be negotiated
+const (
+	FeatureChunks   = "chunks"      // Manifests and piece requests
+	FeaturePush     = "push"        // Pushing missing pieces in answer to a HaveBitmap
+	FeatureFollow   = "follow"      // Following appended data, see FollowRequest
+	FeatureAppend   = "append-sync" // Fetching only appended data, see AppendRequest
+	FeatureChannels = "channels"    // Signed channels, see ChannelRequest
+	FeatureOffers   = "offers"      // Files pushed by the sender, see PushOffer
+	FeatureDHT      = "dht"         // Distributed hash table queries, see DHTRequest
+	FeatureTracker  = "tracker"     // Registry of peers and their files, see TrackerAnnounce
+	FeatureReceipts = "receipts"    // Signed receipts for received files, see Receipt
+	FeatureDedup    = "dedup"       // Content-defined chunks fetched by hash, see RecipeRequest
+	FeatureAdmin    = "admin"       // Commands from operators holding an admin key, see AdminRequest
+	FeatureList     = "list"        // Listing the shared directory, see ListRequest
+	FeatureSearch   = "search"      // Searching the shared directory by name, see SearchRequest
+	FeatureDirs     = "dirs"        // Listing a shared subdirectory to fetch it whole, see DirRequest
+	FeatureDeletes  = "deletes"     // Deletions passed on by a sync partner, see DeleteRequest
+)
+
+// Features returns every feature this implementation supports
+func Features() []string {
+	return []string{FeatureChunks, FeaturePush, FeatureFollow, FeatureAppend, FeatureChannels, FeatureOffers, FeatureDHT, FeatureTracker, FeatureReceipts, FeatureDedup, FeatureAdmin, FeatureList, FeatureSearch, FeatureDirs, FeatureDeletes}
+}
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Names of the codecs a connection can use; see NewCodec
+const (
+	CodecGob   = "gob"
+	CodecJSON  = "json"
+	CodecProto = "proto"
+)
+
+// jsonMessage is the JSON form of a Message, for peers not written in Go:
+//
+//	{"type": 1, "from": "peer1", "payload": {"FileName": "a.txt", ...}}
+//
+// Payloads are the message's payload struct with its Go field names; byte
+// slices are base64 strings and times RFC 3339 strings
+type jsonMessage struct {
+	Type     uint8           `json:"type"`
+	From     string          `json:"from"`
+	FromAddr string          `json:"from_addr,omitempty"`
+	Payload  json.RawMessage `json:"payload,omitempty"`
+}
+
+// JSONEncoder implements Encoder using JSON, one object per message
+type JSONEncoder struct{}
+
+// NewJSONEncoder creates an encoder that writes messages as JSON
+func NewJSONEncoder() *JSONEncoder {
+	return &JSONEncoder{}
+}
+
+func (enc *JSONEncoder) Encode(w io.Writer, msg *Message) error {
+	wire := jsonMessage{
+		Type:     msg.Type,
+		From:     msg.From,
+		FromAddr: msg.FromAddr,
+	}
+	if msg.Payload != nil {
+		payload, err := json.Marshal(msg.Payload)
+		if err != nil {
+			return err
+		}
+		wire.Payload = payload
+	}
+	return json.NewEncoder(w).Encode(&wire)
+}
+
+// JSONDecoder implements Decoder using JSON
+type JSONDecoder struct {
+	registry *Registry // Payload types keyed by message type
+}
+
+// NewJSONDecoder creates a decoder that understands the built-in message types
+func NewJSONDecoder() *JSONDecoder {
+	return NewJSONDecoderWithRegistry(DefaultRegistry())
+}
+
+// NewJSONDecoderWithRegistry creates a decoder that resolves payload types
+// through the given registry
+func NewJSONDecoderWithRegistry(r *Registry) *JSONDecoder {
+	return &JSONDecoder{registry: r}
+}
+
+func (dec *JSONDecoder) Decode(r io.Reader, msg *Message) error {
+	var wire jsonMessage
+	if err := json.NewDecoder(r).Decode(&wire); err != nil {
+		return err
+	}
+
+	msg.Type = wire.Type
+	msg.From = wire.From
+	msg.FromAddr = wire.FromAddr
+	msg.Payload = nil
+	if len(wire.Payload) == 0 || bytes.Equal(wire.Payload, []byte("null")) {
+		return nil
+	}
+
+	payload, err := dec.registry.New(wire.Type)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(wire.Payload, payload); err != nil {
+		return err
+	}
+	msg.Payload = payload
+	return nil
+}
+
+// Codecs returns the names of every codec NewCodec creates, gob first
+func Codecs() []string {
+	return []string{CodecGob, CodecJSON, CodecProto}
+}
+
+// NewCodec returns the encoder and decoder of the named codec
+// r: Registry the decoder resolves payload types through
+func NewCodec(name string, r *Registry) (Encoder, Decoder, error) {
+	switch name {
+	case CodecGob:
+		return NewGobEncoder(), NewGobDecoderWithRegistry(r), nil
+	case CodecJSON:
+		return NewJSONEncoder(), NewJSONDecoderWithRegistry(r), nil
+	case CodecProto:
+		return NewProtoEncoder(), NewProtoDecoderWithRegistry(r), nil
+	}
+	return nil, nil, fmt.Errorf("unknown codec %q", name)
+}
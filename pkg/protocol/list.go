@@ -0,0 +1,65 @@
+package protocol
+
+import "time"
+
+// ListRequest asks a peer for the files in its shared directory, all at
+// once or a page at a time
+type ListRequest struct {
+	ID    uint64
+	After string // Continuation token of the previous page, see ListResponse.Next; empty for the first
+	Limit int    // Most entries wanted, capped by the responder; 0 for all of them
+}
+
+// ListEntry is a shared file in a ListResponse
+type ListEntry struct {
+	Name    string // Wire name, see NameEncodingUTF8NFC
+	Size    int64
+	Hash    []byte // Content hash, see Manifest.ContentHash; empty until the file is hashed
+	ModTime time.Time
+	LinkOf  string // In a DirResponse, an earlier name in it that is a hard link to the same file, empty if none
+}
+
+// ListResponse answers a ListRequest with the shared files the requester
+// may read, sorted by name; Error is set on failure
+// The token in Next resumes the listing after the last entry, even from
+// another connection; it's empty once there are no more
+type ListResponse struct {
+	ID    uint64
+	Files []ListEntry
+	Next  string
+	Error string
+}
+
+// SearchRequest asks a peer for the shared files matching a pattern: a
+// path.Match glob if it contains any of "*?[", matched against the base
+// name unless it contains a "/", and otherwise a case-insensitive
+// substring of the name
+type SearchRequest struct {
+	ID      uint64
+	Pattern string
+}
+
+// SearchResponse answers a SearchRequest with the matching files the
+// requester may read, sorted by name and capped at a limit of the
+// responder's choosing; Error is set on failure
+type SearchResponse struct {
+	ID    uint64
+	Files []ListEntry
+	Error string
+}
+
+// DirRequest asks a peer for the files under a directory of its shared
+// directory, to fetch them one by one with the tree they form
+type DirRequest struct {
+	ID   uint64
+	Path string // Wire name of the directory, see NameEncodingUTF8NFC
+}
+
+// DirResponse answers a DirRequest with the files under the directory
+// that the requester may read, at any depth and sorted by name; each
+// name is relative to the directory. Error is set on failure
+type DirResponse struct {
+	ID    uint64
+	Files []ListEntry
+	Error string
+}
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+)
+
+// Manifest describes a file split into fixed-size pieces, each identified
+// by its SHA-256 hash. Pieces can be fetched from any source holding the
+// same content, peers and HTTP web seeds alike, and verified independently
+type Manifest struct {
+	Name         string
+	NameEncoding string
+	Size         int64
+	PieceSize    int64
+	PieceHashes  [][]byte // SHA-256 of each piece, in order
+	WebSeeds     []string // HTTP(S) URLs serving the same content
+}
+
+// NumPieces returns the number of pieces in the file
+func (m *Manifest) NumPieces() int {
+	return len(m.PieceHashes)
+}
+
+// PieceRange returns the byte offset and length of piece i
+func (m *Manifest) PieceRange(i int) (offset, length int64) {
+	offset = int64(i) * m.PieceSize
+	length = m.PieceSize
+	if offset+length > m.Size {
+		length = m.Size - offset
+	}
+	return offset, length
+}
+
+// Validate checks that the piece layout is consistent with the file size
+func (m *Manifest) Validate() error {
+	if m.Size < 0 || m.PieceSize <= 0 {
+		return fmt.Errorf("invalid manifest: size %d, piece size %d", m.Size, m.PieceSize)
+	}
+	want := int((m.Size + m.PieceSize - 1) / m.PieceSize)
+	if len(m.PieceHashes) != want {
+		return fmt.Errorf("invalid manifest: %d piece hashes for %d pieces", len(m.PieceHashes), want)
+	}
+	return nil
+}
+
+// VerifyPiece checks data against the hash of piece i
+func (m *Manifest) VerifyPiece(i int, data []byte) error {
+	if i < 0 || i >= len(m.PieceHashes) {
+		return fmt.Errorf("piece %d out of range", i)
+	}
+	if _, length := m.PieceRange(i); int64(len(data)) != length {
+		return fmt.Errorf("piece %d has %d bytes, want %d", i, len(data), length)
+	}
+	sum := sha256.Sum256(data)
+	if !bytes.Equal(sum[:], m.PieceHashes[i]) {
+		return fmt.Errorf("piece %d failed hash verification", i)
+	}
+	return nil
+}
+
+// ContentHash identifies the content m describes, regardless of name or
+// web seeds: the SHA-256 of its size, piece size and piece hashes
+func (m *Manifest) ContentHash() []byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%d:", m.Size, m.PieceSize)
+	for _, ph := range m.PieceHashes {
+		h.Write(ph)
+	}
+	return h.Sum(nil)
+}
+
+// SameContent reports whether o describes the same bytes as m, regardless
+// of name or web seeds
+func (m *Manifest) SameContent(o *Manifest) bool {
+	if m.Size != o.Size || m.PieceSize != o.PieceSize || len(m.PieceHashes) != len(o.PieceHashes) {
+		return false
+	}
+	for i := range m.PieceHashes {
+		if !bytes.Equal(m.PieceHashes[i], o.PieceHashes[i]) {
+			return false
+		}
+	}
+	return true
+}
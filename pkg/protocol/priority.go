@@ -0,0 +1,38 @@
+package protocol
+
+import "fmt"
+
+// Priority orders transfers competing for the same peer. The zero value is
+// PriorityNormal, so requests from peers that predate the field keep their
+// old behaviour
+type Priority int8
+
+const (
+	PriorityLow    Priority = -1
+	PriorityNormal Priority = 0
+	PriorityHigh   Priority = 1
+)
+
+// ParsePriority parses "high", "normal" or "low"
+func ParsePriority(s string) (Priority, error) {
+	switch s {
+	case "high":
+		return PriorityHigh, nil
+	case "normal", "":
+		return PriorityNormal, nil
+	case "low":
+		return PriorityLow, nil
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+// String returns the name accepted by ParsePriority
+func (p Priority) String() string {
+	switch {
+	case p > PriorityNormal:
+		return "high"
+	case p < PriorityNormal:
+		return "low"
+	}
+	return "normal"
+}
@@ -0,0 +1,364 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/grpclite"
+)
+
+// Field numbers of Message in proto/messages.proto
+const (
+	protoType         = 1
+	protoFrom         = 2
+	protoFromAddr     = 3
+	protoFileRequest  = 10
+	protoFileResponse = 11
+	protoChunkRequest = 12
+	protoChunkData    = 13
+	protoJSONPayload  = 15
+)
+
+// ProtoEncoder implements Encoder using the protocol buffers wire format
+// of proto/messages.proto, one Message per call
+// Payloads without a definition there are carried as JSON
+type ProtoEncoder struct{}
+
+// NewProtoEncoder creates an encoder that writes messages as protocol buffers
+func NewProtoEncoder() *ProtoEncoder {
+	return &ProtoEncoder{}
+}
+
+func (enc *ProtoEncoder) Encode(w io.Writer, msg *Message) error {
+	var m grpclite.Message
+	m.Uint(protoType, uint64(msg.Type))
+	m.String(protoFrom, msg.From)
+	m.String(protoFromAddr, msg.FromAddr)
+	switch payload := msg.Payload.(type) {
+	case nil:
+	case *FileRequest:
+		m.Embed(protoFileRequest, encodeFileRequest(payload))
+	case *FileResponse:
+		m.Embed(protoFileResponse, encodeFileResponse(payload))
+	case *ChunkRequest:
+		m.Embed(protoChunkRequest, encodeChunkRequest(payload))
+	case *ChunkData:
+		m.Embed(protoChunkData, encodeChunkData(payload))
+	default:
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		m.Embed(protoJSONPayload, data)
+	}
+	_, err := w.Write(m)
+	return err
+}
+
+// ProtoDecoder implements Decoder using the protocol buffers wire format
+// The reader must hold exactly one message, as a frame does, since the
+// format doesn't mark where a message ends
+type ProtoDecoder struct {
+	registry *Registry // Payload types of messages carried as JSON
+}
+
+// NewProtoDecoder creates a decoder that understands the built-in message types
+func NewProtoDecoder() *ProtoDecoder {
+	return NewProtoDecoderWithRegistry(DefaultRegistry())
+}
+
+// NewProtoDecoderWithRegistry creates a decoder that resolves the types of
+// payloads carried as JSON through the given registry
+func NewProtoDecoderWithRegistry(r *Registry) *ProtoDecoder {
+	return &ProtoDecoder{registry: r}
+}
+
+func (dec *ProtoDecoder) Decode(r io.Reader, msg *Message) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	fields, err := grpclite.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	*msg = Message{}
+	var payload func() (interface{}, error)
+	for _, f := range fields {
+		switch f.Num {
+		case protoType:
+			msg.Type = uint8(f.Value)
+		case protoFrom:
+			msg.From = f.String()
+		case protoFromAddr:
+			msg.FromAddr = f.String()
+		case protoFileRequest:
+			payload = func() (interface{}, error) { return decodeFileRequest(f.Data) }
+		case protoFileResponse:
+			payload = func() (interface{}, error) { return decodeFileResponse(f.Data) }
+		case protoChunkRequest:
+			payload = func() (interface{}, error) { return decodeChunkRequest(f.Data) }
+		case protoChunkData:
+			payload = func() (interface{}, error) { return decodeChunkData(f.Data) }
+		case protoJSONPayload:
+			payload = func() (interface{}, error) {
+				v, err := dec.registry.New(msg.Type)
+				if err != nil {
+					return nil, err
+				}
+				return v, json.Unmarshal(f.Data, v)
+			}
+		}
+	}
+	if payload == nil {
+		return nil
+	}
+	// The type field may come after the payload
+	msg.Payload, err = payload()
+	if err != nil {
+		msg.Payload = nil
+		return err
+	}
+	return nil
+}
+
+func encodeFileRequest(req *FileRequest) grpclite.Message {
+	var m grpclite.Message
+	m.String(1, req.FileName)
+	m.String(2, req.NameEncoding)
+	m.Bool(3, req.WantMeta)
+	m.Int(4, int64(req.Priority))
+	m.Bool(5, req.Stream)
+	m.Int(6, req.Offset)
+	m.Bytes(7, req.PrefixHash)
+	m.Bool(8, req.Sparse)
+	for _, algo := range req.HashAlgorithms {
+		m.String(9, algo)
+	}
+	for _, algo := range req.Compression {
+		m.String(10, algo)
+	}
+	return m
+}
+
+func decodeFileRequest(data []byte) (*FileRequest, error) {
+	fields, err := grpclite.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("FileRequest: %v", err)
+	}
+	req := &FileRequest{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			req.FileName = f.String()
+		case 2:
+			req.NameEncoding = f.String()
+		case 3:
+			req.WantMeta = f.Bool()
+		case 4:
+			req.Priority = Priority(int32(f.Value))
+		case 5:
+			req.Stream = f.Bool()
+		case 6:
+			req.Offset = f.Int()
+		case 7:
+			req.PrefixHash = f.Data
+		case 8:
+			req.Sparse = f.Bool()
+		case 9:
+			req.HashAlgorithms = append(req.HashAlgorithms, f.String())
+		case 10:
+			req.Compression = append(req.Compression, f.String())
+		}
+	}
+	return req, nil
+}
+
+func encodeFileResponse(resp *FileResponse) grpclite.Message {
+	var m grpclite.Message
+	m.String(1, resp.Name)
+	m.String(2, resp.NameEncoding)
+	m.Int(3, resp.Size)
+	m.Bytes(4, resp.Data)
+	m.Bytes(5, resp.Hash)
+	if resp.Meta != nil {
+		m.Embed(6, encodeFileMeta(resp.Meta))
+	}
+	m.Bool(7, resp.Streamed)
+	m.Int(8, resp.Offset)
+	m.String(9, resp.HashAlgorithm)
+	m.String(10, resp.Compression)
+	return m
+}
+
+func decodeFileResponse(data []byte) (*FileResponse, error) {
+	fields, err := grpclite.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("FileResponse: %v", err)
+	}
+	resp := &FileResponse{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			resp.Name = f.String()
+		case 2:
+			resp.NameEncoding = f.String()
+		case 3:
+			resp.Size = f.Int()
+		case 4:
+			resp.Data = f.Data
+		case 5:
+			resp.Hash = f.Data
+		case 6:
+			if resp.Meta, err = decodeFileMeta(f.Data); err != nil {
+				return nil, err
+			}
+		case 7:
+			resp.Streamed = f.Bool()
+		case 8:
+			resp.Offset = f.Int()
+		case 9:
+			resp.HashAlgorithm = f.String()
+		case 10:
+			resp.Compression = f.String()
+		}
+	}
+	return resp, nil
+}
+
+func encodeFileMeta(meta *FileMeta) grpclite.Message {
+	var m grpclite.Message
+	m.Uint(1, uint64(meta.Mode))
+	m.Bool(2, meta.HasOwner)
+	m.Int(3, int64(meta.UID))
+	m.Int(4, int64(meta.GID))
+	for name, value := range meta.Xattrs {
+		var entry grpclite.Message
+		entry.String(1, name)
+		entry.Bytes(2, value)
+		m.Embed(5, entry)
+	}
+	return m
+}
+
+func decodeFileMeta(data []byte) (*FileMeta, error) {
+	fields, err := grpclite.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("FileMeta: %v", err)
+	}
+	meta := &FileMeta{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			meta.Mode = uint32(f.Value)
+		case 2:
+			meta.HasOwner = f.Bool()
+		case 3:
+			meta.UID = int(f.Int())
+		case 4:
+			meta.GID = int(f.Int())
+		case 5:
+			entry, err := grpclite.Parse(f.Data)
+			if err != nil {
+				return nil, fmt.Errorf("FileMeta xattr: %v", err)
+			}
+			var name string
+			var value []byte
+			for _, e := range entry {
+				switch e.Num {
+				case 1:
+					name = e.String()
+				case 2:
+					value = e.Data
+				}
+			}
+			if meta.Xattrs == nil {
+				meta.Xattrs = make(map[string][]byte)
+			}
+			meta.Xattrs[name] = value
+		}
+	}
+	return meta, nil
+}
+
+func encodeChunkRequest(req *ChunkRequest) grpclite.Message {
+	var m grpclite.Message
+	m.Uint(1, req.ID)
+	m.String(2, req.FileName)
+	m.String(3, req.NameEncoding)
+	m.Int(4, int64(req.Index))
+	m.Int(5, req.Offset)
+	m.Int(6, req.Length)
+	m.Int(7, int64(req.Priority))
+	for _, algo := range req.Compression {
+		m.String(8, algo)
+	}
+	return m
+}
+
+func decodeChunkRequest(data []byte) (*ChunkRequest, error) {
+	fields, err := grpclite.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("ChunkRequest: %v", err)
+	}
+	req := &ChunkRequest{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			req.ID = f.Value
+		case 2:
+			req.FileName = f.String()
+		case 3:
+			req.NameEncoding = f.String()
+		case 4:
+			req.Index = int(f.Int())
+		case 5:
+			req.Offset = f.Int()
+		case 6:
+			req.Length = f.Int()
+		case 7:
+			req.Priority = Priority(int32(f.Value))
+		case 8:
+			req.Compression = append(req.Compression, f.String())
+		}
+	}
+	return req, nil
+}
+
+func encodeChunkData(d *ChunkData) grpclite.Message {
+	var m grpclite.Message
+	m.Uint(1, d.ID)
+	m.Int(2, int64(d.Index))
+	m.Int(3, d.Offset)
+	m.Bytes(4, d.Data)
+	m.String(5, d.Error)
+	m.String(6, d.Compression)
+	return m
+}
+
+func decodeChunkData(data []byte) (*ChunkData, error) {
+	fields, err := grpclite.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("ChunkData: %v", err)
+	}
+	d := &ChunkData{}
+	for _, f := range fields {
+		switch f.Num {
+		case 1:
+			d.ID = f.Value
+		case 2:
+			d.Index = int(f.Int())
+		case 3:
+			d.Offset = f.Int()
+		case 4:
+			d.Data = f.Data
+		case 5:
+			d.Error = f.String()
+		case 6:
+			d.Compression = f.String()
+		}
+	}
+	return d, nil
+}
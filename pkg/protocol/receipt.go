@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Receipt is the receiver's signed statement that it got a file intact
+// from the sender, which keeps it as proof of the transfer, e.g. for
+// audits or to account for the data peers exchange
+type Receipt struct {
+	File      string            // Name of the file as transferred
+	Hash      []byte            // SHA-256 of the whole file as saved
+	Size      int64             // Size of the whole file
+	Bytes     int64             // Bytes of it the sender delivered; less than Size when other sources or an earlier attempt provided the rest
+	Sender    string            // Peer ID of the sender
+	Receiver  string            // Peer ID of the receiver
+	Time      time.Time         // When the file was verified
+	Key       ed25519.PublicKey // Identity key of the receiver, which signs the receipt
+	Signature []byte            // Ed25519 signature over everything above
+}
+
+// signedBytes returns the canonical encoding covered by the signature
+func (r *Receipt) signedBytes() ([]byte, error) {
+	unsigned := *r
+	unsigned.Signature = nil
+	return json.Marshal(&unsigned)
+}
+
+// Sign sets the receiver's key and signs the receipt with it
+func (r *Receipt) Sign(key ed25519.PrivateKey) error {
+	r.Key = key.Public().(ed25519.PublicKey)
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	r.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+// Verify checks that the receipt was signed by receiver
+func (r *Receipt) Verify(receiver ed25519.PublicKey) error {
+	if len(receiver) != ed25519.PublicKeySize {
+		return errors.New("invalid receiver key")
+	}
+	if !bytes.Equal(r.Key, receiver) {
+		return fmt.Errorf("receipt for %s is signed by a different key", r.File)
+	}
+	data, err := r.signedBytes()
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(receiver, data, r.Signature) {
+		return fmt.Errorf("receipt for %s has an invalid signature", r.File)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import "time"
+
+// Tombstone records that a file the sender synced to the receiver was
+// deleted from the sender's shared directory
+type Tombstone struct {
+	Name      string // Wire name, see NameEncodingUTF8NFC
+	Size      int64
+	PieceSize int64  // Piece size Hash was computed with
+	Hash      []byte // Content hash of the file as synced, see Manifest.ContentHash
+	Deleted   time.Time
+}
+
+// DeleteRequest passes tombstones on to a sync partner, which removes or
+// archives its copies of the files unless they changed since they were
+// synced
+type DeleteRequest struct {
+	ID         uint64
+	Tombstones []Tombstone
+}
+
+// DeleteResponse answers a DeleteRequest with the names of the files
+// removed or archived; copies that changed are kept. Error is set if the
+// receiver takes no deletions from the sender
+type DeleteResponse struct {
+	ID      uint64
+	Deleted []string
+	Error   string
+}
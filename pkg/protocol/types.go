@@ -3,8 +3,61 @@ package protocol
 const (
     MessageTypeFileRequest uint8 = 0x3
     MessageTypeFileResponse uint8 = 0x4
+    MessageTypeBenchData uint8 = 0x5
+    MessageTypeBenchResult uint8 = 0x6
+    MessageTypeManifestRequest uint8 = 0x7
+    MessageTypeManifestResponse uint8 = 0x8
+    MessageTypeChunkRequest uint8 = 0x9
+    MessageTypeChunkData uint8 = 0xA
+    MessageTypeFollowRequest uint8 = 0xB
+    MessageTypeStream uint8 = 0xC
+    MessageTypeAppendRequest uint8 = 0xD
+    MessageTypeAppendData uint8 = 0xE
+    MessageTypeChannelRequest uint8 = 0xF
+    MessageTypeChannelResponse uint8 = 0x10
+    MessageTypeHaveBitmap uint8 = 0x11
+    MessageTypeHello uint8 = 0x12
+    MessageTypeHelloResponse uint8 = 0x13
+    MessageTypePushOffer uint8 = 0x14
+    MessageTypePushReply uint8 = 0x15
+    MessageTypeFileData uint8 = 0x16
+    MessageTypeDHTRequest uint8 = 0x17
+    MessageTypeDHTResponse uint8 = 0x18
+    MessageTypeTrackerAnnounce uint8 = 0x19
+    MessageTypeTrackerQuery uint8 = 0x1A
+    MessageTypeTrackerResponse uint8 = 0x1B
+    MessageTypeReceipt uint8 = 0x1C
+    MessageTypeRecipeRequest uint8 = 0x1D
+    MessageTypeRecipeResponse uint8 = 0x1E
+    MessageTypeBlockRequest uint8 = 0x1F
+    MessageTypeBlockResponse uint8 = 0x20
+    MessageTypeAdminRequest uint8 = 0x21
+    MessageTypeAdminResponse uint8 = 0x22
+    MessageTypeListRequest uint8 = 0x23
+    MessageTypeListResponse uint8 = 0x24
+    MessageTypeSearchRequest uint8 = 0x25
+    MessageTypeSearchResponse uint8 = 0x26
+    MessageTypeDirRequest uint8 = 0x27
+    MessageTypeDirResponse uint8 = 0x28
+    MessageTypeDeleteRequest uint8 = 0x29
+    MessageTypeDeleteResponse uint8 = 0x2A
+    MessageTypeFraming uint8 = 0x2B
+    MessageTypeHandshake uint8 = 0x2C
 )
 
+// Versions of the protocol this implementation speaks, see Handshake
+// Version 1 is the protocol of peers that predate the handshake; a peer
+// that sends no Handshake is taken to speak it
+const (
+    ProtocolVersion    uint16 = 2 // Newest version spoken
+    MinProtocolVersion uint16 = 1 // Oldest version still spoken
+)
+
+// NameEncodingUTF8NFC marks file names as slash-separated UTF-8 in Unicode
+// Normalization Form C. An empty NameEncoding means the same, for peers
+// that predate the field
+const NameEncodingUTF8NFC = "utf-8/nfc"
+
 type Message struct {
     Type     uint8
     From     string
@@ -13,11 +66,355 @@ type Message struct {
 }
 
 type FileRequest struct {
-    FileName string
+    FileName     string
+    NameEncoding string   // Encoding of FileName, see NameEncodingUTF8NFC
+    WantMeta     bool     // Ask the sender to include FileMeta in the response
+    Priority     Priority // Order in which the sender serves competing requests
+    Stream       bool     // Accept the content as FileData messages following the FileResponse
+    Offset       int64    // Bytes of the file the requester already holds, from an interrupted stream
+    PrefixHash   []byte   // Hash of those bytes; the sender resumes after them if they match
+    Sparse       bool     // Accept runs of zeros as FileData holes instead of data
+    HashAlgorithms []string // Algorithms the requester checks the file with, most preferred first, see package checksum; PrefixHash uses the first, and none means SHA-256
+    Compression    []string // Algorithms the requester decompresses Data with, most preferred first, see package compress; none means Data is sent as it is
 }
 
 type FileResponse struct {
-    Name string
+    Name         string
+    NameEncoding string // Encoding of Name, see NameEncodingUTF8NFC
     Size int64
     Data []byte
-} 
\ No newline at end of file
+    Hash []byte    // Hash of Data, checked by the receiver when set
+    Meta *FileMeta // Optional file metadata, set when requested
+    Streamed bool  // Data is empty; the content follows as FileData messages
+    Offset int64   // Where the streamed content starts, when resuming after the requester's bytes
+    HashAlgorithm string // Algorithm of Hash and of the last FileData's Hash, one the request offered; empty means SHA-256
+    Compression   string // Algorithm Data is compressed with, one the request offered; empty means it isn't
+}
+
+// FileData carries the next part of a streamed FileResponse. The last one
+// has Last set and carries the hash of the whole file in Hash, see
+// FileResponse.HashAlgorithm, or Error if the sender had to stop early
+// For requesters that accept them, runs of zeros such as the holes of a
+// sparse file are sent as a Hole length without Data, which the
+// requester leaves as a hole in its copy
+type FileData struct {
+    Name   string
+    Offset int64  // Position of Data in the file
+    Hole   int64  // Length of a run of zeros at Offset, sent instead of Data
+    Data   []byte
+    Last   bool
+    Hash   []byte
+    Error  string
+    Compression string // Algorithm Data is compressed with, see FileResponse.Compression
+}
+
+// FileMeta carries file attributes for faithful replication
+// Fields the sender's platform can't provide are left at their zero value
+type FileMeta struct {
+    Mode     uint32            // Permission bits
+    HasOwner bool              // Set when UID and GID are valid
+    UID      int
+    GID      int
+    Xattrs   map[string][]byte // Extended attributes keyed by full name, e.g. "user.origin"
+}
+
+// BenchData carries synthetic payload for throughput benchmarks
+type BenchData struct {
+    ID   string // Benchmark run the data belongs to
+    Data []byte
+    Last bool   // Set on the final message of a run
+}
+
+// BenchResult is returned by the receiver once the last BenchData arrives
+type BenchResult struct {
+    ID    string
+    Bytes int64 // Total payload bytes received for the run
+}
+
+// ManifestRequest asks a peer for the manifest of one of its shared files
+type ManifestRequest struct {
+    ID           uint64 // Correlates the response with the request
+    FileName     string
+    NameEncoding string
+}
+
+// ManifestResponse answers a ManifestRequest; Error is set on failure
+type ManifestResponse struct {
+    ID       uint64
+    Manifest *Manifest
+    Error    string
+}
+
+// ChunkRequest asks a peer for one piece of a file described by a Manifest
+type ChunkRequest struct {
+    ID           uint64
+    FileName     string
+    NameEncoding string
+    Index        int      // Piece index
+    Offset       int64    // Byte offset of the piece
+    Length       int64    // Length of the piece
+    Priority     Priority // Order in which the sender serves competing requests
+    Compression  []string // Algorithms the requester decompresses Data with, see FileRequest.Compression
+}
+
+// ChunkData carries the content of a requested piece; Error is set on failure
+type ChunkData struct {
+    ID     uint64
+    Index  int
+    Offset int64
+    Data   []byte
+    Error  string
+    Compression string // Algorithm Data is compressed with, one the request offered; empty means it isn't
+}
+
+// FollowRequest subscribes to the bytes appended to a shared file, like
+// "tail -f"; sent again with Cancel set, it ends the subscription
+type FollowRequest struct {
+    ID           uint64 // Identifies the subscription in StreamData
+    FileName     string
+    NameEncoding string
+    Offset       int64  // Where to start; negative counts back from the end
+    Cancel       bool
+}
+
+// StreamData carries bytes of a followed file; Error is set, and the
+// subscription over, when the sender can no longer follow the file
+type StreamData struct {
+    ID        uint64
+    Offset    int64  // Position of Data in the file
+    Data      []byte
+    Truncated bool   // The file shrank or was replaced; Offset restarts from its beginning
+    Error     string
+}
+
+// AppendRequest asks for the bytes of an append-only file past Offset
+// The hashes describe the requester's copy so the sender can tell whether
+// it is still a prefix of the file, or the file was truncated or rewritten
+type AppendRequest struct {
+    ID           uint64
+    FileName     string
+    NameEncoding string
+    Offset       int64  // Size of the requester's copy
+    PrefixHash   []byte // SHA-256 of the requester's copy
+    TailHash     []byte // SHA-256 of the last bytes before Offset, up to AppendTailWindow
+}
+
+// AppendTailWindow is the length of the region hashed by AppendRequest.TailHash
+const AppendTailWindow = 64 << 10
+
+// AppendData answers an AppendRequest with the next bytes of the file
+type AppendData struct {
+    ID       uint64
+    Size     int64  // Current size of the sender's file
+    Data     []byte // Bytes starting at the request's Offset
+    Mismatch bool   // The requester's copy is not a prefix of the file; start over
+    Error    string
+}
+
+// ChannelRequest asks a peer for the latest version of a signed channel
+type ChannelRequest struct {
+    ID   uint64
+    Name string
+}
+
+// ChannelResponse answers a ChannelRequest; Error is set on failure
+type ChannelResponse struct {
+    ID      uint64
+    Channel *Channel
+    Error   string
+}
+
+// HaveBitmap tells a peer which pieces of a file the sender already holds,
+// e.g. when resuming a download. With Stream set, the peer answers by
+// pushing every missing piece as ChunkData with the same ID, followed by a
+// ChunkData with Index -1 (and Error set if it had to stop early)
+type HaveBitmap struct {
+    ID           uint64
+    FileName     string
+    NameEncoding string
+    Size         int64  // Size and PieceSize of the manifest the bitmap refers to
+    PieceSize    int64
+    Have         Bitmap
+    Stream       bool
+    Priority     Priority
+    Compression  []string // Algorithms the streamed pieces may be compressed with, see FileRequest.Compression
+}
+
+// Hello advertises the features the sender supports, see Features; it is
+// answered with a HelloResponse listing the receiver's
+type Hello struct {
+    ID       uint64
+    Features []string
+    Addr     string // Address the sender listens on, e.g. after its network changed; empty if not given
+}
+
+// HelloResponse answers a Hello
+type HelloResponse struct {
+    ID       uint64
+    Features []string
+    Version  string // Software version of the answering peer, empty if it predates reporting one
+}
+
+// Framing is exchanged by transports when a connection opens, telling the
+// other end that typed frames can be sent to it: frames that carry the
+// message type ahead of the encoded message, so the receiver can skip
+// types it doesn't know or size-cap them without decoding. It never
+// reaches the peer; transports that predate it ignore it as an unknown type
+type Framing struct {
+    MaxSize uint32 // Longest frame payload the sender accepts, 0 for no limit
+}
+
+// Handshake is the hello transports exchange when a connection opens,
+// after Framing: the dialer sends it before any other message and the
+// acceptor answers with its own, so both agree on the newest protocol
+// version they share before anything else is read. An acceptor that
+// shares none answers with Error set and closes the connection. Its
+// features reach the peer, which needs no Hello to learn them
+type Handshake struct {
+    Protocol    uint16   // Newest protocol version the sender speaks
+    MinProtocol uint16   // Oldest protocol version the sender speaks
+    ID          string   // Peer ID of the sender, empty if not known to its transport
+    Features    []string // Features the sender serves, see Features
+    Error       string   // Why the sender refuses the connection, empty if it doesn't
+}
+
+// PushOffer asks a peer to accept a file the sender wants to push to it;
+// once a PushReply accepts it, the file follows as a FileResponse, or in
+// pieces when the offer carries a Manifest and the reply a StreamID
+type PushOffer struct {
+    ID           uint64
+    FileName     string
+    NameEncoding string
+    Size         int64
+    Manifest     *Manifest // Set when the file can be sent in pieces
+    Expires      int64     // Unix time after which the offer lapses and its transfer stops, 0 for never
+}
+
+// PushReply answers a PushOffer; Error says why an offer was refused
+// To take the file in pieces, the receiver sets StreamID and lists the
+// pieces it already holds, e.g. from an interrupted push, in Have; the
+// sender then sends the others as ChunkData with that ID, followed by a
+// ChunkData with Index -1 (and Error set if it had to stop early)
+type PushReply struct {
+    ID       uint64
+    Accepted bool
+    WantMeta bool // Include FileMeta in the FileResponse
+    HashAlgorithms []string // Algorithms for the FileResponse's hash, as in FileRequest
+    Compression    []string // Algorithms the FileResponse or pieces may be compressed with, as in FileRequest
+    StreamID uint64
+    Have     Bitmap
+    Error    string
+}
+
+// DHT operations, see DHTRequest
+const (
+    DHTFindNode      = "find_node"      // Contacts closest to Key
+    DHTFindProviders = "find_providers" // Providers of Key, and contacts closest to it
+    DHTAddProvider   = "add_provider"   // Store the sender as a provider of Key
+)
+
+// DHTRequest is a query of the distributed hash table, see package dht
+type DHTRequest struct {
+    ID   uint64
+    Op   string // One of DHTFindNode, DHTFindProviders and DHTAddProvider
+    Key  []byte // Node ID or content hash, see Manifest.ContentHash
+    Addr string // Address the sender listens on
+    Name string // With DHTAddProvider, the name of the file at the sender
+}
+
+// DHTContact is a node of the distributed hash table
+type DHTContact struct {
+    PeerID string
+    Addr   string
+    Name   string // For providers, the name of the file at the node
+}
+
+// DHTResponse answers a DHTRequest; Error is set on failure
+type DHTResponse struct {
+    ID        uint64
+    Closer    []DHTContact // Contacts closest to the requested key
+    Providers []DHTContact
+    Error     string
+}
+
+// TrackerAnnounce registers the sender with a tracker, replacing the files
+// it announced before; with Leaving set it is removed instead
+type TrackerAnnounce struct {
+    ID      uint64
+    Addr    string        // Address the sender listens on
+    Files   []TrackerFile // Files the sender shares
+    Leaving bool
+}
+
+// TrackerFile is a shared file listed in a TrackerAnnounce
+type TrackerFile struct {
+    Name string
+    Size int64
+    Hash []byte // Content hash, see Manifest.ContentHash
+}
+
+// TrackerQuery asks a tracker for the peers sharing a file, by name or,
+// when Hash is set, by content hash
+type TrackerQuery struct {
+    ID   uint64
+    Name string
+    Hash []byte
+}
+
+// TrackerPeer is a peer sharing a file, listed in a TrackerResponse
+type TrackerPeer struct {
+    PeerID string
+    Addr   string
+    Name   string // Name of the file at the peer
+}
+
+// TrackerResponse answers a TrackerAnnounce or TrackerQuery; Error is set
+// on failure
+type TrackerResponse struct {
+    ID       uint64
+    Peers    []TrackerPeer // For a TrackerQuery
+    Interval int64         // Seconds between the announcements the tracker asks for
+    Error    string
+}
+
+// RecipeRequest asks a peer for the content-defined chunks of one of its
+// shared files, so the receiver only fetches those it doesn't hold yet,
+// see package cdc
+type RecipeRequest struct {
+    ID           uint64
+    FileName     string
+    NameEncoding string
+}
+
+// RecipeChunk is one chunk of a file listed in a RecipeResponse
+type RecipeChunk struct {
+    Hash   []byte // SHA-256 of the chunk
+    Length int
+}
+
+// RecipeResponse answers a RecipeRequest with the file's chunks in order;
+// Error is set on failure
+type RecipeResponse struct {
+    ID     uint64
+    Size   int64
+    Hash   []byte // SHA-256 of the whole file
+    Chunks []RecipeChunk
+    Error  string
+}
+
+// BlockRequest asks for chunks of a shared file by their hashes, as listed
+// in its RecipeResponse
+type BlockRequest struct {
+    ID           uint64
+    FileName     string
+    NameEncoding string
+    Hashes       [][]byte
+}
+
+// BlockResponse answers a BlockRequest with the chunks' data in the order
+// they were asked for; Error is set on failure
+type BlockResponse struct {
+    ID     uint64
+    Blocks [][]byte
+    Error  string
+}
@@ -0,0 +1,103 @@
+// Package ratelimit provides a token bucket limiter for throttling byte
+// streams and operation rates
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at a fixed rate up to a burst size
+// A request for more tokens than are available is granted straight away
+// and leaves the bucket in debt, so callers sleep in proportion to the
+// size of each request and arbitrarily large requests never block forever
+// A nil Limiter or one with a rate of 0 never limits. All methods are safe
+// for concurrent use
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum tokens the bucket holds
+	tokens float64 // Tokens available now; negative while in debt
+	last   time.Time
+}
+
+// New creates a limiter allowing rate tokens per second with bursts of up
+// to burst tokens; a burst of 0 defaults to one second's worth
+func New(rate, burst float64) *Limiter {
+	l := &Limiter{}
+	l.SetRate(rate, burst)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate changes the rate and burst size; a rate of 0 removes the limit
+// Debt accumulated under the old rate is kept
+func (l *Limiter) SetRate(rate, burst float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	if burst <= 0 {
+		burst = rate
+	}
+	l.rate = rate
+	l.burst = burst
+	if l.tokens > burst {
+		l.tokens = burst
+	}
+}
+
+// Rate returns the current rate in tokens per second, 0 if unlimited
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN takes n tokens, sleeping until the bucket is out of debt
+// Returns: ctx.Err() if ctx is done before the wait is over
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refill adds the tokens earned since the last update; caller must hold l.mu
+func (l *Limiter) refill(now time.Time) {
+	if !l.last.IsZero() && l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
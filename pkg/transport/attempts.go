@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	attemptsKept  = 16  // Attempts remembered per address, most recent first
+	attemptsAddrs = 256 // Addresses remembered; the least recently tried are forgotten
+)
+
+// Stage is how far a connection attempt got, see ConnAttempt
+type Stage string
+
+const (
+	StageConnected Stage = "connected" // The attempt succeeded
+	StageQueue     Stage = "queue"     // Waiting for a dial slot, see WithDialLimit
+	StageDial      Stage = "dial"      // Opening the connection
+	StageBanned    Stage = "banned"    // The host is banned, see WithBanPolicy
+	StageHandshake Stage = "handshake" // The TLS, Noise, swarm or identity handshake
+	StageCodec     Stage = "codec"     // Agreeing on a codec, see WithCodec
+	StageFraming   Stage = "framing"   // Announcing the frame size limit
+)
+
+// ConnAttempt is one attempt to connect to or from a peer, see
+// TCPTransport.Attempts
+type ConnAttempt struct {
+	Time     time.Time     `json:"time"`
+	Inbound  bool          `json:"inbound,omitempty"` // The remote end dialed
+	Stage    Stage         `json:"stage"`             // StageConnected, or the stage that failed
+	Cause    string        `json:"cause,omitempty"`   // Short reason for a failure, e.g. "refused" or "timeout"
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"` // Time the attempt took
+}
+
+// Failed reports whether the attempt didn't end in a connection
+func (a ConnAttempt) Failed() bool {
+	return a.Stage != StageConnected
+}
+
+// Attempts returns the recent connection attempts by address, most recent
+// first: dials by the address dialed, and incoming connections that
+// failed by the remote host
+func (t *TCPTransport) Attempts() map[string][]ConnAttempt {
+	return t.attempts.all()
+}
+
+// AttemptsTo returns the recent connection attempts to or from addr, most
+// recent first
+// addr: An address dialed, or a remote host
+func (t *TCPTransport) AttemptsTo(addr string) []ConnAttempt {
+	return t.attempts.get(addr)
+}
+
+// recordAttempt remembers the outcome of a connection attempt
+// addr: The address dialed, or the remote address of an incoming connection
+// err: Why the attempt failed at stage, nil if it connected
+func (t *TCPTransport) recordAttempt(addr string, inbound bool, start time.Time, stage Stage, err error) {
+	a := ConnAttempt{Time: start, Inbound: inbound, Stage: stage, Duration: time.Since(start)}
+	if err != nil {
+		a.Cause = causeOf(err)
+		a.Error = err.Error()
+	}
+	if inbound {
+		addr = hostOf(addr)
+	}
+	t.attempts.add(addr, a)
+}
+
+// causeOf names the usual reasons a connection attempt fails
+func causeOf(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return "unreachable"
+	case errors.As(err, &dnsErr):
+		return "name resolution"
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.Is(err, ErrDialQueueTimeout):
+		return "dial queue"
+	case errors.Is(err, ErrShutdown):
+		return "shutdown"
+	}
+	return ""
+}
+
+// attemptLog keeps the recent connection attempts of a bounded number of
+// addresses
+type attemptLog struct {
+	mu    sync.Mutex
+	addrs map[string][]ConnAttempt // Most recent first
+}
+
+func newAttemptLog() *attemptLog {
+	return &attemptLog{addrs: make(map[string][]ConnAttempt)}
+}
+
+func (l *attemptLog) add(addr string, a ConnAttempt) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.addrs[addr]; !ok && len(l.addrs) >= attemptsAddrs {
+		l.forgetOldest()
+	}
+	list := append([]ConnAttempt{a}, l.addrs[addr]...)
+	if len(list) > attemptsKept {
+		list = list[:attemptsKept]
+	}
+	l.addrs[addr] = list
+}
+
+// forgetOldest drops the address tried least recently
+// Caller must hold l.mu
+func (l *attemptLog) forgetOldest() {
+	var oldest string
+	var at time.Time
+	for addr, list := range l.addrs {
+		if oldest == "" || list[0].Time.Before(at) {
+			oldest, at = addr, list[0].Time
+		}
+	}
+	delete(l.addrs, oldest)
+}
+
+func (l *attemptLog) get(addr string) []ConnAttempt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]ConnAttempt(nil), l.addrs[addr]...)
+}
+
+func (l *attemptLog) all() map[string][]ConnAttempt {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := make(map[string][]ConnAttempt, len(l.addrs))
+	for addr, list := range l.addrs {
+		out[addr] = append([]ConnAttempt(nil), list...)
+	}
+	return out
+}
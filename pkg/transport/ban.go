@@ -0,0 +1,272 @@
+package transport
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// Offense is a kind of misbehaviour that counts towards banning a host
+type Offense string
+
+const (
+	OffenseAuth      Offense = "auth"      // Failed the swarm or identity handshake
+	OffenseMalformed Offense = "malformed" // Sent a frame or message that can't be read
+	OffenseRate      Offense = "rate"      // Sent more messages than BanPolicy.MaxMessageRate allows
+)
+
+// BanPolicy decides when hosts that misbehave are banned, see WithBanPolicy
+// Bans apply to a whole host, so peers sharing an address behind NAT are
+// banned together
+type BanPolicy struct {
+	Threshold      int           // Offenses within Window that ban a host, 0 to never ban
+	Window         time.Duration // Period offenses are counted over
+	Duration       time.Duration // Length of a host's first ban; each further one doubles it
+	MaxDuration    time.Duration // Longest ban, also how long a host must behave before its bans are forgotten
+	MaxMessageRate int           // Messages per second a host may send, 0 for no limit; every second over it is an offense
+}
+
+// DefaultBanPolicy bans a host for a minute after 5 offenses in 10 minutes,
+// doubling the ban each time up to a day
+var DefaultBanPolicy = BanPolicy{
+	Threshold:   5,
+	Window:      10 * time.Minute,
+	Duration:    time.Minute,
+	MaxDuration: 24 * time.Hour,
+}
+
+// Ban is a banned host, see TCPTransport.Bans
+type Ban struct {
+	Host    string
+	Offense Offense // Offense that triggered the ban
+	Count   int     // Bans of the host so far, including this one
+	Since   time.Time
+	Until   time.Time
+}
+
+// WithBanPolicy bans hosts that repeatedly fail the handshake, send
+// malformed frames or exceed the message rate; their connections are
+// closed and new ones refused until the ban runs out
+func WithBanPolicy(policy BanPolicy) TCPOption {
+	return func(t *TCPTransport) {
+		t.bans.setPolicy(policy)
+	}
+}
+
+// SetBanPolicy replaces the ban policy; current bans keep running
+func (t *TCPTransport) SetBanPolicy(policy BanPolicy) {
+	t.bans.setPolicy(policy)
+}
+
+// BanPolicy returns the ban policy in effect
+func (t *TCPTransport) BanPolicy() BanPolicy {
+	return t.bans.currentPolicy()
+}
+
+// Bans returns the hosts currently banned, sorted by host
+func (t *TCPTransport) Bans() []Ban {
+	return t.bans.list()
+}
+
+// Unban lifts the ban on host and forgets its offenses
+// Returns: false if the host wasn't banned
+func (t *TCPTransport) Unban(host string) bool {
+	banned := t.bans.unban(host)
+	if banned {
+		logging.Infof(t.logger, "Lifted the ban on %s", host)
+	}
+	return banned
+}
+
+// Report records an offense by the host at addr, for misbehaviour noticed
+// above the transport, and bans it once the policy says so
+// addr: A "host:port" or bare host
+func (t *TCPTransport) Report(addr string, offense Offense) {
+	host := hostOf(addr)
+	ban := t.bans.report(host, offense)
+	if ban == nil {
+		return
+	}
+	logging.Warnf(t.logger, "Banned %s until %s for repeated %s offenses (ban %d)",
+		host, ban.Until.Format("2006-01-02 15:04:05"), offense, ban.Count)
+	t.closeHost(host)
+}
+
+// closeHost closes every connection to or from host
+func (t *TCPTransport) closeHost(host string) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	for _, pc := range t.peers {
+		if hostOf(pc.RemoteAddr().String()) == host {
+			pc.Close()
+		}
+	}
+}
+
+// hostOf returns the host of a "host:port" address, which may be a path
+// address; other addresses are returned unchanged
+func hostOf(addr string) string {
+	addr, _ = SplitPathAddr(addr)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// banList tracks the offenses and bans of remote hosts
+type banList struct {
+	mu     sync.Mutex
+	policy BanPolicy
+	hosts  map[string]*hostRecord
+}
+
+// hostRecord is the standing of one host
+type hostRecord struct {
+	offenses []time.Time // Offenses within the policy's window, oldest first
+	ban      Ban         // Latest ban, if any
+	second   time.Time   // Start of the second messages are being counted for
+	messages int         // Messages received in that second
+}
+
+func newBanList() *banList {
+	return &banList{hosts: make(map[string]*hostRecord)}
+}
+
+func (b *banList) setPolicy(policy BanPolicy) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.policy = policy
+}
+
+func (b *banList) currentPolicy() BanPolicy {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.policy
+}
+
+// banned reports whether host is banned
+func (b *banList) banned(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.hosts[host]
+	return ok && time.Now().Before(r.ban.Until)
+}
+
+// message counts a message from host
+// Returns: Whether it exceeds the policy's message rate, for the first
+// time within the current second
+func (b *banList) message(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.policy.Threshold <= 0 || b.policy.MaxMessageRate <= 0 {
+		return false
+	}
+
+	r := b.record(host)
+	now := time.Now()
+	if now.Sub(r.second) >= time.Second {
+		r.second, r.messages = now, 0
+	}
+	r.messages++
+	return r.messages == b.policy.MaxMessageRate+1
+}
+
+// report records an offense by host
+// Returns: The ban it started, or nil
+func (b *banList) report(host string, offense Offense) *Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.policy.Threshold <= 0 {
+		return nil
+	}
+	b.prune()
+
+	now := time.Now()
+	r := b.record(host)
+	if now.Before(r.ban.Until) {
+		return nil
+	}
+	r.offenses = append(r.offenses, now)
+	if len(r.offenses) < b.policy.Threshold {
+		return nil
+	}
+
+	// Each ban doubles the last one, unless the host behaved for longer
+	// than the longest ban since
+	count := 1
+	if r.ban.Count > 0 && now.Sub(r.ban.Until) < b.policy.MaxDuration {
+		count = r.ban.Count + 1
+	}
+	d := b.policy.Duration
+	for i := 1; i < count && (b.policy.MaxDuration <= 0 || d < b.policy.MaxDuration); i++ {
+		d *= 2
+	}
+	if b.policy.MaxDuration > 0 {
+		d = min(d, b.policy.MaxDuration)
+	}
+	r.ban = Ban{Host: host, Offense: offense, Count: count, Since: now, Until: now.Add(d)}
+	r.offenses = nil
+	ban := r.ban
+	return &ban
+}
+
+// record returns the record of host, creating it if needed
+// Caller must hold b.mu
+func (b *banList) record(host string) *hostRecord {
+	r, ok := b.hosts[host]
+	if !ok {
+		r = &hostRecord{}
+		b.hosts[host] = r
+	}
+	return r
+}
+
+// prune drops the offenses outside the window, and the hosts left with
+// nothing worth remembering
+// Caller must hold b.mu
+func (b *banList) prune() {
+	now := time.Now()
+	for host, r := range b.hosts {
+		i := 0
+		for i < len(r.offenses) && now.Sub(r.offenses[i]) > b.policy.Window {
+			i++
+		}
+		r.offenses = r.offenses[i:]
+		if len(r.offenses) == 0 && now.Sub(r.second) > time.Second && now.Sub(r.ban.Until) > b.policy.MaxDuration {
+			delete(b.hosts, host)
+		}
+	}
+}
+
+// list returns the hosts currently banned, sorted by host
+func (b *banList) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	var bans []Ban
+	for _, r := range b.hosts {
+		if now.Before(r.ban.Until) {
+			bans = append(bans, r.ban)
+		}
+	}
+	slices.SortFunc(bans, func(a, b Ban) int { return strings.Compare(a.Host, b.Host) })
+	return bans
+}
+
+// unban lifts the ban on host and forgets its offenses
+// Returns: false if the host wasn't banned
+func (b *banList) unban(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r, ok := b.hosts[host]
+	if !ok || !time.Now().Before(r.ban.Until) {
+		return false
+	}
+	delete(b.hosts, host)
+	return true
+}
@@ -0,0 +1,150 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// Messages are gob encoded unless the dialer offers another codec in the
+// first frame on the connection, which the acceptor answers before any
+// other frame:
+//
+//	offer   "P2PCODEC", version uint8, codec names separated by commas, most preferred first
+//	answer  "P2PCODEC", version uint8, name of the codec chosen, empty if none is acceptable
+//
+// A connection without an offer stays on gob, so peers that don't know
+// about codecs keep working with each other; a peer not written in Go
+// offers "json" or "proto" and gets JSON or protocol buffers messages in
+// both directions
+const (
+	codecMagic   = "P2PCODEC"
+	codecVersion = 1
+)
+
+// acceptedCodecs are the codecs an acceptor agrees to, in no particular order
+var acceptedCodecs = protocol.Codecs()
+
+// WithCodec sets the codecs offered on the connections the transport
+// dials, most preferred first; every connection accepts any codec
+// Offering only gob, the default, skips the offer, while dialing a peer
+// that predates codec offers fails for any other offer
+func WithCodec(names ...string) TCPOption {
+	return func(t *TCPTransport) {
+		t.codecs = names
+	}
+}
+
+// WithRegistry resolves the payload types of incoming messages through r,
+// whichever codec a connection uses
+func WithRegistry(r *protocol.Registry) TCPOption {
+	return func(t *TCPTransport) {
+		t.registry = r
+		t.decoder = protocol.NewGobDecoderWithRegistry(r)
+	}
+}
+
+// ValidCodec checks that a codec can be offered with WithCodec
+func ValidCodec(name string) error {
+	for _, c := range acceptedCodecs {
+		if c == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown codec %q, want one of %s", name, strings.Join(acceptedCodecs, ", "))
+}
+
+// offersCodec reports whether dialed connections start with a codec offer
+func (t *TCPTransport) offersCodec() bool {
+	return len(t.codecs) > 0 && !(len(t.codecs) == 1 && t.codecs[0] == protocol.CodecGob)
+}
+
+// offerCodec offers the transport's codecs on a dialed connection and
+// switches it to the one the acceptor chooses
+func (t *TCPTransport) offerCodec(pc *peerConn) error {
+	pc.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer pc.SetDeadline(time.Time{})
+
+	if err := pc.writeMessage(codecFrame(strings.Join(t.codecs, ","))); err != nil {
+		return err
+	}
+	_, answer, err := pc.readMessage()
+	if err != nil {
+		return fmt.Errorf("codec negotiation failed: %v", err)
+	}
+	name, ok := parseCodecFrame(answer)
+	if !ok {
+		return fmt.Errorf("codec negotiation failed: peer doesn't support codec offers")
+	}
+	if name == "" {
+		return fmt.Errorf("codec negotiation failed: peer accepts none of %s", strings.Join(t.codecs, ", "))
+	}
+	for _, c := range t.codecs {
+		if c == name {
+			return t.useCodec(pc, name)
+		}
+	}
+	return fmt.Errorf("codec negotiation failed: peer chose %q, which wasn't offered", name)
+}
+
+// answerCodec picks the first codec of an offer the transport accepts,
+// answers the dialer and switches the connection to it
+func (t *TCPTransport) answerCodec(pc *peerConn, offer string) error {
+	chosen := ""
+	for _, name := range strings.Split(offer, ",") {
+		if ValidCodec(name) == nil {
+			chosen = name
+			break
+		}
+	}
+	if err := pc.writeMessage(codecFrame(chosen)); err != nil {
+		return err
+	}
+	if chosen == "" {
+		return fmt.Errorf("no acceptable codec offered in %q", offer)
+	}
+	return t.useCodec(pc, chosen)
+}
+
+// useCodec switches a connection to the named codec
+func (t *TCPTransport) useCodec(pc *peerConn, name string) error {
+	enc, dec, err := protocol.NewCodec(name, t.registry)
+	if err != nil {
+		return err
+	}
+	if name == protocol.CodecGob {
+		dec = t.decoder
+	}
+	pc.codecMu.Lock()
+	pc.encoder, pc.decoder = enc, dec
+	pc.codecMu.Unlock()
+	return nil
+}
+
+// codec returns the encoder and decoder of a connection
+func (t *TCPTransport) codec(pc *peerConn) (protocol.Encoder, protocol.Decoder) {
+	pc.codecMu.RLock()
+	defer pc.codecMu.RUnlock()
+	if pc.encoder == nil {
+		return protocol.NewGobEncoder(), t.decoder
+	}
+	return pc.encoder, pc.decoder
+}
+
+// codecFrame builds an offer or answer frame
+func codecFrame(names string) []byte {
+	frame := append([]byte(codecMagic), codecVersion)
+	return append(frame, names...)
+}
+
+// parseCodecFrame returns the names in an offer or answer frame
+// Returns: false if the frame is not one
+func parseCodecFrame(frame []byte) (string, bool) {
+	if len(frame) < len(codecMagic)+1 || !bytes.HasPrefix(frame, []byte(codecMagic)) || frame[len(codecMagic)] != codecVersion {
+		return "", false
+	}
+	return string(frame[len(codecMagic)+1:]), true
+}
@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// dialTimeout bounds a single connection attempt
+const dialTimeout = 30 * time.Second
+
+// ErrDialQueueTimeout is returned when a dial waited longer than allowed
+// for its turn; see WithDialLimit
+var ErrDialQueueTimeout = errors.New("timed out waiting for a dial slot")
+
+// WithDialLimit bounds the number of connections the transport dials at
+// once, so mirroring or swarming against many peers can't exhaust file
+// descriptors or trip SYN flood protection on the way
+// Further dials queue in the order they were made
+// max: Dials in progress at once, 0 for no limit
+// wait: How long a dial may queue before failing with ErrDialQueueTimeout,
+// 0 to wait until shutdown
+func WithDialLimit(max int, wait time.Duration) TCPOption {
+	return func(t *TCPTransport) {
+		if max <= 0 {
+			t.dials = nil
+			return
+		}
+		t.dials = &dialQueue{slots: make(chan struct{}, max), wait: wait}
+	}
+}
+
+// dialQueue hands out a limited number of dial slots
+type dialQueue struct {
+	slots  chan struct{} // Holds a token for every dial in progress
+	wait   time.Duration
+	queued atomic.Int64 // Dials waiting for a slot
+}
+
+// acquire waits for a dial slot; a nil queue has unlimited slots
+func (q *dialQueue) acquire(ctx context.Context) error {
+	if q == nil {
+		return nil
+	}
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	q.queued.Add(1)
+	defer q.queued.Add(-1)
+	var timeout <-chan time.Time
+	if q.wait > 0 {
+		timer := time.NewTimer(q.wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-timeout:
+		return ErrDialQueueTimeout
+	case <-ctx.Done():
+		return ErrShutdown
+	}
+}
+
+// release returns a slot taken by acquire
+func (q *dialQueue) release() {
+	if q != nil {
+		<-q.slots
+	}
+}
+
+// pendingDial is a dial in progress, which other dials to the same address
+// wait for instead of opening connections of their own
+type pendingDial struct {
+	done chan struct{} // Closed once pc or err is set
+	pc   *peerConn
+	err  error
+}
+
+// DialStats returns the number of dials in progress and queued behind the
+// limit set with WithDialLimit
+func (t *TCPTransport) DialStats() (active, queued int) {
+	if t.dials == nil {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		return len(t.dialing), 0
+	}
+	return len(t.dials.slots), int(t.dials.queued.Load())
+}
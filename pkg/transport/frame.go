@@ -0,0 +1,294 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+	"time"
+)
+
+// Every message on a TCP connection travels in a frame:
+//
+//	length  uint32  payload length in bytes
+//	seq     uint32  per-direction sequence number of data frames
+//	kind    uint8   frameData, frameMessage or frameNack
+//	crc     uint32  CRC-32C over length, seq, kind and payload
+//	payload [length]byte
+//
+// A receiver that sees a CRC mismatch asks the sender to retransmit just
+// the damaged frame with a NACK, holding on to frames that arrive in the
+// meantime so messages are still delivered in order
+// Frames longer than the receiver's limit are refused before their payload
+// is read, see WithMaxMessageSize
+const (
+	frameHeaderSize = 13
+
+	frameData    byte = 0x0 // Payload is an encoded message
+	frameNack    byte = 0x1 // Payload is the 4-byte sequence number to retransmit
+	frameMessage byte = 0x2 // Payload is the message type byte followed by the encoded message
+
+	retransmitFrames = 64       // Maximum number of sent frames kept for retransmission
+	retransmitBytes  = 32 << 20 // Maximum payload bytes kept for retransmission
+	maxCorruptFrames = 8        // Consecutive bad frames after which the stream is considered lost
+	renackInterval   = 500 * time.Millisecond
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrFrameCorrupt is returned when a connection's framing can't be recovered
+var ErrFrameCorrupt = errors.New("frame stream corrupted")
+
+// sentFrame is a data frame kept around in case the peer asks for it again
+type sentFrame struct {
+	kind    byte
+	seq     uint32
+	payload []byte
+}
+
+// heldFrame is a data frame received ahead of a gap
+type heldFrame struct {
+	kind    byte
+	payload []byte
+}
+
+// frameConn implements the framing protocol on top of a byte stream
+// WriteFrame may be called concurrently; ReadFrame must only be called
+// from a single reader goroutine
+type frameConn struct {
+	rw       io.ReadWriter
+	r        *bufio.Reader
+	maxFrame uint32 // Longest payload accepted, 0 for no limit
+
+	wmu       sync.Mutex  // Serializes frame writes
+	sendSeq   uint32      // Sequence number of the next data frame
+	sent      []sentFrame // Recently sent data frames, oldest first
+	sentBytes int         // Total payload bytes in sent
+
+	recvSeq   uint32               // Next data frame to deliver
+	maxSeen   uint32               // One past the highest data frame received
+	held      map[uint32]heldFrame // Frames received ahead of a gap
+	heldBytes int                  // Total payload bytes in held
+	lastNack  time.Time            // When a retransmit was last requested
+	corrupt   int                  // Consecutive frames that failed the CRC check
+	errCh     chan error           // Failures of background retransmissions
+}
+
+// newFrameConn wraps rw with the framing protocol
+func newFrameConn(rw io.ReadWriter) *frameConn {
+	return &frameConn{
+		rw:    rw,
+		r:     bufio.NewReader(rw),
+		held:  make(map[uint32]heldFrame),
+		errCh: make(chan error, 1),
+	}
+}
+
+// WriteFrame sends payload as the next data frame
+// kind: frameData, or frameMessage for a payload starting with its message type
+func (fc *frameConn) WriteFrame(kind byte, payload []byte) error {
+	fc.wmu.Lock()
+	defer fc.wmu.Unlock()
+
+	seq := fc.sendSeq
+	fc.sendSeq++
+
+	fc.sent = append(fc.sent, sentFrame{kind: kind, seq: seq, payload: payload})
+	fc.sentBytes += len(payload)
+	for len(fc.sent) > 1 && (len(fc.sent) > retransmitFrames || fc.sentBytes > retransmitBytes) {
+		fc.sentBytes -= len(fc.sent[0].payload)
+		fc.sent = fc.sent[1:]
+	}
+
+	return fc.writeRaw(kind, seq, payload)
+}
+
+// writeRaw writes a single frame; caller must hold fc.wmu
+func (fc *frameConn) writeRaw(kind byte, seq uint32, payload []byte) error {
+	if uint64(len(payload)) > 0xFFFFFFFF {
+		return fmt.Errorf("frame payload too large: %d bytes", len(payload))
+	}
+
+	var hdr [frameHeaderSize]byte
+	binary.BigEndian.PutUint32(hdr[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(hdr[4:8], seq)
+	hdr[8] = kind
+	crc := crc32.Update(crc32.Checksum(hdr[:9], crcTable), crcTable, payload)
+	binary.BigEndian.PutUint32(hdr[9:13], crc)
+
+	if _, err := fc.rw.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := fc.rw.Write(payload)
+	return err
+}
+
+// retransmit resends a previously sent data frame
+func (fc *frameConn) retransmit(seq uint32) error {
+	fc.wmu.Lock()
+	defer fc.wmu.Unlock()
+
+	// A NACK for a frame that hasn't been sent yet comes from a corrupted
+	// frame we never wrote, e.g. a damaged NACK of our own; ignore it
+	if int32(seq-fc.sendSeq) >= 0 {
+		return nil
+	}
+	for _, f := range fc.sent {
+		if f.seq == seq {
+			return fc.writeRaw(f.kind, f.seq, f.payload)
+		}
+	}
+	return fmt.Errorf("%w: frame %d no longer available for retransmission", ErrFrameCorrupt, seq)
+}
+
+// nack asks the peer to retransmit the given data frames
+func (fc *frameConn) nack(seqs ...uint32) error {
+	fc.wmu.Lock()
+	defer fc.wmu.Unlock()
+
+	fc.lastNack = time.Now()
+	for _, seq := range seqs {
+		var payload [4]byte
+		binary.BigEndian.PutUint32(payload[:], seq)
+		if err := fc.writeRaw(frameNack, 0, payload[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// missing returns the sequence numbers in the current gap, at most
+// retransmitFrames of them
+func (fc *frameConn) missing() []uint32 {
+	var seqs []uint32
+	for seq := fc.recvSeq; seq != fc.maxSeen && len(seqs) < retransmitFrames; seq++ {
+		if _, ok := fc.held[seq]; !ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	return seqs
+}
+
+// ReadFrame returns the kind and payload of the next data frame in
+// sequence order
+// Damaged frames are requested again transparently; an error is returned
+// only when the connection fails or the stream can't be recovered
+func (fc *frameConn) ReadFrame() (byte, []byte, error) {
+	for {
+		if f, ok := fc.held[fc.recvSeq]; ok {
+			delete(fc.held, fc.recvSeq)
+			fc.heldBytes -= len(f.payload)
+			fc.recvSeq++
+			return f.kind, f.payload, nil
+		}
+
+		select {
+		case err := <-fc.errCh:
+			return 0, nil, err
+		default:
+		}
+
+		kind, seq, payload, ok, err := fc.readRaw()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if !ok {
+			fc.corrupt++
+			if fc.corrupt > maxCorruptFrames {
+				return 0, nil, ErrFrameCorrupt
+			}
+			// Frames arrive in the order they were written, so the damaged
+			// frame is most likely the one after the highest seen so far
+			if err := fc.nack(fc.maxSeen); err != nil {
+				return 0, nil, err
+			}
+			if gap := int32(fc.maxSeen - fc.recvSeq); gap >= 0 && gap < retransmitFrames {
+				fc.maxSeen++
+			}
+			continue
+		}
+		fc.corrupt = 0
+
+		switch kind {
+		case frameNack:
+			if len(payload) != 4 {
+				return 0, nil, fmt.Errorf("%w: malformed NACK", ErrFrameCorrupt)
+			}
+			go func(seq uint32) {
+				if err := fc.retransmit(seq); err != nil {
+					select {
+					case fc.errCh <- err:
+					default:
+					}
+				}
+			}(binary.BigEndian.Uint32(payload))
+
+		case frameData, frameMessage:
+			if int32(seq-fc.recvSeq) < 0 {
+				continue // Duplicate of a frame already delivered
+			}
+			// The sender keeps no more frames than this for retransmission,
+			// so a gap any wider could never be filled
+			if seq-fc.recvSeq >= retransmitFrames {
+				return 0, nil, fmt.Errorf("%w: frame %d is too far ahead of %d", ErrFrameCorrupt, seq, fc.recvSeq)
+			}
+			if int32(seq-fc.maxSeen) >= 0 {
+				fc.maxSeen = seq + 1
+			}
+			if seq == fc.recvSeq {
+				fc.recvSeq++
+				return kind, payload, nil
+			}
+
+			if old, ok := fc.held[seq]; ok {
+				fc.heldBytes -= len(old.payload)
+			}
+			fc.held[seq] = heldFrame{kind: kind, payload: payload}
+			fc.heldBytes += len(payload)
+			if fc.heldBytes > retransmitBytes {
+				return 0, nil, fmt.Errorf("%w: %d bytes held ahead of a gap", ErrFrameCorrupt, fc.heldBytes)
+			}
+			if time.Since(fc.lastNack) > renackInterval {
+				if err := fc.nack(fc.missing()...); err != nil {
+					return 0, nil, err
+				}
+			}
+
+		default:
+			return 0, nil, fmt.Errorf("%w: unknown frame kind 0x%x", ErrFrameCorrupt, kind)
+		}
+	}
+}
+
+// readRaw reads one frame from the stream
+// Returns: ok is false if the frame failed its CRC check
+func (fc *frameConn) readRaw() (kind byte, seq uint32, payload []byte, ok bool, err error) {
+	var hdr [frameHeaderSize]byte
+	if _, err := io.ReadFull(fc.r, hdr[:]); err != nil {
+		return 0, 0, nil, false, err
+	}
+
+	length := binary.BigEndian.Uint32(hdr[0:4])
+	if fc.maxFrame > 0 && length > fc.maxFrame {
+		// The stream can't be resynchronised after a frame that isn't read,
+		// and whether the length was damaged or sent can't be told apart
+		return 0, 0, nil, false, fmt.Errorf("%w: %d byte frame over the limit of %d", ErrFrameCorrupt, length, fc.maxFrame)
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(fc.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, 0, nil, false, err
+	}
+
+	crc := crc32.Update(crc32.Checksum(hdr[:9], crcTable), crcTable, payload)
+	if crc != binary.BigEndian.Uint32(hdr[9:13]) {
+		return 0, 0, nil, false, nil
+	}
+	return hdr[8], binary.BigEndian.Uint32(hdr[4:8]), payload, true, nil
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+)
+
+// frameStream holds raw frames for a frameConn to read, and collects what
+// it writes back
+type frameStream struct {
+	in  bytes.Buffer
+	out bytes.Buffer
+}
+
+func (s *frameStream) Read(p []byte) (int, error)  { return s.in.Read(p) }
+func (s *frameStream) Write(p []byte) (int, error) { return s.out.Write(p) }
+
+// add appends a frame, damaging its CRC if corrupt is set
+func (s *frameStream) add(t *testing.T, kind byte, seq uint32, payload []byte, corrupt bool) {
+	t.Helper()
+	w := newFrameConn(&s.in)
+	if err := w.writeRaw(kind, seq, payload); err != nil {
+		t.Fatal(err)
+	}
+	if corrupt {
+		b := s.in.Bytes()
+		b[len(b)-1] ^= 0xFF
+	}
+}
+
+// nacks returns the sequence numbers of the NACK frames written back
+func (s *frameStream) nacks(t *testing.T) []uint32 {
+	t.Helper()
+	r := newFrameConn(&s.out)
+	var seqs []uint32
+	for {
+		kind, _, payload, ok, err := r.readRaw()
+		if err == io.EOF {
+			return seqs
+		}
+		if err != nil || !ok || kind != frameNack {
+			t.Fatalf("unexpected frame written back: kind %d, ok %v, err %v", kind, ok, err)
+		}
+		seqs = append(seqs, binary.BigEndian.Uint32(payload))
+	}
+}
+
+func readFrames(t *testing.T, fc *frameConn, n int) []string {
+	t.Helper()
+	var got []string
+	for i := 0; i < n; i++ {
+		_, payload, err := fc.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		got = append(got, string(payload))
+	}
+	return got
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	w := newFrameConn(&buf)
+	for _, p := range []string{"one", "", "three"} {
+		if err := w.WriteFrame(frameData, []byte(p)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got := readFrames(t, newFrameConn(&buf), 3)
+	if want := []string{"one", "", "three"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestFrameOutOfOrder(t *testing.T) {
+	s := &frameStream{}
+	s.add(t, frameData, 2, []byte("c"), false)
+	s.add(t, frameData, 1, []byte("b"), false)
+	s.add(t, frameData, 0, []byte("a"), false)
+	got := readFrames(t, newFrameConn(s), 3)
+	if want := []string{"a", "b", "c"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if nacks := s.nacks(t); len(nacks) != 2 || nacks[0] != 0 || nacks[1] != 1 {
+		t.Fatalf("NACKs %v, want [0 1]", nacks)
+	}
+}
+
+func TestFrameCorruptRetransmitted(t *testing.T) {
+	s := &frameStream{}
+	s.add(t, frameData, 0, []byte("a"), true)
+	s.add(t, frameData, 1, []byte("b"), false)
+	s.add(t, frameData, 0, []byte("a"), false)
+	got := readFrames(t, newFrameConn(s), 2)
+	if want := []string{"a", "b"}; !slices.Equal(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if nacks := s.nacks(t); len(nacks) != 1 || nacks[0] != 0 {
+		t.Fatalf("NACKs %v, want [0]", nacks)
+	}
+}
+
+func TestFrameTooManyCorrupt(t *testing.T) {
+	s := &frameStream{}
+	for i := 0; i <= maxCorruptFrames; i++ {
+		s.add(t, frameData, 0, []byte("x"), true)
+	}
+	if _, _, err := newFrameConn(s).ReadFrame(); !errors.Is(err, ErrFrameCorrupt) {
+		t.Fatalf("got %v, want ErrFrameCorrupt", err)
+	}
+}
+
+func TestFrameFarAhead(t *testing.T) {
+	for _, seq := range []uint32{retransmitFrames, 1<<31 - 1} {
+		s := &frameStream{}
+		s.add(t, frameData, seq, []byte("x"), false)
+		if _, _, err := newFrameConn(s).ReadFrame(); !errors.Is(err, ErrFrameCorrupt) {
+			t.Fatalf("seq %d: got %v, want ErrFrameCorrupt", seq, err)
+		}
+		if s.out.Len() != 0 {
+			t.Fatalf("seq %d: %d bytes of NACKs written", seq, s.out.Len())
+		}
+	}
+}
+
+func TestFrameHeldBytesCapped(t *testing.T) {
+	s := &frameStream{}
+	big := make([]byte, retransmitBytes/4+1)
+	for seq := uint32(1); seq <= 4; seq++ {
+		s.add(t, frameData, seq, big, false)
+	}
+	if _, _, err := newFrameConn(s).ReadFrame(); !errors.Is(err, ErrFrameCorrupt) {
+		t.Fatalf("got %v, want ErrFrameCorrupt", err)
+	}
+}
+
+func TestFrameOverLimit(t *testing.T) {
+	s := &frameStream{}
+	s.add(t, frameData, 0, make([]byte, 100), false)
+	fc := newFrameConn(s)
+	fc.maxFrame = 99
+	if _, _, err := fc.ReadFrame(); !errors.Is(err, ErrFrameCorrupt) {
+		t.Fatalf("got %v, want ErrFrameCorrupt", err)
+	}
+}
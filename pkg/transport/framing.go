@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// DefaultMaxMessageSize is the longest frame a transport accepts unless
+// WithMaxMessageSize says otherwise; it leaves room for the largest piece
+// and for whole files sent in one message to peers that predate streaming
+const DefaultMaxMessageSize = 256 << 20
+
+// ErrMessageTooLarge is returned by Send for a message longer than the
+// receiving peer accepts
+var ErrMessageTooLarge = errors.New("message too large for the peer")
+
+// WithMaxMessageSize sets the longest frame the transport accepts, so a
+// peer can't make it allocate more than that for one message; a peer
+// sending a longer one is disconnected. 0 removes the limit
+// Peers that exchange protocol.Framing learn each other's limit and
+// refuse to send what the other end would refuse to read
+func WithMaxMessageSize(n uint32) TCPOption {
+	return func(t *TCPTransport) {
+		t.maxMessage = n
+	}
+}
+
+// announceFraming tells the remote end of a dialed connection that it may
+// send typed frames; once it answers in kind, this end sends them too
+func (t *TCPTransport) announceFraming(pc *peerConn) error {
+	msg := protocol.Message{Type: protocol.MessageTypeFraming, Payload: &protocol.Framing{MaxSize: t.maxMessage}}
+	var buf bytes.Buffer
+	encoder, _ := t.codec(pc)
+	if err := encoder.Encode(&buf, &msg); err != nil {
+		return err
+	}
+	return pc.writeMessage(buf.Bytes())
+}
+
+// handleFraming records that the remote end reads typed frames and the
+// longest it accepts, answering the announcement on an accepted connection
+func (t *TCPTransport) handleFraming(pc *peerConn, msg *protocol.Message) error {
+	f, ok := msg.Payload.(*protocol.Framing)
+	if !ok {
+		return errors.New("framing announcement without a payload")
+	}
+	pc.remoteMax.Store(f.MaxSize)
+	if !pc.dialed && !pc.typed.Load() {
+		if err := t.announceFraming(pc); err != nil {
+			return err
+		}
+	}
+	pc.typed.Store(true)
+	return nil
+}
@@ -0,0 +1,125 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// StageHello is the protocol.Handshake of a connection attempt, see ConnAttempt
+const StageHello Stage = "hello"
+
+// ErrIncompatible is returned for connections refused because the peers
+// share no protocol version
+var ErrIncompatible = errors.New("incompatible protocol version")
+
+// SetHello sets the peer ID and features sent in the handshake of new
+// connections; see protocol.Handshake
+func (t *TCPTransport) SetHello(id string, features []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.hello = &protocol.Handshake{ID: id, Features: append([]string(nil), features...)}
+}
+
+// ProtocolVersion returns the protocol version agreed on with the peer
+// connected at addr
+// Returns: false if there's no such connection or the version isn't
+// settled yet
+func (t *TCPTransport) ProtocolVersion(addr string) (uint16, bool) {
+	t.mu.RLock()
+	pc, ok := t.peers[addr]
+	t.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	v := pc.version.Load()
+	return uint16(v), v != 0
+}
+
+// sendHandshake sends this end's handshake on a connection
+// refusal: Why the connection is refused, empty to accept it
+func (t *TCPTransport) sendHandshake(pc *peerConn, refusal string) error {
+	h := protocol.Handshake{Protocol: protocol.ProtocolVersion, MinProtocol: protocol.MinProtocolVersion, Error: refusal}
+	t.mu.RLock()
+	if t.hello != nil {
+		h.ID, h.Features = t.hello.ID, t.hello.Features
+	}
+	t.mu.RUnlock()
+
+	msg := protocol.Message{Type: protocol.MessageTypeHandshake, From: h.ID, Payload: &h}
+	var buf bytes.Buffer
+	kind := frameData
+	if pc.typed.Load() {
+		kind = frameMessage
+		buf.WriteByte(msg.Type)
+	}
+	encoder, _ := t.codec(pc)
+	if err := encoder.Encode(&buf, &msg); err != nil {
+		return err
+	}
+	return pc.writeFrame(kind, buf.Bytes())
+}
+
+// handleHandshake settles the protocol version of a connection from the
+// remote end's handshake, answering it on an accepted connection
+// Returns: An error if the connection must be closed
+func (t *TCPTransport) handleHandshake(addr string, pc *peerConn, msg *protocol.Message) error {
+	h, ok := msg.Payload.(*protocol.Handshake)
+	if !ok {
+		return errors.New("handshake without a payload")
+	}
+	if h.Error != "" {
+		return t.refused(addr, pc, fmt.Errorf("%w: peer refused the connection: %s", ErrIncompatible, h.Error))
+	}
+
+	version := min(protocol.ProtocolVersion, h.Protocol)
+	if version < max(protocol.MinProtocolVersion, h.MinProtocol) {
+		reason := fmt.Sprintf("no common protocol version (%s speaks versions %d to %d, %s speaks %d to %d)",
+			pc.LocalAddr(), protocol.MinProtocolVersion, protocol.ProtocolVersion, pc.RemoteAddr(), h.MinProtocol, h.Protocol)
+		if !pc.dialed {
+			t.sendHandshake(pc, reason)
+		}
+		return t.refused(addr, pc, fmt.Errorf("%w: %s", ErrIncompatible, reason))
+	}
+	if !pc.dialed && pc.version.Load() == 0 {
+		if err := t.sendHandshake(pc, ""); err != nil {
+			return err
+		}
+	}
+	t.settleVersion(pc, version)
+	return nil
+}
+
+// settleLegacy settles the protocol version of a connection whose remote
+// end sent a message without a handshake first, so predates it
+// Returns: An error if the connection must be closed
+func (t *TCPTransport) settleLegacy(addr string, pc *peerConn) error {
+	if protocol.MinProtocolVersion > 1 {
+		reason := fmt.Sprintf("%s speaks protocol version 1, which is no longer supported", pc.RemoteAddr())
+		return t.refused(addr, pc, fmt.Errorf("%w: %s", ErrIncompatible, reason))
+	}
+	t.settleVersion(pc, 1)
+	return nil
+}
+
+// settleVersion records the protocol version agreed on for a connection
+func (t *TCPTransport) settleVersion(pc *peerConn, version uint16) {
+	pc.version.Store(uint32(version))
+	if version < protocol.ProtocolVersion {
+		logging.Infof(t.logger, "Peer at %s speaks protocol version %d, falling back to it", pc.RemoteAddr(), version)
+	}
+}
+
+// refused records why a connection can't be used, so that Send reports it
+// instead of the connection merely closing
+// addr: The key the connection is registered under
+func (t *TCPTransport) refused(addr string, pc *peerConn, err error) error {
+	pc.refusal.Store(err)
+	logging.Warnf(t.logger, "Closing connection with %s: %v", pc.RemoteAddr(), err)
+	t.recordAttempt(addr, !pc.dialed, time.Now(), StageHello, err)
+	return err
+}
@@ -0,0 +1,127 @@
+package transport
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// Once any swarm handshake is done, peers with an identity exchange their
+// keys before any frame:
+//
+//	hello      "P2PIDENT", version uint8, nonce [32]byte, public key [32]byte,
+//	           ID length uint8, ID
+//	signature  Ed25519 signature over the role and both nonces [64]byte
+//
+// The signature proves possession of the key for this connection only;
+// whether the key is the right one for the peer is up to the verifier
+const (
+	identityMagic   = "P2PIDENT"
+	identityVersion = 1
+)
+
+// PeerIdentity is the identity a remote peer proved during the handshake
+type PeerIdentity struct {
+	ID     string            // Peer ID the remote peer announced
+	Key    ed25519.PublicKey // Key the remote peer proved it holds
+	Addr   string            // Address dialed, or the remote address of an incoming connection
+	Dialed bool              // Whether this side initiated the connection
+}
+
+// KeyVerifier decides whether a remote peer's identity is acceptable
+// Returning an error closes the connection; the verifier may block, e.g.
+// to ask the user, without holding up other connections
+type KeyVerifier func(PeerIdentity) error
+
+// SetIdentity makes the transport prove its identity key on every new
+// connection and check the remote peer's with verify
+// Both ends of a connection must have an identity; existing connections
+// are not affected
+func (t *TCPTransport) SetIdentity(id string, key ed25519.PrivateKey, verify KeyVerifier) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.identity = &identity{id: id, key: key, verify: verify}
+}
+
+// identity is the transport's own key and the verifier for remote keys
+type identity struct {
+	id     string
+	key    ed25519.PrivateKey
+	verify KeyVerifier
+}
+
+// handshake exchanges and checks identities on conn, whose deadline the
+// caller has set
+// addr: The address dialed, or the remote address of an incoming connection
+// Returns: The peer ID the remote peer proved its key for
+func (ident *identity) handshake(conn net.Conn, addr string, dialer bool) (string, error) {
+	if len(ident.id) > 255 {
+		return "", fmt.Errorf("peer ID too long for the identity handshake")
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	pub := ident.key.Public().(ed25519.PublicKey)
+	hello := make([]byte, 0, len(identityMagic)+2+32+len(pub)+len(ident.id))
+	hello = append(hello, identityMagic...)
+	hello = append(hello, identityVersion)
+	hello = append(hello, nonce...)
+	hello = append(hello, pub...)
+	hello = append(hello, byte(len(ident.id)))
+	hello = append(hello, ident.id...)
+	if _, err := conn.Write(hello); err != nil {
+		return "", err
+	}
+
+	head := make([]byte, len(identityMagic)+1+32+ed25519.PublicKeySize+1)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return "", fmt.Errorf("identity handshake failed: %v", err)
+	}
+	if string(head[:len(identityMagic)]) != identityMagic {
+		return "", fmt.Errorf("identity handshake failed: peer has no identity key")
+	}
+	if v := head[len(identityMagic)]; v != identityVersion {
+		return "", fmt.Errorf("identity handshake failed: unsupported version %d", v)
+	}
+	rest := head[len(identityMagic)+1:]
+	remoteNonce := rest[:32]
+	remote := PeerIdentity{Key: ed25519.PublicKey(rest[32 : 32+ed25519.PublicKeySize]), Addr: addr, Dialed: dialer}
+	id := make([]byte, rest[len(rest)-1])
+	if _, err := io.ReadFull(conn, id); err != nil {
+		return "", fmt.Errorf("identity handshake failed: %v", err)
+	}
+	remote.ID = string(id)
+
+	dialNonce, acceptNonce := nonce, remoteNonce
+	local, expect := "dialer", "acceptor"
+	if !dialer {
+		dialNonce, acceptNonce = remoteNonce, nonce
+		local, expect = expect, local
+	}
+	transcript := func(role string) []byte {
+		msg := append([]byte("p2p identity "+role), dialNonce...)
+		return append(msg, acceptNonce...)
+	}
+
+	if _, err := conn.Write(ed25519.Sign(ident.key, transcript(local))); err != nil {
+		return "", err
+	}
+	sig := make([]byte, ed25519.SignatureSize)
+	if _, err := io.ReadFull(conn, sig); err != nil {
+		return "", fmt.Errorf("identity handshake failed: %v", err)
+	}
+	if !ed25519.Verify(remote.Key, transcript(expect), sig) {
+		return "", fmt.Errorf("identity handshake failed: peer %s does not hold the key it presented", remote.ID)
+	}
+
+	if ident.verify == nil {
+		return remote.ID, nil
+	}
+	// The verifier may take its time, e.g. asking the user
+	conn.SetDeadline(time.Time{})
+	return remote.ID, ident.verify(remote)
+}
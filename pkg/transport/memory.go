@@ -0,0 +1,181 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// MemoryNetwork connects MemoryTransports living in the same process
+// It is intended for tests and simulations where real sockets are unnecessary
+type MemoryNetwork struct {
+	mu         sync.RWMutex
+	transports map[string]*MemoryTransport // Listening transports keyed by address
+	next       int                         // Counter for generated addresses
+}
+
+// NewMemoryNetwork creates an empty in-process network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		transports: make(map[string]*MemoryTransport),
+	}
+}
+
+// NewTransport creates a transport attached to this network
+// addr: The address the transport will listen on; empty picks a unique one
+// Returns: A transport that must be started with StartListening before use
+func (n *MemoryNetwork) NewTransport(addr string) *MemoryTransport {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if addr == "" {
+		n.next++
+		addr = fmt.Sprintf("mem:%d", n.next)
+	}
+	return &MemoryTransport{
+		network:   n,
+		addr:      addr,
+		messageCh: make(chan protocol.Message, 1024),
+		encoder:   protocol.NewGobEncoder(),
+		decoder:   protocol.NewGobDecoder(),
+		done:      make(chan struct{}),
+	}
+}
+
+// lookup returns the listening transport at addr
+func (n *MemoryNetwork) lookup(addr string) (*MemoryTransport, error) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	t, ok := n.transports[addr]
+	if !ok {
+		return nil, fmt.Errorf("no peer listening on %s", addr)
+	}
+	return t, nil
+}
+
+// MemoryTransport implements the Transport interface over a MemoryNetwork
+// Messages are passed through the codec on every send, so payloads are
+// copied exactly as they would be over a real connection
+// All methods are safe for concurrent use
+type MemoryTransport struct {
+	network   *MemoryNetwork
+	addr      string
+	messageCh chan protocol.Message
+	encoder   protocol.Encoder
+	decoder   protocol.Decoder
+
+	mu        sync.RWMutex  // Guards closed against concurrent delivery
+	closed    bool          // Set once the message channel has been closed
+	done      chan struct{} // Closed on shutdown to unblock pending deliveries
+	closeOnce sync.Once
+}
+
+// GetListenAddress returns the address this transport is reachable at
+func (t *MemoryTransport) GetListenAddress() string {
+	return t.addr
+}
+
+// StartListening registers the transport on its network so peers can reach it
+// Returns an error if another transport already uses the address
+func (t *MemoryTransport) StartListening() error {
+	t.network.mu.Lock()
+	defer t.network.mu.Unlock()
+
+	if _, exists := t.network.transports[t.addr]; exists {
+		return fmt.Errorf("address %s already in use", t.addr)
+	}
+	t.network.transports[t.addr] = t
+	return nil
+}
+
+// ConnectToPeer checks that a transport is listening at addr
+// There is no connection state to set up on an in-process network
+func (t *MemoryTransport) ConnectToPeer(addr string) error {
+	_, err := t.network.lookup(addr)
+	return err
+}
+
+// SetCodec passes the messages the transport sends and receives through
+// the named codec instead of gob; every transport on the network must use
+// the same one. Call it before the transport is used
+func (t *MemoryTransport) SetCodec(name string) error {
+	encoder, decoder, err := protocol.NewCodec(name, protocol.DefaultRegistry())
+	if err != nil {
+		return err
+	}
+	t.encoder, t.decoder = encoder, decoder
+	return nil
+}
+
+// GetMessageChannel returns a receive-only channel for consuming messages
+// The channel is closed when the transport shuts down
+func (t *MemoryTransport) GetMessageChannel() <-chan protocol.Message {
+	return t.messageCh
+}
+
+// Send delivers msg to the transport listening at addr
+func (t *MemoryTransport) Send(addr string, msg protocol.Message) error {
+	select {
+	case <-t.done:
+		return ErrShutdown
+	default:
+	}
+
+	target, err := t.network.lookup(addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to peer %s: %v", addr, err)
+	}
+
+	var buf bytes.Buffer
+	if err := t.encoder.Encode(&buf, &msg); err != nil {
+		return err
+	}
+	var delivered protocol.Message
+	if err := target.decoder.Decode(&buf, &delivered); err != nil {
+		return err
+	}
+	delivered.FromAddr = t.addr
+
+	return target.deliver(delivered)
+}
+
+// deliver queues msg on the transport's message channel
+func (t *MemoryTransport) deliver(msg protocol.Message) error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return fmt.Errorf("peer %s is shut down", t.addr)
+	}
+	select {
+	case t.messageCh <- msg:
+		return nil
+	case <-t.done:
+		return fmt.Errorf("peer %s is shut down", t.addr)
+	}
+}
+
+// Shutdown removes the transport from its network and closes the message channel
+// Calling Shutdown more than once is safe
+func (t *MemoryTransport) Shutdown() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+
+		t.network.mu.Lock()
+		if t.network.transports[t.addr] == t {
+			delete(t.network.transports, t.addr)
+		}
+		t.network.mu.Unlock()
+
+		// Pending deliveries give up once done is closed, so the write
+		// lock can always be acquired here
+		t.mu.Lock()
+		t.closed = true
+		close(t.messageCh)
+		t.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,241 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// Transport is the method set shared by all transports in this package
+// It mirrors peer.Transport so wrappers can be layered over any implementation
+type Transport interface {
+	GetListenAddress() string
+	ConnectToPeer(addr string) error
+	StartListening() error
+	GetMessageChannel() <-chan protocol.Message
+	Shutdown() error
+	Send(addr string, msg protocol.Message) error
+}
+
+// ErrSimulatedDisconnect is returned by SimTransport.Send while the
+// destination is disconnected
+var ErrSimulatedDisconnect = errors.New("simulated disconnect")
+
+// Conditions describes the impairments a SimTransport applies to outgoing messages
+type Conditions struct {
+	Latency   time.Duration // Fixed one-way delay added to every message
+	Jitter    time.Duration // Random extra delay in [0, Jitter)
+	LossRate  float64       // Probability in [0, 1] that a message is silently dropped
+	Bandwidth int64         // Link capacity in bytes per second, 0 for unlimited
+}
+
+// SimTransport wraps another transport and injects latency, jitter, loss,
+// bandwidth limits and disconnects into outgoing messages, so retry and
+// recovery logic can be exercised in tests and benchmarks
+//
+// Randomness comes from a seeded source, so a given seed and sequence of
+// sends always drops and delays the same messages. Messages to the same
+// destination are delivered in order, as they would be over a single TCP
+// connection; Send blocks for the transmission time implied by Bandwidth
+// but not for the latency, which is applied by a per-destination link.
+// Dropping the latency to zero while delayed messages are still queued may
+// let later messages overtake them
+type SimTransport struct {
+	Transport
+
+	mu           sync.Mutex
+	cond         Conditions
+	rng          *rand.Rand
+	linkFree     time.Time           // When the bandwidth-limited link is next idle
+	links        map[string]*simLink // Delivery queues keyed by destination
+	disconnected map[string]bool     // Destinations that currently reject sends
+	closed       bool
+	done         chan struct{} // Closed on shutdown to stop the links
+	logger       *log.Logger
+}
+
+// simLink delivers delayed messages to one destination in order
+type simLink struct {
+	queue chan simMessage
+}
+
+// simMessage is a message waiting for its delivery time
+type simMessage struct {
+	deliverAt time.Time
+	msg       protocol.Message
+}
+
+// NewSimTransport wraps inner with the given network conditions
+// seed: Seed for the random source driving jitter and loss
+func NewSimTransport(inner Transport, cond Conditions, seed int64) *SimTransport {
+	return &SimTransport{
+		Transport:    inner,
+		cond:         cond,
+		rng:          rand.New(rand.NewSource(seed)),
+		links:        make(map[string]*simLink),
+		disconnected: make(map[string]bool),
+		done:         make(chan struct{}),
+		logger:       log.Default(),
+	}
+}
+
+// SetLogger sets the logger used to report failed delayed deliveries
+func (s *SimTransport) SetLogger(logger *log.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.logger = logger
+}
+
+// SetConditions replaces the active conditions; messages already in flight
+// keep the delay they were given
+func (s *SimTransport) SetConditions(cond Conditions) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cond = cond
+}
+
+// Disconnect makes every subsequent Send to addr fail with
+// ErrSimulatedDisconnect until Reconnect is called
+func (s *SimTransport) Disconnect(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.disconnected[addr] = true
+}
+
+// Reconnect undoes a previous Disconnect
+func (s *SimTransport) Reconnect(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.disconnected, addr)
+}
+
+// Send applies the configured conditions and forwards msg to the wrapped transport
+// A lost message is reported as sent, just like a frame lost on the wire
+func (s *SimTransport) Send(addr string, msg protocol.Message) error {
+	size, err := encodedSize(&msg)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrShutdown
+	}
+	if s.disconnected[addr] {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to connect to peer %s: %w", addr, ErrSimulatedDisconnect)
+	}
+
+	cond := s.cond
+	lost := cond.LossRate > 0 && s.rng.Float64() < cond.LossRate
+	delay := cond.Latency
+	if cond.Jitter > 0 {
+		delay += time.Duration(s.rng.Int63n(int64(cond.Jitter)))
+	}
+
+	// Serialize transmissions over the shared link
+	now := time.Now()
+	sent := now
+	if cond.Bandwidth > 0 {
+		start := now
+		if s.linkFree.After(start) {
+			start = s.linkFree
+		}
+		sent = start.Add(time.Duration(float64(size) / float64(cond.Bandwidth) * float64(time.Second)))
+		s.linkFree = sent
+	}
+
+	// Without latency the message is forwarded directly so that errors
+	// from the wrapped transport reach the caller
+	var link *simLink
+	if cond.Latency > 0 || cond.Jitter > 0 {
+		link = s.link(addr)
+	}
+	s.mu.Unlock()
+
+	time.Sleep(time.Until(sent))
+	if lost {
+		return nil
+	}
+	if link == nil {
+		return s.Transport.Send(addr, msg)
+	}
+
+	select {
+	case link.queue <- simMessage{deliverAt: sent.Add(delay), msg: msg}:
+		return nil
+	case <-s.done:
+		return ErrShutdown
+	}
+}
+
+// link returns the delivery queue for addr, starting it if needed
+// Caller must hold s.mu
+func (s *SimTransport) link(addr string) *simLink {
+	if l, ok := s.links[addr]; ok {
+		return l
+	}
+
+	l := &simLink{queue: make(chan simMessage, 1024)}
+	s.links[addr] = l
+	go func() {
+		for {
+			select {
+			case m := <-l.queue:
+				select {
+				case <-time.After(time.Until(m.deliverAt)):
+				case <-s.done:
+					return
+				}
+				if err := s.Transport.Send(addr, m.msg); err != nil {
+					s.mu.Lock()
+					logger := s.logger
+					s.mu.Unlock()
+					logging.Errorf(logger, "Simulated link to %s: send failed: %v", addr, err)
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+// Shutdown stops the delivery links and shuts down the wrapped transport
+// Messages still waiting for their delivery time are dropped
+func (s *SimTransport) Shutdown() error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	s.mu.Unlock()
+
+	return s.Transport.Shutdown()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// encodedSize returns the number of bytes msg occupies on the wire
+func encodedSize(msg *protocol.Message) (int64, error) {
+	var w countingWriter
+	if err := protocol.NewGobEncoder().Encode(&w, msg); err != nil {
+		return 0, err
+	}
+	return w.n, nil
+}
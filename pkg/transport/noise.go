@@ -0,0 +1,337 @@
+package transport
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+)
+
+// A Noise connection starts with a handshake after any TLS one, following
+// the Noise_XX_25519_AESGCM_SHA256 protocol of the Noise Protocol
+// Framework:
+//
+//	hello    "P2PNOISE", version uint8
+//	-> e                  ephemeral key
+//	<- e, ee, s, es       ephemeral key, encrypted static key
+//	-> s, se              encrypted static key
+//
+// Each handshake message is prefixed with its length as a uint16. Both
+// sides end up with each other's static key and a pair of session keys,
+// one per direction; every frame payload after that is sealed with
+// AES-256-GCM under the session key, using a message counter as nonce
+const (
+	noiseMagic    = "P2PNOISE"
+	noiseVersion  = 1
+	noiseProtocol = "Noise_XX_25519_AESGCM_SHA256"
+	noisePrologue = "p2p noise v1"
+)
+
+// ErrNoiseHandshake is returned when a remote peer fails the Noise handshake
+var ErrNoiseHandshake = errors.New("noise handshake failed")
+
+// WithNoise encrypts and authenticates every connection with a Noise_XX
+// handshake, which needs no certificates; peers must all use Noise or none
+// key: The transport's static X25519 key, see LoadOrCreateNoiseKey
+func WithNoise(key *ecdh.PrivateKey) TCPOption {
+	return func(t *TCPTransport) {
+		t.noise = key
+	}
+}
+
+// LoadOrCreateNoiseKey reads a static X25519 key from a PEM file,
+// generating and saving a new one readable only by the owner if the file
+// doesn't exist
+// Returns: The key, and whether it was generated
+func LoadOrCreateNoiseKey(path string) (*ecdh.PrivateKey, bool, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, false, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, false, err
+		}
+		out := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err := os.WriteFile(path, out, 0600); err != nil {
+			return nil, false, fmt.Errorf("failed to save noise key: %v", err)
+		}
+		return key, true, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read noise key: %v", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, false, fmt.Errorf("%s does not contain a PEM private key", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to parse noise key %s: %v", path, err)
+	}
+	key, ok := parsed.(*ecdh.PrivateKey)
+	if !ok || key.Curve() != ecdh.X25519() {
+		return nil, false, fmt.Errorf("%s is not an X25519 key", path)
+	}
+	return key, false, nil
+}
+
+// noiseHandshake runs the Noise_XX handshake on conn and derives the
+// session ciphers; the caller sets a deadline for it
+// dialer: Whether this side initiated the connection, the Noise initiator
+func noiseHandshake(static *ecdh.PrivateKey, conn net.Conn, dialer bool) (*sessionCipher, error) {
+	hello := append([]byte(noiseMagic), noiseVersion)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+	remote := make([]byte, len(hello))
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+	}
+	if string(remote[:len(noiseMagic)]) != noiseMagic {
+		return nil, fmt.Errorf("%w: peer does not use noise", ErrNoiseHandshake)
+	}
+	if v := remote[len(noiseMagic)]; v != noiseVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrNoiseHandshake, v)
+	}
+
+	hs, err := newNoiseState(static)
+	if err != nil {
+		return nil, err
+	}
+	if dialer {
+		err = hs.initiate(conn)
+	} else {
+		err = hs.respond(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	k1, k2 := hs.split()
+	if dialer {
+		return newSessionCipher(k1, k2)
+	}
+	return newSessionCipher(k2, k1)
+}
+
+// noiseState is the handshake and symmetric state of a Noise handshake
+type noiseState struct {
+	s, e   *ecdh.PrivateKey // Local static and ephemeral keys
+	rs, re *ecdh.PublicKey  // Remote static and ephemeral keys
+	ck, h  []byte           // Chaining key and handshake hash
+	k      []byte           // Key encrypting handshake payloads, nil before the first DH
+	n      uint64           // Nonce for k
+}
+
+func newNoiseState(static *ecdh.PrivateKey) (*noiseState, error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocol)
+	hs := &noiseState{s: static, e: e, ck: h, h: h}
+	hs.mixHash([]byte(noisePrologue))
+	return hs, nil
+}
+
+// initiate runs the initiator's side of the XX pattern
+func (hs *noiseState) initiate(conn net.Conn) error {
+	// -> e
+	msg := hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+	if err := writeNoise(conn, append(msg, hs.encryptAndHash(nil)...)); err != nil {
+		return err
+	}
+
+	// <- e, ee, s, es
+	msg, err := readNoise(conn)
+	if err != nil {
+		return err
+	}
+	if hs.re, msg, err = hs.readKey(msg, false); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return err
+	}
+	if hs.rs, msg, err = hs.readKey(msg, true); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return err
+	}
+	if _, err := hs.decryptAndHash(msg); err != nil {
+		return err
+	}
+
+	// -> s, se
+	msg = hs.encryptAndHash(hs.s.PublicKey().Bytes())
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return err
+	}
+	return writeNoise(conn, append(msg, hs.encryptAndHash(nil)...))
+}
+
+// respond runs the responder's side of the XX pattern
+func (hs *noiseState) respond(conn net.Conn) error {
+	// -> e
+	msg, err := readNoise(conn)
+	if err != nil {
+		return err
+	}
+	if hs.re, msg, err = hs.readKey(msg, false); err != nil {
+		return err
+	}
+	if _, err := hs.decryptAndHash(msg); err != nil {
+		return err
+	}
+
+	// <- e, ee, s, es
+	msg = hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+	if err := hs.mixDH(hs.e, hs.re); err != nil {
+		return err
+	}
+	msg = append(msg, hs.encryptAndHash(hs.s.PublicKey().Bytes())...)
+	if err := hs.mixDH(hs.s, hs.re); err != nil {
+		return err
+	}
+	if err := writeNoise(conn, append(msg, hs.encryptAndHash(nil)...)); err != nil {
+		return err
+	}
+
+	// -> s, se
+	if msg, err = readNoise(conn); err != nil {
+		return err
+	}
+	if hs.rs, msg, err = hs.readKey(msg, true); err != nil {
+		return err
+	}
+	if err := hs.mixDH(hs.e, hs.rs); err != nil {
+		return err
+	}
+	_, err = hs.decryptAndHash(msg)
+	return err
+}
+
+// readKey takes a public key off the front of a handshake message,
+// decrypting it if it's a static key
+// Returns: The key and the rest of the message
+func (hs *noiseState) readKey(msg []byte, encrypted bool) (*ecdh.PublicKey, []byte, error) {
+	n := 32
+	if encrypted && hs.k != nil {
+		n += 16
+	}
+	if len(msg) < n {
+		return nil, nil, fmt.Errorf("%w: message too short", ErrNoiseHandshake)
+	}
+	raw := msg[:n]
+	if encrypted {
+		var err error
+		if raw, err = hs.decryptAndHash(raw); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		hs.mixHash(raw)
+	}
+	key, err := ecdh.X25519().NewPublicKey(raw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+	}
+	return key, msg[n:], nil
+}
+
+// mixDH mixes the Diffie-Hellman result of a local and a remote key into
+// the chaining key, and starts encrypting with the key derived from it
+func (hs *noiseState) mixDH(local *ecdh.PrivateKey, remote *ecdh.PublicKey) error {
+	shared, err := local.ECDH(remote)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+	}
+	hs.ck, hs.k = noiseHKDF(hs.ck, shared)
+	hs.n = 0
+	return nil
+}
+
+func (hs *noiseState) mixHash(data []byte) {
+	sum := sha256.Sum256(append(hs.h[:len(hs.h):len(hs.h)], data...))
+	hs.h = sum[:]
+}
+
+// encryptAndHash encrypts a handshake payload once there is a key, and
+// mixes the result into the handshake hash
+func (hs *noiseState) encryptAndHash(plain []byte) []byte {
+	out := plain
+	if hs.k != nil {
+		out = hs.aead().Seal(nil, counterNonce(hs.n), plain, hs.h)
+		hs.n++
+	}
+	hs.mixHash(out)
+	return out
+}
+
+// decryptAndHash reverses encryptAndHash
+func (hs *noiseState) decryptAndHash(data []byte) ([]byte, error) {
+	out := data
+	if hs.k != nil {
+		var err error
+		if out, err = hs.aead().Open(nil, counterNonce(hs.n), data, hs.h); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+		}
+		hs.n++
+	}
+	hs.mixHash(data)
+	return out, nil
+}
+
+func (hs *noiseState) aead() cipher.AEAD {
+	// A 32 byte key always makes a valid cipher
+	aead, _ := newGCM(hs.k)
+	return aead
+}
+
+// split derives the session keys of the initiator and the responder
+func (hs *noiseState) split() ([]byte, []byte) {
+	return noiseHKDF(hs.ck, nil)
+}
+
+// noiseHKDF is the HKDF of the Noise framework with two outputs
+func noiseHKDF(ck, input []byte) ([]byte, []byte) {
+	temp := hmacSum(ck, input)
+	out1 := hmacSum(temp, []byte{1})
+	out2 := hmacSum(temp, out1, []byte{2})
+	return out1, out2
+}
+
+// writeNoise sends a handshake message prefixed with its length
+func writeNoise(conn net.Conn, msg []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(msg)), uint16(len(msg)))
+	_, err := conn.Write(append(buf, msg...))
+	return err
+}
+
+// readNoise reads a handshake message sent by writeNoise
+func readNoise(conn net.Conn) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(conn, size[:]); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoiseHandshake, err)
+	}
+	return msg, nil
+}
@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection; unlike
+// net.Pipe, both ends can write before the other reads, as handshakes do
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	dialed.SetDeadline(deadline)
+	conn.SetDeadline(deadline)
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+// corruptWrite flips a bit in the nth write on a connection
+type corruptWrite struct {
+	net.Conn
+	n int
+}
+
+func (c *corruptWrite) Write(p []byte) (int, error) {
+	if c.n--; c.n == 0 {
+		p = bytes.Clone(p)
+		p[len(p)-1] ^= 1
+	}
+	return c.Conn.Write(p)
+}
+
+type handshakeResult struct {
+	cipher *sessionCipher
+	err    error
+}
+
+// handshakePair runs a handshake on both ends of a connection
+func handshakePair(dialer, acceptor net.Conn, handshake func(conn net.Conn, dialer bool) (*sessionCipher, error)) (handshakeResult, handshakeResult) {
+	done := make(chan handshakeResult, 1)
+	go func() {
+		c, err := handshake(acceptor, false)
+		if err != nil {
+			// Don't leave the dialer waiting for the rest of the handshake
+			acceptor.Close()
+		}
+		done <- handshakeResult{c, err}
+	}()
+	c, err := handshake(dialer, true)
+	if err != nil {
+		dialer.Close()
+	}
+	return handshakeResult{c, err}, <-done
+}
+
+// checkCiphers checks that two session ciphers open what the other seals,
+// once and in order
+func checkCiphers(t *testing.T, a, b *sessionCipher) {
+	t.Helper()
+	for i, msg := range []string{"first", "second"} {
+		sealed := a.seal([]byte(msg))
+		got, err := b.open(sealed)
+		if err != nil || string(got) != msg {
+			t.Fatalf("message %d: %q, %v", i, got, err)
+		}
+		if _, err := b.open(sealed); !errors.Is(err, errMessageAuth) {
+			t.Fatalf("replayed message %d: %v, want errMessageAuth", i, err)
+		}
+	}
+	if got, err := a.open(b.seal([]byte("reply"))); err != nil || string(got) != "reply" {
+		t.Fatalf("reply: %q, %v", got, err)
+	}
+}
+
+func noiseKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	a, b := noiseKey(t), noiseKey(t)
+	c1, c2 := tcpPair(t)
+	dialer, acceptor := handshakePair(c1, c2, func(conn net.Conn, dialing bool) (*sessionCipher, error) {
+		if dialing {
+			return noiseHandshake(a, conn, true)
+		}
+		return noiseHandshake(b, conn, false)
+	})
+	if dialer.err != nil || acceptor.err != nil {
+		t.Fatalf("handshake failed: dialer %v, acceptor %v", dialer.err, acceptor.err)
+	}
+	checkCiphers(t, dialer.cipher, acceptor.cipher)
+}
+
+// TestNoiseHandshakeTampered checks that a handshake message changed on
+// the way fails the handshake
+func TestNoiseHandshakeTampered(t *testing.T) {
+	tests := []struct {
+		name     string
+		dialer   bool // Whether the dialer's write is corrupted
+		write    int
+		failSide string
+	}{
+		{"responder static key", false, 2, "dialer"},
+		{"initiator static key", true, 3, "acceptor"},
+	}
+	for _, tt := range tests {
+		c1, c2 := tcpPair(t)
+		if tt.dialer {
+			c1 = &corruptWrite{Conn: c1, n: tt.write}
+		} else {
+			c2 = &corruptWrite{Conn: c2, n: tt.write}
+		}
+		a, b := noiseKey(t), noiseKey(t)
+		dialer, acceptor := handshakePair(c1, c2, func(conn net.Conn, dialing bool) (*sessionCipher, error) {
+			if dialing {
+				return noiseHandshake(a, conn, true)
+			}
+			return noiseHandshake(b, conn, false)
+		})
+		failed := dialer.err
+		if tt.failSide == "acceptor" {
+			failed = acceptor.err
+		}
+		if !errors.Is(failed, ErrNoiseHandshake) {
+			t.Errorf("%s tampered: %s got %v, want ErrNoiseHandshake", tt.name, tt.failSide, failed)
+		}
+	}
+}
+
+func TestNoiseHandshakeRefused(t *testing.T) {
+	hello := append([]byte(noiseMagic), noiseVersion)
+	tests := []struct {
+		name string
+		send func(conn net.Conn)
+	}{
+		{"plain peer", func(conn net.Conn) { conn.Write([]byte("P2PPLAIN\x01")) }},
+		{"other version", func(conn net.Conn) { conn.Write(append([]byte(noiseMagic), noiseVersion+1)) }},
+		{"truncated hello", func(conn net.Conn) { conn.Write(hello[:4]); conn.Close() }},
+		{"short key", func(conn net.Conn) {
+			conn.Write(hello)
+			writeNoise(conn, make([]byte, 16))
+		}},
+		// An all-zero key makes every Diffie-Hellman result zero
+		{"zero key", func(conn net.Conn) {
+			conn.Write(hello)
+			writeNoise(conn, make([]byte, 32))
+		}},
+	}
+	for _, tt := range tests {
+		c1, c2 := tcpPair(t)
+		go tt.send(c1)
+		if _, err := noiseHandshake(noiseKey(t), c2, false); !errors.Is(err, ErrNoiseHandshake) {
+			t.Errorf("%s: got %v, want ErrNoiseHandshake", tt.name, err)
+		}
+	}
+}
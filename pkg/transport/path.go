@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// pathSeparator joins a remote address and the local address a path to it
+// leaves from, and stripeSeparator adds the number of one of several
+// connections over the same path; neither can appear in a host:port,
+// including IPv6 zones
+const (
+	pathSeparator   = "|"
+	stripeSeparator = "#"
+)
+
+// PathAddr names the path to the peer at addr that leaves from the local IP
+// address local, e.g. one network interface of a multi-homed host
+// Sending to the returned address uses a connection of its own, so a
+// transfer can spread its requests over several paths to the same peer
+func PathAddr(addr, local string) string {
+	if local == "" {
+		return addr
+	}
+	return addr + pathSeparator + local
+}
+
+// StripeAddr names the n-th of several parallel connections to addr, which
+// may be a path address
+// A single TCP stream can't fill a link with a large bandwidth-delay
+// product; requests spread over several connections can
+func StripeAddr(addr string, n int) string {
+	if n == 0 {
+		return addr
+	}
+	return addr + stripeSeparator + strconv.Itoa(n)
+}
+
+// SplitPathAddr returns the remote and local address of a path address
+// made by PathAddr or StripeAddr; local is empty for a plain address
+func SplitPathAddr(addr string) (remote, local string) {
+	addr, _, _ = strings.Cut(addr, stripeSeparator)
+	remote, local, _ = strings.Cut(addr, pathSeparator)
+	return remote, local
+}
+
+// InterfaceAddr resolves a network interface name, such as "eth0", to one
+// of its IP addresses, preferring IPv4; IP addresses are returned unchanged
+func InterfaceAddr(name string) (string, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ip.String(), nil
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", fmt.Errorf("unknown interface %s: %v", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", fmt.Errorf("failed to get addresses of %s: %v", name, err)
+	}
+
+	var fallback string
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			return ipNet.IP.String(), nil
+		}
+		if fallback == "" {
+			fallback = ipNet.IP.String()
+		}
+	}
+	if fallback == "" {
+		return "", fmt.Errorf("interface %s has no usable address", name)
+	}
+	return fallback, nil
+}
+
+// dialPath connects to a plain, path or stripe address
+func dialPath(addr string) (net.Conn, error) {
+	remote, local := SplitPathAddr(addr)
+	d := net.Dialer{Timeout: dialTimeout}
+	if local != "" {
+		ip := net.ParseIP(local)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid local address %q", local)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	return d.Dial("tcp", remote)
+}
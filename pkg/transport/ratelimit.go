@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/ratelimit"
+)
+
+// Limits caps throughput in bytes per second; 0 means unlimited
+type Limits struct {
+	Upload   int64
+	Download int64
+}
+
+// rateLimiter enforces a global cap on all traffic plus optional caps for
+// individual remote peers. A peer's traffic must fit within both, so peer
+// caps can only tighten the global one
+type rateLimiter struct {
+	up   *ratelimit.Limiter
+	down *ratelimit.Limiter
+
+	mu    sync.RWMutex
+	peers map[string]*peerLimiter // Keyed by "host:port" or bare host
+}
+
+// peerLimiter holds the limiters shared by all connections to one peer
+type peerLimiter struct {
+	limits Limits
+	up     *ratelimit.Limiter
+	down   *ratelimit.Limiter
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		up:    ratelimit.New(0, 0),
+		down:  ratelimit.New(0, 0),
+		peers: make(map[string]*peerLimiter),
+	}
+}
+
+// setGlobal replaces the global caps
+func (r *rateLimiter) setGlobal(l Limits) {
+	r.up.SetRate(float64(l.Upload), 0)
+	r.down.SetRate(float64(l.Download), 0)
+}
+
+// global returns the global caps
+func (r *rateLimiter) global() Limits {
+	return Limits{Upload: int64(r.up.Rate()), Download: int64(r.down.Rate())}
+}
+
+// setPeer replaces the caps for a peer; zero Limits removes them
+// key: "host:port" for a single address, or a bare host to cover every
+// connection from that host, including inbound ones from ephemeral ports
+func (r *rateLimiter) setPeer(key string, l Limits) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if l == (Limits{}) {
+		delete(r.peers, key)
+		return
+	}
+	if pl, ok := r.peers[key]; ok {
+		pl.limits = l
+		pl.up.SetRate(float64(l.Upload), 0)
+		pl.down.SetRate(float64(l.Download), 0)
+		return
+	}
+	r.peers[key] = &peerLimiter{
+		limits: l,
+		up:     ratelimit.New(float64(l.Upload), 0),
+		down:   ratelimit.New(float64(l.Download), 0),
+	}
+}
+
+// peerLimits returns a copy of the per-peer caps
+func (r *rateLimiter) peerLimits() map[string]Limits {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	limits := make(map[string]Limits, len(r.peers))
+	for key, pl := range r.peers {
+		limits[key] = pl.limits
+	}
+	return limits
+}
+
+// lookup finds the caps for addr, preferring an exact match over its host
+// All paths to a peer share its caps
+func (r *rateLimiter) lookup(addr string) *peerLimiter {
+	addr, _ = SplitPathAddr(addr)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if pl, ok := r.peers[addr]; ok {
+		return pl
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return r.peers[host]
+	}
+	return nil
+}
+
+// waitUpload blocks until n bytes may be sent to addr
+func (r *rateLimiter) waitUpload(ctx context.Context, addr string, n int) error {
+	if pl := r.lookup(addr); pl != nil {
+		if err := pl.up.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return r.up.WaitN(ctx, n)
+}
+
+// waitDownload blocks until n bytes received from addr may be delivered
+func (r *rateLimiter) waitDownload(ctx context.Context, addr string, n int) error {
+	if pl := r.lookup(addr); pl != nil {
+		if err := pl.down.WaitN(ctx, n); err != nil {
+			return err
+		}
+	}
+	return r.down.WaitN(ctx, n)
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"net"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// SocketOptions tunes the TCP connections of a transport
+// Zero values keep the system defaults
+type SocketOptions struct {
+	KeepAlive   time.Duration // Interval between keepalive probes on idle connections, negative to disable them
+	Nagle       bool          // Clear TCP_NODELAY so the kernel coalesces small writes, trading latency for fewer packets
+	ReadBuffer  int           // Kernel receive buffer size in bytes
+	WriteBuffer int           // Kernel send buffer size in bytes
+}
+
+// WithSocketOptions tunes every TCP connection the transport opens or accepts
+// Bulk transfers over fast, distant links gain from larger buffers, while
+// many small messages gain from the default of sending them immediately
+func WithSocketOptions(o SocketOptions) TCPOption {
+	return func(t *TCPTransport) {
+		t.socket = o
+	}
+}
+
+// SetSocketOptions replaces the socket options; they apply to connections
+// made from now on
+func (t *TCPTransport) SetSocketOptions(o SocketOptions) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.socket = o
+}
+
+// SocketOptions returns the options new connections are tuned with
+func (t *TCPTransport) SocketOptions() SocketOptions {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.socket
+}
+
+// tune applies the socket options to a new connection; failures are
+// logged and leave the system defaults in place
+func (t *TCPTransport) tune(conn net.Conn) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	o := t.SocketOptions()
+
+	var errs []error
+	switch {
+	case o.KeepAlive < 0:
+		errs = append(errs, tc.SetKeepAlive(false))
+	case o.KeepAlive > 0:
+		errs = append(errs, tc.SetKeepAlive(true), tc.SetKeepAlivePeriod(o.KeepAlive))
+	}
+	if o.Nagle {
+		errs = append(errs, tc.SetNoDelay(false))
+	}
+	if o.ReadBuffer > 0 {
+		errs = append(errs, tc.SetReadBuffer(o.ReadBuffer))
+	}
+	if o.WriteBuffer > 0 {
+		errs = append(errs, tc.SetWriteBuffer(o.WriteBuffer))
+	}
+	for _, err := range errs {
+		if err != nil {
+			logging.Errorf(t.logger, "Failed to tune connection to %s: %v", conn.RemoteAddr(), err)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+// A connection between members of a private swarm starts with a handshake
+// before any frame is exchanged:
+//
+//	hello  "P2PSWARM", version uint8, swarm ID [32]byte, nonce [32]byte
+//	proof  HMAC-SHA256 over the role and both nonces [32]byte
+//
+// Both sides send their hello, then a proof that they hold the group key.
+// Session keys for each direction are derived from the group key and the
+// two fresh nonces, and every frame payload is sealed with AES-256-GCM
+// using a per-direction message counter as nonce. Frames are delivered in
+// order, so a replayed, dropped or reordered message fails to open
+const (
+	swarmMagic     = "P2PSWARM"
+	swarmVersion   = 1
+	swarmHelloSize = len(swarmMagic) + 1 + 32 + 32
+	swarmProofSize = sha256.Size
+	minSwarmSecret = 16
+)
+
+// ErrSwarmHandshake is returned when a remote peer fails to prove it
+// belongs to the transport's private swarm
+var ErrSwarmHandshake = errors.New("swarm handshake failed")
+
+// errMessageAuth is returned when a message within a private swarm fails to
+// open, because it was forged, replayed or damaged
+var errMessageAuth = errors.New("failed authentication")
+
+// SwarmKey is the group key shared by the members of a private swarm
+type SwarmKey struct {
+	name   string
+	master []byte
+	id     []byte // Public identifier that tells swarms apart during the handshake
+}
+
+// NewSwarmKey derives the key of the swarm called name from a group secret
+// Swarms with different names don't accept each other even if they share
+// a secret
+// Returns: An error if the secret is shorter than 16 bytes
+func NewSwarmKey(name string, secret []byte) (*SwarmKey, error) {
+	if name == "" {
+		return nil, errors.New("swarm name must not be empty")
+	}
+	if len(secret) < minSwarmSecret {
+		return nil, fmt.Errorf("swarm secret must be at least %d bytes", minSwarmSecret)
+	}
+	k := &SwarmKey{name: name, master: hmacSum(secret, []byte("p2p swarm "+name))}
+	k.id = hmacSum(k.master, []byte("swarm id"))
+	return k, nil
+}
+
+// LoadSwarmKey reads the group secret of the swarm called name from a file
+// Surrounding whitespace is ignored, so the secret may be a line of
+// base64 or hex as well as raw bytes
+func LoadSwarmKey(name, path string) (*SwarmKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read swarm key: %v", err)
+	}
+	return NewSwarmKey(name, bytes.TrimSpace(data))
+}
+
+// Name returns the name of the swarm
+func (k *SwarmKey) Name() string {
+	return k.name
+}
+
+// WithSwarm makes the transport a member of a private swarm: connections
+// are only established with peers holding the same swarm key, and all
+// traffic on them is encrypted
+func WithSwarm(key *SwarmKey) TCPOption {
+	return func(t *TCPTransport) {
+		t.swarm = key
+	}
+}
+
+// handshake authenticates conn as a swarm member and derives the session
+// ciphers; the caller sets a deadline for it
+// dialer: Whether this side initiated the connection
+func (k *SwarmKey) handshake(conn net.Conn, dialer bool) (*sessionCipher, error) {
+	hello := make([]byte, 0, swarmHelloSize)
+	hello = append(hello, swarmMagic...)
+	hello = append(hello, swarmVersion)
+	hello = append(hello, k.id...)
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	hello = append(hello, nonce...)
+	if _, err := conn.Write(hello); err != nil {
+		return nil, err
+	}
+
+	remote := make([]byte, swarmHelloSize)
+	if _, err := io.ReadFull(conn, remote); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSwarmHandshake, err)
+	}
+	switch {
+	case string(remote[:len(swarmMagic)]) != swarmMagic:
+		return nil, fmt.Errorf("%w: peer is not a member of a private swarm", ErrSwarmHandshake)
+	case remote[len(swarmMagic)] != swarmVersion:
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrSwarmHandshake, remote[len(swarmMagic)])
+	case !hmac.Equal(remote[len(swarmMagic)+1:len(swarmMagic)+33], k.id):
+		return nil, fmt.Errorf("%w: peer belongs to a different swarm or holds another key", ErrSwarmHandshake)
+	}
+	remoteNonce := remote[len(swarmMagic)+33:]
+
+	dialNonce, acceptNonce := nonce, remoteNonce
+	if !dialer {
+		dialNonce, acceptNonce = remoteNonce, nonce
+	}
+	proof := func(role string) []byte {
+		return hmacSum(k.master, []byte("proof "+role), dialNonce, acceptNonce)
+	}
+	local, expect := "dialer", "acceptor"
+	if !dialer {
+		local, expect = expect, local
+	}
+
+	if _, err := conn.Write(proof(local)); err != nil {
+		return nil, err
+	}
+	got := make([]byte, swarmProofSize)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSwarmHandshake, err)
+	}
+	if !hmac.Equal(got, proof(expect)) {
+		return nil, fmt.Errorf("%w: peer does not hold the swarm key", ErrSwarmHandshake)
+	}
+
+	sendKey := hmacSum(k.master, []byte("key "+local), dialNonce, acceptNonce)
+	recvKey := hmacSum(k.master, []byte("key "+expect), dialNonce, acceptNonce)
+	return newSessionCipher(sendKey, recvKey)
+}
+
+// hmacSum returns the HMAC-SHA256 of the concatenated parts
+func hmacSum(key []byte, parts ...[]byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return mac.Sum(nil)
+}
+
+// sessionCipher seals and opens the frame payloads of one connection
+type sessionCipher struct {
+	mu      sync.Mutex // Keeps sealing in the order frames are written
+	send    cipher.AEAD
+	sendSeq uint64
+	recv    cipher.AEAD
+	recvSeq uint64
+}
+
+func newSessionCipher(sendKey, recvKey []byte) (*sessionCipher, error) {
+	send, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := newGCM(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionCipher{send: send, recv: recv}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// counterNonce turns a message counter into a GCM nonce
+func counterNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// overhead returns how many bytes seal adds to a payload
+func (s *sessionCipher) overhead() int {
+	return s.send.Overhead()
+}
+
+// seal encrypts the next outgoing payload; caller must hold s.mu until the
+// payload is written so counters and frames stay in step
+func (s *sessionCipher) seal(payload []byte) []byte {
+	sealed := s.send.Seal(nil, counterNonce(s.sendSeq), payload, nil)
+	s.sendSeq++
+	return sealed
+}
+
+// open decrypts the next incoming payload; only the connection's reader
+// goroutine calls it
+func (s *sessionCipher) open(sealed []byte) ([]byte, error) {
+	payload, err := s.recv.Open(nil, counterNonce(s.recvSeq), sealed, nil)
+	if err != nil {
+		return nil, fmt.Errorf("message %d %w", s.recvSeq, errMessageAuth)
+	}
+	s.recvSeq++
+	return payload, nil
+}
@@ -0,0 +1,100 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func swarmKey(t *testing.T, name, secret string) *SwarmKey {
+	t.Helper()
+	k, err := NewSwarmKey(name, []byte(secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestSwarmHandshake(t *testing.T) {
+	k := swarmKey(t, "team", "correct horse battery staple")
+	c1, c2 := tcpPair(t)
+	dialer, acceptor := handshakePair(c1, c2, k.handshake)
+	if dialer.err != nil || acceptor.err != nil {
+		t.Fatalf("handshake failed: dialer %v, acceptor %v", dialer.err, acceptor.err)
+	}
+	checkCiphers(t, dialer.cipher, acceptor.cipher)
+}
+
+func TestSwarmHandshakeOtherKey(t *testing.T) {
+	k := swarmKey(t, "team", "correct horse battery staple")
+	others := map[string]*SwarmKey{
+		"other secret": swarmKey(t, "team", "incorrect horse battery staple"),
+		"other name":   swarmKey(t, "team2", "correct horse battery staple"),
+	}
+	for name, other := range others {
+		c1, c2 := tcpPair(t)
+		dialer, acceptor := handshakePair(c1, c2, func(conn net.Conn, dialing bool) (*sessionCipher, error) {
+			if dialing {
+				return other.handshake(conn, true)
+			}
+			return k.handshake(conn, false)
+		})
+		if !errors.Is(acceptor.err, ErrSwarmHandshake) || dialer.err == nil {
+			t.Errorf("%s: dialer %v, acceptor %v, want both to fail", name, dialer.err, acceptor.err)
+		}
+	}
+
+	if _, err := NewSwarmKey("team", []byte("short")); err == nil {
+		t.Error("short secret accepted")
+	}
+	if _, err := NewSwarmKey("", []byte("correct horse battery staple")); err == nil {
+		t.Error("empty name accepted")
+	}
+}
+
+// TestSwarmHandshakeForged checks that knowing the public swarm ID isn't
+// enough to join: a peer must prove it holds the key, and can't do so by
+// sending back the acceptor's own proof
+func TestSwarmHandshakeForged(t *testing.T) {
+	k := swarmKey(t, "team", "correct horse battery staple")
+	hello := func(conn net.Conn) []byte {
+		msg := append([]byte(swarmMagic), swarmVersion)
+		msg = append(append(msg, k.id...), bytes.Repeat([]byte{7}, 32)...)
+		conn.Write(msg)
+		remote := make([]byte, swarmHelloSize)
+		io.ReadFull(conn, remote)
+		return remote
+	}
+	tests := []struct {
+		name  string
+		prove func(conn net.Conn)
+	}{
+		{"guessed proof", func(conn net.Conn) {
+			hello(conn)
+			conn.Write(make([]byte, swarmProofSize))
+		}},
+		{"reflected proof", func(conn net.Conn) {
+			hello(conn)
+			proof := make([]byte, swarmProofSize)
+			io.ReadFull(conn, proof)
+			conn.Write(proof)
+		}},
+		{"truncated proof", func(conn net.Conn) {
+			hello(conn)
+			conn.Write(make([]byte, swarmProofSize/2))
+			conn.Close()
+		}},
+		{"not a swarm", func(conn net.Conn) {
+			conn.Write(bytes.Repeat([]byte{'x'}, swarmHelloSize))
+		}},
+	}
+	for _, tt := range tests {
+		c1, c2 := tcpPair(t)
+		go tt.prove(c1)
+		if _, err := k.handshake(c2, false); !errors.Is(err, ErrSwarmHandshake) {
+			t.Errorf("%s: got %v, want ErrSwarmHandshake", tt.name, err)
+		}
+	}
+}
@@ -1,41 +1,269 @@
- package transport
+package transport
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
 	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
 )
 
+// handshakeTimeout bounds the handshakes on a new connection
+const handshakeTimeout = 10 * time.Second
+
+// ErrShutdown is returned by operations on a transport that has been shut down
+var ErrShutdown = errors.New("transport is shut down")
+
 // TCPTransport implements the Transport interface using TCP protocol
 // It manages peer connections and message routing in a P2P network
+// All methods are safe for concurrent use
 type TCPTransport struct {
 	listenAddr string          // Address to listen for incoming connections
 	listener   net.Listener    // TCP listener instance
+	accepting  bool            // Set while the listener accepts connections
 	messageCh  chan protocol.Message    // Channel for incoming messages
 	mu         sync.RWMutex    // Mutex for thread-safe operations
-	peers      map[string]net.Conn // Active peer connections
+	peers      map[string]*peerConn // Active peer connections
 	decoder    protocol.Decoder
+	registry   *protocol.Registry // Payload types for codecs chosen per connection
+	codecs     []string        // Codecs offered on dialed connections; see WithCodec
+	maxMessage uint32          // Longest frame accepted, 0 for no limit; see WithMaxMessageSize
+	logger     *log.Logger     // Destination for log output
+	done       chan struct{}   // Closed on shutdown to stop message delivery
+	readers    sync.WaitGroup  // Counts running connection readers
+	closeOnce  sync.Once       // Makes Shutdown idempotent
+	limits     *rateLimiter    // Global and per-peer bandwidth caps
+	ctx        context.Context // Cancelled on shutdown to abort rate limit waits
+	cancel     context.CancelFunc
+	tls        *tls.Config     // Runs connections over TLS, nil for plain TCP
+	noise      *ecdh.PrivateKey // Static key of the Noise handshake, nil to not use Noise
+	swarm      *SwarmKey       // Group key of the private swarm, nil for an open transport
+	identity   *identity       // Key proved on new connections; see SetIdentity
+	dials      *dialQueue      // Bounds concurrent dials, nil for no limit
+	dialing    map[string]*pendingDial // Dials in progress, by address
+	socket     SocketOptions   // Applied to every new connection
+	bans       *banList        // Hosts refused for misbehaving; see WithBanPolicy
+	hello      *protocol.Handshake // ID and features sent in handshakes; see SetHello
+	attempts   *attemptLog     // Recent connection attempts; see Attempts
+}
+
+// peerConn wraps a peer connection with the framing protocol, which also
+// keeps concurrent Send calls to the same peer from interleaving
+type peerConn struct {
+	net.Conn
+	*frameConn
+	ciphers []*sessionCipher // Encrypt frame payloads with Noise or within a private swarm, outermost last
+	peerID  string           // ID the remote peer proved its identity key for, empty without identities
+
+	codecMu sync.RWMutex     // Guards the codec, which an offer may change once the reader runs
+	encoder protocol.Encoder // Codec negotiated for the connection, nil for gob
+	decoder protocol.Decoder
+
+	dialed    bool          // Whether this side initiated the connection
+	typed     atomic.Bool   // The remote end reads typed frames; see protocol.Framing
+	remoteMax atomic.Uint32 // Longest frame the remote end accepts, 0 for no limit
+	version   atomic.Uint32 // Protocol version agreed on, 0 until settled; see protocol.Handshake
+	refusal   atomic.Value  // Error the connection was refused with, once it was
+}
+
+// newPeerConn wraps conn for use by the transport
+// maxFrame: Longest frame payload to accept, 0 for no limit
+func newPeerConn(conn net.Conn, maxFrame uint32) *peerConn {
+	pc := &peerConn{Conn: conn, frameConn: newFrameConn(conn)}
+	pc.maxFrame = maxFrame
+	return pc
+}
+
+// writeMessage sends an encoded message, sealing it with each session cipher
+func (pc *peerConn) writeMessage(payload []byte) error {
+	return pc.writeFrame(frameData, payload)
+}
+
+// writeFrame sends a frame of the given kind, sealing its payload with
+// each session cipher
+// Returns: ErrMessageTooLarge if the remote end wouldn't accept the frame
+func (pc *peerConn) writeFrame(kind byte, payload []byte) error {
+	// Checked before sealing: a frame that isn't sent must not advance
+	// the cipher counters, or the peer can't open any frame after it
+	size := uint64(len(payload))
+	for _, c := range pc.ciphers {
+		size += uint64(c.overhead())
+	}
+	if max := pc.remoteMax.Load(); max > 0 && size > uint64(max) {
+		return fmt.Errorf("%w: %d bytes, the peer accepts up to %d", ErrMessageTooLarge, size, max)
+	}
+	for _, c := range pc.ciphers {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		payload = c.seal(payload)
+	}
+	return pc.WriteFrame(kind, payload)
+}
+
+// readMessage returns the kind and payload of the next frame, opening it
+// with each session cipher
+func (pc *peerConn) readMessage() (byte, []byte, error) {
+	kind, payload, err := pc.ReadFrame()
+	for i := len(pc.ciphers) - 1; i >= 0 && err == nil; i-- {
+		payload, err = pc.ciphers[i].open(payload)
+	}
+	return kind, payload, err
+}
+
+// secure wraps a new connection, first running the TLS, Noise, swarm and
+// identity handshakes the transport is configured for
+// addr: The address dialed, or the remote address of an incoming connection
+// dialer: Whether this side initiated the connection
+func (t *TCPTransport) secure(conn net.Conn, addr string, dialer bool) (*peerConn, error) {
+	t.mu.RLock()
+	ident := t.identity
+	t.mu.RUnlock()
+	if t.tls == nil && t.noise == nil && t.swarm == nil && ident == nil {
+		return newPeerConn(conn, t.maxMessage), nil
+	}
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if t.tls != nil {
+		tc, err := tlsHandshake(t.tls, conn, addr, dialer)
+		if err != nil {
+			return nil, err
+		}
+		conn = tc
+	}
+	pc := newPeerConn(conn, t.maxMessage)
+	if t.noise != nil {
+		c, err := noiseHandshake(t.noise, conn, dialer)
+		if err != nil {
+			return nil, err
+		}
+		pc.ciphers = append(pc.ciphers, c)
+	}
+	if t.swarm != nil {
+		c, err := t.swarm.handshake(conn, dialer)
+		if err != nil {
+			return nil, err
+		}
+		// The swarm cipher goes first, so Noise doesn't take the place of
+		// the swarm's own encryption
+		pc.ciphers = append([]*sessionCipher{c}, pc.ciphers...)
+	}
+	if ident != nil {
+		id, err := ident.handshake(conn, addr, dialer)
+		if err != nil {
+			return nil, err
+		}
+		pc.peerID = id
+	}
+	conn.SetDeadline(time.Time{})
+	return pc, nil
+}
+
+// handshaking reports whether new connections start with a handshake
+func (t *TCPTransport) handshaking() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.tls != nil || t.noise != nil || t.swarm != nil || t.identity != nil
+}
+
+// TCPOption configures optional TCPTransport behaviour
+type TCPOption func(*TCPTransport)
+
+// WithLogger sets the logger the transport writes to instead of the standard logger
+func WithLogger(logger *log.Logger) TCPOption {
+	return func(t *TCPTransport) {
+		t.logger = logger
+	}
+}
+
+// WithDecoder sets the decoder used for incoming messages, e.g. one built
+// with a custom payload registry
+func WithDecoder(decoder protocol.Decoder) TCPOption {
+	return func(t *TCPTransport) {
+		t.decoder = decoder
+	}
+}
+
+// WithRateLimits caps the transport's total upload and download rates
+func WithRateLimits(global Limits) TCPOption {
+	return func(t *TCPTransport) {
+		t.limits.setGlobal(global)
+	}
+}
+
+// WithPeerRateLimits caps the upload and download rates for one peer, in
+// addition to the global caps
+// key: The peer's "host:port", or a bare host to cover all its connections
+func WithPeerRateLimits(key string, l Limits) TCPOption {
+	return func(t *TCPTransport) {
+		t.limits.setPeer(key, l)
+	}
 }
 
 // NewTCPTransport creates and initializes a new TCPTransport instance
-// listenAddr: The address to listen for incoming connections (e.g., "localhost:3000")
+// listenAddr: The address to listen for incoming connections (e.g., "localhost:3000");
+// use port 0 to pick a free port
 // Returns: A configured TCPTransport instance
-func NewTCPTransport(listenAddr string) *TCPTransport {
-	return &TCPTransport{
+func NewTCPTransport(listenAddr string, opts ...TCPOption) *TCPTransport {
+	t := &TCPTransport{
 		listenAddr: listenAddr,
 		messageCh:  make(chan protocol.Message, 1024),
-		peers:      make(map[string]net.Conn),
+		peers:      make(map[string]*peerConn),
+		dialing:    make(map[string]*pendingDial),
 		decoder:    protocol.NewGobDecoder(),
+		registry:   protocol.DefaultRegistry(),
+		maxMessage: DefaultMaxMessageSize,
+		logger:     log.Default(),
+		done:       make(chan struct{}),
+		limits:     newRateLimiter(),
+		bans:       newBanList(),
+		attempts:   newAttemptLog(),
 	}
+	t.ctx, t.cancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(t)
+	}
+	return t
+}
+
+// SetRateLimits replaces the global upload and download caps; connections
+// pick up the new rates immediately
+func (t *TCPTransport) SetRateLimits(global Limits) {
+	t.limits.setGlobal(global)
+}
+
+// RateLimits returns the global upload and download caps
+func (t *TCPTransport) RateLimits() Limits {
+	return t.limits.global()
+}
+
+// SetPeerRateLimits replaces the caps for one peer; zero Limits removes them
+// key: The peer's "host:port", or a bare host to cover all its connections
+func (t *TCPTransport) SetPeerRateLimits(key string, l Limits) {
+	t.limits.setPeer(key, l)
+}
+
+// PeerRateLimits returns the per-peer caps keyed as given to SetPeerRateLimits
+func (t *TCPTransport) PeerRateLimits() map[string]Limits {
+	return t.limits.peerLimits()
 }
 
 // GetListenAddress returns the address this transport is listening on
+// Once listening, this is the actual bound address, so a requested port 0
+// is resolved to the port the OS picked
 func (t *TCPTransport) GetListenAddress() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	return t.listenAddr
 }
 
@@ -46,124 +274,392 @@ func (t *TCPTransport) StartListening() error {
 	if err != nil {
 		return err
 	}
+
+	t.mu.Lock()
 	t.listener = ln
-	
-	go t.handleIncomingConnections()
+	t.listenAddr = ln.Addr().String()
+	t.accepting = true
+	t.mu.Unlock()
+
+	go t.handleIncomingConnections(ln)
 	return nil
 }
 
 // handleIncomingConnections continuously accepts new TCP connections
 // and spawns goroutines to handle each connection
-func (t *TCPTransport) handleIncomingConnections() {
+func (t *TCPTransport) handleIncomingConnections(ln net.Listener) {
+	defer func() {
+		t.mu.Lock()
+		t.accepting = false
+		t.mu.Unlock()
+	}()
+
 	for {
-		conn, err := t.listener.Accept()
+		conn, err := ln.Accept()
 		if err != nil {
-			log.Printf("Connection accept error: %v", err)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logging.Errorf(t.logger, "Connection accept error: %v", err)
+			continue
+		}
+
+		if t.handshaking() {
+			// The handshake waits on the remote peer, so keep it from
+			// holding up the accept loop
+			go t.accept(conn)
 			continue
 		}
-		
-		go t.managePeerConnection(conn)
+		t.accept(conn)
+	}
+}
+
+// accept sets up an incoming connection and starts reading from it
+func (t *TCPTransport) accept(conn net.Conn) {
+	start := time.Now()
+	if host := hostOf(conn.RemoteAddr().String()); t.bans.banned(host) {
+		conn.Close()
+		t.recordAttempt(conn.RemoteAddr().String(), true, start, StageBanned, fmt.Errorf("%s is banned", host))
+		return
 	}
+	t.tune(conn)
+	pc, err := t.secure(conn, conn.RemoteAddr().String(), false)
+	if err != nil {
+		logging.Warnf(t.logger, "Rejected connection from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		t.recordAttempt(conn.RemoteAddr().String(), true, start, StageHandshake, err)
+		t.Report(conn.RemoteAddr().String(), OffenseAuth)
+		return
+	}
+	if !t.addPeer(conn.RemoteAddr().String(), pc) {
+		conn.Close()
+		return
+	}
+	go t.managePeerConnection(conn.RemoteAddr().String(), pc)
+}
+
+// addPeer registers a connection under the given address and accounts
+// for the reader goroutine that will serve it
+// Returns false if the transport has already been shut down
+func (t *TCPTransport) addPeer(addr string, pc *peerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	select {
+	case <-t.done:
+		return false
+	default:
+	}
+	t.peers[addr] = pc
+	t.readers.Add(1)
+	return true
 }
 
 // managePeerConnection handles an individual peer connection
 // It reads messages from the connection and forwards them to the message channel
-func (t *TCPTransport) managePeerConnection(conn net.Conn) {
-	defer conn.Close()
-	
-	log.Printf("New peer connection established from %s", conn.RemoteAddr())
-	
-	t.mu.Lock()
-	t.peers[conn.RemoteAddr().String()] = conn
-	t.mu.Unlock()
+// A panic while reading only closes this connection
+// addr: The key the connection is registered under in the peers map
+func (t *TCPTransport) managePeerConnection(addr string, pc *peerConn) {
+	defer t.readers.Done()
+	defer pc.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			logging.Errorf(t.logger, "Panic reading from %s, closing the connection: %v\n%s", pc.RemoteAddr(), r, debug.Stack())
+		}
+	}()
+
+	logging.Infof(t.logger, "New peer connection established from %s", pc.RemoteAddr())
 
 	defer func() {
 		t.mu.Lock()
-		delete(t.peers, conn.RemoteAddr().String())
+		// Only remove the entry if it still refers to this connection;
+		// a newer connection to the same address may have replaced it
+		if t.peers[addr] == pc {
+			delete(t.peers, addr)
+		}
 		t.mu.Unlock()
 	}()
 
-	msg := &protocol.Message{}
-	for {
-		err := t.decoder.Decode(conn, msg)
+	for first := true; ; first = false {
+		kind, payload, err := pc.readMessage()
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Decode error: %v", err)
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				logging.Errorf(t.logger, "Frame read error from %s: %v", pc.RemoteAddr(), err)
+			}
+			if errors.Is(err, ErrFrameCorrupt) || errors.Is(err, errMessageAuth) {
+				t.Report(pc.RemoteAddr().String(), OffenseMalformed)
+			}
+			return
+		}
+		if offer, ok := parseCodecFrame(payload); ok && first {
+			if err := t.answerCodec(pc, offer); err != nil {
+				logging.Errorf(t.logger, "Codec negotiation with %s failed: %v", pc.RemoteAddr(), err)
+				t.recordAttempt(pc.RemoteAddr().String(), true, time.Now(), StageCodec, err)
+				return
+			}
+			continue
+		}
+		if t.bans.message(hostOf(pc.RemoteAddr().String())) {
+			t.Report(pc.RemoteAddr().String(), OffenseRate)
+		}
+
+		// Holding back delivery stops us reading from the connection,
+		// which throttles the sender through TCP flow control
+		if err := t.limits.waitDownload(t.ctx, addr, len(payload)); err != nil {
+			return
+		}
+
+		typed := kind == frameMessage
+		var msgType uint8
+		if typed {
+			if len(payload) == 0 {
+				logging.Warnf(t.logger, "Empty typed frame from %s", pc.RemoteAddr())
+				t.Report(pc.RemoteAddr().String(), OffenseMalformed)
+				return
+			}
+			msgType, payload = payload[0], payload[1:]
+			if !t.registry.Known(msgType) {
+				// The type tells that there's no point decoding the message
+				logging.Warnf(t.logger, "Ignoring message from %s: %v 0x%x", pc.RemoteAddr(), protocol.ErrUnknownType, msgType)
+				continue
+			}
+		}
+
+		msg := &protocol.Message{}
+		_, decoder := t.codec(pc)
+		if err := decoder.Decode(bytes.NewReader(payload), msg); err != nil {
+			if errors.Is(err, protocol.ErrUnknownType) {
+				// Each message is framed, so skipping one keeps the
+				// connection usable for the types both sides know
+				logging.Warnf(t.logger, "Ignoring message from %s: %v", pc.RemoteAddr(), err)
+				continue
+			}
+			logging.Errorf(t.logger, "Decode error: %v", err)
+			t.Report(pc.RemoteAddr().String(), OffenseMalformed)
+			return
+		}
+
+		if typed && msg.Type != msgType {
+			logging.Warnf(t.logger, "Message from %s of type 0x%x sent in a frame of type 0x%x", pc.RemoteAddr(), msg.Type, msgType)
+			t.Report(pc.RemoteAddr().String(), OffenseMalformed)
+			return
+		}
+		if msg.Type == protocol.MessageTypeFraming {
+			if err := t.handleFraming(pc, msg); err != nil {
+				logging.Errorf(t.logger, "Framing negotiation with %s failed: %v", pc.RemoteAddr(), err)
+				return
+			}
+			continue
+		}
+		if msg.Type == protocol.MessageTypeHandshake {
+			// Delivered on to the peer, which learns the features from it
+			if err := t.handleHandshake(addr, pc, msg); err != nil {
+				return
+			}
+		} else if pc.version.Load() == 0 {
+			if err := t.settleLegacy(addr, pc); err != nil {
+				return
 			}
+		}
+
+		if pc.peerID != "" && msg.From != pc.peerID {
+			// Only the key holder of an ID may send messages under it
+			logging.Warnf(t.logger, "Dropping message from %s (peer %s) claiming to come from %q", pc.RemoteAddr(), pc.peerID, msg.From)
+			t.Report(pc.RemoteAddr().String(), OffenseAuth)
+			continue
+		}
+		msg.FromAddr = pc.RemoteAddr().String()
+		select {
+		case t.messageCh <- *msg:
+		case <-t.done:
 			return
 		}
+	}
+}
+
+// CloseConn closes the connection registered under addr, or whose remote
+// address is addr, e.g. after a message from it could not be handled
+// Returns: false if there is no such connection
+func (t *TCPTransport) CloseConn(addr string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 
-		msg.FromAddr = conn.RemoteAddr().String()
-		t.messageCh <- *msg
+	for key, pc := range t.peers {
+		if key == addr || pc.RemoteAddr().String() == addr {
+			pc.Close()
+			return true
+		}
 	}
+	return false
+}
+
+// Listening reports whether the transport is accepting connections
+func (t *TCPTransport) Listening() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.accepting
+}
+
+// ConnectionCount returns the number of open peer connections
+func (t *TCPTransport) ConnectionCount() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.peers)
+}
+
+// Connected reports whether there is an open connection to addr
+func (t *TCPTransport) Connected(addr string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.peers[addr]
+	return ok
 }
 
 // ConnectToPeer establishes a connection to a remote peer
-// addr: The address of the remote peer to connect to
+// addr: The address of the remote peer to connect to, or a path to it; see PathAddr
 // Returns an error if the connection fails
 func (t *TCPTransport) ConnectToPeer(addr string) error {
-	log.Printf("Connecting to peer at %s", addr)
-	conn, err := net.Dial("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("dial failed: %v", err)
+	_, err := t.dial(addr)
+	return err
+}
+
+// dial connects to addr, registers the connection and starts reading from it
+// Concurrent dials to the same address share one connection attempt
+// Returns: The new connection or an error if dialing fails
+func (t *TCPTransport) dial(addr string) (*peerConn, error) {
+	t.mu.Lock()
+	if d, ok := t.dialing[addr]; ok {
+		t.mu.Unlock()
+		<-d.done
+		return d.pc, d.err
 	}
+	d := &pendingDial{done: make(chan struct{})}
+	t.dialing[addr] = d
+	t.mu.Unlock()
 
+	d.pc, d.err = t.connect(addr)
 	t.mu.Lock()
-	t.peers[addr] = conn
+	delete(t.dialing, addr)
 	t.mu.Unlock()
+	close(d.done)
+	return d.pc, d.err
+}
 
-	log.Printf("Connected to peer at %s", addr)
-	go t.managePeerConnection(conn)
-	return nil
+// connect performs the work of dial once a dial slot is free, recording
+// how far it got; see Attempts
+func (t *TCPTransport) connect(addr string) (*peerConn, error) {
+	start := time.Now()
+	pc, stage, err := t.connectStages(addr)
+	t.recordAttempt(addr, false, start, stage, err)
+	return pc, err
+}
+
+// connectStages performs the work of connect
+// Returns: The new connection, or the stage that failed and why
+func (t *TCPTransport) connectStages(addr string) (*peerConn, Stage, error) {
+	if err := t.dials.acquire(t.ctx); err != nil {
+		return nil, StageQueue, err
+	}
+	logging.Infof(t.logger, "Connecting to peer at %s", addr)
+	conn, err := dialPath(addr)
+	t.dials.release()
+	if err != nil {
+		return nil, StageDial, fmt.Errorf("dial failed: %w", err)
+	}
+	if host := hostOf(conn.RemoteAddr().String()); t.bans.banned(host) {
+		conn.Close()
+		return nil, StageBanned, fmt.Errorf("%s is banned", host)
+	}
+	t.tune(conn)
+
+	pc, err := t.secure(conn, addr, true)
+	if err != nil {
+		conn.Close()
+		return nil, StageHandshake, err
+	}
+	if t.offersCodec() {
+		if err := t.offerCodec(pc); err != nil {
+			conn.Close()
+			return nil, StageCodec, err
+		}
+	}
+	pc.dialed = true
+	if err := t.announceFraming(pc); err != nil {
+		conn.Close()
+		return nil, StageFraming, err
+	}
+	if err := t.sendHandshake(pc, ""); err != nil {
+		conn.Close()
+		return nil, StageHello, err
+	}
+	if !t.addPeer(addr, pc) {
+		conn.Close()
+		return nil, StageConnected, ErrShutdown
+	}
+
+	logging.Infof(t.logger, "Connected to peer at %s", addr)
+	go t.managePeerConnection(addr, pc)
+	return pc, StageConnected, nil
 }
 
 // GetMessageChannel returns a receive-only channel for consuming messages
+// The channel is closed when the transport shuts down
 func (t *TCPTransport) GetMessageChannel() <-chan protocol.Message {
 	return t.messageCh
 }
 
 // Shutdown gracefully closes all connections and resources
+// Calling Shutdown more than once is safe
 func (t *TCPTransport) Shutdown() error {
-	if t.listener != nil {
-		t.listener.Close()
-	}
+	t.closeOnce.Do(func() {
+		t.cancel()
+		t.mu.Lock()
+		close(t.done)
+		if t.listener != nil {
+			t.listener.Close()
+		}
+		for _, conn := range t.peers {
+			conn.Close()
+		}
+		t.mu.Unlock()
 
-	t.mu.Lock()
-	defer t.mu.Unlock()
-	
-	for _, conn := range t.peers {
-		conn.Close()
-	}
-	
-	close(t.messageCh)
+		// Wait for every reader to stop before closing the message
+		// channel so none of them can send on a closed channel
+		t.readers.Wait()
+		close(t.messageCh)
+	})
 	return nil
 }
 
-// Add this method to TCPTransport
+// Send encodes msg and writes it to the peer at addr, connecting first if
+// there is no active connection to that address
 func (t *TCPTransport) Send(addr string, msg protocol.Message) error {
-	t.mu.Lock()
+	t.mu.RLock()
 	conn, exists := t.peers[addr]
-	t.mu.Unlock()
+	t.mu.RUnlock()
 
 	if !exists {
-		// Connect first
-		if err := t.ConnectToPeer(addr); err != nil {
+		var err error
+		if conn, err = t.dial(addr); err != nil {
 			return fmt.Errorf("failed to connect to peer %s: %v", addr, err)
 		}
-		// Wait a bit for connection to be established
-		time.Sleep(100 * time.Millisecond)
-		
-		// Get the connection
-		t.mu.Lock()
-		conn = t.peers[addr]
-		t.mu.Unlock()
-		
-		if conn == nil {
-			return fmt.Errorf("failed to establish connection with %s", addr)
-		}
+	}
+	if err, ok := conn.refusal.Load().(error); ok {
+		return err
 	}
 
-	encoder := protocol.NewGobEncoder()
-	return encoder.Encode(conn, &msg)
+	var buf bytes.Buffer
+	kind := frameData
+	if conn.typed.Load() {
+		kind = frameMessage
+		buf.WriteByte(msg.Type)
+	}
+	encoder, _ := t.codec(conn)
+	if err := encoder.Encode(&buf, &msg); err != nil {
+		return err
+	}
+	if err := t.limits.waitUpload(t.ctx, addr, buf.Len()); err != nil {
+		return ErrShutdown
+	}
+	return conn.writeFrame(kind, buf.Bytes())
 }
-
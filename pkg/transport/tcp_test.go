@@ -0,0 +1,55 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// cipherPair returns the session ciphers of the two ends of a connection
+func cipherPair(t *testing.T) (*sessionCipher, *sessionCipher) {
+	t.Helper()
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	a, err := newSessionCipher(k1, k2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newSessionCipher(k2, k1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestWriteFrameTooLargeKeepsCipherInStep(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	send, recv := newPeerConn(c1, 0), newPeerConn(c2, 0)
+	a1, b1 := cipherPair(t)
+	a2, b2 := cipherPair(t)
+	send.ciphers = []*sessionCipher{a1, a2}
+	recv.ciphers = []*sessionCipher{b1, b2}
+	send.remoteMax.Store(100)
+
+	overhead := a1.overhead() + a2.overhead()
+	if err := send.writeMessage(make([]byte, 101-overhead)); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("got %v, want ErrMessageTooLarge", err)
+	}
+
+	want := make([]byte, 100-overhead)
+	want[0] = 42
+	errCh := make(chan error, 1)
+	go func() { errCh <- send.writeMessage(want) }()
+	_, got, err := recv.readMessage()
+	if err != nil {
+		t.Fatalf("frame after a refused one: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(want))
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+}
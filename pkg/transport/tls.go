@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+// selfSignedValidity is how long a generated certificate is valid for
+const selfSignedValidity = 10 * 365 * 24 * time.Hour
+
+// TLSOptions configures TLS on the connections of a transport, see LoadTLS
+type TLSOptions struct {
+	CertFile string // PEM certificate presented to other peers
+	KeyFile  string // PEM private key of the certificate
+	// CAFile holds PEM certificates that sign the certificates of trusted
+	// peers; when empty, any certificate is accepted and the peers' identity
+	// rests on the identity handshake, see SetIdentity
+	CAFile string
+	// ClientAuth makes peers that connect present a certificate signed by
+	// one in CAFile
+	ClientAuth bool
+	// SelfSigned generates a self-signed certificate into CertFile and
+	// KeyFile if neither exists yet
+	SelfSigned bool
+}
+
+// WithTLS runs every connection over TLS, before the swarm and identity
+// handshakes; peers must all use TLS or none
+// config supplies the certificate and the verification of the remote
+// peer's; LoadTLS builds one from files
+func WithTLS(config *tls.Config) TCPOption {
+	return func(t *TCPTransport) {
+		t.tls = config
+	}
+}
+
+// LoadTLS builds the TLS configuration for WithTLS from files
+// Returns: The configuration, and whether a self-signed certificate was
+// generated for it
+func LoadTLS(o TLSOptions) (*tls.Config, bool, error) {
+	generated := false
+	if o.SelfSigned && !exists(o.CertFile) && !exists(o.KeyFile) {
+		if err := GenerateCertificate(o.CertFile, o.KeyFile); err != nil {
+			return nil, false, err
+		}
+		generated = true
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+		ClientAuth:   tls.RequestClientCert,
+	}
+	if o.CAFile == "" {
+		if o.ClientAuth {
+			return nil, false, errors.New("client certificate verification needs a CA file")
+		}
+		return config, generated, nil
+	}
+
+	data, err := os.ReadFile(o.CAFile)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read TLS CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, false, fmt.Errorf("%s holds no PEM certificates", o.CAFile)
+	}
+	config.RootCAs = pool
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if o.ClientAuth {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, generated, nil
+}
+
+// GenerateCertificate writes a new self-signed ECDSA certificate for this
+// host and its key to the given files
+func GenerateCertificate(certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname != "" && hostname != "localhost" {
+		tmpl.DNSNames = append(tmpl.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		return fmt.Errorf("failed to save TLS key: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return fmt.Errorf("failed to save TLS certificate: %v", err)
+	}
+	return nil
+}
+
+// tlsHandshake runs the TLS handshake on conn; the caller sets a deadline
+// addr: The address dialed, or the remote address of an incoming connection
+// dialer: Whether this side initiated the connection
+func tlsHandshake(config *tls.Config, conn net.Conn, addr string, dialer bool) (*tls.Conn, error) {
+	var tc *tls.Conn
+	if dialer {
+		config = config.Clone()
+		// Peers are dialed by whatever address they listen on, which the
+		// certificates of peers rarely name, so the chain is checked
+		// without the host name
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if roots == nil {
+				return nil
+			}
+			return verifyChain(cs.PeerCertificates, roots, x509.ExtKeyUsageServerAuth)
+		}
+		remote, _ := SplitPathAddr(addr)
+		if host, _, err := net.SplitHostPort(remote); err == nil && net.ParseIP(host) == nil {
+			config.ServerName = host
+		}
+		tc = tls.Client(conn, config)
+	} else {
+		tc = tls.Server(conn, config)
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tc, nil
+}
+
+// verifyChain checks that certs chain up to one of roots
+func verifyChain(certs []*x509.Certificate, roots *x509.CertPool, usage x509.ExtKeyUsage) error {
+	if len(certs) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	inter := x509.NewCertPool()
+	for _, c := range certs[1:] {
+		inter.AddCert(c)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{Roots: roots, Intermediates: inter, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err
+}
+
+// exists reports whether a file exists at path
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,255 @@
+// Package webui serves a browser dashboard of a running peer: the peers it
+// has seen, the files it shares, its transfers with their progress, and
+// the files other peers share, any of which can be requested with a click
+package webui
+
+import (
+	"context"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+const (
+	historyShown   = 20               // Finished transfers listed on the dashboard
+	requestTimeout = 10 * time.Second // Bounds listing another peer's files
+)
+
+//go:embed index.html
+var page []byte
+
+// UI serves the dashboard of one peer
+// The dashboard is unauthenticated and lets anyone who reaches it make the
+// peer download files, so serve it on a loopback address
+type UI struct {
+	peer   *peer.Peer
+	logger *log.Logger
+	mux    *http.ServeMux
+	ctx    context.Context // Ends the downloads requested through the UI once closed
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	server *http.Server
+	closed bool
+}
+
+// overviewJSON is the state the dashboard polls for
+type overviewJSON struct {
+	ID        string                `json:"id"`
+	Addr      string                `json:"addr"`
+	Peers     []peerJSON            `json:"peers"`
+	Files     []fileJSON            `json:"files"`
+	Transfers []peer.Transfer       `json:"transfers"`
+	History   []peer.TransferRecord `json:"history"` // Most recent last
+}
+
+// peerJSON is a peer as the dashboard lists it
+type peerJSON struct {
+	peer.PeerInfo
+	DialAddr string `json:"dial_addr"` // Address to list and request its files at
+}
+
+// fileJSON is a shared file as the dashboard lists it
+type fileJSON struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Hash     string    `json:"hash,omitempty"` // Content hash in hex, empty until the file is hashed
+}
+
+// requestJSON is the body of POST /api/request
+type requestJSON struct {
+	Peer string `json:"peer"` // Address of the peer to receive from
+	File string `json:"file"`
+}
+
+// New creates the dashboard of p
+// logger: Destination for the dashboard's log output, usually the peer's
+func New(p *peer.Peer, logger *log.Logger) *UI {
+	ctx, cancel := context.WithCancel(context.Background())
+	u := &UI{peer: p, logger: logger, mux: http.NewServeMux(), ctx: ctx, cancel: cancel}
+	u.mux.HandleFunc("/", u.handlePage)
+	u.mux.HandleFunc("/api/overview", u.handleOverview)
+	u.mux.HandleFunc("/api/remote", u.handleRemote)
+	u.mux.HandleFunc("/api/request", u.handleRequest)
+	return u
+}
+
+// ServeHTTP serves the page and the API behind it
+func (u *UI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	u.mux.ServeHTTP(w, r)
+}
+
+// Serve serves the dashboard on ln until Close is called
+func (u *UI) Serve(ln net.Listener) error {
+	server := &http.Server{Handler: u, ReadHeaderTimeout: requestTimeout}
+	u.mu.Lock()
+	u.server = server
+	u.mu.Unlock()
+	err := server.Serve(ln)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// Close stops serving and cancels the downloads requested through the
+// dashboard that are still running
+func (u *UI) Close() error {
+	u.mu.Lock()
+	server := u.server
+	u.closed = true
+	u.mu.Unlock()
+	var err error
+	if server != nil {
+		err = server.Close()
+	}
+	u.cancel()
+	u.wg.Wait()
+	return err
+}
+
+// handlePage serves the dashboard itself
+func (u *UI) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// handleOverview reports the peers, shared files and transfers
+func (u *UI) handleOverview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	files, err := u.peer.SharedFiles()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history := u.peer.History()
+	if len(history) > historyShown {
+		history = history[len(history)-historyShown:]
+	}
+	overview := overviewJSON{
+		ID:        u.peer.ID(),
+		Addr:      u.peer.Addr(),
+		Peers:     []peerJSON{},
+		Files:     filesJSON(files),
+		Transfers: u.peer.ActiveTransfers(),
+		History:   history,
+	}
+	for _, info := range u.peer.Peers() {
+		overview.Peers = append(overview.Peers, peerJSON{PeerInfo: info, DialAddr: info.DialAddr()})
+	}
+	if overview.Transfers == nil {
+		overview.Transfers = []peer.Transfer{}
+	}
+	if overview.History == nil {
+		overview.History = []peer.TransferRecord{}
+	}
+	u.writeJSON(w, overview)
+}
+
+// handleRemote lists the files the peer at the "peer" query parameter
+// shares with this one
+func (u *UI) handleRemote(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addr := r.URL.Query().Get("peer")
+	if addr == "" {
+		http.Error(w, "missing peer", http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), requestTimeout)
+	defer cancel()
+	files, err := u.peer.ListFiles(ctx, addr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	u.writeJSON(w, filesJSON(files))
+}
+
+// handleRequest starts receiving the file named in the body in the
+// background; the dashboard follows it among the transfers
+func (u *UI) handleRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// Other sites can't send JSON to the dashboard without the browser
+	// asking first, unlike form posts
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "requests must be JSON", http.StatusUnsupportedMediaType)
+		return
+	}
+	var req requestJSON
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Peer == "" || req.File == "" {
+		http.Error(w, "a request needs a peer and a file", http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	closed := u.closed
+	if !closed {
+		u.wg.Add(1)
+	}
+	u.mu.Unlock()
+	if closed {
+		http.Error(w, "the web UI is closing", http.StatusServiceUnavailable)
+		return
+	}
+
+	logging.Infof(u.logger, "Receiving %s from %s through the web UI", req.File, req.Peer)
+	go func() {
+		defer u.wg.Done()
+		opts := peer.DownloadOptions{Peers: []string{req.Peer}, Priority: protocol.PriorityNormal}
+		if _, err := u.peer.Download(u.ctx, req.File, opts); err != nil && u.ctx.Err() == nil {
+			logging.Errorf(u.logger, "Receiving %s requested through the web UI failed: %v", req.File, err)
+		}
+	}()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// filesJSON converts a file listing to the form the dashboard shows
+func filesJSON(files []protocol.ListEntry) []fileJSON {
+	out := make([]fileJSON, 0, len(files))
+	for _, f := range files {
+		out = append(out, fileJSON{Name: f.Name, Size: f.Size, Modified: f.ModTime, Hash: hex.EncodeToString(f.Hash)})
+	}
+	return out
+}
+
+// writeJSON writes v as the JSON response
+func (u *UI) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logging.Errorf(u.logger, "Web UI response failed: %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+const (
+	barInterval = 200 * time.Millisecond // Least time between redraws of a transfer's bar
+	barWidth    = 20                     // Characters in a bar
+	barNameMax  = 16                     // Characters of the file name shown beside a bar
+	barLineMax  = 79                     // Characters in a line, so it doesn't wrap on a small terminal
+)
+
+// progressBars draws a live progress bar for each active transfer at the
+// bottom of a terminal; log lines written through it are printed above
+// the bars, which are redrawn below them
+type progressBars struct {
+	mu     sync.Mutex
+	out    *os.File
+	active map[uint64]peer.Progress
+	lines  int // Bar lines drawn at the bottom of the terminal
+}
+
+// newProgressBars draws bars on out, which should be a terminal
+func newProgressBars(out *os.File) *progressBars {
+	return &progressBars{out: out, active: map[uint64]peer.Progress{}}
+}
+
+// isTerminal reports whether f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// update redraws the bars with a progress report; a finished transfer's
+// bar is removed, leaving its outcome to the log
+func (b *progressBars) update(pr peer.Progress) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if pr.Finished {
+		delete(b.active, pr.ID)
+	} else {
+		b.active[pr.ID] = pr
+	}
+	b.clear()
+	b.draw()
+}
+
+// Write prints a log line above the bars
+func (b *progressBars) Write(line []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.clear()
+	n, err := b.out.Write(line)
+	b.draw()
+	return n, err
+}
+
+// clear erases the bars; caller must hold b.mu
+func (b *progressBars) clear() {
+	if b.lines > 0 {
+		fmt.Fprintf(b.out, "\r\x1b[%dA\x1b[J", b.lines)
+		b.lines = 0
+	}
+}
+
+// draw prints a bar for each active transfer, oldest first; caller must
+// hold b.mu
+func (b *progressBars) draw() {
+	ids := make([]uint64, 0, len(b.active))
+	for id := range b.active {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var sb strings.Builder
+	for _, id := range ids {
+		sb.WriteString(formatBar(b.active[id]))
+		sb.WriteByte('\n')
+	}
+	b.out.WriteString(sb.String())
+	b.lines = len(ids)
+}
+
+// formatBar renders one transfer as a line like
+// "↓ big.iso  [=======>     ]  47% 27.0MB/57.2MB 10.6MB/s ETA 3s", with an
+// arrow pointing up for sends
+func formatBar(pr peer.Progress) string {
+	name := pr.FileName
+	if r := []rune(name); len(r) > barNameMax {
+		name = "…" + string(r[len(r)-barNameMax+1:])
+	}
+	arrow := "↓"
+	if pr.Direction == "send" {
+		arrow = "↑"
+	}
+	line := fmt.Sprintf("%s %-*s ", arrow, barNameMax, name)
+
+	if pr.Size > 0 {
+		frac := min(float64(pr.Done)/float64(pr.Size), 1)
+		filled := int(frac * barWidth)
+		bar := strings.Repeat("=", filled)
+		if filled < barWidth {
+			bar += ">" + strings.Repeat(" ", barWidth-filled-1)
+		}
+		line += fmt.Sprintf("[%s] %3.0f%% %s/%s", bar, 100*frac, formatSize(pr.Done), formatSize(pr.Size))
+	} else {
+		line += formatSize(pr.Done)
+	}
+	if pr.Rate > 0 {
+		line += fmt.Sprintf(" %s/s", formatSize(int64(pr.Rate)))
+	}
+	if eta := pr.ETA.Round(time.Second); eta > 0 {
+		line += fmt.Sprintf(" ETA %s", eta)
+	}
+	if r := []rune(line); len(r) > barLineMax {
+		line = string(r[:barLineMax])
+	}
+	return line
+}
+
+// progressHub passes the progress reports of the peer's transfers on to
+// subscribers that come and go, such as the watchers of the gRPC service
+type progressHub struct {
+	mu   sync.Mutex
+	seq  int
+	subs map[int]peer.ProgressFunc
+}
+
+// newProgressHub creates a hub without subscribers
+func newProgressHub() *progressHub {
+	return &progressHub{subs: map[int]peer.ProgressFunc{}}
+}
+
+// publish passes a report on to every subscriber
+func (h *progressHub) publish(pr peer.Progress) {
+	h.mu.Lock()
+	subs := make([]peer.ProgressFunc, 0, len(h.subs))
+	for _, fn := range h.subs {
+		subs = append(subs, fn)
+	}
+	h.mu.Unlock()
+	for _, fn := range subs {
+		fn(pr)
+	}
+}
+
+// tee returns a ProgressFunc passing reports to fn and publishing them; on
+// a nil hub it's fn itself
+func (h *progressHub) tee(fn peer.ProgressFunc) peer.ProgressFunc {
+	if h == nil {
+		return fn
+	}
+	return func(pr peer.Progress) {
+		fn(pr)
+		h.publish(pr)
+	}
+}
+
+// subscribe passes the reports published from now on to fn, until the
+// returned function is called
+func (h *progressHub) subscribe(fn peer.ProgressFunc) (unsubscribe func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	id := h.seq
+	h.subs[id] = fn
+	return func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		delete(h.subs, id)
+	}
+}
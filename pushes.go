@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// runPushes implements the "pushes" subcommand
+// It lists the files other peers offered to push to the running peer, or
+// accepts or refuses one of them
+func runPushes(args []string) {
+	fs := flag.NewFlagSet("pushes", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	accept := fs.Uint64("accept", 0, "ID of the offer to accept")
+	reject := fs.Uint64("reject", 0, "ID of the offer to refuse")
+	fs.Parse(args)
+
+	if *accept != 0 || *reject != 0 {
+		decision := decisionJSON{ID: *accept, Accept: true}
+		if *reject != 0 {
+			decision = decisionJSON{ID: *reject}
+		}
+		if err := controlRequest(*addr, http.MethodPost, "/pushes", decision, nil); err != nil {
+			log.Fatal(err)
+		}
+		if decision.Accept {
+			fmt.Printf("Accepted offer %d\n", decision.ID)
+		} else {
+			fmt.Printf("Refused offer %d\n", decision.ID)
+		}
+		return
+	}
+
+	var list []peer.PendingPush
+	if err := controlRequest(*addr, http.MethodGet, "/pushes", nil, &list); err != nil {
+		log.Fatal(err)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPEER\tFILE\tSIZE\tOFFERED\tEXPIRES")
+	for _, o := range list {
+		expires := "-"
+		if o.Expires != nil {
+			expires = o.Expires.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", o.ID, o.Peer, o.Name, formatSize(o.Size), o.Time.Format("2006-01-02 15:04:05"), expires)
+	}
+	w.Flush()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// runQuarantine implements the "quarantine" subcommand
+// It lists the received files the running peer quarantined, or releases or
+// deletes one of them
+func runQuarantine(args []string) {
+	fs := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	release := fs.String("release", "", "Quarantined file to move to where it would have been saved")
+	to := fs.String("to", "", "Path to release the file to instead")
+	del := fs.String("delete", "", "Quarantined file to delete")
+	fs.Parse(args)
+
+	switch {
+	case *release != "":
+		var res releaseJSON
+		if err := controlRequest(*addr, http.MethodPost, "/quarantine", releaseJSON{File: *release, To: *to}, &res); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Released %s to %s\n", *release, res.To)
+	case *del != "":
+		if err := controlRequest(*addr, http.MethodDelete, "/quarantine?file="+url.QueryEscape(*del), nil, nil); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Deleted %s\n", *del)
+	default:
+		var list []peer.QuarantineEntry
+		if err := controlRequest(*addr, http.MethodGet, "/quarantine", nil, &list); err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "FILE\tRECEIVED AS\tFROM\tSIZE\tREASON\tDETAIL")
+		for _, e := range list {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.File, e.Name, e.Peer, formatSize(e.Size), e.Reason, e.Detail)
+		}
+		w.Flush()
+	}
+}
+
+// typeFilter returns a receive filter accepting files whose detected
+// content type starts with one of types, e.g. "image/" or "application/pdf"
+func typeFilter(types []string) func(name, path string) error {
+	return func(name, path string) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		head := make([]byte, 512)
+		n, err := io.ReadFull(f, head)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return err
+		}
+		contentType := http.DetectContentType(head[:n])
+		for _, t := range types {
+			if strings.HasPrefix(contentType, strings.TrimSpace(t)) {
+				return nil
+			}
+		}
+		return fmt.Errorf("content type %s is not accepted", contentType)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"text/tabwriter"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// runReceipts implements the "receipts" subcommand
+// It lists the receipts other peers signed for files the running peer sent
+func runReceipts(args []string) {
+	fs := flag.NewFlagSet("receipts", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	asJSON := fs.Bool("json", false, "Print the signed receipts as JSON, e.g. to hand to an auditor")
+	fs.Parse(args)
+
+	var receipts []protocol.Receipt
+	if err := controlRequest(*addr, http.MethodGet, "/receipts", nil, &receipts); err != nil {
+		log.Fatal(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(receipts)
+		return
+	}
+	if len(receipts) == 0 {
+		fmt.Println("No receipts")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tRECEIVER\tFILE\tDELIVERED\tSIZE\tSHA-256")
+	for _, r := range receipts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%.8x\n", r.Time.Local().Format("2006-01-02 15:04:05"), r.Receiver, r.File,
+			formatSize(r.Bytes), formatSize(r.Size), r.Hash)
+	}
+	w.Flush()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/protocol"
+)
+
+// shellTimeout bounds the shell commands that only ask a peer something
+const shellTimeout = 30 * time.Second
+
+// shellHistory is how many finished transfers the status command shows
+const shellHistory = 10
+
+const shellHelp = `Commands:
+  connect <peer>        Connect to a peer and make it the default for ls and get
+  ls [peer]             List the files a peer shares
+  get <file> [peer]     Receive a file into the received directory
+  send <peer> <file>    Offer a shared file to a peer, which saves it if its push policy allows
+  peers                 List the peers seen so far
+  status                Show this peer, its active transfers and recent history
+  help                  Show this help
+  quit                  Shut the peer down
+A peer is an address, or an ID seen before or on the local network with -mdns.
+Quote names holding spaces with double quotes.`
+
+// shell is the interactive mode started with -shell
+type shell struct {
+	p       *peer.Peer
+	out     io.Writer
+	current string // Address given to the last connect, the default peer
+}
+
+// runShell reads commands from in and runs them one at a time until in is
+// closed or quit is given; the peer keeps serving other peers meanwhile
+func runShell(p *peer.Peer, in io.Reader, out io.Writer) {
+	sh := &shell{p: p, out: out}
+	fmt.Fprintln(out, `Type "help" for the commands.`)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(out, "p2p> ")
+		if !scanner.Scan() {
+			fmt.Fprintln(out)
+			return
+		}
+		args, err := shellFields(scanner.Text())
+		if err != nil {
+			fmt.Fprintf(out, "Error: %v\n", err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return
+		}
+		if err := sh.run(args[0], args[1:]); err != nil {
+			fmt.Fprintf(out, "Error: %v\n", err)
+		}
+	}
+}
+
+// run runs one command
+func (sh *shell) run(command string, args []string) error {
+	switch command {
+	case "help":
+		fmt.Fprintln(sh.out, shellHelp)
+		return nil
+	case "connect":
+		if len(args) != 1 {
+			return errors.New("usage: connect <peer>")
+		}
+		addr, err := sh.resolve(args[0])
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shellTimeout)
+		defer cancel()
+		features, err := sh.p.PeerFeatures(ctx, addr)
+		if err != nil {
+			return err
+		}
+		sh.current = addr
+		fmt.Fprintf(sh.out, "Connected to %s, which supports: %s\n", addr, strings.Join(features, ", "))
+		return nil
+	case "ls":
+		if len(args) > 1 {
+			return errors.New("usage: ls [peer]")
+		}
+		addr, err := sh.peerArg(args, 0)
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shellTimeout)
+		defer cancel()
+		listed := 0
+		return sh.p.ListPages(ctx, addr, "", func(files []protocol.ListEntry, next string) error {
+			printListing(files, listed == 0)
+			listed += len(files)
+			return nil
+		})
+	case "get":
+		if len(args) < 1 || len(args) > 2 {
+			return errors.New("usage: get <file> [peer]")
+		}
+		addr, err := sh.peerArg(args, 1)
+		if err != nil {
+			return err
+		}
+		saved, err := sh.p.Download(context.Background(), args[0], peer.DownloadOptions{Peers: []string{addr}})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "Saved %s\n", saved)
+		return nil
+	case "send":
+		if len(args) != 2 {
+			return errors.New("usage: send <peer> <file>")
+		}
+		addr, err := sh.resolve(args[0])
+		if err != nil {
+			return err
+		}
+		if err := sh.p.PushFile(context.Background(), addr, args[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "Sent %s to %s\n", args[1], addr)
+		return nil
+	case "peers":
+		printPeers(sh.p.Peers())
+		return nil
+	case "status":
+		fmt.Fprintf(sh.out, "Peer %s on %s\nShared directory: %s\nReceived directory: %s\n", sh.p.ID(), sh.p.Addr(), sh.p.SharedDir(), sh.p.ReceivedDir())
+		if sh.current != "" {
+			fmt.Fprintf(sh.out, "Connected to: %s\n", sh.current)
+		}
+		fmt.Fprintln(sh.out)
+		history := sh.p.History()
+		if len(history) > shellHistory {
+			history = history[len(history)-shellHistory:]
+		}
+		printTransfers(sh.out, transfersJSON{Active: sh.p.ActiveTransfers(), History: history})
+		return nil
+	default:
+		return fmt.Errorf("unknown command %q, see help", command)
+	}
+}
+
+// peerArg returns the address of the peer named by args[i], or of the
+// connected peer if there is no such argument
+func (sh *shell) peerArg(args []string, i int) (string, error) {
+	if i < len(args) {
+		return sh.resolve(args[i])
+	}
+	if sh.current == "" {
+		return "", errors.New("no peer given, and not connected to one")
+	}
+	return sh.current, nil
+}
+
+// resolve turns a peer given by ID into its address; anything holding a
+// ":" is taken to be an address already
+func (sh *shell) resolve(name string) (string, error) {
+	if strings.Contains(name, ":") {
+		return name, nil
+	}
+	for _, info := range sh.p.Peers() {
+		if info.ID == name && info.DialAddr() != "" {
+			return info.DialAddr(), nil
+		}
+	}
+	return discoverPeers(sh.p, name)
+}
+
+// shellFields splits a command line into words at spaces, keeping the
+// spaces inside double quotes
+func shellFields(line string) ([]string, error) {
+	var fields []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (r == ' ' || r == '\t'):
+			if inWord {
+				fields = append(fields, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		fields = append(fields, word.String())
+	}
+	return fields, nil
+}
+
+// stdinShell runs the shell on the terminal, then asks the peer to shut
+// down through sigCh
+func stdinShell(p *peer.Peer, sigCh chan<- os.Signal) {
+	runShell(p, os.Stdin, os.Stdout)
+	sigCh <- os.Interrupt
+}
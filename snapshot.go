@@ -0,0 +1,278 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/pkg/config"
+)
+
+// snapshotVersion is the version of the snapshot archive format
+const snapshotVersion = 1
+
+// snapshotManifest is the first entry of a snapshot archive, describing
+// the files after it
+type snapshotManifest struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	ID      string         `json:"id,omitempty"` // -id of the peer, empty if it derives its ID from its key
+	Files   []snapshotFile `json:"files"`
+}
+
+// snapshotFile is a file of the peer kept in a snapshot
+type snapshotFile struct {
+	Role string      `json:"role"` // Flag the file is given with, e.g. "state"
+	Name string      `json:"name"` // Base name the file is stored and restored under
+	Mode os.FileMode `json:"mode"`
+}
+
+// runSnapshot implements the "snapshot" subcommand
+// "snapshot export -o FILE" writes the peer's identity keys, certificates,
+// state (peer store, pinned keys, transfer history), content index and
+// config file to one archive; "snapshot import FILE" restores them, e.g.
+// on new hardware or after losing the disk
+func runSnapshot(args []string) {
+	if len(args) == 0 {
+		log.Fatal("usage: snapshot export -o FILE | snapshot import FILE")
+	}
+	fs := flag.NewFlagSet("snapshot "+args[0], flag.ExitOnError)
+
+	switch args[0] {
+	case "export":
+		out := fs.String("o", "", "Archive to write, e.g. peer1.snapshot.tar.gz")
+		id := fs.String("id", "", "-id the peer runs with, which names its default files")
+		configFile := fs.String("config", "", "Config file the peer runs with, kept in the snapshot and read for the paths of its files")
+		paths := map[string]*string{}
+		for _, role := range []string{"state", "index", "key", "noise-key", "tls-cert", "tls-key", "swarm-key"} {
+			paths[role] = fs.String(role, "", "The peer's -"+role+" file, if not the default")
+		}
+		fs.Parse(args[1:])
+		if *out == "" {
+			log.Fatal("usage: snapshot export -o FILE")
+		}
+
+		files := map[string]string{}
+		if *configFile != "" {
+			cfg, err := config.Load(*configFile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			values := configValues(cfg)
+			if *id == "" {
+				*id = values["id"]
+			}
+			for role, path := range paths {
+				if *path == "" {
+					*path = values[role]
+				}
+			}
+			if *paths["swarm-key"] == "" && values["swarm"] != "" {
+				*paths["swarm-key"] = values["swarm"] + ".key"
+			}
+			files["config"] = *configFile
+		}
+		suffix := ""
+		if *id != "" {
+			suffix = dirSuffix(*id)
+		}
+		defaults := map[string]string{
+			"state":     "state" + suffix + ".json",
+			"index":     "index" + suffix + ".json",
+			"key":       "key" + suffix + ".pem",
+			"noise-key": "noise" + suffix + ".key",
+			"tls-cert":  "tls" + suffix + ".crt",
+			"tls-key":   "tls" + suffix + ".key",
+		}
+		for role, path := range paths {
+			if *path != "" {
+				files[role] = *path
+			} else if def, ok := defaults[role]; ok {
+				files[role] = filepath.Join(".", def)
+			}
+		}
+
+		m, err := exportSnapshot(*out, *id, files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, f := range m.Files {
+			fmt.Printf("%-10s %s\n", f.Role, files[f.Role])
+		}
+		fmt.Printf("Wrote %d files to %s\n", len(m.Files), *out)
+	case "import":
+		dir := fs.String("dir", ".", "Directory to restore the files into")
+		force := fs.Bool("force", false, "Overwrite files that already exist")
+		fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			log.Fatal("usage: snapshot import [-dir DIR] [-force] FILE")
+		}
+		m, err := importSnapshot(fs.Arg(0), *dir, *force)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, f := range m.Files {
+			fmt.Printf("%-10s %s\n", f.Role, filepath.Join(*dir, f.Name))
+		}
+		fmt.Printf("Restored %d files from the snapshot of %s\n", len(m.Files), m.Created.Format("2006-01-02 15:04:05"))
+		if m.ID != "" {
+			fmt.Printf("Start the peer with -id %s\n", m.ID)
+		}
+	default:
+		log.Fatalf("unknown snapshot command %q", args[0])
+	}
+}
+
+// exportSnapshot writes the files that exist among files, by role, to a
+// gzipped tar archive at out
+func exportSnapshot(out, id string, files map[string]string) (*snapshotManifest, error) {
+	m := &snapshotManifest{Version: snapshotVersion, Created: time.Now().UTC(), ID: id}
+	names := map[string]bool{}
+	for _, role := range snapshotRoles {
+		path, ok := files[role]
+		if !ok {
+			continue
+		}
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		name := filepath.Base(path)
+		if names[name] {
+			return nil, fmt.Errorf("two files of the peer are named %s", name)
+		}
+		names[name] = true
+		m.Files = append(m.Files, snapshotFile{Role: role, Name: name, Mode: info.Mode().Perm()})
+	}
+	if len(m.Files) == 0 {
+		return nil, errors.New("none of the peer's files exist here; pass -id or the paths of its files")
+	}
+
+	f, err := os.OpenFile(out, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarFile(tw, "snapshot.json", 0644, data); err != nil {
+		return nil, err
+	}
+	for _, sf := range m.Files {
+		data, err := os.ReadFile(files[sf.Role])
+		if err != nil {
+			return nil, err
+		}
+		if err := writeTarFile(tw, sf.Name, sf.Mode, data); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return m, f.Close()
+}
+
+// snapshotRoles are the files a snapshot may hold, in archive order
+var snapshotRoles = []string{"config", "key", "noise-key", "tls-cert", "tls-key", "swarm-key", "state", "index"}
+
+func writeTarFile(tw *tar.Writer, name string, mode os.FileMode, data []byte) error {
+	hdr := &tar.Header{Name: name, Mode: int64(mode), Size: int64(len(data)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// importSnapshot restores the files of a snapshot archive into dir
+// Nothing is written unless the whole archive reads back as expected
+func importSnapshot(path, dir string, force bool) (*snapshotManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a snapshot: %v", path, err)
+	}
+	tr := tar.NewReader(zr)
+
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "snapshot.json" {
+		return nil, fmt.Errorf("%s is not a snapshot", path)
+	}
+	var m snapshotManifest
+	if err := json.NewDecoder(tr).Decode(&m); err != nil {
+		return nil, fmt.Errorf("invalid snapshot manifest: %v", err)
+	}
+	if m.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", m.Version)
+	}
+
+	expect := map[string]snapshotFile{}
+	for _, sf := range m.Files {
+		if sf.Name != filepath.Base(sf.Name) || sf.Name == "." || sf.Name == ".." {
+			return nil, fmt.Errorf("invalid file name %q in snapshot", sf.Name)
+		}
+		expect[sf.Name] = sf
+		if _, err := os.Stat(filepath.Join(dir, sf.Name)); err == nil && !force {
+			return nil, fmt.Errorf("%s already exists; pass -force to overwrite it", filepath.Join(dir, sf.Name))
+		}
+	}
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %v", err)
+		}
+		if _, ok := expect[hdr.Name]; !ok {
+			return nil, fmt.Errorf("unexpected file %q in snapshot", hdr.Name)
+		}
+		if contents[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return nil, fmt.Errorf("failed to read snapshot: %v", err)
+		}
+	}
+	for name := range expect {
+		if _, ok := contents[name]; !ok {
+			return nil, fmt.Errorf("snapshot is missing %s", name)
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, sf := range m.Files {
+		target := filepath.Join(dir, sf.Name)
+		tmp := target + ".tmp"
+		if err := os.WriteFile(tmp, contents[sf.Name], sf.Mode.Perm()); err != nil {
+			return nil, err
+		}
+		if err := os.Rename(tmp, target); err != nil {
+			return nil, err
+		}
+	}
+	return &m, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+)
+
+// runTracker implements the "tracker" subcommand
+// It lists the peers registered with a running tracker and their files
+func runTracker(args []string) {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running tracker")
+	files := fs.Bool("files", false, "List the files of every peer")
+	fs.Parse(args)
+
+	var peers []peer.TrackedPeer
+	if err := controlRequest(*addr, http.MethodGet, "/tracker", nil, &peers); err != nil {
+		log.Fatal(err)
+	}
+	if len(peers) == 0 {
+		fmt.Println("No peers registered")
+		return
+	}
+	for _, tp := range peers {
+		fmt.Printf("%-20s %-24s %d files, announced %s ago\n", tp.ID, tp.Addr, len(tp.Files), time.Since(tp.Announced).Round(time.Second))
+		if *files {
+			for _, f := range tp.Files {
+				fmt.Printf("    %s (%s)\n", f.Name, formatSize(f.Size))
+			}
+		}
+	}
+}
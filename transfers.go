@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"joeyyy09/P2P-FileTransfer-Go/peer"
+	"joeyyy09/P2P-FileTransfer-Go/pkg/logging"
+)
+
+// runTransfers implements the "transfers" subcommand
+// It prints the running peer's active transfers with progress and speed,
+// followed by its most recent finished transfers
+func runTransfers(args []string) {
+	fs := flag.NewFlagSet("transfers", flag.ExitOnError)
+	addr := fs.String("control", "localhost:9000", "Control API address of the running peer")
+	history := fs.Int("history", 20, "Number of recent finished transfers to show")
+	asJSON := fs.Bool("json", false, "Print JSON instead of tables")
+	watch := fs.Duration("watch", 0, "Refresh at this interval until interrupted, e.g. 2s")
+	fs.Parse(args)
+
+	for {
+		var t transfersJSON
+		if err := controlRequest(*addr, http.MethodGet, "/transfers?history="+strconv.Itoa(*history), nil, &t); err != nil {
+			log.Fatal(err)
+		}
+		if *watch > 0 && !*asJSON {
+			fmt.Print("\033[H\033[2J") // Clear the screen like top
+		}
+		if *asJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.Encode(t)
+		} else {
+			printTransfers(os.Stdout, t)
+		}
+		if *watch <= 0 {
+			return
+		}
+		time.Sleep(*watch)
+	}
+}
+
+// printTransfers renders active and recent transfers as tables
+func printTransfers(out io.Writer, t transfersJSON) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDIR\tFILE\tPEER\tPROGRESS\tSPEED\tELAPSED")
+	for _, a := range t.Active {
+		progress := formatSize(a.Done)
+		if a.Size > 0 {
+			progress = fmt.Sprintf("%s/%s %3.0f%%", formatSize(a.Done), formatSize(a.Size), 100*float64(a.Done)/float64(a.Size))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s/s\t%s\n", a.ID, a.Direction, a.FileName, a.Peer,
+			progress, formatSize(int64(a.Rate)), time.Since(a.Started).Round(time.Second))
+	}
+	if len(t.Active) == 0 {
+		fmt.Fprintln(w, "-\t\tno active transfers")
+	}
+	w.Flush()
+
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "FINISHED\tDIR\tFILE\tPEER\tSIZE\tDURATION\tRESULT")
+	for i := len(t.History) - 1; i >= 0; i-- {
+		h := t.History[i]
+		result := "ok"
+		if h.Error != "" {
+			result = h.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", h.Finished.Local().Format("2006-01-02 15:04:05"),
+			h.Direction, h.FileName, h.Peer, formatSize(h.Size), h.Finished.Sub(h.Started).Round(time.Millisecond), result)
+	}
+	w.Flush()
+}
+
+// logProgress logs a progress report of a transfer, see the -progress flag
+func logProgress(pr peer.Progress) {
+	name := fmt.Sprintf("Transfer %d (%s %s, %s)", pr.ID, pr.Direction, pr.FileName, pr.Peer)
+	if pr.Finished {
+		if pr.Err != nil {
+			logging.Errorf(log.Default(), "%s failed after %s: %v", name, formatSize(pr.Done), pr.Err)
+		} else {
+			logging.Infof(log.Default(), "%s finished: %s in %s", name, formatSize(pr.Done), time.Since(pr.Started).Round(time.Millisecond))
+		}
+		return
+	}
+	progress := formatSize(pr.Done)
+	if pr.Size > 0 {
+		progress = fmt.Sprintf("%s/%s %.0f%%", formatSize(pr.Done), formatSize(pr.Size), 100*float64(pr.Done)/float64(pr.Size))
+	}
+	if pr.Rate > 0 {
+		progress += fmt.Sprintf(" at %s/s", formatSize(int64(pr.Rate)))
+	}
+	if pr.ETA > 0 {
+		progress += fmt.Sprintf(", %s left", pr.ETA.Round(time.Second))
+	}
+	logging.Infof(log.Default(), "%s: %s", name, progress)
+}